@@ -18,9 +18,14 @@
 package umoci
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestCreateExistingFails(t *testing.T) {
@@ -40,10 +45,12 @@ func TestCreateExistingFails(t *testing.T) {
 	os.RemoveAll(dir)
 
 	// create should work
-	_, err = CreateLayout(dir)
+	engineExt, err := CreateLayout(dir)
 	if err != nil {
 		t.Fatal(err)
 	}
+	// The engine must be closed before the image can be opened again.
+	engineExt.Close()
 
 	// but not twice
 	_, err = CreateLayout(dir)
@@ -57,3 +64,104 @@ func TestCreateExistingFails(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestNewImageNoClobber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci_testNewImageNoClobber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := NewImageWithOptions(engineExt, "latest", NewImageOptions{NoClobber: true}); err != nil {
+		t.Fatalf("new image: %+v", err)
+	}
+	old, err := engineExt.ResolveReference(context.Background(), "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 1 {
+		t.Fatalf("expected one reference, got %d", len(old))
+	}
+
+	// --no-clobber must not touch the existing tag.
+	if err := NewImageWithOptions(engineExt, "latest", NewImageOptions{NoClobber: true}); err == nil {
+		t.Fatal("new image with noClobber replaced an existing tag")
+	}
+	cur, err := engineExt.ResolveReference(context.Background(), "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cur) != 1 || cur[0].Descriptor().Digest != old[0].Descriptor().Digest {
+		t.Errorf("existing tag was modified: %v != %v", cur, old)
+	}
+
+	// Without noClobber the tag is replaced.
+	if err := NewImage(engineExt, "latest"); err != nil {
+		t.Fatalf("new image (clobber): %+v", err)
+	}
+	cur, err = engineExt.ResolveReference(context.Background(), "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cur) != 1 {
+		t.Errorf("expected one reference after replacing, got %d", len(cur))
+	}
+}
+
+func TestNewImageCreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci_testNewImageCreated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engineExt, err := CreateLayout(filepath.Join(dir, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	created := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tag := range []string{"a", "b"} {
+		if err := NewImageWithOptions(engineExt, tag, NewImageOptions{Created: &created}); err != nil {
+			t.Fatalf("new image %s: %+v", tag, err)
+		}
+	}
+
+	// The same creation time must result in an identical image.
+	var digests []string
+	for _, tag := range []string{"a", "b"} {
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(descriptorPaths) != 1 {
+			t.Fatalf("expected one reference for %s, got %d", tag, len(descriptorPaths))
+		}
+		digests = append(digests, string(descriptorPaths[0].Descriptor().Digest))
+
+		manifestBlob, err := engineExt.FromDescriptor(context.Background(), descriptorPaths[0].Descriptor())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer manifestBlob.Close()
+		configBlob, err := engineExt.FromDescriptor(context.Background(), manifestBlob.Data.(ispec.Manifest).Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer configBlob.Close()
+		config := configBlob.Data.(ispec.Image)
+		if config.Created == nil || !config.Created.Equal(created) {
+			t.Errorf("%s: expected created %v, got %v", tag, created, config.Created)
+		}
+	}
+	if digests[0] != digests[1] {
+		t.Errorf("images with the same creation time differ: %s != %s", digests[0], digests[1])
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var applyDeltaCommand = uxHistory(cli.Command{
+	Name:  "apply-delta",
+	Usage: "applies a delta layer generated by umoci-delta(1) to an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--output <new-tag>] <patch.tar>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to apply the delta to (if not specified, defaults to "latest"),
+"<new-tag>" is the tag the resulting image will be stored as (if not
+specified, defaults to "<tag>") and "<patch.tar>" is the delta layer (as
+generated by umoci-delta(1)), which may be gzip-compressed.
+
+If --expect is specified, the ChainID of the top-most layer of the resulting
+image (as output by umoci-stat(1) with --chain-ids) must match the given
+digest, otherwise "<new-tag>" is not modified.`,
+
+	// apply-delta modifies an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "tag name for the resulting image (if not specified, the --image tag is replaced)",
+		},
+		cli.StringFlag{
+			Name:  "expect",
+			Usage: "expected chain id of the top-most layer of the resulting image",
+		},
+	},
+
+	Action: applyDelta,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <patch.tar>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("<patch.tar> path cannot be empty")
+		}
+		ctx.App.Metadata["patch"] = ctx.Args().First()
+
+		if ctx.IsSet("output") {
+			tag := ctx.String("output")
+			if !casext.IsValidReferenceName(tag) {
+				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --output")
+			}
+			if tag == "" {
+				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --output")
+			}
+		}
+		if ctx.IsSet("expect") {
+			if err := digest.Digest(ctx.String("expect")).Validate(); err != nil {
+				return errors.Wrap(err, "invalid --expect")
+			}
+		}
+		return nil
+	},
+})
+
+func applyDelta(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	patchPath := ctx.App.Metadata["patch"].(string)
+
+	// Overide the from tag by default, otherwise use the one specified.
+	tagName := fromName
+	if ctx.IsSet("output") {
+		tagName = ctx.String("output")
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	patch, err := os.Open(patchPath)
+	if err != nil {
+		return errors.Wrap(err, "open delta layer")
+	}
+	defer patch.Close()
+	if fi, err := patch.Stat(); err != nil {
+		return errors.Wrap(err, "stat delta layer")
+	} else if fi.IsDir() {
+		return errors.Errorf("delta layer is a directory")
+	}
+
+	var history *ispec.History
+	if !ctx.Bool("no-history") {
+		created := defaultCreated()
+		history = &ispec.History{
+			Comment:    "",
+			Created:    &created,
+			CreatedBy:  historyCreatedBy(ctx),
+			EmptyLayer: false,
+		}
+
+		if ctx.IsSet("history.author") {
+			history.Author = ctx.String("history.author")
+		}
+		if ctx.IsSet("history.comment") {
+			history.Comment = ctx.String("history.comment")
+		}
+		if ctx.IsSet("history.created") {
+			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --history.created")
+			}
+			history.Created = &created
+		}
+		if ctx.IsSet("history.created_by") {
+			history.CreatedBy = ctx.String("history.created_by")
+		}
+	}
+
+	expect := digest.Digest(ctx.String("expect"))
+	return umoci.ApplyDelta(engineExt, fromName, tagName, patch, history, expect)
+}
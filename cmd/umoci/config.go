@@ -18,12 +18,14 @@
 package main
 
 import (
+	"bufio"
+	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/mutate"
-	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -34,7 +36,7 @@ import (
 
 // FIXME: We should also implement a raw mode that just does modifications of
 //        JSON blobs (allowing this all to be used outside of our build setup).
-var configCommand = uxHistory(uxTag(cli.Command{
+var configCommand = uxConfig(uxHistory(uxTag(cli.Command{
 	Name:  "config",
 	Usage: "modifies the image configuration of an OCI image",
 	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
@@ -56,29 +58,229 @@ image.`,
 		if _, ok := ctx.App.Metadata["--image-tag"]; !ok {
 			return errors.Errorf("missing mandatory argument: --image")
 		}
+		if _, err := parseAnnotations(ctx.StringSlice("manifest.annotation")); err != nil {
+			return errors.Wrap(err, "invalid --manifest.annotation")
+		}
+		if ctx.IsSet("manifest.artifacttype") {
+			if err := mutate.ValidateArtifactType(ctx.String("manifest.artifacttype")); err != nil {
+				return errors.Wrap(err, "invalid --manifest.artifacttype")
+			}
+		}
 		return nil
 	},
 
 	Flags: []cli.Flag{
-		cli.StringFlag{Name: "config.user"},
-		cli.StringSliceFlag{Name: "config.exposedports"},
-		cli.StringSliceFlag{Name: "config.env"},
-		cli.StringSliceFlag{Name: "config.entrypoint"}, // FIXME: This interface is weird.
-		cli.StringSliceFlag{Name: "config.cmd"},        // FIXME: This interface is weird.
-		cli.StringSliceFlag{Name: "config.volume"},
-		cli.StringSliceFlag{Name: "config.label"},
-		cli.StringFlag{Name: "config.workingdir"},
-		cli.StringFlag{Name: "config.stopsignal"},
-		cli.StringFlag{Name: "created"}, // FIXME: Implement TimeFlag.
-		cli.StringFlag{Name: "author"},
-		cli.StringFlag{Name: "architecture"},
-		cli.StringFlag{Name: "os"},
-		cli.StringSliceFlag{Name: "manifest.annotation"},
-		cli.StringSliceFlag{Name: "clear"},
+		cli.StringSliceFlag{
+			Name:  "manifest.annotation",
+			Usage: "name=value annotation to set in the manifest",
+		},
+		cli.StringFlag{
+			Name:  "manifest.artifacttype",
+			Usage: "media type to set as the artifactType field of the manifest",
+		},
+		cli.StringSliceFlag{
+			Name:  "clear",
+			Usage: "remove all pre-existing values of a configuration or manifest field (see umoci-config(1))",
+		},
+		cli.StringSliceFlag{
+			Name:  "scrub-history",
+			Usage: "regular expression whose matches are redacted from the image history (metacharacters in literal secrets must be escaped)",
+		},
 	},
 
 	Action: config,
-}))
+})))
+
+// uxConfig adds the set of flags which modify the image configuration (such as
+// --config.user and --author) to the given cli.Command. They are applied to an
+// image configuration with applyConfigFlags.
+func uxConfig(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "config.user",
+			Usage: "user (and optionally group) the container process runs as",
+		},
+		cli.StringSliceFlag{
+			Name:  "config.exposedports",
+			Usage: "port (in the form port[/protocol]) to add to the set of exposed ports",
+		},
+		cli.StringSliceFlag{
+			Name:  "config.env",
+			Usage: "name=value environment variable to set in the configuration",
+		},
+		cli.StringSliceFlag{
+			Name:  "config.env-file",
+			Usage: "file of name=value environment variables to set in the configuration",
+		},
+		cli.StringSliceFlag{
+			Name:  "config.entrypoint", // FIXME: This interface is weird.
+			Usage: "argument of the entrypoint (replaces the existing entrypoint)",
+		},
+		cli.StringSliceFlag{
+			Name:  "config.cmd", // FIXME: This interface is weird.
+			Usage: "argument of the default command (replaces the existing command)",
+		},
+		cli.StringSliceFlag{
+			Name:  "config.volume",
+			Usage: "path to add to the set of volumes",
+		},
+		cli.StringSliceFlag{
+			Name:  "config.label",
+			Usage: "name=value label to set in the configuration",
+		},
+		cli.StringFlag{
+			Name:  "config.workingdir",
+			Usage: "working directory of the container process",
+		},
+		cli.StringFlag{
+			Name:  "config.stopsignal",
+			Usage: "signal sent to the container process to stop it (such as SIGTERM)",
+		},
+		cli.StringFlag{
+			Name:  "created", // FIXME: Implement TimeFlag.
+			Usage: "creation time of the image (in ISO8601 format)",
+		},
+		cli.StringFlag{
+			Name:  "author",
+			Usage: "author of the image",
+		},
+	}...)
+	return uxPlatform(cmd)
+}
+
+// uxPlatform adds the set of flags which modify the platform of the image
+// configuration (--os, --architecture and --variant) to the given
+// cli.Command. They are applied to the image metadata with
+// applyPlatformFlags.
+func uxPlatform(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.StringFlag{
+			Name:  "os",
+			Usage: "operating system of the image (a GOOS value)",
+		},
+		cli.StringFlag{
+			Name:  "architecture, arch",
+			Usage: "CPU architecture of the image (a GOARCH value)",
+		},
+		cli.StringFlag{
+			Name:  "variant",
+			Usage: "variant of the CPU architecture of the image (such as v7 for arm)",
+		},
+		cli.BoolFlag{
+			Name:  "allow-unknown-arch",
+			Usage: "allow --os, --architecture and --variant values which are not known GOOS, GOARCH and variant values",
+		},
+	}...)
+	return cmd
+}
+
+// applyPlatformFlags applies the modifications specified by the flags added
+// by uxPlatform to the given image metadata. The resulting platform is
+// validated (unless --allow-unknown-arch was specified), and true is returned
+// if any of the flags were set.
+func applyPlatformFlags(ctx *cli.Context, meta *mutate.Meta) (bool, error) {
+	changed := false
+	if ctx.IsSet("os") {
+		meta.OS = ctx.String("os")
+		changed = true
+	}
+	// Aliases are tracked separately by IsSet.
+	if ctx.IsSet("architecture") || ctx.IsSet("arch") {
+		meta.Architecture = ctx.String("architecture")
+		changed = true
+	}
+	if ctx.IsSet("variant") {
+		meta.Variant = ctx.String("variant")
+		changed = true
+	}
+	if changed && !ctx.Bool("allow-unknown-arch") {
+		if err := mutate.ValidatePlatform(ispec.Platform{
+			OS:           meta.OS,
+			Architecture: meta.Architecture,
+			Variant:      meta.Variant,
+		}); err != nil {
+			return false, errors.Wrap(err, "invalid platform (use --allow-unknown-arch to override)")
+		}
+	}
+	return changed, nil
+}
+
+// applyConfigFlags applies the modifications specified by the flags added by
+// uxConfig to the given generator.
+func applyConfigFlags(ctx *cli.Context, g *igen.Generator) error {
+	if ctx.IsSet("created") {
+		// How do we handle other formats?
+		created, err := time.Parse(igen.ISO8601, ctx.String("created"))
+		if err != nil {
+			return errors.Wrap(err, "parse --created")
+		}
+		g.SetCreated(created)
+	}
+	if ctx.IsSet("author") {
+		g.SetAuthor(ctx.String("author"))
+	}
+	if ctx.IsSet("config.user") {
+		g.SetConfigUser(ctx.String("config.user"))
+	}
+	if ctx.IsSet("config.stopsignal") {
+		g.SetConfigStopSignal(ctx.String("config.stopsignal"))
+	}
+	if ctx.IsSet("config.workingdir") {
+		g.SetConfigWorkingDir(ctx.String("config.workingdir"))
+	}
+	if ctx.IsSet("config.exposedports") {
+		for _, port := range ctx.StringSlice("config.exposedports") {
+			g.AddConfigExposedPort(port)
+		}
+	}
+	// Environment files are applied in the order given, and any --config.env
+	// flags are applied afterwards. Because AddConfigEnv replaces existing
+	// entries in-place, the last value for a given name wins while the
+	// ordering of Config.Env is preserved.
+	if ctx.IsSet("config.env-file") {
+		for _, path := range ctx.StringSlice("config.env-file") {
+			env, err := parseEnvFile(path)
+			if err != nil {
+				return errors.Wrap(err, "config.env-file")
+			}
+			for _, kv := range env {
+				g.AddConfigEnv(kv[0], kv[1])
+			}
+		}
+	}
+	if ctx.IsSet("config.env") {
+		for _, env := range ctx.StringSlice("config.env") {
+			name, value, err := parseKV(env)
+			if err != nil {
+				return errors.Wrap(err, "config.env")
+			}
+			g.AddConfigEnv(name, value)
+		}
+	}
+	// FIXME: This interface is weird.
+	if ctx.IsSet("config.entrypoint") {
+		g.SetConfigEntrypoint(ctx.StringSlice("config.entrypoint"))
+	}
+	// FIXME: This interface is weird.
+	if ctx.IsSet("config.cmd") {
+		g.SetConfigCmd(ctx.StringSlice("config.cmd"))
+	}
+	if ctx.IsSet("config.volume") {
+		for _, volume := range ctx.StringSlice("config.volume") {
+			g.AddConfigVolume(volume)
+		}
+	}
+	if ctx.IsSet("config.label") {
+		for _, label := range ctx.StringSlice("config.label") {
+			name, value, err := parseKV(label)
+			if err != nil {
+				return errors.Wrap(err, "config.label")
+			}
+			g.AddConfigLabel(name, value)
+		}
+	}
+	return nil
+}
 
 func toImage(config ispec.ImageConfig, meta mutate.Meta) ispec.Image {
 	created := meta.Created
@@ -104,6 +306,23 @@ func fromImage(image ispec.Image) (ispec.ImageConfig, mutate.Meta) {
 	}
 }
 
+// redactedString is the replacement text used by scrubHistory.
+const redactedString = "[REDACTED]"
+
+// scrubHistory replaces any match of the given patterns in the CreatedBy and
+// Comment fields of each history entry with redactedString. The structure of
+// the history (the number of entries and their EmptyLayer flags) is left
+// untouched so that each entry still corresponds to the same layer.
+func scrubHistory(history []ispec.History, patterns []*regexp.Regexp) []ispec.History {
+	for idx := range history {
+		for _, pattern := range patterns {
+			history[idx].CreatedBy = pattern.ReplaceAllLiteralString(history[idx].CreatedBy, redactedString)
+			history[idx].Comment = pattern.ReplaceAllLiteralString(history[idx].Comment, redactedString)
+		}
+	}
+	return history
+}
+
 // parseKV splits a given string (of the form name=value) into (name,
 // value). An error is returned if there is no "=" in the line or if the
 // name is empty.
@@ -120,6 +339,48 @@ func parseKV(input string) (string, string, error) {
 	return name, value, nil
 }
 
+// parseAnnotations parses a set of name=value annotations (such as the values
+// of --manifest.annotation). If the same name is given more than once, the last value
+// is used.
+func parseAnnotations(values []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, value := range values {
+		name, value, err := parseKV(value)
+		if err != nil {
+			return nil, err
+		}
+		annotations[name] = value
+	}
+	return annotations, nil
+}
+
+// parseEnvFile reads a file containing one name=value environment variable
+// per line (in the same format as docker-run(1)'s --env-file). Empty lines and
+// lines starting with "#" are ignored. The returned entries are in the same
+// order as they appear in the file.
+func parseEnvFile(path string) ([][2]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open env file")
+	}
+	defer fh.Close()
+
+	var env [][2]string
+	scanner := bufio.NewScanner(fh)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, err := parseKV(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, lineNo)
+		}
+		env = append(env, [2]string{name, value})
+	}
+	return env, errors.Wrap(scanner.Err(), "read env file")
+}
+
 func config(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	fromName := ctx.App.Metadata["--image-tag"].(string)
@@ -131,7 +392,7 @@ func config(ctx *cli.Context) error {
 	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -170,24 +431,46 @@ func config(ctx *cli.Context) error {
 		return errors.Wrap(err, "get base annotations")
 	}
 
+	artifactType, err := mutator.ArtifactType(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get base artifact type")
+	}
+
 	g, err := igen.NewFromImage(toImage(imageConfig, imageMeta))
 	if err != nil {
 		return errors.Wrap(err, "create new generator")
 	}
 
+	// The variant isn't handled by igen, so it is tracked separately.
+	variant := imageMeta.Variant
+	clearedVariant := false
+
 	if ctx.IsSet("clear") {
 		for _, key := range ctx.StringSlice("clear") {
 			switch key {
-			case "config.labels":
+			case "config.labels", "config.label":
 				g.ClearConfigLabels()
 			case "manifest.annotations":
 				annotations = nil
+			case "manifest.artifacttype":
+				artifactType = ""
 			case "config.exposedports":
 				g.ClearConfigExposedPorts()
 			case "config.env":
 				g.ClearConfigEnv()
-			case "config.volume":
+			case "config.volume", "config.volumes":
 				g.ClearConfigVolumes()
+			case "config.user":
+				g.SetConfigUser("")
+			case "config.workingdir":
+				g.SetConfigWorkingDir("")
+			case "config.stopsignal":
+				g.SetConfigStopSignal("")
+			case "author":
+				g.SetAuthor("")
+			case "variant":
+				variant = ""
+				clearedVariant = true
 			case "rootfs.diffids":
 				//g.ClearRootfsDiffIDs()
 				return errors.Errorf("--clear=rootfs.diffids is not safe")
@@ -201,86 +484,56 @@ func config(ctx *cli.Context) error {
 		}
 	}
 
-	if ctx.IsSet("created") {
-		// How do we handle other formats?
-		created, err := time.Parse(igen.ISO8601, ctx.String("created"))
-		if err != nil {
-			return errors.Wrap(err, "parse --created")
-		}
-		g.SetCreated(created)
-	}
-	if ctx.IsSet("author") {
-		g.SetAuthor(ctx.String("author"))
-	}
-	if ctx.IsSet("architecture") {
-		g.SetArchitecture(ctx.String("architecture"))
-	}
-	if ctx.IsSet("os") {
-		g.SetOS(ctx.String("os"))
-	}
-	if ctx.IsSet("config.user") {
-		g.SetConfigUser(ctx.String("config.user"))
-	}
-	if ctx.IsSet("config.stopsignal") {
-		g.SetConfigStopSignal(ctx.String("config.stopsignal"))
+	if err := applyConfigFlags(ctx, g); err != nil {
+		return err
 	}
-	if ctx.IsSet("config.workingdir") {
-		g.SetConfigWorkingDir(ctx.String("config.workingdir"))
-	}
-	if ctx.IsSet("config.exposedports") {
-		for _, port := range ctx.StringSlice("config.exposedports") {
-			g.AddConfigExposedPort(port)
+	if ctx.IsSet("manifest.annotation") {
+		if annotations == nil {
+			annotations = map[string]string{}
 		}
-	}
-	if ctx.IsSet("config.env") {
-		for _, env := range ctx.StringSlice("config.env") {
-			name, value, err := parseKV(env)
-			if err != nil {
-				return errors.Wrap(err, "config.env")
-			}
-			g.AddConfigEnv(name, value)
+		// This was already validated in Before.
+		newAnnotations, _ := parseAnnotations(ctx.StringSlice("manifest.annotation"))
+		for name, value := range newAnnotations {
+			annotations[name] = value
 		}
 	}
-	// FIXME: This interface is weird.
-	if ctx.IsSet("config.entrypoint") {
-		g.SetConfigEntrypoint(ctx.StringSlice("config.entrypoint"))
+	if ctx.IsSet("manifest.artifacttype") {
+		artifactType = ctx.String("manifest.artifacttype")
 	}
-	// FIXME: This interface is weird.
-	if ctx.IsSet("config.cmd") {
-		g.SetConfigCmd(ctx.StringSlice("config.cmd"))
+	if err := mutator.SetArtifactType(context.Background(), artifactType); err != nil {
+		return errors.Wrap(err, "set artifact type")
 	}
-	if ctx.IsSet("config.volume") {
-		for _, volume := range ctx.StringSlice("config.volume") {
-			g.AddConfigVolume(volume)
-		}
-	}
-	if ctx.IsSet("config.label") {
-		for _, label := range ctx.StringSlice("config.label") {
-			name, value, err := parseKV(label)
-			if err != nil {
-				return errors.Wrap(err, "config.label")
-			}
-			g.AddConfigLabel(name, value)
+
+	var patterns []*regexp.Regexp
+	for _, expr := range ctx.StringSlice("scrub-history") {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return errors.Wrap(err, "scrub-history")
 		}
+		patterns = append(patterns, pattern)
 	}
-	if ctx.IsSet("manifest.annotation") {
-		if annotations == nil {
-			annotations = map[string]string{}
+	if len(patterns) > 0 {
+		oldHistory, err := mutator.History(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "get image history")
 		}
-		for _, label := range ctx.StringSlice("manifest.annotation") {
-			parts := strings.SplitN(label, "=", 2)
-			annotations[parts[0]] = parts[1]
+		if err := mutator.SetHistory(context.Background(), scrubHistory(oldHistory, patterns)); err != nil {
+			return errors.Wrap(err, "set scrubbed history")
 		}
 	}
 
 	var history *ispec.History
 	if !ctx.Bool("no-history") {
-		created := time.Now()
+		created := defaultCreated()
+		if ctx.IsSet("created") {
+			// This was already validated by applyConfigFlags.
+			created, _ = time.Parse(igen.ISO8601, ctx.String("created"))
+		}
 		history = &ispec.History{
 			Author:     g.Author(),
 			Comment:    "",
 			Created:    &created,
-			CreatedBy:  "umoci config",
+			CreatedBy:  historyCreatedBy(ctx),
 			EmptyLayer: true,
 		}
 
@@ -300,24 +553,47 @@ func config(ctx *cli.Context) error {
 		if ctx.IsSet("history.created_by") {
 			history.CreatedBy = ctx.String("history.created_by")
 		}
+		// The new entry must not re-introduce anything we just scrubbed.
+		*history = scrubHistory([]ispec.History{*history}, patterns)[0]
 	}
 
 	newConfig, newMeta := fromImage(g.Image())
+	newMeta.Variant = variant
+	platformChanged, err := applyPlatformFlags(ctx, &newMeta)
+	if err != nil {
+		return err
+	}
+	platformChanged = platformChanged || clearedVariant
 	if err := mutator.Set(context.Background(), newConfig, newMeta, annotations, history); err != nil {
 		return errors.Wrap(err, "set modified configuration")
 	}
+	// Make sure the platform of the image's index entry is also updated.
+	if platformChanged {
+		if err := mutator.SetPlatform(context.Background(), ispec.Platform{
+			OS:           newMeta.OS,
+			Architecture: newMeta.Architecture,
+			Variant:      newMeta.Variant,
+		}); err != nil {
+			return errors.Wrap(err, "set platform")
+		}
+	}
 
 	newDescriptorPath, err := mutator.Commit(context.Background())
 	if err != nil {
 		return errors.Wrap(err, "commit mutated image")
 	}
 
-	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
 
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return errors.Wrap(err, "add new tag")
 	}
 
-	log.Infof("created new tag for image manifest: %s", tagName)
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
 	return nil
 }
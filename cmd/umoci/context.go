@@ -0,0 +1,62 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	"github.com/apex/log"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// commandContext returns the context for the operations of a command. It is
+// cancelled when umoci receives SIGINT or SIGTERM (so that the command can
+// stop and clean up after itself, rather than being killed halfway through
+// writing to the image) or once the --timeout of the command has elapsed, if
+// the command has that flag. A second signal kills umoci as usual. The
+// returned function must be called once the command is done.
+func commandContext(ctx *cli.Context) (context.Context, context.CancelFunc) {
+	var (
+		cmdCtx context.Context
+		cancel context.CancelFunc
+	)
+	if timeout := ctx.Duration("timeout"); timeout > 0 {
+		cmdCtx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		cmdCtx, cancel = context.WithCancel(context.Background())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGINT, unix.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warnf("received %s: cancelling (send it again to exit immediately)", sig)
+			signal.Stop(signals)
+			cancel()
+		case <-cmdCtx.Done():
+		}
+	}()
+	return cmdCtx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/remote"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var copyCommand = cli.Command{
+	Name:  "copy",
+	Usage: "copies a tag from one OCI image to another",
+	ArgsUsage: `--src <src-path>[:<src-tag>] --dest <dest-path>[:<dest-tag>]
+
+Where "<src-path>" is the path to the OCI image to copy from, "<src-tag>" is
+the name of the tag to copy (if not specified, defaults to "latest"),
+"<dest-path>" is the path to the OCI image to copy to (which is created if it
+doesn't exist) and "<dest-tag>" is the name of the tag to create (if not
+specified, defaults to "<src-tag>"). "<src-path>" may also be an oci-archive
+or an http:// or https:// URL of an OCI image layout.
+
+Every blob referenced by "<src-tag>" which is not already present in
+"<dest-path>" is copied (and verified) before the tag is created. If
+"<dest-tag>" already exists it is replaced, unless --no-clobber is specified.`,
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "src",
+			Usage: "OCI image URI to copy from, of the form 'path[:tag]'",
+		},
+		cli.StringFlag{
+			Name:  "dest",
+			Usage: "OCI image URI to copy to, of the form 'path[:tag]'",
+		},
+		cli.BoolFlag{
+			Name:  "no-clobber",
+			Usage: "fail rather than replacing an existing <dest-tag>",
+		},
+		cli.StringSliceFlag{
+			Name:  "http-header",
+			Usage: "extra header (of the form 'name: value') to use when fetching a --src URL",
+		},
+		cli.StringFlag{
+			Name:  "netrc",
+			Usage: "path to a netrc file used for credentials when fetching a --src URL",
+		},
+	},
+
+	Action: copyImage,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("src") {
+			return errors.Errorf("missing mandatory argument: --src")
+		}
+		if !ctx.IsSet("dest") {
+			return errors.Errorf("missing mandatory argument: --dest")
+		}
+
+		srcPath, srcTag, err := parseImageRef(ctx.String("src"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --src")
+		}
+		// The tag of --dest defaults to the tag of --src, rather than
+		// "latest".
+		destPath, destTag, err := parseImageRef(ctx.String("dest"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --dest")
+		}
+		if destPath == ctx.String("dest") {
+			destTag = srcTag
+		}
+		if remote.IsURL(destPath) {
+			return errors.Errorf("--dest must be a local image")
+		}
+
+		ctx.App.Metadata["--src-path"] = srcPath
+		ctx.App.Metadata["--src-tag"] = srcTag
+		ctx.App.Metadata["--dest-path"] = destPath
+		ctx.App.Metadata["--dest-tag"] = destTag
+		return nil
+	},
+}
+
+func copyImage(ctx *cli.Context) error {
+	srcPath := ctx.App.Metadata["--src-path"].(string)
+	srcTag := ctx.App.Metadata["--src-tag"].(string)
+	destPath := ctx.App.Metadata["--dest-path"].(string)
+	destTag := ctx.App.Metadata["--dest-tag"].(string)
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	if _, err := os.Stat(destPath); os.IsNotExist(err) {
+		engineExt, err := umoci.CreateLayout(destPath)
+		if err != nil {
+			return errors.Wrap(err, "create new image")
+		}
+		// #nosec G104
+		_ = engineExt.Close()
+		log.Infof("created new OCI image: %s", destPath)
+	}
+
+	// Get a reference to both CAS. If both are the same image, we only open
+	// it once (since we can't have it open for reading and writing at once).
+	destEngine, err := openImage(ctx, destPath)
+	if err != nil {
+		return errors.Wrap(err, "open destination CAS")
+	}
+	destEngineExt := casext.NewEngine(destEngine)
+	defer destEngine.Close()
+
+	srcEngineExt := destEngineExt
+	if !sameImagePath(srcPath, destPath) {
+		var srcEngine cas.Engine
+		srcEngine, err = openImageReadOnly(ctx, srcPath)
+		if err != nil {
+			return errors.Wrap(err, "open source CAS")
+		}
+		srcEngineExt = casext.NewEngine(srcEngine)
+		defer srcEngine.Close()
+	}
+
+	// Get the descriptor referenced by the source tag (which may be an index,
+	// in which case all of its manifests are copied).
+	descriptorPaths, err := srcEngineExt.ResolveReference(cmdCtx, srcTag)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", srcTag)
+	}
+	descriptor := descriptorPaths[0].Root()
+	for _, descriptorPath := range descriptorPaths {
+		if descriptorPath.Root().Digest != descriptor.Digest {
+			// TODO: Handle this more nicely.
+			return errors.Errorf("tag is ambiguous: %s", srcTag)
+		}
+	}
+	// Don't copy the source tag name along with the descriptor.
+	descriptor.Annotations = copyAnnotations(descriptor.Annotations)
+	delete(descriptor.Annotations, ispec.AnnotationRefName)
+
+	blobs, size, err := srcEngineExt.CopyBlobs(cmdCtx, destEngineExt, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "copy blobs")
+	}
+	log.WithFields(log.Fields{
+		"blobs": blobs,
+		"size":  units.HumanSize(float64(size)),
+	}).Info("copied missing blobs")
+
+	if ctx.Bool("no-clobber") {
+		if err := destEngineExt.AddReference(cmdCtx, destTag, descriptor); err != nil {
+			if errors.Cause(err) == casext.ErrReferenceExists {
+				return errors.Errorf("refusing to clobber existing tag %s", destTag)
+			}
+			return errors.Wrap(err, "add reference")
+		}
+	} else {
+		if err := destEngineExt.UpdateReference(cmdCtx, destTag, descriptor); err != nil {
+			return errors.Wrap(err, "put reference")
+		}
+	}
+
+	log.Infof("copied tag: %s:%s -> %s:%s", srcPath, srcTag, destPath, destTag)
+	return nil
+}
+
+// sameImagePath returns whether the two paths refer to the same image layout.
+func sameImagePath(a, b string) bool {
+	if remote.IsURL(a) || remote.IsURL(b) {
+		return false
+	}
+	aFi, err := os.Stat(a)
+	if err != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	bFi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aFi, bFi)
+}
+
+// copyAnnotations returns a copy of the given annotations.
+func copyAnnotations(annotations map[string]string) map[string]string {
+	copied := map[string]string{}
+	for key, value := range annotations {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,218 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rsa"
+	"time"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/crypt"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var encryptCommand = uxHistory(uxTag(cli.Command{
+	Name:  "encrypt",
+	Usage: "encrypts the layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] --recipient <public-key>...
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to encrypt (if not specified, defaults to "latest") and
+"<new-tag>" is the tag the resulting image will be stored as (if not
+specified, defaults to "<tag>").
+
+Every layer of the image which isn't already encrypted is encrypted, such that
+it can only be decrypted by the holder of the private key of one of the
+recipients. Each "<public-key>" is the path to an RSA public key (or X.509
+certificate) in PEM or DER form, optionally prefixed with "jwe:". Layer keys
+are wrapped using JWE -- PKCS#7 and OpenPGP recipients are not supported.`,
+
+	// encrypt modifies an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "recipient",
+			Usage: "path to the public key of a recipient of the encrypted layers (can be specified multiple times)",
+		},
+	},
+
+	Action: encrypt,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if len(ctx.StringSlice("recipient")) == 0 {
+			return errors.Errorf("missing mandatory argument: --recipient")
+		}
+		return nil
+	},
+}))
+
+var decryptCommand = uxHistory(uxTag(cli.Command{
+	Name:  "decrypt",
+	Usage: "decrypts the encrypted layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] --key <private-key>...
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to decrypt (if not specified, defaults to "latest") and
+"<new-tag>" is the tag the resulting image will be stored as (if not
+specified, defaults to "<tag>").
+
+Every encrypted layer of the image is decrypted using the first "<private-key>"
+which is one of its recipients, resulting in the original layer. Each
+"<private-key>" is the path to an unencrypted RSA private key in PEM or DER
+form. It is an error if none of the keys can decrypt one of the layers.`,
+
+	// decrypt modifies an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "key",
+			Usage: "path to a private key used to decrypt the layers (can be specified multiple times)",
+		},
+	},
+
+	Action: decrypt,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if len(ctx.StringSlice("key")) == 0 {
+			return errors.Errorf("missing mandatory argument: --key")
+		}
+		return nil
+	},
+}))
+
+// cryptHistory returns the history entry to add for encrypt and decrypt, or
+// nil if --no-history was specified.
+func cryptHistory(ctx *cli.Context) (*ispec.History, error) {
+	if ctx.Bool("no-history") {
+		return nil, nil
+	}
+
+	created := defaultCreated()
+	history := &ispec.History{
+		Comment:    "",
+		Created:    &created,
+		CreatedBy:  historyCreatedBy(ctx),
+		EmptyLayer: true,
+	}
+
+	if ctx.IsSet("history.author") {
+		history.Author = ctx.String("history.author")
+	}
+	if ctx.IsSet("history.comment") {
+		history.Comment = ctx.String("history.comment")
+	}
+	if ctx.IsSet("history.created") {
+		created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing --history.created")
+		}
+		history.Created = &created
+	}
+	if ctx.IsSet("history.created_by") {
+		history.CreatedBy = ctx.String("history.created_by")
+	}
+	return history, nil
+}
+
+func encrypt(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	var recipients []*rsa.PublicKey
+	for _, path := range ctx.StringSlice("recipient") {
+		pub, err := crypt.LoadRecipient(path)
+		if err != nil {
+			return errors.Wrap(err, "load --recipient")
+		}
+		recipients = append(recipients, pub)
+	}
+
+	history, err := cryptHistory(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	return umoci.Encrypt(cmdCtx, engineExt, fromName, tagName, recipients, history)
+}
+
+func decrypt(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	var keys []*rsa.PrivateKey
+	for _, path := range ctx.StringSlice("key") {
+		key, err := crypt.LoadPrivateKey(path)
+		if err != nil {
+			return errors.Wrap(err, "load --key")
+		}
+		keys = append(keys, key)
+	}
+
+	history, err := cryptHistory(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	return umoci.Decrypt(cmdCtx, engineExt, fromName, tagName, keys, history)
+}
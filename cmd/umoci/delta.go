@@ -0,0 +1,134 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var deltaCommand = uxRemap(cli.Command{
+	Name:  "delta",
+	Usage: "computes the filesystem delta between two images as a layer",
+	ArgsUsage: `--from <image-path>[:<tag>] --to <image-path>[:<tag>] --output <file>
+
+Where each "<image-path>" is the path to an OCI image, and "<tag>" is the name
+of a tagged image in it (if not specified, defaults to "latest"). The two
+images do not need to be in the same OCI image.
+
+An uncompressed tar layer is written to "<file>", containing all of the
+changes (including whiteouts for removed files) required to convert the root
+filesystem of the --from image into the root filesystem of the --to image. The
+layer can then be added on top of the --from image (with umoci-apply-delta(1))
+to reproduce the root filesystem of the --to image.`,
+
+	// NOTE: delta is not in categoryImage, because it takes two images
+	//       (--from and --to) rather than a single --image.
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "OCI image URI of the form 'path[:tag]' to compute the delta from",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "OCI image URI of the form 'path[:tag]' to compute the delta to",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "path the delta layer will be written to",
+		},
+	},
+
+	Action: delta,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		for _, flag := range []string{"from", "to"} {
+			if !ctx.IsSet(flag) {
+				return errors.Errorf("missing mandatory argument: --%s", flag)
+			}
+			path, tag, err := parseImageRef(ctx.String(flag))
+			if err != nil {
+				return errors.Wrapf(err, "invalid --%s", flag)
+			}
+			ctx.App.Metadata["--"+flag+"-path"] = path
+			ctx.App.Metadata["--"+flag+"-tag"] = tag
+		}
+		if ctx.String("output") == "" {
+			return errors.Errorf("missing mandatory argument: --output")
+		}
+		return nil
+	},
+})
+
+func delta(ctx *cli.Context) error {
+	fromPath := ctx.App.Metadata["--from-path"].(string)
+	fromName := ctx.App.Metadata["--from-tag"].(string)
+	toPath := ctx.App.Metadata["--to-path"].(string)
+	toName := ctx.App.Metadata["--to-tag"].(string)
+	outputPath := ctx.String("output")
+
+	var meta umoci.Meta
+	meta.Version = umoci.MetaVersion
+
+	// Parse and set up the mapping options.
+	if err := umoci.ParseIdmapOptions(&meta, ctx); err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	fromEngine, err := openImageReadOnly(ctx, fromPath)
+	if err != nil {
+		return errors.Wrap(err, "open --from CAS")
+	}
+	fromEngineExt := casext.NewEngine(fromEngine)
+	defer fromEngine.Close()
+
+	toEngine, err := openImageReadOnly(ctx, toPath)
+	if err != nil {
+		return errors.Wrap(err, "open --to CAS")
+	}
+	toEngineExt := casext.NewEngine(toEngine)
+	defer toEngine.Close()
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return errors.Wrap(err, "create output")
+	}
+	defer output.Close()
+
+	if err := umoci.Delta(fromEngineExt, fromName, toEngineExt, toName, meta.MapOptions, output); err != nil {
+		// Don't leave a truncated layer behind.
+		os.Remove(outputPath)
+		return errors.Wrap(err, "compute delta")
+	}
+	if err := output.Close(); err != nil {
+		return errors.Wrap(err, "close output")
+	}
+
+	log.Infof("wrote delta layer: %s", outputPath)
+	return nil
+}
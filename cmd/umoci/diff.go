@@ -0,0 +1,153 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/vbatts/go-mtree"
+)
+
+var diffCommand = uxRootless(cli.Command{
+	Name:  "diff",
+	Usage: "shows the changes made to an OCI runtime bundle since it was unpacked",
+	ArgsUsage: `<bundle>
+
+Where "<bundle>" is a bundle created with umoci-unpack(1). The rootfs of the
+bundle is compared against the metadata saved by umoci-unpack(1) (in the same
+way as umoci-repack(1)), and every path which has been added ("A"), modified
+("M") or deleted ("D") is output. The image is neither read nor modified.
+
+WARNING: Do not depend on the output of this tool unless you're using --json.
+The intention of the default formatting of this tool is that it is easy for
+humans to read, and might change in future versions.`,
+
+	// NOTE: diff is not in categoryImage, because it only operates on a
+	//       bundle and never touches the image.
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "output the changes as a JSON encoded list of deltas",
+		},
+		cli.StringSliceFlag{
+			Name:  "mask-path",
+			Usage: "set of path prefixes in which changes will be ignored",
+		},
+		cli.IntFlag{
+			Name:  "mtree-jobs",
+			Usage: "number of files to digest concurrently when computing the rootfs diff",
+			Value: 1,
+		},
+		cli.BoolFlag{
+			Name:  "mtree-cache",
+			Usage: "cache file digests in the bundle to speed up computing later rootfs diffs",
+		},
+	},
+
+	Action: diff,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <bundle>")
+		}
+		if ctx.Args().First() == "" {
+			return errors.Errorf("bundle path cannot be empty")
+		}
+		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if ctx.Int("mtree-jobs") < 1 {
+			return errors.Errorf("--mtree-jobs must be at least 1")
+		}
+		return nil
+	},
+})
+
+func diff(ctx *cli.Context) error {
+	bundlePath := ctx.App.Metadata["bundle"].(string)
+
+	// Read the metadata first.
+	meta, err := umoci.ReadBundleMeta(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "read umoci.json metadata")
+	}
+
+	log.WithFields(log.Fields{
+		"version":     meta.Version,
+		"from":        meta.From,
+		"map_options": meta.MapOptions,
+	}).Debugf("umoci: loaded Meta metadata")
+
+	if err := umoci.ParseBundleRootless(&meta, ctx); err != nil {
+		return err
+	}
+
+	filters := []mtreefilter.FilterFunc{
+		mtreefilter.MaskFilter(ctx.StringSlice("mask-path")),
+	}
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	diffs, err := umoci.Diff(cmdCtx, bundlePath, meta, filters, ctx.Int("mtree-jobs"), ctx.Bool("mtree-cache"), newProgress())
+	if err != nil {
+		return errors.Wrap(err, "compute bundle diff")
+	}
+
+	if ctx.Bool("json") {
+		// Make sure we output "[]" rather than "null" if nothing changed.
+		if diffs == nil {
+			diffs = []mtree.InodeDelta{}
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(diffs); err != nil {
+			return errors.Wrap(err, "encoding diff")
+		}
+		return nil
+	}
+	return errors.Wrap(formatDiff(os.Stdout, diffs), "format diff")
+}
+
+// formatDiff writes a human-readable summary of diffs to w, with one line per
+// changed path.
+func formatDiff(w io.Writer, diffs []mtree.InodeDelta) error {
+	for _, delta := range diffs {
+		var kind string
+		switch delta.Type() {
+		case mtree.Extra:
+			kind = "A"
+		case mtree.Modified:
+			kind = "M"
+		case mtree.Missing:
+			kind = "D"
+		default:
+			// Should _never_ be reached.
+			return errors.Errorf("[internal error] unknown delta type: %s", delta.Type())
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", kind, delta.Path()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var editLayersCommand = uxHistory(uxTag(cli.Command{
+	Name:  "edit-layers",
+	Usage: "removes or replaces individual layers of an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [--remove <index>]... [--replace <index>=<layer>]... [--truncate <count>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to modify (if not specified, defaults to "latest") and "<new-tag>"
+is the tag the resulting image will be stored as (if not specified, defaults
+to "<tag>").
+
+Layers are identified by their index in the image, counting from the
+bottom-most layer starting at 0 (as listed by umoci-stat(1)). All indices refer
+to the layers of the original image. "<layer>" is the path to an uncompressed
+tar layer (in the OCI layer format) which replaces the layer.
+
+Removing or replacing a layer changes the root filesystem seen by every layer
+above it, so this should only be used to drop layers which are known to be
+independent of the rest of the image (such as a layer which leaked a secret).`,
+
+	// edit-layers modifies an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.IntSliceFlag{
+			Name:  "remove",
+			Usage: "index of a layer to remove from the image",
+		},
+		cli.StringSliceFlag{
+			Name:  "replace",
+			Usage: "index=path of a layer to replace with the uncompressed tar layer at path",
+		},
+		cli.IntFlag{
+			Name:  "truncate",
+			Usage: "number of layers to keep (from the bottom-most layer), removing the rest",
+		},
+	},
+
+	Action: editLayers,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if !ctx.IsSet("remove") && !ctx.IsSet("replace") && !ctx.IsSet("truncate") {
+			return errors.Errorf("at least one of --remove, --replace or --truncate must be specified")
+		}
+		if ctx.IsSet("truncate") && ctx.Int("truncate") < 0 {
+			return errors.Errorf("--truncate must not be negative")
+		}
+		replacements, err := parseLayerReplacements(ctx.StringSlice("replace"))
+		if err != nil {
+			return errors.Wrap(err, "invalid --replace")
+		}
+		for _, n := range ctx.IntSlice("remove") {
+			if _, ok := replacements[n]; ok {
+				return errors.Errorf("layer %d cannot be both removed and replaced", n)
+			}
+		}
+		return nil
+	},
+}))
+
+// parseLayerReplacements parses a set of index=path values, returning a map
+// of layer indices to paths.
+func parseLayerReplacements(values []string) (map[int]string, error) {
+	replacements := map[int]string{}
+	for _, value := range values {
+		index, path, err := parseKV(value)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(index)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse layer index %q", index)
+		}
+		if _, ok := replacements[n]; ok {
+			return nil, errors.Errorf("layer %d is replaced more than once", n)
+		}
+		replacements[n] = path
+	}
+	return replacements, nil
+}
+
+// replaceLayer replaces the layer with index n of the image with the
+// uncompressed tar layer at path.
+func replaceLayer(ctx context.Context, mutator *mutate.Mutator, n int, path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open layer")
+	}
+	defer fh.Close()
+
+	return mutator.ReplaceLayer(ctx, n, fh, nil)
+}
+
+func editLayers(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// This was already validated in Before.
+	replacements, _ := parseLayerReplacements(ctx.StringSlice("replace"))
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engine, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for manifest")
+	}
+
+	// Layers are truncated first, then replaced, and finally removed from the
+	// top-most layer downwards so that the indices of the layers still to be
+	// modified match those of the original image.
+	if ctx.IsSet("truncate") {
+		if err := mutator.TruncateLayers(context.Background(), ctx.Int("truncate")); err != nil {
+			return errors.Wrap(err, "truncate layers")
+		}
+	}
+	for n, path := range replacements {
+		log.Infof("replacing layer %d with %s", n, path)
+		if err := replaceLayer(context.Background(), mutator, n, path); err != nil {
+			return errors.Wrapf(err, "replace layer %d", n)
+		}
+	}
+	removals := ctx.IntSlice("remove")
+	sort.Sort(sort.Reverse(sort.IntSlice(removals)))
+	for idx, n := range removals {
+		if idx > 0 && removals[idx-1] == n {
+			continue
+		}
+		log.Infof("removing layer %d", n)
+		if err := mutator.RemoveLayer(context.Background(), n); err != nil {
+			return errors.Wrapf(err, "remove layer %d", n)
+		}
+	}
+
+	if !ctx.Bool("no-history") {
+		created := defaultCreated()
+		history := ispec.History{
+			Author:     "",
+			Comment:    "",
+			Created:    &created,
+			CreatedBy:  historyCreatedBy(ctx),
+			EmptyLayer: true,
+		}
+
+		if ctx.IsSet("history.author") {
+			history.Author = ctx.String("history.author")
+		}
+		if ctx.IsSet("history.comment") {
+			history.Comment = ctx.String("history.comment")
+		}
+		if ctx.IsSet("history.created") {
+			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --history.created")
+			}
+			history.Created = &created
+		}
+		if ctx.IsSet("history.created_by") {
+			history.CreatedBy = ctx.String("history.created_by")
+		}
+
+		oldHistory, err := mutator.History(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "get image history")
+		}
+		if err := mutator.SetHistory(context.Background(), append(oldHistory, history)); err != nil {
+			return errors.Wrap(err, "add history entry")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var exportCommand = uxArchive(cli.Command{
+	Name:  "export",
+	Usage: "exports an OCI image tag to an archive",
+	ArgsUsage: `--image <image-path>[:<tag>] docker-archive:<path>[:<name>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to export (if not specified, defaults to "latest"), and "<path>"
+is the path of the archive to create, which can be loaded with "docker load".
+If "<name>" (of the form "<repository>[:<tag>]") is specified, the image is
+given that name in the archive.`,
+
+	// export reads manifest information.
+	Category: "image",
+
+	Action: exportArchive,
+})
+
+func exportArchive(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	archivePath := ctx.App.Metadata["archive"].(string)
+	name := ctx.App.Metadata["archive-name"].(string)
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	// Get a reference to the CAS.
+	engine, err := openImageReadOnly(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	return umoci.ExportDockerArchive(cmdCtx, engineExt, fromName, archivePath, name)
+}
@@ -0,0 +1,113 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var extractCommand = uxRemap(cli.Command{
+	Name:  "extract",
+	Usage: "extracts a single file or directory from an image",
+	ArgsUsage: `--image <image-path>[:<tag>] <path> <dest>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to read from (if not specified, defaults to "latest"), "<path>" is
+the path (inside the image's root filesystem) of the file or directory to
+extract and "<dest>" is the path it will be extracted to (which must not
+already exist). Only the layers required to find the final version of "<path>"
+are read, and nothing outside of "<path>" is extracted to disk.`,
+
+	// extract reads manifest information.
+	Category: "image",
+
+	Action: extract,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 2 {
+			return errors.Errorf("invalid number of positional arguments: expected <path> <dest>")
+		}
+		if ctx.Args().Get(0) == "" {
+			return errors.Errorf("path cannot be empty")
+		}
+		if ctx.Args().Get(1) == "" {
+			return errors.Errorf("destination path cannot be empty")
+		}
+		ctx.App.Metadata["path"] = ctx.Args().Get(0)
+		ctx.App.Metadata["dest"] = ctx.Args().Get(1)
+		return nil
+	},
+})
+
+func extract(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+	path := ctx.App.Metadata["path"].(string)
+	dest := ctx.App.Metadata["dest"].(string)
+
+	var meta umoci.Meta
+	if err := umoci.ParseIdmapOptions(&meta, ctx); err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImageReadOnly(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), fromDescriptorPaths[0].Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	if manifestBlob.Descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType), "invalid --image tag")
+	}
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	return layer.ExtractPath(context.Background(), engineExt, manifest, path, dest, &layer.UnpackOptions{MapOptions: meta.MapOptions})
+}
@@ -18,6 +18,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/pkg/errors"
@@ -34,15 +39,38 @@ Where "<image-path>" is the path to the OCI image.
 
 This command will do a mark-and-sweep garbage collection of the provided OCI
 image, only retaining blobs which can be reached by a descriptor path from the
-root set of references. All other blobs will be removed.`,
+root set of references. All other blobs will be removed.
+
+The image is locked for the duration of the garbage collection, and so gc will
+fail if the image is being modified by another umoci process. If --dry-run is
+specified, the blobs which would be removed are listed (along with their size
+in bytes) rather than being removed. With --format=json, a report of the
+removed blobs (and the blobs reachable from each reference) is output as JSON.`,
 
 	// create modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only list the blobs that would be removed",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format of the report of removed blobs ([text], json)",
+			Value: "text",
+		},
+	},
+
 	Before: func(ctx *cli.Context) error {
 		if _, ok := ctx.App.Metadata["--image-path"]; !ok {
 			return errors.Errorf("missing mandatory argument: --layout")
 		}
+		switch format := ctx.String("format"); format {
+		case "text", "json":
+		default:
+			return errors.Errorf("unknown --format: %q", format)
+		}
 		return nil
 	},
 
@@ -52,14 +80,86 @@ root set of references. All other blobs will be removed.`,
 func gc(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
-	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	if ctx.Bool("dry-run") {
+		return gcDryRun(ctx, imagePath)
+	}
+
+	// Get a reference to the CAS. We need to make sure nobody else is using
+	// the image, otherwise we might remove blobs they just added (or are
+	// reading).
+	opts := lockOptions(ctx)
+	opts.NoWait = true
+	engine, err := dir.OpenWithOptions(imagePath, opts)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
+	// Since the image is locked, the report matches what GC removes.
+	var report *casext.GCReport
+	if ctx.String("format") == "json" {
+		report, err = engineExt.GCReport(context.Background())
+		if err != nil {
+			return errors.Wrap(err, "gc report")
+		}
+	}
+
 	// Run the GC.
-	return errors.Wrap(engineExt.GC(context.Background()), "gc")
+	if err := engineExt.GC(context.Background()); err != nil {
+		return errors.Wrap(err, "gc")
+	}
+	if report != nil {
+		return writeGCReport(report, "json")
+	}
+	return nil
+}
+
+// gcDryRun outputs a report of the blobs which would be removed by gc, without
+// modifying the image.
+func gcDryRun(ctx *cli.Context, imagePath string) error {
+	engine, err := openImageReadOnly(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	report, err := engineExt.GCReport(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "gc report")
+	}
+	if err := writeGCReport(report, ctx.String("format")); err != nil {
+		return err
+	}
+
+	log.Infof("would garbage collect %d blobs (%d bytes)", len(report.Unreachable), report.ReclaimedBytes)
+	return nil
+}
+
+// writeGCReport outputs the report to stdout in the given format. The text
+// format lists the digest and size of each unreachable blob (one per line),
+// and logs the reachable-root analysis.
+func writeGCReport(report *casext.GCReport, format string) error {
+	if format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return errors.Wrap(err, "encoding gc report")
+		}
+		return nil
+	}
+
+	for _, root := range report.Roots {
+		log.WithFields(log.Fields{
+			"name":            root.Name,
+			"digest":          root.Descriptor.Digest,
+			"reachable_blobs": root.ReachableBlobs,
+			"reachable_bytes": root.ReachableBytes,
+			"exclusive_blobs": root.ExclusiveBlobs,
+			"exclusive_bytes": root.ExclusiveBytes,
+		}).Info("gc root")
+	}
+	for _, blob := range report.Unreachable {
+		fmt.Printf("%s\t%d\n", blob.Digest, blob.Size)
+	}
+	return nil
 }
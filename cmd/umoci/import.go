@@ -0,0 +1,131 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// dockerArchiveTransport is the prefix of the <archive> argument of
+// umoci-import(1) and umoci-export(1) for "docker save" archives.
+const dockerArchiveTransport = "docker-archive:"
+
+// uxArchive parses the single positional <archive> argument of the given
+// cli.Command, which is of the form "docker-archive:<path>[:<name>]", storing
+// the path in ctx.App.Metadata["archive"] and the name (if any) in
+// ctx.App.Metadata["archive-name"].
+func uxArchive(cmd cli.Command) cli.Command {
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <archive>")
+		}
+		arg := ctx.Args().First()
+		if !strings.HasPrefix(arg, dockerArchiveTransport) {
+			return errors.Errorf("invalid <archive>: unsupported transport (only %s<path> is supported): %q", dockerArchiveTransport, arg)
+		}
+		parts := strings.SplitN(strings.TrimPrefix(arg, dockerArchiveTransport), ":", 2)
+		if parts[0] == "" {
+			return errors.Errorf("invalid <archive>: path cannot be empty")
+		}
+		ctx.App.Metadata["archive"] = parts[0]
+		ctx.App.Metadata["archive-name"] = ""
+		if len(parts) == 2 {
+			if parts[1] == "" {
+				return errors.Errorf("invalid <archive>: name cannot be empty")
+			}
+			ctx.App.Metadata["archive-name"] = parts[1]
+		}
+		if remote.IsURL(ctx.App.Metadata["--image-path"].(string)) {
+			return errors.Errorf("--image must be a local image")
+		}
+
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+	return cmd
+}
+
+var importCommand = uxArchive(cli.Command{
+	Name:  "import",
+	Usage: "imports an image from an archive into an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>] docker-archive:<path>[:<name>]
+
+Where "<image-path>" is the path to the OCI image (which is created if it
+doesn't exist), "<tag>" is the name of the tag that the imported image will be
+saved as (if not specified, defaults to the tag in "<name>", or "latest"), and
+"<path>" is the path to an archive created by "docker save". If the archive
+contains more than one image, "<name>" (of the form "<repository>[:<tag>]")
+selects which image to import.
+
+The image configuration is converted to an OCI image configuration, and the
+layers are compressed and verified against the configuration as they are
+imported.`,
+
+	// import creates a new image, with a given tag.
+	Category: "image",
+
+	Action: importArchive,
+})
+
+func importArchive(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	archivePath := ctx.App.Metadata["archive"].(string)
+	name := ctx.App.Metadata["archive-name"].(string)
+
+	// The tag defaults to the tag in the name, rather than "latest".
+	if !strings.Contains(ctx.String("image"), ":") && name != "" {
+		if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+			tagName = name[idx+1:]
+		}
+	}
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		engineExt, err := umoci.CreateLayout(imagePath)
+		if err != nil {
+			return errors.Wrap(err, "create new image")
+		}
+		// #nosec G104
+		_ = engineExt.Close()
+		log.Infof("created new OCI image: %s", imagePath)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	return umoci.ImportDockerArchive(cmdCtx, engineExt, archivePath, name, tagName)
+}
@@ -25,7 +25,6 @@ import (
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/mutate"
-	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
@@ -48,6 +47,10 @@ The path at "<source>" is added to the image with the given "<target>" name.
 If "--whiteout" is specified, rather than inserting content into the image, a
 removal entry for "<target>" is inserted instead.
 
+By default the inserted entries have the same owner as "<source>" on the host
+(mapped with --uid-map and --gid-map). "--uid" and "--gid" can be used to make
+every inserted entry owned by the given (in-image) user and group instead.
+
 If "--opaque" is specified then any paths below "<target>" (assuming it is a
 directory) from previous layers will no longer be present. Only the contents
 inserted by this command will be visible. This can be used to replace an entire
@@ -61,7 +64,20 @@ Some examples:
 	umoci insert --image oci:foo mybinary /usr/bin/mybinary
 	umoci insert --image oci:foo myconfigdir /etc/myconfigdir
 	umoci insert --image oci:foo --opaque myoptdir /opt
+	umoci insert --image oci:foo --uid 0 --gid 0 ca.pem /etc/pki/trust/anchors/ca.pem
 	umoci insert --image oci:foo --whiteout /some/old/dir
+
+If "--whiteout-mode=overlayfs" is specified, overlayfs whiteouts (character
+devices with device number 0:0) inside "<source>" are inserted as removal
+entries, and directories marked as opaque by overlayfs mask any previous
+entries inside them (as with "--opaque"). This allows the upper directory of an
+overlayfs mount to be inserted as-is. With the default "--whiteout-mode=oci",
+"<source>" is inserted verbatim.
+
+If the tag refers to an index (such as a multi-platform image), the content is
+only inserted into the manifest for the platform given by --platform (or the
+platform of the running system, if not specified). The manifests for other
+platforms in the index are left unchanged.
 `,
 
 	Category: "image",
@@ -77,6 +93,23 @@ Some examples:
 			Name:  "opaque",
 			Usage: "mask any previous entries in the target directory",
 		},
+		cli.IntFlag{
+			Name:  "uid",
+			Usage: "owner of all inserted entries in the image (defaults to the mapped owner of the source)",
+		},
+		cli.IntFlag{
+			Name:  "gid",
+			Usage: "group of all inserted entries in the image (defaults to the mapped group of the source)",
+		},
+		cli.StringFlag{
+			Name:  "whiteout-mode",
+			Usage: "how whiteouts are represented in the source ([oci] or overlayfs)",
+			Value: "oci",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "insert into the manifest for the given platform (os/arch[/variant]) if the tag refers to an index",
+		},
 	},
 
 	Before: func(ctx *cli.Context) error {
@@ -89,6 +122,28 @@ Some examples:
 		if ctx.NArg() != numArgs {
 			return errors.Errorf("invalid number of positional arguments: expected %d", numArgs)
 		}
+		for _, flag := range []string{"uid", "gid"} {
+			if !ctx.IsSet(flag) {
+				continue
+			}
+			if ctx.IsSet("whiteout") {
+				return errors.Errorf("--whiteout and --%s may not be specified together", flag)
+			}
+			if ctx.Int(flag) < 0 {
+				return errors.Errorf("--%s must not be negative", flag)
+			}
+		}
+		if ctx.IsSet("platform") {
+			if _, err := casext.ParsePlatform(ctx.String("platform")); err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+		}
+		if _, err := layer.ParseWhiteoutMode(ctx.String("whiteout-mode")); err != nil {
+			return errors.Wrap(err, "invalid --whiteout-mode")
+		}
+		if ctx.IsSet("whiteout-mode") && ctx.IsSet("whiteout") {
+			return errors.Errorf("--whiteout and --whiteout-mode may not be specified together")
+		}
 		for idx, args := range ctx.Args() {
 			if args == "" {
 				return errors.Errorf("invalid positional argument %d: arguments cannot be empty", idx)
@@ -122,7 +177,7 @@ func insert(ctx *cli.Context) error {
 	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -136,6 +191,17 @@ func insert(ctx *cli.Context) error {
 	if len(descriptorPaths) == 0 {
 		return errors.Errorf("tag not found: %s", fromName)
 	}
+	// If the tag refers to an index, only insert into the manifest for the
+	// requested platform. Commit will replace that manifest in the index.
+	platform := casext.DefaultPlatform()
+	if ctx.IsSet("platform") {
+		// Already validated in Before.
+		platform, _ = casext.ParsePlatform(ctx.String("platform"))
+	}
+	descriptorPaths = casext.SelectPlatform(descriptorPaths, platform)
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("tag has no manifest for platform %s/%s: %s", platform.OS, platform.Architecture, fromName)
+	}
 	if len(descriptorPaths) != 1 {
 		// TODO: Handle this more nicely.
 		return errors.Errorf("tag is ambiguous: %s", fromName)
@@ -155,17 +221,31 @@ func insert(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	generateOptions := layer.GenerateOptions{MapOptions: meta.MapOptions}
+	if ctx.IsSet("uid") {
+		uid := ctx.Int("uid")
+		generateOptions.ForceUID = &uid
+	}
+	if ctx.IsSet("gid") {
+		gid := ctx.Int("gid")
+		generateOptions.ForceGID = &gid
+	}
+
+	whiteoutMode, err := layer.ParseWhiteoutMode(ctx.String("whiteout-mode"))
+	if err != nil {
+		return errors.Wrap(err, "parse --whiteout-mode")
+	}
 
-	reader := layer.GenerateInsertLayer(sourcePath, targetPath, ctx.IsSet("opaque"), &meta.MapOptions)
+	reader := layer.GenerateInsertLayerWithMode(sourcePath, targetPath, ctx.IsSet("opaque"), &generateOptions, whiteoutMode)
 	defer reader.Close()
 
 	var history *ispec.History
 	if !ctx.Bool("no-history") {
-		created := time.Now()
+		created := defaultCreated()
 		history = &ispec.History{
 			Comment:    "",
 			Created:    &created,
-			CreatedBy:  "umoci insert", // XXX: Should we append argv to this?
+			CreatedBy:  historyCreatedBy(ctx),
 			EmptyLayer: false,
 		}
 
@@ -198,11 +278,16 @@ func insert(ctx *cli.Context) error {
 		return errors.Wrap(err, "commit mutated image")
 	}
 
-	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
 
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return errors.Wrap(err, "add new tag")
 	}
-	log.Infof("updated tag for image manifest: %s", tagName)
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("updated tag for image manifest")
 	return nil
 }
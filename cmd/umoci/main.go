@@ -23,6 +23,10 @@ import (
 
 	"github.com/apex/log"
 	logcli "github.com/apex/log/handlers/cli"
+	logjson "github.com/apex/log/handlers/json"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -63,6 +67,7 @@ func main() {
 		v = fmt.Sprintf("%s~git%s", v, gitCommit)
 	}
 	app.Version = v
+	umoci.UmociVersion = v
 
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
@@ -74,10 +79,36 @@ func main() {
 			Usage: "set the log level (debug, info, [warn], error, fatal)",
 			Value: "warn",
 		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "set the log output format ([text], json)",
+			Value: "text",
+		},
+		cli.DurationFlag{
+			Name:  "lock-timeout",
+			Usage: "maximum time to wait for other processes using the image to finish (such as 30s, or 0 to wait indefinitely)",
+		},
+		cli.BoolFlag{
+			Name:  "no-lock",
+			Usage: "do not lock the image (only safe if no other processes use the image concurrently)",
+		},
+		cli.StringFlag{
+			Name:  "digest-algorithm",
+			Usage: "digest algorithm used for new blobs ([sha256] or sha512)",
+			Value: cas.BlobAlgorithm.String(),
+		},
 	}
 
 	app.Before = func(ctx *cli.Context) error {
-		log.SetHandler(logcli.New(os.Stderr))
+		switch format := ctx.GlobalString("log-format"); format {
+		case "text":
+			log.SetHandler(logcli.New(os.Stderr))
+		case "json":
+			log.SetHandler(logjson.New(os.Stderr))
+		default:
+			log.SetHandler(logcli.New(os.Stderr))
+			return errors.Errorf("unknown --log-format: %q", format)
+		}
 
 		if ctx.GlobalBool("verbose") {
 			if ctx.GlobalIsSet("log") {
@@ -94,6 +125,16 @@ func main() {
 			return errors.Wrap(err, "parsing log level")
 		}
 		log.SetLevel(level)
+
+		if ctx.GlobalDuration("lock-timeout") < 0 {
+			return errors.New("--lock-timeout must not be negative")
+		}
+		if ctx.GlobalBool("no-lock") && ctx.GlobalIsSet("lock-timeout") {
+			return errors.New("--lock-timeout and --no-lock are mutually exclusive")
+		}
+		if algo := digest.Algorithm(ctx.GlobalString("digest-algorithm")); !cas.IsSupportedAlgorithm(algo) {
+			return errors.Errorf("unsupported --digest-algorithm: %q", algo)
+		}
 		return nil
 	}
 
@@ -104,12 +145,31 @@ func main() {
 		gcCommand,
 		initCommand,
 		newCommand,
+		copyCommand,
 		tagAddCommand,
 		tagRemoveCommand,
 		tagListCommand,
 		statCommand,
+		catCommand,
+		extractCommand,
+		deltaCommand,
+		applyDeltaCommand,
+		repairDiffIDsCommand,
+		packCommand,
+		diffCommand,
 		rawSubcommand,
 		insertCommand,
+		remapCommand,
+		encryptCommand,
+		decryptCommand,
+		squashCommand,
+		rebaseCommand,
+		editLayersCommand,
+		verifyCommand,
+		pullCommand,
+		pushCommand,
+		importCommand,
+		exportCommand,
 	}
 
 	app.Metadata = map[string]interface{}{}
@@ -19,7 +19,6 @@ package main
 
 import (
 	"github.com/openSUSE/umoci"
-	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -31,7 +30,8 @@ var newCommand = cli.Command{
 	ArgsUsage: `--image <image-path>:<new-tag>
 
 Where "<image-path>" is the path to the OCI image, and "<new-tag>" is the name
-of the tag for the empty manifest.
+of the tag for the empty manifest. If "<new-tag>" already exists it is
+replaced, unless --no-clobber is specified.
 
 Once you create a new image with umoci-new(1) you can directly use the image
 with umoci-unpack(1), umoci-repack(1), and umoci-config(1) to modify the new
@@ -41,6 +41,13 @@ needing a base image to start from.`,
 	// new modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-clobber",
+			Usage: "fail rather than replacing an existing <new-tag>",
+		},
+	},
+
 	Action: newImage,
 }
 
@@ -48,13 +55,21 @@ func newImage(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
+	created, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
-	return umoci.NewImage(engineExt, tagName)
+	return umoci.NewImageWithOptions(engineExt, tagName, umoci.NewImageOptions{
+		NoClobber: ctx.Bool("no-clobber"),
+		Created:   created,
+	})
 }
@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var packCommand = uxConfig(uxHistory(uxRemap(cli.Command{
+	Name:  "pack",
+	Usage: "creates a new single-layer image from a directory",
+	ArgsUsage: `--image <image-path>[:<new-tag>] --rootfs <rootfs>
+
+Where "<image-path>" is the path to the OCI image, "<new-tag>" is the name of
+the tag for the new image (if not specified, defaults to "latest") and
+"<rootfs>" is the path to a directory which will be used as the root
+filesystem of the new image.
+
+This is equivalent to creating a new image with umoci-new(1), unpacking it,
+copying the contents of "<rootfs>" into the bundle and then repacking it with
+umoci-repack(1). The configuration of the new image can be set with the same
+options as umoci-config(1).`,
+
+	// pack modifies an image layout.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "rootfs",
+			Usage: "path to the directory to use as the root filesystem of the new image",
+		},
+	},
+
+	Action: pack,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("rootfs") == "" {
+			return errors.Errorf("missing mandatory argument: --rootfs")
+		}
+		return nil
+	},
+})))
+
+func pack(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	rootfsPath := ctx.String("rootfs")
+
+	var meta umoci.Meta
+	meta.Version = umoci.MetaVersion
+
+	// Parse and set up the mapping options.
+	if err := umoci.ParseIdmapOptions(&meta, ctx); err != nil {
+		return err
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// Start with the same defaults as umoci-new(1).
+	g := igen.New()
+	g.SetCreated(defaultCreated())
+	g.SetOS(runtime.GOOS)
+	g.SetArchitecture(runtime.GOARCH)
+	if err := applyConfigFlags(ctx, g); err != nil {
+		return err
+	}
+	imageConfig, imageMeta := fromImage(g.Image())
+	if _, err := applyPlatformFlags(ctx, &imageMeta); err != nil {
+		return err
+	}
+
+	var history *ispec.History
+	if !ctx.Bool("no-history") {
+		created := defaultCreated()
+		if ctx.IsSet("created") {
+			// This was already validated by applyConfigFlags.
+			created, _ = time.Parse(igen.ISO8601, ctx.String("created"))
+		}
+		history = &ispec.History{
+			Author:     g.Author(),
+			Comment:    "",
+			Created:    &created,
+			CreatedBy:  historyCreatedBy(ctx),
+			EmptyLayer: false,
+		}
+
+		if ctx.IsSet("history.author") {
+			history.Author = ctx.String("history.author")
+		}
+		if ctx.IsSet("history.comment") {
+			history.Comment = ctx.String("history.comment")
+		}
+		if ctx.IsSet("history.created") {
+			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --history.created")
+			}
+			history.Created = &created
+		}
+		if ctx.IsSet("history.created_by") {
+			history.CreatedBy = ctx.String("history.created_by")
+		}
+	}
+
+	return umoci.Pack(engineExt, tagName, rootfsPath, imageConfig, imageMeta, meta.MapOptions, history)
+}
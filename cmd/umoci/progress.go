@@ -0,0 +1,95 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/layer"
+	"golang.org/x/sys/unix"
+)
+
+// progressInterval is the minimum time between redraws of a progress bar.
+const progressInterval = 100 * time.Millisecond
+
+// progressWidth is the number of characters used for the bar itself.
+const progressWidth = 30
+
+// progressPathWidth is the maximum number of characters of the current path
+// shown after the bar.
+const progressPathWidth = 40
+
+// isTerminal returns whether the given file is a terminal.
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// progressBar renders the progress reported to a layer.ProgressFunc as a
+// single (continually redrawn) line.
+type progressBar struct {
+	out      io.Writer
+	lastDraw time.Time
+}
+
+// newProgress returns a layer.ProgressFunc which renders a progress bar on
+// stderr. If stderr is not a terminal, or debug logging is enabled (in which
+// case the bar would be mixed up with the log output), nil is returned so
+// that no progress is reported.
+func newProgress() layer.ProgressFunc {
+	if !isTerminal(os.Stderr) {
+		return nil
+	}
+	if logger, ok := log.Log.(*log.Logger); ok && logger.Level <= log.DebugLevel {
+		return nil
+	}
+	bar := &progressBar{out: os.Stderr}
+	return bar.update
+}
+
+// update redraws the progress bar, unless it was redrawn too recently. Once
+// all of the data has been processed the bar is cleared, so that it doesn't
+// get mixed up with any later output.
+func (pb *progressBar) update(done, total int64, path string) {
+	if total <= 0 {
+		return
+	}
+	if done >= total {
+		fmt.Fprint(pb.out, "\r\033[K")
+		return
+	}
+	now := time.Now()
+	if now.Sub(pb.lastDraw) < progressInterval {
+		return
+	}
+	pb.lastDraw = now
+
+	filled := int(done * progressWidth / total)
+	if len(path) > progressPathWidth {
+		path = "..." + path[len(path)-progressPathWidth+3:]
+	}
+	fmt.Fprintf(pb.out, "\r\033[K[%s%s] %3d%% %s/%s %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled),
+		done*100/total, units.HumanSize(float64(done)), units.HumanSize(float64(total)), path)
+}
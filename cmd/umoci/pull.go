@@ -0,0 +1,157 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/distribution"
+	"github.com/openSUSE/umoci/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// uxRegistry adds the flags used to talk to a registry to the given
+// cli.Command, and parses the single positional <reference> argument of the
+// command (storing it in ctx.App.Metadata["reference"]).
+func uxRegistry(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "use HTTP rather than HTTPS to talk to the registry",
+		},
+		cli.StringFlag{
+			Name:  "netrc",
+			Usage: "path to a netrc file used for registry credentials",
+		},
+	}...)
+
+	oldBefore := cmd.Before
+	cmd.Before = func(ctx *cli.Context) error {
+		if ctx.NArg() != 1 {
+			return errors.Errorf("invalid number of positional arguments: expected <reference>")
+		}
+		ref, err := distribution.ParseReference(ctx.Args().First())
+		if err != nil {
+			return errors.Wrap(err, "invalid <reference>")
+		}
+		ctx.App.Metadata["reference"] = ref
+		if remote.IsURL(ctx.App.Metadata["--image-path"].(string)) {
+			return errors.Errorf("--image must be a local image")
+		}
+
+		if oldBefore != nil {
+			return oldBefore(ctx)
+		}
+		return nil
+	}
+	return cmd
+}
+
+// registryOptions returns the distribution.Options given by the flags added
+// by uxRegistry.
+func registryOptions(ctx *cli.Context) distribution.Options {
+	opt := distribution.Options{
+		PlainHTTP: ctx.Bool("plain-http"),
+	}
+	if netrc := ctx.String("netrc"); netrc != "" {
+		opt.Credentials = func(host string) (string, string, error) {
+			if hostname, _, err := net.SplitHostPort(host); err == nil {
+				host = hostname
+			}
+			return remote.LookupNetrc(netrc, host)
+		}
+	}
+	return opt
+}
+
+var pullCommand = uxRegistry(cli.Command{
+	Name:  "pull",
+	Usage: "pulls an image from a registry into an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>] <reference>
+
+Where "<image-path>" is the path to the OCI image (which is created if it
+doesn't exist), "<tag>" is the name of the tag that the pulled image will be
+saved as (if not specified, defaults to the tag in "<reference>", or "latest"
+if it has none), and "<reference>" refers to the image in a registry that
+implements the OCI distribution specification, of the form
+"<registry>/<repository>[:<tag>][@<digest>]".
+
+Every blob of the image is fetched (unless it is already present) and verified
+before the tag is created.`,
+
+	// pull creates a new image, with a given tag.
+	Category: "image",
+
+	Action: pull,
+})
+
+func pull(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	ref := ctx.App.Metadata["reference"].(distribution.Reference)
+
+	// The tag defaults to the tag in the reference, rather than "latest".
+	if !strings.Contains(ctx.String("image"), ":") && ref.Tag != "" {
+		tagName = ref.Tag
+	}
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
+		engineExt, err := umoci.CreateLayout(imagePath)
+		if err != nil {
+			return errors.Wrap(err, "create new image")
+		}
+		// #nosec G104
+		_ = engineExt.Close()
+		log.Infof("created new OCI image: %s", imagePath)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	client := distribution.NewClient(ref, registryOptions(ctx))
+	descriptor, err := client.Pull(cmdCtx, engine)
+	if err != nil {
+		return errors.Wrapf(err, "pull %s", ref)
+	}
+	log.WithFields(log.Fields{
+		"reference": ref.String(),
+		"manifest":  descriptor.Digest,
+	}).Info("pulled image")
+
+	if err := engineExt.UpdateReference(cmdCtx, tagName, descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
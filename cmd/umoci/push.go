@@ -0,0 +1,122 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/apex/log"
+	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/distribution"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var pushCommand = uxRegistry(cli.Command{
+	Name:  "push",
+	Usage: "pushes an image from an OCI image to a registry",
+	ArgsUsage: `--image <image-path>[:<tag>] <reference>
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to push (if not specified, defaults to "latest"), and
+"<reference>" refers to the repository in a registry that implements the OCI
+distribution specification, of the form
+"<registry>/<repository>[:<tag>][@<digest>]". If "<reference>" has no tag or
+digest, "<tag>" is used as the tag in the registry.
+
+Blobs which are already present in the registry are not uploaded again, and
+interrupted blob uploads are resumed.`,
+
+	// push only reads an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "chunk-size",
+			Usage: "upload blobs in requests of at most this size (such as 16MiB), rather than a single request",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("chunk-size") {
+			size, err := units.RAMInBytes(ctx.String("chunk-size"))
+			if err != nil {
+				return errors.Wrap(err, "invalid --chunk-size")
+			}
+			if size <= 0 {
+				return errors.Errorf("invalid --chunk-size: must be positive")
+			}
+		}
+		return nil
+	},
+
+	Action: push,
+})
+
+func push(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	tagName := ctx.App.Metadata["--image-tag"].(string)
+	ref := ctx.App.Metadata["reference"].(distribution.Reference)
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = tagName
+	}
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	// Get a reference to the CAS.
+	engine, err := openImageReadOnly(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptorPaths, err := engineExt.ResolveReference(cmdCtx, tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return errors.Errorf("tag not found: %s", tagName)
+	}
+	// The whole tagged blob is pushed, so if the tag refers to an index every
+	// manifest in the index is pushed.
+	descriptor := descriptorPaths[0].Root()
+	for _, descriptorPath := range descriptorPaths {
+		if descriptorPath.Root().Digest != descriptor.Digest {
+			// TODO: Handle this more nicely.
+			return errors.Errorf("tag is ambiguous: %s", tagName)
+		}
+	}
+
+	opt := registryOptions(ctx)
+	if ctx.IsSet("chunk-size") {
+		// This was already validated in Before.
+		opt.ChunkSize, _ = units.RAMInBytes(ctx.String("chunk-size"))
+	}
+
+	client := distribution.NewClient(ref, opt)
+	if err := client.Push(cmdCtx, engine, descriptor); err != nil {
+		return errors.Wrapf(err, "push %s", ref)
+	}
+	log.WithFields(log.Fields{
+		"reference": ref.String(),
+		"manifest":  descriptor.Digest,
+	}).Info("pushed image")
+	return nil
+}
@@ -24,7 +24,6 @@ import (
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/mutate"
-	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -81,7 +80,7 @@ func rawAddLayer(ctx *cli.Context) error {
 	meta.Version = umoci.MetaVersion
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -126,12 +125,12 @@ func rawAddLayer(ctx *cli.Context) error {
 
 	var history *ispec.History
 	if !ctx.Bool("no-history") {
-		created := time.Now()
+		created := defaultCreated()
 		history = &ispec.History{
 			Author:     imageMeta.Author,
 			Comment:    "",
 			Created:    &created,
-			CreatedBy:  "umoci raw add-layer", // XXX: Should we append argv to this?
+			CreatedBy:  historyCreatedBy(ctx),
 			EmptyLayer: false,
 		}
 
@@ -164,12 +163,17 @@ func rawAddLayer(ctx *cli.Context) error {
 		return errors.Wrap(err, "commit mutated image")
 	}
 
-	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
 
 	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
 		return errors.Wrap(err, "add new tag")
 	}
 
-	log.Infof("created new tag for image manifest: %s", tagName)
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
 	return nil
 }
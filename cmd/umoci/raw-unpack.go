@@ -22,7 +22,6 @@ import (
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci"
-	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/openSUSE/umoci/oci/layer"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -48,6 +47,23 @@ is the destination to unpack the image to.`,
 			Name:  "keep-dirlinks",
 			Usage: "don't clobber underlying symlinks to directories",
 		},
+		cli.BoolFlag{
+			Name:  "follow-symlinks",
+			Usage: "allow extracting through existing symlinks in parent paths (only use with trusted images)",
+		},
+		cli.BoolFlag{
+			Name:  "sparse",
+			Usage: "leave blocks of zeroes in regular files as holes rather than writing them",
+		},
+		cli.IntFlag{
+			Name:  "jobs, parallel",
+			Usage: "number of layers to decompress concurrently while unpacking",
+			Value: 1,
+		},
+		cli.BoolFlag{
+			Name:  "no-verify",
+			Usage: "only warn (rather than fail) if layer digests do not match while unpacking (only use with trusted image stores)",
+		},
 	},
 
 	Action: rawUnpack,
@@ -60,6 +76,9 @@ is the destination to unpack the image to.`,
 			return errors.Errorf("rootfs path cannot be empty")
 		}
 		ctx.App.Metadata["rootfs"] = ctx.Args().First()
+		if ctx.Int("jobs") < 1 {
+			return errors.Errorf("--jobs must be at least 1")
+		}
 		return nil
 	},
 })
@@ -79,10 +98,17 @@ func rawUnpack(ctx *cli.Context) error {
 		return err
 	}
 
-	meta.MapOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	unpackOptions := layer.UnpackOptions{
+		MapOptions:     meta.MapOptions,
+		KeepDirlinks:   ctx.Bool("keep-dirlinks"),
+		FollowSymlinks: ctx.Bool("follow-symlinks"),
+		Sparse:         ctx.Bool("sparse"),
+		Jobs:           ctx.Int("jobs"),
+		NoVerify:       ctx.Bool("no-verify"),
+	}
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImageReadOnly(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -126,7 +152,7 @@ func rawUnpack(ctx *cli.Context) error {
 	}
 
 	log.Warnf("unpacking rootfs ...")
-	if err := layer.UnpackRootfs(context.Background(), engineExt, rootfsPath, manifest, &meta.MapOptions, nil, ispec.Descriptor{}); err != nil {
+	if err := layer.UnpackRootfsWithOptions(context.Background(), engineExt, rootfsPath, manifest, &unpackOptions); err != nil {
 		return errors.Wrap(err, "create rootfs")
 	}
 	log.Warnf("... done")
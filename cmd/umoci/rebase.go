@@ -0,0 +1,128 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var rebaseCommand = uxHistory(uxTag(cli.Command{
+	Name:  "rebase",
+	Usage: "moves the layers of an image onto a different base image",
+	ArgsUsage: `--image <image-path>[:<tag>] --old-base <old-tag> --onto <new-tag> [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to rebase (if not specified, defaults to "latest"), "<old-tag>"
+is the tag of the base image that "<tag>" was built on, "<new-tag>" is the
+tag of the base image to move the layers of "<tag>" onto, and the resulting
+image is stored as the --tag (if not specified, defaults to "<tag>"). Both
+base images must be in "<image-path>".
+
+The layers of "<old-tag>" must be the bottom-most layers of "<tag>". They are
+replaced with the layers of "<new-tag>", and the history entries of
+"<old-tag>" are replaced with those of "<new-tag>". The rest of the image
+configuration is not modified.`,
+
+	// rebase modifies an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "old-base",
+			Usage: "tag of the base image which the image was built on",
+		},
+		cli.StringFlag{
+			Name:  "onto",
+			Usage: "tag of the base image to move the layers of the image onto",
+		},
+	},
+
+	Action: rebase,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if ctx.String("old-base") == "" {
+			return errors.Errorf("missing mandatory argument: --old-base")
+		}
+		if ctx.String("onto") == "" {
+			return errors.Errorf("missing mandatory argument: --onto")
+		}
+		return nil
+	},
+}))
+
+func rebase(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var history *ispec.History
+	if !ctx.Bool("no-history") {
+		created := defaultCreated()
+		history = &ispec.History{
+			Comment:    "",
+			Created:    &created,
+			CreatedBy:  historyCreatedBy(ctx),
+			EmptyLayer: true,
+		}
+
+		if ctx.IsSet("history.author") {
+			history.Author = ctx.String("history.author")
+		}
+		if ctx.IsSet("history.comment") {
+			history.Comment = ctx.String("history.comment")
+		}
+		if ctx.IsSet("history.created") {
+			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --history.created")
+			}
+			history.Created = &created
+		}
+		if ctx.IsSet("history.created_by") {
+			history.CreatedBy = ctx.String("history.created_by")
+		}
+	}
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	return umoci.Rebase(cmdCtx, engineExt, fromName, tagName, ctx.String("old-base"), ctx.String("onto"), history)
+}
@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/idtools"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var remapCommand = uxHistory(uxTag(cli.Command{
+	Name:  "remap",
+	Usage: "rewrites the ownership of every file in an image",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>] [--uid-map <old:new[:size]>...] [--gid-map <old:new[:size]>...]
+
+Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
+tagged image to remap (if not specified, defaults to "latest") and "<new-tag>"
+is the tag the resulting image will be stored as (if not specified, defaults
+to "<tag>").
+
+The owner of every entry in every layer of the image is rewritten according to
+the given mappings, where each mapping maps the "<size>" ids starting at
+"<old>" to the ids starting at "<new>". If no --uid-map (or --gid-map) is
+specified, the uids (or gids) are not modified. An entry owned by an id which
+is not covered by the mappings is an error, unless --keep-unmapped is
+specified (in which case its owner is left unchanged).`,
+
+	// remap modifies an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "uid-map",
+			Usage: "specifies a uid mapping to apply (old:new[:size])",
+		},
+		cli.StringSliceFlag{
+			Name:  "gid-map",
+			Usage: "specifies a gid mapping to apply (old:new[:size])",
+		},
+		cli.BoolFlag{
+			Name:  "keep-unmapped",
+			Usage: "leave the owner of entries outside of the mappings unchanged",
+		},
+	},
+
+	Action: remap,
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+}))
+
+func remap(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	opt := layer.RemapOptions{
+		KeepUnmapped: ctx.Bool("keep-unmapped"),
+	}
+	for _, uidmap := range ctx.StringSlice("uid-map") {
+		idMap, err := idtools.ParseMapping(uidmap)
+		if err != nil {
+			return errors.Wrapf(err, "failure parsing --uid-map %s", uidmap)
+		}
+		opt.UIDMappings = append(opt.UIDMappings, idMap)
+	}
+	for _, gidmap := range ctx.StringSlice("gid-map") {
+		idMap, err := idtools.ParseMapping(gidmap)
+		if err != nil {
+			return errors.Wrapf(err, "failure parsing --gid-map %s", gidmap)
+		}
+		opt.GIDMappings = append(opt.GIDMappings, idMap)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	var history *ispec.History
+	if !ctx.Bool("no-history") {
+		created := defaultCreated()
+		history = &ispec.History{
+			Comment:    "",
+			Created:    &created,
+			CreatedBy:  historyCreatedBy(ctx),
+			EmptyLayer: true,
+		}
+
+		if ctx.IsSet("history.author") {
+			history.Author = ctx.String("history.author")
+		}
+		if ctx.IsSet("history.comment") {
+			history.Comment = ctx.String("history.comment")
+		}
+		if ctx.IsSet("history.created") {
+			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
+			if err != nil {
+				return errors.Wrap(err, "parsing --history.created")
+			}
+			history.Created = &created
+		}
+		if ctx.IsSet("history.created_by") {
+			history.CreatedBy = ctx.String("history.created_by")
+		}
+	}
+
+	return umoci.Remap(engineExt, fromName, tagName, opt, history)
+}
@@ -21,20 +21,24 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/apex/log"
+	"github.com/docker/go-units"
 	"github.com/openSUSE/umoci"
 	"github.com/openSUSE/umoci/mutate"
-	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
+	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/openSUSE/umoci/pkg/remote"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
-	"golang.org/x/net/context"
 )
 
-var repackCommand = uxHistory(cli.Command{
+// repackNoChangesExitCode is the exit code of "umoci repack --dry-run" when
+// there are no changes to the rootfs.
+const repackNoChangesExitCode = 2
+
+var repackCommand = uxPlatform(uxRootless(uxHistory(cli.Command{
 	Name:  "repack",
 	Usage: "repacks an OCI runtime bundle into a reference",
 	ArgsUsage: `--image <image-path>[:<new-tag>] <bundle>
@@ -46,12 +50,16 @@ layers.
 
 The "<image-path>" MUST be the same image that was used to create "<bundle>"
 (using umoci-unpack(1)). Otherwise umoci will not be able to modify the
-original manifest to add the diff layer.
+original manifest to add the diff layer. Alternatively, --base can be used to
+name a different (but compatible) manifest in "<image-path>" to add the diff
+layer to instead.
 
 All uid-map and gid-map settings are automatically loaded from the bundle
 metadata (which is generated by umoci-unpack(1)) so if you unpacked an image
 using a particular mapping then the same mapping will be used to generate the
-new layer.
+new layer. If the bundle was unpacked in rootless mode but umoci is now running
+as root (or vice versa), repacking fails unless --rootless or --no-rootless is
+used to override the recorded mode.
 
 It should be noted that this is not the same as oci-create-layer because it
 uses go-mtree to create diff layers from runtime bundles unpacked with
@@ -66,6 +74,14 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "mask-path",
 			Usage: "set of path prefixes in which deltas will be ignored when generating new layers",
 		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "glob pattern of paths (and their children) which will be left out of the new layer, even if they have changed",
+		},
+		cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "glob pattern of paths (and their children) which will be included in the new layer, leaving out all other changes",
+		},
 		cli.BoolFlag{
 			Name:  "no-mask-volumes",
 			Usage: "do not add the Config.Volumes of the image to the set of masked paths",
@@ -74,6 +90,101 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			Name:  "refresh-bundle",
 			Usage: "update the bundle metadata to reflect the packed rootfs",
 		},
+		cli.StringFlag{
+			Name:  "perm-policy",
+			Usage: "comma-separated set of mode bits to clear from all entries in the new layer (such as no-group-write,no-other-write)",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "compression algorithm used for the new layer (gzip, zstd or none)",
+			Value: string(mutate.GzipCompression),
+		},
+		cli.StringFlag{
+			Name:  "compress-level",
+			Usage: "gzip compression level used for the new layer (1-9 or default)",
+			Value: "default",
+		},
+		cli.IntFlag{
+			Name:  "compress-jobs",
+			Usage: "number of blocks of the new layer to compress concurrently (defaults to twice the number of CPUs)",
+		},
+		cli.BoolFlag{
+			Name:  "non-distributable",
+			Usage: "add the new layer as a non-distributable layer",
+		},
+		cli.BoolFlag{
+			Name:  "sparse",
+			Usage: "add files with holes to the new layer as sparse entries",
+		},
+		cli.BoolFlag{
+			Name:  "squash",
+			Usage: "squash all of the image's layers (and the new layer) into a single layer",
+		},
+		cli.BoolFlag{
+			Name:  "allow-empty",
+			Usage: "add an empty layer if there are no changes to the rootfs (rather than only a history entry)",
+		},
+		cli.BoolFlag{
+			Name:  "no-clobber",
+			Usage: "fail if the target tag already exists, rather than replacing it",
+		},
+		cli.StringFlag{
+			Name:  "created",
+			Usage: "ISO-8601 creation time of the new image (also the default for --mtime)",
+		},
+		cli.StringFlag{
+			Name:  "mtime",
+			Usage: "clamp the mtime of all entries in the new layer (and the history entry creation time) to this ISO-8601 time (defaults to --created, or $SOURCE_DATE_EPOCH if set)",
+		},
+		cli.IntFlag{
+			Name:  "mtree-jobs",
+			Usage: "number of files to digest concurrently when computing the rootfs diff",
+			Value: 1,
+		},
+		cli.BoolFlag{
+			Name:  "mtree-cache",
+			Usage: "cache file digests in the bundle to speed up computing later rootfs diffs",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "abort the repack (without modifying the image) if it takes longer than this duration (such as 10m)",
+		},
+		cli.StringFlag{
+			Name:  "base",
+			Usage: "tag of the image to add the new layer to, rather than the image the bundle was unpacked from (which must be a prefix of its layers)",
+		},
+		cli.StringSliceFlag{
+			Name:  "manifest.annotation",
+			Usage: "name=value annotation to add to the new manifest (replacing the existing value of that annotation, if any)",
+		},
+		cli.BoolFlag{
+			Name:  "clear-annotations",
+			Usage: "remove all existing annotations of the manifest (before adding any --manifest.annotation)",
+		},
+		cli.StringSliceFlag{
+			Name:  "layer-annotation",
+			Usage: "name=value annotation to add to the descriptor of the new layer",
+		},
+		cli.StringSliceFlag{
+			Name:  "layer-url",
+			Usage: "http:// or https:// url the new layer can be fetched from, making it a foreign layer (can be specified multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "config.label",
+			Usage: "name=value label to set in the image configuration",
+		},
+		cli.StringFlag{
+			Name:  "docker-tag",
+			Usage: "also tag a Docker (v2, schema 2) variant of the new image manifest with this name",
+		},
+		cli.StringFlag{
+			Name:  "max-layer-size",
+			Usage: "split the new layer into several layers which are each at most this size uncompressed (such as 512MiB)",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "compute the new layer without modifying the image or its tags (exits with status 2 if there are no changes)",
+		},
 	},
 
 	Action: repack,
@@ -86,95 +197,263 @@ manifest and configuration information uses the new diff atop the old manifest.`
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if ctx.Int("mtree-jobs") < 1 {
+			return errors.Errorf("--mtree-jobs must be at least 1")
+		}
+		if ctx.Duration("timeout") < 0 {
+			return errors.Errorf("--timeout must not be negative")
+		}
+		if _, err := parseCreated(ctx); err != nil {
+			return err
+		}
+		if ctx.Bool("allow-empty") && ctx.Bool("squash") {
+			return errors.Errorf("--allow-empty and --squash are mutually exclusive")
+		}
+		if _, err := mutate.ParseCompression(ctx.String("compress")); err != nil {
+			return errors.Wrap(err, "invalid --compress")
+		}
+		if _, err := mutate.ParseCompressionLevel(ctx.String("compress-level")); err != nil {
+			return errors.Wrap(err, "invalid --compress-level")
+		}
+		if ctx.IsSet("compress-level") && ctx.String("compress") != string(mutate.GzipCompression) {
+			return errors.Errorf("--compress-level is only supported with --compress=gzip")
+		}
+		if ctx.IsSet("compress-jobs") {
+			if ctx.Int("compress-jobs") < 1 {
+				return errors.Errorf("--compress-jobs must be at least 1")
+			}
+			if ctx.String("compress") == string(mutate.NoCompression) {
+				return errors.Errorf("--compress-jobs cannot be used with --compress=none")
+			}
+		}
+		if _, err := mtreefilter.ExcludeFilter(ctx.StringSlice("exclude")); err != nil {
+			return errors.Wrap(err, "invalid --exclude")
+		}
+		if _, err := mtreefilter.IncludeFilter(ctx.StringSlice("include")); err != nil {
+			return errors.Wrap(err, "invalid --include")
+		}
+		if _, err := parseAnnotations(ctx.StringSlice("manifest.annotation")); err != nil {
+			return errors.Wrap(err, "invalid --manifest.annotation")
+		}
+		if _, err := parseAnnotations(ctx.StringSlice("layer-annotation")); err != nil {
+			return errors.Wrap(err, "invalid --layer-annotation")
+		}
+		for _, url := range ctx.StringSlice("layer-url") {
+			if !remote.IsURL(url) {
+				return errors.Errorf("invalid --layer-url: %q is not an http:// or https:// url", url)
+			}
+		}
+		if _, err := parseAnnotations(ctx.StringSlice("config.label")); err != nil {
+			return errors.Wrap(err, "invalid --config.label")
+		}
+		if ctx.IsSet("base") && ctx.String("base") == "" {
+			return errors.Errorf("--base cannot be empty")
+		}
+		if ctx.IsSet("max-layer-size") {
+			if _, err := parseMaxLayerSize(ctx); err != nil {
+				return err
+			}
+			if ctx.Bool("squash") {
+				return errors.Errorf("--max-layer-size cannot be used with --squash")
+			}
+			if ctx.Bool("dry-run") {
+				return errors.Errorf("--dry-run cannot be used with --max-layer-size")
+			}
+		}
+		if ctx.Bool("dry-run") {
+			for _, flag := range []string{"squash", "refresh-bundle"} {
+				if ctx.Bool(flag) {
+					return errors.Errorf("--dry-run cannot be used with --%s", flag)
+				}
+			}
+			if ctx.IsSet("docker-tag") {
+				return errors.Errorf("--dry-run cannot be used with --docker-tag")
+			}
+		}
+		if ctx.IsSet("docker-tag") {
+			tag := ctx.String("docker-tag")
+			if !casext.IsValidReferenceName(tag) {
+				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --docker-tag")
+			}
+			if tag == "" {
+				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --docker-tag")
+			}
+			if ctx.String("compress") != string(mutate.GzipCompression) {
+				return errors.Errorf("--docker-tag is only supported with --compress=gzip")
+			}
+		}
 		return nil
 	},
-})
+})))
 
 func repack(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 	bundlePath := ctx.App.Metadata["bundle"].(string)
 
-	// Read the metadata first.
-	meta, err := umoci.ReadBundleMeta(bundlePath)
+	rootless, err := umoci.ParseRootlessOverride(ctx)
 	if err != nil {
-		return errors.Wrap(err, "read umoci.json metadata")
+		return err
 	}
 
-	log.WithFields(log.Fields{
-		"version":     meta.Version,
-		"from":        meta.From,
-		"map_options": meta.MapOptions,
-	}).Debugf("umoci: loaded Meta metadata")
+	var permPolicy layer.PermPolicy
+	if ctx.IsSet("perm-policy") {
+		permPolicy, err = layer.ParsePermPolicy(ctx.String("perm-policy"))
+		if err != nil {
+			return errors.Wrap(err, "parse --perm-policy")
+		}
+	}
 
-	if meta.From.Descriptor().MediaType != ispec.MediaTypeImageManifest {
-		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType), "invalid saved from descriptor")
+	mtime, err := parseMtime(ctx)
+	if err != nil {
+		return err
 	}
 
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
 
-	// Create the mutator.
-	mutator, err := mutate.New(engineExt, meta.From)
-	if err != nil {
-		return errors.Wrap(err, "create mutator for base image")
-	}
+	// These were all already validated in Before.
+	annotations, _ := parseAnnotations(ctx.StringSlice("manifest.annotation"))
+	layerAnnotations, _ := parseAnnotations(ctx.StringSlice("layer-annotation"))
+	labels, _ := parseAnnotations(ctx.StringSlice("config.label"))
+	compression, _ := mutate.ParseCompression(ctx.String("compress"))
+	compressionLevel, _ := mutate.ParseCompressionLevel(ctx.String("compress-level"))
+	excludeFilter, _ := mtreefilter.ExcludeFilter(ctx.StringSlice("exclude"))
+	includeFilter, _ := mtreefilter.IncludeFilter(ctx.StringSlice("include"))
+	maxLayerSize, _ := parseMaxLayerSize(ctx)
+	created, _ := parseCreated(ctx)
 
-	// We need to mask config.Volumes.
-	config, err := mutator.Config(context.Background())
-	if err != nil {
-		return errors.Wrap(err, "get config")
+	opt := umoci.RepackOptions{
+		Base:                 ctx.String("base"),
+		Rootless:             rootless,
+		MaskPaths:            ctx.StringSlice("mask-path"),
+		NoMaskVolumes:        ctx.Bool("no-mask-volumes"),
+		Filters:              []mtreefilter.FilterFunc{includeFilter, excludeFilter},
+		PermPolicy:           permPolicy,
+		ClampMtime:           mtime,
+		Sparse:               ctx.Bool("sparse"),
+		Progress:             newProgress(),
+		Annotations:          annotations,
+		ClearAnnotations:     ctx.Bool("clear-annotations"),
+		LayerAnnotations:     layerAnnotations,
+		LayerURLs:            ctx.StringSlice("layer-url"),
+		Labels:               labels,
+		Created:              created,
+		Compression:          compression,
+		CompressionLevel:     compressionLevel,
+		CompressionJobs:      ctx.Int("compress-jobs"),
+		AllowUnknownPlatform: ctx.Bool("allow-unknown-arch"),
+		MtreeJobs:            ctx.Int("mtree-jobs"),
+		MtreeCache:           ctx.Bool("mtree-cache"),
+		RefreshBundle:        ctx.Bool("refresh-bundle"),
+		NonDistributable:     ctx.Bool("non-distributable"),
+		Squash:               ctx.Bool("squash"),
+		NoClobber:            ctx.Bool("no-clobber"),
+		AllowEmpty:           ctx.Bool("allow-empty"),
+		MaxLayerSize:         maxLayerSize,
+		DockerTag:            ctx.String("docker-tag"),
 	}
-
-	maskedPaths := ctx.StringSlice("mask-path")
-	if !ctx.Bool("no-mask-volumes") {
-		for v := range config.Volumes {
-			maskedPaths = append(maskedPaths, v)
-		}
+	if ctx.IsSet("os") {
+		osName := ctx.String("os")
+		opt.OS = &osName
 	}
-
-	imageMeta, err := mutator.Meta(context.Background())
-	if err != nil {
-		return errors.Wrap(err, "get image metadata")
+	// Aliases are tracked separately by IsSet.
+	if ctx.IsSet("architecture") || ctx.IsSet("arch") {
+		arch := ctx.String("architecture")
+		opt.Architecture = &arch
+	}
+	if ctx.IsSet("variant") {
+		variant := ctx.String("variant")
+		opt.Variant = &variant
 	}
 
-	var history *ispec.History
 	if !ctx.Bool("no-history") {
-		created := time.Now()
-		history = &ispec.History{
-			Author:     imageMeta.Author,
-			Comment:    "",
+		created := defaultCreated()
+		if mtime != nil {
+			created = *mtime
+		}
+		// An empty author is replaced with the author of the image.
+		opt.History = &ispec.History{
+			Author:     ctx.String("history.author"),
+			Comment:    ctx.String("history.comment"),
 			Created:    &created,
-			CreatedBy:  "umoci repack", // XXX: Should we append argv to this?
+			CreatedBy:  historyCreatedBy(ctx),
 			EmptyLayer: false,
 		}
-
-		if ctx.IsSet("history.author") {
-			history.Author = ctx.String("history.author")
-		}
-		if ctx.IsSet("history.comment") {
-			history.Comment = ctx.String("history.comment")
-		}
 		if ctx.IsSet("history.created") {
 			created, err := time.Parse(igen.ISO8601, ctx.String("history.created"))
 			if err != nil {
 				return errors.Wrap(err, "parsing --history.created")
 			}
-			history.Created = &created
+			opt.History.Created = &created
 		}
 		if ctx.IsSet("history.created_by") {
-			history.CreatedBy = ctx.String("history.created_by")
+			opt.History.CreatedBy = ctx.String("history.created_by")
 		}
 	}
 
-	filters := []mtreefilter.FilterFunc{
-		mtreefilter.MaskFilter(maskedPaths),
+	if ctx.Bool("dry-run") {
+		descriptor, err := umoci.RepackBundleDryRun(cmdCtx, engineExt, tagName, bundlePath, opt)
+		if err != nil {
+			return err
+		}
+		if descriptor == nil {
+			return cli.NewExitError("", repackNoChangesExitCode)
+		}
+		return nil
 	}
+	return umoci.RepackBundle(cmdCtx, engineExt, tagName, bundlePath, opt)
+}
 
-	return umoci.Repack(engineExt, tagName, bundlePath, meta, history, filters, ctx.Bool("refresh-bundle"), mutator)
+// parseMaxLayerSize returns the value of --max-layer-size in bytes, or 0 if it
+// is not set (meaning the new layer is not split).
+func parseMaxLayerSize(ctx *cli.Context) (int64, error) {
+	if !ctx.IsSet("max-layer-size") {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(ctx.String("max-layer-size"))
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid --max-layer-size")
+	}
+	if size < layer.MinSplitSize {
+		return 0, errors.Errorf("invalid --max-layer-size: must be at least %d bytes", layer.MinSplitSize)
+	}
+	return size, nil
+}
+
+// parseCreated returns the value of --created, or nil if it is not set.
+func parseCreated(ctx *cli.Context) (*time.Time, error) {
+	if !ctx.IsSet("created") {
+		return nil, nil
+	}
+	created, err := time.Parse(igen.ISO8601, ctx.String("created"))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing --created")
+	}
+	return &created, nil
+}
+
+// parseMtime returns the time that entries in a generated layer should be
+// clamped to, taken from --mtime or (if unset) --created or $SOURCE_DATE_EPOCH.
+// If none of them are set, nil is returned.
+func parseMtime(ctx *cli.Context) (*time.Time, error) {
+	if ctx.IsSet("mtime") {
+		mtime, err := time.Parse(igen.ISO8601, ctx.String("mtime"))
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing --mtime")
+		}
+		return &mtime, nil
+	}
+	if created, err := parseCreated(ctx); err != nil || created != nil {
+		return created, err
+	}
+	return sourceDateEpoch()
 }
@@ -0,0 +1,91 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var repairDiffIDsCommand = uxTag(cli.Command{
+	Name:  "repair-diffids",
+	Usage: "recomputes the rootfs.diff_ids of an image from its layers",
+	ArgsUsage: `--image <image-path>[:<tag>] [--tag <new-tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to repair (if not specified, defaults to "latest").
+"<new-tag>" is the new reference name to save the repaired image as, if this
+is not specified then umoci will replace the old image.
+
+Every layer of the image is decompressed and digested, and the rootfs.diff_ids
+of the image configuration are rewritten to match. Each incorrect diff_id is
+reported. If all of the diff_ids are already correct, the image is not
+modified.`,
+
+	// repair-diffids modifies an image.
+	Category: "image",
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		return nil
+	},
+
+	Action: repairDiffIDs,
+})
+
+func repairDiffIDs(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+	fromName := ctx.App.Metadata["--image-tag"].(string)
+
+	// By default we clobber the old tag.
+	tagName := fromName
+	if val, ok := ctx.App.Metadata["--tag"]; ok {
+		tagName = val.(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImage(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	repairs, err := umoci.RepairDiffIDs(engineExt, fromName, tagName)
+	if err != nil {
+		return errors.Wrap(err, "repair diff_ids")
+	}
+
+	for _, repair := range repairs {
+		switch {
+		case repair.Layer == "":
+			fmt.Printf("removed extra diff_id %s\n", repair.Old)
+		case repair.Old == "":
+			fmt.Printf("layer %s: added missing diff_id %s\n", repair.Layer, repair.New)
+		default:
+			fmt.Printf("layer %s: replaced diff_id %s with %s\n", repair.Layer, repair.Old, repair.New)
+		}
+	}
+	return nil
+}
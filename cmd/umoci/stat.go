@@ -23,7 +23,6 @@ import (
 	"os"
 
 	"github.com/openSUSE/umoci"
-	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -39,9 +38,14 @@ var statCommand = cli.Command{
 Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
 the tagged image to stat.
 
-WARNING: Do not depend on the output of this tool unless you're using --json.
-The intention of the default formatting of this tool is that it is easy for
-humans to read, and might change in future versions.`,
+If --format is specified, the status information is output either as a JSON
+encoded blob ("--format json", which is the same as --json) or by executing the
+given Go text/template (such as "--format '{{.Config.Env}}'") with the status
+information of each manifest.
+
+WARNING: Do not depend on the output of this tool unless you're using --json
+or --format. The intention of the default formatting of this tool is that it is
+easy for humans to read, and might change in future versions.`,
 
 	// stat gives information about a manifest.
 	Category: "image",
@@ -51,6 +55,37 @@ humans to read, and might change in future versions.`,
 			Name:  "json",
 			Usage: "output the stat information as a JSON encoded blob",
 		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output the stat information as a JSON encoded blob (json) or using the given Go template",
+		},
+		cli.BoolFlag{
+			Name:  "chain-ids",
+			Usage: "output the diff_id and chain_id of each layer rather than the history",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "only stat the manifest for the given platform (os/arch[/variant]) if the tag refers to an index",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.IsSet("format") {
+			if ctx.Bool("json") {
+				return errors.Errorf("--json and --format are mutually exclusive")
+			}
+			if format := ctx.String("format"); format != "json" {
+				if _, err := umoci.ParseStatTemplate(format); err != nil {
+					return errors.Wrap(err, "invalid --format")
+				}
+			}
+		}
+		if ctx.IsSet("platform") {
+			if _, err := casext.ParsePlatform(ctx.String("platform")); err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+		}
+		return nil
 	},
 
 	Action: stat,
@@ -61,7 +96,7 @@ func stat(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImageReadOnly(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -75,32 +110,69 @@ func stat(ctx *cli.Context) error {
 	if len(manifestDescriptorPaths) == 0 {
 		return errors.Errorf("tag not found: %s", tagName)
 	}
-	if len(manifestDescriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", tagName)
-	}
-	manifestDescriptor := manifestDescriptorPaths[0].Descriptor()
-
-	// FIXME: Implement support for manifest lists.
-	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
-		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid saved from descriptor")
+	// If the tag refers to an index, either restrict the output to the
+	// manifest for the requested platform or show all of them.
+	if ctx.IsSet("platform") {
+		// This was already validated in Before.
+		platform, _ := casext.ParsePlatform(ctx.String("platform"))
+		manifestDescriptorPaths = casext.SelectPlatform(manifestDescriptorPaths, platform)
+		if len(manifestDescriptorPaths) == 0 {
+			return errors.Errorf("tag has no manifest for platform %s: %s", ctx.String("platform"), tagName)
+		}
 	}
 
 	// Get stat information.
-	ms, err := umoci.Stat(context.Background(), engineExt, manifestDescriptor)
-	if err != nil {
-		return errors.Wrap(err, "stat")
+	var stats []umoci.ManifestStat
+	for _, manifestDescriptorPath := range manifestDescriptorPaths {
+		manifestDescriptor := manifestDescriptorPath.Descriptor()
+		if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+			return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType), "invalid saved from descriptor")
+		}
+		ms, err := umoci.Stat(context.Background(), engineExt, manifestDescriptor)
+		if err != nil {
+			return errors.Wrapf(err, "stat %s", manifestDescriptor.Digest)
+		}
+		stats = append(stats, ms)
 	}
 
 	// Output the stat information.
-	if ctx.Bool("json") {
-		// Use JSON.
-		if err := json.NewEncoder(os.Stdout).Encode(ms); err != nil {
+	if format := ctx.String("format"); format != "" && format != "json" {
+		// This was already validated in Before.
+		tmpl, _ := umoci.ParseStatTemplate(format)
+		for _, ms := range stats {
+			if err := ms.FormatTemplate(os.Stdout, tmpl); err != nil {
+				return errors.Wrap(err, "format stat")
+			}
+		}
+		return nil
+	}
+	if ctx.Bool("json") || ctx.String("format") == "json" {
+		// Use JSON. For backwards compatibility a single manifest is output
+		// as an object, while several manifests are output as an array.
+		var data interface{} = stats
+		if len(stats) == 1 {
+			data = stats[0]
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(data); err != nil {
 			return errors.Wrap(err, "encoding stat")
 		}
-	} else {
-		if err := ms.Format(os.Stdout); err != nil {
-			return errors.Wrap(err, "format stat")
+		return nil
+	}
+	for idx, ms := range stats {
+		if len(stats) > 1 {
+			if idx > 0 {
+				fmt.Fprintf(os.Stdout, "\n")
+			}
+			fmt.Fprintf(os.Stdout, "MANIFEST: %s\n", manifestDescriptorPaths[idx].Descriptor().Digest)
+		}
+		if ctx.Bool("chain-ids") {
+			if err := ms.FormatChainIDs(os.Stdout); err != nil {
+				return errors.Wrap(err, "format chain ids")
+			}
+		} else {
+			if err := ms.Format(os.Stdout); err != nil {
+				return errors.Wrap(err, "format stat")
+			}
 		}
 	}
 
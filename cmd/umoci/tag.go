@@ -19,10 +19,14 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/apex/log"
-	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
+	digest "github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/net/context"
@@ -34,11 +38,21 @@ var tagAddCommand = cli.Command{
 	ArgsUsage: `--image <image-path>[:<tag>] <new-tag>
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the old name of
-the tag and "<new-tag>" is the new name of the tag.`,
+the tag and "<new-tag>" is the new name of the tag.
+
+If "<new-tag>" already exists it is replaced, unless --no-clobber is
+specified.`,
 
 	// tag modifies an image layout.
 	Category: "image",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "no-clobber",
+			Usage: "fail rather than replacing an existing <new-tag>",
+		},
+	},
+
 	Action: tagAdd,
 
 	Before: func(ctx *cli.Context) error {
@@ -62,7 +76,7 @@ func tagAdd(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["new-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -84,8 +98,17 @@ func tagAdd(ctx *cli.Context) error {
 	descriptor := descriptorPaths[0].Descriptor()
 
 	// Add it.
-	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
-		return errors.Wrap(err, "put reference")
+	if ctx.Bool("no-clobber") {
+		if err := engineExt.AddReference(context.Background(), tagName, descriptor); err != nil {
+			if errors.Cause(err) == casext.ErrReferenceExists {
+				return errors.Errorf("refusing to clobber existing tag %s", tagName)
+			}
+			return errors.Wrap(err, "add reference")
+		}
+	} else {
+		if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+			return errors.Wrap(err, "put reference")
+		}
 	}
 
 	log.Infof("created new tag: %q -> %q", tagName, fromName)
@@ -113,7 +136,7 @@ func tagRemove(ctx *cli.Context) error {
 	tagName := ctx.App.Metadata["--image-tag"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImage(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -138,11 +161,20 @@ var tagListCommand = cli.Command{
 Where "<image-path>" is the path to the OCI layout.
 
 Gives the full list of tags in an OCI layout, with each tag name on a single
-line. See umoci-stat(1) to get more information about each tagged image.`,
+line. If --long is specified, the digest and size of the descriptor each tag
+refers to and the platforms of the images it contains are also output. See
+umoci-stat(1) to get more information about each tagged image.`,
 
 	// tag modifies an image layout.
 	Category: "layout",
 
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "long, l",
+			Usage: "also output the digest, size and platforms of each tag",
+		},
+	},
+
 	Action: tagList,
 }
 
@@ -150,7 +182,7 @@ func tagList(ctx *cli.Context) error {
 	imagePath := ctx.App.Metadata["--image-path"].(string)
 
 	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	engine, err := openImageReadOnly(ctx, imagePath)
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
@@ -162,8 +194,100 @@ func tagList(ctx *cli.Context) error {
 		return errors.Wrap(err, "list references")
 	}
 
+	if ctx.Bool("long") {
+		return tagListLong(context.Background(), engineExt, names)
+	}
 	for _, name := range names {
 		fmt.Println(name)
 	}
 	return nil
 }
+
+// tagListLong outputs a line for each descriptor referenced by the given tags,
+// containing the tag name, the digest and size of the descriptor, and the
+// platforms of the images reachable from it.
+func tagListLong(ctx context.Context, engineExt casext.Engine, names []string) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	seenNames := map[string]struct{}{}
+	for _, name := range names {
+		// Tags referring to several descriptors are listed once for each
+		// descriptor, so we only need to resolve each name once.
+		if _, ok := seenNames[name]; ok {
+			continue
+		}
+		seenNames[name] = struct{}{}
+
+		descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+		if err != nil {
+			return errors.Wrapf(err, "resolve reference %s", name)
+		}
+
+		var roots []ispec.Descriptor
+		platforms := map[digest.Digest][]string{}
+		for _, descriptorPath := range descriptorPaths {
+			root := descriptorPath.Root()
+			if _, ok := platforms[root.Digest]; !ok {
+				roots = append(roots, root)
+				platforms[root.Digest] = nil
+			}
+			platform, err := descriptorPlatform(ctx, engineExt, descriptorPath.Descriptor())
+			if err != nil {
+				return errors.Wrapf(err, "get platform of %s", name)
+			}
+			if platform != "" {
+				platforms[root.Digest] = append(platforms[root.Digest], platform)
+			}
+		}
+
+		for _, root := range roots {
+			platformList := "-"
+			if len(platforms[root.Digest]) > 0 {
+				platformList = strings.Join(platforms[root.Digest], ",")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", name, root.Digest, root.Size, platformList)
+		}
+	}
+	return tw.Flush()
+}
+
+// descriptorPlatform returns the platform (in the form used by --platform) of
+// the given descriptor. If the descriptor has no platform, the platform is
+// taken from the image configuration of the manifest it refers to. If the
+// platform is unknown, "" is returned.
+func descriptorPlatform(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor) (string, error) {
+	if descriptor.Platform != nil {
+		return casext.FormatPlatform(*descriptor.Platform), nil
+	}
+	if descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return "", nil
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return "", errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return "", errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Not an image configuration, so there's no platform information.
+		return "", nil
+	}
+	if config.OS == "" || config.Architecture == "" {
+		return "", nil
+	}
+	return casext.FormatPlatform(ispec.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+	}), nil
+}
@@ -18,10 +18,18 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
 	"github.com/openSUSE/umoci"
-	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/archive"
+	"github.com/openSUSE/umoci/oci/cas/web"
 	"github.com/openSUSE/umoci/oci/casext"
-	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openSUSE/umoci/oci/crypt"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/remote"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
@@ -33,11 +41,48 @@ var unpackCommand = uxRemap(cli.Command{
 
 Where "<image-path>" is the path to the OCI image, "<tag>" is the name of the
 tagged image to unpack (if not specified, defaults to "latest") and "<bundle>"
-is the destination to unpack the image to.
+is the destination to unpack the image to. "<image-path>" may also be an
+http:// or https:// URL of an OCI image layout (which is read directly), or
+of an oci-archive (a tar archive of an OCI image layout), which will be
+downloaded to a temporary directory for unpacking.
 
 It should be noted that this is not the same as oci-create-runtime-bundle,
 because this command also will create an mtree specification to allow for layer
-creation with umoci-repack(1).`,
+creation with umoci-repack(1).
+
+If --base is specified, only the files which differ from the root filesystem
+of the "--base" tag (in the same image) are unpacked, with removed files
+represented as whiteouts. Such bundles cannot be used with umoci-repack(1).
+By default the whiteouts are empty files with a ".wh." prefix (as in a layer),
+but with --whiteout-mode=overlayfs they are overlayfs whiteouts instead (so that
+the root filesystem can be used as a layer of an overlayfs mount).
+
+If --upto is specified, only the layers of the image up to (and including) the
+given layer are unpacked, so that the root filesystem is the root filesystem of
+the image at that layer. umoci-repack(1) of such a bundle drops the layers above
+it, adding the new layer directly on top of the given layer.
+
+If the tag refers to an index (such as a multi-platform image), the manifest for
+the platform given by --platform (or the platform of the running system, if not
+specified) is unpacked. umoci-repack(1) of such a bundle replaces that manifest
+in the index, leaving the manifests for other platforms unchanged.
+
+If --mode=overlay is specified, each layer is extracted into its own directory
+inside "<bundle>/layers" and the root filesystem is assembled by mounting an
+overlayfs on "<bundle>/rootfs" (using "<bundle>/upper" as the upper directory),
+which is done by running the "<bundle>/mount-rootfs" helper script.
+umoci-repack(1) of such a bundle generates the new layer directly from the
+upper directory rather than computing a diff of the root filesystem.
+
+Encrypted layers (see umoci-encrypt(1)) are decrypted while unpacking using the
+private keys given with --decryption-key. Unpacking fails if none of the keys
+can decrypt one of the layers.
+
+If --fetch-foreign-layers is specified, the blobs of foreign layers (layers with
+urls) which are missing from the image are fetched from their urls (using the
+--http-header and --netrc options) and verified. The fetched blobs are added to
+"<image-path>" if it is an image layout directory, and are otherwise only used
+for unpacking.`,
 
 	// unpack reads manifest information.
 	Category: "image",
@@ -47,6 +92,66 @@ creation with umoci-repack(1).`,
 			Name:  "keep-dirlinks",
 			Usage: "don't clobber underlying symlinks to directories",
 		},
+		cli.BoolFlag{
+			Name:  "follow-symlinks",
+			Usage: "allow extracting through existing symlinks in parent paths (only use with trusted images)",
+		},
+		cli.BoolFlag{
+			Name:  "sparse",
+			Usage: "leave blocks of zeroes in regular files as holes rather than writing them",
+		},
+		cli.IntFlag{
+			Name:  "jobs, parallel",
+			Usage: "number of layers to decompress concurrently while unpacking",
+			Value: 1,
+		},
+		cli.BoolFlag{
+			Name:  "no-verify",
+			Usage: "only warn (rather than fail) if layer digests do not match while unpacking (only use with trusted image stores)",
+		},
+		cli.StringSliceFlag{
+			Name:  "decryption-key",
+			Usage: "path to a private key used to decrypt encrypted layers (can be specified multiple times)",
+		},
+		cli.BoolFlag{
+			Name:  "fetch-foreign-layers",
+			Usage: "fetch missing foreign layers from their urls",
+		},
+		cli.StringSliceFlag{
+			Name:  "http-header",
+			Usage: "extra header (of the form 'name: value') to use when fetching an --image URL or foreign layers",
+		},
+		cli.StringFlag{
+			Name:  "netrc",
+			Usage: "path to a netrc file used for credentials when fetching an --image URL or foreign layers",
+		},
+		cli.StringFlag{
+			Name:  "base",
+			Usage: "only unpack the changes relative to this tag (the bundle cannot be repacked)",
+		},
+		cli.StringFlag{
+			Name:  "upto",
+			Usage: "only unpack the layers up to (and including) this layer, given as a 1-based index or a layer digest",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "unpack the manifest for the given platform (os/arch[/variant]) if the tag refers to an index",
+		},
+		cli.StringFlag{
+			Name:  "whiteout-mode",
+			Usage: "how whiteouts are represented in a --base bundle ([oci] or overlayfs)",
+			Value: "oci",
+		},
+		cli.StringFlag{
+			Name:  "mode",
+			Usage: "how to unpack the root filesystem ([extract] or overlay)",
+			Value: "extract",
+		},
+		cli.StringFlag{
+			Name:  "symlink-policy",
+			Usage: "which symlinks to create when unpacking (all, no-absolute or relative-only)",
+			Value: "all",
+		},
 	},
 
 	Action: unpack,
@@ -59,6 +164,56 @@ creation with umoci-repack(1).`,
 			return errors.Errorf("bundle path cannot be empty")
 		}
 		ctx.App.Metadata["bundle"] = ctx.Args().First()
+		if ctx.Int("jobs") < 1 {
+			return errors.Errorf("--jobs must be at least 1")
+		}
+
+		if ctx.IsSet("base") {
+			tag := ctx.String("base")
+			if !casext.IsValidReferenceName(tag) {
+				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --base")
+			}
+			if tag == "" {
+				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --base")
+			}
+		}
+		if ctx.IsSet("upto") {
+			if ctx.String("upto") == "" {
+				return errors.Wrap(fmt.Errorf("layer is empty"), "invalid --upto")
+			}
+			if ctx.IsSet("base") {
+				return errors.Errorf("--upto cannot be used with --base")
+			}
+		}
+		if ctx.IsSet("platform") {
+			if _, err := casext.ParsePlatform(ctx.String("platform")); err != nil {
+				return errors.Wrap(err, "invalid --platform")
+			}
+		}
+		if _, err := layer.ParseSymlinkPolicy(ctx.String("symlink-policy")); err != nil {
+			return errors.Wrap(err, "invalid --symlink-policy")
+		}
+		if _, err := layer.ParseWhiteoutMode(ctx.String("whiteout-mode")); err != nil {
+			return errors.Wrap(err, "invalid --whiteout-mode")
+		}
+		if ctx.IsSet("whiteout-mode") && !ctx.IsSet("base") {
+			return errors.Errorf("--whiteout-mode can only be used with --base")
+		}
+		if ctx.String("whiteout-mode") == "overlayfs" && ctx.Bool("rootless") {
+			return errors.Errorf("--whiteout-mode=overlayfs cannot be used with --rootless")
+		}
+		switch mode := ctx.String("mode"); mode {
+		case "extract":
+		case "overlay":
+			if ctx.IsSet("base") {
+				return errors.Errorf("--mode=overlay cannot be used with --base")
+			}
+			if ctx.Bool("rootless") {
+				return errors.Errorf("--mode=overlay cannot be used with --rootless")
+			}
+		default:
+			return errors.Errorf("invalid --mode: %q", mode)
+		}
 		return nil
 	},
 })
@@ -77,14 +232,101 @@ func unpack(ctx *cli.Context) error {
 		return err
 	}
 
-	meta.MapOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	// These options only affect this unpack, so they aren't saved in the
+	// bundle metadata along with meta.MapOptions.
+	var unpackOptions layer.UnpackOptions
+	unpackOptions.KeepDirlinks = ctx.Bool("keep-dirlinks")
+	unpackOptions.FollowSymlinks = ctx.Bool("follow-symlinks")
+	unpackOptions.Sparse = ctx.Bool("sparse")
+	unpackOptions.SymlinkPolicy, err = layer.ParseSymlinkPolicy(ctx.String("symlink-policy"))
+	if err != nil {
+		return errors.Wrap(err, "parse --symlink-policy")
+	}
+	unpackOptions.Jobs = ctx.Int("jobs")
+	unpackOptions.NoVerify = ctx.Bool("no-verify")
+	for _, path := range ctx.StringSlice("decryption-key") {
+		key, err := crypt.LoadPrivateKey(path)
+		if err != nil {
+			return errors.Wrap(err, "load --decryption-key")
+		}
+		unpackOptions.DecryptionKeys = append(unpackOptions.DecryptionKeys, key)
+	}
+	unpackOptions.WhiteoutMode, err = layer.ParseWhiteoutMode(ctx.String("whiteout-mode"))
+	if err != nil {
+		return errors.Wrap(err, "parse --whiteout-mode")
+	}
+	if ctx.IsSet("platform") {
+		platform, err := casext.ParsePlatform(ctx.String("platform"))
+		if err != nil {
+			return errors.Wrap(err, "parse --platform")
+		}
+		unpackOptions.Platform = &platform
+	}
+	if ctx.Bool("fetch-foreign-layers") {
+		opt, err := remoteOptions(ctx)
+		if err != nil {
+			return err
+		}
+		unpackOptions.ForeignLayers = &opt
+	}
+
+	// Fetch the layout if we were given a URL of an oci-archive (image
+	// layouts published at a URL are used directly).
+	if remote.IsURL(imagePath) {
+		opt, err := remoteOptions(ctx)
+		if err != nil {
+			return err
+		}
+		if engine, err := web.OpenReadOnly(imagePath, opt); err == nil {
+			engine.Close()
+		} else if errors.Cause(err) == cas.ErrInvalid {
+			layoutPath, err := ioutil.TempDir("", "umoci-remote-")
+			if err != nil {
+				return errors.Wrap(err, "create remote layout directory")
+			}
+			defer os.RemoveAll(layoutPath)
+
+			if err := remote.FetchLayout(imagePath, layoutPath, opt); err != nil {
+				return errors.Wrap(err, "fetch remote layout")
+			}
+			imagePath = layoutPath
+		} else {
+			return errors.Wrap(err, "open remote layout")
+		}
+
+		if ctx.Bool("strict-spec") {
+			if err := checkStrictSpec(ctx, imagePath, fromName); err != nil {
+				return err
+			}
+		}
+	}
 
-	// Get a reference to the CAS.
-	engine, err := dir.Open(imagePath)
+	// Get a reference to the CAS. Fetched foreign layers are added to image
+	// layout directories, so they need to be opened for writing.
+	var engine cas.Engine
+	if unpackOptions.ForeignLayers != nil && !remote.IsURL(imagePath) && !archive.IsArchive(imagePath) {
+		engine, err = openImage(ctx, imagePath)
+	} else {
+		engine, err = openImageReadOnly(ctx, imagePath)
+	}
 	if err != nil {
 		return errors.Wrap(err, "open CAS")
 	}
 	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
-	return umoci.Unpack(engineExt, fromName, bundlePath, meta.MapOptions, nil, ispec.Descriptor{})
+
+	unpackOptions.MapOptions = meta.MapOptions
+	if ctx.IsSet("base") {
+		return umoci.UnpackDelta(engineExt, fromName, ctx.String("base"), bundlePath, unpackOptions)
+	}
+	if ctx.IsSet("upto") {
+		unpackOptions.UpTo, err = umoci.ResolveUnpackUpTo(engineExt, fromName, ctx.String("upto"), unpackOptions.Platform)
+		if err != nil {
+			return errors.Wrap(err, "resolve --upto")
+		}
+	}
+	if ctx.String("mode") == "overlay" {
+		return umoci.UnpackOverlay(engineExt, fromName, bundlePath, unpackOptions)
+	}
+	return umoci.UnpackWithOptions(engineExt, fromName, bundlePath, unpackOptions)
 }
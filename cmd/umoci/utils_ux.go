@@ -19,11 +19,23 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/archive"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/cas/web"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/remote"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"golang.org/x/net/context"
 )
 
 func flattenCommands(cmds []cli.Command) []*cli.Command {
@@ -35,6 +47,33 @@ func flattenCommands(cmds []cli.Command) []*cli.Command {
 	return flatten
 }
 
+// sourceDateEpoch returns the time given by $SOURCE_DATE_EPOCH (as a number of
+// seconds since the Unix epoch), or nil if it is not set. This is used as the
+// default for timestamps so that builds can be reproducible.
+func sourceDateEpoch() (*time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing $SOURCE_DATE_EPOCH")
+	}
+	t := time.Unix(seconds, 0).UTC()
+	return &t, nil
+}
+
+// defaultCreated returns the creation time of new history entries (if
+// --history.created was not specified) and images, which is
+// $SOURCE_DATE_EPOCH (if set) or the current time.
+func defaultCreated() time.Time {
+	// This was already validated in uxHistory's Before.
+	if epoch, _ := sourceDateEpoch(); epoch != nil {
+		return *epoch
+	}
+	return time.Now()
+}
+
 // uxHistory adds the full set of --history.* flags to the given cli.Command as
 // well as adding relevant validation logic to the .Before of the command. The
 // values will be stored in ctx.Metadata with the keys "--history.author",
@@ -56,11 +95,15 @@ func uxHistory(cmd cli.Command) cli.Command {
 		},
 		cli.StringFlag{
 			Name:  "history.created",
-			Usage: "created value for the history entry",
+			Usage: "created value for the history entry (defaults to $SOURCE_DATE_EPOCH if set, otherwise the current time)",
 		},
 		cli.StringFlag{
 			Name:  "history.created_by",
-			Usage: "created_by value for the history entry",
+			Usage: "created_by value for the history entry (defaults to the umoci command-line)",
+		},
+		cli.StringSliceFlag{
+			Name:  "history.redact",
+			Usage: "name of a flag whose value is redacted from the default created_by value",
 		},
 	}
 	cmd.Flags = append(cmd.Flags, historyFlags...)
@@ -77,6 +120,9 @@ func uxHistory(cmd cli.Command) cli.Command {
 				}
 			}
 		}
+		if _, err := sourceDateEpoch(); err != nil {
+			return err
+		}
 
 		// Include any old befores set.
 		if oldBefore != nil {
@@ -88,6 +134,60 @@ func uxHistory(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// historyCreatedBy returns the default created_by value for a history entry
+// generated by the current command, which is the full umoci command-line as a
+// shell-quoted string. The values of any flags named with --history.redact are
+// replaced with redactedString, as are the values of --scrub-history (which
+// would otherwise leak the secrets being scrubbed into the new entry).
+func historyCreatedBy(ctx *cli.Context) string {
+	redact := map[string]struct{}{
+		"scrub-history": {},
+	}
+	for _, name := range ctx.StringSlice("history.redact") {
+		redact[strings.TrimLeft(name, "-")] = struct{}{}
+	}
+
+	words := []string{"umoci"}
+	args := os.Args[1:]
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		if arg == "--" {
+			// Everything after "--" is a positional argument.
+			for _, arg := range args[idx:] {
+				words = append(words, shellQuote(arg))
+			}
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg || name == "" {
+			words = append(words, shellQuote(arg))
+			continue
+		}
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			if _, ok := redact[name[:eq]]; ok {
+				arg = arg[:len(arg)-len(name)+eq+1] + redactedString
+			}
+			words = append(words, shellQuote(arg))
+			continue
+		}
+		words = append(words, shellQuote(arg))
+		if _, ok := redact[name]; ok && idx+1 < len(args) {
+			words = append(words, redactedString)
+			idx++
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// shellQuote quotes the given word so that it would be parsed as a single
+// word by a POSIX shell. Words which don't need to be quoted are left as-is.
+func shellQuote(word string) string {
+	if word != "" && strings.Trim(word, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=.,/:@%[]") == "" {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'"'"'`, -1) + "'"
+}
+
 // uxTag adds a --tag flag to the given cli.Command as well as adding relevant
 // validation logic to the .Before of the command. The value will be stored in
 // ctx.Metadata["--tag"] as a string (or nil if --tag was not specified).
@@ -121,6 +221,42 @@ func uxTag(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// parseImageRef parses an image reference of the form "path[:tag]" (where
+// the tag defaults to "latest"), and verifies that both components are valid.
+func parseImageRef(image string) (string, string, error) {
+	var dir, tag string
+	sep := strings.Index(image, ":")
+	if remote.IsURL(image) {
+		// URLs contain colons of their own, so the tag can only be
+		// after the final path component.
+		sep = strings.LastIndex(image, ":")
+		if sep < strings.LastIndex(image, "/") {
+			sep = -1
+		}
+	}
+	if sep == -1 {
+		dir = image
+		tag = "latest"
+	} else {
+		dir = image[:sep]
+		tag = image[sep+1:]
+	}
+
+	// Verify directory value.
+	if dir == "" {
+		return "", "", errors.Errorf("path is empty")
+	}
+
+	// Verify tag value.
+	if !casext.IsValidReferenceName(tag) {
+		return "", "", errors.Errorf("tag contains invalid characters: '%s'", tag)
+	}
+	if tag == "" {
+		return "", "", errors.Errorf("tag is empty")
+	}
+	return dir, tag, nil
+}
+
 // uxImage adds an --image flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The values (image,
 // tag) will be stored in ctx.Metadata["--image-path"] and
@@ -130,6 +266,9 @@ func uxImage(cmd cli.Command) cli.Command {
 	cmd.Flags = append(cmd.Flags, cli.StringFlag{
 		Name:  "image",
 		Usage: "OCI image URI of the form 'path[:tag]'",
+	}, cli.BoolFlag{
+		Name:  "strict-spec",
+		Usage: "refuse to operate on images that use features not supported by umoci",
 	})
 
 	oldBefore := cmd.Before
@@ -138,31 +277,20 @@ func uxImage(cmd cli.Command) cli.Command {
 		if ctx.IsSet("image") {
 			image := ctx.String("image")
 
-			var dir, tag string
-			sep := strings.Index(image, ":")
-			if sep == -1 {
-				dir = image
-				tag = "latest"
-			} else {
-				dir = image[:sep]
-				tag = image[sep+1:]
-			}
-
-			// Verify directory value.
-			if dir == "" {
-				return errors.Wrap(fmt.Errorf("path is empty"), "invalid --image")
-			}
-
-			// Verify tag value.
-			if !casext.IsValidReferenceName(tag) {
-				return errors.Wrap(fmt.Errorf("tag contains invalid characters: '%s'", tag), "invalid --image")
-			}
-			if tag == "" {
-				return errors.Wrap(fmt.Errorf("tag is empty"), "invalid --image")
+			dir, tag, err := parseImageRef(image)
+			if err != nil {
+				return errors.Wrap(err, "invalid --image")
 			}
 
 			ctx.App.Metadata["--image-path"] = dir
 			ctx.App.Metadata["--image-tag"] = tag
+
+			// Remote images are checked once they've been fetched.
+			if ctx.Bool("strict-spec") && !remote.IsURL(dir) {
+				if err := checkStrictSpec(ctx, dir, tag); err != nil {
+					return err
+				}
+			}
 		}
 
 		if oldBefore != nil {
@@ -174,6 +302,84 @@ func uxImage(cmd cli.Command) cli.Command {
 	return cmd
 }
 
+// lockOptions returns the options for opening an image, as configured by the
+// global --lock-timeout, --no-lock and --digest-algorithm flags.
+func lockOptions(ctx *cli.Context) dir.OpenOptions {
+	return dir.OpenOptions{
+		LockTimeout:   ctx.GlobalDuration("lock-timeout"),
+		NoLock:        ctx.GlobalBool("no-lock"),
+		BlobAlgorithm: digest.Algorithm(ctx.GlobalString("digest-algorithm")),
+	}
+}
+
+// openImage opens the OCI image layout at the given path for writing. Only
+// one process can have an image open for writing at a time, so this waits for
+// any other process to finish using the image (for at most --lock-timeout, if
+// it was specified).
+func openImage(ctx *cli.Context, imagePath string) (cas.Engine, error) {
+	return dir.OpenWithOptions(imagePath, lockOptions(ctx))
+}
+
+// remoteOptions returns the options for fetching an --image URL, as
+// configured by the --http-header and --netrc flags (if the command has them).
+func remoteOptions(ctx *cli.Context) (remote.Options, error) {
+	opt := remote.Options{
+		Headers:   http.Header{},
+		NetrcPath: ctx.String("netrc"),
+	}
+	for _, header := range ctx.StringSlice("http-header") {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return remote.Options{}, errors.Errorf("invalid --http-header: %q", header)
+		}
+		opt.Headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return opt, nil
+}
+
+// openImageReadOnly opens the OCI image at the given path read-only. The path
+// may either be an image layout directory, an (uncompressed) tar archive of
+// an image layout such as those created by "skopeo copy oci-archive:", or an
+// http:// or https:// URL of an image layout. Any number of processes can read
+// an image layout directory at the same time, but this waits for any process
+// modifying it to finish (for at most --lock-timeout, if it was specified).
+func openImageReadOnly(ctx *cli.Context, imagePath string) (cas.Engine, error) {
+	if remote.IsURL(imagePath) {
+		opt, err := remoteOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return web.OpenReadOnly(imagePath, opt)
+	}
+	if archive.IsArchive(imagePath) {
+		return archive.OpenReadOnly(imagePath)
+	}
+	return dir.OpenReadOnlyWithOptions(imagePath, lockOptions(ctx))
+}
+
+// checkStrictSpec checks that the image referenced by the given tag does not
+// use any features unsupported by umoci (see umoci.CheckSupported). If the tag
+// doesn't exist, there is nothing to check.
+func checkStrictSpec(ctx *cli.Context, imagePath, tagName string) error {
+	engine, err := openImageReadOnly(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), tagName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	for _, descriptorPath := range descriptorPaths {
+		if err := umoci.CheckSupported(context.Background(), engineExt, descriptorPath.Root()); err != nil {
+			return errors.Wrap(err, "--strict-spec")
+		}
+	}
+	return nil
+}
+
 // uxLayout adds an --layout flag to the given cli.Command as well as adding
 // relevant validation logic to the .Before of the command. The value is stored
 // in ctx.App.Metadata["--image-path"] as a string (or nil --layout was not set).
@@ -219,10 +425,21 @@ func uxRemap(cmd cli.Command) cli.Command {
 			Name:  "gid-map",
 			Usage: "specifies a gid mapping to use (container:host:size)",
 		},
+	}...)
+
+	return uxRootless(cmd)
+}
+
+func uxRootless(cmd cli.Command) cli.Command {
+	cmd.Flags = append(cmd.Flags, []cli.Flag{
 		cli.BoolFlag{
 			Name:  "rootless",
 			Usage: "enable rootless command support",
 		},
+		cli.BoolFlag{
+			Name:  "no-rootless",
+			Usage: "disable rootless command support",
+		},
 	}...)
 
 	return cmd
@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/openSUSE/umoci"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/remote"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+var verifyCommand = cli.Command{
+	Name:  "verify",
+	Usage: "verifies the consistency of an OCI image",
+	ArgsUsage: `--image <image-path>[:<tag>]
+
+Where "<image-path>" is the path to the OCI image, and "<tag>" is the name of
+the tagged image to verify (if not specified, every image in the layout is
+verified).
+
+Every blob reachable from the index of the image is read, and checked to match
+the digest and size of the descriptors referencing it. The number of layers of
+each manifest is checked against the number of rootfs.diff_ids and non-empty
+history entries of its configuration. Every problem found is reported, and
+umoci will exit with a non-zero exit status if there were any problems.
+
+If --diff-ids is specified, every layer is also decompressed to check that its
+DiffID matches the rootfs.diff_ids of the configuration. If --orphans is
+specified (and no tag was given), every blob which is not reachable from the
+index of the image is reported as a problem (including whether it matches its
+digest).`,
+
+	// verify only reads an image.
+	Category: "image",
+
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "diff-ids",
+			Usage: "also decompress every layer to check its DiffID",
+		},
+		cli.BoolFlag{
+			Name:  "orphans",
+			Usage: "also report blobs which are not referenced by any image (if no tag was given)",
+		},
+	},
+
+	Before: func(ctx *cli.Context) error {
+		if ctx.NArg() != 0 {
+			return errors.Errorf("invalid number of positional arguments: expected none")
+		}
+		if remote.IsURL(ctx.App.Metadata["--image-path"].(string)) {
+			return errors.Errorf("--image must be a local image")
+		}
+		return nil
+	},
+
+	Action: verify,
+}
+
+func verify(ctx *cli.Context) error {
+	imagePath := ctx.App.Metadata["--image-path"].(string)
+
+	// Unlike other commands, the whole image is verified unless a tag was
+	// explicitly specified.
+	var tagName string
+	if strings.Contains(ctx.String("image"), ":") {
+		tagName = ctx.App.Metadata["--image-tag"].(string)
+	}
+
+	// Get a reference to the CAS.
+	engine, err := openImageReadOnly(ctx, imagePath)
+	if err != nil {
+		return errors.Wrap(err, "open CAS")
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	opt := umoci.VerifyOptions{
+		DiffIDs: ctx.Bool("diff-ids"),
+		Orphans: ctx.Bool("orphans"),
+	}
+	problems, err := umoci.VerifyWithOptions(context.Background(), engineExt, tagName, opt)
+	if err != nil {
+		return errors.Wrap(err, "verify image")
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("verify: found %d problem(s) in image", len(problems)), 1)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"crypto/rsa"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Encrypt encrypts every layer of the image referenced by fromName for the
+// given recipients (see mutate.Mutator.EncryptLayers), and tags the result as
+// tagName. Since no layers are added, history (if non-nil) is added to the
+// image as an empty layer entry.
+func Encrypt(ctx context.Context, engineExt casext.Engine, fromName string, tagName string, recipients []*rsa.PublicKey, history *ispec.History) error {
+	return mapImageLayers(ctx, engineExt, fromName, tagName, history, "encrypt", func(mutator *mutate.Mutator) error {
+		return mutator.EncryptLayers(ctx, recipients)
+	})
+}
+
+// Decrypt decrypts every encrypted layer of the image referenced by fromName
+// using the given private keys (see mutate.Mutator.DecryptLayers), and tags
+// the result as tagName. Since no layers are added, history (if non-nil) is
+// added to the image as an empty layer entry.
+func Decrypt(ctx context.Context, engineExt casext.Engine, fromName string, tagName string, keys []*rsa.PrivateKey, history *ispec.History) error {
+	return mapImageLayers(ctx, engineExt, fromName, tagName, history, "decrypt", func(mutator *mutate.Mutator) error {
+		return mutator.DecryptLayers(ctx, keys)
+	})
+}
+
+// mapImageLayers modifies the layers of the image referenced by fromName with
+// fn, and tags the result as tagName.
+func mapImageLayers(ctx context.Context, engineExt casext.Engine, fromName string, tagName string, history *ispec.History, action string, fn func(*mutate.Mutator) error) error {
+	fromDescriptorPaths, err := engineExt.ResolveReference(ctx, fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag is not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engineExt, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	log.Infof("%sing layers ...", action)
+	if err := fn(mutator); err != nil {
+		return errors.Wrapf(err, "%s layers", action)
+	}
+	log.Info("... done")
+
+	if history != nil {
+		config, err := mutator.Config(ctx)
+		if err != nil {
+			return err
+		}
+
+		imageMeta, err := mutator.Meta(ctx)
+		if err != nil {
+			return err
+		}
+
+		annotations, err := mutator.Annotations(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := mutator.Set(ctx, config, imageMeta, annotations, history); err != nil {
+			return errors.Wrap(err, "add history")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if err := engineExt.UpdateReference(ctx, tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
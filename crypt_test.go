@@ -0,0 +1,123 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/crypt"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func imageLayers(t *testing.T, engineExt casext.Engine, name string) []ispec.Descriptor {
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("expected %s to resolve to 1 image, got %d", name, len(descriptorPaths))
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := mutator.Layers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layers
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEncryptDecrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc/secret"), []byte("hunter2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Encrypt(ctx, engineExt, "latest", "encrypted", []*rsa.PublicKey{&key.PublicKey}, &ispec.History{Comment: "encrypted"}); err != nil {
+		t.Fatalf("unexpected error encrypting image: %+v", err)
+	}
+	for _, layerDescriptor := range imageLayers(t, engineExt, "encrypted") {
+		if !crypt.IsEncrypted(layerDescriptor.MediaType) {
+			t.Errorf("layer %s is not encrypted: %s", layerDescriptor.Digest, layerDescriptor.MediaType)
+		}
+	}
+
+	// Unpacking requires the key.
+	if err := Unpack(engineExt, "encrypted", filepath.Join(root, "bundle-nokey"), layer.MapOptions{}, nil, ispec.Descriptor{}); err == nil {
+		t.Errorf("expected error unpacking encrypted image without a key")
+	}
+	for _, jobs := range []int{0, 2} {
+		bundle := filepath.Join(root, fmt.Sprintf("bundle-%d", jobs))
+		opt := layer.UnpackOptions{DecryptionKeys: []*rsa.PrivateKey{key}, Jobs: jobs}
+		if err := UnpackWithOptions(engineExt, "encrypted", bundle, opt); err != nil {
+			t.Fatalf("unexpected error unpacking encrypted image (jobs=%d): %+v", jobs, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(bundle, layer.RootfsName, "etc/secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hunter2" {
+			t.Errorf("unexpected contents of unpacked file (jobs=%d): %q", jobs, data)
+		}
+	}
+
+	// Decrypting results in the original layers.
+	if err := Decrypt(ctx, engineExt, "encrypted", "decrypted", []*rsa.PrivateKey{key}, nil); err != nil {
+		t.Fatalf("unexpected error decrypting image: %+v", err)
+	}
+	if expected, got := imageLayers(t, engineExt, "latest"), imageLayers(t, engineExt, "decrypted"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("decrypted layers don't match original: expected %+v got %+v", expected, got)
+	}
+}
@@ -0,0 +1,298 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/apex/log"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// Delta computes the filesystem delta between the image referenced by
+// fromName (in fromEngine) and the image referenced by toName (in toEngine),
+// and writes it to w as an uncompressed tar layer. The layer contains every
+// entry which was added or modified in the second image, as well as whiteouts
+// for every entry removed. Adding the layer on top of the first image results
+// in the same root filesystem as the second image.
+//
+// Both images are extracted to temporary directories (using mapOptions),
+// which are removed before returning.
+func Delta(fromEngine casext.Engine, fromName string, toEngine casext.Engine, toName string, mapOptions layer.MapOptions, w io.Writer) error {
+	fromManifest, err := resolveManifest(fromEngine, fromName)
+	if err != nil {
+		return errors.Wrap(err, "resolve from image")
+	}
+	toManifest, err := resolveManifest(toEngine, toName)
+	if err != nil {
+		return errors.Wrap(err, "resolve to image")
+	}
+
+	return computeDelta(fromEngine, fromManifest, toEngine, toManifest, mapOptions, func(delta io.Reader, _ string) error {
+		_, err := io.Copy(w, delta)
+		return errors.Wrap(err, "write delta layer")
+	})
+}
+
+// computeDelta extracts both images to a temporary directory, and calls fn
+// with the delta layer between them as well as the path of the extracted root
+// filesystem of the second image. The temporary directory is removed once fn
+// returns.
+func computeDelta(fromEngine casext.Engine, fromManifest ispec.Manifest, toEngine casext.Engine, toManifest ispec.Manifest, mapOptions layer.MapOptions, fn func(delta io.Reader, toRootfs string) error) error {
+	fsEval := mapFsEval(mapOptions)
+
+	tempDir, err := ioutil.TempDir("", "umoci-delta-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary directory")
+	}
+	defer fsEval.RemoveAll(tempDir)
+
+	// The second root filesystem is named layer.RootfsName, so that it can be
+	// used to generate a runtime configuration.
+	fromRootfs := filepath.Join(tempDir, "from")
+	toRootfs := filepath.Join(tempDir, layer.RootfsName)
+
+	log.Info("unpacking from image ...")
+	if err := layer.UnpackRootfs(context.Background(), fromEngine, fromRootfs, fromManifest, &mapOptions, nil, ispec.Descriptor{}); err != nil {
+		return errors.Wrap(err, "unpack from image")
+	}
+	log.Info("unpacking to image ...")
+	if err := layer.UnpackRootfs(context.Background(), toEngine, toRootfs, toManifest, &mapOptions, nil, ispec.Descriptor{}); err != nil {
+		return errors.Wrap(err, "unpack to image")
+	}
+	log.Info("... done")
+
+	log.Info("computing filesystem diff ...")
+	spec, err := mtree.Walk(fromRootfs, nil, MtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "generate mtree spec")
+	}
+	diffs, err := mtree.Check(toRootfs, spec, MtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "check mtree")
+	}
+	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.SimplifyFilter(diffs))
+	log.Info("... done")
+
+	log.WithFields(log.Fields{
+		"ndiff": len(diffs),
+	}).Debugf("umoci: computed delta")
+
+	reader, err := layer.GenerateLayer(context.Background(), toRootfs, diffs, &mapOptions)
+	if err != nil {
+		return errors.Wrap(err, "generate delta layer")
+	}
+	defer reader.Close()
+
+	return fn(reader, toRootfs)
+}
+
+// resolveManifest returns the manifest referenced by the (unambiguous) tag
+// name in the given image.
+func resolveManifest(engineExt casext.Engine, name string) (ispec.Manifest, error) {
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), name)
+	if err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return ispec.Manifest{}, errors.Errorf("tag is not found: %s", name)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return ispec.Manifest{}, errors.Errorf("tag is ambiguous: %s", name)
+	}
+	return descriptorManifest(engineExt, descriptorPaths[0].Descriptor())
+}
+
+// descriptorManifest returns the image manifest the descriptor refers to.
+func descriptorManifest(engineExt casext.Engine, descriptor ispec.Descriptor) (ispec.Manifest, error) {
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), descriptor)
+	if err != nil {
+		return ispec.Manifest{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	if manifestBlob.Descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Manifest{}, errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType), "invalid tag")
+	}
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Manifest{}, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+	return manifest, nil
+}
+
+// ApplyDelta adds the delta layer read from patch (as generated by Delta) on
+// top of the image referenced by fromName, and tags the result as tagName.
+// The patch may either be an uncompressed or a gzip-compressed tar archive,
+// and is validated before the image is modified. If expect is non-empty, it
+// is the expected ChainID of the top-most layer of the resulting image (see
+// mutate.ChainIDs) and tagName is only updated if the ChainID matches.
+func ApplyDelta(engineExt casext.Engine, fromName string, tagName string, patch io.ReadSeeker, history *ispec.History, expect digest.Digest) error {
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag is not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engineExt, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	// Validate the entire patch before adding it, so that we don't end up
+	// adding garbage to the image.
+	if err := validateDelta(patch); err != nil {
+		return errors.Wrap(err, "validate delta layer")
+	}
+	if _, err := patch.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek delta layer")
+	}
+	patchReader, err := openDelta(patch)
+	if err != nil {
+		return errors.Wrap(err, "open delta layer")
+	}
+	defer patchReader.Close()
+
+	if err := mutator.Add(context.Background(), patchReader, history); err != nil {
+		return errors.Wrap(err, "add delta layer")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if expect != "" {
+		chainID, err := topChainID(engineExt, newDescriptorPath.Descriptor())
+		if err != nil {
+			return errors.Wrap(err, "compute chain id")
+		}
+		if chainID != expect {
+			return errors.Errorf("resulting image does not match expected chain id: expected %s, got %s", expect, chainID)
+		}
+		log.Infof("resulting image matches expected chain id: %s", expect)
+	}
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
+
+// openDelta returns a reader for the uncompressed contents of the given delta
+// layer, decompressing it if it was gzip-compressed.
+func openDelta(patch io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(patch)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		return gzr, nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// validateDelta verifies that the given delta layer is a (possibly
+// gzip-compressed) tar archive.
+func validateDelta(patch io.Reader) error {
+	patchReader, err := openDelta(patch)
+	if err != nil {
+		return err
+	}
+	defer patchReader.Close()
+
+	tr := tar.NewReader(patchReader)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "not a valid tar archive")
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return errors.Wrap(err, "not a valid tar archive")
+		}
+	}
+	return nil
+}
+
+// topChainID returns the ChainID of the top-most layer of the given manifest.
+func topChainID(engineExt casext.Engine, manifestDescriptor ispec.Descriptor) (digest.Digest, error) {
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), manifestDescriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return "", errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	configBlob, err := engineExt.FromDescriptor(context.Background(), manifest.Config)
+	if err != nil {
+		return "", errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		// Should _never_ be reached.
+		return "", errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+	}
+
+	chainIDs := mutate.ChainIDs(config)
+	if len(chainIDs) == 0 {
+		return "", errors.Errorf("image has no layers")
+	}
+	return chainIDs[len(chainIDs)-1], nil
+}
@@ -0,0 +1,252 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestApplyDelta(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestApplyDelta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	base := putTestManifest(t, engineExt, []ispec.Descriptor{}, 0)
+	if err := engineExt.UpdateReference(ctx, "base", base); err != nil {
+		t.Fatal(err)
+	}
+
+	var patch bytes.Buffer
+	tw := tar.NewWriter(&patch)
+	content := "patched file"
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(content)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The only layer is the patch, so its ChainID is its DiffID.
+	chainID := digest.FromBytes(patch.Bytes())
+
+	var gzipPatch bytes.Buffer
+	gzw := gzip.NewWriter(&gzipPatch)
+	if _, err := gzw.Write(patch.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		patch  []byte
+		expect digest.Digest
+		fail   bool
+	}{
+		{name: "Uncompressed", patch: patch.Bytes()},
+		{name: "Gzip", patch: gzipPatch.Bytes()},
+		{name: "Expect", patch: patch.Bytes(), expect: chainID},
+		{name: "ExpectMismatch", patch: patch.Bytes(), expect: digest.FromString("wrong"), fail: true},
+		{name: "Invalid", patch: []byte("this is not a tar archive"), fail: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tagName := "new-" + test.name
+			err := ApplyDelta(engineExt, "base", tagName, bytes.NewReader(test.patch), nil, test.expect)
+			descriptorPaths, resolveErr := engineExt.ResolveReference(ctx, tagName)
+			if resolveErr != nil {
+				t.Fatal(resolveErr)
+			}
+			if test.fail {
+				if err == nil {
+					t.Errorf("expected error applying delta")
+				}
+				if len(descriptorPaths) != 0 {
+					t.Errorf("tag %s was created despite failure", tagName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if len(descriptorPaths) != 1 {
+				t.Fatalf("expected tag %s to be created, got %d descriptors", tagName, len(descriptorPaths))
+			}
+
+			gotChainID, err := topChainID(engineExt, descriptorPaths[0].Descriptor())
+			if err != nil {
+				t.Fatalf("unexpected error getting chain id: %+v", err)
+			}
+			if gotChainID != chainID {
+				t.Errorf("unexpected chain id: expected %s, got %s", chainID, gotChainID)
+			}
+		})
+	}
+}
+
+// putPlatformIndex packs a manifest for each of the given architectures (whose
+// root filesystem is created by populate) and tags an index containing all of
+// them as tagName.
+func putPlatformIndex(t *testing.T, engineExt casext.Engine, root, tagName string, archs []string, populate func(rootfs, arch string) error) []ispec.Descriptor {
+	var manifests []ispec.Descriptor
+	for _, arch := range archs {
+		rootfs := filepath.Join(root, tagName+"-rootfs-"+arch)
+		if err := os.MkdirAll(rootfs, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := populate(rootfs, arch); err != nil {
+			t.Fatal(err)
+		}
+		archTag := tagName + "-" + arch
+		if err := Pack(engineExt, archTag, rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: arch}, layer.MapOptions{}, nil); err != nil {
+			t.Fatalf("unexpected error packing rootfs: %+v", err)
+		}
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), archTag)
+		if err != nil || len(descriptorPaths) != 1 {
+			t.Fatalf("unexpected error resolving %s: %+v", archTag, err)
+		}
+		descriptor := descriptorPaths[0].Descriptor()
+		descriptor.Annotations = nil
+		descriptor.Platform = &ispec.Platform{OS: "linux", Architecture: arch}
+		manifests = append(manifests, descriptor)
+	}
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: manifests,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), tagName, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return manifests
+}
+
+func TestUnpackDeltaPlatformIndex(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackDeltaPlatformIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	// The arch file must be identical (including its mtime) in both images,
+	// so that it is not part of the delta.
+	writeArch := func(rootfs, arch string) error {
+		path := filepath.Join(rootfs, "arch")
+		if err := ioutil.WriteFile(path, []byte(arch), 0644); err != nil {
+			return err
+		}
+		epoch := time.Unix(0, 0)
+		return os.Chtimes(path, epoch, epoch)
+	}
+
+	archs := []string{"amd64", "arm64"}
+	bases := putPlatformIndex(t, engineExt, root, "base", archs, writeArch)
+	latests := putPlatformIndex(t, engineExt, root, "latest", archs, func(rootfs, arch string) error {
+		if err := writeArch(rootfs, arch); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(rootfs, "new-"+arch), []byte(arch), 0644)
+	})
+
+	// Unpacking a platform which isn't in the indexes must fail.
+	if err := UnpackDelta(engineExt, "latest", "base", filepath.Join(root, "bundle-s390x"), layer.UnpackOptions{Platform: &ispec.Platform{OS: "linux", Architecture: "s390x"}}); err == nil {
+		t.Errorf("expected error unpacking missing platform")
+	}
+
+	for idx, arch := range archs {
+		t.Run(arch, func(t *testing.T) {
+			bundle := filepath.Join(root, "bundle-"+arch)
+			if err := UnpackDelta(engineExt, "latest", "base", bundle, layer.UnpackOptions{Platform: latests[idx].Platform}); err != nil {
+				t.Fatalf("unexpected error unpacking delta: %+v", err)
+			}
+
+			// Only the file added for this platform is in the delta.
+			entries, err := ioutil.ReadDir(filepath.Join(bundle, layer.RootfsName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "new-"+arch {
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("unexpected delta contents: expected [new-%s], got %v", arch, names)
+			}
+
+			meta, err := ReadBundleMeta(bundle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := meta.From.Descriptor().Digest; got != latests[idx].Digest {
+				t.Errorf("unexpected from manifest: expected %s, got %s", latests[idx].Digest, got)
+			}
+			if meta.Base == nil || meta.Base.Descriptor().Digest != bases[idx].Digest {
+				t.Errorf("unexpected base manifest: expected %s, got %v", bases[idx].Digest, meta.Base)
+			}
+			if meta.Platform == nil || meta.Platform.Architecture != arch {
+				t.Errorf("unexpected bundle platform: expected %s, got %v", arch, meta.Platform)
+			}
+		})
+	}
+}
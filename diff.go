@@ -0,0 +1,163 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// Diff computes the set of changes made to the rootfs of the bundle at
+// bundlePath, relative to the mtree manifest saved when the bundle was
+// unpacked (or last refreshed). This is the same set of changes that RepackBundle
+// would use to generate a new layer, after applying the given filters. The
+// returned deltas are sorted by path. mtreeJobs is the number of files which
+// will be digested concurrently (see CheckMtree). If mtreeCache is set, the
+// digests of unchanged files are cached in the bundle (see MtreeCache) so
+// that later calls don't need to re-hash them. If progress is non-nil, it is
+// called as each file is digested. If ctx is cancelled, the diff is aborted
+// (see CheckMtree).
+func Diff(ctx context.Context, bundlePath string, meta Meta, filters []mtreefilter.FilterFunc, mtreeJobs int, mtreeCache bool, progress layer.ProgressFunc) ([]mtree.InodeDelta, error) {
+	if meta.Overlay {
+		return nil, errors.Errorf("bundle was unpacked with --mode=overlay and has no mtree manifest: its changes are in %s", filepath.Join(bundlePath, OverlayUpperName))
+	}
+
+	mtreeName := bundleMtreeName(meta.From.Descriptor().Digest)
+	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+
+	log.WithFields(log.Fields{
+		"bundle": bundlePath,
+		"rootfs": layer.RootfsName,
+		"mtree":  mtreePath,
+	}).Debugf("umoci: computing bundle diff")
+
+	mfh, err := os.Open(mtreePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open mtree")
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse mtree")
+	}
+
+	keywords := meta.mtreeKeywords()
+	log.WithFields(log.Fields{
+		"keywords": keywords,
+	}).Debugf("umoci: parsed mtree spec")
+
+	if err := checkMtreeKeywords(spec, keywords); err != nil {
+		return nil, errors.Wrap(err, "check mtree keywords")
+	}
+
+	fsEval := mapFsEval(meta.MapOptions)
+
+	var cache *MtreeCache
+	cachePath := filepath.Join(bundlePath, MtreeCacheName)
+	if mtreeCache {
+		cache = LoadMtreeCache(cachePath, keywords)
+	}
+
+	log.Info("computing filesystem diff ...")
+	diffs, err := CheckMtree(ctx, fullRootfsPath, spec, keywords, fsEval, mtreeJobs, cache, progress)
+	if err != nil {
+		return nil, errors.Wrap(err, "check mtree")
+	}
+	log.Info("... done")
+
+	if cache != nil {
+		// The cache is only an optimisation, so failing to save it is not
+		// fatal.
+		if err := cache.Save(cachePath); err != nil {
+			log.Warnf("failed to save mtree cache: %v", err)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"ndiff": len(diffs),
+	}).Debugf("umoci: checked mtree spec")
+
+	allFilters := append(filters, mtreefilter.SimplifyFilter(diffs))
+	return mtreefilter.FilterDeltas(diffs, allFilters...), nil
+}
+
+// specKeywords returns the set of keywords that were used to generate spec.
+// This is taken from the "keywords" header written by go-mtree if it is
+// present, otherwise it is the set of keywords used by the entries in spec
+// (which may be a subset of the keywords used to generate it, as not every
+// keyword applies to every inode). The returned bool is whether the header was
+// present.
+func specKeywords(spec *mtree.DirectoryHierarchy) ([]mtree.Keyword, bool) {
+	for _, e := range spec.Entries {
+		if e.Type != mtree.CommentType {
+			continue
+		}
+		comment := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(e.Raw), "#"))
+		if !strings.HasPrefix(comment, "keywords:") {
+			continue
+		}
+		var keywords []mtree.Keyword
+		for _, kw := range strings.Split(strings.TrimPrefix(comment, "keywords:"), ",") {
+			if kw = strings.TrimSpace(kw); kw != "" {
+				keywords = append(keywords, mtree.KeywordSynonym(kw))
+			}
+		}
+		return keywords, true
+	}
+	return spec.UsedKeywords(), false
+}
+
+// checkMtreeKeywords verifies that spec was generated with the given set of
+// keywords. Checking a spec against a different set of keywords produces
+// spurious (or missing) changes, which would result in an incorrect layer
+// being generated.
+func checkMtreeKeywords(spec *mtree.DirectoryHierarchy, keywords []mtree.Keyword) error {
+	var expected []mtree.Keyword
+	for _, kw := range keywords {
+		expected = append(expected, mtree.KeywordSynonym(string(kw)))
+	}
+
+	used, exact := specKeywords(spec)
+	mismatch := false
+	for _, kw := range used {
+		if !mtree.InKeywordSlice(kw, expected) {
+			mismatch = true
+		}
+	}
+	if exact {
+		for _, kw := range expected {
+			if !mtree.InKeywordSlice(kw, used) {
+				mismatch = true
+			}
+		}
+	}
+	if mismatch {
+		return errors.Errorf("bundle was created with different mtree keywords (%s) than expected (%s): re-create the bundle with umoci-unpack", strings.Join(mtree.FromKeywords(used), ","), strings.Join(mtree.FromKeywords(keywords), ","))
+	}
+	return nil
+}
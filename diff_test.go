@@ -0,0 +1,176 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+func TestDiff(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestDiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	for _, dir := range []string{"etc", "var/cache"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"etc/modify", "etc/remove"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, file), []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A freshly unpacked bundle has no changes.
+	diffs, err := Diff(context.Background(), bundle, meta, nil, 1, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("unexpected changes in unmodified bundle: %v", diffs)
+	}
+
+	bundleRootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := ioutil.WriteFile(filepath.Join(bundleRootfs, "etc/modify"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(bundleRootfs, "etc/remove")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundleRootfs, "etc/add"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundleRootfs, "var/cache/masked"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err = Diff(context.Background(), bundle, meta, []mtreefilter.FilterFunc{mtreefilter.MaskFilter([]string{"/var"})}, 1, false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error computing diff: %+v", err)
+	}
+	got := map[string]mtree.DifferenceType{}
+	for _, delta := range diffs {
+		got[delta.Path()] = delta.Type()
+	}
+	for path, expected := range map[string]mtree.DifferenceType{
+		"etc/add":    mtree.Extra,
+		"etc/modify": mtree.Modified,
+		"etc/remove": mtree.Missing,
+	} {
+		if got[path] != expected {
+			t.Errorf("%s: expected %q change, got %q", path, expected, got[path])
+		}
+	}
+	for path := range got {
+		if path == "var/cache/masked" || path == "var/cache" {
+			t.Errorf("%s: masked path was included in diff", path)
+		}
+	}
+}
+
+func TestDiffMtreeKeywords(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestDiffMtreeKeywords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc/file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keywords recorded at unpack time are used.
+	if _, err := Diff(context.Background(), bundle, meta, nil, 1, false, nil); err != nil {
+		t.Errorf("unexpected error computing diff: %+v", err)
+	}
+
+	// Bundles with no recorded keywords fall back to MtreeKeywords.
+	legacyMeta := meta
+	legacyMeta.Provenance = nil
+	if _, err := Diff(context.Background(), bundle, legacyMeta, nil, 1, false, nil); err != nil {
+		t.Errorf("unexpected error computing diff of legacy bundle: %+v", err)
+	}
+
+	// If the keywords don't match the mtree manifest, the diff is rejected.
+	for _, keywords := range [][]mtree.Keyword{
+		MtreeKeywords[1:],
+		append(append([]mtree.Keyword{}, MtreeKeywords...), "md5digest"),
+	} {
+		badMeta := meta
+		badMeta.Provenance = &Provenance{Reference: "latest", MtreeKeywords: keywords}
+		if _, err := Diff(context.Background(), bundle, badMeta, nil, 1, false, nil); err == nil {
+			t.Errorf("expected error computing diff with keywords %v", keywords)
+		}
+	}
+}
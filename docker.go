@@ -0,0 +1,135 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/casext/mediatype"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// dockerLayerMediaTypes maps the OCI layer media types which have a Docker
+// equivalent to their Docker media type. Docker has no equivalent for
+// uncompressed or zstd-compressed layers.
+var dockerLayerMediaTypes = map[string]string{
+	ispec.MediaTypeImageLayerGzip:                 mediatype.DockerLayerGzip,
+	ispec.MediaTypeImageLayerNonDistributableGzip: mediatype.DockerForeignLayerGzip,
+}
+
+// dockerDescriptor returns a copy of the given descriptor with the given media
+// type. Annotations and platform information are dropped, since they are not
+// part of the Docker format.
+func dockerDescriptor(descriptor ispec.Descriptor, mediaType string) ispec.Descriptor {
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    descriptor.Digest,
+		Size:      descriptor.Size,
+		URLs:      descriptor.URLs,
+	}
+}
+
+// DockerManifest translates the OCI image manifest referenced by
+// manifestDescriptor into an equivalent Docker image manifest (v2, schema 2),
+// adds it to the image and returns its descriptor. The Docker manifest
+// references the same configuration and layer blobs as the OCI manifest (only
+// the media types differ), and the OCI manifest is not modified. An error is
+// returned if any of the layers use a compression format that cannot be
+// represented in a Docker manifest.
+func DockerManifest(ctx context.Context, engineExt casext.Engine, manifestDescriptor ispec.Descriptor) (ispec.Descriptor, error) {
+	if manifestDescriptor.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestDescriptor.MediaType)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, manifestDescriptor)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return ispec.Descriptor{}, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		return ispec.Descriptor{}, errors.Errorf("config has unsupported media type %s", manifest.Config.MediaType)
+	}
+	dockerManifest := mediatype.DockerManifestBlob{
+		SchemaVersion: 2,
+		MediaType:     mediatype.DockerManifest,
+		Config:        dockerDescriptor(manifest.Config, mediatype.DockerConfig),
+		Layers:        []ispec.Descriptor{},
+	}
+	for _, layerDescriptor := range manifest.Layers {
+		mediaType, ok := dockerLayerMediaTypes[layerDescriptor.MediaType]
+		if !ok {
+			return ispec.Descriptor{}, errors.Errorf("layer %s has media type %s which has no docker equivalent", layerDescriptor.Digest, layerDescriptor.MediaType)
+		}
+		dockerManifest.Layers = append(dockerManifest.Layers, dockerDescriptor(layerDescriptor, mediaType))
+	}
+
+	dockerDigest, dockerSize, err := engineExt.PutBlobJSON(ctx, dockerManifest)
+	if err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "put docker manifest blob")
+	}
+
+	log.WithFields(log.Fields{
+		"oci":    manifestDescriptor.Digest,
+		"docker": dockerDigest,
+	}).Debugf("umoci: created docker manifest")
+
+	return ispec.Descriptor{
+		MediaType: mediatype.DockerManifest,
+		Digest:    dockerDigest,
+		Size:      dockerSize,
+	}, nil
+}
+
+// TagDockerManifest creates a Docker image manifest (see DockerManifest) for
+// the OCI image manifest referenced by fromName, and tags it as tagName
+// (replacing any existing tag with that name). fromName is left untouched.
+func TagDockerManifest(ctx context.Context, engineExt casext.Engine, fromName string, tagName string) error {
+	fromDescriptorPaths, err := engineExt.ResolveReference(ctx, fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag is not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	dockerDescriptor, err := DockerManifest(ctx, engineExt, fromDescriptorPaths[0].Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "create docker manifest")
+	}
+	if err := engineExt.UpdateReference(ctx, tagName, dockerDescriptor); err != nil {
+		return errors.Wrap(err, "add docker tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for docker image manifest")
+	return nil
+}
@@ -0,0 +1,523 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/config/convert"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// dockerArchiveManifestFile is the file in a "docker save" archive which lists
+// the images stored in the archive.
+const dockerArchiveManifestFile = "manifest.json"
+
+// dockerArchiveImage is an entry in the manifest.json of a "docker save"
+// archive. All paths are relative to the root of the archive.
+type dockerArchiveImage struct {
+	// Config is the path of the Docker image configuration.
+	Config string `json:"Config"`
+
+	// RepoTags are the names (of the form name:tag) of the image.
+	RepoTags []string `json:"RepoTags"`
+
+	// Layers are the paths of the (uncompressed) layers of the image, from
+	// the bottom-most layer upwards.
+	Layers []string `json:"Layers"`
+}
+
+// dockerArchiveEntry is the location of the contents of a regular file in a
+// "docker save" archive.
+type dockerArchiveEntry struct {
+	offset, size int64
+}
+
+// dockerArchive is an opened "docker save" archive.
+type dockerArchive struct {
+	path    string
+	fh      *os.File
+	entries map[string]dockerArchiveEntry
+}
+
+// openDockerArchive opens the "docker save" archive at the given path, and
+// records where the contents of every regular file are stored.
+func openDockerArchive(archivePath string) (*dockerArchive, error) {
+	fh, err := os.Open(archivePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open archive")
+	}
+	da := &dockerArchive{
+		path:    archivePath,
+		fh:      fh,
+		entries: map[string]dockerArchiveEntry{},
+	}
+
+	tr := tar.NewReader(fh)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fh.Close()
+			return nil, errors.Wrap(err, "read archive")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// The tar reader does not buffer, so the current offset of the file
+		// is the start of the entry's contents.
+		offset, err := fh.Seek(0, io.SeekCurrent)
+		if err != nil {
+			fh.Close()
+			return nil, errors.Wrap(err, "get archive offset")
+		}
+		da.entries[dockerArchiveName(hdr.Name)] = dockerArchiveEntry{offset: offset, size: hdr.Size}
+	}
+	return da, nil
+}
+
+// dockerArchiveName returns the cleaned path of an archive entry, relative to
+// the root of the archive.
+func dockerArchiveName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// open returns a reader for the contents of the given file in the archive.
+func (da *dockerArchive) open(name string) (*io.SectionReader, error) {
+	ent, ok := da.entries[dockerArchiveName(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: da.path + ":" + name, Err: os.ErrNotExist}
+	}
+	return io.NewSectionReader(da.fh, ent.offset, ent.size), nil
+}
+
+// readJSON parses the given JSON file in the archive into v.
+func (da *dockerArchive) readJSON(name string, v interface{}) error {
+	rdr, err := da.open(name)
+	if err != nil {
+		return err
+	}
+	return errors.Wrapf(json.NewDecoder(rdr).Decode(v), "parse %s", name)
+}
+
+// Close closes the archive.
+func (da *dockerArchive) Close() error {
+	return da.fh.Close()
+}
+
+// dockerRepoTag returns repoTag with an explicit tag ("latest" if it has none),
+// which is how names are stored in a "docker save" archive.
+func dockerRepoTag(repoTag string) string {
+	if !strings.Contains(repoTag[strings.LastIndex(repoTag, "/")+1:], ":") {
+		repoTag += ":latest"
+	}
+	return repoTag
+}
+
+// selectImage returns the image in the archive with the given name. If repoTag
+// is empty, the archive must contain exactly one image.
+func (da *dockerArchive) selectImage(repoTag string) (dockerArchiveImage, error) {
+	var images []dockerArchiveImage
+	if err := da.readJSON(dockerArchiveManifestFile, &images); err != nil {
+		return dockerArchiveImage{}, errors.Wrap(err, "read docker archive manifest")
+	}
+	if repoTag == "" {
+		if len(images) != 1 {
+			return dockerArchiveImage{}, errors.Errorf("archive contains %d images: the image to import must be named", len(images))
+		}
+		return images[0], nil
+	}
+	repoTag = dockerRepoTag(repoTag)
+	for _, image := range images {
+		for _, name := range image.RepoTags {
+			if name == repoTag {
+				return image, nil
+			}
+		}
+	}
+	return dockerArchiveImage{}, errors.Errorf("archive does not contain image %s", repoTag)
+}
+
+// openLayer returns a reader for the uncompressed contents of the given layer
+// in the archive. Layers are usually stored uncompressed, but some tools
+// produce archives with gzip-compressed layers.
+func (da *dockerArchive) openLayer(name string) (io.ReadCloser, error) {
+	rdr, err := da.open(name)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewReader(rdr)
+	if magic, err := buf.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzr, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		return gzr, nil
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+// ImportDockerArchive imports the image named repoTag (of the form name:tag)
+// from the "docker save" archive at archivePath, and tags it as tagName. If
+// repoTag is empty, the archive must contain exactly one image. The Docker
+// image configuration is converted to an OCI image configuration (see
+// convert.FromDockerConfig), and the layers are compressed as they are added
+// to the image. The DiffIDs of the layers are verified against the
+// configuration, and the history of the image is preserved.
+func ImportDockerArchive(ctx context.Context, engineExt casext.Engine, archivePath string, repoTag string, tagName string) error {
+	da, err := openDockerArchive(archivePath)
+	if err != nil {
+		return err
+	}
+	defer da.Close()
+
+	image, err := da.selectImage(repoTag)
+	if err != nil {
+		return err
+	}
+
+	configReader, err := da.open(image.Config)
+	if err != nil {
+		return errors.Wrap(err, "open docker config")
+	}
+	configData, err := ioutil.ReadAll(configReader)
+	if err != nil {
+		return errors.Wrap(err, "read docker config")
+	}
+	config, err := convert.FromDockerConfig(configData)
+	if err != nil {
+		return err
+	}
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(image.Layers) {
+		return errors.Errorf("docker config has %d diff_ids but the image has %d layers", len(diffIDs), len(image.Layers))
+	}
+
+	// Each layer is added with its history entry (so that the history matches
+	// up with the layers), and then the empty-layer entries are restored.
+	history := config.History
+	var layerHistory []ispec.History
+	for _, entry := range history {
+		if !entry.EmptyLayer {
+			layerHistory = append(layerHistory, entry)
+		}
+	}
+	if len(layerHistory) != len(image.Layers) {
+		log.Warnf("docker image has %d non-empty history entries but %d layers: not importing history", len(layerHistory), len(image.Layers))
+		history, layerHistory = nil, nil
+	}
+
+	// Start with an empty image using the converted configuration.
+	config.RootFS.DiffIDs = []digest.Digest{}
+	config.History = nil
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		return errors.Wrap(err, "put config blob")
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	})
+	if err != nil {
+		return errors.Wrap(err, "put manifest blob")
+	}
+
+	mutator, err := mutate.New(engineExt, casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}}})
+	if err != nil {
+		return errors.Wrap(err, "create mutator for new image")
+	}
+
+	for idx, layerName := range image.Layers {
+		log.WithFields(log.Fields{
+			"layer": layerName,
+		}).Infof("importing layer %d of %d", idx+1, len(image.Layers))
+
+		var entry *ispec.History
+		if layerHistory != nil {
+			entry = &layerHistory[idx]
+		}
+		if err := func() error {
+			layerReader, err := da.openLayer(layerName)
+			if err != nil {
+				return errors.Wrap(err, "open layer")
+			}
+			defer layerReader.Close()
+			return mutator.Add(ctx, layerReader, entry)
+		}(); err != nil {
+			return errors.Wrapf(err, "import layer %s", layerName)
+		}
+	}
+
+	newDiffIDs, err := mutator.DiffIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for idx, diffID := range newDiffIDs {
+		if diffID != diffIDs[idx] {
+			return errors.Errorf("layer %s has diff_id %s, but the docker config lists %s", image.Layers[idx], diffID, diffIDs[idx])
+		}
+	}
+	if history != nil {
+		if err := mutator.SetHistory(ctx, history); err != nil {
+			return errors.Wrap(err, "set history")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		return errors.Wrap(err, "commit imported image")
+	}
+
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if err := engineExt.UpdateReference(ctx, tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
+
+// dockerArchiveWriter writes the entries of a "docker save" archive.
+type dockerArchiveWriter struct {
+	tw *tar.Writer
+
+	// written is the set of entries which have already been written.
+	written map[string]struct{}
+}
+
+// header returns the tar header for an entry in the archive. The metadata of
+// every entry is fixed so that the archive is reproducible.
+func (dw *dockerArchiveWriter) header(name string, typeflag byte, size int64) *tar.Header {
+	mode := int64(0644)
+	if typeflag == tar.TypeDir {
+		mode = 0755
+	}
+	return &tar.Header{
+		Name:     name,
+		Typeflag: typeflag,
+		Mode:     mode,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+	}
+}
+
+// writeFile writes the regular file name to the archive, with size bytes of
+// contents read from r. Entries which have already been written are skipped.
+func (dw *dockerArchiveWriter) writeFile(name string, r io.Reader, size int64) error {
+	if _, ok := dw.written[name]; ok {
+		return nil
+	}
+	dw.written[name] = struct{}{}
+
+	if dir := path.Dir(name); dir != "." {
+		if _, ok := dw.written[dir+"/"]; !ok {
+			dw.written[dir+"/"] = struct{}{}
+			if err := dw.tw.WriteHeader(dw.header(dir+"/", tar.TypeDir, 0)); err != nil {
+				return errors.Wrapf(err, "write %s header", dir)
+			}
+		}
+	}
+	if err := dw.tw.WriteHeader(dw.header(name, tar.TypeReg, size)); err != nil {
+		return errors.Wrapf(err, "write %s header", name)
+	}
+	if _, err := io.CopyN(dw.tw, r, size); err != nil {
+		return errors.Wrapf(err, "write %s", name)
+	}
+	return nil
+}
+
+// writeLayer decompresses the given layer blob and writes it to the archive
+// as name, verifying that it matches diffID.
+func (dw *dockerArchiveWriter) writeLayer(ctx context.Context, engineExt casext.Engine, name string, descriptor ispec.Descriptor, diffID digest.Digest) error {
+	if _, ok := dw.written[name]; ok {
+		return nil
+	}
+
+	// The size of the uncompressed layer is needed for the tar header, so
+	// spool it to disk first.
+	spool, err := ioutil.TempFile("", "umoci-export-layer-")
+	if err != nil {
+		return errors.Wrap(err, "create spool file")
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	layerReader, err := layer.OpenLayer(ctx, engineExt, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "open layer")
+	}
+	defer layerReader.Close()
+
+	digester := diffID.Algorithm().Digester()
+	size, err := io.Copy(io.MultiWriter(spool, digester.Hash()), layerReader)
+	if err != nil {
+		return errors.Wrap(err, "decompress layer")
+	}
+	if digester.Digest() != diffID {
+		return errors.Errorf("layer %s has diff_id %s, but the config lists %s", descriptor.Digest, digester.Digest(), diffID)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek spool file")
+	}
+	return dw.writeFile(name, spool, size)
+}
+
+// ExportDockerArchive writes the image referenced by fromName to a new "docker
+// save" archive at archivePath, which can be loaded with "docker load". If
+// repoTag is non-empty, the image is named repoTag (of the form name:tag) in
+// the archive. The image configuration is stored as-is (the OCI format is
+// understood by Docker, and so the Docker image ID is the digest of the
+// configuration), and the layers are stored uncompressed.
+func ExportDockerArchive(ctx context.Context, engineExt casext.Engine, fromName string, archivePath string, repoTag string) (Err error) {
+	fromDescriptorPaths, err := engineExt.ResolveReference(ctx, fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag is not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(ctx, fromDescriptorPaths[0].Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return errors.Wrap(err, "get config")
+	}
+	defer configBlob.Close()
+	config, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return errors.Errorf("config has unsupported media type %s", configBlob.Descriptor.MediaType)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.Errorf("config has %d diff_ids but the image has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	configReader, err := engineExt.GetBlob(ctx, manifest.Config.Digest)
+	if err != nil {
+		return errors.Wrap(err, "get config blob")
+	}
+	defer configReader.Close()
+
+	fh, err := os.Create(archivePath)
+	if err != nil {
+		return errors.Wrap(err, "create archive")
+	}
+	defer func() {
+		if err := fh.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close archive")
+		}
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(archivePath)
+		}
+	}()
+
+	dw := &dockerArchiveWriter{
+		tw:      tar.NewWriter(fh),
+		written: map[string]struct{}{},
+	}
+	image := dockerArchiveImage{
+		Config:   manifest.Config.Digest.Encoded() + ".json",
+		RepoTags: []string{},
+		Layers:   []string{},
+	}
+	if repoTag != "" {
+		image.RepoTags = append(image.RepoTags, dockerRepoTag(repoTag))
+	}
+
+	for idx, descriptor := range manifest.Layers {
+		log.WithFields(log.Fields{
+			"layer": descriptor.Digest,
+		}).Infof("exporting layer %d of %d", idx+1, len(manifest.Layers))
+
+		diffID := config.RootFS.DiffIDs[idx]
+		name := diffID.Encoded() + "/layer.tar"
+		if err := dw.writeLayer(ctx, engineExt, name, descriptor, diffID); err != nil {
+			return errors.Wrapf(err, "export layer %s", descriptor.Digest)
+		}
+		image.Layers = append(image.Layers, name)
+	}
+
+	if err := dw.writeFile(image.Config, configReader, manifest.Config.Size); err != nil {
+		return errors.Wrap(err, "export config")
+	}
+	manifestData, err := json.Marshal([]dockerArchiveImage{image})
+	if err != nil {
+		return errors.Wrap(err, "encode docker archive manifest")
+	}
+	if err := dw.writeFile(dockerArchiveManifestFile, bytes.NewReader(manifestData), int64(len(manifestData))); err != nil {
+		return errors.Wrap(err, "export docker archive manifest")
+	}
+	if err := dw.tw.Close(); err != nil {
+		return errors.Wrap(err, "close archive")
+	}
+
+	log.WithFields(log.Fields{
+		"archive":  archivePath,
+		"manifest": fromDescriptorPaths[0].Descriptor().Digest,
+	}).Info("exported image to docker archive")
+	return nil
+}
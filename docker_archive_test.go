@@ -0,0 +1,229 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context"
+)
+
+// writeTestDockerArchive writes a "docker save" archive containing a single
+// image (named repoTag) with the given layers to archivePath. If badDiffID is
+// set, the configuration lists the wrong diff_id for the last layer.
+func writeTestDockerArchive(t *testing.T, archivePath string, repoTag string, layers [][]byte, badDiffID bool) {
+	var diffIDs []digest.Digest
+	var layerNames []string
+	var history []map[string]interface{}
+	for idx, data := range layers {
+		diffID := digest.FromBytes(data)
+		if badDiffID && idx == len(layers)-1 {
+			diffID = digest.FromString("bad")
+		}
+		diffIDs = append(diffIDs, diffID)
+		layerNames = append(layerNames, diffID.Encoded()+"/layer.tar")
+		history = append(history,
+			map[string]interface{}{"created_by": "layer", "comment": layerNames[idx]},
+			map[string]interface{}{"created_by": "empty", "empty_layer": true})
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture":   "amd64",
+		"os":             "linux",
+		"docker_version": "20.10.0",
+		"config": map[string]interface{}{
+			"Env":        []string{"PATH=/bin"},
+			"Entrypoint": []string{"/bin/sh"},
+			"Hostname":   "ignored",
+		},
+		"container_config": map[string]interface{}{
+			"Cmd": []string{"ignored"},
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": diffIDs,
+		},
+		"history": history,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configName := digest.FromBytes(config).Encoded() + ".json"
+	manifest, err := json.Marshal([]dockerArchiveImage{{
+		Config:   configName,
+		RepoTags: []string{repoTag},
+		Layers:   layerNames,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	files := map[string][]byte{
+		configName:                config,
+		dockerArchiveManifestFile: manifest,
+	}
+	for idx, data := range layers {
+		files[layerNames[idx]] = data
+	}
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(archivePath, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testLayerTar returns an uncompressed layer containing a single file.
+func testLayerTar(t *testing.T, name string) []byte {
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(name))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDockerArchive(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestDockerArchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	layers := [][]byte{testLayerTar(t, "a"), testLayerTar(t, "b")}
+	archivePath := filepath.Join(root, "docker.tar")
+	writeTestDockerArchive(t, archivePath, "example.com:5000/foo:bar", layers, false)
+
+	if err := ImportDockerArchive(ctx, engineExt, archivePath, "example.com:5000/foo:other", "imported"); err == nil {
+		t.Errorf("expected error importing missing image")
+	}
+	if err := ImportDockerArchive(ctx, engineExt, archivePath, "example.com:5000/foo:bar", "imported"); err != nil {
+		t.Fatalf("unexpected error importing docker archive: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "imported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("expected imported tag to be created")
+	}
+	imported := descriptorPaths[0]
+	mutator, err := mutate.New(engineExt, imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffIDs, err := mutator.DiffIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []digest.Digest{digest.FromBytes(layers[0]), digest.FromBytes(layers[1])}; !reflect.DeepEqual(diffIDs, expected) {
+		t.Errorf("unexpected diff_ids: expected %v, got %v", expected, diffIDs)
+	}
+	history, err := mutator.History(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 || history[0].Comment != diffIDs[0].Encoded()+"/layer.tar" || !history[1].EmptyLayer || history[2].Comment != diffIDs[1].Encoded()+"/layer.tar" {
+		t.Errorf("history was not imported: %#v", history)
+	}
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Env, []string{"PATH=/bin"}) || !reflect.DeepEqual(config.Entrypoint, []string{"/bin/sh"}) {
+		t.Errorf("config was not imported: %#v", config)
+	}
+
+	// Exporting and re-importing the image must give the same image.
+	exportPath := filepath.Join(root, "export.tar")
+	if err := ExportDockerArchive(ctx, engineExt, "imported", exportPath, "foo"); err != nil {
+		t.Fatalf("unexpected error exporting docker archive: %+v", err)
+	}
+	if err := ImportDockerArchive(ctx, engineExt, exportPath, "foo:latest", "reimported"); err != nil {
+		t.Fatalf("unexpected error importing exported docker archive: %+v", err)
+	}
+	descriptorPaths, err = engineExt.ResolveReference(ctx, "reimported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("expected reimported tag to be created")
+	}
+	if got := descriptorPaths[0].Descriptor(); got.Digest != imported.Descriptor().Digest {
+		t.Errorf("round-tripped image differs: expected %s, got %s", imported.Descriptor().Digest, got.Digest)
+	}
+}
+
+func TestDockerArchiveBadDiffID(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestDockerArchiveBadDiffID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	archivePath := filepath.Join(root, "docker.tar")
+	writeTestDockerArchive(t, archivePath, "foo:latest", [][]byte{testLayerTar(t, "a")}, true)
+
+	if err := ImportDockerArchive(ctx, engineExt, archivePath, "", "imported"); err == nil {
+		t.Errorf("expected error importing archive with bad diff_id")
+	}
+	if descriptorPaths, err := engineExt.ResolveReference(ctx, "imported"); err != nil || len(descriptorPaths) != 0 {
+		t.Errorf("tag was created for bad archive: %v %v", descriptorPaths, err)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestTagDockerManifest(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestTagDockerManifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	base := putTestManifest(t, engineExt, []ispec.Descriptor{}, 0)
+	if err := engineExt.UpdateReference(ctx, "base", base); err != nil {
+		t.Fatal(err)
+	}
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "dir/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyDelta(engineExt, "base", "oci", bytes.NewReader(layer.Bytes()), nil, ""); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	if err := TagDockerManifest(ctx, engineExt, "oci", "docker"); err != nil {
+		t.Fatalf("unexpected error tagging docker manifest: %+v", err)
+	}
+
+	ociPaths, err := engineExt.ResolveReference(ctx, "oci")
+	if err != nil || len(ociPaths) != 1 {
+		t.Fatalf("failed to resolve oci tag: %v %+v", ociPaths, err)
+	}
+	dockerPaths, err := engineExt.ResolveReference(ctx, "docker")
+	if err != nil || len(dockerPaths) != 1 {
+		t.Fatalf("failed to resolve docker tag: %v %+v", dockerPaths, err)
+	}
+	if mediaType := ociPaths[0].Descriptor().MediaType; mediaType != ispec.MediaTypeImageManifest {
+		t.Errorf("oci tag has unexpected media type %s", mediaType)
+	}
+	if mediaType := dockerPaths[0].Descriptor().MediaType; mediaType != mediatype.DockerManifest {
+		t.Errorf("docker tag has unexpected media type %s", mediaType)
+	}
+
+	ociBlob, err := engineExt.FromDescriptor(ctx, ociPaths[0].Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ociBlob.Close()
+	ociManifest := ociBlob.Data.(ispec.Manifest)
+
+	dockerBlob, err := engineExt.FromDescriptor(ctx, dockerPaths[0].Descriptor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dockerBlob.Close()
+	dockerManifest, ok := dockerBlob.Data.(mediatype.DockerManifestBlob)
+	if !ok {
+		t.Fatalf("docker manifest has unexpected type %T", dockerBlob.Data)
+	}
+
+	if dockerManifest.SchemaVersion != 2 || dockerManifest.MediaType != mediatype.DockerManifest {
+		t.Errorf("unexpected docker manifest header: %d %s", dockerManifest.SchemaVersion, dockerManifest.MediaType)
+	}
+	if dockerManifest.Config.MediaType != mediatype.DockerConfig {
+		t.Errorf("unexpected docker config media type: %s", dockerManifest.Config.MediaType)
+	}
+	if dockerManifest.Config.Digest != ociManifest.Config.Digest {
+		t.Errorf("docker config digest %s doesn't match oci config digest %s", dockerManifest.Config.Digest, ociManifest.Config.Digest)
+	}
+	if len(dockerManifest.Layers) != len(ociManifest.Layers) {
+		t.Fatalf("docker manifest has %d layers, expected %d", len(dockerManifest.Layers), len(ociManifest.Layers))
+	}
+	for idx, dockerLayer := range dockerManifest.Layers {
+		if dockerLayer.MediaType != mediatype.DockerLayerGzip {
+			t.Errorf("layer %d: unexpected docker media type %s", idx, dockerLayer.MediaType)
+		}
+		if dockerLayer.Digest != ociManifest.Layers[idx].Digest || dockerLayer.Size != ociManifest.Layers[idx].Size {
+			t.Errorf("layer %d: docker descriptor %v doesn't match oci descriptor %v", idx, dockerLayer, ociManifest.Layers[idx])
+		}
+	}
+
+	// The blobs referenced by the docker manifest must survive a GC, even
+	// without the oci tag.
+	if err := engineExt.DeleteReference(ctx, "oci"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.DeleteReference(ctx, "base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("unexpected error in GC: %+v", err)
+	}
+	for _, descriptor := range append(dockerManifest.Layers, dockerManifest.Config) {
+		if _, err := engineExt.BlobSize(ctx, descriptor.Digest); err != nil {
+			t.Errorf("blob %s referenced by docker manifest was removed by GC: %+v", descriptor.Digest, err)
+		}
+	}
+}
+
+func TestDockerManifestUnsupportedLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestDockerManifestUnsupportedLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	manifest := putTestManifest(t, engineExt, []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    digest.FromString("layer"),
+		Size:      5,
+	}}, 1)
+	if _, err := DockerManifest(ctx, engineExt, manifest); err == nil {
+		t.Errorf("expected error creating docker manifest with uncompressed layer")
+	}
+}
@@ -7,7 +7,7 @@ require (
 	github.com/cyphar/filepath-securejoin v0.2.2
 	github.com/docker/go-units v0.4.0
 	github.com/golang/protobuf v1.3.2
-	github.com/klauspost/compress v1.8.3 // indirect
+	github.com/klauspost/compress v1.8.3
 	github.com/klauspost/cpuid v1.2.1 // indirect
 	github.com/klauspost/pgzip v1.2.1
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
@@ -0,0 +1,244 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// isDigestKeyword returns whether the given keyword requires the contents of
+// a file to be read (and hashed) in order to be computed.
+func isDigestKeyword(keyword mtree.Keyword) bool {
+	return strings.HasSuffix(string(mtree.KeywordSynonym(string(keyword.Prefix()))), "digest")
+}
+
+// CheckMtree is equivalent to mtree.Check(root, spec, keywords, fsEval),
+// except that the digest keywords (which require reading the entire contents
+// of every regular file) are computed by up to jobs concurrent workers. The
+// returned deltas are sorted by path, so the result does not depend on how the
+// work was scheduled. If cache is non-nil, the digests of files which have not
+// changed since they were cached are taken from the cache rather than being
+// recomputed (and the cache is updated). If progress is non-nil, it is called
+// as each file is digested. If ctx is cancelled, no more files are digested
+// and the error of ctx is returned. If jobs <= 1, cache is nil, progress is nil
+// and ctx can never be cancelled, this is exactly mtree.Check.
+func CheckMtree(ctx context.Context, root string, spec *mtree.DirectoryHierarchy, keywords []mtree.Keyword, fsEval mtree.FsEval, jobs int, cache *MtreeCache, progress layer.ProgressFunc) ([]mtree.InodeDelta, error) {
+	if jobs <= 1 && cache == nil && progress == nil && ctx.Done() == nil {
+		return mtree.Check(root, spec, keywords, fsEval)
+	}
+	if keywords == nil {
+		keywords = spec.UsedKeywords()
+	}
+
+	dh, err := WalkMtree(ctx, root, keywords, fsEval, jobs, cache, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs, err := mtree.Compare(spec, dh, keywords)
+	if err != nil {
+		return nil, errors.Wrap(err, "compare mtree")
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path() < diffs[j].Path()
+	})
+	return diffs, nil
+}
+
+// WalkMtree is equivalent to mtree.Walk(root, nil, keywords, fsEval), except
+// that the digest keywords are computed by up to jobs concurrent workers. The
+// cache and progress arguments, as well as the handling of ctx, are the same
+// as for CheckMtree.
+func WalkMtree(ctx context.Context, root string, keywords []mtree.Keyword, fsEval mtree.FsEval, jobs int, cache *MtreeCache, progress layer.ProgressFunc) (*mtree.DirectoryHierarchy, error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// Walk the tree without any of the digest keywords, which should be
+	// fairly cheap since it only involves metadata lookups.
+	var walkKeywords, digestKeywords []mtree.Keyword
+	for _, keyword := range keywords {
+		if isDigestKeyword(keyword) {
+			digestKeywords = append(digestKeywords, keyword)
+		} else {
+			walkKeywords = append(walkKeywords, keyword)
+		}
+	}
+	if cache != nil && !equalKeywords(cache.keywords, digestKeywords) {
+		log.Warnf("ignoring mtree cache loaded for different keywords: %v", cache.keywords)
+		cache = nil
+	}
+	dh, err := mtree.Walk(root, nil, walkKeywords, fsEval)
+	if err != nil {
+		return nil, errors.Wrap(err, "walk rootfs")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(digestKeywords) > 0 {
+		if err := digestEntries(ctx, root, dh, digestKeywords, fsEval, jobs, cache, progress); err != nil {
+			return nil, err
+		}
+	}
+	// mtree.Walk records the keywords it was given in the header comments,
+	// which need to include the digest keywords as well.
+	for i, e := range dh.Entries {
+		if e.Type == mtree.CommentType && strings.Contains(e.Raw, "keywords: ") {
+			dh.Entries[i].Raw = fmt.Sprintf("#%16s%s", "keywords: ", strings.Join(mtree.FromKeywords(keywords), ","))
+		}
+	}
+	return dh, nil
+}
+
+// digestEntries computes the given digest keywords for every regular file in
+// dh (using jobs concurrent workers), and appends them to the keywords of the
+// corresponding entry. Digests are looked up in (and added to) cache, and
+// progress (if non-nil) is called after each entry is digested. Entries which
+// have not been digested by the time ctx is cancelled fail with its error.
+func digestEntries(ctx context.Context, root string, dh *mtree.DirectoryHierarchy, keywords []mtree.Keyword, fsEval mtree.FsEval, jobs int, cache *MtreeCache, progress layer.ProgressFunc) error {
+	var (
+		wg      sync.WaitGroup
+		indices = make(chan int)
+		errs    = make([]error, len(dh.Entries))
+		results = make([][]mtree.KeyVal, len(dh.Entries))
+	)
+
+	// Figure out how much data needs to be digested, so that progress can be
+	// reported as a fraction of the total.
+	var (
+		progressLock sync.Mutex
+		done, total  int64
+		sizes        = make([]int64, len(dh.Entries))
+	)
+	if progress != nil {
+		for idx, entry := range dh.Entries {
+			if entry.Type != mtree.RelativeType && entry.Type != mtree.FullType {
+				continue
+			}
+			relPath, err := entry.Path()
+			if err != nil {
+				continue
+			}
+			if info, err := fsEval.Lstat(filepath.Join(root, relPath)); err == nil && info.Mode().IsRegular() {
+				sizes[idx] = info.Size()
+				total += sizes[idx]
+			}
+		}
+	}
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				if err := ctx.Err(); err != nil {
+					errs[idx] = err
+					continue
+				}
+				results[idx], errs[idx] = digestEntry(root, dh.Entries[idx], keywords, fsEval, cache)
+				if progress != nil {
+					relPath, _ := dh.Entries[idx].Path()
+					progressLock.Lock()
+					done += sizes[idx]
+					progress(done, total, relPath)
+					progressLock.Unlock()
+				}
+			}
+		}()
+	}
+	for idx, entry := range dh.Entries {
+		if entry.Type == mtree.RelativeType || entry.Type == mtree.FullType {
+			indices <- idx
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	// Apply the results in entry order, returning the first error (by entry
+	// order) so that errors are also deterministic.
+	for idx := range dh.Entries {
+		if errs[idx] != nil {
+			return errs[idx]
+		}
+		dh.Entries[idx].Keywords = append(dh.Entries[idx].Keywords, results[idx]...)
+	}
+	return nil
+}
+
+// digestEntry computes the given digest keywords for a single entry. Entries
+// which are not regular files have no digests.
+func digestEntry(root string, entry mtree.Entry, keywords []mtree.Keyword, fsEval mtree.FsEval, cache *MtreeCache) ([]mtree.KeyVal, error) {
+	relPath, err := entry.Path()
+	if err != nil {
+		return nil, errors.Wrap(err, "get entry path")
+	}
+	path := filepath.Join(root, relPath)
+
+	info, err := fsEval.Lstat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "lstat entry")
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	if kvs, ok := cache.lookup(relPath, info); ok {
+		return kvs, nil
+	}
+
+	var kvs []mtree.KeyVal
+	for _, keyword := range keywords {
+		keyFunc, ok := mtree.KeywordFuncs[keyword.Prefix()]
+		if !ok {
+			return nil, errors.Errorf("unknown keyword %q for file %q", keyword.Prefix(), path)
+		}
+		err := func() error {
+			fh, err := fsEval.Open(path)
+			if err != nil {
+				return errors.Wrap(err, "open entry")
+			}
+			defer fh.Close()
+
+			newKvs, err := fsEval.KeywordFunc(keyFunc)(path, info, fh)
+			if err != nil {
+				return errors.Wrapf(err, "compute %s", keyword)
+			}
+			for _, kv := range newKvs {
+				if kv != "" {
+					kvs = append(kvs, kv)
+				}
+			}
+			return nil
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	cache.store(relPath, info, kvs)
+	return kvs, nil
+}
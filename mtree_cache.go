@@ -0,0 +1,200 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// MtreeCacheName is the name of the digest cache stored in a bundle when
+// umoci-repack(1) or umoci-diff(1) are used with --mtree-cache.
+const MtreeCacheName = "umoci-mtree-cache.json"
+
+// mtreeCacheVersion is the version of the on-disk cache format. Caches with
+// a different version are ignored.
+const mtreeCacheVersion = 1
+
+// mtreeCacheRacyWindow is how recently a file may have been modified (before
+// the check started) for its digests to still be cached. Files modified more
+// recently than this could be modified again without their mtime changing
+// (on filesystems with coarse timestamps), so they are always re-hashed.
+const mtreeCacheRacyWindow = time.Second
+
+// mtreeCacheFile is the on-disk format of an MtreeCache.
+type mtreeCacheFile struct {
+	Version  int                        `json:"version"`
+	Keywords []mtree.Keyword            `json:"keywords"`
+	Entries  map[string]mtreeCacheEntry `json:"entries"`
+}
+
+// mtreeCacheEntry holds the cached digests of a single regular file.
+type mtreeCacheEntry struct {
+	Mtime   time.Time      `json:"mtime"`
+	Size    int64          `json:"size"`
+	Digests []mtree.KeyVal `json:"digests"`
+}
+
+// MtreeCache is a cache of the digest keywords of every regular file in a
+// rootfs, keyed by the path, mtime and size of each file. It allows
+// CheckMtree to skip re-hashing files which have not changed since the rootfs
+// was last checked. A nil *MtreeCache is valid, and caches nothing.
+type MtreeCache struct {
+	keywords []mtree.Keyword
+	started  time.Time
+
+	lock sync.Mutex
+	old  map[string]mtreeCacheEntry
+	new  map[string]mtreeCacheEntry
+}
+
+// LoadMtreeCache loads the cache at the given path, for use with a check of
+// the given keywords. If the cache is missing, corrupt or was generated for a
+// different set of digest keywords, an empty cache is returned (resulting in
+// every file being re-hashed).
+func LoadMtreeCache(path string, keywords []mtree.Keyword) *MtreeCache {
+	var digestKeywords []mtree.Keyword
+	for _, keyword := range keywords {
+		if isDigestKeyword(keyword) {
+			digestKeywords = append(digestKeywords, keyword)
+		}
+	}
+	cache := &MtreeCache{
+		keywords: digestKeywords,
+		started:  time.Now(),
+		old:      map[string]mtreeCacheEntry{},
+		new:      map[string]mtreeCacheEntry{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Debugf("mtree cache %s does not exist", path)
+		return cache
+	}
+	if err != nil {
+		log.Warnf("ignoring mtree cache: %v", errors.Wrap(err, "read mtree cache"))
+		return cache
+	}
+
+	var cacheFile mtreeCacheFile
+	if err := json.Unmarshal(data, &cacheFile); err != nil {
+		log.Warnf("ignoring corrupt mtree cache: %v", errors.Wrap(err, "decode mtree cache"))
+		return cache
+	}
+	if cacheFile.Version != mtreeCacheVersion {
+		log.Warnf("ignoring mtree cache with unsupported version: %d", cacheFile.Version)
+		return cache
+	}
+	if !equalKeywords(cacheFile.Keywords, digestKeywords) {
+		log.Infof("ignoring mtree cache generated with different keywords: %v", cacheFile.Keywords)
+		return cache
+	}
+	if cacheFile.Entries != nil {
+		cache.old = cacheFile.Entries
+	}
+	log.Debugf("loaded mtree cache %s (%d entries)", path, len(cache.old))
+	return cache
+}
+
+// equalKeywords returns whether a and b contain the same keywords in the same
+// order.
+func equalKeywords(a, b []mtree.Keyword) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the cached digests for the file at path, if the file has
+// not changed since they were cached.
+func (c *MtreeCache) lookup(path string, info os.FileInfo) ([]mtree.KeyVal, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.old[path]
+	if !ok || entry.Size != info.Size() || !entry.Mtime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	c.new[path] = entry
+	return entry.Digests, true
+}
+
+// store adds the digests computed for the file at path to the cache.
+func (c *MtreeCache) store(path string, info os.FileInfo, digests []mtree.KeyVal) {
+	if c == nil {
+		return
+	}
+	if !info.ModTime().Before(c.started.Add(-mtreeCacheRacyWindow)) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.new[path] = mtreeCacheEntry{
+		Mtime:   info.ModTime(),
+		Size:    info.Size(),
+		Digests: digests,
+	}
+}
+
+// Save writes the cache to the given path, atomically replacing any existing
+// cache. Only the files seen by checks using this cache are included, so
+// entries for files which have since been removed are dropped.
+func (c *MtreeCache) Save(path string) error {
+	c.lock.Lock()
+	data, err := json.Marshal(mtreeCacheFile{
+		Version:  mtreeCacheVersion,
+		Keywords: c.keywords,
+		Entries:  c.new,
+	})
+	c.lock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "encode mtree cache")
+	}
+
+	fh, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return errors.Wrap(err, "create mtree cache")
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err := fh.Write(data); err != nil {
+		return errors.Wrap(err, "write mtree cache")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close mtree cache")
+	}
+	return errors.Wrap(os.Rename(fh.Name(), path), "rename mtree cache")
+}
@@ -0,0 +1,348 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// setupMtreeTree creates a tree of nfiles files (each of the given size) in
+// nested directories under root, and returns the mtree spec of the tree.
+func setupMtreeTree(t testing.TB, root string, nfiles, size int) *mtree.DirectoryHierarchy {
+	for i := 0; i < nfiles; i++ {
+		path := filepath.Join(root, fmt.Sprintf("dir%d", i%4), fmt.Sprintf("file%d", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte{byte(i)}, size)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir0/file0", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := mtree.Walk(root, nil, MtreeKeywords, fseval.DefaultFsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func deltaStrings(diffs []mtree.InodeDelta) []string {
+	var strs []string
+	for _, diff := range diffs {
+		strs = append(strs, fmt.Sprintf("%s:%s", diff.Path(), diff.Type()))
+	}
+	return strs
+}
+
+func TestCheckMtreeJobs(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestCheckMtreeJobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	spec := setupMtreeTree(t, root, 32, 1024)
+
+	// Modify the contents of a file without changing its size or mtime, so
+	// that only the digest can detect the change.
+	path := filepath.Join(root, "dir1", "file5")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte{0xff}, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	// Add and remove some files.
+	if err := ioutil.WriteFile(filepath.Join(root, "dir2", "new"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "dir3", "file7")); err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := CheckMtree(context.Background(), root, spec, MtreeKeywords, fseval.DefaultFsEval, 1, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error checking mtree: %+v", err)
+	}
+	expected := deltaStrings(serial)
+	sort.Strings(expected)
+
+	for _, jobs := range []int{2, 4, 16} {
+		t.Run(fmt.Sprintf("jobs=%d", jobs), func(t *testing.T) {
+			diffs, err := CheckMtree(context.Background(), root, spec, MtreeKeywords, fseval.DefaultFsEval, jobs, nil, nil)
+			if err != nil {
+				t.Fatalf("unexpected error checking mtree: %+v", err)
+			}
+			got := deltaStrings(diffs)
+			if !sort.StringsAreSorted(got) {
+				t.Errorf("diffs are not sorted: %v", got)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(expected) {
+				t.Errorf("diffs differ from serial check: expected %v, got %v", expected, got)
+			}
+		})
+	}
+
+	// Sanity check the expected changes were all found.
+	for _, want := range []string{
+		"dir1/file5:modified",
+		"dir2/new:extra",
+		"dir3/file7:missing",
+	} {
+		found := false
+		for _, got := range expected {
+			if got == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected delta %q not found in %v", want, expected)
+		}
+	}
+}
+
+func TestWalkMtree(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestWalkMtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	spec := setupMtreeTree(t, root, 32, 1024)
+
+	for _, jobs := range []int{1, 4} {
+		t.Run(fmt.Sprintf("jobs=%d", jobs), func(t *testing.T) {
+			dh, err := WalkMtree(context.Background(), root, MtreeKeywords, fseval.DefaultFsEval, jobs, nil, nil)
+			if err != nil {
+				t.Fatalf("unexpected error walking mtree: %+v", err)
+			}
+			if err := checkMtreeKeywords(dh, MtreeKeywords); err != nil {
+				t.Errorf("spec has unexpected keywords: %v", err)
+			}
+			// The generated spec must be indistinguishable from a plain
+			// mtree.Walk, in both directions.
+			for _, pair := range [][2]*mtree.DirectoryHierarchy{{spec, dh}, {dh, spec}} {
+				diffs, err := mtree.Compare(pair[0], pair[1], MtreeKeywords)
+				if err != nil {
+					t.Fatalf("unexpected error comparing specs: %+v", err)
+				}
+				if len(diffs) != 0 {
+					t.Errorf("spec differs from mtree.Walk: %v", deltaStrings(diffs))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCheckMtree(b *testing.B) {
+	root, err := ioutil.TempDir("", "umoci-BenchmarkCheckMtree")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	spec := setupMtreeTree(b, root, 64, 1<<20)
+
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := CheckMtree(context.Background(), root, spec, MtreeKeywords, fseval.DefaultFsEval, jobs, nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckMtreeCache(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestCheckMtreeCache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	cachePath := filepath.Join(root, MtreeCacheName)
+	setupMtreeTree(t, rootfs, 8, 1024)
+
+	// Files modified very recently are never cached, so backdate them.
+	oldTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	path := filepath.Join(rootfs, "dir1", "file5")
+	if err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return os.Chtimes(path, oldTime, oldTime)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := mtree.Walk(rootfs, nil, MtreeKeywords, fseval.DefaultFsEval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Populate the cache.
+	cache := LoadMtreeCache(cachePath, MtreeKeywords)
+	diffs, err := CheckMtree(context.Background(), rootfs, spec, MtreeKeywords, fseval.DefaultFsEval, 2, cache, nil)
+	if err != nil {
+		t.Fatalf("unexpected error checking mtree: %+v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("unexpected diffs for unchanged tree: %v", deltaStrings(diffs))
+	}
+	if err := cache.Save(cachePath); err != nil {
+		t.Fatalf("unexpected error saving cache: %+v", err)
+	}
+
+	// Change the contents of a file without changing its size or mtime. This
+	// is only noticed if the cache is not used, which lets us verify that the
+	// cached digests are actually being used.
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, oldTime, oldTime); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err = CheckMtree(context.Background(), rootfs, spec, MtreeKeywords, fseval.DefaultFsEval, 1, LoadMtreeCache(cachePath, MtreeKeywords), nil)
+	if err != nil {
+		t.Fatalf("unexpected error checking mtree: %+v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("cached digests were not used: got diffs %v", deltaStrings(diffs))
+	}
+
+	expected := []string{"dir1/file5:modified"}
+
+	// Changing the keyword set invalidates the cache.
+	keywords := append([]mtree.Keyword{}, MtreeKeywords...)
+	keywords = append(keywords, "sha512digest")
+	diffs, err = CheckMtree(context.Background(), rootfs, spec, keywords, fseval.DefaultFsEval, 1, LoadMtreeCache(cachePath, keywords), nil)
+	if err != nil {
+		t.Fatalf("unexpected error checking mtree: %+v", err)
+	}
+	if got := deltaStrings(diffs); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("cache was not invalidated by keyword change: expected %v, got %v", expected, got)
+	}
+
+	// A corrupt cache results in a full check.
+	if err := ioutil.WriteFile(cachePath, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = CheckMtree(context.Background(), rootfs, spec, MtreeKeywords, fseval.DefaultFsEval, 1, LoadMtreeCache(cachePath, MtreeKeywords), nil)
+	if err != nil {
+		t.Fatalf("unexpected error checking mtree: %+v", err)
+	}
+	if got := deltaStrings(diffs); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("corrupt cache was used: expected %v, got %v", expected, got)
+	}
+
+	// As does a missing one.
+	if err := os.Remove(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = CheckMtree(context.Background(), rootfs, spec, MtreeKeywords, fseval.DefaultFsEval, 1, LoadMtreeCache(cachePath, MtreeKeywords), nil)
+	if err != nil {
+		t.Fatalf("unexpected error checking mtree: %+v", err)
+	}
+	if got := deltaStrings(diffs); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("unexpected diffs with missing cache: expected %v, got %v", expected, got)
+	}
+}
+
+func TestCheckMtreeProgress(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestCheckMtreeProgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	const nfiles, size = 16, 1024
+	spec := setupMtreeTree(t, root, nfiles, size)
+
+	for _, jobs := range []int{1, 4} {
+		t.Run(fmt.Sprintf("jobs=%d", jobs), func(t *testing.T) {
+			var (
+				calls int
+				done  int64
+			)
+			_, err := CheckMtree(context.Background(), root, spec, MtreeKeywords, fseval.DefaultFsEval, jobs, nil, func(newDone, total int64, path string) {
+				calls++
+				if newDone < done {
+					t.Errorf("progress went backwards: %d -> %d (%s)", done, newDone, path)
+				}
+				if total != nfiles*size {
+					t.Errorf("unexpected total: expected %d, got %d", nfiles*size, total)
+				}
+				done = newDone
+			})
+			if err != nil {
+				t.Fatalf("unexpected error checking mtree: %+v", err)
+			}
+			if calls < nfiles {
+				t.Errorf("expected at least %d progress calls, got %d", nfiles, calls)
+			}
+			if done != nfiles*size {
+				t.Errorf("progress did not finish: expected %d, got %d", nfiles*size, done)
+			}
+		})
+	}
+}
+
+func TestCheckMtreeCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestCheckMtreeCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	spec := setupMtreeTree(t, root, 32, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, jobs := range []int{1, 4} {
+		t.Run(fmt.Sprintf("jobs=%d", jobs), func(t *testing.T) {
+			_, err := CheckMtree(ctx, root, spec, MtreeKeywords, fseval.DefaultFsEval, jobs, nil, nil)
+			if errors.Cause(err) != context.Canceled {
+				t.Errorf("expected mtree check to be cancelled: got %v", err)
+			}
+		})
+	}
+}
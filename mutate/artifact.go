@@ -0,0 +1,95 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// artifactManifest is an ispec.Manifest with the "artifactType" field added
+// in image-spec v1.1, which is not supported by the version of image-spec we
+// use. If ArtifactType is empty, it is serialised identically to an
+// ispec.Manifest.
+type artifactManifest struct {
+	ispec.Manifest
+
+	// ArtifactType is the media type of the artifact (if the manifest
+	// describes an artifact rather than a container image).
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// mediaTypeRegexp matches media types of the form "type/subtype" as described
+// in RFC 6838 (section 4.2). Parameters are not permitted.
+var mediaTypeRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}$`)
+
+// ValidateArtifactType returns an error if the given artifact type is not a
+// valid media type (as described in RFC 6838).
+func ValidateArtifactType(artifactType string) error {
+	if !mediaTypeRegexp.MatchString(artifactType) {
+		return errors.Errorf("invalid artifact type %q: must be a media type of the form type/subtype", artifactType)
+	}
+	return nil
+}
+
+// ManifestArtifactType returns the "artifactType" of the manifest referenced
+// by the given descriptor, or "" if it is not set.
+func ManifestArtifactType(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) (string, error) {
+	reader, err := engine.GetVerifiedBlob(ctx, manifestDescriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "get manifest blob")
+	}
+	defer reader.Close()
+
+	var manifest artifactManifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return "", errors.Wrap(err, "parse manifest")
+	}
+	return manifest.ArtifactType, nil
+}
+
+// ArtifactType returns the current artifact type of the manifest, or "" if it
+// is not set.
+func (m *Mutator) ArtifactType(ctx context.Context) (string, error) {
+	if err := m.cache(ctx); err != nil {
+		return "", errors.Wrap(err, "getting cache failed")
+	}
+
+	return m.artifactType, nil
+}
+
+// SetArtifactType sets the artifact type of the manifest. If artifactType is
+// "", the field is removed from the manifest.
+func (m *Mutator) SetArtifactType(ctx context.Context, artifactType string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	if artifactType != "" {
+		if err := ValidateArtifactType(artifactType); err != nil {
+			return err
+		}
+	}
+	m.artifactType = artifactType
+	return nil
+}
@@ -0,0 +1,42 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ChainIDs computes the ChainID of each layer in the given image
+// configuration, in the same order as config.RootFS.DiffIDs. The ChainID of a
+// layer identifies the layer together with all of the layers beneath it, and
+// is computed as described in the image-spec (the first ChainID is the first
+// DiffID, and each subsequent ChainID is the SHA256 digest of the previous
+// ChainID and the layer's DiffID separated by a single space). This matches
+// the algorithm used by containerd.
+func ChainIDs(config ispec.Image) []digest.Digest {
+	var chainIDs []digest.Digest
+	for idx, diffID := range config.RootFS.DiffIDs {
+		chainID := diffID
+		if idx > 0 {
+			chainID = digest.FromString(chainIDs[idx-1].String() + " " + diffID.String())
+		}
+		chainIDs = append(chainIDs, chainID)
+	}
+	return chainIDs
+}
@@ -0,0 +1,60 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestChainIDs(t *testing.T) {
+	// The DiffIDs are the SHA256 digests of "a", "b" and "c", and the expected
+	// ChainIDs were computed independently with sha256sum(1).
+	config := ispec.Image{
+		RootFS: ispec.RootFS{
+			Type: "layers",
+			DiffIDs: []digest.Digest{
+				"sha256:ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+				"sha256:3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d",
+				"sha256:2e7d2c03a9507ae265ecf5b5356885a53393a2029d241394997265a1a25aefc6",
+			},
+		},
+	}
+	expected := []digest.Digest{
+		"sha256:ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+		"sha256:51c0c8ace48498d6f5fee6b0592cc06f2da0f3cbe09c5a34a97dce85c3889676",
+		"sha256:2fce7f8ce91bcf0a1428b36e1024639fdbd9469eea762dba98aa749631885106",
+	}
+
+	chainIDs := ChainIDs(config)
+	if len(chainIDs) != len(expected) {
+		t.Fatalf("unexpected number of chain ids: expected %d, got %d", len(expected), len(chainIDs))
+	}
+	for idx := range expected {
+		if chainIDs[idx] != expected[idx] {
+			t.Errorf("chain id %d: expected %s, got %s", idx, expected[idx], chainIDs[idx])
+		}
+	}
+
+	// No layers means no chain ids.
+	if chainIDs := ChainIDs(ispec.Image{}); len(chainIDs) != 0 {
+		t.Errorf("expected no chain ids for empty image, got %v", chainIDs)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"io"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Compression is the algorithm used to compress the layers added to an image
+// by a Mutator.
+type Compression string
+
+const (
+	// GzipCompression compresses layers with gzip. This is the default, and
+	// is supported by all image tools.
+	GzipCompression Compression = "gzip"
+
+	// ZstdCompression compresses layers with zstd.
+	ZstdCompression Compression = "zstd"
+
+	// NoCompression stores layers uncompressed.
+	NoCompression Compression = "none"
+)
+
+// ParseCompression returns the Compression with the given name.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case GzipCompression, ZstdCompression, NoCompression:
+		return c, nil
+	}
+	return "", errors.Errorf("unsupported compression: %q", name)
+}
+
+// DefaultCompressionLevel is the gzip compression level used unless another
+// level is set with SetCompressionLevel.
+const DefaultCompressionLevel = gzip.DefaultCompression
+
+// ParseCompressionLevel returns the gzip compression level with the given
+// name, which must either be "default" or an integer from gzip.BestSpeed (1)
+// to gzip.BestCompression (9).
+func ParseCompressionLevel(name string) (int, error) {
+	if name == "default" {
+		return DefaultCompressionLevel, nil
+	}
+	level, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, errors.Errorf("compression level must be an integer or \"default\": %q", name)
+	}
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return 0, errors.Errorf("compression level out of range [%d, %d]: %d", gzip.BestSpeed, gzip.BestCompression, level)
+	}
+	return level, nil
+}
+
+// validateCompressionLevel returns an error if level is not a gzip
+// compression level which can be used by a Mutator.
+func validateCompressionLevel(level int) error {
+	if level != DefaultCompressionLevel && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		return errors.Errorf("compression level out of range [%d, %d]: %d", gzip.BestSpeed, gzip.BestCompression, level)
+	}
+	return nil
+}
+
+// DefaultCompressionJobs returns the number of blocks of a layer which are
+// compressed concurrently unless another number is set with
+// SetCompressionJobs.
+func DefaultCompressionJobs() int {
+	return 2 * runtime.NumCPU()
+}
+
+// mediaType returns the media type of a layer compressed with c.
+func (c Compression) mediaType(nonDistributable bool) string {
+	switch c {
+	case ZstdCompression:
+		if nonDistributable {
+			return layer.MediaTypeImageLayerNonDistributableZstd
+		}
+		return layer.MediaTypeImageLayerZstd
+	case NoCompression:
+		if nonDistributable {
+			return ispec.MediaTypeImageLayerNonDistributable
+		}
+		return ispec.MediaTypeImageLayer
+	default:
+		if nonDistributable {
+			return ispec.MediaTypeImageLayerNonDistributableGzip
+		}
+		return ispec.MediaTypeImageLayerGzip
+	}
+}
+
+// nopWriteCloser wraps an io.Writer so that it implements io.WriteCloser.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// zstdWriter wraps a *zstd.Encoder so that Close can be safely called more
+// than once (a second call to Encoder.Close would write another frame).
+type zstdWriter struct {
+	*zstd.Encoder
+	closed bool
+}
+
+func (zw *zstdWriter) Close() error {
+	if zw.closed {
+		return nil
+	}
+	zw.closed = true
+	return zw.Encoder.Close()
+}
+
+// compress returns a writer which compresses everything written to it with
+// c, and writes the result to w. Closing the returned writer does not close w.
+// The level is only used for GzipCompression, and a level of 0 is treated as
+// DefaultCompressionLevel. Similarly, jobs of 0 is treated as
+// DefaultCompressionJobs().
+func (c Compression) compress(w io.Writer, level int, jobs int) (io.WriteCloser, error) {
+	if jobs == 0 {
+		jobs = DefaultCompressionJobs()
+	}
+	switch c {
+	case ZstdCompression:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(jobs))
+		if err != nil {
+			return nil, errors.Wrap(err, "create zstd writer")
+		}
+		return &zstdWriter{Encoder: zw}, nil
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	default:
+		if level == 0 {
+			level = DefaultCompressionLevel
+		}
+		gzw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip writer")
+		}
+		if err := gzw.SetConcurrency(256<<10, jobs); err != nil {
+			return nil, errors.Wrapf(err, "set concurrency level to %v blocks", jobs)
+		}
+		// Don't embed a timestamp or filename in the gzip header, so that the
+		// same layer contents always result in the same blob. pgzip writes the
+		// zero time.Time as a (bogus) non-zero timestamp, but an mtime of 0
+		// means "no timestamp" in gzip.
+		gzw.Header.ModTime = time.Unix(0, 0)
+		gzw.Header.Name = ""
+		gzw.Header.Comment = ""
+		return gzw, nil
+	}
+}
+
+// SetCompression sets the algorithm used to compress all layers which are
+// subsequently added to the image. By default, GzipCompression is used.
+func (m *Mutator) SetCompression(compression Compression) {
+	m.compression = compression
+}
+
+// SetCompressionLevel sets the gzip compression level used to compress all
+// layers which are subsequently added to the image. The level must either be
+// DefaultCompressionLevel or between gzip.BestSpeed (1) and
+// gzip.BestCompression (9). It has no effect unless GzipCompression is used.
+func (m *Mutator) SetCompressionLevel(level int) error {
+	if err := validateCompressionLevel(level); err != nil {
+		return err
+	}
+	m.compressionLevel = level
+	return nil
+}
+
+// SetCompressionJobs sets the number of blocks of each layer which are
+// compressed concurrently, for all layers which are subsequently added to the
+// image. The default is DefaultCompressionJobs(). Setting jobs to 1 disables
+// concurrent compression. The compressed layers do not depend on the number
+// of jobs with GzipCompression. It has no effect with NoCompression.
+func (m *Mutator) SetCompressionJobs(jobs int) error {
+	if jobs < 1 {
+		return errors.Errorf("number of compression jobs must be at least 1: %d", jobs)
+	}
+	m.compressionJobs = jobs
+	return nil
+}
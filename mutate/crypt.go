@@ -0,0 +1,139 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/crypt"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// EncryptLayers encrypts every layer of the image which isn't already
+// encrypted, such that it can be decrypted by the holder of the private key of
+// any of the given recipients (see crypt.EncryptLayer). The contents of the
+// layers are unchanged, so the DiffIDs and history of the image are not
+// modified.
+func (m *Mutator) EncryptLayers(ctx context.Context, recipients []*rsa.PublicKey) error {
+	if len(recipients) == 0 {
+		return errors.New("encrypt layers: no recipients specified")
+	}
+	return m.mapLayerBlobs(ctx, func(descriptor ispec.Descriptor, r io.Reader) (ispec.Descriptor, error) {
+		if crypt.IsEncrypted(descriptor.MediaType) {
+			log.Debugf("encrypt layers: layer %s is already encrypted", descriptor.Digest)
+			return descriptor, nil
+		}
+
+		encrypter, err := crypt.EncryptLayer(r, descriptor.Digest.Algorithm(), recipients)
+		if err != nil {
+			return ispec.Descriptor{}, err
+		}
+		layerDigest, layerSize, err := m.engine.PutBlob(ctx, encrypter)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "put encrypted layer")
+		}
+		encAnnotations, err := encrypter.Annotations()
+		if err != nil {
+			return ispec.Descriptor{}, err
+		}
+
+		annotations := map[string]string{}
+		for k, v := range descriptor.Annotations {
+			annotations[k] = v
+		}
+		for k, v := range encAnnotations {
+			annotations[k] = v
+		}
+		return ispec.Descriptor{
+			MediaType:   crypt.EncryptedMediaType(descriptor.MediaType),
+			Digest:      layerDigest,
+			Size:        layerSize,
+			Annotations: annotations,
+		}, nil
+	})
+}
+
+// DecryptLayers decrypts every encrypted layer of the image, using the first
+// of the given private keys which is a recipient of each layer (see
+// crypt.DecryptLayer). It is an error if none of the keys can decrypt one of
+// the layers. As with EncryptLayers, the DiffIDs and history of the image are
+// not modified.
+func (m *Mutator) DecryptLayers(ctx context.Context, keys []*rsa.PrivateKey) error {
+	return m.mapLayerBlobs(ctx, func(descriptor ispec.Descriptor, r io.Reader) (ispec.Descriptor, error) {
+		if !crypt.IsEncrypted(descriptor.MediaType) {
+			return descriptor, nil
+		}
+
+		decrypter, err := crypt.DecryptLayer(ioutil.NopCloser(r), descriptor, keys)
+		if err != nil {
+			return ispec.Descriptor{}, err
+		}
+		defer decrypter.Close()
+
+		layerDigest, layerSize, err := m.engine.PutBlob(ctx, decrypter)
+		if err != nil {
+			return ispec.Descriptor{}, errors.Wrap(err, "put decrypted layer")
+		}
+		return ispec.Descriptor{
+			MediaType:   crypt.DecryptedMediaType(descriptor.MediaType),
+			Digest:      layerDigest,
+			Size:        layerSize,
+			Annotations: crypt.StripAnnotations(descriptor.Annotations),
+		}, nil
+	})
+}
+
+// mapLayerBlobs replaces the descriptor of every layer of the image with the
+// result of calling fn with the descriptor and the (verified) blob of the
+// layer. If fn returns the descriptor unmodified, the blob need not be read.
+// Unlike MapLayers, the layer blobs are passed as-is (without being
+// decompressed), so fn must ensure that the contents of the layer are
+// unchanged.
+func (m *Mutator) mapLayerBlobs(ctx context.Context, fn func(descriptor ispec.Descriptor, r io.Reader) (ispec.Descriptor, error)) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	newLayers := make([]ispec.Descriptor, len(m.manifest.Layers))
+	for idx, descriptor := range m.manifest.Layers {
+		if err := func() error {
+			blob, err := m.engine.GetVerifiedBlob(ctx, descriptor)
+			if err != nil {
+				return errors.Wrap(err, "get layer blob")
+			}
+			defer blob.Close()
+
+			newDescriptor, err := fn(descriptor, blob)
+			if err != nil {
+				return err
+			}
+			newLayers[idx] = newDescriptor
+			return nil
+		}(); err != nil {
+			return errors.Wrapf(err, "map layer %d", idx)
+		}
+	}
+
+	m.manifest.Layers = newLayers
+	return nil
+}
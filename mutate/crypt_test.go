@@ -0,0 +1,115 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/crypt"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestMutateEncryptDecryptLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateEncryptDecryptLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	alice, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eve, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	oldLayers := append([]ispec.Descriptor(nil), mutator.manifest.Layers...)
+	oldConfig := *mutator.config
+
+	if err := mutator.EncryptLayers(context.Background(), nil); err == nil {
+		t.Errorf("expected error encrypting without recipients")
+	}
+	if err := mutator.EncryptLayers(context.Background(), []*rsa.PublicKey{&alice.PublicKey}); err != nil {
+		t.Fatalf("unexpected error encrypting layers: %+v", err)
+	}
+
+	encLayer := mutator.manifest.Layers[0]
+	if encLayer.MediaType != crypt.EncryptedMediaType(oldLayers[0].MediaType) {
+		t.Errorf("unexpected encrypted layer media type: %s", encLayer.MediaType)
+	}
+	if encLayer.Digest == oldLayers[0].Digest {
+		t.Errorf("encrypted layer has the same digest as the original")
+	}
+	for _, annotation := range []string{crypt.AnnotationJWEKeys, crypt.AnnotationPubOpts} {
+		if _, ok := encLayer.Annotations[annotation]; !ok {
+			t.Errorf("encrypted layer is missing %s annotation", annotation)
+		}
+	}
+	if !reflect.DeepEqual(*mutator.config, oldConfig) {
+		t.Errorf("encrypting layers modified the configuration")
+	}
+
+	// Encrypting again is a no-op.
+	if err := mutator.EncryptLayers(context.Background(), []*rsa.PublicKey{&eve.PublicKey}); err != nil {
+		t.Fatalf("unexpected error re-encrypting layers: %+v", err)
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[0], encLayer) {
+		t.Errorf("re-encrypting layers modified encrypted layer")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptorPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.DecryptLayers(context.Background(), []*rsa.PrivateKey{eve}); err == nil {
+		t.Errorf("expected error decrypting layers with the wrong key")
+	}
+	if err := mutator.DecryptLayers(context.Background(), []*rsa.PrivateKey{eve, alice}); err != nil {
+		t.Fatalf("unexpected error decrypting layers: %+v", err)
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers, oldLayers) {
+		t.Errorf("decrypted layers don't match original: expected %+v got %+v", oldLayers, mutator.manifest.Layers)
+	}
+	if !reflect.DeepEqual(*mutator.config, oldConfig) {
+		t.Errorf("decrypting layers modified the configuration")
+	}
+}
@@ -23,15 +23,18 @@
 package mutate
 
 import (
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
-	"runtime"
 	"time"
 
 	"github.com/apex/log"
-	gzip "github.com/klauspost/pgzip"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/casext/mediatype"
+	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -62,9 +65,47 @@ type Mutator struct {
 	engine casext.Engine
 	source casext.DescriptorPath
 
-	// Cached values of the configuration and manifest.
+	// Cached values of the configuration and manifest. They are loaded from
+	// source once (see cache), and are invalidated by Commit and Refresh.
 	manifest *ispec.Manifest
 	config   *ispec.Image
+
+	// artifactType is the cached "artifactType" of the manifest, which is
+	// stored separately because ispec.Manifest doesn't have the field.
+	artifactType string
+
+	// variant is the cached "variant" of the configuration, which is stored
+	// separately because ispec.Image doesn't have the field.
+	variant string
+
+	// platformChanged is whether SetPlatform has been called since the
+	// cache was loaded, in which case Commit also updates the platform of
+	// the index entry referencing the manifest.
+	platformChanged bool
+
+	// compression is the algorithm used to compress added layers (see
+	// SetCompression).
+	compression Compression
+
+	// compressionLevel is the gzip compression level used for added layers
+	// (see SetCompressionLevel). 0 means DefaultCompressionLevel.
+	compressionLevel int
+
+	// compressionJobs is the number of blocks compressed concurrently for
+	// added layers (see SetCompressionJobs). 0 means DefaultCompressionJobs().
+	compressionJobs int
+
+	// annotations are merged into the annotations of the manifest by Commit
+	// (see AddAnnotations).
+	annotations map[string]string
+
+	// layerAnnotations are the annotations of the descriptors of added layers
+	// (see SetLayerAnnotations).
+	layerAnnotations map[string]string
+
+	// layerURLs are the urls of the descriptors of added layers (see
+	// SetLayerURLs).
+	layerURLs []string
 }
 
 // Meta is a wrapper around the "safe" fields in ispec.Image, which can be
@@ -86,6 +127,11 @@ type Meta struct {
 	// OS is the name of the operating system which the image is built to run
 	// on.
 	OS string `json:"os"`
+
+	// Variant is the variant of the CPU architecture which the binaries in
+	// this image are built to run on (such as "v7" for the "arm"
+	// architecture).
+	Variant string `json:"variant,omitempty"`
 }
 
 // cache ensures that the cached versions of the related configurations have
@@ -94,52 +140,90 @@ type Meta struct {
 func (m *Mutator) cache(ctx context.Context) error {
 	// We need the manifest
 	if m.manifest == nil {
-		blob, err := m.engine.FromDescriptor(ctx, m.source.Descriptor())
-		if err != nil {
-			return errors.Wrap(err, "cache source manifest")
+		descriptor := m.source.Descriptor()
+		if descriptor.MediaType != ispec.MediaTypeImageManifest {
+			// Should _never_ be reached.
+			return errors.Errorf("[internal error] unknown manifest blob type: %s", descriptor.MediaType)
 		}
-		defer blob.Close()
 
-		manifest, ok := blob.Data.(ispec.Manifest)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] unknown manifest blob type: %s", blob.Descriptor.MediaType)
+		// The artifact type isn't included in ispec.Manifest, so we parse the
+		// manifest ourselves to avoid reading it twice.
+		var manifest artifactManifest
+		if err := getJSONBlob(ctx, m.engine, descriptor, &manifest); err != nil {
+			return errors.Wrap(err, "cache source manifest")
 		}
 
 		// Make a copy of the manifest.
-		m.manifest = manifestPtr(manifest)
+		m.manifest = manifestPtr(manifest.Manifest)
+		m.artifactType = manifest.ArtifactType
 	}
 
 	if m.config == nil {
-		blob, err := m.engine.FromDescriptor(ctx, m.manifest.Config)
-		if err != nil {
-			return errors.Wrap(err, "cache source config")
+		descriptor := m.manifest.Config
+		if descriptor.MediaType != ispec.MediaTypeImageConfig && descriptor.MediaType != mediatype.DockerConfig {
+			// Should _never_ be reached.
+			return errors.Errorf("[internal error] unknown config blob type: %s", descriptor.MediaType)
 		}
-		defer blob.Close()
 
-		config, ok := blob.Data.(ispec.Image)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] unknown config blob type: %s", blob.Descriptor.MediaType)
+		// Similarly, the variant isn't included in ispec.Image.
+		var config variantImage
+		if err := getJSONBlob(ctx, m.engine, descriptor, &config); err != nil {
+			return errors.Wrap(err, "cache source config")
 		}
 
 		// Make a copy of the config and configDescriptor.
-		m.config = configPtr(config)
+		m.config = configPtr(config.Image)
+		m.variant = config.Variant
 	}
 
 	return nil
 }
 
+// getJSONBlob reads the blob referenced by descriptor (verifying its digest
+// and size) and decodes it as JSON into v.
+func getJSONBlob(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, v interface{}) error {
+	reader, err := engine.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		return errors.Wrapf(err, "parse %s", descriptor.MediaType)
+	}
+	// Make sure the entire blob is verified.
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return errors.Wrap(err, "discard trailing data")
+	}
+	return errors.Wrap(reader.Close(), "close blob")
+}
+
 // New creates a new Mutator for the given descriptor (which _must_ have a
-// MediaType of ispec.MediaTypeImageManifest.
+// MediaType of ispec.MediaTypeImageManifest, or be an index containing a
+// manifest for casext.DefaultPlatform).
 func New(engine cas.Engine, src casext.DescriptorPath) (*Mutator, error) {
+	return NewPlatform(engine, src, casext.DefaultPlatform())
+}
+
+// NewPlatform is like New, except that if src refers to an index then the
+// manifest in the index suitable for the given platform is modified (see
+// casext.ResolvePlatform). The other entries in the index are left untouched
+// by Commit.
+func NewPlatform(engine cas.Engine, src casext.DescriptorPath, platform ispec.Platform) (*Mutator, error) {
+	engineExt := casext.NewEngine(engine)
+
+	src, err := engineExt.ResolvePlatform(context.Background(), src, platform)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve platform manifest")
+	}
+
 	// We currently only support changing a given manifest through a walk.
 	if mt := src.Descriptor().MediaType; mt != ispec.MediaTypeImageManifest {
 		return nil, errors.Errorf("unsupported source type: %s", mt)
 	}
 
 	return &Mutator{
-		engine: casext.NewEngine(engine),
+		engine: engineExt,
 		source: src,
 	}, nil
 }
@@ -171,6 +255,7 @@ func (m *Mutator) Meta(ctx context.Context) (Meta, error) {
 		Author:       m.config.Author,
 		Architecture: m.config.Architecture,
 		OS:           m.config.OS,
+		Variant:      m.variant,
 	}, nil
 }
 
@@ -190,6 +275,67 @@ func (m *Mutator) Annotations(ctx context.Context) (map[string]string, error) {
 	return annotations, nil
 }
 
+// AddAnnotations adds the given annotations to the manifest written by Commit.
+// They are merged into the annotations of the manifest (including any set with
+// Set) when it is committed, so an existing annotation is only replaced if the
+// same key is given. If AddAnnotations is called more than once, the
+// annotations of each call are merged in order.
+func (m *Mutator) AddAnnotations(annotations map[string]string) {
+	if m.annotations == nil {
+		m.annotations = map[string]string{}
+	}
+	for k, v := range annotations {
+		m.annotations[k] = v
+	}
+}
+
+// SetAnnotations replaces the annotations of the current manifest with the
+// given set (a nil or empty map removes all of them), without modifying the
+// image configuration or history. Any annotations given to AddAnnotations are
+// still merged in by Commit.
+func (m *Mutator) SetAnnotations(ctx context.Context, annotations map[string]string) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.manifest.Annotations = nil
+	if len(annotations) > 0 {
+		m.manifest.Annotations = map[string]string{}
+		for k, v := range annotations {
+			m.manifest.Annotations[k] = v
+		}
+	}
+	return nil
+}
+
+// SetLayerAnnotations sets the annotations of the descriptors of all layers
+// which are subsequently added to the image (including the descriptor
+// returned by DescribeLayer). By default, added layers have no annotations.
+// Layers added with AddExisting keep the annotations of their descriptor.
+func (m *Mutator) SetLayerAnnotations(annotations map[string]string) {
+	m.layerAnnotations = nil
+	if len(annotations) > 0 {
+		m.layerAnnotations = map[string]string{}
+		for k, v := range annotations {
+			m.layerAnnotations[k] = v
+		}
+	}
+}
+
+// SetLayerURLs sets the urls of the descriptors of all layers which are
+// subsequently added to the image (including the descriptor returned by
+// DescribeLayer), making them foreign layers which can be fetched from any of
+// the urls. The layer blobs are still added to the image, but since clients
+// may fetch them from the urls instead, they can be removed from the image
+// once they have been uploaded (see layer.UnpackOptions.ForeignLayers). By
+// default, added layers have no urls.
+func (m *Mutator) SetLayerURLs(urls []string) {
+	m.layerURLs = nil
+	if len(urls) > 0 {
+		m.layerURLs = append([]string(nil), urls...)
+	}
+}
+
 // Set sets the image configuration and metadata to the given values. The
 // provided ispec.History entry is appended to the image's history and should
 // correspond to what operations were made to the configuration.
@@ -209,6 +355,7 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	m.config.Author = meta.Author
 	m.config.Architecture = meta.Architecture
 	m.config.OS = meta.OS
+	m.variant = meta.Variant
 
 	// Append history.
 	if history != nil {
@@ -218,33 +365,269 @@ func (m *Mutator) Set(ctx context.Context, config ispec.ImageConfig, meta Meta,
 	return nil
 }
 
-// add adds the given layer to the CAS, and mutates the configuration to
-// include the diffID. The returned string is the digest of the *compressed*
-// layer (which is compressed by us).
-func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.History) (digest.Digest, int64, error) {
+// History returns the current (cached) image history. The returned slice is a
+// copy, and should be used as the source for any modifications of the history
+// using SetHistory.
+func (m *Mutator) History(ctx context.Context) ([]ispec.History, error) {
 	if err := m.cache(ctx); err != nil {
-		return "", -1, errors.Wrap(err, "getting cache failed")
+		return nil, errors.Wrap(err, "getting cache failed")
 	}
 
-	diffidDigester := cas.BlobAlgorithm.Digester()
+	history := make([]ispec.History, len(m.config.History))
+	copy(history, m.config.History)
+	return history, nil
+}
+
+// countNonEmpty returns the number of entries in the given history which
+// correspond to a layer (in other words, which are not EmptyLayer entries).
+func countNonEmpty(history []ispec.History) int {
+	n := 0
+	for _, entry := range history {
+		if !entry.EmptyLayer {
+			n++
+		}
+	}
+	return n
+}
+
+// SetHistory replaces the entire image history with the given set of entries.
+// This is intended for post-hoc modification of existing history entries (such
+// as sanitising their contents), and so the new history must have the same
+// number of non-empty-layer entries as the current history -- otherwise the
+// correspondence between history entries and layers would be broken.
+func (m *Mutator) SetHistory(ctx context.Context, history []ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	if got, want := countNonEmpty(history), countNonEmpty(m.config.History); got != want {
+		return errors.Errorf("new history has %d non-empty layer entries, expected %d", got, want)
+	}
+
+	m.config.History = make([]ispec.History, len(history))
+	copy(m.config.History, history)
+	return nil
+}
+
+// Layers returns the current set of layer descriptors in the manifest (from the
+// bottom-most layer upwards).
+func (m *Mutator) Layers(ctx context.Context) ([]ispec.Descriptor, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	layers := make([]ispec.Descriptor, len(m.manifest.Layers))
+	copy(layers, m.manifest.Layers)
+	return layers, nil
+}
+
+// DiffIDs returns the current rootfs.diff_ids of the image configuration.
+func (m *Mutator) DiffIDs(ctx context.Context) ([]digest.Digest, error) {
+	if err := m.cache(ctx); err != nil {
+		return nil, errors.Wrap(err, "getting cache failed")
+	}
+
+	diffIDs := make([]digest.Digest, len(m.config.RootFS.DiffIDs))
+	copy(diffIDs, m.config.RootFS.DiffIDs)
+	return diffIDs, nil
+}
+
+// SetDiffIDs replaces the rootfs.diff_ids of the image configuration. This is
+// only intended for repairing images with incorrect diff_ids, and so there must
+// be exactly one diff_id for each layer in the manifest. No attempt is made to
+// verify that the diff_ids match the layers.
+func (m *Mutator) SetDiffIDs(ctx context.Context, diffIDs []digest.Digest) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	if len(diffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("got %d diff_ids, expected %d (one for each layer)", len(diffIDs), len(m.manifest.Layers))
+	}
+
+	m.config.RootFS.DiffIDs = make([]digest.Digest, len(diffIDs))
+	copy(m.config.RootFS.DiffIDs, diffIDs)
+	return nil
+}
+
+// TruncateLayers removes all but the first n layers of the image (from the
+// bottom-most layer upwards), along with their diff_ids. If every layer has a
+// history entry, the history is also truncated just before the entry of the
+// first removed layer -- otherwise the history is left untouched, since it's
+// not possible to tell which entries correspond to the removed layers. The
+// rest of the configuration is not modified.
+func (m *Mutator) TruncateLayers(ctx context.Context, n int) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	if n < 0 || n > len(m.manifest.Layers) {
+		return errors.Errorf("cannot truncate image with %d layers to %d layers", len(m.manifest.Layers), n)
+	}
+
+	if countNonEmpty(m.config.History) == len(m.manifest.Layers) {
+		var (
+			cut      = len(m.config.History)
+			nonEmpty int
+		)
+		for idx, entry := range m.config.History {
+			if entry.EmptyLayer {
+				continue
+			}
+			if nonEmpty == n {
+				cut = idx
+				break
+			}
+			nonEmpty++
+		}
+		m.config.History = m.config.History[:cut]
+	}
+	if len(m.config.RootFS.DiffIDs) > n {
+		m.config.RootFS.DiffIDs = m.config.RootFS.DiffIDs[:n]
+	}
+	m.manifest.Layers = m.manifest.Layers[:n]
+	return nil
+}
+
+// layerHistoryIndex returns the index of the history entry of the layer with
+// the given index. If not every layer has a history entry, it is not possible
+// to tell which entry corresponds to the layer and -1 is returned. The cache
+// must already be loaded.
+func (m *Mutator) layerHistoryIndex(n int) int {
+	if countNonEmpty(m.config.History) != len(m.manifest.Layers) {
+		return -1
+	}
+	var nonEmpty int
+	for idx, entry := range m.config.History {
+		if entry.EmptyLayer {
+			continue
+		}
+		if nonEmpty == n {
+			return idx
+		}
+		nonEmpty++
+	}
+	return -1
+}
+
+// checkLayerIndex returns an error if n is not the index of a layer of the
+// image, or if the image doesn't have a diff_id for every layer. The cache
+// must already be loaded.
+func (m *Mutator) checkLayerIndex(n int) error {
+	if n < 0 || n >= len(m.manifest.Layers) {
+		return errors.Errorf("image has no layer %d (it has %d layers)", n, len(m.manifest.Layers))
+	}
+	if len(m.config.RootFS.DiffIDs) != len(m.manifest.Layers) {
+		return errors.Errorf("image has %d diff_ids but %d layers", len(m.config.RootFS.DiffIDs), len(m.manifest.Layers))
+	}
+	return nil
+}
+
+// RemoveLayer removes the layer with index n (counting from the bottom-most
+// layer, starting at 0) from the image, along with its diff_id. If every layer
+// has a history entry, the history entry of the layer is also removed --
+// otherwise the history is left untouched. Note that removing a layer changes
+// the root filesystem seen by every layer above it (for instance, whiteouts
+// for files added by the removed layer no longer have any effect).
+func (m *Mutator) RemoveLayer(ctx context.Context, n int) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if err := m.checkLayerIndex(n); err != nil {
+		return err
+	}
+
+	if idx := m.layerHistoryIndex(n); idx >= 0 {
+		m.config.History = append(m.config.History[:idx:idx], m.config.History[idx+1:]...)
+	} else {
+		log.Warnf("cannot identify the history entry of layer %d -- leaving history untouched", n)
+	}
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs[:n:n], m.config.RootFS.DiffIDs[n+1:]...)
+	m.manifest.Layers = append(m.manifest.Layers[:n:n], m.manifest.Layers[n+1:]...)
+	return nil
+}
+
+// ReplaceLayer replaces the layer with index n (counting from the bottom-most
+// layer, starting at 0) with the layer read from r. As with Add, the stream
+// must not be compressed. The new layer is compressed with the current
+// compression, has the current layer annotations (see SetLayerAnnotations),
+// and is non-distributable if the replaced layer was. If history is non-nil
+// and every layer has a history entry, it replaces the history entry of the
+// replaced layer -- otherwise the history is left untouched.
+func (m *Mutator) ReplaceLayer(ctx context.Context, n int, r io.Reader, history *ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if err := m.checkLayerIndex(n); err != nil {
+		return err
+	}
+
+	layerDigest, layerSize, layerDiffID, err := m.putLayer(ctx, r)
+	if err != nil {
+		return errors.Wrap(err, "put layer")
+	}
+
+	if history != nil {
+		if idx := m.layerHistoryIndex(n); idx >= 0 {
+			entry := *history
+			entry.EmptyLayer = false
+			m.config.History[idx] = entry
+		} else {
+			log.Warnf("cannot identify the history entry of layer %d -- leaving history untouched", n)
+		}
+	}
+	m.config.RootFS.DiffIDs[n] = layerDiffID
+	m.manifest.Layers[n] = m.layerDescriptor(layerDigest, layerSize, isNonDistributable(m.manifest.Layers[n].MediaType))
+	return nil
+}
+
+// putLayer compresses the given (uncompressed) layer and adds it to the CAS,
+// returning the digest and size of the compressed blob as well as the DiffID
+// of the layer. The configuration is not modified.
+func (m *Mutator) putLayer(ctx context.Context, reader io.Reader) (digest.Digest, int64, digest.Digest, error) {
+	return m.compressLayer(reader, func(r io.Reader) (digest.Digest, int64, error) {
+		return m.engine.PutBlob(ctx, r)
+	})
+}
+
+// diffIDAlgorithm returns the digest algorithm to use for the DiffIDs of new
+// layers. To keep the rootfs consistent, this is the algorithm already used by
+// the image's DiffIDs (or the algorithm used for new blobs, if the image has no
+// layers).
+func (m *Mutator) diffIDAlgorithm() digest.Algorithm {
+	if m.config != nil && len(m.config.RootFS.DiffIDs) > 0 {
+		if algo := m.config.RootFS.DiffIDs[0].Algorithm(); cas.IsSupportedAlgorithm(algo) {
+			return algo
+		}
+	}
+	return m.engine.BlobAlgorithm()
+}
+
+// compressLayer compresses the given (uncompressed) layer and passes the
+// compressed stream to put, which returns the digest and size of the
+// compressed blob. The DiffID of the layer is also returned. The layer is
+// hashed and compressed concurrently with put reading the compressed stream,
+// so the layer is never held in full.
+func (m *Mutator) compressLayer(reader io.Reader, put func(io.Reader) (digest.Digest, int64, error)) (digest.Digest, int64, digest.Digest, error) {
+	diffidDigester := m.diffIDAlgorithm().Digester()
 	hashReader := io.TeeReader(reader, diffidDigester.Hash())
 
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 
-	gzw := gzip.NewWriter(pipeWriter)
-	defer gzw.Close()
-	if err := gzw.SetConcurrency(256<<10, 2*runtime.NumCPU()); err != nil {
-		return "", -1, errors.Wrapf(err, "set concurrency level to %v blocks", 2*runtime.NumCPU())
+	compressWriter, err := m.compression.compress(pipeWriter, m.compressionLevel, m.compressionJobs)
+	if err != nil {
+		return "", -1, "", errors.Wrap(err, "create compressed writer")
 	}
+	defer compressWriter.Close()
 	go func() {
-		if _, err := io.Copy(gzw, hashReader); err != nil {
+		if _, err := io.Copy(compressWriter, hashReader); err != nil {
 			// #nosec G104
 			_ = pipeWriter.CloseWithError(errors.Wrap(err, "compressing layer"))
 		}
-		if err := gzw.Close(); err != nil {
+		if err := compressWriter.Close(); err != nil {
 			// #nosec G104
-			_ = pipeWriter.CloseWithError(errors.Wrap(err, "close gzip writer"))
+			_ = pipeWriter.CloseWithError(errors.Wrap(err, "close compressed writer"))
 		}
 		if err := pipeWriter.Close(); err != nil {
 			// #nosec G104
@@ -252,14 +635,60 @@ func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.Hist
 		}
 	}()
 
-	layerDigest, layerSize, err := m.engine.PutBlob(ctx, pipeReader)
+	layerDigest, layerSize, err := put(pipeReader)
 	if err != nil {
-		return "", -1, errors.Wrap(err, "put layer blob")
+		return "", -1, "", errors.Wrap(err, "put layer blob")
 	}
 
+	return layerDigest, layerSize, diffidDigester.Digest(), nil
+}
+
+// add adds the given layer to the CAS, and mutates the configuration to
+// include the diffID. The returned string is the digest of the *compressed*
+// layer (which is compressed by us).
+func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.History) (digest.Digest, int64, error) {
+	if err := m.cache(ctx); err != nil {
+		return "", -1, errors.Wrap(err, "getting cache failed")
+	}
+
+	layerDigest, layerSize, layerDiffID, err := m.putLayer(ctx, reader)
+	if err != nil {
+		return "", -1, err
+	}
+	m.addDiffID(layerDiffID, history)
+	return layerDigest, layerSize, nil
+}
+
+// layerDescriptor returns the descriptor for a layer added to the image with
+// the given digest and size, using the current compression, layer annotations
+// and layer urls.
+func (m *Mutator) layerDescriptor(layerDigest digest.Digest, layerSize int64, nonDistributable bool) ispec.Descriptor {
+	var annotations map[string]string
+	if m.layerAnnotations != nil {
+		annotations = map[string]string{}
+		for k, v := range m.layerAnnotations {
+			annotations[k] = v
+		}
+	}
+	var urls []string
+	if m.layerURLs != nil {
+		urls = append([]string(nil), m.layerURLs...)
+	}
+	return ispec.Descriptor{
+		MediaType:   m.compression.mediaType(nonDistributable),
+		Digest:      layerDigest,
+		Size:        layerSize,
+		URLs:        urls,
+		Annotations: annotations,
+	}
+}
+
+// addDiffID mutates the configuration to include the diffID of a new layer,
+// as well as the history entry for it (if any). The cache must already be
+// loaded.
+func (m *Mutator) addDiffID(diffID digest.Digest, history *ispec.History) {
 	// Add DiffID to configuration.
-	layerDiffID := diffidDigester.Digest()
-	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, layerDiffID)
+	m.config.RootFS.DiffIDs = append(m.config.RootFS.DiffIDs, diffID)
 
 	// Append history.
 	if history != nil {
@@ -272,14 +701,22 @@ func (m *Mutator) add(ctx context.Context, reader io.Reader, history *ispec.Hist
 		// quite confused).
 		log.Warnf("new layer has no history entry -- this will confuse many tools!")
 	}
-	return layerDigest, layerSize, nil
 }
 
 // Add adds a layer to the image, by reading the layer changeset blob from the
 // provided reader. The stream must not be compressed, as it is used to
 // generate the DiffIDs for the image metatadata. The provided history entry is
 // appended to the image's history and should correspond to what operations
-// were made to the configuration.
+// were made to the configuration. If history is nil, the layer is added
+// without a history entry -- note that the resulting image will then have
+// fewer non-empty-layer history entries than layers, which strict validators
+// (and tools which correlate history with layers) may reject.
+//
+// The layer is compressed, digested and written to the CAS in a single pass
+// as it is read from r, so neither the uncompressed nor the compressed layer
+// is buffered in memory or spooled to disk before being written (the engine
+// only writes the compressed blob to a temporary file, which is renamed once
+// its digest is known).
 func (m *Mutator) Add(ctx context.Context, r io.Reader, history *ispec.History) error {
 	if err := m.cache(ctx); err != nil {
 		return errors.Wrap(err, "getting cache failed")
@@ -291,12 +728,7 @@ func (m *Mutator) Add(ctx context.Context, r io.Reader, history *ispec.History)
 	}
 
 	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerGzip,
-		Digest:    digest,
-		Size:      size,
-	})
+	m.manifest.Layers = append(m.manifest.Layers, m.layerDescriptor(digest, size, false))
 	return nil
 }
 
@@ -313,26 +745,215 @@ func (m *Mutator) AddNonDistributable(ctx context.Context, r io.Reader, history
 	}
 
 	// Append to layers.
-	m.manifest.Layers = append(m.manifest.Layers, ispec.Descriptor{
-		// TODO: Detect whether the layer is gzip'd or not...
-		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
-		Digest:    digest,
-		Size:      size,
+	m.manifest.Layers = append(m.manifest.Layers, m.layerDescriptor(digest, size, true))
+	return nil
+}
+
+// DescribeLayer returns the descriptor and DiffID of the layer that Add (or
+// AddNonDistributable, if nonDistributable is set) would add to the image for
+// the given uncompressed layer, without adding the layer to the CAS or
+// modifying the image.
+func (m *Mutator) DescribeLayer(ctx context.Context, r io.Reader, nonDistributable bool) (ispec.Descriptor, digest.Digest, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "getting cache failed")
+	}
+
+	layerDigest, layerSize, layerDiffID, err := m.compressLayer(r, func(r io.Reader) (digest.Digest, int64, error) {
+		digester := m.engine.BlobAlgorithm().Digester()
+		size, err := io.Copy(digester.Hash(), r)
+		if err != nil {
+			return "", -1, err
+		}
+		return digester.Digest(), size, nil
 	})
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrap(err, "describe layer")
+	}
+	return m.layerDescriptor(layerDigest, layerSize, nonDistributable), layerDiffID, nil
+}
+
+// AddExisting adds a layer blob which is already present in the CAS to the
+// image, without reading its contents. layerDescriptor must have one of the
+// layer media types, and diffID must be the DiffID of the layer (the digest
+// of its uncompressed contents). The blob must exist in the engine and have
+// the size given by layerDescriptor, but since the blob is not read neither
+// its contents nor diffID are verified -- callers should only use this with
+// layers they have generated (or verified) themselves. The history entry is
+// handled the same way as with Add.
+func (m *Mutator) AddExisting(ctx context.Context, layerDescriptor ispec.Descriptor, diffID digest.Digest, history *ispec.History) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	if !layer.IsSupportedLayerType(layerDescriptor.MediaType) {
+		return errors.Errorf("add existing layer: unsupported layer media type: %s", layerDescriptor.MediaType)
+	}
+	if err := layerDescriptor.Digest.Validate(); err != nil {
+		return errors.Wrap(err, "add existing layer: invalid layer digest")
+	}
+	if err := diffID.Validate(); err != nil {
+		return errors.Wrap(err, "add existing layer: invalid diffid")
+	}
+	size, err := m.engine.BlobSize(ctx, layerDescriptor.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "add existing layer: get layer blob %s", layerDescriptor.Digest)
+	}
+	if size != layerDescriptor.Size {
+		return errors.Errorf("add existing layer: blob %s has size %d (descriptor has size %d)", layerDescriptor.Digest, size, layerDescriptor.Size)
+	}
+
+	m.addDiffID(diffID, history)
+	m.manifest.Layers = append(m.manifest.Layers, layerDescriptor)
+	return nil
+}
+
+// isNonDistributable returns whether the given layer media type is one of the
+// non-distributable layer media types.
+func isNonDistributable(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageLayerNonDistributable ||
+		mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
+		mediaType == layer.MediaTypeImageLayerNonDistributableZstd
+}
+
+// Squash replaces all of the layers of the image (followed by the layer read
+// from r, if r is non-nil) with a single layer equivalent to applying them in
+// order (see layer.SquashLayers). As with Add, the stream must not be
+// compressed. Since the existing history entries no longer correspond to any
+// layer, the image's history is replaced with just the provided history entry
+// (if history is nil, the squashed layer has no history entry). If any of the
+// squashed layers was non-distributable, so is the squashed layer.
+func (m *Mutator) Squash(ctx context.Context, r io.Reader, history *ispec.History) error {
+	return errors.Wrap(m.squash(ctx, r, history, false), "squash layers")
+}
+
+// SquashNonDistributable is the same as Squash, except that the squashed layer
+// is always a non-distributable layer.
+func (m *Mutator) SquashNonDistributable(ctx context.Context, r io.Reader, history *ispec.History) error {
+	return errors.Wrap(m.squash(ctx, r, history, true), "squash layers into non-distributable layer")
+}
+
+// squash implements Squash and SquashNonDistributable.
+func (m *Mutator) squash(ctx context.Context, r io.Reader, history *ispec.History, nonDistributable bool) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	var openers []layer.Opener
+	for _, descriptor := range m.manifest.Layers {
+		descriptor := descriptor
+		nonDistributable = nonDistributable || isNonDistributable(descriptor.MediaType)
+		openers = append(openers, func() (io.ReadCloser, error) {
+			return layer.OpenLayer(ctx, m.engine, descriptor)
+		})
+	}
+	if r != nil {
+		// The new layer needs to be read more than once, so spool it to disk.
+		spool, err := ioutil.TempFile("", "umoci-squash-layer-")
+		if err != nil {
+			return errors.Wrap(err, "create spool file")
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if _, err := io.Copy(spool, r); err != nil {
+			return errors.Wrap(err, "spool new layer")
+		}
+		openers = append(openers, func() (io.ReadCloser, error) {
+			return os.Open(spool.Name())
+		})
+	}
+	if len(openers) == 0 {
+		return errors.Errorf("image has no layers to squash")
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeReader.Close()
+	go func() {
+		// #nosec G104
+		_ = pipeWriter.CloseWithError(layer.SquashLayers(openers, pipeWriter))
+	}()
+
+	// The squashed layer replaces all of the existing layers and history, so
+	// only update the configuration once the layer has been added.
+	oldDiffIDs, oldHistory := m.config.RootFS.DiffIDs, m.config.History
+	m.config.RootFS.DiffIDs, m.config.History = nil, nil
+	digest, size, err := m.add(ctx, pipeReader, history)
+	if err != nil {
+		m.config.RootFS.DiffIDs, m.config.History = oldDiffIDs, oldHistory
+		return errors.Wrap(err, "add squashed layer")
+	}
+
+	m.manifest.Layers = []ispec.Descriptor{m.layerDescriptor(digest, size, nonDistributable)}
+	return nil
+}
+
+// MapLayers replaces every layer of the image with the result of calling fn
+// with the uncompressed contents of the layer, which fn must write (as an
+// uncompressed layer) to w. The new layers are compressed as though they were
+// added with Add, but are otherwise equivalent to the layers they replace (in
+// particular, non-distributable layers remain non-distributable). The history
+// of the image is not modified.
+func (m *Mutator) MapLayers(ctx context.Context, fn func(r io.Reader, w io.Writer) error) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+	if len(m.manifest.Layers) != len(m.config.RootFS.DiffIDs) {
+		return errors.Errorf("image has %d layers but %d diff_ids", len(m.manifest.Layers), len(m.config.RootFS.DiffIDs))
+	}
+
+	newLayers := make([]ispec.Descriptor, len(m.manifest.Layers))
+	newDiffIDs := make([]digest.Digest, len(m.manifest.Layers))
+	for idx, descriptor := range m.manifest.Layers {
+		if err := func() error {
+			layerReader, err := layer.OpenLayer(ctx, m.engine, descriptor)
+			if err != nil {
+				return errors.Wrap(err, "open layer")
+			}
+			defer layerReader.Close()
+
+			pipeReader, pipeWriter := io.Pipe()
+			defer pipeReader.Close()
+			go func() {
+				// #nosec G104
+				_ = pipeWriter.CloseWithError(fn(layerReader, pipeWriter))
+			}()
+
+			layerDigest, layerSize, layerDiffID, err := m.putLayer(ctx, pipeReader)
+			if err != nil {
+				return err
+			}
+			newLayers[idx] = ispec.Descriptor{
+				MediaType:   m.compression.mediaType(isNonDistributable(descriptor.MediaType)),
+				Digest:      layerDigest,
+				Size:        layerSize,
+				Annotations: descriptor.Annotations,
+			}
+			newDiffIDs[idx] = layerDiffID
+			return nil
+		}(); err != nil {
+			return errors.Wrapf(err, "map layer %d", idx)
+		}
+	}
+
+	m.manifest.Layers = newLayers
+	m.config.RootFS.DiffIDs = newDiffIDs
 	return nil
 }
 
 // Commit writes all of the temporary changes made to the configuration,
 // metadata and manifest to the engine. It then returns a new manifest
 // descriptor (which can be used in place of the source descriptor provided to
-// New).
+// New). After Commit, the Mutator refers to the committed image, and so any
+// further changes are made on top of the committed changes.
 func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	if err := m.cache(ctx); err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "getting cache failed")
 	}
 
 	// We first have to commit the configuration blob.
-	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, m.config)
+	configDigest, configSize, err := m.engine.PutBlobJSON(ctx, variantImage{
+		Image:   *m.config,
+		Variant: m.variant,
+	})
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated config blob")
 	}
@@ -343,8 +964,24 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 		Size:      configSize,
 	}
 
+	// Merge any annotations added with AddAnnotations. We make a copy since
+	// the map might have been provided by the caller of Set.
+	if len(m.annotations) > 0 {
+		annotations := map[string]string{}
+		for k, v := range m.manifest.Annotations {
+			annotations[k] = v
+		}
+		for k, v := range m.annotations {
+			annotations[k] = v
+		}
+		m.manifest.Annotations = annotations
+	}
+
 	// Now commit the manifest.
-	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, m.manifest)
+	manifestDigest, manifestSize, err := m.engine.PutBlobJSON(ctx, artifactManifest{
+		Manifest:     *m.manifest,
+		ArtifactType: m.artifactType,
+	})
 	if err != nil {
 		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated manifest blob")
 	}
@@ -362,6 +999,7 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 	end := &newPath.Walk[pathLength-1]
 	end.Digest = manifestDigest
 	end.Size = manifestSize
+	m.updatePlatform(end)
 
 	// Walk up the path, mutating the parent reference of each descriptor.
 	for idx := pathLength - 1; idx >= 1; idx-- {
@@ -398,5 +1036,31 @@ func (m *Mutator) Commit(ctx context.Context) (casext.DescriptorPath, error) {
 		newPath.Walk[idx-1].Size = blobSize
 	}
 
+	// Any further mutations are made to the committed image. The cached
+	// manifest and configuration are reloaded from the new blobs the next
+	// time they're needed, so that they match what was actually committed.
+	m.source = newPath
+	m.annotations = nil
+	m.invalidate()
 	return newPath, nil
 }
+
+// invalidate discards the cached manifest and configuration, so that they
+// are reloaded from the source image by the next call to cache.
+func (m *Mutator) invalidate() {
+	m.manifest = nil
+	m.config = nil
+	m.artifactType = ""
+	m.variant = ""
+	m.platformChanged = false
+}
+
+// Refresh discards the cached manifest and configuration of the image, and
+// reloads them from the engine. Any changes which haven't been committed with
+// Commit are lost. Refresh is only needed if the source image has been
+// modified outside of this Mutator, since the Mutator otherwise keeps its
+// cache up-to-date.
+func (m *Mutator) Refresh(ctx context.Context) error {
+	m.invalidate()
+	return errors.Wrap(m.cache(ctx), "refresh cache")
+}
@@ -23,17 +23,23 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	casdir "github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
 	"github.com/opencontainers/go-digest"
 	imeta "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -196,6 +202,183 @@ func TestMutateCache(t *testing.T) {
 	}
 }
 
+// readCountingEngine is a cas.Engine which counts the number of times each
+// blob is read.
+type readCountingEngine struct {
+	cas.Engine
+	reads map[digest.Digest]int
+}
+
+func (e *readCountingEngine) GetBlob(ctx context.Context, blobDigest digest.Digest) (io.ReadCloser, error) {
+	e.reads[blobDigest]++
+	return e.Engine.GetBlob(ctx, blobDigest)
+}
+
+func TestMutateCacheReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateCacheReads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	baseEngine, fromDescriptor := setup(t, dir)
+	defer baseEngine.Close()
+	engine := &readCountingEngine{Engine: baseEngine, reads: map[digest.Digest]int{}}
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Many reads and modifications only need to read the blobs once, and
+	// always return consistent data.
+	for i := 0; i < 3; i++ {
+		config, err := mutator.Config(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error getting config: %+v", err)
+		}
+		if config.User != "default:user" {
+			t.Errorf("config.User is inconsistent: got %q", config.User)
+		}
+		if _, err := mutator.Meta(context.Background()); err != nil {
+			t.Fatalf("unexpected error getting meta: %+v", err)
+		}
+		layers, err := mutator.Layers(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error getting layers: %+v", err)
+		}
+		if len(layers) != 1 || layers[0].Digest != expectedLayerDigest {
+			t.Errorf("layers are inconsistent: got %v", layers)
+		}
+	}
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{User: "changed:user"}, Meta{}, nil, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %+v", err)
+	}
+	if config.User != "changed:user" {
+		t.Errorf("config.User was not changed: got %q", config.User)
+	}
+	if n := engine.reads[fromDescriptor.Digest]; n != 1 {
+		t.Errorf("manifest was read %d times, expected 1", n)
+	}
+	if n := engine.reads[expectedConfigDigest]; n != 1 {
+		t.Errorf("config was read %d times, expected 1", n)
+	}
+
+	// Committing invalidates the cache, and the data is then read from the
+	// committed blobs.
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if mutator.manifest != nil || mutator.config != nil {
+		t.Errorf("cache was not invalidated by Commit")
+	}
+	config, err = mutator.Config(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %+v", err)
+	}
+	if config.User != "changed:user" {
+		t.Errorf("config.User of committed image is inconsistent: got %q", config.User)
+	}
+	if n := engine.reads[newPath.Descriptor().Digest]; n != 1 {
+		t.Errorf("committed manifest was read %d times, expected 1", n)
+	}
+}
+
+func TestMutateRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRefresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{User: "changed:user"}, Meta{}, nil, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	// Uncommitted changes are discarded by Refresh.
+	if err := mutator.Refresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error refreshing: %+v", err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %+v", err)
+	}
+	if config.User != "default:user" {
+		t.Errorf("config.User was not refreshed: got %q", config.User)
+	}
+	history, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting history: %+v", err)
+	}
+	if len(history) != 1 {
+		t.Errorf("history was not refreshed: got %d entries", len(history))
+	}
+}
+
+func TestMutateCommitTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateCommitTwice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{User: "changed:user"}, Meta{}, nil, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	if _, err := mutator.Commit(context.Background()); err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// Later changes are made on top of the committed image.
+	if err := mutator.Add(context.Background(), bytes.NewReader(nil), nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting config: %+v", err)
+	}
+	if config.User != "changed:user" {
+		t.Errorf("first commit was lost: config.User is %q", config.User)
+	}
+	layers, err := mutator.Layers(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting layers: %+v", err)
+	}
+	if len(layers) != 2 {
+		t.Errorf("second commit was lost: got %d layers", len(layers))
+	}
+}
+
 func TestMutateAdd(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestMutateAdd")
 	if err != nil {
@@ -276,6 +459,259 @@ func TestMutateAdd(t *testing.T) {
 	}
 }
 
+// streamCheckingEngine is a cas.Engine which records how much of each blob had
+// been written when the source of the blob (a streamCheckingReader) was
+// exhausted.
+type streamCheckingEngine struct {
+	cas.Engine
+	mu      sync.Mutex
+	written int64
+	puts    int
+}
+
+func (e *streamCheckingEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	e.mu.Lock()
+	e.puts++
+	e.written = 0
+	e.mu.Unlock()
+	return e.Engine.PutBlob(ctx, io.TeeReader(reader, e))
+}
+
+func (e *streamCheckingEngine) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.written += int64(len(p))
+	return len(p), nil
+}
+
+// streamCheckingReader produces size bytes of incompressible data, and records
+// how much of the blob had been written to the engine when it was exhausted.
+type streamCheckingReader struct {
+	engine    *streamCheckingEngine
+	rand      *rand.Rand
+	remaining int64
+	// writtenAtEOF is the number of bytes written to the CAS when the
+	// reader was exhausted.
+	writtenAtEOF int64
+}
+
+func (r *streamCheckingReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		r.engine.mu.Lock()
+		r.writtenAtEOF = r.engine.written
+		r.engine.mu.Unlock()
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, _ := r.rand.Read(p)
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+func TestMutateAddStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddStreaming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	checkingEngine := &streamCheckingEngine{Engine: engine}
+	mutator, err := New(checkingEngine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const size = 8 << 20
+	reader := &streamCheckingReader{
+		engine:    checkingEngine,
+		rand:      rand.New(rand.NewSource(1)),
+		remaining: size,
+	}
+	if err := mutator.Add(context.Background(), reader, &ispec.History{
+		Comment: "large layer",
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	if checkingEngine.puts != 1 {
+		t.Errorf("expected the layer to be written with a single PutBlob, got %d", checkingEngine.puts)
+	}
+	// If the layer was buffered before being written, nothing would have been
+	// written to the engine by the time the reader was exhausted. Allow for
+	// the internal buffering of the compressor.
+	if reader.writtenAtEOF < size/2 {
+		t.Errorf("layer was not streamed into the CAS: only %d of %d bytes were written before the layer was read in full", reader.writtenAtEOF, size)
+	}
+
+	// The temporary blob must have been renamed into place.
+	layers := mutator.manifest.Layers
+	layerDescriptor := layers[len(layers)-1]
+	if layerDescriptor.Size != checkingEngine.written {
+		t.Errorf("layer descriptor has size %d, but %d bytes were written", layerDescriptor.Size, checkingEngine.written)
+	}
+	blobSize, err := casext.NewEngine(engine).BlobSize(context.Background(), layerDescriptor.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting layer blob size: %+v", err)
+	}
+	if blobSize != layerDescriptor.Size {
+		t.Errorf("layer blob has size %d, expected %d", blobSize, layerDescriptor.Size)
+	}
+}
+
+func TestMutateAddNoHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddNoHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a new layer without a history entry.
+	buffer := bytes.NewBufferString("contents")
+	if err := mutator.Add(context.Background(), buffer, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the data to check it.
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Check layer was added.
+	if len(mutator.manifest.Layers) != 2 {
+		t.Errorf("manifest.Layers was not updated")
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Errorf("config.RootFS.DiffIDs was not updated")
+	}
+
+	// Check history was not modified.
+	if len(mutator.config.History) != 1 {
+		t.Errorf("config.History was updated: %v", mutator.config.History)
+	}
+}
+
+func TestMutateAddExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddExisting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	// Put a layer blob (which isn't a valid layer, but whatever) into the
+	// CAS ourselves.
+	contents := "existing layer contents"
+	layerDigest, layerSize, err := engineExt.PutBlob(context.Background(), bytes.NewBufferString(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID := digest.FromString("uncompressed contents")
+	layerDescriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid layers must be rejected without modifying the image.
+	for _, test := range []struct {
+		name       string
+		descriptor ispec.Descriptor
+		diffID     digest.Digest
+	}{
+		{"MissingBlob", ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip, Digest: digest.FromString("missing"), Size: 7}, diffID},
+		{"WrongSize", ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip, Digest: layerDigest, Size: layerSize + 1}, diffID},
+		{"WrongMediaType", ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: layerDigest, Size: layerSize}, diffID},
+		{"InvalidDiffID", layerDescriptor, digest.Digest("sha256:invalid")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := mutator.AddExisting(context.Background(), test.descriptor, test.diffID, &ispec.History{}); err == nil {
+				t.Errorf("expected error adding invalid existing layer")
+			}
+			if len(mutator.manifest.Layers) != 1 || len(mutator.config.RootFS.DiffIDs) != 1 || len(mutator.config.History) != 1 {
+				t.Errorf("image was modified by failed AddExisting")
+			}
+		})
+	}
+
+	// Add the existing layer.
+	if err := mutator.AddExisting(context.Background(), layerDescriptor, diffID, &ispec.History{
+		Comment: "existing layer",
+	}); err != nil {
+		t.Fatalf("unexpected error adding existing layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Check the layer was added as-is.
+	if len(mutator.manifest.Layers) != 2 {
+		t.Fatalf("manifest.Layers was not updated")
+	}
+	if mutator.manifest.Layers[0].Digest != expectedLayerDigest {
+		t.Errorf("manifest.Layers[0].Digest is not the same!")
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[1], layerDescriptor) {
+		t.Errorf("manifest.Layers[1] is not the existing layer: %v", mutator.manifest.Layers[1])
+	}
+
+	// Check config was also modified.
+	if len(mutator.config.RootFS.DiffIDs) != 2 || mutator.config.RootFS.DiffIDs[1] != diffID {
+		t.Errorf("config.RootFS.DiffIDs was not updated: %v", mutator.config.RootFS.DiffIDs)
+	}
+
+	// Check history.
+	if len(mutator.config.History) != 2 {
+		t.Fatalf("config.History was not updated")
+	}
+	if mutator.config.History[1].EmptyLayer != false {
+		t.Errorf("config.History[1].EmptyLayer was not set")
+	}
+	if mutator.config.History[1].Comment != "existing layer" {
+		t.Errorf("config.History[1].Comment was not set")
+	}
+}
+
 func TestMutateAddNonDistributable(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestMutateAddNonDistributable")
 	if err != nil {
@@ -429,8 +865,8 @@ func TestMutateSet(t *testing.T) {
 	}
 }
 
-func TestMutateSetNoHistory(t *testing.T) {
-	dir, err := ioutil.TempDir("", "umoci-TestMutateSetNoHistory")
+func TestMutateAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAnnotations")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -444,10 +880,27 @@ func TestMutateSetNoHistory(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Change the config
-	if err := mutator.Set(context.Background(), ispec.ImageConfig{
-		User: "changed:user",
-	}, Meta{}, nil, nil); err != nil {
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAnnotations := map[string]string{"a": "1", "b": "2"}
+	if err := mutator.Set(context.Background(), config, meta, setAnnotations, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	// Annotations from both calls are merged, replacing only the same keys.
+	mutator.AddAnnotations(map[string]string{"b": "3", ispec.AnnotationRevision: "abc"})
+	mutator.AddAnnotations(map[string]string{ispec.AnnotationCreated: "2019-01-01T00:00:00Z"})
+
+	layerAnnotations := map[string]string{"layer": "value"}
+	mutator.SetLayerAnnotations(layerAnnotations)
+	layerAnnotations["layer"] = "changed"
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), &ispec.History{}); err != nil {
 		t.Fatalf("unexpected error adding layer: %+v", err)
 	}
 
@@ -456,7 +909,197 @@ func TestMutateSetNoHistory(t *testing.T) {
 		t.Fatalf("unexpected error committing changes: %+v", err)
 	}
 
-	if newDescriptor.Descriptor().Digest == fromDescriptor.Digest {
+	if !reflect.DeepEqual(setAnnotations, map[string]string{"a": "1", "b": "2"}) {
+		t.Errorf("Commit modified the annotations passed to Set: %v", setAnnotations)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	expectedAnnotations := map[string]string{
+		"a":                      "1",
+		"b":                      "3",
+		ispec.AnnotationRevision: "abc",
+		ispec.AnnotationCreated:  "2019-01-01T00:00:00Z",
+	}
+	if !reflect.DeepEqual(mutator.manifest.Annotations, expectedAnnotations) {
+		t.Errorf("unexpected manifest annotations: expected %v, got %v", expectedAnnotations, mutator.manifest.Annotations)
+	}
+
+	// Only the new layer has the layer annotations.
+	if len(mutator.manifest.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(mutator.manifest.Layers))
+	}
+	if got := mutator.manifest.Layers[0].Annotations; got != nil {
+		t.Errorf("existing layer annotations were modified: %v", got)
+	}
+	if got := mutator.manifest.Layers[1].Annotations; !reflect.DeepEqual(got, map[string]string{"layer": "value"}) {
+		t.Errorf("unexpected new layer annotations: %v", got)
+	}
+}
+
+func TestMutateLayerURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateLayerURLs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls := []string{"https://example.com/layer.tar.gz"}
+	mutator.SetLayerURLs(urls)
+	urls[0] = "https://example.com/changed.tar.gz"
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("contents"), &ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	mutator.SetLayerURLs(nil)
+	if err := mutator.Add(context.Background(), bytes.NewBufferString("more contents"), &ispec.History{}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Only the layer added while the urls were set has them, and the layer
+	// blob is still added to the image.
+	if len(mutator.manifest.Layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(mutator.manifest.Layers))
+	}
+	if got := mutator.manifest.Layers[0].URLs; got != nil {
+		t.Errorf("existing layer urls were modified: %v", got)
+	}
+	if got := mutator.manifest.Layers[1].URLs; !reflect.DeepEqual(got, []string{"https://example.com/layer.tar.gz"}) {
+		t.Errorf("unexpected new layer urls: %v", got)
+	}
+	if got := mutator.manifest.Layers[2].URLs; got != nil {
+		t.Errorf("unexpected urls after SetLayerURLs(nil): %v", got)
+	}
+	blob, err := casext.NewEngine(engine).FromDescriptor(context.Background(), mutator.manifest.Layers[1])
+	if err != nil {
+		t.Fatalf("foreign layer blob not added to image: %+v", err)
+	}
+	blob.Close()
+}
+
+func TestMutateSetAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldHistory, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	annotations := map[string]string{"a": "1", "b": "2"}
+	if err := mutator.SetAnnotations(context.Background(), annotations); err != nil {
+		t.Fatalf("unexpected error setting annotations: %+v", err)
+	}
+	annotations["a"] = "changed"
+	mutator.AddAnnotations(map[string]string{"b": "3"})
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := mutator.Annotations(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"a": "1", "b": "3"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected manifest annotations: expected %v, got %v", expected, got)
+	}
+	newHistory, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newHistory) != len(oldHistory) {
+		t.Errorf("SetAnnotations modified the history: expected %d entries, got %d", len(oldHistory), len(newHistory))
+	}
+
+	// Setting an empty set removes all annotations.
+	if err := mutator.SetAnnotations(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error clearing annotations: %+v", err)
+	}
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := mutator.Annotations(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Errorf("expected no manifest annotations, got %v", got)
+	}
+}
+
+func TestMutateSetNoHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetNoHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the config
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{
+		User: "changed:user",
+	}, Meta{}, nil, nil); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	if newDescriptor.Descriptor().Digest == fromDescriptor.Digest {
 		t.Fatalf("new and old descriptors are the same!")
 	}
 
@@ -494,6 +1137,157 @@ func TestMutateSetNoHistory(t *testing.T) {
 	}
 }
 
+func TestMutateSetHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetHistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting history: %+v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("unexpected history length: expected 1, got %d", len(history))
+	}
+
+	// Changing the number of layer entries must be rejected.
+	if err := mutator.SetHistory(context.Background(), append(history, ispec.History{Comment: "extra"})); err == nil {
+		t.Errorf("expected error when adding non-empty history entry")
+	}
+	if err := mutator.SetHistory(context.Background(), nil); err == nil {
+		t.Errorf("expected error when removing non-empty history entry")
+	}
+
+	// But modifying entries (or adding empty ones) is fine.
+	history[0].CreatedBy = "[REDACTED]"
+	history = append(history, ispec.History{Comment: "empty", EmptyLayer: true})
+	if err := mutator.SetHistory(context.Background(), history); err != nil {
+		t.Fatalf("unexpected error setting history: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the data to check it.
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// Check history.
+	if len(mutator.config.History) != 2 {
+		t.Fatalf("config.History was not updated")
+	}
+	if mutator.config.History[0].CreatedBy != "[REDACTED]" {
+		t.Errorf("config.History[0].CreatedBy was not updated: got %q", mutator.config.History[0].CreatedBy)
+	}
+	if mutator.config.History[0].EmptyLayer != false {
+		t.Errorf("config.History[0].EmptyLayer was changed")
+	}
+	if mutator.config.History[1].EmptyLayer != true {
+		t.Errorf("config.History[1].EmptyLayer was not set")
+	}
+
+	// Layers must be untouched.
+	if len(mutator.manifest.Layers) != 1 {
+		t.Errorf("manifest.Layers was updated")
+	}
+}
+
+func TestMutateArtifactType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateArtifactType")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artifactType, err := mutator.ArtifactType(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting artifact type: %+v", err)
+	}
+	if artifactType != "" {
+		t.Errorf("unexpected artifact type in base image: %q", artifactType)
+	}
+
+	for _, bad := range []string{"invalid", "/subtype", "type/", "type/sub/type", "type/subtype; charset=utf-8"} {
+		if err := mutator.SetArtifactType(context.Background(), bad); err == nil {
+			t.Errorf("expected error when setting invalid artifact type %q", bad)
+		}
+	}
+
+	const expectedArtifactType = "application/vnd.example.thing"
+	if err := mutator.SetArtifactType(context.Background(), expectedArtifactType); err != nil {
+		t.Fatalf("unexpected error setting artifact type: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	artifactType, err = ManifestArtifactType(context.Background(), casext.NewEngine(engine), newDescriptor.Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error getting artifact type: %+v", err)
+	}
+	if artifactType != expectedArtifactType {
+		t.Errorf("manifest artifactType was not updated: expected %q, got %q", expectedArtifactType, artifactType)
+	}
+
+	// Make sure the artifact type is preserved by later mutations, and can
+	// be cleared.
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifactType, err = mutator.ArtifactType(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting artifact type: %+v", err)
+	}
+	if artifactType != expectedArtifactType {
+		t.Errorf("artifact type was not cached: expected %q, got %q", expectedArtifactType, artifactType)
+	}
+	if err := mutator.SetArtifactType(context.Background(), ""); err != nil {
+		t.Fatalf("unexpected error clearing artifact type: %+v", err)
+	}
+
+	newDescriptor, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	artifactType, err = ManifestArtifactType(context.Background(), casext.NewEngine(engine), newDescriptor.Descriptor())
+	if err != nil {
+		t.Fatalf("unexpected error getting artifact type: %+v", err)
+	}
+	if artifactType != "" {
+		t.Errorf("manifest artifactType was not cleared: got %q", artifactType)
+	}
+}
+
 func walkDescriptorRoot(ctx context.Context, engine casext.Engine, root ispec.Descriptor) (casext.DescriptorPath, error) {
 	var foundPath *casext.DescriptorPath
 
@@ -629,3 +1423,944 @@ func TestMutatePath(t *testing.T) {
 		}
 	}
 }
+
+func TestMutatePlatformIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutatePlatformIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, manifestDescriptor := setup(t, dir)
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	// Create an index with the same manifest for two platforms.
+	amd64Descriptor := manifestDescriptor
+	amd64Descriptor.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64Descriptor := manifestDescriptor
+	arm64Descriptor.Platform = &ispec.Platform{OS: "linux", Architecture: "arm64"}
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{amd64Descriptor, arm64Descriptor},
+	})
+	if err != nil {
+		t.Fatalf("failed to put blob json index: %+v", err)
+	}
+	indexPath := casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}}}
+
+	if _, err := NewPlatform(engine, indexPath, ispec.Platform{OS: "linux", Architecture: "s390x"}); err == nil {
+		t.Errorf("expected error creating mutator for missing platform")
+	}
+
+	mutator, err := NewPlatform(engine, indexPath, *arm64Descriptor.Platform)
+	if err != nil {
+		t.Fatalf("unexpected error creating mutator: %+v", err)
+	}
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{
+		User: "changed:user",
+	}, Meta{}, nil, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	if newPath.Root().Digest == indexDigest {
+		t.Fatalf("index was not modified")
+	}
+
+	indexBlob, err := engineExt.FromDescriptor(context.Background(), newPath.Root())
+	if err != nil {
+		t.Fatalf("unexpected error getting new index: %+v", err)
+	}
+	defer indexBlob.Close()
+	index, ok := indexBlob.Data.(ispec.Index)
+	if !ok {
+		t.Fatalf("new root is not an index: %s", indexBlob.Descriptor.MediaType)
+	}
+
+	if len(index.Manifests) != 2 {
+		t.Fatalf("unexpected number of index entries: expected 2, got %d", len(index.Manifests))
+	}
+	if !reflect.DeepEqual(index.Manifests[0], amd64Descriptor) {
+		t.Errorf("other platform entry was modified: expected %v, got %v", amd64Descriptor, index.Manifests[0])
+	}
+	if index.Manifests[1].Digest == manifestDescriptor.Digest {
+		t.Errorf("selected platform entry was not modified")
+	}
+	if !reflect.DeepEqual(index.Manifests[1].Platform, arm64Descriptor.Platform) {
+		t.Errorf("selected platform entry lost its platform: got %v", index.Manifests[1].Platform)
+	}
+}
+
+func TestMutateSetPlatform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSetPlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, manifestDescriptor := setup(t, dir)
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	amd64Descriptor := manifestDescriptor
+	amd64Descriptor.Platform = &ispec.Platform{OS: "linux", Architecture: "amd64"}
+	armDescriptor := manifestDescriptor
+	armDescriptor.Platform = &ispec.Platform{OS: "linux", Architecture: "arm", OSVersion: "5.4"}
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: []ispec.Descriptor{amd64Descriptor, armDescriptor},
+	})
+	if err != nil {
+		t.Fatalf("failed to put blob json index: %+v", err)
+	}
+	indexPath := casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}}}
+
+	mutator, err := NewPlatform(engine, indexPath, *armDescriptor.Platform)
+	if err != nil {
+		t.Fatalf("unexpected error creating mutator: %+v", err)
+	}
+	expectedPlatform := ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	if err := mutator.SetPlatform(context.Background(), expectedPlatform); err != nil {
+		t.Fatalf("unexpected error setting platform: %+v", err)
+	}
+	newPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	// The index entry is updated (keeping the other fields of its platform).
+	indexBlob, err := engineExt.FromDescriptor(context.Background(), newPath.Root())
+	if err != nil {
+		t.Fatalf("unexpected error getting new index: %+v", err)
+	}
+	defer indexBlob.Close()
+	index := indexBlob.Data.(ispec.Index)
+	if !reflect.DeepEqual(index.Manifests[0], amd64Descriptor) {
+		t.Errorf("other platform entry was modified: expected %v, got %v", amd64Descriptor, index.Manifests[0])
+	}
+	expectedEntryPlatform := expectedPlatform
+	expectedEntryPlatform.OSVersion = "5.4"
+	if !reflect.DeepEqual(index.Manifests[1].Platform, &expectedEntryPlatform) {
+		t.Errorf("platform of index entry was not updated: expected %v, got %v", expectedEntryPlatform, index.Manifests[1].Platform)
+	}
+
+	// The variant is stored in the configuration.
+	mutator, err = New(engine, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform, err := mutator.Platform(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting platform: %+v", err)
+	}
+	if !reflect.DeepEqual(platform, expectedPlatform) {
+		t.Errorf("unexpected platform: expected %v, got %v", expectedPlatform, platform)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting meta: %+v", err)
+	}
+	if meta.Variant != "v7" {
+		t.Errorf("unexpected variant in meta: got %q", meta.Variant)
+	}
+
+	// And is preserved by Set.
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), config, meta, nil, nil); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	newPath, err = mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	platform, err = mutator.Platform(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error getting platform: %+v", err)
+	}
+	if platform.Variant != "v7" {
+		t.Errorf("variant was not preserved: got %q", platform.Variant)
+	}
+}
+
+func TestValidatePlatform(t *testing.T) {
+	for _, test := range []struct {
+		platform ispec.Platform
+		valid    bool
+	}{
+		{ispec.Platform{OS: "linux", Architecture: "amd64"}, true},
+		{ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{ispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{ispec.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, true},
+		{ispec.Platform{OS: "linux", Architecture: "amd64", Variant: "v7"}, false},
+		{ispec.Platform{OS: "linux", Architecture: "arm", Variant: "armv7"}, false},
+		{ispec.Platform{OS: "linux", Architecture: "s390x", Variant: "v1"}, false},
+		{ispec.Platform{OS: "windows", Architecture: "arm64"}, true},
+		{ispec.Platform{OS: "linux", Architecture: "x86_64"}, false},
+		{ispec.Platform{OS: "Linux", Architecture: "amd64"}, false},
+		{ispec.Platform{OS: "", Architecture: "amd64"}, false},
+	} {
+		err := ValidatePlatform(test.platform)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidatePlatform(%v): expected valid=%v, got error %v", test.platform, test.valid, err)
+		}
+	}
+}
+
+func TestMutateAddCompression(t *testing.T) {
+	for _, test := range []struct {
+		compression Compression
+		mediaType   string
+	}{
+		{GzipCompression, ispec.MediaTypeImageLayerGzip},
+		{ZstdCompression, layer.MediaTypeImageLayerZstd},
+		{NoCompression, ispec.MediaTypeImageLayer},
+	} {
+		t.Run(string(test.compression), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestMutateAddCompression")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engine, fromDescriptor := setup(t, dir)
+			defer engine.Close()
+
+			mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutator.SetCompression(test.compression)
+
+			// This isn't a valid image, but whatever.
+			contents := "contents"
+			if err := mutator.Add(context.Background(), bytes.NewBufferString(contents), &ispec.History{}); err != nil {
+				t.Fatalf("unexpected error adding layer: %+v", err)
+			}
+
+			newDescriptor, err := mutator.Commit(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error committing changes: %+v", err)
+			}
+
+			mutator, err = New(engine, newDescriptor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mutator.cache(context.Background()); err != nil {
+				t.Fatalf("unexpected error getting cache: %+v", err)
+			}
+
+			newLayer := mutator.manifest.Layers[1]
+			if newLayer.MediaType != test.mediaType {
+				t.Errorf("unexpected media type: expected %s, got %s", test.mediaType, newLayer.MediaType)
+			}
+
+			// The layer must decompress to the DiffID in the config.
+			diffID, err := layer.DiffID(context.Background(), engine, newLayer)
+			if err != nil {
+				t.Fatalf("unexpected error computing diffid: %+v", err)
+			}
+			if diffID != mutator.config.RootFS.DiffIDs[1] {
+				t.Errorf("diffid mismatch: expected %s, got %s", mutator.config.RootFS.DiffIDs[1], diffID)
+			}
+			if expected := digest.FromString(contents); diffID != expected {
+				t.Errorf("unexpected diffid: expected %s, got %s", expected, diffID)
+			}
+		})
+	}
+}
+
+func TestMutateAddGzipReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddGzipReproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator.SetCompression(GzipCompression)
+
+	// Adding the same contents twice must result in identical blobs.
+	contents := strings.Repeat("some contents ", 1<<10)
+	for i := 0; i < 2; i++ {
+		if err := mutator.Add(context.Background(), bytes.NewBufferString(contents), &ispec.History{}); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	layerA, layerB := mutator.manifest.Layers[1], mutator.manifest.Layers[2]
+	if layerA.Digest != layerB.Digest {
+		t.Errorf("identical layers have different digests: %s != %s", layerA.Digest, layerB.Digest)
+	}
+
+	// The gzip header must not contain a filename or modification time.
+	blob, err := engine.GetBlob(context.Background(), layerA.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(blob, header); err != nil {
+		t.Fatal(err)
+	}
+	if flags := header[3]; flags != 0 {
+		t.Errorf("unexpected gzip header flags: %#x", flags)
+	}
+	if mtime := header[4:8]; !bytes.Equal(mtime, []byte{0, 0, 0, 0}) {
+		t.Errorf("unexpected gzip header mtime: %v", mtime)
+	}
+}
+
+func TestMutateDescribeLayer(t *testing.T) {
+	for _, test := range []struct {
+		compression      Compression
+		nonDistributable bool
+	}{
+		{GzipCompression, false},
+		{GzipCompression, true},
+		{ZstdCompression, false},
+		{NoCompression, false},
+	} {
+		t.Run(fmt.Sprintf("%s-%v", test.compression, test.nonDistributable), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "umoci-TestMutateDescribeLayer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engine, fromDescriptor := setup(t, dir)
+			defer engine.Close()
+
+			mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutator.SetCompression(test.compression)
+
+			// This isn't a valid image, but whatever.
+			contents := "contents"
+			descriptor, diffID, err := mutator.DescribeLayer(context.Background(), bytes.NewBufferString(contents), test.nonDistributable)
+			if err != nil {
+				t.Fatalf("unexpected error describing layer: %+v", err)
+			}
+			if expected := digest.FromString(contents); diffID != expected {
+				t.Errorf("unexpected diffid: expected %s, got %s", expected, diffID)
+			}
+
+			// Neither the CAS nor the image may have been modified.
+			if _, err := engine.GetBlob(context.Background(), descriptor.Digest); !os.IsNotExist(errors.Cause(err)) {
+				t.Errorf("expected described layer to not be in the CAS: got %v", err)
+			}
+			if err := mutator.cache(context.Background()); err != nil {
+				t.Fatalf("unexpected error getting cache: %+v", err)
+			}
+			if len(mutator.manifest.Layers) != 1 || len(mutator.config.RootFS.DiffIDs) != 1 {
+				t.Errorf("DescribeLayer modified the image: %d layers, %d diffids", len(mutator.manifest.Layers), len(mutator.config.RootFS.DiffIDs))
+			}
+
+			// The descriptor must match what would actually be added.
+			if test.nonDistributable {
+				err = mutator.AddNonDistributable(context.Background(), bytes.NewBufferString(contents), &ispec.History{})
+			} else {
+				err = mutator.Add(context.Background(), bytes.NewBufferString(contents), &ispec.History{})
+			}
+			if err != nil {
+				t.Fatalf("unexpected error adding layer: %+v", err)
+			}
+			if got := mutator.manifest.Layers[1]; !reflect.DeepEqual(got, descriptor) {
+				t.Errorf("described layer does not match added layer: expected %v, got %v", got, descriptor)
+			}
+			if got := mutator.config.RootFS.DiffIDs[1]; got != diffID {
+				t.Errorf("described diffid does not match added layer: expected %s, got %s", got, diffID)
+			}
+		})
+	}
+}
+
+func TestParseCompressionLevel(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		level int
+		fail  bool
+	}{
+		{"default", DefaultCompressionLevel, false},
+		{"1", 1, false},
+		{"9", 9, false},
+		{"0", 0, true},
+		{"10", 0, true},
+		{"-1", 0, true},
+		{"fast", 0, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			level, err := ParseCompressionLevel(test.name)
+			if test.fail {
+				if err == nil {
+					t.Errorf("expected error parsing compression level, got %d", level)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error parsing compression level: %+v", err)
+			}
+			if level != test.level {
+				t.Errorf("unexpected compression level: expected %d, got %d", test.level, level)
+			}
+		})
+	}
+}
+
+func TestMutateAddCompressionLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddCompressionLevel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []int{0, 10} {
+		if err := mutator.SetCompressionLevel(level); err == nil {
+			t.Errorf("expected error setting compression level %d", level)
+		}
+	}
+
+	// Add the same (compressible) contents with the fastest and the best
+	// compression levels.
+	contents := strings.Repeat("some compressible contents ", 1<<14)
+	for _, level := range []int{1, 9} {
+		if err := mutator.SetCompressionLevel(level); err != nil {
+			t.Fatalf("unexpected error setting compression level %d: %+v", level, err)
+		}
+		if err := mutator.Add(context.Background(), bytes.NewBufferString(contents), &ispec.History{}); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	fastLayer, bestLayer := mutator.manifest.Layers[1], mutator.manifest.Layers[2]
+	for idx, newLayer := range []ispec.Descriptor{fastLayer, bestLayer} {
+		diffID, err := layer.DiffID(context.Background(), engine, newLayer)
+		if err != nil {
+			t.Fatalf("unexpected error computing diffid: %+v", err)
+		}
+		if expected := digest.FromString(contents); diffID != expected {
+			t.Errorf("layer %d: unexpected diffid: expected %s, got %s", idx, expected, diffID)
+		}
+	}
+	if bestLayer.Size > fastLayer.Size {
+		t.Errorf("level 9 layer (%d bytes) larger than level 1 layer (%d bytes)", bestLayer.Size, fastLayer.Size)
+	}
+}
+
+func TestMutateAddCompressionJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateAddCompressionJobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, jobs := range []int{-1, 0} {
+		if err := mutator.SetCompressionJobs(jobs); err == nil {
+			t.Errorf("expected error setting compression jobs %d", jobs)
+		}
+	}
+
+	// Add the same contents (spanning several blocks) with a different number
+	// of jobs. With gzip the compressed layers must be identical.
+	contents := strings.Repeat("some compressible contents ", 1<<16)
+	for _, jobs := range []int{1, 4} {
+		if err := mutator.SetCompressionJobs(jobs); err != nil {
+			t.Fatalf("unexpected error setting compression jobs %d: %+v", jobs, err)
+		}
+		if err := mutator.Add(context.Background(), bytes.NewBufferString(contents), &ispec.History{}); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	serialLayer, parallelLayer := mutator.manifest.Layers[1], mutator.manifest.Layers[2]
+	if serialLayer.Digest != parallelLayer.Digest {
+		t.Errorf("compressed layer depends on jobs: %s != %s", serialLayer.Digest, parallelLayer.Digest)
+	}
+	diffID, err := layer.DiffID(context.Background(), engine, parallelLayer)
+	if err != nil {
+		t.Fatalf("unexpected error computing diffid: %+v", err)
+	}
+	if expected := digest.FromString(contents); diffID != expected {
+		t.Errorf("unexpected diffid: expected %s, got %s", expected, diffID)
+	}
+}
+
+// tarLayer returns an uncompressed tar layer containing the given regular
+// files (a nil value creates a whiteout for the path instead).
+func tarLayer(t *testing.T, files map[string][]byte) *bytes.Buffer {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, name := range names {
+		data := files[name]
+		if data == nil {
+			name = filepath.Join(filepath.Dir(name), ".wh."+filepath.Base(name))
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buffer
+}
+
+func TestMutateSquash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateSquash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The base layer from setup() is not actually compressed.
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	mutator.manifest.Layers[0].MediaType = ispec.MediaTypeImageLayer
+
+	if err := mutator.AddNonDistributable(context.Background(), tarLayer(t, map[string][]byte{
+		"test":  nil,
+		"first": []byte("first layer"),
+	}), &ispec.History{Comment: "first layer"}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if err := mutator.Set(context.Background(), ispec.ImageConfig{}, Meta{}, nil, &ispec.History{Comment: "empty layer"}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+
+	// Squash the layers with a new one.
+	if err := mutator.Squash(context.Background(), tarLayer(t, map[string][]byte{
+		"second": []byte("second layer"),
+	}), &ispec.History{Comment: "squashed"}); err != nil {
+		t.Fatalf("unexpected error squashing layers: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// There must be exactly one (non-distributable) layer.
+	if len(mutator.manifest.Layers) != 1 {
+		t.Fatalf("expected 1 layer, got %d", len(mutator.manifest.Layers))
+	}
+	squashedLayer := mutator.manifest.Layers[0]
+	if squashedLayer.MediaType != ispec.MediaTypeImageLayerNonDistributableGzip {
+		t.Errorf("unexpected media type: %s", squashedLayer.MediaType)
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 1 {
+		t.Fatalf("expected 1 diffid, got %d", len(mutator.config.RootFS.DiffIDs))
+	}
+	diffID, err := layer.DiffID(context.Background(), engine, squashedLayer)
+	if err != nil {
+		t.Fatalf("unexpected error computing diffid: %+v", err)
+	}
+	if diffID != mutator.config.RootFS.DiffIDs[0] {
+		t.Errorf("diffid mismatch: expected %s, got %s", mutator.config.RootFS.DiffIDs[0], diffID)
+	}
+
+	// The history is collapsed into a single entry.
+	if len(mutator.config.History) != 1 {
+		t.Fatalf("expected 1 history entry, got %d", len(mutator.config.History))
+	}
+	if mutator.config.History[0].Comment != "squashed" || mutator.config.History[0].EmptyLayer {
+		t.Errorf("unexpected history entry: %#v", mutator.config.History[0])
+	}
+
+	// Check the contents of the squashed layer.
+	rdr, err := layer.OpenLayer(context.Background(), engine, squashedLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	var names []string
+	tr := tar.NewReader(rdr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if expected := []string{"first", "second"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected squashed layer contents: expected %v, got %v", expected, names)
+	}
+}
+
+func TestMutateMapLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateMapLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The base layer from setup() is not actually compressed.
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	mutator.manifest.Layers[0].MediaType = ispec.MediaTypeImageLayer
+
+	if err := mutator.AddNonDistributable(context.Background(), tarLayer(t, map[string][]byte{
+		"first": []byte("first layer"),
+	}), &ispec.History{Comment: "first layer"}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	oldHistory := append([]ispec.History(nil), mutator.config.History...)
+
+	// Change the owner of every entry.
+	if err := mutator.MapLayers(context.Background(), func(r io.Reader, w io.Writer) error {
+		tr := tar.NewReader(r)
+		tw := tar.NewWriter(w)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			hdr.Uid = 1337
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+		}
+		return tw.Close()
+	}); err != nil {
+		t.Fatalf("unexpected error mapping layers: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(mutator.manifest.Layers))
+	}
+	for idx, expected := range []string{ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip} {
+		if mediaType := mutator.manifest.Layers[idx].MediaType; mediaType != expected {
+			t.Errorf("layer %d: unexpected media type: expected %s, got %s", idx, expected, mediaType)
+		}
+	}
+	if !reflect.DeepEqual(mutator.config.History, oldHistory) {
+		t.Errorf("history was modified: expected %#v, got %#v", oldHistory, mutator.config.History)
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Fatalf("expected 2 diffids, got %d", len(mutator.config.RootFS.DiffIDs))
+	}
+
+	for idx, descriptor := range mutator.manifest.Layers {
+		diffID, err := layer.DiffID(context.Background(), engine, descriptor)
+		if err != nil {
+			t.Fatalf("unexpected error computing diffid: %+v", err)
+		}
+		if diffID != mutator.config.RootFS.DiffIDs[idx] {
+			t.Errorf("layer %d: diffid mismatch: expected %s, got %s", idx, mutator.config.RootFS.DiffIDs[idx], diffID)
+		}
+
+		rdr, err := layer.OpenLayer(context.Background(), engine, descriptor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(rdr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Uid != 1337 {
+				t.Errorf("layer %d: %s: unexpected uid: expected 1337, got %d", idx, hdr.Name, hdr.Uid)
+			}
+		}
+		rdr.Close()
+	}
+}
+
+func TestMutateTruncateLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateTruncateLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add an empty history entry and two more layers.
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), config, meta, nil, &ispec.History{Comment: "empty"}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	for _, comment := range []string{"second", "third"} {
+		if err := mutator.Add(context.Background(), bytes.NewBufferString(comment), &ispec.History{Comment: comment}); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+
+	if err := mutator.TruncateLayers(context.Background(), 4); err == nil {
+		t.Errorf("expected error truncating to more layers than the image has")
+	}
+	if err := mutator.TruncateLayers(context.Background(), -1); err == nil {
+		t.Errorf("expected error truncating to a negative number of layers")
+	}
+
+	if err := mutator.TruncateLayers(context.Background(), 2); err != nil {
+		t.Fatalf("unexpected error truncating layers: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 2 {
+		t.Errorf("unexpected number of layers: expected 2, got %d", len(mutator.manifest.Layers))
+	}
+	if mutator.manifest.Layers[0].Digest != expectedLayerDigest {
+		t.Errorf("first layer was modified: got %s", mutator.manifest.Layers[0].Digest)
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Errorf("unexpected number of diff_ids: expected 2, got %d", len(mutator.config.RootFS.DiffIDs))
+	}
+	var comments []string
+	for _, entry := range mutator.config.History {
+		comments = append(comments, entry.Comment)
+	}
+	if expected := []string{"", "empty", "second"}; !reflect.DeepEqual(comments, expected) {
+		t.Errorf("unexpected history: expected %v, got %v", expected, comments)
+	}
+}
+
+func TestMutateRemoveReplaceLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRemoveReplaceLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	mutator, err := New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add an empty history entry and two more layers.
+	config, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Set(context.Background(), config, meta, nil, &ispec.History{Comment: "empty"}); err != nil {
+		t.Fatalf("unexpected error setting config: %+v", err)
+	}
+	for _, comment := range []string{"second", "third"} {
+		if err := mutator.AddNonDistributable(context.Background(), bytes.NewBufferString(comment), &ispec.History{Comment: comment}); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+
+	for _, n := range []int{-1, 3} {
+		if err := mutator.RemoveLayer(context.Background(), n); err == nil {
+			t.Errorf("expected error removing layer %d", n)
+		}
+		if err := mutator.ReplaceLayer(context.Background(), n, bytes.NewBufferString("new"), nil); err == nil {
+			t.Errorf("expected error replacing layer %d", n)
+		}
+	}
+
+	// Remove the second layer, and replace the third (now second) layer.
+	if err := mutator.RemoveLayer(context.Background(), 1); err != nil {
+		t.Fatalf("unexpected error removing layer: %+v", err)
+	}
+	replacedDescriptor, replacedDiffID, err := mutator.DescribeLayer(context.Background(), bytes.NewBufferString("replaced"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.ReplaceLayer(context.Background(), 1, bytes.NewBufferString("replaced"), &ispec.History{Comment: "replaced"}); err != nil {
+		t.Fatalf("unexpected error replacing layer: %+v", err)
+	}
+
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	mutator, err = New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 2 {
+		t.Fatalf("unexpected number of layers: expected 2, got %d", len(mutator.manifest.Layers))
+	}
+	if mutator.manifest.Layers[0].Digest != expectedLayerDigest {
+		t.Errorf("first layer was modified: got %s", mutator.manifest.Layers[0].Digest)
+	}
+	if !reflect.DeepEqual(mutator.manifest.Layers[1], replacedDescriptor) {
+		t.Errorf("unexpected replaced layer: expected %v, got %v", replacedDescriptor, mutator.manifest.Layers[1])
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 || mutator.config.RootFS.DiffIDs[1] != replacedDiffID {
+		t.Errorf("unexpected diff_ids: %v", mutator.config.RootFS.DiffIDs)
+	}
+	var comments []string
+	for _, entry := range mutator.config.History {
+		comments = append(comments, entry.Comment)
+	}
+	if expected := []string{"", "empty", "replaced"}; !reflect.DeepEqual(comments, expected) {
+		t.Errorf("unexpected history: expected %v, got %v", expected, comments)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// variantImage is an ispec.Image with the "variant" field added in image-spec
+// v1.1, which is not supported by the version of image-spec we use. If
+// Variant is empty, it is serialised identically to an ispec.Image.
+type variantImage struct {
+	ispec.Image
+
+	// Variant is the variant of the CPU architecture which the binaries in
+	// this image are built to run on (such as "v7" for "arm").
+	Variant string `json:"variant,omitempty"`
+}
+
+// knownOS is the set of operating systems (GOOS values) known to Go.
+var knownOS = map[string]struct{}{
+	"aix": {}, "android": {}, "darwin": {}, "dragonfly": {}, "freebsd": {},
+	"hurd": {}, "illumos": {}, "ios": {}, "js": {}, "linux": {}, "nacl": {},
+	"netbsd": {}, "openbsd": {}, "plan9": {}, "solaris": {}, "wasip1": {},
+	"windows": {}, "zos": {},
+}
+
+// knownArch is the set of CPU architectures (GOARCH values) known to Go.
+var knownArch = map[string]struct{}{
+	"386": {}, "amd64": {}, "amd64p32": {}, "arm": {}, "armbe": {},
+	"arm64": {}, "arm64be": {}, "loong64": {}, "mips": {}, "mipsle": {},
+	"mips64": {}, "mips64le": {}, "mips64p32": {}, "mips64p32le": {},
+	"ppc": {}, "ppc64": {}, "ppc64le": {}, "riscv": {}, "riscv64": {},
+	"s390": {}, "s390x": {}, "sparc": {}, "sparc64": {}, "wasm": {},
+}
+
+// knownVariants is the set of CPU architecture variants known for each
+// architecture (the values of GOARM, GOARM64, GOAMD64 and GORISCV64 used in
+// image indexes). Architectures which are not listed have no variants.
+var knownVariants = map[string]map[string]struct{}{
+	"arm": {"v5": {}, "v6": {}, "v7": {}, "v8": {}},
+	"arm64": {
+		"v8": {}, "v8.0": {}, "v8.1": {}, "v8.2": {}, "v8.3": {}, "v8.4": {},
+		"v8.5": {}, "v8.6": {}, "v8.7": {}, "v8.8": {}, "v8.9": {},
+		"v9": {}, "v9.0": {}, "v9.1": {}, "v9.2": {}, "v9.3": {}, "v9.4": {},
+		"v9.5": {},
+	},
+	"amd64":   {"v1": {}, "v2": {}, "v3": {}, "v4": {}},
+	"riscv64": {"rva20u64": {}, "rva22u64": {}},
+}
+
+// ValidatePlatform returns an error if the operating system or CPU
+// architecture of the given platform are not known GOOS and GOARCH values, or
+// if the variant (if any) is not a known variant of the architecture.
+func ValidatePlatform(platform ispec.Platform) error {
+	if _, ok := knownOS[platform.OS]; !ok {
+		return errors.Errorf("unknown operating system %q", platform.OS)
+	}
+	if _, ok := knownArch[platform.Architecture]; !ok {
+		return errors.Errorf("unknown architecture %q", platform.Architecture)
+	}
+	if platform.Variant != "" {
+		if _, ok := knownVariants[platform.Architecture][platform.Variant]; !ok {
+			return errors.Errorf("unknown variant %q of architecture %q", platform.Variant, platform.Architecture)
+		}
+	}
+	return nil
+}
+
+// Platform returns the current platform (operating system, architecture and
+// variant) of the image configuration.
+func (m *Mutator) Platform(ctx context.Context) (ispec.Platform, error) {
+	if err := m.cache(ctx); err != nil {
+		return ispec.Platform{}, errors.Wrap(err, "getting cache failed")
+	}
+
+	return ispec.Platform{
+		OS:           m.config.OS,
+		Architecture: m.config.Architecture,
+		Variant:      m.variant,
+	}, nil
+}
+
+// SetPlatform sets the operating system, architecture and variant of the
+// image configuration. The other fields of platform are ignored. If the
+// image is referenced through an index (see NewPlatform), the platform of
+// its index entry is also updated by Commit.
+func (m *Mutator) SetPlatform(ctx context.Context, platform ispec.Platform) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	m.config.OS = platform.OS
+	m.config.Architecture = platform.Architecture
+	m.variant = platform.Variant
+	m.platformChanged = true
+	return nil
+}
+
+// updatePlatform updates the platform of the given index entry (if it has
+// one) to match the platform of the image configuration, if it was changed
+// with SetPlatform.
+func (m *Mutator) updatePlatform(descriptor *ispec.Descriptor) {
+	if !m.platformChanged || descriptor.Platform == nil {
+		return
+	}
+	platform := *descriptor.Platform
+	platform.OS = m.config.OS
+	platform.Architecture = m.config.Architecture
+	platform.Variant = m.variant
+	descriptor.Platform = &platform
+}
@@ -0,0 +1,149 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// historyEqual returns whether two history entries are identical. Created is
+// compared with time.Time.Equal, since the same time may be stored with
+// different locations.
+func historyEqual(a, b ispec.History) bool {
+	if (a.Created == nil) != (b.Created == nil) {
+		return false
+	}
+	if a.Created != nil && !a.Created.Equal(*b.Created) {
+		return false
+	}
+	return a.CreatedBy == b.CreatedBy &&
+		a.Author == b.Author &&
+		a.Comment == b.Comment &&
+		a.EmptyLayer == b.EmptyLayer
+}
+
+// baseHistoryLength returns the number of entries at the start of history
+// which belong to the base image with the given history and number of layers.
+// If history starts with baseHistory, it is used as-is. Otherwise, if every
+// layer of the image has a history entry, the entries up to (and including)
+// the entry of the last layer of the base image are used. If neither is
+// possible, false is returned.
+func baseHistoryLength(history, baseHistory []ispec.History, baseLayers, layers int) (int, bool) {
+	if len(baseHistory) <= len(history) {
+		prefix := true
+		for idx, entry := range baseHistory {
+			if !historyEqual(entry, history[idx]) {
+				prefix = false
+				break
+			}
+		}
+		if prefix {
+			return len(baseHistory), true
+		}
+	}
+	if countNonEmpty(history) != layers {
+		return 0, false
+	}
+	var nonEmpty int
+	for idx, entry := range history {
+		if nonEmpty == baseLayers {
+			return idx, true
+		}
+		if !entry.EmptyLayer {
+			nonEmpty++
+		}
+	}
+	return len(history), true
+}
+
+// Rebase replaces the layers of the image which belong to oldBase with the
+// layers of newBase, so that the layers added on top of oldBase (such as the
+// layers of an application) are moved onto newBase. The layers of oldBase must
+// be the bottom-most layers of the image, and newBase must have the same
+// operating system and architecture as the image. If either base refers to an
+// index, the manifest for the platform of the image is used.
+//
+// The diff_ids of the image are updated to match the new set of layers, and
+// the history entries of oldBase are replaced with those of newBase (if the
+// history entries of oldBase cannot be identified, the history is left
+// untouched). The rest of the configuration (such as Config.Env) is not
+// modified, and so may still contain values inherited from oldBase.
+func (m *Mutator) Rebase(ctx context.Context, oldBase, newBase casext.DescriptorPath) error {
+	if err := m.cache(ctx); err != nil {
+		return errors.Wrap(err, "getting cache failed")
+	}
+
+	platform := ispec.Platform{
+		OS:           m.config.OS,
+		Architecture: m.config.Architecture,
+		Variant:      m.variant,
+	}
+	oldMutator, err := NewPlatform(m.engine, oldBase, platform)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for old base")
+	}
+	if err := oldMutator.cache(ctx); err != nil {
+		return errors.Wrap(err, "get old base")
+	}
+	newMutator, err := NewPlatform(m.engine, newBase, platform)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for new base")
+	}
+	if err := newMutator.cache(ctx); err != nil {
+		return errors.Wrap(err, "get new base")
+	}
+
+	if newMutator.config.OS != m.config.OS || newMutator.config.Architecture != m.config.Architecture {
+		return errors.Errorf("new base has platform %s/%s, expected %s/%s", newMutator.config.OS, newMutator.config.Architecture, m.config.OS, m.config.Architecture)
+	}
+	for name, mutator := range map[string]*Mutator{"image": m, "old base": oldMutator, "new base": newMutator} {
+		if len(mutator.config.RootFS.DiffIDs) != len(mutator.manifest.Layers) {
+			return errors.Errorf("%s has %d diff_ids but %d layers", name, len(mutator.config.RootFS.DiffIDs), len(mutator.manifest.Layers))
+		}
+	}
+
+	oldLayers := oldMutator.manifest.Layers
+	if len(oldLayers) > len(m.manifest.Layers) {
+		return errors.Errorf("image has fewer layers (%d) than the old base (%d)", len(m.manifest.Layers), len(oldLayers))
+	}
+	for idx, layer := range oldLayers {
+		if layer.Digest != m.manifest.Layers[idx].Digest {
+			return errors.Errorf("layer %d of the image (%s) does not match the old base (%s)", idx, m.manifest.Layers[idx].Digest, layer.Digest)
+		}
+	}
+
+	// Figure out the history before we modify the layers.
+	cut, ok := baseHistoryLength(m.config.History, oldMutator.config.History, len(oldLayers), len(m.manifest.Layers))
+	if ok {
+		history := append([]ispec.History{}, newMutator.config.History...)
+		m.config.History = append(history, m.config.History[cut:]...)
+	} else {
+		log.Warnf("rebase: cannot identify the history entries of the old base, leaving history untouched")
+	}
+
+	layers := append([]ispec.Descriptor{}, newMutator.manifest.Layers...)
+	m.manifest.Layers = append(layers, m.manifest.Layers[len(oldLayers):]...)
+	diffIDs := append([]digest.Digest{}, newMutator.config.RootFS.DiffIDs...)
+	m.config.RootFS.DiffIDs = append(diffIDs, m.config.RootFS.DiffIDs[len(oldLayers):]...)
+	return nil
+}
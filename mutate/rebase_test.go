@@ -0,0 +1,160 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// addLayer adds a layer with the given contents and history comment to the
+// image described by from, and returns the committed image.
+func addLayer(t *testing.T, engine cas.Engine, from casext.DescriptorPath, contents string) casext.DescriptorPath {
+	mutator, err := New(engine, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Add(context.Background(), bytes.NewBufferString(contents), &ispec.History{
+		Comment: contents,
+	}); err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+	return newDescriptor
+}
+
+func TestMutateRebase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestMutateRebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	oldBase := casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}}
+	newBase := addLayer(t, engine, oldBase, "new base")
+	app := addLayer(t, engine, oldBase, "app")
+
+	mutator, err := New(engine, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Rebase(context.Background(), oldBase, newBase); err != nil {
+		t.Fatalf("unexpected error rebasing: %+v", err)
+	}
+	newDescriptor, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error committing changes: %+v", err)
+	}
+
+	rebased, err := New(engine, newDescriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rebased.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	newBaseMutator, err := New(engine, newBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newBaseMutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+	appMutator, err := New(engine, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := appMutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	// The layers of the new base are followed by the top layer of the app.
+	if len(rebased.manifest.Layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(rebased.manifest.Layers))
+	}
+	for idx, layer := range newBaseMutator.manifest.Layers {
+		if rebased.manifest.Layers[idx].Digest != layer.Digest {
+			t.Errorf("layer %d is not from the new base: %s", idx, rebased.manifest.Layers[idx].Digest)
+		}
+		if rebased.config.RootFS.DiffIDs[idx] != newBaseMutator.config.RootFS.DiffIDs[idx] {
+			t.Errorf("diff_id %d is not from the new base: %s", idx, rebased.config.RootFS.DiffIDs[idx])
+		}
+	}
+	if rebased.manifest.Layers[2].Digest != appMutator.manifest.Layers[1].Digest {
+		t.Errorf("top layer is not from the app: %s", rebased.manifest.Layers[2].Digest)
+	}
+	if rebased.config.RootFS.DiffIDs[2] != appMutator.config.RootFS.DiffIDs[1] {
+		t.Errorf("top diff_id is not from the app: %s", rebased.config.RootFS.DiffIDs[2])
+	}
+
+	// The history of the old base is replaced by the history of the new base.
+	var comments []string
+	for _, entry := range rebased.config.History {
+		comments = append(comments, entry.Comment)
+	}
+	if len(comments) != 3 || comments[1] != "new base" || comments[2] != "app" {
+		t.Errorf("unexpected history after rebase: %q", comments)
+	}
+
+	// Images which weren't built on the old base cannot be rebased.
+	mutator, err = New(engine, newBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.Rebase(context.Background(), app, oldBase); err == nil {
+		t.Errorf("expected error rebasing image which doesn't contain the old base")
+	}
+}
+
+func TestBaseHistoryLength(t *testing.T) {
+	base := []ispec.History{{CreatedBy: "base"}, {CreatedBy: "cmd", EmptyLayer: true}}
+
+	for _, test := range []struct {
+		name        string
+		history     []ispec.History
+		baseHistory []ispec.History
+		baseLayers  int
+		layers      int
+		expected    int
+		ok          bool
+	}{
+		{"Prefix", append(append([]ispec.History{}, base...), ispec.History{CreatedBy: "app"}), base, 1, 2, 2, true},
+		{"Counted", []ispec.History{{CreatedBy: "other"}, {CreatedBy: "env", EmptyLayer: true}, {CreatedBy: "app"}}, base, 1, 2, 1, true},
+		{"Mismatched", []ispec.History{{CreatedBy: "app"}}, base, 1, 2, 0, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := baseHistoryLength(test.history, test.baseHistory, test.baseLayers, test.layers)
+			if ok != test.ok || got != test.expected {
+				t.Errorf("expected (%d, %v), got (%d, %v)", test.expected, test.ok, got, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// checkedTarReader returns a reader which passes through the contents of
+// reader, but which fails if the contents are not a valid tar archive. The
+// archive is validated as it is read, so the error is returned before the
+// final read of the archive returns io.EOF.
+func checkedTarReader(reader io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() (Err error) {
+		defer func() {
+			// #nosec G104
+			_ = pw.CloseWithError(errors.Wrap(Err, "invalid tar archive"))
+		}()
+
+		tr := tar.NewReader(io.TeeReader(reader, pw))
+		for {
+			_, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return err
+			}
+		}
+		// Pass through any padding after the end-of-archive marker, so the
+		// layer is stored as given.
+		_, err := io.Copy(pw, reader)
+		return err
+	}()
+	return pr
+}
+
+// AddLayerFromTar adds the (uncompressed) tar archive read from reader as a
+// new layer on top of the image referred to by base, and commits the modified
+// image (see Mutator.Add and Mutator.Commit). The archive is validated as it
+// is read, and if it is not a valid tar archive no new image is committed
+// (though the partially-written layer blob may remain until it is garbage
+// collected). history is appended to the image's history, as with Add.
+//
+// Unlike umoci.Repack, no bundle or root filesystem is needed -- the archive
+// is used as-is, and so must already be a valid OCI layer changeset (with any
+// whiteouts the caller requires). No references are modified, so callers must
+// update any tags to point to the returned descriptor path themselves.
+func AddLayerFromTar(ctx context.Context, engine cas.Engine, base casext.DescriptorPath, reader io.Reader, history *ispec.History) (casext.DescriptorPath, error) {
+	mutator, err := New(engine, base)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "create mutator for base image")
+	}
+
+	layerReader := checkedTarReader(reader)
+	defer layerReader.Close()
+
+	if err := mutator.Add(ctx, layerReader, history); err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "add layer")
+	}
+	newPath, err := mutator.Commit(ctx)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "commit mutated image")
+	}
+	return newPath, nil
+}
@@ -0,0 +1,132 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mutate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestAddLayerFromTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestAddLayerFromTar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+	engineExt := casext.NewEngine(engine)
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	data := []byte("new contents")
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "new",
+		Mode:     0644,
+		Size:     int64(len(data)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerData := buffer.Bytes()
+
+	newPath, err := AddLayerFromTar(context.Background(), engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}}, bytes.NewReader(layerData), &ispec.History{
+		Comment: "new layer",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error adding layer: %+v", err)
+	}
+	if newPath.Descriptor().Digest == fromDescriptor.Digest {
+		t.Fatalf("new and old descriptors are the same!")
+	}
+
+	mutator, err := New(engine, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mutator.cache(context.Background()); err != nil {
+		t.Fatalf("unexpected error getting cache: %+v", err)
+	}
+
+	if len(mutator.manifest.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(mutator.manifest.Layers))
+	}
+	if mutator.manifest.Layers[0].Digest != expectedLayerDigest {
+		t.Errorf("manifest.Layers[0].Digest was modified")
+	}
+	if len(mutator.config.RootFS.DiffIDs) != 2 {
+		t.Fatalf("expected 2 diff_ids, got %d", len(mutator.config.RootFS.DiffIDs))
+	}
+	if got, want := mutator.config.RootFS.DiffIDs[1], digest.SHA256.FromBytes(layerData); got != want {
+		t.Errorf("unexpected diff_id: got %s, expected %s", got, want)
+	}
+	if len(mutator.config.History) != 2 || mutator.config.History[1].Comment != "new layer" {
+		t.Errorf("history entry was not added: %#v", mutator.config.History)
+	}
+
+	// The stored layer is the compressed tar archive.
+	blob, err := engineExt.GetBlob(context.Background(), mutator.manifest.Layers[1].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	gzr, err := gzip.NewReader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedData, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(storedData, layerData) {
+		t.Errorf("stored layer does not match the tar archive")
+	}
+}
+
+func TestAddLayerFromTarInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestAddLayerFromTarInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, fromDescriptor := setup(t, dir)
+	defer engine.Close()
+
+	reader := strings.NewReader(strings.Repeat("not a tar archive", 100))
+	if _, err := AddLayerFromTar(context.Background(), engine, casext.DescriptorPath{Walk: []ispec.Descriptor{fromDescriptor}}, reader, nil); err == nil {
+		t.Errorf("expected an error adding an invalid tar archive")
+	}
+}
@@ -30,16 +30,77 @@ import (
 	"golang.org/x/net/context"
 )
 
-// NewImage creates a new empty image (tag) in the existing layout.
+// NewImageOptions are optional settings for NewImageWithOptions.
+type NewImageOptions struct {
+	// NoClobber causes an error to be returned (without modifying the image)
+	// if the tag already exists, rather than replacing it.
+	NoClobber bool
+
+	// Created is the creation time of the new image. If nil, the current time
+	// is used.
+	Created *time.Time
+}
+
+// NewImage creates a new empty image (tag) in the existing layout. If the tag
+// already exists, it is replaced.
 func NewImage(engineExt casext.Engine, tagName string) error {
+	return NewImageWithOptions(engineExt, tagName, NewImageOptions{})
+}
+
+// NewImageWithOptions is the same as NewImage, but with the behaviour
+// modified by opt.
+func NewImageWithOptions(engineExt casext.Engine, tagName string, opt NewImageOptions) error {
+	if opt.NoClobber {
+		if err := checkNoClobber(engineExt, tagName); err != nil {
+			return err
+		}
+	}
+
+	createTime := time.Now()
+	if opt.Created != nil {
+		createTime = *opt.Created
+	}
+
 	// Create a new manifest.
 	log.WithFields(log.Fields{
 		"tag": tagName,
 	}).Debugf("creating new manifest")
 
+	descriptor, err := newManifest(engineExt, createTime)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"manifest": descriptor.Digest,
+	}).Info("new image manifest created")
+
+	if opt.NoClobber {
+		if err := engineExt.AddReference(context.Background(), tagName, descriptor); err != nil {
+			if errors.Cause(err) == casext.ErrReferenceExists {
+				// Include the existing digest in the error if possible.
+				if err := checkNoClobber(engineExt, tagName); err != nil {
+					return err
+				}
+			}
+			return errors.Wrap(err, "add new tag")
+		}
+	} else if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
+
+// newManifest creates a new empty image manifest (with no layers and a default
+// configuration created at createTime) in the layout, and returns its
+// descriptor. No tag is created.
+func newManifest(engineExt casext.Engine, createTime time.Time) (ispec.Descriptor, error) {
 	// Create a new image config.
 	g := igen.New()
-	createTime := time.Now()
 
 	// Set all of the defaults we need.
 	g.SetCreated(createTime)
@@ -55,7 +116,7 @@ func NewImage(engineExt casext.Engine, tagName string) error {
 	config := g.Image()
 	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), config)
 	if err != nil {
-		return errors.Wrap(err, "put config blob")
+		return ispec.Descriptor{}, errors.Wrap(err, "put config blob")
 	}
 
 	log.WithFields(log.Fields{
@@ -79,7 +140,7 @@ func NewImage(engineExt casext.Engine, tagName string) error {
 
 	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(context.Background(), manifest)
 	if err != nil {
-		return errors.Wrap(err, "put manifest blob")
+		return ispec.Descriptor{}, errors.Wrap(err, "put manifest blob")
 	}
 
 	log.WithFields(log.Fields{
@@ -87,22 +148,10 @@ func NewImage(engineExt casext.Engine, tagName string) error {
 		"size":   manifestSize,
 	}).Debugf("umoci: added new manifest")
 
-	// Now create a new reference, and either add it to the engine or spew it
-	// to stdout.
-
-	descriptor := ispec.Descriptor{
+	return ispec.Descriptor{
 		// FIXME: Support manifest lists.
 		MediaType: ispec.MediaTypeImageManifest,
 		Digest:    manifestDigest,
 		Size:      manifestSize,
-	}
-
-	log.Infof("new image manifest created: %s", descriptor.Digest)
-
-	if err := engineExt.UpdateReference(context.Background(), tagName, descriptor); err != nil {
-		return errors.Wrap(err, "add new tag")
-	}
-
-	log.Infof("created new tag for image manifest: %s", tagName)
-	return nil
+	}, nil
 }
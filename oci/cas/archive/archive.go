@@ -0,0 +1,281 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package archive implements a read-only cas.Engine for OCI images stored in
+// a single (uncompressed) tar archive of an OCI image layout, such as those
+// produced by "skopeo copy oci-archive:" or "docker save".
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/hardening"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ImageLayoutVersion is the version of the image layout we support. It
+	// is the same as dir.ImageLayoutVersion.
+	ImageLayoutVersion = "1.0.0"
+
+	// blobDirectory is the directory inside an OCI image that contains blobs.
+	blobDirectory = "blobs"
+
+	// indexFile is the file inside an OCI image that contains the top-level
+	// index.
+	indexFile = "index.json"
+
+	// layoutFile is the file in side an OCI image the indicates what version
+	// of the OCI spec the image is.
+	layoutFile = "oci-layout"
+
+	// dockerManifestFile is the file inside a "docker save" archive which
+	// describes the images in the (non-OCI) legacy Docker archive format.
+	dockerManifestFile = "manifest.json"
+)
+
+// blobPath returns the path to a blob given its digest, relative to the root
+// of the OCI image. The digest must be of the form algorithm:hex.
+func blobPath(digest digest.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	algo := digest.Algorithm()
+	hash := digest.Hex()
+
+	if !cas.IsSupportedAlgorithm(algo) {
+		return "", errors.Errorf("unsupported algorithm: %q", algo)
+	}
+
+	return path.Join(blobDirectory, algo.String(), hash), nil
+}
+
+// entry is the location of the contents of a regular file in the archive.
+type entry struct {
+	offset, size int64
+}
+
+type archiveEngine struct {
+	path string
+	fh   *os.File
+
+	// entries maps the (cleaned) path of every regular file in the archive to
+	// its contents.
+	entries map[string]entry
+}
+
+// IsArchive returns whether the given path refers to an image archive (which
+// must be opened with OpenReadOnly) rather than an image layout directory.
+// This is decided purely based on whether the path is a regular file (or a
+// symlink to one).
+func IsArchive(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// cleanName returns the cleaned path of an archive entry, relative to the
+// root of the archive.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// scan reads the headers of every entry in the archive, and records where the
+// contents of every regular file are stored.
+func (e *archiveEngine) scan() error {
+	// Compressed archives can't be used, since we need random access to the
+	// blobs.
+	var magic [2]byte
+	if _, err := io.ReadFull(e.fh, magic[:]); err == nil && bytes.Equal(magic[:], []byte{0x1f, 0x8b}) {
+		return errors.Errorf("compressed image archives are not supported (decompress the archive first)")
+	}
+	if _, err := e.fh.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek to start of archive")
+	}
+
+	tr := tar.NewReader(e.fh)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read archive")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// The tar reader does not buffer, so the current offset of the file
+		// is the start of the entry's contents.
+		offset, err := e.fh.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return errors.Wrap(err, "get archive offset")
+		}
+		e.entries[cleanName(hdr.Name)] = entry{offset: offset, size: hdr.Size}
+	}
+	return nil
+}
+
+// open returns a reader for the contents of the given file in the archive. If
+// the file does not exist in the archive, an error satisfying os.IsNotExist is
+// returned.
+func (e *archiveEngine) open(name string) (*io.SectionReader, error) {
+	ent, ok := e.entries[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: e.path + ":" + name, Err: os.ErrNotExist}
+	}
+	return io.NewSectionReader(e.fh, ent.offset, ent.size), nil
+}
+
+// validate ensures that the archive contains a valid image layout.
+func (e *archiveEngine) validate() error {
+	rdr, err := e.open(layoutFile)
+	if err != nil {
+		if _, ok := e.entries[dockerManifestFile]; ok {
+			return errors.Wrap(cas.ErrInvalid, "archive is a legacy docker archive without an OCI image layout")
+		}
+		return errors.Wrap(cas.ErrInvalid, "read oci-layout")
+	}
+
+	var ociLayout ispec.ImageLayout
+	if err := json.NewDecoder(rdr).Decode(&ociLayout); err != nil {
+		return errors.Wrap(err, "parse oci-layout")
+	}
+
+	// XXX: Currently the meaning of this field is not adequately defined by
+	//      the spec, nor is the "official" value determined by the spec.
+	if ociLayout.Version != ImageLayoutVersion {
+		return errors.Wrap(cas.ErrInvalid, "layout version is not supported")
+	}
+
+	if _, ok := e.entries[indexFile]; !ok {
+		return errors.Wrap(cas.ErrInvalid, "check index")
+	}
+	return nil
+}
+
+// PutBlob implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e *archiveEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return "", -1, errors.Wrap(cas.ErrReadOnly, "put blob")
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns os.ErrNotExist if the digest is not found.
+func (e *archiveEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute blob path")
+	}
+	rdr, err := e.open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open blob")
+	}
+	return &hardening.VerifiedReadCloser{
+		Reader:         ioutil.NopCloser(rdr),
+		ExpectedDigest: digest,
+		ExpectedSize:   rdr.Size(),
+	}, nil
+}
+
+// PutIndex implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e *archiveEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return errors.Wrap(cas.ErrReadOnly, "put index")
+}
+
+// GetIndex returns the index of the OCI image. Return ErrNotExist if the
+// digest is not found. If the image doesn't have an index, ErrInvalid is
+// returned (a valid OCI image MUST have an image index).
+func (e *archiveEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	rdr, err := e.open(indexFile)
+	if err != nil {
+		return ispec.Index{}, errors.Wrap(cas.ErrInvalid, "read index")
+	}
+
+	var index ispec.Index
+	if err := json.NewDecoder(rdr).Decode(&index); err != nil {
+		return ispec.Index{}, errors.Wrap(err, "parse index")
+	}
+	return index, nil
+}
+
+// DeleteBlob implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e *archiveEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return errors.Wrap(cas.ErrReadOnly, "delete blob")
+}
+
+// ListBlobs returns the set of blob digests stored in the image.
+func (e *archiveEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	digests := []digest.Digest{}
+	for _, algo := range cas.SupportedAlgorithms {
+		prefix := path.Join(blobDirectory, algo.String()) + "/"
+		for name := range e.entries {
+			if hash := strings.TrimPrefix(name, prefix); hash != name && !strings.Contains(hash, "/") {
+				digests = append(digests, digest.NewDigestFromHex(algo.String(), hash))
+			}
+		}
+	}
+	return digests, nil
+}
+
+// Clean implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e *archiveEngine) Clean(ctx context.Context) error {
+	return errors.Wrap(cas.ErrReadOnly, "clean")
+}
+
+// Close releases all references held by the e. Subsequent operations may
+// fail.
+func (e *archiveEngine) Close() error {
+	return errors.Wrap(e.fh.Close(), "close archive")
+}
+
+// OpenReadOnly opens a new read-only reference to the OCI image stored in the
+// tar archive at the provided path. The archive must be uncompressed, and
+// must contain an OCI image layout (either at the root of the archive or with
+// a "./" prefix). All operations which would modify the image return
+// cas.ErrReadOnly.
+func OpenReadOnly(path string) (cas.Engine, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open archive")
+	}
+	engine := &archiveEngine{
+		path:    path,
+		fh:      fh,
+		entries: map[string]entry{},
+	}
+
+	if err := engine.scan(); err != nil {
+		fh.Close()
+		return nil, errors.Wrap(err, "scan archive")
+	}
+	if err := engine.validate(); err != nil {
+		fh.Close()
+		return nil, errors.Wrap(err, "validate")
+	}
+	return engine, nil
+}
@@ -0,0 +1,254 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// createArchive creates a tar archive at archivePath of the directory root,
+// with every entry name prefixed with prefix.
+func createArchive(t *testing.T, root, archivePath, prefix string) {
+	fh, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	tw := tar.NewWriter(fh)
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + relPath
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if _, err := tw.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveEngine(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestArchiveEngine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	dirEngine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+
+	blobs := []string{"some blob", "another blob", "yet another blob"}
+	var digests []digest.Digest
+	for _, blob := range blobs {
+		dgst, _, err := dirEngine.PutBlob(ctx, bytes.NewBufferString(blob))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %+v", err)
+		}
+		digests = append(digests, dgst)
+	}
+	index := ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Manifests: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    digests[0],
+			Size:      int64(len(blobs[0])),
+		}},
+	}
+	if err := dirEngine.PutIndex(ctx, index); err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	if err := dirEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"", "./"} {
+		t.Run("prefix="+prefix, func(t *testing.T) {
+			archivePath := filepath.Join(root, "image.tar")
+			createArchive(t, image, archivePath, prefix)
+			defer os.Remove(archivePath)
+
+			if !IsArchive(archivePath) {
+				t.Errorf("archive not detected as archive")
+			}
+			if IsArchive(image) {
+				t.Errorf("image layout detected as archive")
+			}
+
+			engine, err := OpenReadOnly(archivePath)
+			if err != nil {
+				t.Fatalf("unexpected error opening archive: %+v", err)
+			}
+			defer engine.Close()
+
+			for idx, blob := range blobs {
+				rdr, err := engine.GetBlob(ctx, digests[idx])
+				if err != nil {
+					t.Fatalf("unexpected error getting blob: %+v", err)
+				}
+				data, err := ioutil.ReadAll(rdr)
+				rdr.Close()
+				if err != nil {
+					t.Fatalf("unexpected error reading blob: %+v", err)
+				}
+				if string(data) != blob {
+					t.Errorf("unexpected blob contents: expected %q, got %q", blob, data)
+				}
+			}
+
+			if _, err := engine.GetBlob(ctx, digest.FromString("missing blob")); !os.IsNotExist(errors.Cause(err)) {
+				t.Errorf("expected os.ErrNotExist getting missing blob, got %v", err)
+			}
+
+			gotIndex, err := engine.GetIndex(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error getting index: %+v", err)
+			}
+			if len(gotIndex.Manifests) != 1 || gotIndex.Manifests[0].Digest != digests[0] {
+				t.Errorf("unexpected index: %+v", gotIndex)
+			}
+
+			gotDigests, err := engine.ListBlobs(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error listing blobs: %+v", err)
+			}
+			sort.Slice(gotDigests, func(i, j int) bool { return gotDigests[i] < gotDigests[j] })
+			expected := append([]digest.Digest{}, digests...)
+			sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+			if len(gotDigests) != len(expected) {
+				t.Fatalf("unexpected blob list: expected %v, got %v", expected, gotDigests)
+			}
+			for idx := range expected {
+				if gotDigests[idx] != expected[idx] {
+					t.Errorf("unexpected blob list: expected %v, got %v", expected, gotDigests)
+				}
+			}
+
+			// All modifications must be rejected.
+			if _, _, err := engine.PutBlob(ctx, bytes.NewBufferString("new blob")); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("expected cas.ErrReadOnly from PutBlob, got %v", err)
+			}
+			if err := engine.PutIndex(ctx, index); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("expected cas.ErrReadOnly from PutIndex, got %v", err)
+			}
+			if err := engine.DeleteBlob(ctx, digests[0]); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("expected cas.ErrReadOnly from DeleteBlob, got %v", err)
+			}
+			if err := engine.Clean(ctx); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("expected cas.ErrReadOnly from Clean, got %v", err)
+			}
+
+			// The directory engine must refuse to open the archive.
+			if _, err := dir.Open(archivePath); errors.Cause(err) != cas.ErrInvalid {
+				t.Errorf("expected cas.ErrInvalid opening archive as a directory, got %v", err)
+			}
+		})
+	}
+}
+
+func TestArchiveEngineInvalid(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestArchiveEngineInvalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// A legacy "docker save" archive.
+	legacy := filepath.Join(root, "legacy")
+	if err := os.Mkdir(legacy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(legacy, "manifest.json"), []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	legacyPath := filepath.Join(root, "legacy.tar")
+	createArchive(t, legacy, legacyPath, "")
+	if _, err := OpenReadOnly(legacyPath); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected cas.ErrInvalid opening legacy docker archive, got %v", err)
+	}
+
+	// A compressed archive.
+	data, err := ioutil.ReadFile(legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	gzw := gzip.NewWriter(&buffer)
+	if _, err := io.Copy(gzw, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compressedPath := filepath.Join(root, "compressed.tar.gz")
+	if err := ioutil.WriteFile(compressedPath, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenReadOnly(compressedPath); err == nil {
+		t.Errorf("expected error opening compressed archive")
+	}
+}
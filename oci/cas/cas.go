@@ -21,10 +21,11 @@ import (
 	"fmt"
 	"io"
 
-	// We need to include sha256 in order for go-digest to properly handle such
-	// hashes, since Go's crypto library like to lazy-load cryptographic
-	// libraries.
+	// We need to include sha256 and sha512 in order for go-digest to properly
+	// handle such hashes, since Go's crypto library like to lazy-load
+	// cryptographic libraries.
 	_ "crypto/sha256"
+	_ "crypto/sha512"
 
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -32,11 +33,30 @@ import (
 )
 
 const (
-	// BlobAlgorithm is the name of the only supported digest algorithm for blobs.
-	// FIXME: We can make this a list.
+	// BlobAlgorithm is the name of the digest algorithm used by default for
+	// blobs added to an image. Blobs using any of the SupportedAlgorithms can
+	// be read.
 	BlobAlgorithm = digest.SHA256
 )
 
+// SupportedAlgorithms is the set of digest algorithms which can be used by
+// blobs stored in an image.
+var SupportedAlgorithms = []digest.Algorithm{
+	digest.SHA256,
+	digest.SHA512,
+}
+
+// IsSupportedAlgorithm returns whether blobs using the given digest algorithm
+// can be stored in an image.
+func IsSupportedAlgorithm(algo digest.Algorithm) bool {
+	for _, supported := range SupportedAlgorithms {
+		if algo == supported {
+			return algo.Available()
+		}
+	}
+	return false
+}
+
 // Exposed errors.
 var (
 	// ErrNotExist is effectively an implementation-neutral version of
@@ -58,6 +78,10 @@ var (
 	// ErrClobber is returned when a requested operation would require clobbering a
 	// reference or blob which already exists.
 	ErrClobber = fmt.Errorf("operation would clobber existing object")
+
+	// ErrReadOnly is returned when a modifying operation is attempted on an
+	// image which was opened read-only.
+	ErrReadOnly = fmt.Errorf("operation not permitted on read-only image")
 )
 
 // Engine is an interface that provides methods for accessing and modifying an
@@ -26,6 +26,7 @@ import (
 	"testing"
 
 	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
@@ -157,6 +158,52 @@ func TestEngineBlob(t *testing.T) {
 	}
 }
 
+func TestEngineBlobFailedReader(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobFailedReader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	readErr := errors.New("reader failed")
+	reader := io.MultiReader(bytes.NewBufferString("partial blob"), &errorReader{readErr})
+	if _, _, err := engine.PutBlob(ctx, reader); errors.Cause(err) != readErr {
+		t.Errorf("PutBlob: expected reader error: got %v", err)
+	}
+
+	// The partially-written blob must have been removed.
+	temp := engine.(*dirEngine).temp
+	names, err := ioutil.ReadDir(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range names {
+		t.Errorf("temporary file %s was not removed", fi.Name())
+	}
+}
+
+// errorReader is an io.Reader which always fails with err.
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
 func TestEngineValidate(t *testing.T) {
 	root, err := ioutil.TempDir("", "umoci-TestEngineValidate")
 	if err != nil {
@@ -300,3 +347,159 @@ func TestEngineValidate(t *testing.T) {
 		engine.Close()
 	}
 }
+
+func TestEngineBlobSHA512(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobSHA512")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	// Write a sha512 blob by hand, since PutBlob uses cas.BlobAlgorithm by
+	// default.
+	content := []byte("some sha512 blob")
+	blobDigest := digest.SHA512.FromBytes(content)
+	blobDir := filepath.Join(image, blobDirectory, digest.SHA512.String())
+	if err := os.Mkdir(blobDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(blobDir, blobDigest.Encoded()), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	blobReader, err := engine.GetBlob(ctx, blobDigest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	gotBytes, err := ioutil.ReadAll(blobReader)
+	blobReader.Close()
+	if err != nil {
+		t.Errorf("GetBlob: failed to ReadAll: %+v", err)
+	}
+	if !bytes.Equal(content, gotBytes) {
+		t.Errorf("GetBlob: bytes did not match: expected=%s got=%s", string(content), string(gotBytes))
+	}
+
+	// Add a sha256 blob, both should be listed.
+	sha256Digest, _, err := engine.PutBlob(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("ListBlobs: unexpected error: %+v", err)
+	}
+	if len(blobs) != 2 {
+		t.Errorf("ListBlobs: expected 2 blobs, got %v", blobs)
+	}
+	for _, expected := range []digest.Digest{blobDigest, sha256Digest} {
+		found := false
+		for _, blob := range blobs {
+			if blob == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("ListBlobs: %s missing from %v", expected, blobs)
+		}
+	}
+
+	// Unsupported algorithms must be rejected.
+	if _, err := engine.GetBlob(ctx, digest.SHA384.FromBytes(content)); err == nil {
+		t.Errorf("GetBlob: expected error with unsupported algorithm")
+	}
+
+	if err := engine.DeleteBlob(ctx, blobDigest); err != nil {
+		t.Errorf("DeleteBlob: unexpected error: %+v", err)
+	}
+	if br, err := engine.GetBlob(ctx, blobDigest); !os.IsNotExist(errors.Cause(err)) {
+		if err == nil {
+			br.Close()
+		}
+		t.Errorf("GetBlob: expected blob to be deleted: %+v", err)
+	}
+}
+
+func TestEngineBlobAlgorithm(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineBlobAlgorithm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	if engine, err := OpenWithOptions(image, OpenOptions{BlobAlgorithm: digest.SHA384}); err == nil {
+		engine.Close()
+		t.Errorf("OpenWithOptions: expected error with unsupported algorithm")
+	}
+
+	engine, err := OpenWithOptions(image, OpenOptions{BlobAlgorithm: digest.SHA512})
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+
+	// New blobs use the configured algorithm (even though Create only made
+	// the directory for cas.BlobAlgorithm).
+	content := []byte("some blob")
+	blobDigest, _, err := engine.PutBlob(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if blobDigest != digest.SHA512.FromBytes(content) {
+		t.Errorf("PutBlob: expected sha512 digest, got %s", blobDigest)
+	}
+	if _, err := os.Stat(filepath.Join(image, blobDirectory, "sha512", blobDigest.Encoded())); err != nil {
+		t.Errorf("PutBlob: blob not stored in sha512 directory: %v", err)
+	}
+
+	// Blobs from other images can keep their digests.
+	dirEngine := engine.(*dirEngine)
+	if dirEngine.BlobAlgorithm() != digest.SHA512 {
+		t.Errorf("BlobAlgorithm: expected sha512, got %s", dirEngine.BlobAlgorithm())
+	}
+	sha256Digest, _, err := dirEngine.PutBlobWithAlgorithm(ctx, bytes.NewReader(content), digest.SHA256)
+	if err != nil {
+		t.Fatalf("PutBlobWithAlgorithm: unexpected error: %+v", err)
+	}
+	if sha256Digest != digest.SHA256.FromBytes(content) {
+		t.Errorf("PutBlobWithAlgorithm: expected sha256 digest, got %s", sha256Digest)
+	}
+	if _, _, err := dirEngine.PutBlobWithAlgorithm(ctx, bytes.NewReader(content), digest.SHA384); err == nil {
+		t.Errorf("PutBlobWithAlgorithm: expected error with unsupported algorithm")
+	}
+
+	for _, dgst := range []digest.Digest{blobDigest, sha256Digest} {
+		blobReader, err := engine.GetBlob(ctx, dgst)
+		if err != nil {
+			t.Fatalf("GetBlob(%s): unexpected error: %+v", dgst, err)
+		}
+		gotBytes, err := ioutil.ReadAll(blobReader)
+		blobReader.Close()
+		if err != nil {
+			t.Errorf("GetBlob(%s): failed to ReadAll: %+v", dgst, err)
+		}
+		if !bytes.Equal(content, gotBytes) {
+			t.Errorf("GetBlob(%s): bytes did not match: expected=%s got=%s", dgst, string(content), string(gotBytes))
+		}
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas"
@@ -64,7 +65,7 @@ func blobPath(digest digest.Digest) (string, error) {
 	algo := digest.Algorithm()
 	hash := digest.Hex()
 
-	if algo != cas.BlobAlgorithm {
+	if !cas.IsSupportedAlgorithm(algo) {
 		return "", errors.Errorf("unsupported algorithm: %q", algo)
 	}
 
@@ -75,6 +76,70 @@ type dirEngine struct {
 	path     string
 	temp     string
 	tempFile *os.File
+
+	// lockFile is the handle to the image directory used to hold a flock(2)
+	// on the image, if the engine was opened with locking (see lock).
+	lockFile *os.File
+
+	// algorithm is the digest algorithm used for blobs added with PutBlob
+	// (see BlobAlgorithm).
+	algorithm digest.Algorithm
+}
+
+// BlobAlgorithm returns the digest algorithm used for blobs added to the image
+// with PutBlob (see OpenOptions.BlobAlgorithm).
+func (e *dirEngine) BlobAlgorithm() digest.Algorithm {
+	if e.algorithm == "" {
+		return cas.BlobAlgorithm
+	}
+	return e.algorithm
+}
+
+// lockPollInterval is how often lock retries taking the lock on an image
+// while waiting for another engine to release it.
+const lockPollInterval = 50 * time.Millisecond
+
+// lock takes an advisory lock on the image directory. Engines which modify
+// the image take an exclusive lock (unix.LOCK_EX), so that only one engine can
+// modify the image at a time (otherwise concurrent modifications of
+// index.json could be lost). Read-only engines take a shared lock
+// (unix.LOCK_SH), so that they don't see partial modifications and their
+// blobs aren't garbage collected while they are in use. If the image is
+// already locked, lock waits for it to be released as specified by opts.
+func (e *dirEngine) lock(opts OpenOptions, how int) error {
+	lockFile, err := os.Open(e.path)
+	if err != nil {
+		return errors.Wrap(err, "open image for lock")
+	}
+
+	var deadline time.Time
+	if opts.LockTimeout > 0 {
+		deadline = time.Now().Add(opts.LockTimeout)
+	}
+	for waited := false; ; waited = true {
+		err := unix.Flock(int(lockFile.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK {
+			lockFile.Close()
+			return errors.Wrap(err, "lock image")
+		}
+		if opts.NoWait {
+			lockFile.Close()
+			return errors.Errorf("image is in use by another process")
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			lockFile.Close()
+			return errors.Errorf("image is in use by another process: timed out after %s", opts.LockTimeout)
+		}
+		if !waited {
+			log.Infof("waiting for another process to finish using image %s", e.path)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	e.lockFile = lockFile
+	return nil
 }
 
 func (e *dirEngine) ensureTempDir() error {
@@ -103,6 +168,10 @@ func (e *dirEngine) ensureTempDir() error {
 
 // verify ensures that the image is valid.
 func (e *dirEngine) validate() error {
+	if fi, err := os.Stat(e.path); err == nil && fi.Mode().IsRegular() {
+		return errors.Wrap(cas.ErrInvalid, "image is a file (image archives can only be opened read-only)")
+	}
+
 	content, err := ioutil.ReadFile(filepath.Join(e.path, layoutFile))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -123,8 +192,8 @@ func (e *dirEngine) validate() error {
 	}
 
 	// Check that "blobs" and "index.json" exist in the image.
-	// FIXME: We also should check that blobs *only* contains a cas.BlobAlgorithm
-	//        directory (with no subdirectories) and that refs *only* contains
+	// FIXME: We also should check that blobs *only* contains cas.SupportedAlgorithms
+	//        directories (with no subdirectories) and that refs *only* contains
 	//        files (optionally also making sure they're all JSON descriptors).
 	if fi, err := os.Stat(filepath.Join(e.path, blobDirectory)); err != nil {
 		if os.IsNotExist(err) {
@@ -151,11 +220,22 @@ func (e *dirEngine) validate() error {
 // means that "the content is stored at DIGEST" without implying "because
 // of this PutBlob() call".
 func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return e.PutBlobWithAlgorithm(ctx, reader, e.BlobAlgorithm())
+}
+
+// PutBlobWithAlgorithm is the same as PutBlob, except that the blob is stored
+// using the given digest algorithm (which must be one of
+// cas.SupportedAlgorithms) rather than BlobAlgorithm. This allows blobs
+// copied from other images to keep their digests.
+func (e *dirEngine) PutBlobWithAlgorithm(ctx context.Context, reader io.Reader, algo digest.Algorithm) (_ digest.Digest, _ int64, Err error) {
+	if !cas.IsSupportedAlgorithm(algo) {
+		return "", -1, errors.Errorf("unsupported blob digest algorithm: %q", algo)
+	}
 	if err := e.ensureTempDir(); err != nil {
 		return "", -1, errors.Wrap(err, "ensure tempdir")
 	}
 
-	digester := cas.BlobAlgorithm.Digester()
+	digester := algo.Digester()
 
 	// We copy this into a temporary file because we need to get the blob hash,
 	// but also to avoid half-writing an invalid blob.
@@ -165,6 +245,14 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 	}
 	tempPath := fh.Name()
 	defer fh.Close()
+	// Don't leave a partially-written blob behind if the reader fails (such
+	// as when generating the blob was cancelled).
+	defer func() {
+		if Err != nil {
+			// #nosec G104
+			_ = os.Remove(tempPath)
+		}
+	}()
 
 	writer := io.MultiWriter(fh, digester.Hash())
 	size, err := io.Copy(writer, reader)
@@ -181,8 +269,13 @@ func (e *dirEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Diges
 		return "", -1, errors.Wrap(err, "compute blob name")
 	}
 
-	// Move the blob to its correct path.
+	// Move the blob to its correct path. Only the directory for
+	// cas.BlobAlgorithm is created by Create, so the directory for the blob's
+	// algorithm may not exist yet.
 	path = filepath.Join(e.path, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", -1, errors.Wrap(err, "create blob directory")
+	}
 	if err := os.Rename(tempPath, path); err != nil {
 		return "", -1, errors.Wrap(err, "rename temporary blob")
 	}
@@ -205,10 +298,23 @@ func (e *dirEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadC
 	}, errors.Wrap(err, "open blob")
 }
 
+// syncDir syncs the directory at the given path, so that any renames into the
+// directory are persisted.
+func syncDir(path string) error {
+	dirFh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dirFh.Close()
+	return dirFh.Sync()
+}
+
 // PutIndex sets the index of the OCI image to the given index, replacing the
 // previously existing index. This operation is atomic; any readers attempting
 // to access the OCI image while it is being modified will only ever see the
-// new or old index.
+// new or old index. The new index is synced to disk before it replaces the old
+// one, so that a crash cannot leave behind an empty or partially-written
+// index.
 func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	if err := e.ensureTempDir(); err != nil {
 		return errors.Wrap(err, "ensure tempdir")
@@ -227,6 +333,9 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	if err := json.NewEncoder(fh).Encode(index); err != nil {
 		return errors.Wrap(err, "write temporary index")
 	}
+	if err := fh.Sync(); err != nil {
+		return errors.Wrap(err, "sync temporary index")
+	}
 	if err := fh.Close(); err != nil {
 		return errors.Wrap(err, "close temporary index")
 	}
@@ -236,7 +345,7 @@ func (e *dirEngine) PutIndex(ctx context.Context, index ispec.Index) error {
 	if err := os.Rename(tempPath, path); err != nil {
 		return errors.Wrap(err, "rename temporary index")
 	}
-	return nil
+	return errors.Wrap(syncDir(e.path), "sync image directory")
 }
 
 // GetIndex returns the index of the OCI image. Return ErrNotExist if the
@@ -284,20 +393,28 @@ func (e *dirEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error
 // ListBlobs returns the set of blob digests stored in the image.
 func (e *dirEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
 	digests := []digest.Digest{}
-	blobDir := filepath.Join(e.path, blobDirectory, cas.BlobAlgorithm.String())
+	for _, algo := range cas.SupportedAlgorithms {
+		blobDir := filepath.Join(e.path, blobDirectory, algo.String())
 
-	if err := filepath.Walk(blobDir, func(path string, _ os.FileInfo, _ error) error {
-		// Skip the actual directory.
-		if path == blobDir {
-			return nil
+		// Only the directory for cas.BlobAlgorithm is created by Create, so
+		// the other algorithms' directories may not exist.
+		if _, err := os.Lstat(blobDir); os.IsNotExist(err) {
+			continue
 		}
 
-		// XXX: Do we need to handle multiple-directory-deep cases?
-		digest := digest.NewDigestFromHex(cas.BlobAlgorithm.String(), filepath.Base(path))
-		digests = append(digests, digest)
-		return nil
-	}); err != nil {
-		return nil, errors.Wrap(err, "walk blobdir")
+		if err := filepath.Walk(blobDir, func(path string, _ os.FileInfo, _ error) error {
+			// Skip the actual directory.
+			if path == blobDir {
+				return nil
+			}
+
+			// XXX: Do we need to handle multiple-directory-deep cases?
+			digest := digest.NewDigestFromHex(algo.String(), filepath.Base(path))
+			digests = append(digests, digest)
+			return nil
+		}); err != nil {
+			return nil, errors.Wrapf(err, "walk blobdir %s", algo)
+		}
 	}
 
 	return digests, nil
@@ -360,13 +477,137 @@ func (e *dirEngine) Close() error {
 		if err := os.RemoveAll(e.temp); err != nil {
 			return errors.Wrap(err, "remove tempdir")
 		}
+		e.temp = ""
+	}
+	if e.lockFile != nil {
+		if err := unix.Flock(int(e.lockFile.Fd()), unix.LOCK_UN); err != nil {
+			return errors.Wrap(err, "unlock image")
+		}
+		if err := e.lockFile.Close(); err != nil {
+			return errors.Wrap(err, "close image lock")
+		}
+		e.lockFile = nil
 	}
 	return nil
 }
 
-// Open opens a new reference to the directory-backed OCI image referenced by
-// the provided path.
+// OpenOptions configures how OpenWithOptions (and OpenReadOnlyWithOptions)
+// wait for the lock on an image.
+type OpenOptions struct {
+	// LockTimeout is the maximum time to wait for other engines to release
+	// the image. If zero, OpenWithOptions waits indefinitely.
+	LockTimeout time.Duration
+
+	// NoWait causes OpenWithOptions to fail immediately if the image is
+	// already in use, rather than waiting for it to be released.
+	NoWait bool
+
+	// NoLock disables locking of the image entirely. This is only safe if
+	// no other engines use the image concurrently, but allows images to be
+	// used on filesystems which don't support flock(2).
+	NoLock bool
+
+	// BlobAlgorithm is the digest algorithm used for blobs added to the image
+	// with PutBlob, which must be one of cas.SupportedAlgorithms. If empty,
+	// cas.BlobAlgorithm is used. Blobs using any supported algorithm can be
+	// read regardless.
+	BlobAlgorithm digest.Algorithm
+}
+
+// OpenWithOptions opens a new reference to the directory-backed OCI image
+// referenced by the provided path. An exclusive lock is taken on the image,
+// which is released by Close. This ensures that no other engines opened with
+// OpenWithOptions (or Open) modify the image at the same time, so changes to
+// the index of the image cannot be lost and garbage collection cannot remove
+// blobs which are in the process of being added to the image. Engines opened
+// with OpenReadOnlyWithOptions take a shared lock, and so cannot be open at
+// the same time either. Engines opened with OpenReadOnly do not take any
+// locks, and are not affected. If the image is already in use,
+// OpenWithOptions waits for it to be released as configured by opts (unless
+// opts.NoLock is set, in which case no lock is taken).
+func OpenWithOptions(path string, opts OpenOptions) (cas.Engine, error) {
+	if opts.BlobAlgorithm != "" && !cas.IsSupportedAlgorithm(opts.BlobAlgorithm) {
+		return nil, errors.Errorf("unsupported blob digest algorithm: %q", opts.BlobAlgorithm)
+	}
+	engine := &dirEngine{
+		path:      path,
+		temp:      "",
+		algorithm: opts.BlobAlgorithm,
+	}
+
+	if err := engine.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate")
+	}
+	if !opts.NoLock {
+		if err := engine.lock(opts, unix.LOCK_EX); err != nil {
+			return nil, err
+		}
+	}
+
+	return engine, nil
+}
+
+// Open is the same as OpenWithOptions with the default options, and thus
+// waits indefinitely for any other engines using the image to be closed.
 func Open(path string) (cas.Engine, error) {
+	return OpenWithOptions(path, OpenOptions{})
+}
+
+// OpenExclusive is the same as OpenWithOptions with NoWait set, and is used
+// for operations such as garbage collection which should not wait for other
+// users of the image.
+func OpenExclusive(path string) (cas.Engine, error) {
+	return OpenWithOptions(path, OpenOptions{NoWait: true})
+}
+
+// readOnlyEngine is a dirEngine which rejects all modifying operations with
+// cas.ErrReadOnly. Since it never creates a temporary directory, it never
+// takes any locks on the image and thus any number of readers can use the
+// same image concurrently.
+type readOnlyEngine struct {
+	*dirEngine
+}
+
+// PutBlob implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e readOnlyEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return "", -1, errors.Wrap(cas.ErrReadOnly, "put blob")
+}
+
+// PutBlobWithAlgorithm always returns cas.ErrReadOnly.
+func (e readOnlyEngine) PutBlobWithAlgorithm(ctx context.Context, reader io.Reader, algo digest.Algorithm) (digest.Digest, int64, error) {
+	return "", -1, errors.Wrap(cas.ErrReadOnly, "put blob")
+}
+
+// PutIndex implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e readOnlyEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return errors.Wrap(cas.ErrReadOnly, "put index")
+}
+
+// DeleteBlob implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e readOnlyEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return errors.Wrap(cas.ErrReadOnly, "delete blob")
+}
+
+// Clean implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e readOnlyEngine) Clean(ctx context.Context) error {
+	return errors.Wrap(cas.ErrReadOnly, "clean")
+}
+
+// OpenReadOnly opens a new read-only reference to the directory-backed OCI
+// image referenced by the provided path. No locks are taken on the image, and
+// all operations which would modify the image return cas.ErrReadOnly.
+func OpenReadOnly(path string) (cas.Engine, error) {
+	return OpenReadOnlyWithOptions(path, OpenOptions{NoLock: true})
+}
+
+// OpenReadOnlyWithOptions is the same as OpenReadOnly, except that (unless
+// opts.NoLock is set) a shared lock is taken on the image, which is released
+// by Close. Any number of read-only engines can hold the lock at the same
+// time, but it ensures that no engines opened with OpenWithOptions modify the
+// image (or garbage collect blobs) while it is being read. If the image is
+// being modified, OpenReadOnlyWithOptions waits for it to be released as
+// configured by opts.
+func OpenReadOnlyWithOptions(path string, opts OpenOptions) (cas.Engine, error) {
 	engine := &dirEngine{
 		path: path,
 		temp: "",
@@ -375,8 +616,13 @@ func Open(path string) (cas.Engine, error) {
 	if err := engine.validate(); err != nil {
 		return nil, errors.Wrap(err, "validate")
 	}
+	if !opts.NoLock {
+		if err := engine.lock(opts, unix.LOCK_SH); err != nil {
+			return nil, err
+		}
+	}
 
-	return engine, nil
+	return readOnlyEngine{engine}, nil
 }
 
 // Create creates a new OCI image layout at the given path. If the path already
@@ -24,6 +24,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/pkg/errors"
@@ -247,11 +248,10 @@ func TestEngineGCLocking(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Open a new reference and GC it.
-	gcEngine, err := Open(image)
-	if err != nil {
-		t.Fatalf("unexpected error opening image: %+v", err)
-	}
+	// Create a new reference and GC it. Open would wait for engine to be
+	// closed, so the engine is created directly to make sure that Clean
+	// respects the tempdir locks of other engines.
+	gcEngine := &dirEngine{path: image}
 
 	// TODO: This should be done with casext.GC...
 	if err := gcEngine.Clean(ctx); err != nil {
@@ -277,3 +277,275 @@ func TestEngineGCLocking(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenReadOnly(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestOpenReadOnly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	content := []byte("here's some sample content")
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	digest, _, err := engine.PutBlob(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("PutBlob: unexpected error: %+v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %+v", err)
+	}
+
+	roEngine, err := OpenReadOnly(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image read-only: %+v", err)
+	}
+	defer roEngine.Close()
+
+	// Reading must work as usual.
+	blobReader, err := roEngine.GetBlob(ctx, digest)
+	if err != nil {
+		t.Fatalf("GetBlob: unexpected error: %+v", err)
+	}
+	gotContent, err := ioutil.ReadAll(blobReader)
+	blobReader.Close()
+	if err != nil {
+		t.Fatalf("GetBlob: failed to read blob: %+v", err)
+	}
+	if !bytes.Equal(gotContent, content) {
+		t.Errorf("GetBlob: content doesn't match: expected=%q got=%q", content, gotContent)
+	}
+	index, err := roEngine.GetIndex(ctx)
+	if err != nil {
+		t.Fatalf("GetIndex: unexpected error: %+v", err)
+	}
+	if blobs, err := roEngine.ListBlobs(ctx); err != nil {
+		t.Errorf("ListBlobs: unexpected error: %+v", err)
+	} else if len(blobs) != 1 {
+		t.Errorf("ListBlobs: expected one blob, got %v", blobs)
+	}
+
+	// ... but any modification must fail.
+	if _, _, err := roEngine.PutBlob(ctx, bytes.NewReader(content)); errors.Cause(err) != cas.ErrReadOnly {
+		t.Errorf("PutBlob: expected ErrReadOnly, got %+v", err)
+	}
+	if err := roEngine.PutIndex(ctx, index); errors.Cause(err) != cas.ErrReadOnly {
+		t.Errorf("PutIndex: expected ErrReadOnly, got %+v", err)
+	}
+	if err := roEngine.DeleteBlob(ctx, digest); errors.Cause(err) != cas.ErrReadOnly {
+		t.Errorf("DeleteBlob: expected ErrReadOnly, got %+v", err)
+	}
+	if err := roEngine.Clean(ctx); errors.Cause(err) != cas.ErrReadOnly {
+		t.Errorf("Clean: expected ErrReadOnly, got %+v", err)
+	}
+
+	// No temporary directories (and thus no locks) should have been created.
+	if matches, err := filepath.Glob(filepath.Join(image, ".umoci-*")); err != nil {
+		t.Fatal(err)
+	} else if len(matches) > 0 {
+		t.Errorf("read-only engine created temporary directories: %v", matches)
+	}
+}
+
+func TestOpenExclusive(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestOpenExclusive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	// An exclusive engine cannot be opened while there is a writer.
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	if exclusive, err := OpenExclusive(image); err == nil {
+		exclusive.Close()
+		t.Fatalf("expected OpenExclusive to fail while image is open")
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("unexpected error closing image: %+v", err)
+	}
+
+	exclusive, err := OpenExclusive(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image exclusively: %+v", err)
+	}
+
+	// Only one exclusive engine can exist at a time, but readers don't take
+	// any locks.
+	if other, err := OpenExclusive(image); err == nil {
+		other.Close()
+		t.Fatalf("expected second OpenExclusive to fail")
+	}
+	reader, err := OpenReadOnly(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image read-only: %+v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("unexpected error closing read-only image: %+v", err)
+	}
+
+	// Writers must wait until the exclusive engine is closed.
+	opened := make(chan error)
+	go func() {
+		engine, err := Open(image)
+		if err == nil {
+			err = engine.Close()
+		}
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		t.Fatalf("Open did not wait for exclusive engine to be closed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := exclusive.Close(); err != nil {
+		t.Fatalf("unexpected error closing exclusive image: %+v", err)
+	}
+	if err := <-opened; err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+}
+
+func TestOpenLockTimeout(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestOpenLockTimeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+
+	// Only one writer can use the image at a time.
+	if other, err := OpenWithOptions(image, OpenOptions{NoWait: true}); err == nil {
+		other.Close()
+		t.Fatalf("expected second writer with NoWait to fail")
+	}
+	start := time.Now()
+	if other, err := OpenWithOptions(image, OpenOptions{LockTimeout: 200 * time.Millisecond}); err == nil {
+		other.Close()
+		t.Fatalf("expected second writer with LockTimeout to fail")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("OpenWithOptions returned after %s, before LockTimeout expired", elapsed)
+	}
+
+	// Once the writer is closed, the lock can be taken within the timeout.
+	opened := make(chan error)
+	go func() {
+		other, err := OpenWithOptions(image, OpenOptions{LockTimeout: 10 * time.Second})
+		if err == nil {
+			err = other.Close()
+		}
+		opened <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := engine.Close(); err != nil {
+		t.Fatalf("unexpected error closing image: %+v", err)
+	}
+	if err := <-opened; err != nil {
+		t.Fatalf("unexpected error opening image after it was released: %+v", err)
+	}
+}
+
+func TestOpenReadOnlyWithOptions(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestOpenReadOnlyWithOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	// Any number of readers can use the image at the same time.
+	reader, err := OpenReadOnlyWithOptions(image, OpenOptions{NoWait: true})
+	if err != nil {
+		t.Fatalf("unexpected error opening image read-only: %+v", err)
+	}
+	other, err := OpenReadOnlyWithOptions(image, OpenOptions{NoWait: true})
+	if err != nil {
+		t.Fatalf("unexpected error opening image read-only twice: %+v", err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatalf("unexpected error closing read-only image: %+v", err)
+	}
+
+	// ... but writers cannot, unless they don't take a lock.
+	if writer, err := OpenWithOptions(image, OpenOptions{NoWait: true}); err == nil {
+		writer.Close()
+		t.Fatalf("expected writer to fail while image is being read")
+	}
+	writer, err := OpenWithOptions(image, OpenOptions{NoLock: true})
+	if err != nil {
+		t.Fatalf("unexpected error opening image with NoLock: %+v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error closing image: %+v", err)
+	}
+
+	// Writers must wait until the reader is closed.
+	opened := make(chan error)
+	go func() {
+		engine, err := Open(image)
+		if err == nil {
+			err = engine.Close()
+		}
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		t.Fatalf("Open did not wait for reader to be closed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("unexpected error closing read-only image: %+v", err)
+	}
+	if err := <-opened; err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+
+	// Readers must not be able to use the image while it is being modified.
+	writer, err = Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer writer.Close()
+	if reader, err := OpenReadOnlyWithOptions(image, OpenOptions{LockTimeout: 100 * time.Millisecond}); err == nil {
+		reader.Close()
+		t.Fatalf("expected reader with LockTimeout to fail while image is being modified")
+	}
+	reader, err = OpenReadOnly(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image read-only without locking: %+v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("unexpected error closing read-only image: %+v", err)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package web implements a read-only cas.Engine for OCI image layouts which
+// are published over HTTP(S), such as a layout directory served by a static
+// web server or stored in an S3 bucket. Since plain HTTP doesn't allow the
+// contents of a directory to be listed, ListBlobs is not implemented.
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/pkg/hardening"
+	"github.com/openSUSE/umoci/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// ImageLayoutVersion is the version of the image layout we support. It
+	// is the same as dir.ImageLayoutVersion.
+	ImageLayoutVersion = "1.0.0"
+
+	// blobDirectory is the directory inside an OCI image that contains blobs.
+	blobDirectory = "blobs"
+
+	// indexFile is the file inside an OCI image that contains the top-level
+	// index.
+	indexFile = "index.json"
+
+	// layoutFile is the file in side an OCI image the indicates what version
+	// of the OCI spec the image is.
+	layoutFile = "oci-layout"
+)
+
+// blobPath returns the path to a blob given its digest, relative to the root
+// of the OCI image. The digest must be of the form algorithm:hex.
+func blobPath(digest digest.Digest) (string, error) {
+	if err := digest.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid digest: %q", digest)
+	}
+
+	algo := digest.Algorithm()
+	hash := digest.Hex()
+
+	if !cas.IsSupportedAlgorithm(algo) {
+		return "", errors.Errorf("unsupported algorithm: %q", algo)
+	}
+
+	return path.Join(blobDirectory, algo.String(), hash), nil
+}
+
+type webEngine struct {
+	// base is the URL of the image layout, with a trailing "/" so that the
+	// files of the layout can be resolved relative to it.
+	base *url.URL
+	opt  remote.Options
+}
+
+// get fetches the file at the given path (relative to the root of the image
+// layout). If the file doesn't exist, cas.ErrNotExist is returned. The caller
+// must close the returned body.
+func (e *webEngine) get(ctx context.Context, name string) (io.ReadCloser, error) {
+	u, err := e.base.Parse(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve url")
+	}
+	req, err := remote.NewRequest(u.String(), e.opt)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.opt.HTTPClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetch %s", name)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errors.Wrapf(cas.ErrNotExist, "fetch %s", name)
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("fetch %s: unexpected status: %s", name, resp.Status)
+	}
+}
+
+// getJSON fetches the file at the given path (relative to the root of the
+// image layout) and unmarshals it into v.
+func (e *webEngine) getJSON(ctx context.Context, name string, v interface{}) error {
+	body, err := e.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", name)
+	}
+	return errors.Wrapf(json.Unmarshal(content, v), "parse %s", name)
+}
+
+func (e *webEngine) validate(ctx context.Context) error {
+	var ociLayout ispec.ImageLayout
+	if err := e.getJSON(ctx, layoutFile, &ociLayout); err != nil {
+		// Anything other than a valid oci-layout means that the URL doesn't
+		// refer to an image layout.
+		if errors.Cause(err) == cas.ErrNotExist {
+			err = cas.ErrInvalid
+		} else if _, ok := errors.Cause(err).(*json.SyntaxError); ok {
+			err = cas.ErrInvalid
+		}
+		return errors.Wrap(err, "read oci-layout")
+	}
+
+	// XXX: Currently the meaning of this field is not adequately defined by
+	//      the spec, nor is the "official" value determined by the spec.
+	if ociLayout.Version != ImageLayoutVersion {
+		return errors.Wrap(cas.ErrInvalid, "layout version is not supported")
+	}
+	return nil
+}
+
+// PutBlob implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e *webEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	return "", -1, errors.Wrap(cas.ErrReadOnly, "put blob")
+}
+
+// GetBlob returns a reader for retrieving a blob from the image, which the
+// caller must Close(). Returns cas.ErrNotExist if the digest is not found.
+func (e *webEngine) GetBlob(ctx context.Context, digest digest.Digest) (io.ReadCloser, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, errors.Wrap(err, "compute blob path")
+	}
+	body, err := e.get(ctx, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open blob")
+	}
+	return &hardening.VerifiedReadCloser{
+		Reader:         body,
+		ExpectedDigest: digest,
+		ExpectedSize:   int64(-1), // We don't know the expected size.
+	}, nil
+}
+
+// PutIndex implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e *webEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	return errors.Wrap(cas.ErrReadOnly, "put index")
+}
+
+// GetIndex returns the index of the image. If the image doesn't have an
+// index, cas.ErrInvalid is returned.
+func (e *webEngine) GetIndex(ctx context.Context) (ispec.Index, error) {
+	var index ispec.Index
+	if err := e.getJSON(ctx, indexFile, &index); err != nil {
+		if errors.Cause(err) == cas.ErrNotExist {
+			err = cas.ErrInvalid
+		}
+		return ispec.Index{}, errors.Wrap(err, "read index")
+	}
+	return index, nil
+}
+
+// DeleteBlob implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e *webEngine) DeleteBlob(ctx context.Context, digest digest.Digest) error {
+	return errors.Wrap(cas.ErrReadOnly, "delete blob")
+}
+
+// ListBlobs implements cas.Engine, but always returns cas.ErrNotImplemented
+// since the blobs directory of the layout cannot be listed over HTTP.
+func (e *webEngine) ListBlobs(ctx context.Context) ([]digest.Digest, error) {
+	return nil, errors.Wrap(cas.ErrNotImplemented, "list blobs")
+}
+
+// Clean implements cas.Engine, but always returns cas.ErrReadOnly.
+func (e *webEngine) Clean(ctx context.Context) error {
+	return errors.Wrap(cas.ErrReadOnly, "clean")
+}
+
+// Close releases all references held by the engine.
+func (e *webEngine) Close() error {
+	return nil
+}
+
+// OpenReadOnly opens a new read-only reference to the OCI image layout
+// published at the given HTTP(S) URL (the URL of the directory containing
+// "oci-layout", "index.json" and "blobs"). Requests are made with the headers
+// and credentials configured by opt. If the URL doesn't refer to an image
+// layout, cas.ErrInvalid is returned. All operations which would modify the
+// image return cas.ErrReadOnly.
+func OpenReadOnly(rawurl string, opt remote.Options) (cas.Engine, error) {
+	base, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse url")
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.Errorf("unsupported url scheme: %s", base.Scheme)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		if base.RawPath != "" {
+			base.RawPath += "/"
+		}
+	}
+
+	engine := &webEngine{
+		base: base,
+		opt:  opt,
+	}
+	if err := engine.validate(context.Background()); err != nil {
+		return nil, errors.Wrap(err, "validate")
+	}
+	return engine, nil
+}
@@ -0,0 +1,153 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package web
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestWebEngine(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestWebEngine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	dirEngine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	content := "some blob"
+	dgst, size, err := dirEngine.PutBlob(ctx, bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %+v", err)
+	}
+	index := ispec.Index{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Manifests: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    dgst,
+			Size:      size,
+		}},
+	}
+	if err := dirEngine.PutIndex(ctx, index); err != nil {
+		t.Fatalf("unexpected error putting index: %+v", err)
+	}
+	if err := dirEngine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Serve the directory, requiring a token for the image.
+	fileServer := http.FileServer(http.Dir(root))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	opt := remote.Options{
+		Headers: http.Header{"Authorization": []string{"Bearer token"}},
+	}
+
+	if _, err := OpenReadOnly(server.URL+"/image", remote.Options{}); err == nil {
+		t.Errorf("expected error opening image without credentials")
+	}
+	if _, err := OpenReadOnly(server.URL+"/nonexistent", opt); errors.Cause(err) != cas.ErrInvalid {
+		t.Errorf("expected ErrInvalid opening non-image, got %+v", err)
+	}
+	if _, err := OpenReadOnly("ftp://example.com/image", opt); err == nil {
+		t.Errorf("expected error opening non-HTTP url")
+	}
+
+	for _, suffix := range []string{"", "/"} {
+		t.Run("suffix="+suffix, func(t *testing.T) {
+			engine, err := OpenReadOnly(server.URL+"/image"+suffix, opt)
+			if err != nil {
+				t.Fatalf("unexpected error opening image: %+v", err)
+			}
+			defer engine.Close()
+
+			gotIndex, err := engine.GetIndex(ctx)
+			if err != nil {
+				t.Fatalf("GetIndex: unexpected error: %+v", err)
+			}
+			if !reflect.DeepEqual(gotIndex, index) {
+				t.Errorf("GetIndex: expected %+v, got %+v", index, gotIndex)
+			}
+
+			reader, err := engine.GetBlob(ctx, dgst)
+			if err != nil {
+				t.Fatalf("GetBlob: unexpected error: %+v", err)
+			}
+			gotContent, err := ioutil.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatalf("GetBlob: failed to read blob: %+v", err)
+			}
+			if string(gotContent) != content {
+				t.Errorf("GetBlob: expected %q, got %q", content, gotContent)
+			}
+
+			missing := digest.FromString("missing blob")
+			if _, err := engine.GetBlob(ctx, missing); errors.Cause(err) != cas.ErrNotExist {
+				t.Errorf("GetBlob: expected ErrNotExist, got %+v", err)
+			}
+
+			// Modifications (and listing blobs) must fail.
+			if _, _, err := engine.PutBlob(ctx, bytes.NewBufferString(content)); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("PutBlob: expected ErrReadOnly, got %+v", err)
+			}
+			if err := engine.PutIndex(ctx, index); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("PutIndex: expected ErrReadOnly, got %+v", err)
+			}
+			if err := engine.DeleteBlob(ctx, dgst); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("DeleteBlob: expected ErrReadOnly, got %+v", err)
+			}
+			if err := engine.Clean(ctx); errors.Cause(err) != cas.ErrReadOnly {
+				t.Errorf("Clean: expected ErrReadOnly, got %+v", err)
+			}
+			if _, err := engine.ListBlobs(ctx); errors.Cause(err) != cas.ErrNotImplemented {
+				t.Errorf("ListBlobs: expected ErrNotImplemented, got %+v", err)
+			}
+		})
+	}
+}
@@ -20,8 +20,11 @@ package casext
 import (
 	"io"
 	"io/ioutil"
+	"os"
 
 	"github.com/openSUSE/umoci/oci/casext/mediatype"
+	"github.com/openSUSE/umoci/pkg/hardening"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -91,3 +94,30 @@ func (e Engine) FromDescriptor(ctx context.Context, descriptor ispec.Descriptor)
 	}
 	return &blob, nil
 }
+
+// BlobSize returns the size of the blob with the given digest. If the engine
+// provides no cheaper way of finding the size of a blob (such as stat(2)), the
+// entire blob is read.
+func (e Engine) BlobSize(ctx context.Context, digest digest.Digest) (int64, error) {
+	reader, err := e.GetBlob(ctx, digest)
+	if err != nil {
+		return -1, errors.Wrap(err, "get blob")
+	}
+	defer reader.Close()
+
+	// Look through the verification wrapper (since we don't care about the
+	// contents) to see whether the blob is backed by a file.
+	var underlying io.Reader = reader
+	if verified, ok := underlying.(*hardening.VerifiedReadCloser); ok {
+		underlying = verified.Reader
+	}
+	if statter, ok := underlying.(interface {
+		Stat() (os.FileInfo, error)
+	}); ok {
+		if fi, err := statter.Stat(); err == nil {
+			return fi.Size(), nil
+		}
+	}
+	size, err := io.Copy(ioutil.Discard, reader)
+	return size, errors.Wrap(err, "read blob")
+}
@@ -20,7 +20,14 @@
 // of cas.Engine.
 package casext
 
-import "github.com/openSUSE/umoci/oci/cas"
+import (
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
 
 // TODO: Convert this to an interface and make Engine private.
 
@@ -36,3 +43,33 @@ type Engine struct {
 func NewEngine(engine cas.Engine) Engine {
 	return Engine{Engine: engine}
 }
+
+// BlobAlgorithm returns the digest algorithm used for blobs added to the image
+// with PutBlob. This is cas.BlobAlgorithm unless the underlying cas.Engine
+// uses a different algorithm (by implementing a BlobAlgorithm method, as with
+// dir.OpenOptions.BlobAlgorithm).
+func (e Engine) BlobAlgorithm() digest.Algorithm {
+	if engine, ok := e.Engine.(interface {
+		BlobAlgorithm() digest.Algorithm
+	}); ok {
+		return engine.BlobAlgorithm()
+	}
+	return cas.BlobAlgorithm
+}
+
+// PutBlobWithAlgorithm adds a new blob to the image like PutBlob, except that
+// the blob is stored using the given digest algorithm. This is used when
+// copying blobs from other images, so that they keep their digests. Unless the
+// underlying cas.Engine implements a PutBlobWithAlgorithm method (as dir
+// engines do), algo must be the same as BlobAlgorithm.
+func (e Engine) PutBlobWithAlgorithm(ctx context.Context, reader io.Reader, algo digest.Algorithm) (digest.Digest, int64, error) {
+	if engine, ok := e.Engine.(interface {
+		PutBlobWithAlgorithm(context.Context, io.Reader, digest.Algorithm) (digest.Digest, int64, error)
+	}); ok {
+		return engine.PutBlobWithAlgorithm(ctx, reader, algo)
+	}
+	if algo != e.BlobAlgorithm() {
+		return "", -1, errors.Errorf("unsupported digest algorithm for new blobs: %s", algo)
+	}
+	return e.PutBlob(ctx, reader)
+}
@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext/mediatype"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// isNonDistributable returns whether the given media type is that of a
+// non-distributable (foreign) layer, which images may legitimately not contain.
+func isNonDistributable(mediaType string) bool {
+	switch mediaType {
+	case ispec.MediaTypeImageLayerNonDistributable,
+		ispec.MediaTypeImageLayerNonDistributableGzip,
+		// layer.MediaTypeImageLayerNonDistributableZstd (which we can't
+		// import here).
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd",
+		mediatype.DockerForeignLayerGzip:
+		return true
+	}
+	return false
+}
+
+// isMissingBlob returns whether err indicates that a blob is missing from the
+// image.
+func isMissingBlob(err error) bool {
+	cause := errors.Cause(err)
+	return cause == cas.ErrNotExist || os.IsNotExist(cause)
+}
+
+// hasBlob returns whether the engine already contains the blob described by
+// descriptor.
+func (e Engine) hasBlob(ctx context.Context, descriptor ispec.Descriptor) (bool, error) {
+	size, err := e.BlobSize(ctx, descriptor.Digest)
+	if isMissingBlob(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return size == descriptor.Size, nil
+}
+
+// copyBlob copies the blob described by descriptor from e to dst, verifying
+// that the copied blob matches the descriptor.
+func (e Engine) copyBlob(ctx context.Context, dst Engine, descriptor ispec.Descriptor) (Err error) {
+	reader, err := e.GetVerifiedBlob(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer func() {
+		if err := reader.Close(); err != nil && Err == nil {
+			Err = errors.Wrap(err, "close blob")
+		}
+	}()
+
+	dgst, size, err := dst.PutBlobWithAlgorithm(ctx, reader, descriptor.Digest.Algorithm())
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if dgst != descriptor.Digest || size != descriptor.Size {
+		// Should _never_ be reached, since the reader is verified.
+		return errors.Errorf("[internal error] copied blob does not match descriptor: expected %s (%d bytes), got %s (%d bytes)", descriptor.Digest, descriptor.Size, dgst, size)
+	}
+	return nil
+}
+
+// CopyBlobs copies the blob described by root, and every blob reachable from
+// it, from e to dst. Blobs which are already present in dst are not copied
+// again, and every copied blob is verified against its descriptor.
+// Non-distributable layers which are missing from e are skipped (as they need
+// to be fetched from their original location anyway). No references in dst
+// are modified, so callers must add a reference to root themselves.
+//
+// The number of blobs and bytes copied are returned.
+func (e Engine) CopyBlobs(ctx context.Context, dst Engine, root ispec.Descriptor) (int, int64, error) {
+	var (
+		blobs int
+		bytes int64
+	)
+	err := e.Walk(ctx, root, func(descriptorPath DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+		has, err := dst.hasBlob(ctx, descriptor)
+		if err != nil {
+			return errors.Wrapf(err, "stat destination blob %s", descriptor.Digest)
+		}
+		if has {
+			// We still need to walk the children of the blob, in case a
+			// previous copy was interrupted.
+			return nil
+		}
+
+		if IsForeignLayer(descriptor) {
+			if has, err := e.hasBlob(ctx, descriptor); err != nil {
+				return errors.Wrapf(err, "stat source blob %s", descriptor.Digest)
+			} else if !has {
+				log.Warnf("skipping missing foreign layer %s", descriptor.Digest)
+				return ErrSkipDescriptor
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"digest":    descriptor.Digest,
+			"mediatype": descriptor.MediaType,
+			"size":      descriptor.Size,
+		}).Info("copying blob")
+
+		if err := e.copyBlob(ctx, dst, descriptor); err != nil {
+			return errors.Wrapf(err, "copy blob %s", descriptor.Digest)
+		}
+		blobs++
+		bytes += descriptor.Size
+		return nil
+	})
+	return blobs, bytes, err
+}
@@ -0,0 +1,130 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/opencontainers/go-digest"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func newCopyTestEngine(t *testing.T, path string) Engine {
+	if err := dir.Create(path); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEngine(engine)
+}
+
+func putCopyTestBlob(t *testing.T, engine Engine, mediaType string, data []byte) ispec.Descriptor {
+	dgst, size, err := engine.PutBlob(context.Background(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: size}
+}
+
+func TestCopyBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestCopyBlobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	src := newCopyTestEngine(t, filepath.Join(root, "src"))
+	defer src.Close()
+	dst := newCopyTestEngine(t, filepath.Join(root, "dst"))
+	defer dst.Close()
+
+	// The first layer is shared with the destination, and the foreign layer
+	// is not present in either image.
+	shared := putCopyTestBlob(t, src, ispec.MediaTypeImageLayer, []byte("shared layer"))
+	putCopyTestBlob(t, dst, ispec.MediaTypeImageLayer, []byte("shared layer"))
+	layer := putCopyTestBlob(t, src, ispec.MediaTypeImageLayer, []byte("new layer"))
+	foreign := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerNonDistributable,
+		Digest:    digest.FromString("foreign layer"),
+		Size:      int64(len("foreign layer")),
+	}
+
+	configDigest, configSize, err := src.PutBlobJSON(ctx, ispec.Image{OS: "linux", Architecture: "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := src.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Config:    ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: configSize},
+		Layers:    []ispec.Descriptor{shared, layer, foreign},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+
+	// The shared layer and the foreign layer are not copied.
+	blobs, size, err := src.CopyBlobs(ctx, dst, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error copying blobs: %+v", err)
+	}
+	if blobs != 3 {
+		t.Errorf("expected 3 blobs to be copied, got %d", blobs)
+	}
+	if expected := manifestSize + configSize + layer.Size; size != expected {
+		t.Errorf("expected %d bytes to be copied, got %d", expected, size)
+	}
+	for _, descriptor := range []ispec.Descriptor{manifest, shared, layer} {
+		if has, err := dst.hasBlob(ctx, descriptor); err != nil || !has {
+			t.Errorf("blob %s missing from destination: %v", descriptor.Digest, err)
+		}
+	}
+	if has, err := dst.hasBlob(ctx, foreign); err != nil || has {
+		t.Errorf("foreign layer unexpectedly in destination: %v", err)
+	}
+
+	// Nothing is copied the second time around.
+	blobs, _, err = src.CopyBlobs(ctx, dst, manifest)
+	if err != nil {
+		t.Fatalf("unexpected error copying blobs again: %+v", err)
+	}
+	if blobs != 0 {
+		t.Errorf("expected no blobs to be copied again, got %d", blobs)
+	}
+
+	// Missing blobs (other than foreign layers) must result in an error.
+	missing := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    digest.FromString("missing layer"),
+		Size:      int64(len("missing layer")),
+	}
+	if _, _, err := src.CopyBlobs(ctx, dst, missing); err == nil {
+		t.Errorf("expected error copying missing blob")
+	}
+}
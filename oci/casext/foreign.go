@@ -0,0 +1,105 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/hardening"
+	"github.com/openSUSE/umoci/pkg/remote"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// IsForeignLayer returns whether the given descriptor is that of a foreign
+// layer (a non-distributable layer, or any blob with urls to fetch it from),
+// which images may legitimately not contain.
+func IsForeignLayer(descriptor ispec.Descriptor) bool {
+	return isNonDistributable(descriptor.MediaType) || len(descriptor.URLs) > 0
+}
+
+// OpenForeignLayer returns a reader for the blob of the given foreign layer,
+// fetched from the first of the urls of its descriptor which can be fetched
+// (using opt). The blob is verified against the digest and size of the
+// descriptor as it is read, and the caller must read it to EOF (checking the
+// error) before trusting it.
+func OpenForeignLayer(ctx context.Context, descriptor ispec.Descriptor, opt remote.Options) (io.ReadCloser, error) {
+	if len(descriptor.URLs) == 0 {
+		return nil, errors.Errorf("foreign layer %s has no urls", descriptor.Digest)
+	}
+	if err := descriptor.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "foreign layer %s", descriptor.Digest)
+	}
+
+	var lastErr error
+	for _, rawurl := range descriptor.URLs {
+		req, err := remote.NewRequest(rawurl, opt)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "fetch %s", rawurl)
+			continue
+		}
+		// Don't leak any credentials in the URL into the logs.
+		logURL := *req.URL
+		logURL.User = nil
+
+		log.Infof("fetching foreign layer %s: %s", descriptor.Digest, logURL.String())
+		resp, err := opt.HTTPClient().Do(req.WithContext(ctx))
+		if err != nil {
+			lastErr = errors.Wrapf(err, "fetch %s", logURL.String())
+			log.Warnf("%v", lastErr)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			// #nosec G104
+			_ = resp.Body.Close()
+			lastErr = errors.Errorf("fetch %s: unexpected status: %s", logURL.String(), resp.Status)
+			log.Warnf("%v", lastErr)
+			continue
+		}
+		return &hardening.VerifiedReadCloser{
+			Reader:         resp.Body,
+			ExpectedDigest: descriptor.Digest,
+			ExpectedSize:   descriptor.Size,
+		}, nil
+	}
+	return nil, errors.Wrapf(lastErr, "fetch foreign layer %s", descriptor.Digest)
+}
+
+// FetchForeignLayer fetches the blob of the given foreign layer (see
+// OpenForeignLayer) and adds it to the image. Nothing is added to the image
+// unless the fetched blob matches the descriptor.
+func (e Engine) FetchForeignLayer(ctx context.Context, descriptor ispec.Descriptor, opt remote.Options) error {
+	reader, err := OpenForeignLayer(ctx, descriptor, opt)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	blobDigest, blobSize, err := e.PutBlobWithAlgorithm(ctx, reader, descriptor.Digest.Algorithm())
+	if err != nil {
+		return errors.Wrapf(err, "put foreign layer %s", descriptor.Digest)
+	}
+	if blobDigest != descriptor.Digest || blobSize != descriptor.Size {
+		// Should _never_ be reached, since the reader is verified.
+		return errors.Errorf("[internal error] put foreign layer %s: blob stored as %s (%d bytes)", descriptor.Digest, blobDigest, blobSize)
+	}
+	return nil
+}
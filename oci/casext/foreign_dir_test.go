@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/pkg/remote"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+func TestIsForeignLayer(t *testing.T) {
+	for _, test := range []struct {
+		descriptor ispec.Descriptor
+		foreign    bool
+	}{
+		{ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip}, false},
+		{ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig}, false},
+		{ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerNonDistributableGzip}, true},
+		{ispec.Descriptor{MediaType: ispec.MediaTypeImageLayerGzip, URLs: []string{"https://example.com/layer"}}, true},
+	} {
+		if got := IsForeignLayer(test.descriptor); got != test.foreign {
+			t.Errorf("IsForeignLayer(%v): expected %v, got %v", test.descriptor, test.foreign, got)
+		}
+	}
+}
+
+func TestFetchForeignLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestFetchForeignLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engine := newCopyTestEngine(t, filepath.Join(root, "image"))
+	defer engine.Close()
+
+	data := "foreign layer contents"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good":
+			w.Write([]byte(data))
+		case "/bad":
+			w.Write([]byte("something else entirely"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	descriptor := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    digest.FromString(data),
+		Size:      int64(len(data)),
+	}
+
+	// A blob which doesn't match the descriptor must not be added.
+	descriptor.URLs = []string{server.URL + "/bad"}
+	if err := engine.FetchForeignLayer(ctx, descriptor, remote.Options{}); err == nil {
+		t.Errorf("expected fetching a mismatched foreign layer to fail")
+	}
+	if _, err := engine.GetBlob(ctx, descriptor.Digest); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected mismatched foreign layer to not be added: got %v", err)
+	}
+
+	// Urls which cannot be fetched are skipped.
+	descriptor.URLs = []string{server.URL + "/missing", server.URL + "/good"}
+	if err := engine.FetchForeignLayer(ctx, descriptor, remote.Options{}); err != nil {
+		t.Fatalf("unexpected error fetching foreign layer: %+v", err)
+	}
+	reader, err := engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		t.Fatalf("fetched foreign layer not in image: %+v", err)
+	}
+	defer reader.Close()
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != data {
+		t.Errorf("unexpected foreign layer contents: %q", got)
+	}
+
+	descriptor.URLs = []string{server.URL + "/missing"}
+	if _, err := OpenForeignLayer(ctx, descriptor, remote.Options{}); err == nil {
+		t.Errorf("expected opening a foreign layer with no working urls to fail")
+	}
+	descriptor.URLs = nil
+	if _, err := OpenForeignLayer(ctx, descriptor, remote.Options{}); err == nil {
+		t.Errorf("expected opening a foreign layer without urls to fail")
+	}
+}
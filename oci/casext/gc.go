@@ -18,6 +18,8 @@
 package casext
 
 import (
+	"sort"
+
 	"github.com/apex/log"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -25,23 +27,17 @@ import (
 	"golang.org/x/net/context"
 )
 
-// GC will perform a mark-and-sweep garbage collection of the OCI image
-// referenced by the given CAS engine. The root set is taken to be the set of
-// references stored in the image, and all blobs not reachable by following a
-// descriptor path from the root set will be removed.
-//
-// GC will only call ListBlobs and ListReferences once, and assumes that there
-// is no change in the set of references or blobs after calling those
-// functions. In other words, it assumes it is the only user of the image that
-// is making modifications. Things will not go well if this assumption is
-// challenged.
-func (e Engine) GC(ctx context.Context) error {
+// Unreachable returns the digests of every blob in the OCI image referenced by
+// the given CAS engine which is not reachable by following a descriptor path
+// from the root set (the set of references stored in the image). These are
+// the blobs which would be removed by GC.
+func (e Engine) Unreachable(ctx context.Context) ([]digest.Digest, error) {
 	// Generate the root set of descriptors.
 	var root []ispec.Descriptor
 
 	index, err := e.GetIndex(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get top-level index")
+		return nil, errors.Wrap(err, "get top-level index")
 	}
 
 	for _, descriptor := range index.Manifests {
@@ -60,25 +56,176 @@ func (e Engine) GC(ctx context.Context) error {
 
 		reachables, err := e.Reachable(ctx, descriptor)
 		if err != nil {
-			return errors.Wrapf(err, "getting reachables from root %d", idx)
+			return nil, errors.Wrapf(err, "getting reachables from root %d", idx)
 		}
 		for _, reachable := range reachables {
 			black[reachable] = struct{}{}
 		}
 	}
 
-	// Sweep all blobs in the white set.
+	// Collect all blobs in the white set.
 	blobs, err := e.ListBlobs(ctx)
 	if err != nil {
-		return errors.Wrap(err, "get blob list")
+		return nil, errors.Wrap(err, "get blob list")
 	}
 
-	n := 0
+	var white []digest.Digest
 	for _, digest := range blobs {
 		if _, ok := black[digest]; ok {
 			// Digest is in the black set.
 			continue
 		}
+		white = append(white, digest)
+	}
+	return white, nil
+}
+
+// GCBlob is a blob in an OCI image, as listed in a GCReport.
+type GCBlob struct {
+	// Digest is the digest of the blob.
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of the blob in bytes.
+	Size int64 `json:"size"`
+}
+
+// GCRoot is a reference in the root set of an OCI image, along with the
+// blobs which are reachable from it, as listed in a GCReport.
+type GCRoot struct {
+	// Name is the name of the reference (its AnnotationRefName). It is empty
+	// if the reference has no name.
+	Name string `json:"name,omitempty"`
+
+	// Descriptor is the descriptor of the reference.
+	Descriptor ispec.Descriptor `json:"descriptor"`
+
+	// ReachableBlobs and ReachableBytes are the number and total size of the
+	// blobs in the image which are reachable from this reference.
+	ReachableBlobs int   `json:"reachable_blobs"`
+	ReachableBytes int64 `json:"reachable_bytes"`
+
+	// ExclusiveBlobs and ExclusiveBytes are the number and total size of the
+	// blobs in the image which are only reachable from this reference (and
+	// thus would be removed by GC if this reference was removed).
+	ExclusiveBlobs int   `json:"exclusive_blobs"`
+	ExclusiveBytes int64 `json:"exclusive_bytes"`
+}
+
+// GCReport describes the result of a garbage collection of an OCI image,
+// without modifying the image (see Engine.GCReport).
+type GCReport struct {
+	// Roots is the root set of the image, in the same order as the
+	// references in the image's index.
+	Roots []GCRoot `json:"roots"`
+
+	// Unreachable is the set of blobs which would be removed by GC, sorted by
+	// digest.
+	Unreachable []GCBlob `json:"unreachable"`
+
+	// TotalBlobs and TotalBytes are the number and total size of all blobs
+	// in the image.
+	TotalBlobs int   `json:"total_blobs"`
+	TotalBytes int64 `json:"total_bytes"`
+
+	// ReclaimedBytes is the total size of the blobs in Unreachable.
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+}
+
+// GCReport returns a report of which blobs would be removed by GC (and how
+// much space would be reclaimed) along with an analysis of which blobs are
+// reachable from each reference in the root set. The image is not modified.
+func (e Engine) GCReport(ctx context.Context) (*GCReport, error) {
+	index, err := e.GetIndex(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+
+	blobs, err := e.ListBlobs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob list")
+	}
+	sizes := map[digest.Digest]int64{}
+	report := &GCReport{TotalBlobs: len(blobs)}
+	for _, blob := range blobs {
+		size, err := e.BlobSize(ctx, blob)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get size of blob %s", blob)
+		}
+		sizes[blob] = size
+		report.TotalBytes += size
+	}
+
+	// Mark from the root set, keeping track of which roots reach each blob.
+	// Blobs which are referenced but missing from the image (such as
+	// foreign layers) are ignored.
+	var reachables [][]digest.Digest
+	refCounts := map[digest.Digest]int{}
+	for idx, descriptor := range index.Manifests {
+		reachable, err := e.Reachable(ctx, descriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting reachables from root %d", idx)
+		}
+		reachables = append(reachables, reachable)
+		for _, blob := range reachable {
+			refCounts[blob]++
+		}
+	}
+	for idx, descriptor := range index.Manifests {
+		root := GCRoot{
+			Name:       descriptor.Annotations[ispec.AnnotationRefName],
+			Descriptor: descriptor,
+		}
+		for _, blob := range reachables[idx] {
+			size, ok := sizes[blob]
+			if !ok {
+				continue
+			}
+			root.ReachableBlobs++
+			root.ReachableBytes += size
+			if refCounts[blob] == 1 {
+				root.ExclusiveBlobs++
+				root.ExclusiveBytes += size
+			}
+		}
+		report.Roots = append(report.Roots, root)
+	}
+
+	for _, blob := range blobs {
+		if _, ok := refCounts[blob]; ok {
+			continue
+		}
+		report.Unreachable = append(report.Unreachable, GCBlob{
+			Digest: blob,
+			Size:   sizes[blob],
+		})
+		report.ReclaimedBytes += sizes[blob]
+	}
+	sort.Slice(report.Unreachable, func(i, j int) bool {
+		return report.Unreachable[i].Digest < report.Unreachable[j].Digest
+	})
+	return report, nil
+}
+
+// GC will perform a mark-and-sweep garbage collection of the OCI image
+// referenced by the given CAS engine. The root set is taken to be the set of
+// references stored in the image, and all blobs not reachable by following a
+// descriptor path from the root set will be removed (see Unreachable).
+//
+// GC will only call ListBlobs and ListReferences once, and assumes that there
+// is no change in the set of references or blobs after calling those
+// functions. In other words, it assumes it is the only user of the image that
+// is making modifications. Things will not go well if this assumption is
+// challenged (for directory-backed images, this can be ensured by opening the
+// image with dir.OpenExclusive).
+func (e Engine) GC(ctx context.Context) error {
+	white, err := e.Unreachable(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Sweep all blobs in the white set.
+	n := 0
+	for _, digest := range white {
 		log.Infof("garbage collecting blob: %s", digest)
 
 		if err := e.DeleteBlob(ctx, digest); err != nil {
@@ -162,6 +162,30 @@ func TestGCWithNonEmptyIndex(t *testing.T) {
 		t.Fatalf("error writing index: %+v", err)
 	}
 
+	if blobSize, err := engineExt.BlobSize(ctx, digest); err != nil {
+		t.Fatalf("unexpected error getting blob size: %+v", err)
+	} else if blobSize != size {
+		t.Errorf("unexpected blob size: expected %d, got %d", size, blobSize)
+	}
+
+	// Everything but the referenced blob must be unreachable.
+	b, err = engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	unreachable, err := engineExt.Unreachable(ctx)
+	if err != nil {
+		t.Fatalf("Unreachable failed: %+v", err)
+	}
+	if len(unreachable) != len(b)-1 {
+		t.Errorf("expected %d unreachable blobs, got %d", len(b)-1, len(unreachable))
+	}
+	for _, unreachableDigest := range unreachable {
+		if unreachableDigest == digest {
+			t.Errorf("referenced blob %s is unreachable", digest)
+		}
+	}
+
 	err = engineExt.GC(ctx)
 	if err != nil {
 		t.Fatalf("GC failed: %+v", err)
@@ -175,3 +199,198 @@ func TestGCWithNonEmptyIndex(t *testing.T) {
 		t.Fatalf("expected single-entry blob list after GC")
 	}
 }
+
+func TestGCReport(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestGCReport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// Two manifests which share a layer, as well as an orphan blob.
+	layerDigest, layerSize, err := engine.PutBlob(ctx, strings.NewReader("shared layer"))
+	if err != nil {
+		t.Fatalf("error writing blob: %+v", err)
+	}
+	orphanDigest, orphanSize, err := engine.PutBlob(ctx, strings.NewReader("orphan blob"))
+	if err != nil {
+		t.Fatalf("error writing blob: %+v", err)
+	}
+	var manifestSizes []int64
+	for _, name := range []string{"a", "b"} {
+		configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{Author: name})
+		if err != nil {
+			t.Fatalf("error writing config: %+v", err)
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+			Versioned: imeta.Versioned{
+				SchemaVersion: 2,
+			},
+			Config: ispec.Descriptor{
+				MediaType: ispec.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers: []ispec.Descriptor{
+				{
+					MediaType: ispec.MediaTypeImageLayer,
+					Digest:    layerDigest,
+					Size:      layerSize,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("error writing manifest: %+v", err)
+		}
+		if err := engineExt.UpdateReference(ctx, name, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}); err != nil {
+			t.Fatalf("error updating reference: %+v", err)
+		}
+		manifestSizes = append(manifestSizes, manifestSize+configSize)
+	}
+
+	report, err := engineExt.GCReport(ctx)
+	if err != nil {
+		t.Fatalf("GCReport failed: %+v", err)
+	}
+	if report.TotalBlobs != 6 {
+		t.Errorf("expected 6 blobs, got %d", report.TotalBlobs)
+	}
+	if len(report.Unreachable) != 1 || report.Unreachable[0].Digest != orphanDigest || report.Unreachable[0].Size != orphanSize {
+		t.Errorf("unexpected unreachable blobs: %v", report.Unreachable)
+	}
+	if report.ReclaimedBytes != orphanSize {
+		t.Errorf("expected %d reclaimed bytes, got %d", orphanSize, report.ReclaimedBytes)
+	}
+	if len(report.Roots) != 2 {
+		t.Fatalf("expected 2 roots, got %d", len(report.Roots))
+	}
+	for idx, name := range []string{"a", "b"} {
+		root := report.Roots[idx]
+		if root.Name != name {
+			t.Errorf("expected root %d to be %s, got %s", idx, name, root.Name)
+		}
+		// The shared layer is reachable, but not exclusive to either root.
+		if root.ReachableBlobs != 3 || root.ReachableBytes != manifestSizes[idx]+layerSize {
+			t.Errorf("unexpected reachable blobs of %s: %d (%d bytes)", name, root.ReachableBlobs, root.ReachableBytes)
+		}
+		if root.ExclusiveBlobs != 2 || root.ExclusiveBytes != manifestSizes[idx] {
+			t.Errorf("unexpected exclusive blobs of %s: %d (%d bytes)", name, root.ExclusiveBlobs, root.ExclusiveBytes)
+		}
+	}
+
+	// The report must not modify the image.
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	if len(blobs) != 6 {
+		t.Errorf("expected 6 blobs after GCReport, got %d", len(blobs))
+	}
+}
+
+func TestGCForeignLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestGCForeignLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	// A manifest with a local layer and a foreign layer which is only
+	// available from its urls (and so is missing from the image).
+	localDigest, localSize, err := engine.PutBlob(ctx, strings.NewReader("local layer"))
+	if err != nil {
+		t.Fatalf("error writing blob: %+v", err)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{Author: "foreign"})
+	if err != nil {
+		t.Fatalf("error writing config: %+v", err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{
+			{
+				MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
+				Digest:    "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+				Size:      1234,
+				URLs:      []string{"https://example.com/layer.tar.gz"},
+			},
+			{
+				MediaType: ispec.MediaTypeImageLayer,
+				Digest:    localDigest,
+				Size:      localSize,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error writing manifest: %+v", err)
+	}
+	if err := engineExt.UpdateReference(ctx, "foreign", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		t.Fatalf("error updating reference: %+v", err)
+	}
+
+	report, err := engineExt.GCReport(ctx)
+	if err != nil {
+		t.Fatalf("GCReport failed: %+v", err)
+	}
+	if len(report.Unreachable) != 0 {
+		t.Errorf("unexpected unreachable blobs: %v", report.Unreachable)
+	}
+	// The missing foreign layer is not counted.
+	if len(report.Roots) != 1 || report.Roots[0].ReachableBlobs != 3 {
+		t.Errorf("unexpected roots: %+v", report.Roots)
+	}
+
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatalf("GC failed: %+v", err)
+	}
+	blobs, err := engine.ListBlobs(ctx)
+	if err != nil {
+		t.Fatalf("unable to list blobs: %+v", err)
+	}
+	if len(blobs) != 3 {
+		t.Errorf("expected 3 blobs after GC, got %d", len(blobs))
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mediatype
+
+import (
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Media types used by Docker's "image manifest v2, schema 2" format. These are
+// only used by umoci when producing Docker-compatible variants of OCI
+// manifests, but are registered so that such manifests are understood when
+// walking an image (such as during garbage collection).
+const (
+	// DockerManifest is the media type of a Docker image manifest.
+	DockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+	// DockerConfig is the media type of a Docker image configuration.
+	DockerConfig = "application/vnd.docker.container.image.v1+json"
+
+	// DockerLayerGzip is the media type of a gzip-compressed Docker layer.
+	DockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// DockerForeignLayerGzip is the media type of a gzip-compressed Docker
+	// layer which may not be uploaded to registries.
+	DockerForeignLayerGzip = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// DockerManifestBlob is the structure of a Docker image manifest. It is
+// identical to ispec.Manifest except for the mediaType field (and the lack of
+// annotations).
+type DockerManifestBlob struct {
+	// SchemaVersion is always 2.
+	SchemaVersion int `json:"schemaVersion"`
+
+	// MediaType is always DockerManifest.
+	MediaType string `json:"mediaType"`
+
+	// Config references the configuration of the image.
+	Config ispec.Descriptor `json:"config"`
+
+	// Layers are the layers of the image.
+	Layers []ispec.Descriptor `json:"layers"`
+}
+
+// Register the Docker image types.
+func init() {
+	RegisterParser(DockerConfig, CustomJSONParser(ispec.Image{}))
+
+	RegisterTarget(DockerManifest)
+	RegisterParser(DockerManifest, CustomJSONParser(DockerManifestBlob{}))
+}
@@ -0,0 +1,137 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"runtime"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DefaultPlatform returns the platform of the running system, which is used
+// to select a manifest from an index if no other platform was specified.
+func DefaultPlatform() ispec.Platform {
+	return ispec.Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+	}
+}
+
+// ParsePlatform parses a platform of the form "os/arch[/variant]" (such as
+// "linux/arm64" or "linux/arm/v7").
+func ParsePlatform(value string) (ispec.Platform, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ispec.Platform{}, errors.Errorf("invalid platform %q: must be of the form os/arch[/variant]", value)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return ispec.Platform{}, errors.Errorf("invalid platform %q: must be of the form os/arch[/variant]", value)
+		}
+	}
+	platform := ispec.Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// FormatPlatform formats a platform in the "os/arch[/variant]" form accepted
+// by ParsePlatform.
+func FormatPlatform(platform ispec.Platform) string {
+	value := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		value += "/" + platform.Variant
+	}
+	return value
+}
+
+// MatchPlatform returns whether the given descriptor (an entry in an index)
+// is suitable for the given platform. Descriptors without a platform are
+// suitable for all platforms, and an empty Variant in platform matches any
+// variant.
+func MatchPlatform(descriptor ispec.Descriptor, platform ispec.Platform) bool {
+	if descriptor.Platform == nil {
+		return true
+	}
+	if descriptor.Platform.OS != platform.OS || descriptor.Platform.Architecture != platform.Architecture {
+		return false
+	}
+	return platform.Variant == "" || descriptor.Platform.Variant == platform.Variant
+}
+
+// SelectPlatform filters the given set of descriptor paths (as returned by
+// ResolveReference) to only those which are suitable for the given platform.
+// If there is only one descriptor path it is always returned, so that
+// single-platform images work regardless of the platform requested.
+func SelectPlatform(descriptorPaths []DescriptorPath, platform ispec.Platform) []DescriptorPath {
+	if len(descriptorPaths) <= 1 {
+		return descriptorPaths
+	}
+	var selected []DescriptorPath
+	for _, descriptorPath := range descriptorPaths {
+		if MatchPlatform(descriptorPath.Descriptor(), platform) {
+			selected = append(selected, descriptorPath)
+		}
+	}
+	return selected
+}
+
+// ResolvePlatform extends the given descriptor path (which refers to an index)
+// so that it refers to the manifest in the index (or any nested indexes) which
+// is suitable for the given platform. If the descriptor path already refers to
+// a manifest, it is returned unmodified. An error is returned if there is not
+// exactly one suitable manifest.
+func (e Engine) ResolvePlatform(ctx context.Context, descriptorPath DescriptorPath, platform ispec.Platform) (DescriptorPath, error) {
+	for descriptorPath.Descriptor().MediaType == ispec.MediaTypeImageIndex {
+		blob, err := e.FromDescriptor(ctx, descriptorPath.Descriptor())
+		if err != nil {
+			return DescriptorPath{}, errors.Wrap(err, "get index")
+		}
+		index, ok := blob.Data.(ispec.Index)
+		blob.Close()
+		if !ok {
+			// Should _never_ be reached.
+			return DescriptorPath{}, errors.Errorf("[internal error] unknown index blob type: %s", blob.Descriptor.MediaType)
+		}
+
+		var matches []ispec.Descriptor
+		for _, descriptor := range index.Manifests {
+			if (descriptor.MediaType == ispec.MediaTypeImageManifest || descriptor.MediaType == ispec.MediaTypeImageIndex) && MatchPlatform(descriptor, platform) {
+				matches = append(matches, descriptor)
+			}
+		}
+		if len(matches) == 0 {
+			return DescriptorPath{}, errors.Errorf("index %s has no manifest for platform %s/%s", descriptorPath.Descriptor().Digest, platform.OS, platform.Architecture)
+		}
+		if len(matches) != 1 {
+			return DescriptorPath{}, errors.Errorf("index %s has %d manifests for platform %s/%s", descriptorPath.Descriptor().Digest, len(matches), platform.OS, platform.Architecture)
+		}
+
+		walk := make([]ispec.Descriptor, len(descriptorPath.Walk), len(descriptorPath.Walk)+1)
+		copy(walk, descriptorPath.Walk)
+		descriptorPath = DescriptorPath{Walk: append(walk, matches[0])}
+	}
+	return descriptorPath, nil
+}
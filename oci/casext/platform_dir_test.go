@@ -0,0 +1,189 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package casext
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	ispecs "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected ispec.Platform
+		fail     bool
+	}{
+		{value: "linux/amd64", expected: ispec.Platform{OS: "linux", Architecture: "amd64"}},
+		{value: "linux/arm/v7", expected: ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{value: "windows/amd64", expected: ispec.Platform{OS: "windows", Architecture: "amd64"}},
+		{value: "", fail: true},
+		{value: "linux", fail: true},
+		{value: "linux/", fail: true},
+		{value: "/amd64", fail: true},
+		{value: "linux/arm/", fail: true},
+		{value: "linux/arm/v7/extra", fail: true},
+	} {
+		got, err := ParsePlatform(test.value)
+		if test.fail {
+			if err == nil {
+				t.Errorf("ParsePlatform(%q): expected error, got %v", test.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePlatform(%q): unexpected error: %+v", test.value, err)
+			continue
+		}
+		if got.OS != test.expected.OS || got.Architecture != test.expected.Architecture || got.Variant != test.expected.Variant {
+			t.Errorf("ParsePlatform(%q): expected %v, got %v", test.value, test.expected, got)
+		}
+		if formatted := FormatPlatform(got); formatted != test.value {
+			t.Errorf("FormatPlatform(%v): expected %q, got %q", got, test.value, formatted)
+		}
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	linuxAmd64 := ispec.Platform{OS: "linux", Architecture: "amd64"}
+	linuxArmV7 := ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+	for _, test := range []struct {
+		platform *ispec.Platform
+		want     ispec.Platform
+		expected bool
+	}{
+		{platform: nil, want: linuxAmd64, expected: true},
+		{platform: &linuxAmd64, want: linuxAmd64, expected: true},
+		{platform: &linuxAmd64, want: ispec.Platform{OS: "windows", Architecture: "amd64"}, expected: false},
+		{platform: &linuxAmd64, want: linuxArmV7, expected: false},
+		{platform: &linuxArmV7, want: ispec.Platform{OS: "linux", Architecture: "arm"}, expected: true},
+		{platform: &linuxArmV7, want: ispec.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, expected: false},
+	} {
+		got := MatchPlatform(ispec.Descriptor{Platform: test.platform}, test.want)
+		if got != test.expected {
+			t.Errorf("MatchPlatform(%v, %v): expected %v, got %v", test.platform, test.want, test.expected, got)
+		}
+	}
+}
+
+func TestResolvePlatform(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestResolvePlatform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	platforms := []ispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	var manifests []ispec.Descriptor
+	for _, platform := range platforms {
+		// Make each manifest unique.
+		manifest := ispec.Manifest{
+			Versioned:   ispecs.Versioned{SchemaVersion: 2},
+			Config:      ispec.Descriptor{MediaType: ispec.MediaTypeImageConfig},
+			Layers:      []ispec.Descriptor{},
+			Annotations: map[string]string{"arch": platform.Architecture},
+		}
+		manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		platform := platform
+		manifests = append(manifests, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+			Platform:  &platform,
+		})
+	}
+
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(ctx, ispec.Index{
+		Versioned: ispecs.Versioned{SchemaVersion: 2},
+		Manifests: manifests,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexPath := DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}}}
+
+	for idx, platform := range platforms {
+		resolved, err := engineExt.ResolvePlatform(ctx, indexPath, platform)
+		if err != nil {
+			t.Errorf("ResolvePlatform(%v): unexpected error: %+v", platform, err)
+			continue
+		}
+		if len(resolved.Walk) != 2 || resolved.Root().Digest != indexDigest {
+			t.Errorf("ResolvePlatform(%v): unexpected path: %v", platform, resolved.Walk)
+			continue
+		}
+		if resolved.Descriptor().Digest != manifests[idx].Digest {
+			t.Errorf("ResolvePlatform(%v): expected manifest %s, got %s", platform, manifests[idx].Digest, resolved.Descriptor().Digest)
+		}
+
+		// A path to a manifest is returned as-is.
+		again, err := engineExt.ResolvePlatform(ctx, resolved, ispec.Platform{OS: "plan9", Architecture: "386"})
+		if err != nil {
+			t.Errorf("ResolvePlatform(manifest): unexpected error: %+v", err)
+		} else if len(again.Walk) != 2 || again.Descriptor().Digest != resolved.Descriptor().Digest {
+			t.Errorf("ResolvePlatform(manifest): path was modified: %v", again.Walk)
+		}
+	}
+
+	if _, err := engineExt.ResolvePlatform(ctx, indexPath, ispec.Platform{OS: "plan9", Architecture: "386"}); err == nil {
+		t.Errorf("ResolvePlatform: expected error for missing platform")
+	}
+
+	// SelectPlatform should pick the same manifest from the resolved paths.
+	var paths []DescriptorPath
+	for _, manifest := range manifests {
+		paths = append(paths, DescriptorPath{Walk: []ispec.Descriptor{indexPath.Root(), manifest}})
+	}
+	selected := SelectPlatform(paths, platforms[1])
+	if len(selected) != 1 || selected[0].Descriptor().Digest != manifests[1].Digest {
+		t.Errorf("SelectPlatform: unexpected result: %v", selected)
+	}
+	if selected := SelectPlatform(paths[:1], platforms[1]); len(selected) != 1 {
+		t.Errorf("SelectPlatform: single path was filtered: %v", selected)
+	}
+}
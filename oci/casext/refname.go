@@ -114,10 +114,32 @@ func (e Engine) ResolveReference(ctx context.Context, refname string) ([]Descrip
 //      removes ambiguity with regards to which root needs to be operated on.
 //      If a user has that information we should provide them a way to use it.
 
+// ErrReferenceExists is returned (wrapped) by AddReference if there is already
+// an entry for the given reference name.
+var ErrReferenceExists = errors.New("reference already exists")
+
 // UpdateReference replaces an existing entry for refname with the given
-// descriptor. If there are multiple descriptors that match the refname they
-// are all replaced with the given descriptor.
+// descriptor (or adds a new entry, if refname does not exist). If there are
+// multiple descriptors that match the refname they are all replaced with the
+// given descriptor. The replacement is done with a single PutIndex, so (with
+// engines where PutIndex is atomic) there is no point at which refname does
+// not exist -- callers should use this rather than DeleteReference followed by
+// AddReference.
 func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor ispec.Descriptor) error {
+	return e.putReference(ctx, refname, descriptor, true)
+}
+
+// AddReference adds a new entry for refname with the given descriptor. Unlike
+// UpdateReference, existing entries are never replaced -- if there is already
+// an entry for refname then ErrReferenceExists is returned and the index is
+// not modified.
+func (e Engine) AddReference(ctx context.Context, refname string, descriptor ispec.Descriptor) error {
+	return e.putReference(ctx, refname, descriptor, false)
+}
+
+// putReference implements UpdateReference and AddReference. If overwrite is
+// not set, an error is returned if refname already exists.
+func (e Engine) putReference(ctx context.Context, refname string, descriptor ispec.Descriptor, overwrite bool) error {
 	// XXX: It should be possible to override this somehow, in case we are
 	//      dealing with an image that abuses the image specification in some
 	//      way.
@@ -138,7 +160,10 @@ func (e Engine) UpdateReference(ctx context.Context, refname string, descriptor
 			newIndex = append(newIndex, descriptor)
 		}
 	}
-	if len(newIndex)-len(index.Manifests) > 1 {
+	if !overwrite && len(newIndex) != len(index.Manifests) {
+		return errors.Wrapf(ErrReferenceExists, "add reference %q", refname)
+	}
+	if len(index.Manifests)-len(newIndex) > 1 {
 		// Warn users if the operation is going to remove more than one references.
 		log.Warn("multiple references match the given reference name -- all of them have been replaced due to this ambiguity")
 	}
@@ -181,7 +206,7 @@ func (e Engine) DeleteReference(ctx context.Context, refname string) error {
 			newIndex = append(newIndex, descriptor)
 		}
 	}
-	if len(newIndex)-len(index.Manifests) > 1 {
+	if len(index.Manifests)-len(newIndex) > 1 {
 		// Warn users if the operation is going to remove more than one references.
 		log.Warn("multiple references match the given reference name -- all of them have been deleted due to this ambiguity")
 	}
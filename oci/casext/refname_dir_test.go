@@ -32,11 +32,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext/mediatype"
 	"github.com/opencontainers/go-digest"
 	ispecs "github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -414,6 +416,150 @@ func TestEngineReference(t *testing.T) {
 	}
 }
 
+func TestEngineAddReference(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineAddReference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	engineExt := NewEngine(engine)
+	defer engine.Close()
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 2 {
+		t.Fatalf("fakeSetupEngine returned too few descriptors: %d", len(descMap))
+	}
+	first, second := descMap[0], descMap[1]
+
+	if err := engineExt.AddReference(ctx, "tag", first.index); err != nil {
+		t.Fatalf("AddReference: unexpected error: %+v", err)
+	}
+
+	// Adding the same reference again must fail, and not modify the index.
+	if err := engineExt.AddReference(ctx, "tag", second.index); errors.Cause(err) != ErrReferenceExists {
+		t.Errorf("AddReference: expected ErrReferenceExists, got: %+v", err)
+	}
+	gotDescriptorPaths, err := engineExt.ResolveReference(ctx, "tag")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(gotDescriptorPaths) != 1 {
+		t.Fatalf("ResolveReference: expected to get %d descriptors, got %d: %+v", 1, len(gotDescriptorPaths), gotDescriptorPaths)
+	}
+	if gotDescriptor := gotDescriptorPaths[0].Descriptor(); !reflect.DeepEqual(first.result, gotDescriptor) {
+		t.Errorf("AddReference: existing reference was modified: expected=%v got=%v", first.result, gotDescriptor)
+	}
+
+	// UpdateReference still replaces it.
+	if err := engineExt.UpdateReference(ctx, "tag", second.index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	gotDescriptorPaths, err = engineExt.ResolveReference(ctx, "tag")
+	if err != nil {
+		t.Fatalf("ResolveReference: unexpected error: %+v", err)
+	}
+	if len(gotDescriptorPaths) != 1 {
+		t.Fatalf("ResolveReference: expected to get %d descriptors, got %d: %+v", 1, len(gotDescriptorPaths), gotDescriptorPaths)
+	}
+	if gotDescriptor := gotDescriptorPaths[0].Descriptor(); !reflect.DeepEqual(second.result, gotDescriptor) {
+		t.Errorf("UpdateReference: got different descriptor: expected=%v got=%v", second.result, gotDescriptor)
+	}
+
+	// Invalid reference names are still rejected.
+	if err := engineExt.AddReference(ctx, "invalid//tag", first.index); err == nil {
+		t.Errorf("AddReference: expected error with invalid reference name")
+	}
+}
+
+// indexRecorder is a cas.Engine which records every index written with
+// PutIndex.
+type indexRecorder struct {
+	cas.Engine
+	indexes []ispec.Index
+}
+
+func (e *indexRecorder) PutIndex(ctx context.Context, index ispec.Index) error {
+	e.indexes = append(e.indexes, index)
+	return e.Engine.PutIndex(ctx, index)
+}
+
+func TestEngineUpdateReferenceAtomic(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestEngineUpdateReferenceAtomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatalf("unexpected error opening image: %+v", err)
+	}
+	defer engine.Close()
+	recorder := &indexRecorder{Engine: engine}
+	engineExt := NewEngine(recorder)
+
+	descMap, err := fakeSetupEngine(t, engineExt)
+	if err != nil {
+		t.Fatalf("unexpected error doing fakeSetupEngine: %+v", err)
+	}
+	if len(descMap) < 2 {
+		t.Fatalf("fakeSetupEngine returned too few descriptors: %d", len(descMap))
+	}
+	first, second := descMap[0], descMap[1]
+
+	if err := engineExt.UpdateReference(ctx, "tag", first.index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	recorder.indexes = nil
+
+	// Replacing the reference must be done with a single index update, which
+	// contains exactly one entry for the reference.
+	if err := engineExt.UpdateReference(ctx, "tag", second.index); err != nil {
+		t.Fatalf("UpdateReference: unexpected error: %+v", err)
+	}
+	if len(recorder.indexes) != 1 {
+		t.Fatalf("UpdateReference: expected a single PutIndex, got %d", len(recorder.indexes))
+	}
+	var found []ispec.Descriptor
+	for _, descriptor := range recorder.indexes[0].Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == "tag" {
+			found = append(found, descriptor)
+		}
+	}
+	if len(found) != 1 || found[0].Digest != second.index.Digest {
+		t.Errorf("UpdateReference: expected only %s to be tagged, got %v", second.index.Digest, found)
+	}
+
+	// No temporary index files should be left behind.
+	if matches, err := filepath.Glob(filepath.Join(image, ".umoci-*", "index-*")); err != nil {
+		t.Fatal(err)
+	} else if len(matches) > 0 {
+		t.Errorf("UpdateReference left temporary index files behind: %v", matches)
+	}
+}
+
 func TestEngineReferenceReadonly(t *testing.T) {
 	ctx := context.Background()
 
@@ -127,6 +127,12 @@ func (ws *walkState) recurse(ctx context.Context, descriptorPath DescriptorPath)
 			log.Infof("skipping walk into unknown media-type %v of blob %v", descriptor.MediaType, descriptor.Digest)
 			return nil
 		}
+		// Foreign layers need not be present in the image, and have no
+		// children to walk into.
+		if IsForeignLayer(descriptor) && isMissingBlob(err) {
+			log.Debugf("skipping walk into missing foreign layer %v", descriptor.Digest)
+			return nil
+		}
 		return err
 	}
 	defer blob.Close()
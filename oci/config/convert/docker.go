@@ -0,0 +1,44 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package convert
+
+import (
+	"encoding/json"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// FromDockerConfig converts a Docker image configuration (as referenced by
+// Docker image manifests and stored in "docker save" archives) into an OCI
+// image configuration. The OCI format was derived from the Docker format, so
+// the shared fields are identical and any Docker-specific fields (such as
+// "container_config" or "docker_version") are dropped.
+func FromDockerConfig(data []byte) (ispec.Image, error) {
+	var image ispec.Image
+	if err := json.Unmarshal(data, &image); err != nil {
+		return ispec.Image{}, errors.Wrap(err, "parse docker config")
+	}
+	if image.OS == "" || image.Architecture == "" {
+		return ispec.Image{}, errors.Errorf("docker config is missing os or architecture")
+	}
+	if image.RootFS.Type != "layers" {
+		return ispec.Image{}, errors.Errorf("docker config has unsupported rootfs type: %q", image.RootFS.Type)
+	}
+	return image, nil
+}
@@ -0,0 +1,362 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package crypt implements the encryption and decryption of image layers, in
+// a manner compatible with the encrypted layers generated by other ocicrypt
+// implementations. Layers are encrypted with a random symmetric key, which is
+// then wrapped for each recipient using JWE (RSA-OAEP with AES-GCM). Other key
+// wrapping protocols (PKCS#7 and OpenPGP) are deliberately not supported, and
+// layers whose keys are only wrapped with them are rejected. The ciphertext
+// of a layer must be authenticated with an HMAC, so layers generated by old
+// implementations which didn't include one cannot be decrypted.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// MediaTypeSuffix is the suffix added to the media type of a layer when it is
+// encrypted.
+const MediaTypeSuffix = "+encrypted"
+
+const (
+	// AnnotationJWEKeys is the layer annotation containing the wrapped
+	// private options of the layer (a base64-encoded JWE).
+	AnnotationJWEKeys = "org.opencontainers.image.enc.keys.jwe"
+
+	// AnnotationPubOpts is the layer annotation containing the public options
+	// of the layer (base64-encoded JSON).
+	AnnotationPubOpts = "org.opencontainers.image.enc.pubopts"
+
+	// annotationPKCS7Keys and annotationPGPKeys are the layer annotations
+	// containing the private options wrapped with PKCS#7 and OpenPGP, which
+	// are not supported.
+	annotationPKCS7Keys = "org.opencontainers.image.enc.keys.pkcs7"
+	annotationPGPKeys   = "org.opencontainers.image.enc.keys.pgp"
+
+	// annotationPrefix is the prefix of all encryption annotations.
+	annotationPrefix = "org.opencontainers.image.enc."
+)
+
+// cipherAES256CTR is the only layer cipher supported. The layer is encrypted
+// with AES-256-CTR, and the ciphertext is authenticated with HMAC-SHA256
+// (using the same key).
+const cipherAES256CTR = "AES_256_CTR_HMAC_SHA256"
+
+// errNoKey is returned if none of the private keys given can decrypt a layer.
+var errNoKey = errors.New("no matching private key found to decrypt layer")
+
+// IsEncrypted returns whether the given media type is that of an encrypted
+// layer.
+func IsEncrypted(mediaType string) bool {
+	return strings.HasSuffix(mediaType, MediaTypeSuffix)
+}
+
+// EncryptedMediaType returns the media type of mediaType once encrypted.
+func EncryptedMediaType(mediaType string) string {
+	return mediaType + MediaTypeSuffix
+}
+
+// DecryptedMediaType returns the media type of the encrypted media type once
+// decrypted.
+func DecryptedMediaType(mediaType string) string {
+	return strings.TrimSuffix(mediaType, MediaTypeSuffix)
+}
+
+// StripAnnotations returns a copy of annotations without any encryption
+// annotations, or nil if no annotations remain.
+func StripAnnotations(annotations map[string]string) map[string]string {
+	var stripped map[string]string
+	for k, v := range annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			continue
+		}
+		if stripped == nil {
+			stripped = map[string]string{}
+		}
+		stripped[k] = v
+	}
+	return stripped
+}
+
+// publicOptions are the options of an encrypted layer stored (unencrypted)
+// in the AnnotationPubOpts annotation.
+type publicOptions struct {
+	Cipher        string            `json:"cipher"`
+	HMAC          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// privateOptions are the options of an encrypted layer which are wrapped for
+// each recipient and stored in the AnnotationJWEKeys annotation.
+type privateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        digest.Digest     `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// newLayerCipher returns the AES-256-CTR stream and HMAC-SHA256 used to
+// encrypt (or decrypt) a layer with the given key and nonce.
+func newLayerCipher(key, nonce []byte) (cipher.Stream, hash.Hash, error) {
+	if len(key) != 32 {
+		return nil, nil, errors.Errorf("invalid %s key size: %d", cipherAES256CTR, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create layer cipher")
+	}
+	if len(nonce) != block.BlockSize() {
+		return nil, nil, errors.Errorf("invalid %s nonce size: %d", cipherAES256CTR, len(nonce))
+	}
+	return cipher.NewCTR(block, nonce), hmac.New(sha256.New, key), nil
+}
+
+// LayerEncrypter encrypts a layer blob as it is read. Once it has been read
+// to EOF, Annotations returns the annotations which must be set on the
+// descriptor of the encrypted blob.
+type LayerEncrypter struct {
+	r          io.Reader
+	recipients []*rsa.PublicKey
+	stream     cipher.Stream
+	mac        hash.Hash
+	digester   digest.Digester
+	key, nonce []byte
+	eof        bool
+}
+
+// EncryptLayer returns a LayerEncrypter which encrypts the layer blob read
+// from r for the given recipients. The digest of the blob is computed using
+// algorithm.
+func EncryptLayer(r io.Reader, algorithm digest.Algorithm, recipients []*rsa.PublicKey) (*LayerEncrypter, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "generate layer key")
+	}
+	nonce := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "generate layer nonce")
+	}
+	stream, mac, err := newLayerCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &LayerEncrypter{
+		r:          r,
+		recipients: recipients,
+		stream:     stream,
+		mac:        mac,
+		digester:   algorithm.Digester(),
+		key:        key,
+		nonce:      nonce,
+	}, nil
+}
+
+// Read reads encrypted data.
+func (e *LayerEncrypter) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if n > 0 {
+		// #nosec G104
+		_, _ = e.digester.Hash().Write(p[:n])
+		e.stream.XORKeyStream(p[:n], p[:n])
+		// #nosec G104
+		_, _ = e.mac.Write(p[:n])
+	}
+	if err == io.EOF {
+		e.eof = true
+	}
+	return n, err
+}
+
+// Annotations returns the encryption annotations of the encrypted layer. It
+// is an error to call Annotations before the layer has been read to EOF.
+func (e *LayerEncrypter) Annotations() (map[string]string, error) {
+	if !e.eof {
+		return nil, errors.New("[internal error] layer annotations requested before layer was encrypted")
+	}
+
+	pubOpts, err := json.Marshal(publicOptions{
+		Cipher:        cipherAES256CTR,
+		HMAC:          e.mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal public options")
+	}
+	privOpts, err := json.Marshal(privateOptions{
+		SymmetricKey:  e.key,
+		Digest:        e.digester.Digest(),
+		CipherOptions: map[string][]byte{"nonce": e.nonce},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal private options")
+	}
+	jwe, err := jweEncrypt(privOpts, e.recipients)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrap layer key")
+	}
+	return map[string]string{
+		AnnotationJWEKeys: base64.StdEncoding.EncodeToString(jwe),
+		AnnotationPubOpts: base64.StdEncoding.EncodeToString(pubOpts),
+	}, nil
+}
+
+// unwrapOptions returns the private options of the encrypted layer described
+// by desc, using the first private key which is one of the recipients of the
+// layer.
+func unwrapOptions(desc ispec.Descriptor, keys []*rsa.PrivateKey) (privateOptions, error) {
+	var privOpts privateOptions
+
+	wrapped, ok := desc.Annotations[AnnotationJWEKeys]
+	if !ok {
+		for _, annotation := range []string{annotationPKCS7Keys, annotationPGPKeys} {
+			if _, ok := desc.Annotations[annotation]; ok {
+				return privOpts, errors.Errorf("layer %s keys are only wrapped with an unsupported protocol (%s): only jwe is supported", desc.Digest, annotation)
+			}
+		}
+		return privOpts, errors.Errorf("layer %s is missing %s annotation (only jwe is supported)", desc.Digest, AnnotationJWEKeys)
+	}
+	// Some implementations join several wrapped keys with commas.
+	for _, b64jwe := range strings.Split(wrapped, ",") {
+		jwe, err := base64.StdEncoding.DecodeString(b64jwe)
+		if err != nil {
+			return privOpts, errors.Wrapf(err, "decode %s annotation", AnnotationJWEKeys)
+		}
+		data, err := jweDecrypt(jwe, keys)
+		if err == errNoKey {
+			continue
+		} else if err != nil {
+			return privOpts, errors.Wrap(err, "unwrap layer key")
+		}
+		if err := json.Unmarshal(data, &privOpts); err != nil {
+			return privOpts, errors.Wrap(err, "parse private options")
+		}
+		return privOpts, nil
+	}
+	return privOpts, errors.Wrapf(errNoKey, "layer %s", desc.Digest)
+}
+
+// layerDecrypter decrypts an encrypted layer blob as it is read.
+type layerDecrypter struct {
+	rc       io.ReadCloser
+	stream   cipher.Stream
+	mac      hash.Hash
+	wantMAC  []byte
+	digester digest.Digester
+	digest   digest.Digest
+	err      error
+}
+
+// DecryptLayer returns a reader which decrypts the encrypted layer blob
+// described by desc and read from rc, using the first of the private keys
+// which is one of the recipients of the layer. The ciphertext is
+// authenticated, and the digest of the decrypted blob verified, once it has
+// been read to EOF -- any mismatch is returned instead of io.EOF. Since the
+// public options are not themselves authenticated, a layer without an HMAC is
+// rejected rather than being decrypted unauthenticated. Closing the reader
+// closes rc.
+func DecryptLayer(rc io.ReadCloser, desc ispec.Descriptor, keys []*rsa.PrivateKey) (io.ReadCloser, error) {
+	if !IsEncrypted(desc.MediaType) {
+		return nil, errors.Errorf("layer %s is not encrypted: %s", desc.Digest, desc.MediaType)
+	}
+
+	// Older implementations didn't store any public options, and thus had no
+	// HMAC to authenticate the ciphertext with.
+	b64opts, ok := desc.Annotations[AnnotationPubOpts]
+	if !ok {
+		return nil, errors.Errorf("layer %s is missing %s annotation: unauthenticated layers are not supported", desc.Digest, AnnotationPubOpts)
+	}
+	data, err := base64.StdEncoding.DecodeString(b64opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %s annotation", AnnotationPubOpts)
+	}
+	var pubOpts publicOptions
+	if err := json.Unmarshal(data, &pubOpts); err != nil {
+		return nil, errors.Wrap(err, "parse public options")
+	}
+	if pubOpts.Cipher != cipherAES256CTR {
+		return nil, errors.Errorf("unsupported layer cipher: %q", pubOpts.Cipher)
+	}
+	if len(pubOpts.HMAC) == 0 {
+		return nil, errors.Errorf("layer %s has no hmac: unauthenticated layers are not supported", desc.Digest)
+	}
+
+	privOpts, err := unwrapOptions(desc, keys)
+	if err != nil {
+		return nil, err
+	}
+	if err := privOpts.Digest.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid layer digest in private options")
+	}
+	stream, mac, err := newLayerCipher(privOpts.SymmetricKey, privOpts.CipherOptions["nonce"])
+	if err != nil {
+		return nil, err
+	}
+	return &layerDecrypter{
+		rc:       rc,
+		stream:   stream,
+		mac:      mac,
+		wantMAC:  pubOpts.HMAC,
+		digester: privOpts.Digest.Algorithm().Digester(),
+		digest:   privOpts.Digest,
+	}, nil
+}
+
+// Read reads decrypted data.
+func (d *layerDecrypter) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.rc.Read(p)
+	if n > 0 {
+		// #nosec G104
+		_, _ = d.mac.Write(p[:n])
+		d.stream.XORKeyStream(p[:n], p[:n])
+		// #nosec G104
+		_, _ = d.digester.Hash().Write(p[:n])
+	}
+	if err == io.EOF {
+		if !hmac.Equal(d.mac.Sum(nil), d.wantMAC) {
+			err = errors.New("decrypt layer: hmac mismatch")
+		} else if got := d.digester.Digest(); got != d.digest {
+			err = errors.Errorf("decrypt layer: digest mismatch: expected %s got %s", d.digest, got)
+		}
+	}
+	d.err = err
+	return n, err
+}
+
+// Close closes the underlying reader.
+func (d *layerDecrypter) Close() error {
+	return d.rc.Close()
+}
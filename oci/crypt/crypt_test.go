@@ -0,0 +1,279 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+func genKey(t *testing.T) *rsa.PrivateKey {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %+v", err)
+	}
+	return priv
+}
+
+// encryptTestLayer encrypts data for the given recipients, returning the
+// ciphertext and the descriptor of the encrypted blob.
+func encryptTestLayer(t *testing.T, data []byte, recipients ...*rsa.PublicKey) ([]byte, ispec.Descriptor) {
+	enc, err := EncryptLayer(bytes.NewReader(data), digest.SHA256, recipients)
+	if err != nil {
+		t.Fatalf("EncryptLayer: %+v", err)
+	}
+	if _, err := enc.Annotations(); err == nil {
+		t.Errorf("expected Annotations to fail before EOF")
+	}
+	ciphertext, err := ioutil.ReadAll(enc)
+	if err != nil {
+		t.Fatalf("read encrypted layer: %+v", err)
+	}
+	annotations, err := enc.Annotations()
+	if err != nil {
+		t.Fatalf("Annotations: %+v", err)
+	}
+	return ciphertext, ispec.Descriptor{
+		MediaType:   EncryptedMediaType(ispec.MediaTypeImageLayerGzip),
+		Digest:      digest.FromBytes(ciphertext),
+		Size:        int64(len(ciphertext)),
+		Annotations: annotations,
+	}
+}
+
+func TestEncryptDecryptLayer(t *testing.T) {
+	alice, bob, eve := genKey(t), genKey(t), genKey(t)
+
+	data := make([]byte, 3*4096+17)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, desc := encryptTestLayer(t, data, &alice.PublicKey, &bob.PublicKey)
+	if bytes.Equal(ciphertext, data) {
+		t.Fatalf("encrypted layer is the same as the plaintext")
+	}
+	if len(ciphertext) != len(data) {
+		t.Errorf("encrypted layer has unexpected size: expected %d got %d", len(data), len(ciphertext))
+	}
+
+	for _, keys := range [][]*rsa.PrivateKey{
+		{alice},
+		{bob},
+		{eve, bob},
+	} {
+		rc, err := DecryptLayer(ioutil.NopCloser(bytes.NewReader(ciphertext)), desc, keys)
+		if err != nil {
+			t.Fatalf("DecryptLayer: %+v", err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("read decrypted layer: %+v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("decrypted layer doesn't match original")
+		}
+		if err := rc.Close(); err != nil {
+			t.Errorf("close decrypted layer: %+v", err)
+		}
+	}
+
+	if _, err := DecryptLayer(ioutil.NopCloser(bytes.NewReader(ciphertext)), desc, []*rsa.PrivateKey{eve}); errors.Cause(err) != errNoKey {
+		t.Errorf("expected errNoKey decrypting without a recipient key, got %v", err)
+	}
+	if _, err := DecryptLayer(ioutil.NopCloser(bytes.NewReader(ciphertext)), desc, nil); errors.Cause(err) != errNoKey {
+		t.Errorf("expected errNoKey decrypting without keys, got %v", err)
+	}
+
+	notEncrypted := desc
+	notEncrypted.MediaType = DecryptedMediaType(desc.MediaType)
+	if _, err := DecryptLayer(ioutil.NopCloser(bytes.NewReader(ciphertext)), notEncrypted, []*rsa.PrivateKey{alice}); err == nil {
+		t.Errorf("expected error decrypting an unencrypted layer")
+	}
+}
+
+func TestDecryptLayerTampered(t *testing.T) {
+	alice := genKey(t)
+	data := []byte("some layer data which will be tampered with")
+	ciphertext, desc := encryptTestLayer(t, data, &alice.PublicKey)
+
+	// Flipping a bit of the ciphertext must be caught by the hmac.
+	tampered := append([]byte{}, ciphertext...)
+	tampered[3] ^= 0x01
+	rc, err := DecryptLayer(ioutil.NopCloser(bytes.NewReader(tampered)), desc, []*rsa.PrivateKey{alice})
+	if err != nil {
+		t.Fatalf("DecryptLayer: %+v", err)
+	}
+	if _, err := ioutil.ReadAll(rc); err == nil {
+		t.Errorf("expected error reading tampered layer")
+	}
+
+	// Truncation must also be caught.
+	rc, err = DecryptLayer(ioutil.NopCloser(bytes.NewReader(ciphertext[:10])), desc, []*rsa.PrivateKey{alice})
+	if err != nil {
+		t.Fatalf("DecryptLayer: %+v", err)
+	}
+	if _, err := ioutil.ReadAll(rc); err == nil {
+		t.Errorf("expected error reading truncated layer")
+	}
+}
+
+func TestDecryptLayerUnauthenticated(t *testing.T) {
+	alice := genKey(t)
+	data := []byte("some layer data which must be authenticated")
+	ciphertext, desc := encryptTestLayer(t, data, &alice.PublicKey)
+
+	withAnnotations := func(edit func(map[string]string)) ispec.Descriptor {
+		modified := desc
+		modified.Annotations = map[string]string{}
+		for k, v := range desc.Annotations {
+			modified.Annotations[k] = v
+		}
+		edit(modified.Annotations)
+		return modified
+	}
+	noHMAC, err := json.Marshal(publicOptions{Cipher: cipherAES256CTR})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, desc := range map[string]ispec.Descriptor{
+		// The public options aren't authenticated, so stripping the hmac
+		// must not disable the check.
+		"MissingPubOpts": withAnnotations(func(a map[string]string) {
+			delete(a, AnnotationPubOpts)
+		}),
+		"EmptyHMAC": withAnnotations(func(a map[string]string) {
+			a[AnnotationPubOpts] = base64.StdEncoding.EncodeToString(noHMAC)
+		}),
+		// PKCS#7 is not supported, even if we have the key.
+		"PKCS7": withAnnotations(func(a map[string]string) {
+			a[annotationPKCS7Keys] = a[AnnotationJWEKeys]
+			delete(a, AnnotationJWEKeys)
+		}),
+	} {
+		if _, err := DecryptLayer(ioutil.NopCloser(bytes.NewReader(ciphertext)), desc, []*rsa.PrivateKey{alice}); err == nil {
+			t.Errorf("%s: expected error decrypting layer", name)
+		}
+	}
+}
+
+func TestJWEFlattened(t *testing.T) {
+	alice := genKey(t)
+	plaintext := []byte(`{"symkey":"dGVzdA=="}`)
+
+	data, err := jweEncrypt(plaintext, []*rsa.PublicKey{&alice.PublicKey})
+	if err != nil {
+		t.Fatalf("jweEncrypt: %+v", err)
+	}
+	var msg jweMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Recipients) != 1 {
+		t.Fatalf("expected 1 recipient, got %d", len(msg.Recipients))
+	}
+
+	// Convert to the flattened serialisation, using RSA-OAEP-256 for the key.
+	cek, err := rsa.DecryptOAEP(sha1.New(), nil, alice, mustDecode(t, msg.Recipients[0].EncryptedKey), nil)
+	if err != nil {
+		t.Fatalf("unwrap cek: %+v", err)
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &alice.PublicKey, cek, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Header = map[string]interface{}{"alg": jweAlgRSAOAEP256}
+	msg.EncryptedKey = b64.EncodeToString(encryptedKey)
+	msg.Recipients = nil
+	flattened, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := jweDecrypt(flattened, []*rsa.PrivateKey{alice})
+	if err != nil {
+		t.Fatalf("jweDecrypt: %+v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("decrypted jwe doesn't match: expected %q got %q", plaintext, got)
+	}
+
+	// Changing the protected header must break authentication.
+	msg.Protected = b64.EncodeToString([]byte(`{"enc":"A256GCM","x":1}`))
+	modified, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jweDecrypt(modified, []*rsa.PrivateKey{alice}); err == nil {
+		t.Errorf("expected error decrypting jwe with modified protected header")
+	}
+}
+
+func mustDecode(t *testing.T, s string) []byte {
+	data, err := b64.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStripAnnotations(t *testing.T) {
+	for _, test := range []struct {
+		annotations, expected map[string]string
+	}{
+		{nil, nil},
+		{map[string]string{AnnotationJWEKeys: "a", AnnotationPubOpts: "b"}, nil},
+		{map[string]string{AnnotationJWEKeys: "a", "foo": "bar"}, map[string]string{"foo": "bar"}},
+	} {
+		got := StripAnnotations(test.annotations)
+		if len(got) != len(test.expected) || (got == nil) != (test.expected == nil) {
+			t.Errorf("StripAnnotations(%v): expected %v got %v", test.annotations, test.expected, got)
+			continue
+		}
+		for k, v := range test.expected {
+			if got[k] != v {
+				t.Errorf("StripAnnotations(%v): expected %v got %v", test.annotations, test.expected, got)
+			}
+		}
+	}
+}
+
+func TestMediaTypes(t *testing.T) {
+	mt := EncryptedMediaType(ispec.MediaTypeImageLayerGzip)
+	if mt != "application/vnd.oci.image.layer.v1.tar+gzip+encrypted" {
+		t.Errorf("unexpected encrypted media type: %s", mt)
+	}
+	if !IsEncrypted(mt) || IsEncrypted(ispec.MediaTypeImageLayerGzip) {
+		t.Errorf("IsEncrypted returned the wrong result")
+	}
+	if got := DecryptedMediaType(mt); got != ispec.MediaTypeImageLayerGzip {
+		t.Errorf("unexpected decrypted media type: %s", got)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// This is a minimal implementation of JSON Web Encryption (RFC 7516), which
+// only supports what is needed to wrap the private options of encrypted
+// layers: RSA-OAEP (or RSA-OAEP-256) key encryption, and AES-GCM content
+// encryption. Messages are generated using the general JSON serialisation
+// with one recipient per public key, and both the general and flattened JSON
+// serialisations are accepted when decrypting.
+
+const (
+	jweAlgRSAOAEP    = "RSA-OAEP"
+	jweAlgRSAOAEP256 = "RSA-OAEP-256"
+	jweEncA256GCM    = "A256GCM"
+)
+
+// jweRecipient is a recipient of a JWE in the general JSON serialisation.
+type jweRecipient struct {
+	Header       map[string]interface{} `json:"header,omitempty"`
+	EncryptedKey string                 `json:"encrypted_key,omitempty"`
+}
+
+// jweMessage is a JWE in the general (or flattened) JSON serialisation.
+type jweMessage struct {
+	Protected   string                 `json:"protected,omitempty"`
+	Unprotected map[string]interface{} `json:"unprotected,omitempty"`
+	Recipients  []jweRecipient         `json:"recipients,omitempty"`
+	AAD         string                 `json:"aad,omitempty"`
+	IV          string                 `json:"iv"`
+	Ciphertext  string                 `json:"ciphertext"`
+	Tag         string                 `json:"tag"`
+
+	// Only used by the flattened JSON serialisation.
+	Header       map[string]interface{} `json:"header,omitempty"`
+	EncryptedKey string                 `json:"encrypted_key,omitempty"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// jweKeySize returns the key size of the given content encryption algorithm.
+func jweKeySize(enc string) (int, error) {
+	switch enc {
+	case "A128GCM":
+		return 16, nil
+	case "A192GCM":
+		return 24, nil
+	case jweEncA256GCM:
+		return 32, nil
+	}
+	return 0, errors.Errorf("unsupported jwe content encryption algorithm: %q", enc)
+}
+
+// jweOAEPHash returns the hash used by the given key encryption algorithm.
+func jweOAEPHash(alg string) (hash.Hash, error) {
+	switch alg {
+	case jweAlgRSAOAEP:
+		// #nosec G401
+		return sha1.New(), nil
+	case jweAlgRSAOAEP256:
+		return sha256.New(), nil
+	}
+	return nil, errors.Errorf("unsupported jwe key encryption algorithm: %q", alg)
+}
+
+// jweAAD returns the additional authenticated data of the message.
+func (msg jweMessage) jweAAD() []byte {
+	aad := msg.Protected
+	if msg.AAD != "" {
+		aad += "." + msg.AAD
+	}
+	return []byte(aad)
+}
+
+// jweEncrypt encrypts plaintext such that it can be decrypted by the holder of
+// the private key of any of the given recipients.
+func jweEncrypt(plaintext []byte, recipients []*rsa.PublicKey) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+
+	protected, err := json.Marshal(map[string]string{"enc": jweEncA256GCM})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal protected header")
+	}
+	msg := jweMessage{
+		Protected: b64.EncodeToString(protected),
+	}
+
+	cek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, cek); err != nil {
+		return nil, errors.Wrap(err, "generate content encryption key")
+	}
+	for _, pub := range recipients {
+		// #nosec G401
+		encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, cek, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "encrypt content encryption key")
+		}
+		msg.Recipients = append(msg.Recipients, jweRecipient{
+			Header:       map[string]interface{}{"alg": jweAlgRSAOAEP},
+			EncryptedKey: b64.EncodeToString(encryptedKey),
+		})
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, errors.Wrap(err, "create content cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "create content cipher")
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, errors.Wrap(err, "generate iv")
+	}
+	sealed := aead.Seal(nil, iv, plaintext, msg.jweAAD())
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	msg.IV = b64.EncodeToString(iv)
+	msg.Ciphertext = b64.EncodeToString(ciphertext)
+	msg.Tag = b64.EncodeToString(tag)
+	return json.Marshal(msg)
+}
+
+// jweDecrypt decrypts the given JWE using the first of the private keys which
+// is one of its recipients. errNoKey is returned if none of them are.
+func jweDecrypt(data []byte, keys []*rsa.PrivateKey) ([]byte, error) {
+	var msg jweMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, errors.Wrap(err, "parse jwe")
+	}
+	recipients := msg.Recipients
+	if len(recipients) == 0 {
+		recipients = []jweRecipient{{Header: msg.Header, EncryptedKey: msg.EncryptedKey}}
+	}
+
+	// The protected, unprotected and per-recipient headers are combined to
+	// get the full header (they must not have overlapping members).
+	shared := map[string]interface{}{}
+	if msg.Protected != "" {
+		protected, err := b64.DecodeString(msg.Protected)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode protected header")
+		}
+		if err := json.Unmarshal(protected, &shared); err != nil {
+			return nil, errors.Wrap(err, "parse protected header")
+		}
+	}
+	for k, v := range msg.Unprotected {
+		shared[k] = v
+	}
+
+	iv, err := b64.DecodeString(msg.IV)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode iv")
+	}
+	ciphertext, err := b64.DecodeString(msg.Ciphertext)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode ciphertext")
+	}
+	tag, err := b64.DecodeString(msg.Tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode tag")
+	}
+
+	for _, recipient := range recipients {
+		header := map[string]interface{}{}
+		for k, v := range shared {
+			header[k] = v
+		}
+		for k, v := range recipient.Header {
+			header[k] = v
+		}
+		alg, _ := header["alg"].(string)
+		enc, _ := header["enc"].(string)
+
+		oaepHash, err := jweOAEPHash(alg)
+		if err != nil {
+			return nil, err
+		}
+		keySize, err := jweKeySize(enc)
+		if err != nil {
+			return nil, err
+		}
+		encryptedKey, err := b64.DecodeString(recipient.EncryptedKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode encrypted key")
+		}
+
+		for _, priv := range keys {
+			cek, err := rsa.DecryptOAEP(oaepHash, nil, priv, encryptedKey, nil)
+			if err != nil {
+				// This key isn't the one for this recipient.
+				continue
+			}
+			if len(cek) != keySize {
+				return nil, errors.Errorf("content encryption key has the wrong size for %s", enc)
+			}
+			block, err := aes.NewCipher(cek)
+			if err != nil {
+				return nil, errors.Wrap(err, "create content cipher")
+			}
+			aead, err := cipher.NewGCMWithNonceSize(block, len(iv))
+			if err != nil {
+				return nil, errors.Wrap(err, "create content cipher")
+			}
+			plaintext, err := aead.Open(nil, iv, append(ciphertext, tag...), msg.jweAAD())
+			if err != nil {
+				return nil, errors.Wrap(err, "decrypt jwe")
+			}
+			return plaintext, nil
+		}
+	}
+	return nil, errNoKey
+}
@@ -0,0 +1,124 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypt
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parsePEM returns the DER contents of the first PEM block in data, or data
+// itself if it isn't PEM-encoded.
+func parsePEM(data []byte) (string, []byte) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", data
+	}
+	return block.Type, block.Bytes
+}
+
+// ParsePublicKey parses an RSA public key, which may either be a bare key (in
+// PKIX or PKCS#1 form) or an X.509 certificate. Both PEM and DER encodings
+// are accepted.
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	typ, der := parsePEM(data)
+
+	var key interface{}
+	if typ == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse certificate")
+		}
+		key = cert.PublicKey
+	} else if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		key = pub
+	} else if pub, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		key = pub
+	} else if cert, err := x509.ParseCertificate(der); err == nil {
+		key = cert.PublicKey
+	} else {
+		return nil, errors.New("unrecognised public key format")
+	}
+
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("unsupported public key type %T: only RSA keys are supported", key)
+	}
+	return pub, nil
+}
+
+// ParsePrivateKey parses an unencrypted RSA private key (in PKCS#1 or PKCS#8
+// form). Both PEM and DER encodings are accepted.
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	typ, der := parsePEM(data)
+	if strings.Contains(typ, "ENCRYPTED") {
+		return nil, errors.New("password-protected private keys are not supported")
+	}
+
+	var key interface{}
+	if priv, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		key = priv
+	} else if priv, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		key = priv
+	} else {
+		return nil, errors.New("unrecognised private key format")
+	}
+
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key type %T: only RSA keys are supported", key)
+	}
+	return priv, nil
+}
+
+// recipientPrefix is the protocol prefix of recipients, as used by other
+// ocicrypt implementations. JWE is the only protocol supported.
+const recipientPrefix = "jwe:"
+
+// LoadRecipient loads the public key of a recipient from the file at path.
+// The path may have a "jwe:" prefix (other protocols, such as "pkcs7:" and
+// "pgp:", are not supported).
+func LoadRecipient(path string) (*rsa.PublicKey, error) {
+	if idx := strings.Index(path, ":"); idx > 0 && !strings.ContainsRune(path[:idx], '/') {
+		if protocol := path[:idx+1]; protocol != recipientPrefix {
+			return nil, errors.Errorf("unsupported recipient protocol %q: only %q is supported", protocol, recipientPrefix)
+		}
+		path = path[idx+1:]
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read public key")
+	}
+	pub, err := ParsePublicKey(data)
+	return pub, errors.Wrapf(err, "parse public key %s", path)
+}
+
+// LoadPrivateKey loads the private key from the file at path.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read private key")
+	}
+	priv, err := ParsePrivateKey(data)
+	return priv, errors.Wrapf(err, "parse private key %s", path)
+}
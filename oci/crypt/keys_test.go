@@ -0,0 +1,154 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package crypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParsePublicKey(t *testing.T) {
+	priv := genKey(t)
+
+	pkixDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "umoci test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"pkix-pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkixDER})},
+		{"pkix-der", pkixDER},
+		{"pkcs1-pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&priv.PublicKey)})},
+		{"cert-pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})},
+		{"cert-der", cert},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pub, err := ParsePublicKey(test.data)
+			if err != nil {
+				t.Fatalf("ParsePublicKey: %+v", err)
+			}
+			if !pub.Equal(&priv.PublicKey) {
+				t.Errorf("parsed public key doesn't match")
+			}
+		})
+	}
+
+	if _, err := ParsePublicKey([]byte("garbage")); err == nil {
+		t.Errorf("expected error parsing garbage public key")
+	}
+
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub, err := x509.MarshalPKIXPublicKey(&ecPriv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePublicKey(ecPub); err == nil {
+		t.Errorf("expected error parsing ecdsa public key")
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	priv := genKey(t)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"pkcs1-pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})},
+		{"pkcs1-der", x509.MarshalPKCS1PrivateKey(priv)},
+		{"pkcs8-pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParsePrivateKey(test.data)
+			if err != nil {
+				t.Fatalf("ParsePrivateKey: %+v", err)
+			}
+			if !got.Equal(priv) {
+				t.Errorf("parsed private key doesn't match")
+			}
+		})
+	}
+
+	if _, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: pkcs8})); err == nil {
+		t.Errorf("expected error parsing encrypted private key")
+	}
+}
+
+func TestLoadRecipient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLoadRecipient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	priv := genKey(t)
+	pkixDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkixDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recipient := range []string{path, "jwe:" + path} {
+		pub, err := LoadRecipient(recipient)
+		if err != nil {
+			t.Errorf("LoadRecipient(%q): %+v", recipient, err)
+			continue
+		}
+		if !pub.Equal(&priv.PublicKey) {
+			t.Errorf("LoadRecipient(%q): public key doesn't match", recipient)
+		}
+	}
+	for _, recipient := range []string{"pkcs7:" + path, "pgp:user@example.com", filepath.Join(dir, "missing.pem")} {
+		if _, err := LoadRecipient(recipient); err == nil {
+			t.Errorf("LoadRecipient(%q): expected error", recipient)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package distribution implements a client for the OCI distribution
+// specification, which allows for images to be pulled from (and pushed to) a
+// container registry, reading and writing the blobs directly from a cas.Engine.
+package distribution
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext/mediatype"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// maxManifestSize is the largest manifest (or index) which will be fetched
+// from a registry. The distribution specification requires registries to
+// accept manifests of at least this size.
+const maxManifestSize = 4 << 20
+
+// maxUploadRetries is the number of times an interrupted blob upload is
+// resumed before giving up.
+const maxUploadRetries = 3
+
+// manifestMediaTypes are the media types which are stored in the manifest
+// (rather than the blob) endpoints of a registry.
+var manifestMediaTypes = []string{
+	ispec.MediaTypeImageIndex,
+	ispec.MediaTypeImageManifest,
+	mediatype.DockerManifest,
+}
+
+// isManifestType returns whether the given media type is one of
+// manifestMediaTypes.
+func isManifestType(mediaType string) bool {
+	for _, mt := range manifestMediaTypes {
+		if mediaType == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// Options are the options used when talking to a registry.
+type Options struct {
+	// Client is the HTTP client used to make requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+
+	// PlainHTTP makes requests use HTTP rather than HTTPS. This should only
+	// be used for local registries (such as in tests).
+	PlainHTTP bool
+
+	// Credentials returns the username and password used to authenticate
+	// with the registry at host. If nil (or if it returns an empty username
+	// and password), requests are made anonymously.
+	Credentials func(host string) (string, string, error)
+
+	// ChunkSize is the maximum size of each request when uploading a blob.
+	// If zero, each blob is uploaded with a single request. Smaller chunks
+	// mean that less data needs to be resent if an upload is interrupted.
+	ChunkSize int64
+}
+
+// Client is a client for a single repository in a registry.
+type Client struct {
+	ref    Reference
+	opt    Options
+	client *http.Client
+
+	// authorization is the value of the Authorization header used for
+	// requests, once the registry has asked for authentication.
+	authorization string
+}
+
+// NewClient creates a new client for the repository of the given reference.
+func NewClient(ref Reference, opt Options) *Client {
+	client := opt.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{
+		ref:    ref,
+		opt:    opt,
+		client: client,
+	}
+}
+
+// Reference returns the reference the client was created with.
+func (c *Client) Reference() Reference {
+	return c.ref
+}
+
+// url returns the URL of the given path within the repository's API.
+func (c *Client) url(format string, args ...interface{}) string {
+	scheme := "https"
+	if c.opt.PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/", scheme, c.ref.Registry, c.ref.Repository) + fmt.Sprintf(format, args...)
+}
+
+// do sends the request returned by newRequest. If the registry asks for
+// authentication, the client authenticates (using the challenge in the
+// response) and sends a new request from newRequest.
+func (c *Client) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, errors.Wrap(err, "create request")
+		}
+		req = req.WithContext(ctx)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+
+		log.WithFields(log.Fields{
+			"method": req.Method,
+			"url":    req.URL.String(),
+		}).Debugf("distribution: sending request")
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		// #nosec G104
+		_ = resp.Body.Close()
+		if err := c.authenticate(ctx, challenge); err != nil {
+			return nil, errors.Wrap(err, "authenticate")
+		}
+	}
+}
+
+// credentials returns the credentials for the registry, if any.
+func (c *Client) credentials() (string, string, error) {
+	if c.opt.Credentials == nil {
+		return "", "", nil
+	}
+	return c.opt.Credentials(c.ref.Registry)
+}
+
+// authenticate sets the authorization used by the client, based on the given
+// WWW-Authenticate challenge. Both the "Basic" scheme, and the "Bearer"
+// scheme (where a token is fetched from the given realm) are supported.
+func (c *Client) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	username, password, err := c.credentials()
+	if err != nil {
+		return errors.Wrap(err, "get credentials")
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" && password == "" {
+			return errors.Errorf("registry requires credentials")
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		return nil
+	case "bearer":
+		return c.fetchToken(ctx, params, username, password)
+	default:
+		return errors.Errorf("unsupported authentication challenge: %q", challenge)
+	}
+}
+
+// fetchToken fetches a bearer token from the realm of a "Bearer" challenge,
+// and sets it as the authorization used by the client.
+func (c *Client) fetchToken(ctx context.Context, params map[string]string, username, password string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return errors.Errorf("invalid bearer challenge realm: %q", params["realm"])
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", c.ref.Repository)
+	}
+	for _, s := range strings.Split(scope, " ") {
+		query.Add("scope", s)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "create token request")
+	}
+	req = req.WithContext(ctx)
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fetch token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("fetch token", resp)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token); err != nil {
+		return errors.Wrap(err, "decode token")
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errors.Errorf("token response did not include a token")
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate challenge of the form
+// `scheme key="value",key=value`, returning the scheme and parameters.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	challenge = strings.TrimSpace(challenge)
+	idx := strings.IndexAny(challenge, " \t")
+	if idx == -1 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:idx], challenge[idx+1:]
+
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var buf strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				buf.WriteByte(rest[i])
+			}
+			value = buf.String()
+			if i < len(rest) {
+				i++
+			}
+			rest = rest[i:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// responseError returns an error describing an unexpected response from the
+// registry, including any errors in the body of the response.
+func responseError(op string, resp *http.Response) error {
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(data, &body); err == nil && len(body.Errors) > 0 {
+		var msgs []string
+		for _, e := range body.Errors {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", e.Code, e.Message))
+		}
+		return errors.Errorf("%s: unexpected status: %s (%s)", op, resp.Status, strings.Join(msgs, "; "))
+	}
+	return errors.Errorf("%s: unexpected status: %s", op, resp.Status)
+}
+
+// GetManifest fetches the manifest (or index) with the given reference (a tag
+// or digest) from the registry. The returned descriptor describes the
+// manifest, and the digest of the manifest is verified if reference is a
+// digest.
+func (c *Client) GetManifest(ctx context.Context, reference string) (ispec.Descriptor, []byte, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", c.url("manifests/%s", reference), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		return req, nil
+	})
+	if err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "get manifest")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			return ispec.Descriptor{}, nil, errors.Wrapf(cas.ErrNotExist, "get manifest %s", reference)
+		}
+		return ispec.Descriptor{}, nil, responseError("get manifest", resp)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return ispec.Descriptor{}, nil, errors.Wrap(err, "read manifest")
+	}
+	if len(data) > maxManifestSize {
+		return ispec.Descriptor{}, nil, errors.Errorf("manifest is larger than %d bytes", maxManifestSize)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !isManifestType(mediaType) {
+		// Fall back to the mediaType field of the manifest.
+		var manifest struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil || !isManifestType(manifest.MediaType) {
+			return ispec.Descriptor{}, nil, errors.Errorf("unsupported manifest media type: %q", resp.Header.Get("Content-Type"))
+		}
+		mediaType = manifest.MediaType
+	}
+
+	algorithm := cas.BlobAlgorithm
+	if dgst, err := digest.Parse(reference); err == nil {
+		algorithm = dgst.Algorithm()
+		if !algorithm.Available() {
+			return ispec.Descriptor{}, nil, errors.Errorf("unsupported digest algorithm: %s", algorithm)
+		}
+		if actual := algorithm.FromBytes(data); actual != dgst {
+			return ispec.Descriptor{}, nil, errors.Errorf("manifest digest mismatch: expected %s, got %s", dgst, actual)
+		}
+	}
+	return ispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    algorithm.FromBytes(data),
+		Size:      int64(len(data)),
+	}, data, nil
+}
+
+// PutManifest uploads the given manifest (or index) to the registry, with the
+// given reference (a tag or digest).
+func (c *Client) PutManifest(ctx context.Context, reference string, mediaType string, data []byte) error {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("PUT", c.url("manifests/%s", reference), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "put manifest")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return responseError("put manifest", resp)
+	}
+	return nil
+}
+
+// GetBlob returns a reader for the blob with the given digest, which the
+// caller must Close. The contents are not verified.
+func (c *Client) GetBlob(ctx context.Context, dgst digest.Digest) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", c.url("blobs/%s", dgst), nil)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get blob")
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errors.Wrapf(cas.ErrNotExist, "get blob %s", dgst)
+		}
+		return nil, responseError("get blob", resp)
+	}
+	return resp.Body, nil
+}
+
+// BlobExists returns whether the blob with the given digest is present in the
+// repository.
+func (c *Client) BlobExists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("HEAD", c.url("blobs/%s", dgst), nil)
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "stat blob")
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError("stat blob", resp)
+	}
+}
+
+// location returns the (absolute) URL in the Location header of resp.
+func location(resp *http.Response) (string, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", errors.Errorf("response has no Location header")
+	}
+	u, err := resp.Request.URL.Parse(loc)
+	if err != nil {
+		return "", errors.Wrap(err, "parse Location header")
+	}
+	return u.String(), nil
+}
+
+// PutBlob uploads the blob described by descriptor to the registry, unless
+// it is already present. open is called to get a reader for the contents of
+// the blob -- if the upload is interrupted, open is called again and the
+// upload is resumed from where the registry reports it was interrupted.
+func (c *Client) PutBlob(ctx context.Context, descriptor ispec.Descriptor, open func() (io.ReadCloser, error)) error {
+	exists, err := c.BlobExists(ctx, descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Debugf("distribution: blob %s already exists", descriptor.Digest)
+		return nil
+	}
+
+	// Start the upload.
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("POST", c.url("blobs/uploads/"), nil)
+	})
+	if err != nil {
+		return errors.Wrap(err, "start upload")
+	}
+	// #nosec G104
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return responseError("start upload", resp)
+	}
+	uploadURL, err := location(resp)
+	if err != nil {
+		return errors.Wrap(err, "start upload")
+	}
+
+	var offset int64
+	for retries := 0; offset < descriptor.Size; {
+		end := descriptor.Size
+		if c.opt.ChunkSize > 0 && offset+c.opt.ChunkSize < end {
+			end = offset + c.opt.ChunkSize
+		}
+		newURL, err := c.putChunk(ctx, uploadURL, open, offset, end)
+		if err == nil {
+			uploadURL, offset = newURL, end
+			continue
+		}
+		if ctx.Err() != nil || retries >= maxUploadRetries {
+			return errors.Wrapf(err, "upload blob %s", descriptor.Digest)
+		}
+		retries++
+
+		log.Warnf("upload of blob %s was interrupted, resuming: %v", descriptor.Digest, err)
+		newURL, newOffset, statusErr := c.uploadStatus(ctx, uploadURL)
+		if statusErr != nil {
+			return errors.Wrapf(err, "upload blob %s (could not resume: %v)", descriptor.Digest, statusErr)
+		}
+		uploadURL, offset = newURL, newOffset
+	}
+
+	// Finish the upload.
+	u, err := url.Parse(uploadURL)
+	if err != nil {
+		return errors.Wrap(err, "parse upload url")
+	}
+	query := u.Query()
+	query.Set("digest", descriptor.Digest.String())
+	u.RawQuery = query.Encode()
+	resp, err = c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("PUT", u.String(), nil)
+	})
+	if err != nil {
+		return errors.Wrap(err, "finish upload")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return responseError("finish upload", resp)
+	}
+	return nil
+}
+
+// putChunk uploads the [start, end) range of the blob returned by open to
+// the upload at uploadURL, returning the URL to use for the rest of the
+// upload.
+func (c *Client) putChunk(ctx context.Context, uploadURL string, open func() (io.ReadCloser, error), start, end int64) (string, error) {
+	var blob io.ReadCloser
+	defer func() {
+		if blob != nil {
+			// #nosec G104
+			_ = blob.Close()
+		}
+	}()
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		if blob != nil {
+			// #nosec G104
+			_ = blob.Close()
+		}
+		var err error
+		blob, err = open()
+		if err != nil {
+			return nil, errors.Wrap(err, "open blob")
+		}
+		if _, err := io.CopyN(ioutil.Discard, blob, start); err != nil {
+			return nil, errors.Wrap(err, "seek blob")
+		}
+		req, err := http.NewRequest("PATCH", uploadURL, ioutil.NopCloser(io.LimitReader(blob, end-start)))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = end - start
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, end-1))
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", responseError("upload chunk", resp)
+	}
+	return location(resp)
+}
+
+// uploadStatus returns the URL to use for the rest of the upload at
+// uploadURL, and the offset from which the upload should be resumed.
+func (c *Client) uploadStatus(ctx context.Context, uploadURL string) (string, int64, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", uploadURL, nil)
+	})
+	if err != nil {
+		return "", 0, errors.Wrap(err, "get upload status")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return "", 0, responseError("get upload status", resp)
+	}
+
+	newURL := uploadURL
+	if resp.Header.Get("Location") != "" {
+		newURL, err = location(resp)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	// The Range header is of the form "0-<last byte>". If it is missing,
+	// nothing has been uploaded yet.
+	rng := resp.Header.Get("Range")
+	if rng == "" {
+		return newURL, 0, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+	if len(parts) != 2 || parts[0] != "0" {
+		return "", 0, errors.Errorf("invalid upload range: %q", rng)
+	}
+	last, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || last < -1 {
+		return "", 0, errors.Errorf("invalid upload range: %q", rng)
+	}
+	return newURL, last + 1, nil
+}
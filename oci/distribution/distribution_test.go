@@ -0,0 +1,419 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package distribution
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	casdir "github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestParseReference(t *testing.T) {
+	dgst := digest.FromString("manifest")
+	for _, test := range []struct {
+		ref      string
+		expected Reference
+		valid    bool
+	}{
+		{"example.com/foo", Reference{Registry: "example.com", Repository: "foo"}, true},
+		{"example.com/foo/bar:1.0", Reference{Registry: "example.com", Repository: "foo/bar", Tag: "1.0"}, true},
+		{"localhost:5000/foo:latest", Reference{Registry: "localhost:5000", Repository: "foo", Tag: "latest"}, true},
+		{"localhost:5000/foo", Reference{Registry: "localhost:5000", Repository: "foo"}, true},
+		{"example.com/foo@" + dgst.String(), Reference{Registry: "example.com", Repository: "foo", Digest: dgst}, true},
+		{"example.com/foo:1.0@" + dgst.String(), Reference{Registry: "example.com", Repository: "foo", Tag: "1.0", Digest: dgst}, true},
+		{"foo", Reference{}, false},
+		{"foo:latest", Reference{}, false},
+		{"/foo", Reference{}, false},
+		{"example.com/Foo", Reference{}, false},
+		{"example.com/foo:", Reference{}, false},
+		{"example.com/foo:-bad", Reference{}, false},
+		{"example.com/foo@sha256:bad", Reference{}, false},
+	} {
+		ref, err := ParseReference(test.ref)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.ref, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected error, got %#v", test.ref, ref)
+		} else if ref != test.expected {
+			t.Errorf("%s: expected %#v, got %#v", test.ref, test.expected, ref)
+		} else if test.valid && ref.String() != test.ref {
+			t.Errorf("%s: String() returned %s", test.ref, ref.String())
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo:pull,push"`)
+	if scheme != "Bearer" {
+		t.Errorf("unexpected scheme: %s", scheme)
+	}
+	expected := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:foo:pull,push",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("unexpected params: %v", params)
+	}
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	if scheme != "Basic" || params["realm"] != "registry" {
+		t.Errorf("unexpected challenge: %s %v", scheme, params)
+	}
+}
+
+// testRegistry is a minimal in-memory registry implementing the parts of the
+// distribution specification used by Client. It requires bearer tokens
+// (fetched from /token with the credentials "user:pass"), and can be made to
+// fail blob uploads part-way through.
+type testRegistry struct {
+	t *testing.T
+
+	lock      sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[string][]byte
+	types     map[string]string
+	uploads   map[string][]byte
+	nextID    int
+
+	// failPatches is the number of chunk uploads which will fail after
+	// only storing half of the chunk.
+	failPatches int
+	// patches is the number of chunk uploads received.
+	patches int
+}
+
+func newTestRegistry(t *testing.T) (*testRegistry, *httptest.Server) {
+	r := &testRegistry{
+		t:         t,
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+		uploads:   map[string][]byte{},
+	}
+	return r, httptest.NewServer(r)
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if req.URL.Path == "/token" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, "token "+req.URL.Query().Get("scope"))
+		return
+	}
+
+	const prefix = "/v2/test/repo/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, prefix)
+
+	action := "pull"
+	if req.Method != "GET" && req.Method != "HEAD" {
+		action = "pull,push"
+	}
+	scope := "repository:test/repo:" + action
+	if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, "Bearer token ") || !strings.Contains(auth, action) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test",scope=%q`, req.Host, scope))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(path, "manifests/"):
+		ref := strings.TrimPrefix(path, "manifests/")
+		switch req.Method {
+		case "GET":
+			data, ok := r.manifests[ref]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", r.types[ref])
+			w.Write(data)
+		case "PUT":
+			data, _ := ioutil.ReadAll(req.Body)
+			dgst := digest.FromBytes(data)
+			for _, name := range []string{ref, dgst.String()} {
+				r.manifests[name] = data
+				r.types[name] = req.Header.Get("Content-Type")
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+	case path == "blobs/uploads/":
+		r.nextID++
+		id := strconv.Itoa(r.nextID)
+		r.uploads[id] = nil
+		w.Header().Set("Location", prefix+"blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(path, "blobs/uploads/"):
+		id := strings.TrimPrefix(path, "blobs/uploads/")
+		data, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			w.Header().Set("Location", req.URL.Path)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+			w.WriteHeader(http.StatusNoContent)
+		case "PATCH":
+			r.patches++
+			var start, end int
+			if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			chunk, _ := ioutil.ReadAll(req.Body)
+			if len(chunk) != end-start+1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if r.failPatches > 0 {
+				r.failPatches--
+				r.uploads[id] = append(data, chunk[:len(chunk)/2]...)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			r.uploads[id] = append(data, chunk...)
+			w.Header().Set("Location", req.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		case "PUT":
+			dgst, err := digest.Parse(req.URL.Query().Get("digest"))
+			if err != nil || dgst != digest.FromBytes(data) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.blobs[dgst] = data
+			delete(r.uploads, id)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.HasPrefix(path, "blobs/"):
+		dgst := digest.Digest(strings.TrimPrefix(path, "blobs/"))
+		data, ok := r.blobs[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// setupImage creates a new image layout in dir, containing an image with a
+// single layer, and returns the descriptor of its manifest.
+func setupImage(t *testing.T, dir string) (cas.Engine, ispec.Descriptor) {
+	if err := casdir.Create(dir); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := casdir.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	ctx := context.Background()
+
+	layerData := bytes.Repeat([]byte("layer data "), 1000)
+	layerDigest, layerSize, err := engine.PutBlob(ctx, bytes.NewReader(layerData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS: ispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{layerDigest},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, ispec.Manifest{
+		Versioned: imeta.Versioned{SchemaVersion: 2},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func testClient(t *testing.T, server *httptest.Server, ref string, opt Options) *Client {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference, err := ParseReference(u.Host + "/" + ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt.PlainHTTP = true
+	opt.Credentials = func(host string) (string, string, error) {
+		if host != u.Host {
+			t.Errorf("credentials requested for unexpected host %s", host)
+		}
+		return "user", "pass", nil
+	}
+	return NewClient(reference, opt)
+}
+
+func TestPushPull(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "umoci-TestPushPull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	registry, server := newTestRegistry(t)
+	defer server.Close()
+
+	engine, manifest := setupImage(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	// Upload in small chunks, with one of the chunks being interrupted.
+	registry.failPatches = 1
+	client := testClient(t, server, "test/repo:1.0", Options{ChunkSize: 1024})
+	if err := client.Push(ctx, engine, manifest); err != nil {
+		t.Fatalf("unexpected error pushing image: %+v", err)
+	}
+	if registry.failPatches != 0 {
+		t.Errorf("upload was not interrupted")
+	}
+	if registry.patches < 10 {
+		t.Errorf("expected the layer to be uploaded in chunks, got %d requests", registry.patches)
+	}
+	if len(registry.blobs) != 2 {
+		t.Errorf("expected 2 blobs in the registry, got %d", len(registry.blobs))
+	}
+	if _, ok := registry.manifests["1.0"]; !ok {
+		t.Errorf("manifest was not tagged")
+	}
+
+	// Pushing again doesn't upload any blobs.
+	patches := registry.patches
+	if err := client.Push(ctx, engine, manifest); err != nil {
+		t.Fatalf("unexpected error pushing image again: %+v", err)
+	}
+	if registry.patches != patches {
+		t.Errorf("existing blobs were uploaded again")
+	}
+
+	// Pull the image into a new layout, both by tag and by digest.
+	for _, ref := range []string{"test/repo:1.0", "test/repo@" + manifest.Digest.String()} {
+		newDir := filepath.Join(dir, "pulled-"+strconv.Itoa(len(ref)))
+		if err := casdir.Create(newDir); err != nil {
+			t.Fatal(err)
+		}
+		newEngine, err := casdir.Open(newDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer newEngine.Close()
+
+		root, err := testClient(t, server, ref, Options{}).Pull(ctx, newEngine)
+		if err != nil {
+			t.Fatalf("%s: unexpected error pulling image: %+v", ref, err)
+		}
+		if !reflect.DeepEqual(root, manifest) {
+			t.Errorf("%s: unexpected root descriptor: %#v", ref, root)
+		}
+
+		// Every blob of the image must be present and valid.
+		paths, err := casext.NewEngine(newEngine).Paths(ctx, root)
+		if err != nil {
+			t.Fatalf("%s: pulled image is incomplete: %+v", ref, err)
+		}
+		if len(paths) != 3 {
+			t.Errorf("%s: expected 3 blobs, got %d", ref, len(paths))
+		}
+		for _, path := range paths {
+			has, err := hasBlob(ctx, casext.NewEngine(newEngine), path.Descriptor())
+			if err != nil || !has {
+				t.Errorf("%s: blob %s is missing", ref, path.Descriptor().Digest)
+			}
+		}
+	}
+
+	// Missing tags are reported as such.
+	if _, err := testClient(t, server, "test/repo:missing", Options{}).Pull(ctx, engine); err == nil {
+		t.Errorf("expected an error pulling a missing tag")
+	}
+}
+
+func TestPullBadCredentials(t *testing.T) {
+	_, server := newTestRegistry(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "umoci-TestPullBadCredentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	engine, _ := setupImage(t, filepath.Join(dir, "image"))
+	defer engine.Close()
+
+	client := testClient(t, server, "test/repo:1.0", Options{})
+	client.opt.Credentials = func(string) (string, string, error) { return "user", "wrong", nil }
+	if _, err := client.Pull(context.Background(), engine); err == nil {
+		t.Errorf("expected an error pulling with the wrong credentials")
+	}
+}
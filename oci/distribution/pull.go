@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package distribution
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// hasBlob returns whether the engine already contains the blob described by
+// descriptor.
+func hasBlob(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor) (bool, error) {
+	size, err := engine.BlobSize(ctx, descriptor.Digest)
+	if cause := errors.Cause(err); cause == cas.ErrNotExist || os.IsNotExist(cause) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return size == descriptor.Size, nil
+}
+
+// putBlob stores the contents of reader in the engine, and verifies that it
+// matches descriptor. If it doesn't match, the stored blob is removed.
+func putBlob(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, reader io.Reader) error {
+	dgst, size, err := engine.PutBlobWithAlgorithm(ctx, io.LimitReader(reader, descriptor.Size+1), descriptor.Digest.Algorithm())
+	if err != nil {
+		return errors.Wrap(err, "put blob")
+	}
+	if dgst != descriptor.Digest || size != descriptor.Size {
+		// Don't remove a blob which happened to already be present.
+		if dgst != descriptor.Digest {
+			if has, _ := hasBlob(ctx, engine, descriptor); !has {
+				// #nosec G104
+				_ = engine.DeleteBlob(ctx, dgst)
+			}
+		}
+		return errors.Errorf("blob does not match descriptor: expected %s (%d bytes), got %s (%d bytes)", descriptor.Digest, descriptor.Size, dgst, size)
+	}
+	return nil
+}
+
+// Pull fetches the image referred to by the client's reference, and every
+// blob it references, into the engine. Blobs which are already present in the
+// engine are not fetched again, and every fetched blob is verified against
+// its descriptor. The descriptor of the image's manifest (or index) is
+// returned -- no references in the engine are modified, so callers must add
+// a reference to the descriptor themselves.
+func (c *Client) Pull(ctx context.Context, engine cas.Engine) (ispec.Descriptor, error) {
+	engineExt := casext.NewEngine(engine)
+
+	root, data, err := c.GetManifest(ctx, c.ref.reference())
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if err := putBlob(ctx, engineExt, root, bytes.NewReader(data)); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "store manifest")
+	}
+
+	if err := engineExt.Walk(ctx, root, func(descriptorPath casext.DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+		has, err := hasBlob(ctx, engineExt, descriptor)
+		if err != nil {
+			return errors.Wrapf(err, "stat blob %s", descriptor.Digest)
+		}
+		if has {
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"digest":    descriptor.Digest,
+			"mediatype": descriptor.MediaType,
+			"size":      descriptor.Size,
+		}).Info("fetching blob")
+
+		if isManifestType(descriptor.MediaType) {
+			_, data, err := c.GetManifest(ctx, descriptor.Digest.String())
+			if err != nil {
+				return err
+			}
+			return errors.Wrapf(putBlob(ctx, engineExt, descriptor, bytes.NewReader(data)), "store manifest %s", descriptor.Digest)
+		}
+
+		blob, err := c.GetBlob(ctx, descriptor.Digest)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+		return errors.Wrapf(putBlob(ctx, engineExt, descriptor, blob), "store blob %s", descriptor.Digest)
+	}); err != nil {
+		return ispec.Descriptor{}, errors.Wrap(err, "fetch blobs")
+	}
+	return root, nil
+}
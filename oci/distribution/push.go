@@ -0,0 +1,109 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package distribution
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Push uploads the image with the given root descriptor (a manifest or
+// index), and every blob it references, from the engine to the registry. The
+// blobs are uploaded before the manifests which reference them, and the root
+// descriptor is uploaded last, tagged with the tag of the client's reference
+// (or by digest if the reference has no tag). Blobs which are already present
+// in the registry are not uploaded again.
+func (c *Client) Push(ctx context.Context, engine cas.Engine, root ispec.Descriptor) error {
+	if c.ref.Digest != "" && c.ref.Digest != root.Digest {
+		return errors.Errorf("reference digest %s does not match image digest %s", c.ref.Digest, root.Digest)
+	}
+	if !isManifestType(root.MediaType) {
+		return errors.Errorf("unsupported root media type: %s", root.MediaType)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	// Every descriptor comes after all of its children in the reverse of the
+	// (depth-first) walk order.
+	var descriptors []ispec.Descriptor
+	if err := engineExt.Walk(ctx, root, func(descriptorPath casext.DescriptorPath) error {
+		descriptors = append(descriptors, descriptorPath.Descriptor())
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "walk image")
+	}
+
+	seen := map[digest.Digest]struct{}{}
+	for i := len(descriptors) - 1; i >= 0; i-- {
+		descriptor := descriptors[i]
+		if _, ok := seen[descriptor.Digest]; ok {
+			continue
+		}
+		seen[descriptor.Digest] = struct{}{}
+
+		log.WithFields(log.Fields{
+			"digest":    descriptor.Digest,
+			"mediatype": descriptor.MediaType,
+			"size":      descriptor.Size,
+		}).Info("pushing blob")
+
+		if isManifestType(descriptor.MediaType) {
+			reference := descriptor.Digest.String()
+			if descriptor.Digest == root.Digest && c.ref.Tag != "" {
+				reference = c.ref.Tag
+			}
+			if err := c.pushManifest(ctx, engineExt, descriptor, reference); err != nil {
+				return errors.Wrapf(err, "push manifest %s", descriptor.Digest)
+			}
+			continue
+		}
+
+		if err := c.PutBlob(ctx, descriptor, func() (io.ReadCloser, error) {
+			return engineExt.GetBlob(ctx, descriptor.Digest)
+		}); err != nil {
+			return errors.Wrapf(err, "push blob %s", descriptor.Digest)
+		}
+	}
+	return nil
+}
+
+// pushManifest uploads the manifest (or index) described by descriptor from
+// the engine to the registry, with the given reference.
+func (c *Client) pushManifest(ctx context.Context, engine casext.Engine, descriptor ispec.Descriptor, reference string) error {
+	blob, err := engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		return errors.Wrap(err, "get blob")
+	}
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(blob, maxManifestSize+1))
+	if err != nil {
+		return errors.Wrap(err, "read blob")
+	}
+	if len(data) > maxManifestSize {
+		return errors.Errorf("manifest is larger than %d bytes", maxManifestSize)
+	}
+	return c.PutManifest(ctx, reference, descriptor.MediaType, data)
+}
@@ -0,0 +1,116 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package distribution
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+var (
+	// repositoryRegexp matches a valid repository name, as defined by the
+	// OCI distribution specification.
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+
+	// tagRegexp matches a valid tag, as defined by the OCI distribution
+	// specification.
+	tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+// Reference is a reference to an image in a registry.
+type Reference struct {
+	// Registry is the host (and optional port) of the registry.
+	Registry string
+
+	// Repository is the name of the repository in the registry.
+	Repository string
+
+	// Tag is the tag of the image in the repository. It is empty if the
+	// reference did not include a tag.
+	Tag string
+
+	// Digest is the digest of the image manifest (or index). It is empty if
+	// the reference did not include a digest.
+	Digest digest.Digest
+}
+
+// ParseReference parses a reference of the form
+// "registry/repository[:tag][@digest]", such as "example.com/foo/bar:1.0".
+// Unlike other tools, the registry must always be specified.
+func ParseReference(ref string) (Reference, error) {
+	var reference Reference
+
+	name := ref
+	if idx := strings.Index(name, "@"); idx != -1 {
+		dgst, err := digest.Parse(name[idx+1:])
+		if err != nil {
+			return Reference{}, errors.Wrap(err, "invalid digest")
+		}
+		reference.Digest = dgst
+		name = name[:idx]
+	}
+	if idx := strings.LastIndex(name, ":"); idx != -1 && idx > strings.LastIndex(name, "/") {
+		reference.Tag = name[idx+1:]
+		name = name[:idx]
+		if !tagRegexp.MatchString(reference.Tag) {
+			return Reference{}, errors.Errorf("invalid tag: %q", reference.Tag)
+		}
+	}
+
+	idx := strings.Index(name, "/")
+	if idx == -1 {
+		return Reference{}, errors.Errorf("reference must include a registry: %q", ref)
+	}
+	reference.Registry = name[:idx]
+	reference.Repository = name[idx+1:]
+	if reference.Registry == "" {
+		return Reference{}, errors.Errorf("registry is empty")
+	}
+	if !repositoryRegexp.MatchString(reference.Repository) {
+		return Reference{}, errors.Errorf("invalid repository name: %q", reference.Repository)
+	}
+	return reference, nil
+}
+
+// String returns the reference in the form accepted by ParseReference.
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// reference returns the part of the reference used to refer to the image
+// manifest in the registry API -- the digest if there is one, otherwise the
+// tag (or "latest" if neither were specified).
+func (r Reference) reference() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	if r.Tag != "" {
+		return r.Tag
+	}
+	return "latest"
+}
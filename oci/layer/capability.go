@@ -0,0 +1,57 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"encoding/binary"
+)
+
+// capabilityXattr is the xattr used to store file capabilities.
+const capabilityXattr = "security.capability"
+
+// These match the definitions of struct vfs_ns_cap_data in
+// <linux/capability.h>. All fields are stored little-endian.
+const (
+	vfsCapRevisionMask = 0xFF000000
+	vfsCapRevision2    = 0x02000000
+	vfsCapRevision3    = 0x03000000
+
+	vfsCapV2Size = 4 + 2*(4+4)
+	vfsCapV3Size = vfsCapV2Size + 4
+)
+
+// capabilityToV2 converts a namespaced (VFS_CAP_REVISION_3) file capability
+// into a non-namespaced (VFS_CAP_REVISION_2) one, by dropping the root uid the
+// capability is scoped to. The kernel only writes v3 capabilities when they
+// are set from inside a user namespace, and the root uid is meaningless on
+// other hosts (as well as preventing the capability from taking effect in any
+// container which doesn't use the same mapping). Any other value (including
+// malformed capabilities) is returned unchanged.
+func capabilityToV2(value []byte) []byte {
+	if len(value) != vfsCapV3Size {
+		return value
+	}
+	magic := binary.LittleEndian.Uint32(value[0:4])
+	if magic&vfsCapRevisionMask != vfsCapRevision3 {
+		return value
+	}
+	newValue := make([]byte, vfsCapV2Size)
+	copy(newValue, value)
+	binary.LittleEndian.PutUint32(newValue[0:4], (magic&^vfsCapRevisionMask)|vfsCapRevision2)
+	return newValue
+}
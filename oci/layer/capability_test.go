@@ -0,0 +1,59 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"bytes"
+	"testing"
+)
+
+// cap_net_bind_service=ep, in each of the capability formats.
+var (
+	testCapV2 = []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	testCapV3 = []byte{0x01, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xe8, 0x03, 0x00, 0x00}
+)
+
+func TestCapabilityToV2(t *testing.T) {
+	testCapV1 := []byte{0x01, 0x00, 0x00, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	badCapV3 := append([]byte{}, testCapV3...)
+	badCapV3[3] = 0x04
+
+	for _, test := range []struct {
+		name     string
+		value    []byte
+		expected []byte
+	}{
+		{"V1", testCapV1, testCapV1},
+		{"V2", testCapV2, testCapV2},
+		{"V3", testCapV3, testCapV2},
+		{"UnknownRevision", badCapV3, badCapV3},
+		{"Truncated", testCapV3[:10], testCapV3[:10]},
+		{"Empty", []byte{}, []byte{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			value := append([]byte{}, test.value...)
+			got := capabilityToV2(value)
+			if !bytes.Equal(got, test.expected) {
+				t.Errorf("unexpected capability: expected %x, got %x", test.expected, got)
+			}
+			if !bytes.Equal(value, test.value) {
+				t.Errorf("capabilityToV2 modified its argument: %x", value)
+			}
+		})
+	}
+}
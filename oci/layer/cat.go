@@ -0,0 +1,200 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// catResult is the result of scanning a single layer for a path.
+type catResult int
+
+const (
+	// catNotFound means the layer has no information about the path, and the
+	// lower layers must be searched.
+	catNotFound catResult = iota
+
+	// catFound means the path was found (and handled) in the layer.
+	catFound
+
+	// catRemoved means the layer removes the path from the lower layers
+	// (either through a whiteout or by replacing a parent directory).
+	catRemoved
+)
+
+// CatFile writes the contents of the regular file at path (as it would appear
+// in the root filesystem after extracting all of the layers of the given
+// manifest) to w. Only the layers required to find the final version of the
+// file are read, starting from the top-most layer. An error is returned if the
+// path does not exist (or was removed by a whiteout) or is not a regular file.
+//
+// Note that symlinks are not followed (since they may only be resolved in the
+// context of the complete root filesystem).
+func CatFile(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, path string, w io.Writer) error {
+	return catLayers(ctx, casext.NewEngine(engine), manifest.Layers, path, w)
+}
+
+// catLayers is CatFile for the root filesystem made up of the given layers.
+func catLayers(ctx context.Context, engineExt casext.Engine, layers []ispec.Descriptor, path string, w io.Writer) error {
+	path = cleanRelPath(path)
+	if path == "." {
+		return errors.Errorf("cat %s: is a directory", path)
+	}
+
+	for idx := len(layers) - 1; idx >= 0; idx-- {
+		layerDescriptor := layers[idx]
+		log.Debugf("cat %s: scanning layer %s", path, layerDescriptor.Digest)
+
+		result, linkname, err := catLayer(ctx, engineExt, layerDescriptor, path, w)
+		if err != nil {
+			return errors.Wrapf(err, "cat %s: layer %s", path, layerDescriptor.Digest)
+		}
+		switch result {
+		case catFound:
+			if linkname == "" {
+				return nil
+			}
+			if linkname == path {
+				return errors.Errorf("cat %s: hardlink refers to itself", path)
+			}
+			log.Debugf("cat %s: following hardlink to %s", path, linkname)
+			// Hardlinks redirect us to a different path, which must be
+			// resolved starting from the layer the hardlink was found in.
+			path = linkname
+			idx++
+		case catRemoved:
+			return errors.Errorf("cat %s: file was removed in layer %s", path, layerDescriptor.Digest)
+		}
+	}
+	return errors.Errorf("cat %s: no such file in image", path)
+}
+
+// catLayer scans the given layer for path. If the path is found as a regular
+// file its contents are copied to w, and if it is found as a hardlink the
+// (cleaned) link target is returned.
+func catLayer(ctx context.Context, engineExt casext.Engine, layerDescriptor ispec.Descriptor, path string, w io.Writer) (catResult, string, error) {
+	layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
+	if err != nil {
+		return catNotFound, "", errors.Wrap(err, "get layer blob")
+	}
+	defer layerBlob.Close()
+	if !isLayerType(layerBlob.Descriptor.MediaType) {
+		return catNotFound, "", errors.Errorf("blob is not correct mediatype: %s", layerBlob.Descriptor.MediaType)
+	}
+	layerData, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		// Should _never_ be reached.
+		return catNotFound, "", errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+	}
+
+	layerRaw, err := decompressLayer(layerBlob.Descriptor.MediaType, layerData)
+	if err != nil {
+		return catNotFound, "", errors.Wrap(err, "decompress layer")
+	}
+	defer layerRaw.Close()
+
+	// Whiteouts (and parent directories being replaced) only apply to the
+	// lower layers, so an entry for path in this layer always wins. Thus we
+	// have to scan the whole layer before we can decide whether it was
+	// removed.
+	removed := false
+	tr := tar.NewReader(layerRaw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return catNotFound, "", errors.Wrap(err, "read next entry")
+		}
+
+		name := cleanRelPath(hdr.Name)
+		dir, file := filepath.Split(name)
+		dir = filepath.Clean(dir)
+
+		switch {
+		case name == path:
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				if _, err := io.Copy(w, tr); err != nil {
+					return catNotFound, "", errors.Wrap(err, "copy file contents")
+				}
+				return catFound, "", nil
+			case tar.TypeLink:
+				return catFound, cleanRelPath(hdr.Linkname), nil
+			case tar.TypeDir:
+				return catNotFound, "", errors.Errorf("is a directory")
+			default:
+				return catNotFound, "", errors.Errorf("not a regular file (type %q)", hdr.Typeflag)
+			}
+
+		case file == whOpaque:
+			// An opaque whiteout removes all lower entries inside dir.
+			if isPathPrefix(path, dir) {
+				removed = true
+			}
+
+		case strings.HasPrefix(file, whPrefix):
+			// A regular whiteout removes the lower entry (and all its
+			// children, if it is a directory).
+			target := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+			if path == target || isPathPrefix(path, target) {
+				removed = true
+			}
+
+		case hdr.Typeflag != tar.TypeDir && isPathPrefix(path, name):
+			// A parent of path being replaced with a non-directory also
+			// removes all of the lower entries underneath it.
+			removed = true
+		}
+	}
+
+	if removed {
+		return catRemoved, "", nil
+	}
+	return catNotFound, "", nil
+}
+
+// cleanRelPath cleans the given path and makes it relative to the root of the
+// image (regardless of whether it was absolute).
+func cleanRelPath(path string) string {
+	path = strings.TrimPrefix(CleanPath("/"+path), "/")
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// isPathPrefix returns whether path is strictly inside the directory prefix.
+// Both paths must already be cleaned.
+func isPathPrefix(path, prefix string) bool {
+	if prefix == "." {
+		return path != "."
+	}
+	return strings.HasPrefix(path, prefix+"/")
+}
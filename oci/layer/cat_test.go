@@ -0,0 +1,163 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+type catEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	data     string
+}
+
+// makeTarImage creates a new image in root containing the given layers (as
+// uncompressed tar archives), and returns the manifest of the image. The
+// config and DiffIDs are not filled, since they are not needed for CatFile.
+func makeTarImage(t *testing.T, root string, layers [][]catEntry) (casext.Engine, ispec.Manifest) {
+	ctx := context.Background()
+
+	image := filepath.Join(root, "image")
+	if err := dir.Create(image); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	var manifest ispec.Manifest
+	for _, layer := range layers {
+		var buffer bytes.Buffer
+		tw := tar.NewWriter(&buffer)
+		for _, entry := range layer {
+			hdr := &tar.Header{
+				Name:     entry.name,
+				Typeflag: entry.typeflag,
+				Linkname: entry.linkname,
+				Mode:     0644,
+				Size:     int64(len(entry.data)),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(entry.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		layerDigest, layerSize, err := engineExt.PutBlob(ctx, &buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+	return engineExt, manifest
+}
+
+func TestCatFile(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestCatFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifest := makeTarImage(t, root, [][]catEntry{
+		{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "base os-release"},
+			{name: "etc/hostname", typeflag: tar.TypeReg, data: "base hostname"},
+			{name: "etc/link", typeflag: tar.TypeLink, linkname: "etc/hostname"},
+			{name: "opaque/", typeflag: tar.TypeDir},
+			{name: "opaque/file", typeflag: tar.TypeReg, data: "opaque file"},
+			{name: "replaced/", typeflag: tar.TypeDir},
+			{name: "replaced/file", typeflag: tar.TypeReg, data: "replaced file"},
+			{name: "deleted", typeflag: tar.TypeReg, data: "deleted file"},
+			{name: "symlink", typeflag: tar.TypeSymlink, linkname: "etc/hostname"},
+		},
+		{
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "new os-release"},
+			{name: "opaque/", typeflag: tar.TypeDir},
+			{name: "opaque/" + whOpaque, typeflag: tar.TypeReg},
+			{name: "replaced", typeflag: tar.TypeReg, data: "now a file"},
+			{name: whPrefix + "deleted", typeflag: tar.TypeReg},
+		},
+		{
+			{name: "./etc/other", typeflag: tar.TypeLink, linkname: "./etc/os-release"},
+		},
+	})
+	defer engineExt.Close()
+
+	for _, test := range []struct {
+		path     string
+		expected string
+		fail     bool
+	}{
+		{path: "/etc/os-release", expected: "new os-release"},
+		{path: "etc/hostname", expected: "base hostname"},
+		{path: "etc/link", expected: "base hostname"},
+		{path: "etc/other", expected: "new os-release"},
+		{path: "replaced", expected: "now a file"},
+		{path: "etc", fail: true},
+		{path: "/", fail: true},
+		{path: "symlink", fail: true},
+		{path: "deleted", fail: true},
+		{path: "opaque/file", fail: true},
+		{path: "replaced/file", fail: true},
+		{path: "does/not/exist", fail: true},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			var buffer bytes.Buffer
+			err := CatFile(ctx, engineExt, manifest, test.path, &buffer)
+			if test.fail {
+				if err == nil {
+					t.Errorf("expected error, got contents %q", buffer.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if buffer.String() != test.expected {
+				t.Errorf("unexpected contents: expected %q, got %q", test.expected, buffer.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// These are the media types of zstd-compressed layers. They are not included
+// in the version of the image-spec we use, but are otherwise identical to the
+// gzip-compressed layer media types.
+const (
+	// MediaTypeImageLayerZstd is the media type used for zstd-compressed
+	// layers.
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeImageLayerNonDistributableZstd is the media type used for
+	// zstd-compressed non-distributable layers.
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+func needsZstd(mediaType string) bool {
+	return mediaType == MediaTypeImageLayerZstd || mediaType == MediaTypeImageLayerNonDistributableZstd
+}
+
+// zstdReader wraps a *zstd.Decoder so that it implements io.ReadCloser.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+// Close releases the resources used by the decoder.
+func (zr zstdReader) Close() error {
+	zr.Decoder.Close()
+	return nil
+}
+
+// decompressLayer returns a reader for the uncompressed contents of a layer
+// blob with the given media type. Closing the returned reader does not close
+// r.
+func decompressLayer(mediaType string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case needsGunzip(mediaType):
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+		return gzr, nil
+	case needsZstd(mediaType):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "create zstd reader")
+		}
+		return zstdReader{zr}, nil
+	case mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable:
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, errors.Errorf("unsupported layer media type: %s", mediaType)
+}
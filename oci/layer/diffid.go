@@ -0,0 +1,78 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"io"
+
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DiffID computes the DiffID (the digest of the uncompressed contents) of the
+// layer blob referenced by the given descriptor, decompressing the layer if
+// necessary. The compressed blob is verified against the descriptor digest
+// while it is read. The DiffID uses the digest algorithm used for new blobs in
+// engine (see casext.Engine.BlobAlgorithm).
+func DiffID(ctx context.Context, engine cas.Engine, layerDescriptor ispec.Descriptor) (digest.Digest, error) {
+	return DiffIDWithAlgorithm(ctx, engine, layerDescriptor, casext.NewEngine(engine).BlobAlgorithm())
+}
+
+// DiffIDWithAlgorithm is the same as DiffID, except that the DiffID uses the
+// given digest algorithm (such as the algorithm of an existing DiffID which is
+// being checked).
+func DiffIDWithAlgorithm(ctx context.Context, engine cas.Engine, layerDescriptor ispec.Descriptor, algo digest.Algorithm) (digest.Digest, error) {
+	if !algo.Available() {
+		return "", errors.Errorf("unsupported digest algorithm: %q", algo)
+	}
+	engineExt := casext.NewEngine(engine)
+
+	layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
+	if err != nil {
+		return "", errors.Wrap(err, "get layer blob")
+	}
+	defer layerBlob.Close()
+	if !isLayerType(layerBlob.Descriptor.MediaType) {
+		return "", errors.Errorf("blob is not correct mediatype: %s", layerBlob.Descriptor.MediaType)
+	}
+	layerData, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		// Should _never_ be reached.
+		return "", errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+	}
+
+	layerRaw, err := decompressLayer(layerBlob.Descriptor.MediaType, layerData)
+	if err != nil {
+		return "", errors.Wrap(err, "decompress layer")
+	}
+	defer layerRaw.Close()
+
+	diffIDDigester := algo.Digester()
+	if _, err := io.Copy(diffIDDigester.Hash(), layerRaw); err != nil {
+		return "", errors.Wrap(err, "digest layer")
+	}
+	// Make sure that the compressed blob was verified completely.
+	if err := layerData.Close(); err != nil {
+		return "", errors.Wrap(err, "close layer data")
+	}
+	return diffIDDigester.Digest(), nil
+}
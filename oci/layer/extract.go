@@ -0,0 +1,246 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// pathExtractor keeps track of the state of ExtractPath while it scans the
+// layers of an image from the top-most layer down.
+type pathExtractor struct {
+	engineExt casext.Engine
+	layers    []ispec.Descriptor
+	opt       *UnpackOptions
+	te        *TarExtractor
+
+	// path is the (cleaned) path inside the image being extracted, which is
+	// extracted to root/base.
+	path string
+	root string
+	base string
+
+	// extracted is the set of paths (inside the image) which have already been
+	// extracted from an upper layer, and thus take precedence over any entries
+	// for the same path in lower layers.
+	extracted map[string]struct{}
+
+	// removed is the set of paths which (along with their children) have been
+	// removed from the lower layers by a whiteout in an upper layer.
+	removed map[string]struct{}
+
+	// masked is the set of paths whose children (but not the path itself)
+	// have been removed from the lower layers, either by an opaque whiteout or
+	// by the path being replaced with a non-directory in an upper layer.
+	masked map[string]struct{}
+}
+
+// ExtractPath extracts the file or directory at path (as it would appear in
+// the root filesystem after extracting all of the layers of the given
+// manifest) to dest, which must not already exist. The layers are scanned
+// starting from the top-most layer, and entries in lower layers are only
+// extracted if they were not replaced or removed (by a whiteout) in an upper
+// layer. Once the final version of path is known to be a non-directory (or to
+// have been removed) no further layers are read.
+//
+// Hardlinks to files that are not extracted from the same layer (such as
+// files outside of path) are extracted as copies of the linked file. As with
+// CatFile, symlinks in the components of path are not followed.
+func ExtractPath(ctx context.Context, engine cas.Engine, manifest ispec.Manifest, path, dest string, opt *UnpackOptions) error {
+	if opt == nil {
+		opt = &UnpackOptions{}
+	}
+
+	path = cleanRelPath(path)
+	dest = filepath.Clean(dest)
+	if _, err := os.Lstat(dest); err == nil {
+		return errors.Errorf("extract %s: destination %s already exists", path, dest)
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "extract %s: check destination", path)
+	}
+
+	pe := &pathExtractor{
+		engineExt: casext.NewEngine(engine),
+		layers:    manifest.Layers,
+		opt:       opt,
+		te:        NewTarExtractorWithOptions(*opt),
+		path:      path,
+		root:      filepath.Dir(dest),
+		base:      filepath.Base(dest),
+		extracted: make(map[string]struct{}),
+		removed:   make(map[string]struct{}),
+		masked:    make(map[string]struct{}),
+	}
+
+	for idx := len(manifest.Layers) - 1; idx >= 0; idx-- {
+		layerDescriptor := manifest.Layers[idx]
+		log.Debugf("extract %s: scanning layer %s", path, layerDescriptor.Digest)
+
+		if err := pe.extractLayer(ctx, idx); err != nil {
+			return errors.Wrapf(err, "extract %s: layer %s", path, layerDescriptor.Digest)
+		}
+
+		// Nothing in the lower layers can affect path if it has been removed,
+		// or if it is a non-directory (or opaque directory) we've extracted.
+		_, isExtracted := pe.extracted[path]
+		_, isMasked := pe.masked[path]
+		if pe.isRemoved(path) || (isExtracted && isMasked) {
+			break
+		}
+	}
+
+	if len(pe.extracted) == 0 {
+		if pe.isRemoved(path) {
+			return errors.Errorf("extract %s: path was removed from image", path)
+		}
+		return errors.Errorf("extract %s: no such file or directory in image", path)
+	}
+	return nil
+}
+
+// isRemoved returns whether the lower version of the given path has been
+// removed by an upper layer.
+func (pe *pathExtractor) isRemoved(name string) bool {
+	for p := name; ; p = filepath.Dir(p) {
+		if _, ok := pe.removed[p]; ok {
+			return true
+		}
+		if _, ok := pe.masked[p]; ok && p != name {
+			return true
+		}
+		if p == "." {
+			return false
+		}
+	}
+}
+
+// destName returns the name (relative to pe.root) that the given path inside
+// the image (which must be path or inside path) is extracted to.
+func (pe *pathExtractor) destName(name string) string {
+	rel := strings.TrimPrefix(name, pe.path+"/")
+	if pe.path == "." {
+		rel = name
+	}
+	if name == pe.path {
+		rel = "."
+	}
+	return filepath.Join(pe.base, rel)
+}
+
+// extractLayer extracts all of the entries in the layer with the given index
+// which are inside pe.path and are not overridden by an upper layer.
+func (pe *pathExtractor) extractLayer(ctx context.Context, idx int) error {
+	layerBlob, layerRaw, err := openLayerBlob(ctx, pe.engineExt, pe.layers[idx], pe.opt)
+	if err != nil {
+		return err
+	}
+	defer layerBlob.Close()
+	defer layerRaw.Close()
+
+	// Whiteouts (and directories being replaced) in this layer only apply to
+	// the lower layers, so we only merge them once the layer is done.
+	layerExtracted := make(map[string]struct{})
+	layerRemoved := make(map[string]struct{})
+	layerMasked := make(map[string]struct{})
+
+	tr := tar.NewReader(layerRaw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		name := cleanRelPath(hdr.Name)
+		dir, file := filepath.Split(name)
+		dir = filepath.Clean(dir)
+
+		switch {
+		case file == whOpaque:
+			layerMasked[dir] = struct{}{}
+			continue
+		case strings.HasPrefix(file, whPrefix):
+			layerRemoved[filepath.Join(dir, strings.TrimPrefix(file, whPrefix))] = struct{}{}
+			continue
+		}
+
+		if name != pe.path && !isPathPrefix(name, pe.path) {
+			// A parent of path being replaced with a non-directory removes
+			// all of the lower entries underneath it.
+			if hdr.Typeflag != tar.TypeDir && isPathPrefix(pe.path, name) {
+				layerMasked[name] = struct{}{}
+			}
+			continue
+		}
+		if _, ok := pe.extracted[name]; ok || pe.isRemoved(name) {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			layerMasked[name] = struct{}{}
+		}
+
+		var r io.Reader = tr
+		if hdr.Typeflag == tar.TypeLink {
+			linkname := cleanRelPath(hdr.Linkname)
+			if _, ok := layerExtracted[linkname]; ok {
+				hdr.Linkname = pe.destName(linkname)
+			} else {
+				// The link target isn't extracted, so we have to copy the
+				// contents of the file as it was in this layer.
+				log.Debugf("extract %s: copying hardlink %s target %s", pe.path, name, linkname)
+				var buffer bytes.Buffer
+				if err := catLayers(ctx, pe.engineExt, pe.layers[:idx+1], linkname, &buffer); err != nil {
+					return errors.Wrapf(err, "copy hardlink %s", name)
+				}
+				hdr.Typeflag = tar.TypeReg
+				hdr.Linkname = ""
+				hdr.Size = int64(buffer.Len())
+				r = &buffer
+			}
+		}
+
+		hdr.Name = pe.destName(name)
+		if err := pe.te.UnpackEntry(pe.root, hdr, r); err != nil {
+			return errors.Wrapf(err, "unpack entry: %s", name)
+		}
+		layerExtracted[name] = struct{}{}
+		pe.extracted[name] = struct{}{}
+	}
+
+	for name := range layerRemoved {
+		pe.removed[name] = struct{}{}
+	}
+	for name := range layerMasked {
+		pe.masked[name] = struct{}{}
+	}
+	return nil
+}
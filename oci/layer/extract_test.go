@@ -0,0 +1,188 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+func TestExtractPath(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestExtractPath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifest := makeTarImage(t, root, [][]catEntry{
+		{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "base os-release"},
+			{name: "etc/hostname", typeflag: tar.TypeReg, data: "base hostname"},
+			{name: "etc/link", typeflag: tar.TypeLink, linkname: "etc/hostname"},
+			{name: "etc/deleted", typeflag: tar.TypeReg, data: "deleted file"},
+			{name: "opaque/", typeflag: tar.TypeDir},
+			{name: "opaque/file", typeflag: tar.TypeReg, data: "opaque file"},
+			{name: "replaced/", typeflag: tar.TypeDir},
+			{name: "replaced/file", typeflag: tar.TypeReg, data: "replaced file"},
+			{name: "deleted", typeflag: tar.TypeReg, data: "deleted file"},
+		},
+		{
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "new os-release"},
+			{name: "etc/" + whPrefix + "deleted", typeflag: tar.TypeReg},
+			{name: "opaque/", typeflag: tar.TypeDir},
+			{name: "opaque/" + whOpaque, typeflag: tar.TypeReg},
+			{name: "opaque/new", typeflag: tar.TypeReg, data: "new file"},
+			{name: "replaced", typeflag: tar.TypeReg, data: "now a file"},
+			{name: whPrefix + "deleted", typeflag: tar.TypeReg},
+		},
+		{
+			{name: "./etc/other", typeflag: tar.TypeLink, linkname: "./etc/os-release"},
+		},
+	})
+	defer engineExt.Close()
+
+	// Map root (which owns everything in the archives) to the current user.
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    os.Geteuid() != 0,
+		},
+	}
+
+	for idx, test := range []struct {
+		path     string
+		expected map[string]string
+		missing  []string
+		fail     bool
+	}{
+		{path: "/etc/os-release", expected: map[string]string{".": "new os-release"}},
+		{path: "etc/link", expected: map[string]string{".": "base hostname"}},
+		{path: "replaced", expected: map[string]string{".": "now a file"}},
+		{
+			path: "/etc",
+			expected: map[string]string{
+				"os-release": "new os-release",
+				"hostname":   "base hostname",
+				"link":       "base hostname",
+				"other":      "new os-release",
+			},
+			missing: []string{"deleted", ".wh.deleted"},
+		},
+		{
+			path:     "opaque",
+			expected: map[string]string{"new": "new file"},
+			missing:  []string{"file", whOpaque},
+		},
+		{
+			path: "/",
+			expected: map[string]string{
+				"etc/os-release": "new os-release",
+				"etc/link":       "base hostname",
+				"opaque/new":     "new file",
+				"replaced":       "now a file",
+			},
+			missing: []string{"deleted", "etc/deleted", "opaque/file"},
+		},
+		{path: "deleted", fail: true},
+		{path: "etc/deleted", fail: true},
+		{path: "opaque/file", fail: true},
+		{path: "replaced/file", fail: true},
+		{path: "does/not/exist", fail: true},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			dest := filepath.Join(root, "dest", strconv.Itoa(idx))
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ExtractPath(ctx, engineExt, manifest, test.path, dest, unpackOptions)
+			if test.fail {
+				if err == nil {
+					t.Errorf("expected error extracting %s", test.path)
+				}
+				if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+					t.Errorf("expected %s to not exist after failed extract: %v", dest, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+
+			for name, data := range test.expected {
+				got, err := ioutil.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Errorf("read extracted %s: %v", name, err)
+					continue
+				}
+				if string(got) != data {
+					t.Errorf("unexpected contents of %s: expected %q, got %q", name, data, string(got))
+				}
+			}
+			for _, name := range test.missing {
+				if _, err := os.Lstat(filepath.Join(dest, name)); !os.IsNotExist(err) {
+					t.Errorf("expected %s to not exist: %v", name, err)
+				}
+			}
+		})
+	}
+
+	// Hardlinks to files extracted from the same layer are kept as hardlinks,
+	// while hardlinks to files from other layers are copied.
+	dest := filepath.Join(root, "dest", "hardlinks")
+	if err := ExtractPath(ctx, engineExt, manifest, "etc", dest, unpackOptions); err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	var hostnameSt, linkSt, osReleaseSt, otherSt unix.Stat_t
+	for _, stat := range []struct {
+		name string
+		st   *unix.Stat_t
+	}{
+		{"hostname", &hostnameSt},
+		{"link", &linkSt},
+		{"os-release", &osReleaseSt},
+		{"other", &otherSt},
+	} {
+		if err := unix.Lstat(filepath.Join(dest, stat.name), stat.st); err != nil {
+			t.Fatalf("lstat %s: %v", stat.name, err)
+		}
+	}
+	if hostnameSt.Ino != linkSt.Ino {
+		t.Errorf("expected link to be a hardlink to hostname")
+	}
+	if osReleaseSt.Ino == otherSt.Ino {
+		t.Errorf("expected other to be a copy of os-release")
+	}
+
+	// Extracting to an existing path must fail.
+	if err := ExtractPath(ctx, engineExt, manifest, "etc", dest, unpackOptions); err == nil {
+		t.Errorf("expected error extracting to existing destination")
+	}
+}
@@ -25,9 +25,12 @@ import (
 	"sort"
 
 	"github.com/apex/log"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
 	"github.com/openSUSE/umoci/pkg/unpriv"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
 )
 
 // inodeDeltas is a wrapper around []mtree.InodeDelta that allows for sorting
@@ -43,10 +46,33 @@ func (ids inodeDeltas) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
 // provided path (which should be the rootfs of the layer that was diffed). The
 // returned reader is for the *raw* tar data, it is the caller's responsibility
 // to gzip it.
-func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.ReadCloser, error) {
-	var mapOptions MapOptions
+//
+// mtree.Missing entries are converted into whiteouts. If every entry that was
+// previously inside an (existing and modified) directory has been removed, a
+// single opaque whiteout is used for the directory instead.
+//
+// The layer is generated as it is read from the returned reader (the
+// generator blocks until the previous data has been read), so the memory used
+// does not depend on the size or number of the files in the layer.
+//
+// If ctx is cancelled while the layer is being generated, reading from the
+// returned reader fails with the error of ctx.
+//
+// The ownership of the entries is mapped using opt.
+func GenerateLayer(ctx context.Context, path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.ReadCloser, error) {
+	return GenerateLayerWithOptions(ctx, path, deltas, generateOptions(opt))
+}
+
+// GenerateLayerWithOptions is the same as GenerateLayer, but with the
+// generated layer modified by opt. Only the deltas accepted by all of
+// opt.Filters (if any) are included in the layer.
+func GenerateLayerWithOptions(ctx context.Context, path string, deltas []mtree.InodeDelta, opt *GenerateOptions) (io.ReadCloser, error) {
+	var generateOpt GenerateOptions
 	if opt != nil {
-		mapOptions = *opt
+		generateOpt = *opt
+	}
+	if len(generateOpt.Filters) > 0 {
+		deltas = mtreefilter.FilterDeltas(deltas, generateOpt.Filters...)
 	}
 
 	reader, writer := io.Pipe()
@@ -61,33 +87,85 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 		// We can't just dump all of the file contents into a tar file. We need
 		// to emulate a proper tar generator. Luckily there aren't that many
 		// things to emulate (and we can do them all in tar.go).
-		tg := newTarGenerator(writer, mapOptions)
+		tg := newTarGenerator(writer, generateOpt)
 
 		// Sort the delta paths.
-		// FIXME: We need to add whiteouts first, otherwise we might end up
-		//        doing something silly like deleting a file which we actually
-		//        meant to modify.
 		sort.Sort(inodeDeltas(deltas))
 
+		// Directories which had all of their contents removed get an opaque
+		// whiteout, rather than a whiteout for each removed child.
+		opaqueDirs, err := opaqueDirectories(path, deltas, tg.fsEval)
+		if err != nil {
+			return errors.Wrap(err, "find opaque directories")
+		}
+
+		// Figure out how much data we need to write, so that progress can be
+		// reported as a fraction of the total.
+		var done, total int64
+		if generateOpt.Progress != nil {
+			for _, delta := range deltas {
+				if delta.Type() != mtree.Missing {
+					total += regularFileSize(tg.fsEval, filepath.Join(path, delta.Path()))
+				}
+			}
+		}
+
+		// Whiteouts only apply to the lower layers, but layers are usually
+		// extracted one entry at a time (by umoci as well as other tools). If
+		// a whiteout was written after a new entry for one of its parent
+		// directories (such as when a directory has been replaced by a
+		// symlink), the whiteout would be resolved relative to the new entry
+		// when extracted -- removing the wrong path, or failing outright. So
+		// all of the whiteouts are written (in path order) before any of the
+		// other entries.
+		for _, delta := range deltas {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			name := delta.Path()
+			switch delta.Type() {
+			case mtree.Modified:
+				if _, ok := opaqueDirs[cleanRelPath(name)]; ok {
+					if err := tg.AddOpaqueWhiteout(name); err != nil {
+						log.Warnf("generate layer: could not add opaque whiteout '%s': %s", name, err)
+						return errors.Wrap(err, "generate opaque whiteout layer file")
+					}
+				}
+			case mtree.Missing:
+				if !underOpaqueDirectory(cleanRelPath(name), opaqueDirs) {
+					if err := tg.AddWhiteout(name); err != nil {
+						log.Warnf("generate layer: could not add whiteout '%s': %s", name, err)
+						return errors.Wrap(err, "generate whiteout layer file")
+					}
+				}
+				if generateOpt.Progress != nil {
+					generateOpt.Progress(done, total, name)
+				}
+			}
+		}
+
 		for _, delta := range deltas {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if delta.Type() == mtree.Missing {
+				continue
+			}
+
 			name := delta.Path()
 			fullPath := filepath.Join(path, name)
 
 			// XXX: It's possible that if we unlink a hardlink, we're going to
 			//      AddFile() for no reason. Maybe we should drop nlink= from
 			//      the set of keywords we care about?
-
-			switch delta.Type() {
-			case mtree.Modified, mtree.Extra:
-				if err := tg.AddFile(name, fullPath); err != nil {
-					log.Warnf("generate layer: could not add file '%s': %s", name, err)
-					return errors.Wrap(err, "generate layer file")
-				}
-			case mtree.Missing:
-				if err := tg.AddWhiteout(name); err != nil {
-					log.Warnf("generate layer: could not add whiteout '%s': %s", name, err)
-					return errors.Wrap(err, "generate whiteout layer file")
-				}
+			if err := tg.AddFile(name, fullPath); err != nil {
+				log.Warnf("generate layer: could not add file '%s': %s", name, err)
+				return errors.Wrap(err, "generate layer file")
+			}
+			if generateOpt.Progress != nil {
+				done += regularFileSize(tg.fsEval, fullPath)
+				generateOpt.Progress(done, total, name)
 			}
 		}
 
@@ -102,15 +180,134 @@ func GenerateLayer(path string, deltas []mtree.InodeDelta, opt *MapOptions) (io.
 	return reader, nil
 }
 
+// regularFileSize returns the size of path if it is a regular file, and 0
+// otherwise (or if it cannot be stat-ed). It is only used for reporting
+// progress, so errors are not fatal.
+func regularFileSize(fsEval fseval.FsEval, path string) int64 {
+	fi, err := fsEval.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0
+	}
+	return fi.Size()
+}
+
+// opaqueDirectories returns the set of (cleaned) paths of directories which
+// still exist in the rootfs at root, but none of whose previous contents
+// remain -- the directory was either emptied, or was deleted and recreated
+// with entirely new contents. This is the case when the directory has at
+// least one mtree.Missing child, and every entry currently inside it is
+// mtree.Extra. Such directories can be represented with a single opaque
+// whiteout, as every entry inside them is already included in the layer.
+//
+// Only the entries inside candidate directories are kept in memory, so this
+// is cheap for the common case of a layer which doesn't remove any files.
+func opaqueDirectories(root string, deltas []mtree.InodeDelta, fsEval fseval.FsEval) (map[string]struct{}, error) {
+	removed := map[string]struct{}{}
+	for _, delta := range deltas {
+		if delta.Type() == mtree.Missing {
+			removed[filepath.Dir(cleanRelPath(delta.Path()))] = struct{}{}
+		}
+	}
+
+	// Candidates are modified directories with a removed child. We never emit
+	// an opaque whiteout for the root of the layer, since that would mask the
+	// entire lower filesystem.
+	var candidates []string
+	candidateSet := map[string]struct{}{}
+	for _, delta := range deltas {
+		name := cleanRelPath(delta.Path())
+		if delta.Type() != mtree.Modified || name == "." {
+			continue
+		}
+		if _, ok := removed[name]; ok {
+			candidates = append(candidates, name)
+			candidateSet[name] = struct{}{}
+		}
+	}
+
+	opaqueDirs := map[string]struct{}{}
+	if len(candidates) == 0 {
+		return opaqueDirs, nil
+	}
+
+	extra := map[string]struct{}{}
+	for _, delta := range deltas {
+		name := cleanRelPath(delta.Path())
+		if delta.Type() == mtree.Extra && underOpaqueDirectory(name, candidateSet) {
+			extra[name] = struct{}{}
+		}
+	}
+
+	for _, name := range candidates {
+		fullPath := filepath.Join(root, name)
+		fi, err := fsEval.Lstat(fullPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "lstat directory")
+		}
+		if !fi.IsDir() {
+			continue
+		}
+
+		survived := false
+		if err := fsEval.Walk(fullPath, func(curPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if curPath == fullPath {
+				return nil
+			}
+			relPath, err := filepath.Rel(root, curPath)
+			if err != nil {
+				return err
+			}
+			if _, ok := extra[cleanRelPath(relPath)]; !ok {
+				// This entry existed before, so an opaque whiteout would
+				// remove it from the lower layers.
+				survived = true
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, errors.Wrap(err, "walk directory")
+		}
+		if !survived {
+			log.Debugf("generate layer: using opaque whiteout for '%s'", name)
+			opaqueDirs[name] = struct{}{}
+		}
+	}
+	return opaqueDirs, nil
+}
+
+// underOpaqueDirectory returns whether the (cleaned) path is inside any of the
+// given opaque directories.
+func underOpaqueDirectory(name string, opaqueDirs map[string]struct{}) bool {
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if _, ok := opaqueDirs[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateInsertLayer generates a completely new layer from "root"to be
 // inserted into the image at "target". If "root" is an empty string then the
 // "target" will be removed via a whiteout.
 func GenerateInsertLayer(root string, target string, opaque bool, opt *MapOptions) io.ReadCloser {
+	return GenerateInsertLayerWithMode(root, target, opaque, generateOptions(opt), WhiteoutModeOCI)
+}
+
+// GenerateInsertLayerWithMode is the same as GenerateInsertLayer, except that
+// the generated layer is modified by opt, and if mode is WhiteoutModeOverlayfs, overlayfs whiteouts inside "root" (such as
+// in the upper directory of an overlayfs mount) are converted to whiteouts
+// rather than being inserted as character devices.
+func GenerateInsertLayerWithMode(root string, target string, opaque bool, opt *GenerateOptions, mode WhiteoutMode) io.ReadCloser {
 	root = CleanPath(root)
 
-	var mapOptions MapOptions
+	var generateOpt GenerateOptions
 	if opt != nil {
-		mapOptions = *opt
+		generateOpt = *opt
 	}
 
 	reader, writer := io.Pipe()
@@ -121,7 +318,7 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *MapOption
 			_ = writer.CloseWithError(errors.Wrap(Err, "generate layer"))
 		}()
 
-		tg := newTarGenerator(writer, mapOptions)
+		tg := newTarGenerator(writer, generateOpt)
 
 		if opaque {
 			if err := tg.AddOpaqueWhiteout(target); err != nil {
@@ -137,6 +334,9 @@ func GenerateInsertLayer(root string, target string, opaque bool, opt *MapOption
 			}
 
 			pathInTar := path.Join(target, curPath[len(root):])
+			if mode == WhiteoutModeOverlayfs {
+				return tg.addOverlayFile(pathInTar, curPath, info)
+			}
 			return tg.AddFile(pathInTar, curPath)
 		})
 	}()
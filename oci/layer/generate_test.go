@@ -20,13 +20,20 @@ package layer
 import (
 	"archive/tar"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
 )
 
 func TestGenerate(t *testing.T) {
@@ -74,7 +81,7 @@ func TestGenerate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(context.Background(), dir, diffs, &MapOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,6 +143,180 @@ func TestGenerate(t *testing.T) {
 	}
 }
 
+func TestGenerateOpaqueWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateOpaqueWhiteout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{"emptied", "replaced/sub", "partial"} {
+		if err := os.MkdirAll(filepath.Join(dir, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"emptied/a", "emptied/b", "replaced/old", "replaced/sub/old", "partial/kept", "partial/deleted"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty one directory, replace another with new contents and only remove
+	// some of the contents of the last one.
+	for _, path := range []string{"emptied/a", "emptied/b", "partial/deleted"} {
+		if err := os.Remove(filepath.Join(dir, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "replaced", "newsub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "replaced", "newsub", "new"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the directories are seen as modified.
+	mtime := time.Unix(1234567890, 0)
+	for _, path := range []string{"emptied", "replaced", "partial"} {
+		if err := os.Chtimes(filepath.Join(dir, path), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(context.Background(), dir, diffs, &MapOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The root directory's link count changed, which isn't interesting.
+		if hdr.Name == "." {
+			continue
+		}
+		names = append(names, hdr.Name)
+	}
+
+	// Whiteouts are written before any other entries.
+	expected := []string{
+		"emptied/" + whOpaque,
+		"partial/" + whPrefix + "deleted",
+		"replaced/" + whOpaque,
+		"emptied/",
+		"partial/",
+		"replaced/",
+		"replaced/newsub/",
+		"replaced/newsub/new",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected layer entries: expected %v, got %v", expected, names)
+	}
+}
+
+func TestGenerateProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateProgress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "some"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"deleted", "unchanged"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "some", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "some", "deleted")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "some", name), bytes.Repeat([]byte(name), 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		done  int64
+		paths = map[string]struct{}{}
+	)
+	reader, err := GenerateLayerWithOptions(context.Background(), dir, diffs, &GenerateOptions{
+		Progress: func(newDone, total int64, path string) {
+			if newDone < done {
+				t.Errorf("progress went backwards: %d -> %d (%s)", done, newDone, path)
+			}
+			if total != 300 {
+				t.Errorf("unexpected total: expected %d, got %d", 300, total)
+			}
+			done = newDone
+			paths[path] = struct{}{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+
+	if done != 300 {
+		t.Errorf("progress did not finish: expected %d, got %d", 300, done)
+	}
+	for _, path := range []string{"some/a", "some/b", "some/c", "some/deleted"} {
+		if _, ok := paths[path]; !ok {
+			t.Errorf("no progress reported for %s", path)
+		}
+	}
+}
+
 // Make sure that openSUSE/umoci#33 doesn't regress.
 func TestGenerateMissingFileError(t *testing.T) {
 	dir, err := ioutil.TempDir("", "umoci-TestGenerateError")
@@ -188,7 +369,7 @@ func TestGenerateMissingFileError(t *testing.T) {
 	}
 
 	// Generate a layer where the changed file is missing after the diff.
-	reader, err := GenerateLayer(dir, diffs, &MapOptions{})
+	reader, err := GenerateLayer(context.Background(), dir, diffs, &MapOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -253,7 +434,7 @@ func TestGenerateWrongRootError(t *testing.T) {
 	}
 
 	// Generate a layer with the wrong root directory.
-	reader, err := GenerateLayer(filepath.Join(dir, "some"), diffs, &MapOptions{})
+	reader, err := GenerateLayer(context.Background(), filepath.Join(dir, "some"), diffs, &MapOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -270,3 +451,749 @@ func TestGenerateWrongRootError(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateLayerCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	reader, err := GenerateLayer(ctx, dir, diffs, &MapOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if _, err := io.Copy(ioutil.Discard, reader); errors.Cause(err) != context.Canceled {
+		t.Errorf("expected generating layer to be cancelled: got %v", err)
+	}
+}
+
+func TestGenerateInsertLayerOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateInsertLayerOwner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "certs", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"certs/ca.pem", "certs/sub/other.pem"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uid, gid := 1000, 100
+	reader := GenerateInsertLayerWithMode(filepath.Join(dir, "certs"), "/etc/ssl/certs", false, &GenerateOptions{
+		ForceUID: &uid,
+		ForceGID: &gid,
+	}, WhiteoutModeOCI)
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if hdr.Uid != uid || hdr.Gid != gid {
+			t.Errorf("%s: expected owner %d:%d, got %d:%d", hdr.Name, uid, gid, hdr.Uid, hdr.Gid)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	expected := []string{
+		"etc/ssl/certs/",
+		"etc/ssl/certs/ca.pem",
+		"etc/ssl/certs/sub/",
+		"etc/ssl/certs/sub/other.pem",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected layer entries: expected %v, got %v", expected, names)
+	}
+}
+
+func TestGenerateLayerHardlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerHardlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "some"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "some", "orig"), []byte("orig"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(rootfs, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Link to an existing file, and create a new set of linked files.
+	if err := os.Link(filepath.Join(rootfs, "some", "orig"), filepath.Join(rootfs, "some", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "some", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"new-link1", "new-link2"} {
+		if err := os.Link(filepath.Join(rootfs, "some", "new"), filepath.Join(rootfs, "some", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(context.Background(), rootfs, diffs, &MapOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	layer, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+
+	// The contents of each set of linked files are only included once.
+	regular := map[string]struct{}{}
+	links := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			regular[hdr.Name] = struct{}{}
+		case tar.TypeLink:
+			links[hdr.Name] = hdr.Linkname
+		}
+	}
+	if len(regular) != 2 || len(links) != 3 {
+		t.Errorf("expected 2 regular files and 3 hardlinks in layer, got %v and %v", regular, links)
+	}
+	for name, linkname := range links {
+		if _, ok := regular[linkname]; !ok {
+			t.Errorf("hardlink %s refers to %s, which is not a regular file in the layer", name, linkname)
+		}
+	}
+
+	// And they are extracted as hardlinks.
+	unpacked := filepath.Join(dir, "unpacked")
+	if err := os.MkdirAll(unpacked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackLayer(unpacked, bytes.NewReader(layer), &MapOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	for _, group := range [][]string{
+		{"orig", "link"},
+		{"new", "new-link1", "new-link2"},
+	} {
+		first, err := os.Lstat(filepath.Join(unpacked, "some", group[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range group[1:] {
+			fi, err := os.Lstat(filepath.Join(unpacked, "some", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !os.SameFile(first, fi) {
+				t.Errorf("some/%s is not a hardlink to some/%s", name, group[0])
+			}
+		}
+	}
+}
+
+func TestGenerateLayerHardlinksCrossDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerHardlinksCrossDirectory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(rootfs, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A busybox-style tree, where the applets in several directories are all
+	// hardlinks to the same binary.
+	for _, path := range []string{"bin", "sbin", "usr/bin", "usr/sbin"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	busybox := filepath.Join(rootfs, "usr", "bin", "busybox")
+	if err := ioutil.WriteFile(busybox, []byte("busybox binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	applets := []string{"bin/ls", "bin/sh", "sbin/init", "usr/bin/wget", "usr/sbin/httpd"}
+	for _, applet := range applets {
+		if err := os.Link(busybox, filepath.Join(rootfs, applet)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		filters  []mtreefilter.FilterFunc
+		regular  string
+		excluded string
+	}{
+		// The first of the links (in path order) holds the contents.
+		{name: "All", regular: "bin/ls"},
+		// If that link is left out of the layer, the next one does.
+		{
+			name:     "Filtered",
+			filters:  []mtreefilter.FilterFunc{mtreefilter.MaskFilter([]string{"bin/ls"})},
+			regular:  "bin/sh",
+			excluded: "bin/ls",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := GenerateLayerWithOptions(context.Background(), rootfs, diffs, &GenerateOptions{Filters: test.filters})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			layer, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("unexpected error reading layer: %+v", err)
+			}
+
+			var regular []string
+			links := map[string]string{}
+			tr := tar.NewReader(bytes.NewReader(layer))
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				switch hdr.Typeflag {
+				case tar.TypeReg:
+					regular = append(regular, hdr.Name)
+				case tar.TypeLink:
+					links[hdr.Name] = hdr.Linkname
+				}
+			}
+			if !reflect.DeepEqual(regular, []string{test.regular}) {
+				t.Errorf("expected only %s to be a regular file, got %v", test.regular, regular)
+			}
+			for _, path := range append(applets, "usr/bin/busybox") {
+				if path == test.regular || path == test.excluded {
+					continue
+				}
+				if linkname, ok := links[path]; !ok || linkname != test.regular {
+					t.Errorf("expected %s to be a hardlink to %s, got %q", path, test.regular, linkname)
+				}
+			}
+			if _, ok := links[test.excluded]; ok {
+				t.Errorf("filtered path %s was included in the layer", test.excluded)
+			}
+
+			// All of the links are extracted as the same inode.
+			unpacked := filepath.Join(dir, "unpacked-"+test.name)
+			if err := os.MkdirAll(unpacked, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := UnpackLayer(unpacked, bytes.NewReader(layer), &MapOptions{}); err != nil {
+				t.Fatalf("unexpected error unpacking layer: %+v", err)
+			}
+			first, err := os.Lstat(filepath.Join(unpacked, test.regular))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for path := range links {
+				fi, err := os.Lstat(filepath.Join(unpacked, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !os.SameFile(first, fi) {
+					t.Errorf("%s is not a hardlink to %s", path, test.regular)
+				}
+			}
+		})
+	}
+}
+
+// setupGenerateBenchmark creates a tree of n small files in a new directory,
+// and returns the directory and the deltas which add every file in it.
+func setupGenerateBenchmark(b *testing.B, n int) (string, []mtree.InodeDelta) {
+	dir, err := ioutil.TempDir("", "umoci-BenchmarkGenerateLayer")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	keywords := []mtree.Keyword{"type", "size"}
+	initDh, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		subdir := filepath.Join(dir, fmt.Sprintf("dir%d", i/1000))
+		if i%1000 == 0 {
+			if err := os.Mkdir(subdir, 0755); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(subdir, fmt.Sprintf("file%d", i)), []byte("contents"), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	postDh, err := mtree.Walk(dir, nil, keywords, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	deltas, err := mtree.Compare(initDh, postDh, keywords)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return dir, deltas
+}
+
+// BenchmarkGenerateLayer reports the peak growth of the (live) heap while
+// generating a layer, not including the deltas themselves, which should not
+// depend on the number of entries in the layer. The heap is measured while
+// the generator is blocked on the reader, at exponentially increasing offsets
+// in the layer.
+func BenchmarkGenerateLayer(b *testing.B) {
+	for _, n := range []int{10000, 1000000} {
+		b.Run(fmt.Sprintf("entries=%d", n), func(b *testing.B) {
+			if n > 10000 && testing.Short() {
+				b.Skip("skipping large benchmark in short mode")
+			}
+
+			b.StopTimer()
+			dir, deltas := setupGenerateBenchmark(b, n)
+			defer os.RemoveAll(dir)
+
+			var peak uint64
+			heapAlloc := func() uint64 {
+				var stats runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				return stats.HeapAlloc
+			}
+			for i := 0; i < b.N; i++ {
+				base := heapAlloc()
+
+				b.StartTimer()
+				reader, err := GenerateLayer(context.Background(), dir, deltas, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var (
+					buf              = make([]byte, 32*1024)
+					read, next int64 = 0, 1024 * 1024
+				)
+				for {
+					n, err := reader.Read(buf)
+					read += int64(n)
+					if read >= next {
+						b.StopTimer()
+						if heap := heapAlloc(); heap > base && heap-base > peak {
+							peak = heap - base
+						}
+						next *= 2
+						b.StartTimer()
+					}
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						b.Fatalf("unexpected error reading layer: %+v", err)
+					}
+				}
+				reader.Close()
+				b.StopTimer()
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
+
+func TestGenerateLayerTransform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerTransform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(rootfs, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "config"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "setuid"), []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(rootfs, "etc", "setuid"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	// A hardlink to a skipped file must still be included in the layer.
+	if err := os.Link(filepath.Join(rootfs, "etc", "secret"), filepath.Join(rootfs, "etc", "tsecret")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []string
+	transform := func(hdr *tar.Header, content io.Reader) (io.Reader, error) {
+		seen = append(seen, hdr.Name)
+		switch hdr.Name {
+		case "etc/config":
+			newContent := []byte("rewritten")
+			hdr.Size = int64(len(newContent))
+			return bytes.NewReader(newContent), nil
+		case "etc/secret":
+			return nil, ErrSkipEntry
+		case "etc/setuid":
+			hdr.Mode &^= 04000
+		}
+		return content, nil
+	}
+
+	reader, err := GenerateLayerWithOptions(context.Background(), rootfs, diffs, &GenerateOptions{Transform: transform})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	entries := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error reading entry: %+v", err)
+		}
+		entries[hdr.Name] = hdr
+		contents[hdr.Name] = string(data)
+	}
+
+	// The transform is called in the order entries are added.
+	expectedSeen := []string{"etc/", "etc/config", "etc/secret", "etc/setuid", "etc/tsecret"}
+	if !reflect.DeepEqual(seen, expectedSeen) {
+		t.Errorf("transform called with unexpected entries: expected %v, got %v", expectedSeen, seen)
+	}
+
+	if got := contents["etc/config"]; got != "rewritten" {
+		t.Errorf("etc/config has unexpected contents %q", got)
+	}
+	if _, ok := entries["etc/secret"]; ok {
+		t.Errorf("skipped entry etc/secret was included in the layer")
+	}
+	if hdr, ok := entries["etc/setuid"]; !ok || hdr.Mode&04000 != 0 {
+		t.Errorf("etc/setuid was not included without its setuid bit: %v", hdr)
+	}
+	if hdr, ok := entries["etc/tsecret"]; !ok || hdr.Typeflag != tar.TypeReg || contents["etc/tsecret"] != "secret" {
+		t.Errorf("etc/tsecret was not included as a regular file: %v", hdr)
+	}
+}
+
+func TestGenerateLayerFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerFilters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	for _, path := range []string{"etc", "var/cache"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"etc/removed", "var/cache/old"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, path), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(rootfs, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"etc/removed", "var/cache/old"} {
+		if err := os.Remove(filepath.Join(rootfs, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"etc/config", "etc/config.swp", "var/cache/blob"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, path), []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	excludeCache, err := mtreefilter.ExcludeFilter([]string{"var/cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	excludeSwap := func(path string) bool {
+		return filepath.Ext(path) != ".swp"
+	}
+
+	reader, err := GenerateLayerWithOptions(context.Background(), rootfs, diffs, &GenerateOptions{
+		Filters: []mtreefilter.FilterFunc{excludeCache, excludeSwap},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	expected := []string{"etc/.wh.removed", "etc/", "etc/config"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("layer has unexpected entries: expected %v, got %v", expected, names)
+	}
+}
+
+func TestGenerateLayerTransformError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerTransformError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initDh, err := mtree.Walk(dir, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	postDh, err := mtree.Walk(dir, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		transform TarTransformFunc
+	}{
+		{"Error", func(hdr *tar.Header, content io.Reader) (io.Reader, error) {
+			return nil, fmt.Errorf("transform failed")
+		}},
+		{"WhiteoutPath", func(hdr *tar.Header, content io.Reader) (io.Reader, error) {
+			hdr.Name = ".wh.file"
+			return content, nil
+		}},
+		{"WrongSize", func(hdr *tar.Header, content io.Reader) (io.Reader, error) {
+			return bytes.NewReader([]byte("x")), nil
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := GenerateLayerWithOptions(context.Background(), dir, diffs, &GenerateOptions{Transform: test.transform})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			if _, err := ioutil.ReadAll(reader); err == nil {
+				t.Errorf("expected an error generating layer")
+			}
+		})
+	}
+}
+
+func TestGenerateLayerWhiteoutReplacedParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerWhiteoutReplacedParent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// makeLower creates the lower layer's rootfs.
+	makeLower := func(root string) {
+		for _, name := range []string{"link/file", "target/file", "file/child"} {
+			if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+	makeLower(rootfs)
+
+	initDh, err := mtree.Walk(rootfs, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the parent directories of the removed files with a symlink to
+	// another directory (containing a file with the same name), and with a
+	// regular file.
+	if err := os.RemoveAll(filepath.Join(rootfs, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", filepath.Join(rootfs, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(rootfs, "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte("now a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayer(context.Background(), rootfs, diffs, &MapOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	layer, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+
+	// Applying the layer to the lower layer must give the same rootfs.
+	unpacked := filepath.Join(dir, "unpacked")
+	makeLower(unpacked)
+	if err := UnpackLayer(unpacked, bytes.NewReader(layer), &MapOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(unpacked, "target", "file")); err != nil {
+		t.Errorf("file shadowed by the new symlink was removed: %v", err)
+	} else if string(data) != "target/file" {
+		t.Errorf("target/file has unexpected contents %q", data)
+	}
+	if target, err := os.Readlink(filepath.Join(unpacked, "link")); err != nil || target != "target" {
+		t.Errorf("link was not replaced by a symlink: %q %v", target, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(unpacked, "file")); err != nil || string(data) != "now a file" {
+		t.Errorf("file was not replaced by a regular file: %q %v", data, err)
+	}
+}
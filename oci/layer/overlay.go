@@ -0,0 +1,323 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/apex/log"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// OverlayOpaqueXattr is the xattr used by overlayfs to mark a directory in an
+// upper layer as opaque (hiding the contents of the directory in the lower
+// layers). It is the overlayfs equivalent of an opaque whiteout.
+const OverlayOpaqueXattr = overlayXattrPrefix + "opaque"
+
+// overlayXattrPrefix is the prefix of the xattrs used internally by
+// overlayfs. They are never included in generated layers.
+const overlayXattrPrefix = "trusted.overlay."
+
+// IsOverlayWhiteout returns whether fi describes an overlayfs whiteout, which
+// is a character device with device number 0:0.
+func IsOverlayWhiteout(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+// UnpackOverlayRootfs extracts each of the layers in the given manifest into
+// its own directory inside layersPath (named after the index of the layer in
+// the manifest), such that the directories can be used as the lower
+// directories of an overlayfs mount. Whiteouts are converted to their
+// overlayfs equivalents (see UnpackOverlayLayer). The indices of the layers
+// which were extracted are returned, from the bottom-most layer up.
+//
+// Overlay whiteouts can only be created by a privileged user, so rootless
+// unpacking is not supported. opt.StartFrom is also not supported, since every
+// layer needs its own directory.
+func UnpackOverlayRootfs(ctx context.Context, engine cas.Engine, layersPath string, manifest ispec.Manifest, opt *UnpackOptions) (_ []int, Err error) {
+	engineExt := casext.NewEngine(engine)
+	if opt == nil {
+		opt = &UnpackOptions{}
+	}
+	if opt.MapOptions.Rootless {
+		return nil, errors.Errorf("unpack overlay: rootless unpacking is not supported")
+	}
+	if opt.StartFrom.MediaType != "" {
+		return nil, errors.Errorf("unpack overlay: starting from a layer is not supported")
+	}
+
+	diffIDs, layers, err := manifestLayers(ctx, engineExt, manifest, opt)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		return nil, errors.Errorf("unpack overlay: image has no layers to use as lower directories")
+	}
+
+	if err := os.Mkdir(layersPath, 0700); err != nil {
+		return nil, errors.Wrap(err, "mkdir layers")
+	}
+	defer func() {
+		if Err != nil {
+			// It's too late to care about errors.
+			// #nosec G104
+			_ = fseval.DefaultFsEval.RemoveAll(layersPath)
+		}
+	}()
+
+	for _, idx := range layers {
+		layerDescriptor := manifest.Layers[idx]
+		layerPath := filepath.Join(layersPath, strconv.Itoa(idx))
+		log.Infof("unpack overlay layer: %s", layerDescriptor.Digest)
+
+		if err := initRootfs(layerPath, &opt.MapOptions); err != nil {
+			return nil, err
+		}
+		if err := unpackLayerBlob(ctx, engineExt, layerPath, layerDescriptor, diffIDs[idx], opt, unpackOverlayLayer); err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+// UnpackOverlayLayer is the same as UnpackDeltaLayer with
+// WhiteoutModeOverlayfs: ordinary whiteouts become character devices with
+// device number 0:0, and opaque whiteouts set OverlayOpaqueXattr on their
+// directory. root should be an empty directory, which can then be used as a
+// lower directory of an overlayfs mount above the directories of the previous
+// layers.
+func UnpackOverlayLayer(root string, layer io.Reader, opt *UnpackOptions) error {
+	if opt == nil {
+		opt = &UnpackOptions{}
+	}
+	return unpackOverlayLayer(context.Background(), root, layer, opt)
+}
+
+// unpackOverlayLayer is the same as UnpackOverlayLayer, except that it stops
+// extracting entries (returning the error of ctx) if ctx is cancelled.
+func unpackOverlayLayer(ctx context.Context, root string, layer io.Reader, opt *UnpackOptions) error {
+	overlayOpt := *opt
+	overlayOpt.WhiteoutMode = WhiteoutModeOverlayfs
+	return unpackDeltaLayer(ctx, root, layer, &overlayOpt)
+}
+
+// overlayWhiteout converts the given whiteout entry to an overlayfs whiteout
+// inside root. For opaque whiteouts, the directory is created (if necessary)
+// and its path is returned so that the caller can set OverlayOpaqueXattr on it
+// once the rest of the layer has been extracted.
+func (te *TarExtractor) overlayWhiteout(root string, hdr *tar.Header) (string, error) {
+	hdr.Name = CleanPath(hdr.Name)
+	unsafeDir, file := filepath.Split(hdr.Name)
+	if err := te.checkParents(root, unsafeDir); err != nil {
+		return "", errors.Wrapf(err, "unsafe path %s", hdr.Name)
+	}
+	dir, err := securejoin.SecureJoinVFS(root, unsafeDir, te.fsEval)
+	if err != nil {
+		return "", errors.Wrap(err, "sanitise symlinks in root")
+	}
+
+	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+		return "", errors.Wrap(err, "mkdir parent")
+	}
+	dirFi, err := te.fsEval.Lstat(dir)
+	if err != nil {
+		return "", errors.Wrap(err, "stat parent")
+	}
+
+	if file == whOpaque {
+		return dir, nil
+	}
+
+	path := filepath.Join(dir, strings.TrimPrefix(file, whPrefix))
+	if err := te.fsEval.RemoveAll(path); err != nil {
+		return "", errors.Wrap(err, "remove whited-out path")
+	}
+	if err := te.fsEval.Mknod(path, os.FileMode(unix.S_IFCHR), unix.Mkdev(0, 0)); err != nil {
+		return "", errors.Wrap(err, "mknod whiteout")
+	}
+
+	// Creating the whiteout modified the parent directory's mtime.
+	return "", errors.Wrap(te.fsEval.Lutimes(dir, dirFi.ModTime(), dirFi.ModTime()), "restore parent mtime")
+}
+
+// OverlayChanges returns the paths (relative to upper, and sorted) of all of
+// the entries in the given overlayfs upper directory, which are the changes
+// made to the overlay since it was mounted. Only the paths accepted by all of
+// opt.Filters (if any) are returned. Entries inside opaque directories and
+// directories which replaced a whiteout are included, as they are new.
+func OverlayChanges(upper string, opt *GenerateOptions) ([]string, error) {
+	var generateOpt GenerateOptions
+	if opt != nil {
+		generateOpt = *opt
+	}
+	fsEval := fseval.DefaultFsEval
+	if generateOpt.MapOptions.Rootless {
+		fsEval = fseval.RootlessFsEval
+	}
+
+	var changes []string
+	err := fsEval.Walk(upper, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(upper, path)
+		if err != nil {
+			return errors.Wrap(err, "get relative path")
+		}
+		if name == "." {
+			return nil
+		}
+		for _, filter := range generateOpt.Filters {
+			if !filter(name) {
+				return nil
+			}
+		}
+		changes = append(changes, name)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "walk upper directory")
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+// GenerateOverlayLayer creates a new OCI diff layer from the given changes
+// (as returned by OverlayChanges) in the overlayfs upper directory upper. This
+// avoids having to compute a diff of the whole root filesystem, because the
+// upper directory only contains the changed files. Overlay whiteouts are
+// converted to whiteouts, and opaque directories (see OverlayOpaqueXattr) get
+// an opaque whiteout. As with GenerateLayer, all of the whiteouts are written
+// before any of the other entries, the returned reader is for the *raw* tar
+// data, and reading from it fails with the error of ctx if ctx is cancelled.
+func GenerateOverlayLayer(ctx context.Context, upper string, changes []string, opt *GenerateOptions) (io.ReadCloser, error) {
+	var generateOpt GenerateOptions
+	if opt != nil {
+		generateOpt = *opt
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() (Err error) {
+		// Close with the returned error.
+		defer func() {
+			// #nosec G104
+			_ = writer.CloseWithError(errors.Wrap(Err, "generate overlay layer"))
+		}()
+
+		tg := newTarGenerator(writer, generateOpt)
+
+		// Figure out how much data we need to write, so that progress can be
+		// reported as a fraction of the total.
+		var done, total int64
+		if generateOpt.Progress != nil {
+			for _, name := range changes {
+				total += regularFileSize(tg.fsEval, filepath.Join(upper, name))
+			}
+		}
+
+		whiteouts := map[string]struct{}{}
+		for _, name := range changes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			fullPath := filepath.Join(upper, name)
+			fi, err := tg.fsEval.Lstat(fullPath)
+			if err != nil {
+				return errors.Wrap(err, "lstat upper entry")
+			}
+			switch {
+			case IsOverlayWhiteout(fi):
+				whiteouts[name] = struct{}{}
+				if err := tg.AddWhiteout(name); err != nil {
+					return errors.Wrap(err, "generate whiteout layer file")
+				}
+			case fi.IsDir():
+				if opaque, err := tg.fsEval.Lgetxattr(fullPath, OverlayOpaqueXattr); err == nil && string(opaque) == "y" {
+					if err := tg.AddOpaqueWhiteout(name); err != nil {
+						return errors.Wrap(err, "generate opaque whiteout layer file")
+					}
+				}
+			}
+		}
+
+		for _, name := range changes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, ok := whiteouts[name]; ok {
+				continue
+			}
+
+			fullPath := filepath.Join(upper, name)
+			if err := tg.AddFile(name, fullPath); err != nil {
+				log.Warnf("generate overlay layer: could not add file '%s': %s", name, err)
+				return errors.Wrap(err, "generate layer file")
+			}
+			if generateOpt.Progress != nil {
+				done += regularFileSize(tg.fsEval, fullPath)
+				generateOpt.Progress(done, total, name)
+			}
+		}
+
+		if err := tg.tw.Close(); err != nil {
+			log.Warnf("generate overlay layer: could not close tar.Writer: %s", err)
+			return errors.Wrap(err, "close tar writer")
+		}
+		return nil
+	}()
+
+	return reader, nil
+}
+
+// addOverlayFile is the same as AddFile, except that overlayfs whiteouts are
+// added as whiteouts, and opaque directories (see OverlayOpaqueXattr) get an
+// opaque whiteout after their own entry.
+func (tg *tarGenerator) addOverlayFile(name, path string, fi os.FileInfo) error {
+	if IsOverlayWhiteout(fi) {
+		return errors.Wrap(tg.AddWhiteout(name), "generate whiteout layer file")
+	}
+	if err := tg.AddFile(name, path); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if opaque, err := tg.fsEval.Lgetxattr(path, OverlayOpaqueXattr); err == nil && string(opaque) == "y" {
+			return errors.Wrap(tg.AddOpaqueWhiteout(name), "generate opaque whiteout layer file")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+func TestUnpackOverlayLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Log("overlay whiteouts can only be created with root privileges")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackOverlayLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Opaque whiteouts are generated before the entry for their directory,
+	// and regular whiteouts may not have an entry for their directory.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "usr/bin/.wh.ls", Typeflag: tar.TypeReg},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("root\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "layer")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnpackOverlayLayer(root, &buf, &UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking overlay layer: %+v", err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(root, "usr", "bin", "ls"))
+	if err != nil {
+		t.Fatalf("whiteout not extracted: %v", err)
+	}
+	if !IsOverlayWhiteout(fi) {
+		t.Errorf("whiteout was not converted to an overlay whiteout: mode=%v", fi.Mode())
+	}
+	if _, err := os.Lstat(filepath.Join(root, "usr", "bin", ".wh.ls")); !os.IsNotExist(err) {
+		t.Errorf("whiteout file should not be extracted verbatim: %v", err)
+	}
+
+	opaque, err := system.Lgetxattr(filepath.Join(root, "etc"), OverlayOpaqueXattr)
+	if err != nil {
+		t.Fatalf("opaque whiteout not converted to xattr: %v", err)
+	}
+	if string(opaque) != "y" {
+		t.Errorf("unexpected opaque xattr value: %q", opaque)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "etc", whOpaque)); !os.IsNotExist(err) {
+		t.Errorf("opaque whiteout file should not be extracted verbatim: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "etc", "passwd")); err != nil || string(data) != "root\n" {
+		t.Errorf("regular file not extracted correctly: %q (%v)", data, err)
+	}
+}
+
+func TestGenerateOverlayLayer(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Log("overlay whiteouts can only be created with root privileges")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateOverlayLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Lay out an upper directory the way overlayfs would after a file is
+	// removed, a directory is replaced, and a file is added.
+	upper := filepath.Join(dir, "upper")
+	for _, path := range []string{"a/b", "etc", "usr/bin"} {
+		if err := os.MkdirAll(filepath.Join(upper, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unix.Mknod(filepath.Join(upper, "usr", "bin", "ls"), unix.S_IFCHR, int(unix.Mkdev(0, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(upper, "etc"), OverlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upper, "etc", "passwd"), []byte("root\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// overlayfs sets other internal xattrs on copied-up files.
+	if err := unix.Lsetxattr(filepath.Join(upper, "etc", "passwd"), overlayXattrPrefix+"origin", []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := OverlayChanges(upper, &GenerateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting overlay changes: %+v", err)
+	}
+	expectedChanges := []string{"a", "a/b", "etc", "etc/passwd", "usr", "usr/bin", "usr/bin/ls"}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Fatalf("unexpected overlay changes: expected %v got %v", expectedChanges, changes)
+	}
+
+	reader, err := GenerateOverlayLayer(context.Background(), upper, changes, &GenerateOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error generating overlay layer: %+v", err)
+	}
+	defer reader.Close()
+
+	var names []string
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+		for name := range hdr.Xattrs {
+			if strings.HasPrefix(name, overlayXattrPrefix) {
+				t.Errorf("%s: overlay xattr %s included in layer", hdr.Name, name)
+			}
+		}
+	}
+
+	// Whiteouts come first, and the overlay whiteout itself isn't included.
+	expectedNames := []string{"etc/.wh..wh..opq", "usr/bin/.wh.ls", "a/", "a/b/", "etc/", "etc/passwd", "usr/", "usr/bin/"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("unexpected layer entries: expected %v got %v", expectedNames, names)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// PermPolicy is a set of mode bits which must never be set on the entries of
+// a generated layer. Any offending bits are cleared from the tar headers as
+// the layer is generated. The zero value is a no-op policy.
+type PermPolicy struct {
+	// Mask is the set of mode bits (in the same form as tar.Header.Mode)
+	// which will be cleared.
+	Mask int64
+}
+
+// permPolicyRules are the named rules accepted by ParsePermPolicy.
+var permPolicyRules = map[string]int64{
+	"no-setuid":      04000,
+	"no-setgid":      02000,
+	"no-sticky":      01000,
+	"no-user-read":   00400,
+	"no-user-write":  00200,
+	"no-user-exec":   00100,
+	"no-group-read":  00040,
+	"no-group-write": 00020,
+	"no-group-exec":  00010,
+	"no-other-read":  00004,
+	"no-other-write": 00002,
+	"no-other-exec":  00001,
+}
+
+// ParsePermPolicy parses a comma-separated list of rules into a PermPolicy.
+// Each rule is either the name of a rule (such as "no-group-write") or an
+// octal mask of bits to clear (such as "0022").
+func ParsePermPolicy(policy string) (PermPolicy, error) {
+	var pp PermPolicy
+	for _, rule := range strings.Split(policy, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if mask, ok := permPolicyRules[rule]; ok {
+			pp.Mask |= mask
+			continue
+		}
+		mask, err := strconv.ParseInt(rule, 8, 64)
+		if err != nil || mask < 0 || mask > 07777 {
+			return PermPolicy{}, errors.Errorf("invalid permission policy rule: %q", rule)
+		}
+		pp.Mask |= mask
+	}
+	return pp, nil
+}
+
+// apply clears any mode bits of hdr disallowed by the policy, logging each
+// adjustment made. Symlinks and hardlinks are left alone, since their mode
+// bits are meaningless.
+func (pp PermPolicy) apply(hdr *tar.Header) {
+	if pp.Mask == 0 || hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+		return
+	}
+	if newMode := hdr.Mode &^ pp.Mask; newMode != hdr.Mode {
+		log.WithFields(log.Fields{
+			"path":     hdr.Name,
+			"old_mode": strconv.FormatInt(hdr.Mode&07777, 8),
+			"new_mode": strconv.FormatInt(newMode&07777, 8),
+		}).Infof("perm-policy: adjusted mode of %s", hdr.Name)
+		hdr.Mode = newMode
+	}
+}
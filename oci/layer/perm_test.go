@@ -0,0 +1,150 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePermPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		mask   int64
+		fail   bool
+	}{
+		{policy: "", mask: 0},
+		{policy: "no-group-write", mask: 00020},
+		{policy: "no-group-write,no-other-write", mask: 00022},
+		{policy: " no-setuid , no-setgid ", mask: 06000},
+		{policy: "0022", mask: 00022},
+		{policy: "no-other-write,0070", mask: 00072},
+		{policy: "no-such-rule", fail: true},
+		{policy: "0999", fail: true},
+		{policy: "017777", fail: true},
+	} {
+		pp, err := ParsePermPolicy(test.policy)
+		if test.fail {
+			if err == nil {
+				t.Errorf("ParsePermPolicy(%q): expected error, got mask %o", test.policy, pp.Mask)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePermPolicy(%q): unexpected error: %+v", test.policy, err)
+			continue
+		}
+		if pp.Mask != test.mask {
+			t.Errorf("ParsePermPolicy(%q): expected mask %o, got %o", test.policy, test.mask, pp.Mask)
+		}
+	}
+}
+
+func TestTarGenerateAddFilePermPolicy(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateAddFilePermPolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []struct {
+		name     string
+		mode     os.FileMode
+		expected int64
+	}{
+		{name: "dir", mode: os.ModeDir | 0777, expected: 0755},
+		{name: "dir/file", mode: 0666, expected: 0644},
+		{name: "dir/exec", mode: 0751, expected: 0751},
+		{name: "dir/setuid", mode: os.ModeSetuid | 0776, expected: 04754},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if file.mode.IsDir() {
+			err = os.Mkdir(path, file.mode.Perm())
+		} else {
+			err = ioutil.WriteFile(path, []byte("file contents"), file.mode.Perm())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, file.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("file", filepath.Join(dir, "dir", "symlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := ParsePermPolicy("no-group-write,no-other-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := newTarGenerator(writer, GenerateOptions{PermPolicy: policy})
+	tr := tar.NewReader(reader)
+
+	// Create all of the tar entries in a goroutine so we can parse the tar
+	// entries as they're generated (io.Pipe pipes are unbuffered).
+	go func() {
+		for _, file := range files {
+			if err := tg.AddFile(file.name, filepath.Join(dir, file.name)); err != nil {
+				t.Errorf("AddFile: %s: unexpected error: %s", file.name, err)
+			}
+		}
+		if err := tg.AddFile("dir/symlink", filepath.Join(dir, "dir", "symlink")); err != nil {
+			t.Errorf("AddFile: dir/symlink: unexpected error: %s", err)
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Errorf("tw.Close: unexpected error: %s", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("writer.Close: unexpected error: %s", err)
+		}
+	}()
+
+	for _, file := range files {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if hdr.Mode&07777 != file.expected {
+			t.Errorf("%s: unexpected mode: expected %o, got %o", file.name, file.expected, hdr.Mode&07777)
+		}
+	}
+
+	// Symlinks must be left alone.
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar archive: %s", err)
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		t.Fatalf("expected symlink entry, got type %q", hdr.Typeflag)
+	}
+	if hdr.Mode&0777 != 0777 {
+		t.Errorf("symlink mode was modified: got %o", hdr.Mode&07777)
+	}
+
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected no more entries, err=%s", err)
+	}
+}
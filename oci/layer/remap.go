@@ -0,0 +1,100 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+
+	"github.com/openSUSE/umoci/pkg/idtools"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// RemapOptions describes how RemapLayer rewrites the ownership of entries.
+type RemapOptions struct {
+	// UIDMappings and GIDMappings are the mappings applied to the owner of
+	// every entry. The ContainerID of each mapping is the ID in the original
+	// layer, and the HostID is the ID it is rewritten to. If no mappings are
+	// provided, the corresponding IDs are left unchanged.
+	UIDMappings []rspec.LinuxIDMapping
+	GIDMappings []rspec.LinuxIDMapping
+
+	// KeepUnmapped leaves the owner of entries with an ID that is not covered
+	// by the mappings unchanged, rather than returning an error.
+	KeepUnmapped bool
+}
+
+// remapID applies the given mapping to id. If the id is not covered by the
+// mapping it is returned unchanged if keepUnmapped is set.
+func remapID(id int, idMap []rspec.LinuxIDMapping, keepUnmapped bool) (int, error) {
+	newID, err := idtools.ToHost(id, idMap)
+	if err != nil {
+		if keepUnmapped {
+			return id, nil
+		}
+		return -1, err
+	}
+	return newID, nil
+}
+
+// RemapLayer copies the uncompressed layer read from r to w, rewriting the
+// owner of every entry according to opt. Since the user and group names of
+// remapped entries are unlikely to still be correct, they are cleared. The
+// contents of every entry are copied unmodified.
+func RemapLayer(r io.Reader, w io.Writer, opt RemapOptions) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		uid, err := remapID(hdr.Uid, opt.UIDMappings, opt.KeepUnmapped)
+		if err != nil {
+			return errors.Wrapf(err, "remap uid of %s", hdr.Name)
+		}
+		gid, err := remapID(hdr.Gid, opt.GIDMappings, opt.KeepUnmapped)
+		if err != nil {
+			return errors.Wrapf(err, "remap gid of %s", hdr.Name)
+		}
+		if uid != hdr.Uid {
+			hdr.Uid, hdr.Uname = uid, ""
+		}
+		if gid != hdr.Gid {
+			hdr.Gid, hdr.Gname = gid, ""
+		}
+		// The ownership is entirely described by the header fields, so make
+		// sure that stale PAX records don't override them.
+		for _, key := range []string{"uid", "gid", "uname", "gname"} {
+			delete(hdr.PAXRecords, key)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write header %s", hdr.Name)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrapf(err, "write contents %s", hdr.Name)
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
@@ -0,0 +1,103 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestRemapLayer(t *testing.T) {
+	headers := []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "root/", Mode: 0700, Uid: 0, Gid: 0, Uname: "root", Gname: "root"},
+		{Typeflag: tar.TypeReg, Name: "root/file", Mode: 0644, Uid: 0, Gid: 100, Uname: "root", Gname: "users", Size: 8},
+		{Typeflag: tar.TypeSymlink, Name: "user", Linkname: "root/file", Uid: 1000, Gid: 1000},
+		{Typeflag: tar.TypeReg, Name: "nobody", Mode: 0644, Uid: 65534, Gid: 65534, Uname: "nobody", Gname: "nogroup"},
+	}
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for _, hdr := range headers {
+		hdr := hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(make([]byte, hdr.Size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := RemapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 1000}},
+	}
+
+	// 1000 and 65534 are not covered by the gid mapping.
+	if err := RemapLayer(bytes.NewReader(layer.Bytes()), ioutil.Discard, opt); err == nil {
+		t.Errorf("expected error remapping entries with unmapped gids")
+	}
+
+	opt.KeepUnmapped = true
+	var remapped bytes.Buffer
+	if err := RemapLayer(bytes.NewReader(layer.Bytes()), &remapped, opt); err != nil {
+		t.Fatalf("unexpected error remapping layer: %+v", err)
+	}
+
+	expected := []struct {
+		uid, gid     int
+		uname, gname string
+	}{
+		{uid: 100000, gid: 200000},
+		{uid: 100000, gid: 200100},
+		{uid: 101000, gid: 1000},
+		{uid: 165534, gid: 65534, gname: "nogroup"},
+	}
+	tr := tar.NewReader(&remapped)
+	for idx := 0; ; idx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if idx != len(expected) {
+				t.Errorf("expected %d entries, got %d", len(expected), idx)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("remapped layer is not a valid tar archive: %+v", err)
+		}
+		if idx >= len(expected) {
+			t.Fatalf("unexpected extra entry %s", hdr.Name)
+		}
+		if hdr.Name != headers[idx].Name || hdr.Size != headers[idx].Size || hdr.Linkname != headers[idx].Linkname {
+			t.Errorf("%s: entry was modified: %#v", headers[idx].Name, hdr)
+		}
+		want := expected[idx]
+		if hdr.Uid != want.uid || hdr.Gid != want.gid {
+			t.Errorf("%s: unexpected owner: expected %d:%d, got %d:%d", hdr.Name, want.uid, want.gid, hdr.Uid, hdr.Gid)
+		}
+		if hdr.Uname != want.uname || hdr.Gname != want.gname {
+			t.Errorf("%s: unexpected owner names: expected %q:%q, got %q:%q", hdr.Name, want.uname, want.gname, hdr.Uname, hdr.Gname)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/pkg/errors"
+)
+
+// sparseBlockSize is the granularity at which zeroes are turned into holes
+// when extracting a file with UnpackOptions.Sparse.
+const sparseBlockSize = 4096
+
+// sparsePAXPlaceholder is used in place of the "GNU.sparse." prefix for the
+// PAX records of sparse entries, because archive/tar silently drops any
+// GNU.sparse.* records given to it (it doesn't support writing sparse files).
+// The placeholder has the same length as the real prefix, so it can be
+// replaced in the encoded PAX header without changing the record lengths.
+const (
+	sparsePAXPrefix      = "GNU.sparse."
+	sparsePAXPlaceholder = "UMO.sparse."
+)
+
+// hasHoles returns whether the given data regions of a file of the given size
+// leave any holes in the file.
+func hasHoles(regions []system.Region, size int64) bool {
+	var total int64
+	for _, region := range regions {
+		total += region.Length
+	}
+	return total < size
+}
+
+// encodeSparseMap encodes the given data regions as a PAX 1.0 sparse map,
+// padded to a multiple of the tar block size.
+func encodeSparseMap(regions []system.Region) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n", len(regions))
+	for _, region := range regions {
+		fmt.Fprintf(&buf, "%d\n%d\n", region.Offset, region.Length)
+	}
+	if pad := buf.Len() % 512; pad != 0 {
+		buf.Write(make([]byte, 512-pad))
+	}
+	return buf.Bytes()
+}
+
+// replacePAXPrefix replaces the prefix old with new (which must be the same
+// length) in the keys of the PAX records in the given encoded header, which
+// consists of an extended header block, the records and the main header
+// block.
+func replacePAXPrefix(raw []byte, old, new string) error {
+	if len(raw) < 3*512 || len(old) != len(new) {
+		return errors.Errorf("unexpected pax header layout")
+	}
+	records := raw[512 : len(raw)-512]
+	for len(records) > 0 && records[0] != 0 {
+		// Each record is "<length> <key>=<value>\n".
+		sp := bytes.IndexByte(records, ' ')
+		if sp < 0 {
+			return errors.Errorf("invalid pax record")
+		}
+		n, err := strconv.Atoi(string(records[:sp]))
+		if err != nil || n <= sp || n > len(records) {
+			return errors.Errorf("invalid pax record length")
+		}
+		if key := records[sp+1 : n]; bytes.HasPrefix(key, []byte(old)) {
+			copy(key, new)
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// addSparseFile writes hdr to the layer as a PAX 1.0 sparse entry (the same
+// format used by GNU tar with --sparse --sparse-version=1.0), containing only
+// the given data regions of fh. Readers which support sparse entries
+// (including archive/tar) see the entry as a regular file with the contents
+// of fh.
+func (tg *tarGenerator) addSparseFile(hdr *tar.Header, fh *os.File, regions []system.Region) error {
+	// GNU tar always terminates the sparse map with the end of the file.
+	size := hdr.Size
+	if n := len(regions); n == 0 || regions[n-1].Offset+regions[n-1].Length < size {
+		regions = append(regions, system.Region{Offset: size, Length: 0})
+	}
+	sparseMap := encodeSparseMap(regions)
+
+	sparseHdr := *hdr
+	dir, file := path.Split(hdr.Name)
+	sparseHdr.Name = path.Join(dir, "GNUSparseFile.0", file)
+	if sparseHdr.Format == tar.FormatUnknown {
+		// Match what tg.tw does for entries without an explicit format.
+		sparseHdr.ModTime = sparseHdr.ModTime.Round(time.Second)
+		sparseHdr.AccessTime = time.Time{}
+		sparseHdr.ChangeTime = time.Time{}
+	}
+	sparseHdr.Format = tar.FormatPAX
+	sparseHdr.Size = int64(len(sparseMap))
+	for _, region := range regions {
+		sparseHdr.Size += region.Length
+	}
+	sparseHdr.PAXRecords = map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		sparseHdr.PAXRecords[k] = v
+	}
+	for k, v := range map[string]string{
+		"major":    "1",
+		"minor":    "0",
+		"name":     hdr.Name,
+		"realsize": strconv.FormatInt(size, 10),
+	} {
+		sparseHdr.PAXRecords[sparsePAXPlaceholder+k] = v
+	}
+
+	// Encode the header, and fix up the placeholder records.
+	var raw bytes.Buffer
+	if err := tar.NewWriter(&raw).WriteHeader(&sparseHdr); err != nil {
+		return errors.Wrap(err, "encode sparse header")
+	}
+	if err := replacePAXPrefix(raw.Bytes(), sparsePAXPlaceholder, sparsePAXPrefix); err != nil {
+		return errors.Wrap(err, "encode sparse header")
+	}
+
+	// Write the entry directly to the layer, bypassing tg.tw (which must be
+	// flushed first so that the previous entry is padded).
+	if err := tg.tw.Flush(); err != nil {
+		return errors.Wrap(err, "flush layer")
+	}
+	if _, err := tg.w.Write(raw.Bytes()); err != nil {
+		return errors.Wrap(err, "write sparse header")
+	}
+	if _, err := tg.w.Write(sparseMap); err != nil {
+		return errors.Wrap(err, "write sparse map")
+	}
+	for _, region := range regions {
+		n, err := io.Copy(tg.w, io.NewSectionReader(fh, region.Offset, region.Length))
+		if err != nil {
+			return errors.Wrap(err, "copy to layer")
+		}
+		if n != region.Length {
+			return errors.Wrap(io.ErrShortWrite, "copy to layer")
+		}
+	}
+	if pad := sparseHdr.Size % 512; pad != 0 {
+		if _, err := tg.w.Write(make([]byte, 512-pad)); err != nil {
+			return errors.Wrap(err, "pad sparse entry")
+		}
+	}
+	return nil
+}
+
+// copySparse copies the contents of r to fh (which must be empty), creating
+// holes in fh rather than writing blocks which consist entirely of zeroes.
+// Returns the number of bytes copied (including the holes).
+func copySparse(fh *os.File, r io.Reader) (int64, error) {
+	var (
+		total int64
+		hole  bool
+		zero  = make([]byte, sparseBlockSize)
+		buf   = make([]byte, sparseBlockSize)
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := fh.Seek(int64(n), io.SeekCurrent); err != nil {
+					return total, err
+				}
+				hole = true
+			} else {
+				if _, err := fh.Write(buf[:n]); err != nil {
+					return total, err
+				}
+				hole = false
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return total, err
+		}
+	}
+	// A trailing hole needs the file to be extended explicitly.
+	if hole {
+		if err := fh.Truncate(total); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,237 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/pkg/system"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// makeSparseFile creates a file of the given size at path, which only has
+// data (of the given byte) in the given regions.
+func makeSparseFile(t *testing.T, path string, size int64, regions []system.Region, b byte) {
+	fh, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	for _, region := range regions {
+		if _, err := fh.WriteAt(bytes.Repeat([]byte{b}, int(region.Length)), region.Offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fh.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// allocatedSize returns the number of bytes allocated on disk for path.
+func allocatedSize(t *testing.T, path string) int64 {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks * 512
+}
+
+func TestGenerateLayerSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateLayerSparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "var", "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get initial.
+	initDh, err := mtree.Walk(rootfs, nil, append(mtree.DefaultKeywords, "sha256digest"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const size = 64 << 20
+	sparsePath := filepath.Join(rootfs, "var", "lib", "disk.img")
+	makeSparseFile(t, sparsePath, size, []system.Region{
+		{Offset: 0, Length: 4096},
+		{Offset: 32 << 20, Length: 1 << 20},
+	}, 'x')
+	fh, err := os.Open(sparsePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regions, err := system.DataRegions(fh, size)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasHoles(regions, size) {
+		t.Skip("filesystem does not support SEEK_DATA and SEEK_HOLE")
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "var", "lib", "small"), []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get post.
+	postDh, err := mtree.Walk(rootfs, nil, initDh.UsedKeywords(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := mtree.Compare(initDh, postDh, initDh.UsedKeywords())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := GenerateLayerWithOptions(context.Background(), rootfs, diffs, &GenerateOptions{Sparse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	layer, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %+v", err)
+	}
+	if len(layer) > 4<<20 {
+		t.Errorf("layer containing sparse file is too large: %d bytes", len(layer))
+	}
+
+	// The sparse entry must look like a regular file to readers.
+	expected, err := ioutil.ReadFile(sparsePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %+v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %+v", hdr.Name, err)
+		}
+		if int64(len(data)) != hdr.Size {
+			t.Errorf("%s has size %d but %d bytes of contents", hdr.Name, hdr.Size, len(data))
+		}
+		entries[hdr.Name] = data
+	}
+	if data, ok := entries["var/lib/disk.img"]; !ok {
+		t.Errorf("sparse file is missing from layer: %v", entries)
+	} else if !bytes.Equal(data, expected) {
+		t.Errorf("sparse file has unexpected contents")
+	}
+	if data := entries["var/lib/small"]; string(data) != "small" {
+		t.Errorf("var/lib/small has unexpected contents %q", data)
+	}
+
+	// Extracting the layer sparsely must give the same (sparse) file.
+	unpacked := filepath.Join(dir, "unpacked")
+	if err := os.MkdirAll(unpacked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unpackLayer(context.Background(), unpacked, bytes.NewReader(layer), &UnpackOptions{Sparse: true}); err != nil {
+		t.Fatalf("unexpected error unpacking layer: %+v", err)
+	}
+	unpackedPath := filepath.Join(unpacked, "var", "lib", "disk.img")
+	data, err := ioutil.ReadFile(unpackedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("extracted sparse file has unexpected contents")
+	}
+	if allocated := allocatedSize(t, unpackedPath); allocated >= size/2 {
+		t.Errorf("extracted file is not sparse: %d bytes allocated", allocated)
+	}
+}
+
+func TestUnpackLayerSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackLayerSparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A regular (non-sparse) entry with large runs of zeroes, including a
+	// trailing run and a partial final block.
+	const size = 8<<20 + 100
+	contents := make([]byte, size)
+	copy(contents[4<<20:], bytes.Repeat([]byte{'x'}, 10000))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "zeroes",
+		Mode:     0644,
+		Size:     size,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := buf.Bytes()
+
+	for _, test := range []struct {
+		name   string
+		sparse bool
+	}{
+		{"Sparse", true},
+		{"Dense", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root := filepath.Join(dir, test.name)
+			if err := os.MkdirAll(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := unpackLayer(context.Background(), root, bytes.NewReader(layer), &UnpackOptions{Sparse: test.sparse}); err != nil {
+				t.Fatalf("unexpected error unpacking layer: %+v", err)
+			}
+			path := filepath.Join(root, "zeroes")
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, contents) {
+				t.Errorf("extracted file has unexpected contents")
+			}
+			if allocated := allocatedSize(t, path); test.sparse && allocated >= size/2 {
+				t.Errorf("extracted file is not sparse: %d bytes allocated", allocated)
+			}
+		})
+	}
+}
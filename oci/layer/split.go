@@ -0,0 +1,206 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// tarBlockSize is the size of a tar block. Headers and file contents are both
+// padded to a multiple of the block size.
+const tarBlockSize = 512
+
+// MinSplitSize is the smallest maximum size accepted by SplitLayer. It is the
+// size of a (single block) header together with the end-of-archive marker, so
+// each layer can hold at least one entry.
+const MinSplitSize = 3 * tarBlockSize
+
+// countingWriter is an io.Writer which counts the number of bytes written to
+// the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes p to the underlying writer.
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// entrySize returns the number of bytes the entry with the given header takes
+// up in a tar archive, including any extended headers and the padded contents.
+func entrySize(hdr *tar.Header) (int64, error) {
+	cw := &countingWriter{w: ioutil.Discard}
+	if err := tar.NewWriter(cw).WriteHeader(hdr); err != nil {
+		return 0, err
+	}
+	size := hdr.Size
+	if rem := size % tarBlockSize; rem != 0 {
+		size += tarBlockSize - rem
+	}
+	return cw.n + size, nil
+}
+
+// isWhiteoutEntry returns whether the entry with the given name is a whiteout
+// (including opaque whiteouts).
+func isWhiteoutEntry(name string) bool {
+	return strings.HasPrefix(path.Base(path.Clean(name)), whPrefix)
+}
+
+// SplitLayer splits the uncompressed layer read from reader into a sequence
+// of layers, each of which is at most maxSize bytes (uncompressed). The layer
+// is only split at entry boundaries, so an entry which is larger than maxSize
+// by itself is placed in a layer of its own (which will be larger than
+// maxSize). fn is called with each of the new layers in order, and must read
+// the layer in its entirety before returning.
+//
+// Applying the new layers in order is equivalent to applying the original
+// layer, provided that no whiteout in the original layer follows a
+// non-whiteout entry which ends up in an earlier layer. Otherwise the whiteout
+// could remove (or be resolved through) that entry. Layers created with
+// GenerateLayer always have their whiteouts before any other entries, but if
+// a layer would be split in such a way, an error is returned.
+func SplitLayer(ctx context.Context, reader io.Reader, maxSize int64, fn func(segment io.Reader) error) error {
+	if maxSize < MinSplitSize {
+		return errors.Errorf("maximum layer size must be at least %d bytes", MinSplitSize)
+	}
+
+	tr := tar.NewReader(reader)
+	next, err := tr.Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read next entry")
+	}
+
+	type segmentResult struct {
+		next    *tar.Header
+		content bool
+		err     error
+	}
+
+	// Whether any of the previous layers contained non-whiteout entries.
+	var afterContent bool
+	for idx := 1; next != nil; idx++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		pr, pw := io.Pipe()
+		resultCh := make(chan segmentResult, 1)
+		go func(first *tar.Header, afterContent bool) {
+			var res segmentResult
+			res.next, res.content, res.err = writeSegment(ctx, pw, tr, first, maxSize, afterContent)
+			// #nosec G104
+			_ = pw.CloseWithError(res.err)
+			resultCh <- res
+		}(next, afterContent)
+
+		if err := fn(pr); err != nil {
+			// Unblock the writer, so the goroutine doesn't leak.
+			// #nosec G104
+			_ = pr.CloseWithError(err)
+			<-resultCh
+			return errors.Wrapf(err, "add layer segment %d", idx)
+		}
+		// fn should have read everything, but make sure we don't block the
+		// writer if it didn't.
+		if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+			<-resultCh
+			return errors.Wrapf(err, "generate layer segment %d", idx)
+		}
+		res := <-resultCh
+		if res.err != nil {
+			return errors.Wrapf(res.err, "generate layer segment %d", idx)
+		}
+		log.Debugf("split layer: wrote layer segment %d", idx)
+
+		afterContent = afterContent || res.content
+		next = res.next
+	}
+	return nil
+}
+
+// writeSegment writes hdr and as many of the following entries from tr as fit
+// within maxSize bytes to w as a tar archive. It returns the header of the
+// first entry which didn't fit (or nil if tr has been exhausted), and whether
+// any non-whiteout entries were written. afterContent indicates whether any
+// of the previous segments contained non-whiteout entries.
+func writeSegment(ctx context.Context, w io.Writer, tr *tar.Reader, hdr *tar.Header, maxSize int64, afterContent bool) (*tar.Header, bool, error) {
+	tw := tar.NewWriter(w)
+
+	// The end-of-archive marker is two zero blocks.
+	size := int64(2 * tarBlockSize)
+	var entries int
+	var content bool
+	for hdr != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+
+		hdrSize, err := entrySize(hdr)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "compute size of entry %s", hdr.Name)
+		}
+		if size+hdrSize > maxSize {
+			if entries > 0 {
+				break
+			}
+			log.Warnf("split layer: entry %s (%d bytes) is larger than the maximum layer size", hdr.Name, hdrSize)
+		}
+
+		if isWhiteoutEntry(hdr.Name) {
+			if afterContent {
+				return nil, false, errors.Errorf("whiteout %s would be applied after entries in an earlier layer segment", hdr.Name)
+			}
+		} else {
+			content = true
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, false, errors.Wrapf(err, "write header for %s", hdr.Name)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return nil, false, errors.Wrapf(err, "copy contents of %s", hdr.Name)
+		}
+		entries++
+		size += hdrSize
+
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			hdr = nil
+		} else if err != nil {
+			return nil, false, errors.Wrap(err, "read next entry")
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, false, errors.Wrap(err, "close tar writer")
+	}
+	return hdr, content, nil
+}
@@ -0,0 +1,171 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// makeTarLayer returns an uncompressed tar archive containing the given
+// entries.
+func makeTarLayer(t *testing.T, entries []catEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.data)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header %s: %v", entry.name, err)
+		}
+		if _, err := io.WriteString(tw, entry.data); err != nil {
+			t.Fatalf("write data %s: %v", entry.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSplitLayer(t *testing.T) {
+	big := strings.Repeat("x", 3*tarBlockSize)
+	layer := makeTarLayer(t, []catEntry{
+		{name: "etc/" + whOpaque, typeflag: tar.TypeReg},
+		{name: "dir", typeflag: tar.TypeReg},
+		{name: whPrefix + "removed", typeflag: tar.TypeReg},
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a", typeflag: tar.TypeReg, data: "a"},
+		{name: "dir/big", typeflag: tar.TypeReg, data: big + big},
+		{name: "dir/b", typeflag: tar.TypeReg, data: "b"},
+		{name: "dir/link", typeflag: tar.TypeLink, linkname: "dir/a"},
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/file", typeflag: tar.TypeReg, data: big},
+	})
+
+	maxSize := int64(8 * tarBlockSize)
+	var segments [][]string
+	var contents = map[string]string{}
+	if err := SplitLayer(context.Background(), bytes.NewReader(layer), maxSize, func(segment io.Reader) error {
+		data, err := ioutil.ReadAll(segment)
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			names = append(names, hdr.Name)
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			contents[hdr.Name] = string(content)
+		}
+		if int64(len(data)) > maxSize && len(names) > 1 {
+			t.Errorf("segment %d is %d bytes (larger than %d) with %d entries", len(segments)+1, len(data), maxSize, len(names))
+		}
+		segments = append(segments, names)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error splitting layer: %+v", err)
+	}
+
+	// The three whiteouts and "dir/" fit into the first segment, the big
+	// file is larger than maxSize and so gets a segment of its own.
+	expected := [][]string{
+		{"etc/" + whOpaque, "dir", whPrefix + "removed", "dir/", "dir/a"},
+		{"dir/big"},
+		{"dir/b", "dir/link", "etc/"},
+		{"etc/file"},
+	}
+	if len(segments) != len(expected) {
+		t.Fatalf("expected %d segments, got %d: %v", len(expected), len(segments), segments)
+	}
+	for idx, names := range segments {
+		if strings.Join(names, ",") != strings.Join(expected[idx], ",") {
+			t.Errorf("segment %d: expected entries %v, got %v", idx+1, expected[idx], names)
+		}
+	}
+	if contents["dir/big"] != big+big {
+		t.Errorf("contents of dir/big were not preserved")
+	}
+	if contents["etc/file"] != big {
+		t.Errorf("contents of etc/file were not preserved")
+	}
+}
+
+func TestSplitLayerWhiteoutAfterContent(t *testing.T) {
+	big := strings.Repeat("x", 4*tarBlockSize)
+	layer := makeTarLayer(t, []catEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/file", typeflag: tar.TypeReg, data: big},
+		{name: "dir/" + whPrefix + "file", typeflag: tar.TypeReg},
+	})
+
+	// A whiteout in a later segment than a regular entry could remove that
+	// entry, so it must be rejected.
+	err := SplitLayer(context.Background(), bytes.NewReader(layer), 4*tarBlockSize, func(segment io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, segment)
+		return err
+	})
+	if err == nil {
+		t.Fatalf("expected an error splitting a layer with a whiteout after other entries")
+	}
+
+	// But the same layer can be "split" into a single layer.
+	var segments int
+	if err := SplitLayer(context.Background(), bytes.NewReader(layer), 64*tarBlockSize, func(segment io.Reader) error {
+		segments++
+		_, err := io.Copy(ioutil.Discard, segment)
+		return err
+	}); err != nil {
+		t.Fatalf("unexpected error splitting layer: %+v", err)
+	}
+	if segments != 1 {
+		t.Errorf("expected a single segment, got %d", segments)
+	}
+}
+
+func TestSplitLayerTooSmall(t *testing.T) {
+	layer := makeTarLayer(t, []catEntry{{name: "file", typeflag: tar.TypeReg}})
+	if err := SplitLayer(context.Background(), bytes.NewReader(layer), MinSplitSize-1, func(segment io.Reader) error {
+		t.Errorf("unexpected segment")
+		return nil
+	}); err == nil {
+		t.Errorf("expected an error with a maximum size smaller than MinSplitSize")
+	}
+}
@@ -0,0 +1,327 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Opener returns a new reader for the uncompressed contents of a layer. It is
+// used by SquashLayers, which needs to read each layer more than once.
+type Opener func() (io.ReadCloser, error)
+
+// layerReader is an io.ReadCloser for the uncompressed contents of a layer
+// blob, which closes both the decompressor and the underlying blob.
+type layerReader struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+// Close closes the decompressor and the underlying blob.
+func (lr layerReader) Close() error {
+	err := lr.ReadCloser.Close()
+	if err2 := lr.blob.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// OpenLayer returns a reader for the uncompressed contents of the given layer
+// blob in the engine.
+func OpenLayer(ctx context.Context, engine cas.Engine, layerDescriptor ispec.Descriptor) (io.ReadCloser, error) {
+	engineExt := casext.NewEngine(engine)
+
+	layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "get layer blob")
+	}
+	if !isLayerType(layerBlob.Descriptor.MediaType) {
+		layerBlob.Close()
+		return nil, errors.Errorf("blob is not correct mediatype: %s", layerBlob.Descriptor.MediaType)
+	}
+	layerData, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		layerBlob.Close()
+		// Should _never_ be reached.
+		return nil, errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+	}
+
+	layerRaw, err := decompressLayer(layerBlob.Descriptor.MediaType, layerData)
+	if err != nil {
+		layerBlob.Close()
+		return nil, errors.Wrap(err, "decompress layer")
+	}
+	return layerReader{ReadCloser: layerRaw, blob: layerBlob}, nil
+}
+
+// squashVersion identifies a single entry of one of the layers being
+// squashed, by the index of the layer and the index of the entry within it.
+type squashVersion struct {
+	layer, entry int
+}
+
+// squashLink is the (regular file) entry that a hardlink referred to when it
+// was created.
+type squashLink struct {
+	path    string
+	version squashVersion
+}
+
+// squasher keeps track of which entries of a set of layers are visible after
+// the layers have been applied in order.
+type squasher struct {
+	// winners maps every path which exists after applying the layers to the
+	// entry which provides it.
+	winners map[string]squashVersion
+
+	// links maps every hardlink entry to the entry it refers to.
+	links map[squashVersion]squashLink
+}
+
+// removeLower removes path (if self is set) and all of its children from the
+// set of visible entries, if they were provided by a layer lower than layer.
+func (s *squasher) removeLower(path string, self bool, layer int) {
+	for name, version := range s.winners {
+		if version.layer < layer && ((self && name == path) || isPathPrefix(name, path)) {
+			delete(s.winners, name)
+		}
+	}
+}
+
+// scan updates the set of visible entries with the given layer.
+func (s *squasher) scan(layer int, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for idx := 0; ; idx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		version := squashVersion{layer: layer, entry: idx}
+
+		// Whiteouts (and parent directories being replaced) only apply to
+		// the lower layers, so an entry in this layer always wins. This is
+		// the same logic as catLayer.
+		name := cleanRelPath(hdr.Name)
+		dir, file := filepath.Split(name)
+		dir = filepath.Clean(dir)
+
+		switch {
+		case file == whOpaque:
+			s.removeLower(dir, false, layer)
+		case strings.HasPrefix(file, whPrefix):
+			s.removeLower(filepath.Join(dir, strings.TrimPrefix(file, whPrefix)), true, layer)
+		default:
+			if hdr.Typeflag != tar.TypeDir {
+				s.removeLower(name, false, layer)
+			}
+			s.winners[name] = version
+
+			if hdr.Typeflag == tar.TypeLink {
+				linkname := cleanRelPath(hdr.Linkname)
+				target, ok := s.winners[linkname]
+				if !ok {
+					return errors.Errorf("hardlink %s refers to non-existent path %s", name, linkname)
+				}
+				link := squashLink{path: linkname, version: target}
+				// Always refer to the underlying regular file.
+				if targetLink, ok := s.links[target]; ok {
+					link = targetLink
+				}
+				s.links[version] = link
+			}
+		}
+	}
+	return nil
+}
+
+// visible returns whether the given entry exists after applying all of the
+// layers.
+func (s *squasher) visible(path string, version squashVersion) bool {
+	winner, ok := s.winners[path]
+	return ok && winner == version
+}
+
+// SquashLayers writes a single uncompressed layer to w, which is equivalent to
+// applying all of the given layers in order (from the bottom-most layer
+// upwards). Whiteouts are applied to the lower layers, and are not included
+// in the squashed layer. Each layer is read twice.
+//
+// Hardlinks which referred to a file which was later replaced or removed are
+// converted into copies of the file they referred to, since the original file
+// is no longer part of the squashed layer.
+func SquashLayers(layers []Opener, w io.Writer) error {
+	s := &squasher{
+		winners: map[string]squashVersion{},
+		links:   map[squashVersion]squashLink{},
+	}
+
+	// First figure out which entries are visible in the final root
+	// filesystem.
+	for idx, open := range layers {
+		if err := withLayer(open, func(r io.Reader) error {
+			return s.scan(idx, r)
+		}); err != nil {
+			return errors.Wrapf(err, "scan layer %d", idx)
+		}
+	}
+
+	// Regular files which are no longer visible, but which are referred to by
+	// a visible hardlink, need to be copied into the hardlinks.
+	orphans := map[squashVersion]struct{}{}
+	for _, version := range s.winners {
+		if link, ok := s.links[version]; ok && !s.visible(link.path, link.version) {
+			orphans[link.version] = struct{}{}
+		}
+	}
+
+	tempDir, err := ioutil.TempDir("", "umoci-squash-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary directory")
+	}
+	defer os.RemoveAll(tempDir)
+
+	var (
+		orphanHdrs = map[squashVersion]*tar.Header{}
+		orphanDsts = map[squashVersion]string{}
+	)
+
+	tw := tar.NewWriter(w)
+	for layer, open := range layers {
+		if err := withLayer(open, func(r io.Reader) error {
+			tr := tar.NewReader(r)
+			for idx := 0; ; idx++ {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return errors.Wrap(err, "read next entry")
+				}
+				version := squashVersion{layer: layer, entry: idx}
+				name := cleanRelPath(hdr.Name)
+
+				if _, ok := orphans[version]; ok {
+					// Save the file for the hardlinks which refer to it.
+					orphanPath := filepath.Join(tempDir, fmt.Sprintf("%d-%d", layer, idx))
+					if err := saveFile(orphanPath, tr); err != nil {
+						return errors.Wrapf(err, "save hardlinked file %s", name)
+					}
+					orphanHdr := *hdr
+					orphanHdrs[version] = &orphanHdr
+				}
+				if !s.visible(name, version) {
+					continue
+				}
+
+				link, isLink := s.links[version]
+				if !isLink || s.visible(link.path, link.version) {
+					if isLink {
+						hdr.Linkname = link.path
+					}
+					if err := tw.WriteHeader(hdr); err != nil {
+						return errors.Wrapf(err, "write header %s", name)
+					}
+					if _, err := io.Copy(tw, tr); err != nil {
+						return errors.Wrapf(err, "write contents %s", name)
+					}
+					continue
+				}
+
+				// The first hardlink to an orphaned file becomes a copy of it,
+				// and any others are hardlinks to that copy.
+				if dst, ok := orphanDsts[link.version]; ok {
+					hdr.Linkname = dst
+					if err := tw.WriteHeader(hdr); err != nil {
+						return errors.Wrapf(err, "write header %s", name)
+					}
+					continue
+				}
+				log.Debugf("squash: hardlink %s refers to replaced file %s, copying file contents", name, link.path)
+				if err := writeOrphan(tw, hdr.Name, orphanHdrs[link.version], filepath.Join(tempDir, fmt.Sprintf("%d-%d", link.version.layer, link.version.entry))); err != nil {
+					return errors.Wrapf(err, "write copy of %s", link.path)
+				}
+				orphanDsts[link.version] = name
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "squash layer %d", layer)
+		}
+	}
+	return errors.Wrap(tw.Close(), "close tar writer")
+}
+
+// withLayer calls fn with the contents of the layer returned by open.
+func withLayer(open Opener, fn func(io.Reader) error) error {
+	r, err := open()
+	if err != nil {
+		return errors.Wrap(err, "open layer")
+	}
+	defer r.Close()
+	return fn(r)
+}
+
+// saveFile writes the contents of r to a new file at path.
+func saveFile(path string, r io.Reader) error {
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	if _, err := io.Copy(fh, r); err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// writeOrphan writes a copy of the file (with the given header, whose contents
+// were saved to path) to tw with the given name.
+func writeOrphan(tw *tar.Writer, name string, hdr *tar.Header, path string) error {
+	if hdr == nil {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] missing header for hardlinked file")
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	newHdr := *hdr
+	newHdr.Name = name
+	if err := tw.WriteHeader(&newHdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fh)
+	return err
+}
@@ -0,0 +1,159 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestSquashLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestSquashLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifest := makeTarImage(t, root, [][]catEntry{
+		{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "base os-release"},
+			{name: "etc/hostname", typeflag: tar.TypeReg, data: "base hostname"},
+			{name: "etc/link", typeflag: tar.TypeLink, linkname: "etc/hostname"},
+			{name: "etc/link2", typeflag: tar.TypeLink, linkname: "etc/link"},
+			{name: "opaque/", typeflag: tar.TypeDir},
+			{name: "opaque/file", typeflag: tar.TypeReg, data: "opaque file"},
+			{name: "replaced/", typeflag: tar.TypeDir},
+			{name: "replaced/file", typeflag: tar.TypeReg, data: "replaced file"},
+			{name: "deleted", typeflag: tar.TypeReg, data: "deleted file"},
+			{name: "symlink", typeflag: tar.TypeSymlink, linkname: "etc/hostname"},
+		},
+		{
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "new os-release"},
+			{name: "etc/hostname", typeflag: tar.TypeReg, data: "new hostname"},
+			{name: "opaque/", typeflag: tar.TypeDir},
+			{name: "opaque/" + whOpaque, typeflag: tar.TypeReg},
+			{name: "opaque/new", typeflag: tar.TypeReg, data: "new opaque file"},
+			{name: "replaced", typeflag: tar.TypeReg, data: "now a file"},
+			{name: whPrefix + "deleted", typeflag: tar.TypeReg},
+		},
+		{
+			{name: "./etc/other", typeflag: tar.TypeLink, linkname: "./etc/os-release"},
+		},
+	})
+	defer engineExt.Close()
+
+	var openers []Opener
+	for _, descriptor := range manifest.Layers {
+		descriptor := descriptor
+		openers = append(openers, func() (io.ReadCloser, error) {
+			return OpenLayer(ctx, engineExt, descriptor)
+		})
+	}
+
+	var squashed bytes.Buffer
+	if err := SquashLayers(openers, &squashed); err != nil {
+		t.Fatalf("unexpected error squashing layers: %+v", err)
+	}
+
+	// Make sure that there are no whiteouts or duplicate entries.
+	names := map[string]struct{}{}
+	tr := tar.NewReader(bytes.NewReader(squashed.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("squashed layer is not a valid tar archive: %+v", err)
+		}
+		name := cleanRelPath(hdr.Name)
+		if _, ok := names[name]; ok {
+			t.Errorf("duplicate entry %s in squashed layer", name)
+		}
+		names[name] = struct{}{}
+	}
+	for _, name := range []string{"deleted", "opaque/file", "replaced/file", whPrefix + "deleted", "opaque/" + whOpaque} {
+		if _, ok := names[name]; ok {
+			t.Errorf("removed entry %s included in squashed layer", name)
+		}
+	}
+
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, &squashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	squashedManifest := ispec.Manifest{
+		Layers: []ispec.Descriptor{{
+			MediaType: ispec.MediaTypeImageLayer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		}},
+	}
+
+	// Every file must have the same contents in the squashed layer as in the
+	// original set of layers.
+	for _, test := range []struct {
+		path     string
+		expected string
+		fail     bool
+	}{
+		{path: "etc/os-release", expected: "new os-release"},
+		{path: "etc/hostname", expected: "new hostname"},
+		{path: "etc/link", expected: "base hostname"},
+		{path: "etc/link2", expected: "base hostname"},
+		{path: "etc/other", expected: "new os-release"},
+		{path: "opaque/new", expected: "new opaque file"},
+		{path: "replaced", expected: "now a file"},
+		{path: "symlink", fail: true},
+		{path: "deleted", fail: true},
+		{path: "opaque/file", fail: true},
+		{path: "replaced/file", fail: true},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			for _, m := range []ispec.Manifest{manifest, squashedManifest} {
+				var buffer bytes.Buffer
+				err := CatFile(ctx, engineExt, m, test.path, &buffer)
+				if test.fail {
+					if err == nil {
+						t.Errorf("expected error, got contents %q", buffer.String())
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %+v", err)
+				}
+				if buffer.String() != test.expected {
+					t.Errorf("unexpected contents: expected %q, got %q", test.expected, buffer.String())
+				}
+			}
+		})
+	}
+	if _, ok := names["symlink"]; !ok {
+		t.Errorf("symlink missing from squashed layer")
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// SymlinkPolicy controls which symlinks are created when extracting a layer.
+// The zero value is SymlinkPolicyAll.
+type SymlinkPolicy int
+
+const (
+	// SymlinkPolicyAll creates all symlinks as-is.
+	SymlinkPolicyAll SymlinkPolicy = iota
+
+	// SymlinkPolicyNoAbsolute rewrites symlinks with absolute targets to
+	// the equivalent relative target (relative to the root of the layer).
+	SymlinkPolicyNoAbsolute
+
+	// SymlinkPolicyRelativeOnly only creates symlinks with relative targets
+	// which do not escape the root of the layer. All other symlinks are not
+	// extracted.
+	SymlinkPolicyRelativeOnly
+)
+
+// symlinkPolicyNames are the names accepted by ParseSymlinkPolicy.
+var symlinkPolicyNames = map[string]SymlinkPolicy{
+	"all":           SymlinkPolicyAll,
+	"no-absolute":   SymlinkPolicyNoAbsolute,
+	"relative-only": SymlinkPolicyRelativeOnly,
+}
+
+// ParseSymlinkPolicy parses the name of a SymlinkPolicy ("all",
+// "no-absolute" or "relative-only").
+func ParseSymlinkPolicy(policy string) (SymlinkPolicy, error) {
+	sp, ok := symlinkPolicyNames[policy]
+	if !ok {
+		return SymlinkPolicyAll, errors.Errorf("invalid symlink policy: %q", policy)
+	}
+	return sp, nil
+}
+
+// String returns the name of the policy.
+func (sp SymlinkPolicy) String() string {
+	for name, policy := range symlinkPolicyNames {
+		if policy == sp {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// apply applies the policy to hdr (which must have a cleaned Name), rewriting
+// the target of the symlink if necessary. If the symlink is not permitted, it
+// is logged and false is returned (meaning that the entry must be skipped).
+// Entries other than symlinks are always permitted.
+func (sp SymlinkPolicy) apply(hdr *tar.Header) bool {
+	if sp == SymlinkPolicyAll || hdr.Typeflag != tar.TypeSymlink {
+		return true
+	}
+
+	switch sp {
+	case SymlinkPolicyNoAbsolute:
+		if !filepath.IsAbs(hdr.Linkname) {
+			return true
+		}
+		// Compute the target relative to the parent directory of the
+		// symlink, with both paths scoped to the root.
+		parent := filepath.Dir(filepath.Join("/", hdr.Name))
+		target, err := filepath.Rel(parent, filepath.Clean(hdr.Linkname))
+		if err != nil {
+			// Should never happen, since both paths are absolute.
+			log.Warnf("symlink-policy: blocked symlink %s -> %s: %v", hdr.Name, hdr.Linkname, err)
+			return false
+		}
+		log.WithFields(log.Fields{
+			"path":       hdr.Name,
+			"old_target": hdr.Linkname,
+			"new_target": target,
+		}).Infof("symlink-policy: rewrote absolute symlink %s", hdr.Name)
+		hdr.Linkname = target
+		return true
+	case SymlinkPolicyRelativeOnly:
+		if filepath.IsAbs(hdr.Linkname) {
+			log.Warnf("symlink-policy: blocked absolute symlink %s -> %s", hdr.Name, hdr.Linkname)
+			return false
+		}
+		resolved := filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)
+		if resolved == ".." || strings.HasPrefix(resolved, "../") {
+			log.Warnf("symlink-policy: blocked symlink escaping the root %s -> %s", hdr.Name, hdr.Linkname)
+			return false
+		}
+		return true
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy   string
+		expected SymlinkPolicy
+		fail     bool
+	}{
+		{policy: "all", expected: SymlinkPolicyAll},
+		{policy: "no-absolute", expected: SymlinkPolicyNoAbsolute},
+		{policy: "relative-only", expected: SymlinkPolicyRelativeOnly},
+		{policy: "", fail: true},
+		{policy: "none", fail: true},
+	} {
+		sp, err := ParseSymlinkPolicy(test.policy)
+		if test.fail {
+			if err == nil {
+				t.Errorf("ParseSymlinkPolicy(%q): expected error, got %s", test.policy, sp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSymlinkPolicy(%q): unexpected error: %+v", test.policy, err)
+			continue
+		}
+		if sp != test.expected {
+			t.Errorf("ParseSymlinkPolicy(%q): expected %s, got %s", test.policy, test.expected, sp)
+		}
+		if sp.String() != test.policy {
+			t.Errorf("ParseSymlinkPolicy(%q).String(): got %q", test.policy, sp.String())
+		}
+	}
+}
+
+func TestUnpackEntrySymlinkPolicy(t *testing.T) {
+	links := []struct {
+		name, target string
+	}{
+		{name: "etc/relative", target: "../usr/lib"},
+		{name: "etc/absolute", target: "/usr/lib/os-release"},
+		{name: "etc/root", target: "/"},
+		{name: "etc/escape", target: "../../../etc/shadow"},
+		{name: "sibling", target: "etc"},
+	}
+
+	for _, test := range []struct {
+		policy   SymlinkPolicy
+		expected map[string]string // "" means the symlink was blocked.
+	}{
+		{policy: SymlinkPolicyAll, expected: map[string]string{
+			"etc/relative": "../usr/lib",
+			"etc/absolute": "/usr/lib/os-release",
+			"etc/root":     "/",
+			"etc/escape":   "../../../etc/shadow",
+			"sibling":      "etc",
+		}},
+		{policy: SymlinkPolicyNoAbsolute, expected: map[string]string{
+			"etc/relative": "../usr/lib",
+			"etc/absolute": "../usr/lib/os-release",
+			"etc/root":     "..",
+			"etc/escape":   "../../../etc/shadow",
+			"sibling":      "etc",
+		}},
+		{policy: SymlinkPolicyRelativeOnly, expected: map[string]string{
+			"etc/relative": "../usr/lib",
+			"etc/absolute": "",
+			"etc/root":     "",
+			"etc/escape":   "",
+			"sibling":      "etc",
+		}},
+	} {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			root, err := ioutil.TempDir("", "umoci-TestUnpackEntrySymlinkPolicy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			te := NewTarExtractorWithOptions(UnpackOptions{SymlinkPolicy: test.policy})
+			if err := te.UnpackEntry(root, &tar.Header{
+				Name:     "etc/",
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+			}, nil); err != nil {
+				t.Fatalf("unexpected error unpacking directory: %+v", err)
+			}
+			for _, link := range links {
+				if err := te.UnpackEntry(root, &tar.Header{
+					Name:     link.name,
+					Typeflag: tar.TypeSymlink,
+					Linkname: link.target,
+				}, nil); err != nil {
+					t.Fatalf("unexpected error unpacking %s: %+v", link.name, err)
+				}
+			}
+
+			for name, expected := range test.expected {
+				target, err := os.Readlink(filepath.Join(root, name))
+				if expected == "" {
+					if !os.IsNotExist(err) {
+						t.Errorf("%s: expected symlink to be blocked, got %q (err=%v)", name, target, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s: unexpected error reading symlink: %v", name, err)
+					continue
+				}
+				if target != expected {
+					t.Errorf("%s: expected target %q, got %q", name, expected, target)
+				}
+			}
+		})
+	}
+}
@@ -43,9 +43,9 @@ var inUserNamespace = shared.RunningInUserNS()
 
 // TarExtractor represents a tar file to be extracted.
 type TarExtractor struct {
-	// mapOptions is the set of mapping options to use when extracting
-	// filesystem layers.
-	mapOptions MapOptions
+	// opt is the set of options (including the mapping options) to use when
+	// extracting filesystem layers.
+	opt UnpackOptions
 
 	// partialRootless indicates whether "partial rootless" tricks should be
 	// applied in our extraction. Rootless and userns execution have some
@@ -75,14 +75,21 @@ type TarExtractor struct {
 
 // NewTarExtractor creates a new TarExtractor.
 func NewTarExtractor(opt MapOptions) *TarExtractor {
+	return NewTarExtractorWithOptions(UnpackOptions{MapOptions: opt})
+}
+
+// NewTarExtractorWithOptions is the same as NewTarExtractor, but with the
+// extraction modified by opt. Only the options which affect the extraction of
+// individual entries (such as opt.KeepDirlinks) are used.
+func NewTarExtractorWithOptions(opt UnpackOptions) *TarExtractor {
 	fsEval := fseval.DefaultFsEval
-	if opt.Rootless {
+	if opt.MapOptions.Rootless {
 		fsEval = fseval.RootlessFsEval
 	}
 
 	return &TarExtractor{
-		mapOptions:      opt,
-		partialRootless: opt.Rootless || inUserNamespace,
+		opt:             opt,
+		partialRootless: opt.MapOptions.Rootless || inUserNamespace,
 		fsEval:          fsEval,
 		upperPaths:      make(map[string]struct{}),
 		enotsupWarned:   false,
@@ -104,7 +111,7 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 
 	// Apply the owner. If we are rootless then "user.rootlesscontainers" has
 	// already been set up by unmapHeader, so nothing to do here.
-	if !te.mapOptions.Rootless {
+	if !te.opt.MapOptions.Rootless {
 		// XXX: While unpriv.Lchown doesn't make a whole lot of sense this
 		//      should _probably_ be put inside FsEval.
 		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
@@ -219,7 +226,7 @@ func (te *TarExtractor) restoreMetadata(path string, hdr *tar.Header) error {
 // pathname or other information.
 func (te *TarExtractor) applyMetadata(path string, hdr *tar.Header) error {
 	// Modify the header.
-	if err := unmapHeader(hdr, te.mapOptions); err != nil {
+	if err := unmapHeader(hdr, te.opt.MapOptions); err != nil {
 		return errors.Wrap(err, "unmap header")
 	}
 
@@ -227,6 +234,48 @@ func (te *TarExtractor) applyMetadata(path string, hdr *tar.Header) error {
 	return te.restoreMetadata(path, hdr)
 }
 
+// keepWhiteout extracts the given whiteout entry verbatim as an empty file at
+// the given root, rather than applying it. The metadata of the parent
+// directory is left as-is.
+func (te *TarExtractor) keepWhiteout(root string, hdr *tar.Header) error {
+	hdr.Name = CleanPath(hdr.Name)
+	unsafeDir, file := filepath.Split(hdr.Name)
+	if err := te.checkParents(root, unsafeDir); err != nil {
+		return errors.Wrapf(err, "unsafe path %s", hdr.Name)
+	}
+	dir, err := securejoin.SecureJoinVFS(root, unsafeDir, te.fsEval)
+	if err != nil {
+		return errors.Wrap(err, "sanitise symlinks in root")
+	}
+	path := filepath.Join(dir, file)
+
+	if err := te.fsEval.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "mkdir parent")
+	}
+	dirFi, err := te.fsEval.Lstat(dir)
+	if err != nil {
+		return errors.Wrap(err, "stat parent")
+	}
+
+	fh, err := te.fsEval.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "create whiteout")
+	}
+	if err := fh.Close(); err != nil {
+		return errors.Wrap(err, "close whiteout")
+	}
+
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = 0
+	hdr.Linkname = ""
+	if err := te.applyMetadata(path, hdr); err != nil {
+		return errors.Wrap(err, "apply hdr metadata")
+	}
+
+	// Creating the whiteout modified the parent directory's mtime.
+	return errors.Wrap(te.fsEval.Lutimes(dir, dirFi.ModTime(), dirFi.ModTime()), "restore parent mtime")
+}
+
 // isDirlink returns whether the given path is a link to a directory (or a
 // dirlink in rsync(1) parlance) which is used by --keep-dirlink to see whether
 // we should extract through the link or clobber the link with a directory (in
@@ -271,6 +320,64 @@ func (te *TarExtractor) isDirlink(root string, path string) (bool, error) {
 	return targetInfo.IsDir(), nil
 }
 
+// checkParents returns an error if any of the existing components of unsafeDir
+// (a path relative to root) is a symlink, since writing through such a symlink
+// would modify something other than the path named in the layer. Symlinks are
+// only followed (always scoped to root) if FollowSymlinks is set, or if they
+// are links to directories and KeepDirlinks is set (in which case writing
+// through them is the whole point).
+func (te *TarExtractor) checkParents(root string, unsafeDir string) error {
+	if te.opt.FollowSymlinks {
+		return nil
+	}
+
+	current := root
+	for _, part := range strings.Split(filepath.Join("/", unsafeDir), "/") {
+		if part == "" {
+			continue
+		}
+		current = filepath.Join(current, part)
+
+		fi, err := te.fsEval.Lstat(current)
+		if err != nil {
+			// The rest of the path doesn't exist yet, and will be created as
+			// directories.
+			if securejoin.IsNotExist(err) {
+				err = nil
+			}
+			return errors.Wrap(err, "check parent")
+		}
+		if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+			// Non-directories are clobbered or will cause an error later.
+			if !fi.IsDir() {
+				return nil
+			}
+			continue
+		}
+
+		unsafePath, err := filepath.Rel(root, current)
+		if err != nil {
+			return errors.Wrap(err, "get relative-to-root path")
+		}
+		if te.opt.KeepDirlinks {
+			isDirlink, err := te.isDirlink(root, current)
+			if err != nil {
+				return errors.Wrap(err, "check is dirlink")
+			}
+			if isDirlink {
+				// Continue checking from the target of the dirlink.
+				current, err = securejoin.SecureJoinVFS(root, unsafePath, te.fsEval)
+				if err != nil {
+					return errors.Wrap(err, "sanitise dirlink in root")
+				}
+				continue
+			}
+		}
+		return errors.Errorf("refusing to follow symlink /%s in parent path", unsafePath)
+	}
+	return nil
+}
+
 // UnpackEntry extracts the given tar.Header to the provided root, ensuring
 // that the layer state is consistent with the layer state that produced the
 // tar archive being iterated over. This does handle whiteouts, so a tar.Header
@@ -286,6 +393,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		"type": hdr.Typeflag,
 	}).Debugf("unpacking entry")
 
+	// Skip any symlinks not permitted by the policy (which also rewrites
+	// any symlinks as necessary).
+	if !te.opt.SymlinkPolicy.apply(hdr) {
+		return nil
+	}
+
 	// Get directory and filename, but we have to safely get the directory
 	// component of the path. SecureJoinVFS will evaluate the path itself,
 	// which we don't want (we're clever enough to handle the actual path being
@@ -295,6 +408,9 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		// If we got an entry for the root, then unsafeDir is the full path.
 		unsafeDir, file = hdr.Name, "."
 	}
+	if err := te.checkParents(root, unsafeDir); err != nil {
+		return errors.Wrapf(err, "unsafe path %s", hdr.Name)
+	}
 	dir, err := securejoin.SecureJoinVFS(root, unsafeDir, te.fsEval)
 	if err != nil {
 		return errors.Wrap(err, "sanitise symlinks in root")
@@ -501,14 +617,14 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		//       this is something that would also be useful in the same vein
 		//       as --keep-dirlinks (which currently only prevents clobbering
 		//       in the opposite case).
-		if te.mapOptions.KeepDirlinks &&
+		if te.opt.KeepDirlinks &&
 			fi.Mode()&os.ModeSymlink == os.ModeSymlink && hdr.Typeflag == tar.TypeDir {
 			isDirlink, err = te.isDirlink(root, path)
 			if err != nil {
 				return errors.Wrap(err, "check is dirlink")
 			}
 		}
-		if !(isDirlink && te.mapOptions.KeepDirlinks) {
+		if !(isDirlink && te.opt.KeepDirlinks) {
 			if err := te.fsEval.RemoveAll(path); err != nil {
 				return errors.Wrap(err, "clobber old path")
 			}
@@ -530,7 +646,12 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 		defer fh.Close()
 
 		// We need to make sure that we copy all of the bytes.
-		n, err := io.Copy(fh, r)
+		var n int64
+		if te.opt.Sparse {
+			n, err = copySparse(fh, r)
+		} else {
+			n, err = io.Copy(fh, r)
+		}
 		if int64(n) != hdr.Size {
 			if err != nil {
 				err = errors.Wrapf(err, "short write")
@@ -576,6 +697,9 @@ func (te *TarExtractor) UnpackEntry(root string, hdr *tar.Header, r io.Reader) (
 			// that we don't resolve the last part of the link path (in case
 			// the user actually wanted to hardlink to a symlink).
 			unsafeLinkDir, linkFile := filepath.Split(CleanPath(linkname))
+			if err := te.checkParents(root, unsafeLinkDir); err != nil {
+				return errors.Wrapf(err, "unsafe hardlink target %s", linkname)
+			}
 			linkDir, err := securejoin.SecureJoinVFS(root, unsafeLinkDir, te.fsEval)
 			if err != nil {
 				return errors.Wrap(err, "sanitise hardlink target in root")
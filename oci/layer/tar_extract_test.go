@@ -41,7 +41,7 @@ import (
 // with the given prefix will resolve to the same path without it during
 // unpacking. The "unsafe" version should resolve to the parent directory
 // (which will be checked). The rootfs is assumed to be <dir>/rootfs.
-func testUnpackEntrySanitiseHelper(t *testing.T, dir, file, prefix string) func(t *testing.T) {
+func testUnpackEntrySanitiseHelper(t *testing.T, dir, file, prefix string, opt UnpackOptions) func(t *testing.T) {
 	// We return a function so that we can pass it directly to t.Run(...).
 	return func(t *testing.T) {
 		hostValue := []byte("host content")
@@ -68,7 +68,7 @@ func testUnpackEntrySanitiseHelper(t *testing.T, dir, file, prefix string) func(
 			ChangeTime: time.Now(),
 		}
 
-		te := NewTarExtractor(MapOptions{})
+		te := NewTarExtractorWithOptions(opt)
 		if err := te.UnpackEntry(rootfs, hdr, bytes.NewBuffer(ctrValue)); err != nil {
 			t.Fatalf("unexpected UnpackEntry error: %s", err)
 		}
@@ -116,7 +116,7 @@ func TestUnpackEntrySanitiseScoping(t *testing.T) {
 			}
 
 			t.Logf("running Test%s", test.name)
-			testUnpackEntrySanitiseHelper(t, dir, filepath.Join("/", test.prefix, "file"), test.prefix)(t)
+			testUnpackEntrySanitiseHelper(t, dir, filepath.Join("/", test.prefix, "file"), test.prefix, UnpackOptions{})(t)
 		}
 	}(t)
 }
@@ -124,7 +124,7 @@ func TestUnpackEntrySanitiseScoping(t *testing.T) {
 // TestUnpackEntrySymlinkScoping makes sure that path sanitisation is done
 // safely with regards to symlinks path components set to /.. and similar
 // prefixes in invalid tar archives (a regular tar archive won't contain stuff
-// like that).
+// like that). Such symlinks are only followed with FollowSymlinks.
 func TestUnpackEntrySymlinkScoping(t *testing.T) {
 	// TODO: Modify this to use subtests once Go 1.7 is in enough places.
 	func(t *testing.T) {
@@ -155,11 +155,84 @@ func TestUnpackEntrySymlinkScoping(t *testing.T) {
 			}
 
 			t.Logf("running Test%s", test.name)
-			testUnpackEntrySanitiseHelper(t, dir, filepath.Join("/", test.prefix, "file"), "link")(t)
+			testUnpackEntrySanitiseHelper(t, dir, filepath.Join("/", test.prefix, "file"), "link", UnpackOptions{FollowSymlinks: true})(t)
 		}
 	}(t)
 }
 
+// TestUnpackEntrySymlinkParent makes sure that entries are not extracted
+// through existing symlinks in their parent path components unless
+// FollowSymlinks (or KeepDirlinks for links to directories) is set.
+func TestUnpackEntrySymlinkParent(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		opt   UnpackOptions
+		hdr   tar.Header
+		allow bool
+	}{
+		{"Default", UnpackOptions{}, tar.Header{Name: "link/file", Typeflag: tar.TypeReg}, false},
+		{"DefaultNested", UnpackOptions{}, tar.Header{Name: "dir/link/sub/file", Typeflag: tar.TypeReg}, false},
+		{"DefaultWhiteout", UnpackOptions{}, tar.Header{Name: "link/" + whPrefix + "target", Typeflag: tar.TypeReg}, false},
+		{"DefaultHardlink", UnpackOptions{}, tar.Header{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "link/target"}, false},
+		{"FollowSymlinks", UnpackOptions{FollowSymlinks: true}, tar.Header{Name: "link/file", Typeflag: tar.TypeReg}, true},
+		{"KeepDirlinks", UnpackOptions{KeepDirlinks: true}, tar.Header{Name: "link/file", Typeflag: tar.TypeReg}, true},
+		{"KeepDirlinksFileLink", UnpackOptions{KeepDirlinks: true}, tar.Header{Name: "filelink/file", Typeflag: tar.TypeReg}, false},
+		{"NoSymlink", UnpackOptions{}, tar.Header{Name: "dir/real/file", Typeflag: tar.TypeReg}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rootfs, err := ioutil.TempDir("", "umoci-TestUnpackEntrySymlinkParent")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(rootfs)
+
+			if err := os.MkdirAll(filepath.Join(rootfs, "dir", "real", "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(rootfs, "dir", "real", "target"), []byte("target"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("dir/real", filepath.Join(rootfs, "link")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("real", filepath.Join(rootfs, "dir", "link")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink("dir/real/target", filepath.Join(rootfs, "filelink")); err != nil {
+				t.Fatal(err)
+			}
+
+			hdr := test.hdr
+			hdr.Uid, hdr.Gid = os.Getuid(), os.Getgid()
+			hdr.Mode = 0644
+			hdr.ModTime = time.Now()
+
+			te := NewTarExtractorWithOptions(test.opt)
+			err = te.UnpackEntry(rootfs, &hdr, bytes.NewBuffer(nil))
+			if test.allow && err != nil {
+				t.Fatalf("unexpected UnpackEntry error: %+v", err)
+			} else if !test.allow && err == nil {
+				t.Fatalf("expected UnpackEntry to refuse to follow symlink")
+			}
+
+			// None of the refused entries may have modified the target
+			// directory.
+			if !test.allow {
+				names, err := ioutil.ReadDir(filepath.Join(rootfs, "dir", "real"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(names) != 2 {
+					t.Errorf("target directory was modified: %v", names)
+				}
+				if _, err := os.Lstat(filepath.Join(rootfs, hdr.Name)); err == nil && hdr.Typeflag == tar.TypeLink {
+					t.Errorf("hardlink was created despite error")
+				}
+			}
+		})
+	}
+}
+
 // TestUnpackEntryParentDir ensures that when UnpackEntry hits a path that
 // doesn't have its leading directories, we create all of the parent
 // directories.
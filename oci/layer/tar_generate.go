@@ -23,9 +23,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/openSUSE/umoci/pkg/testutils"
 	"github.com/pkg/errors"
 )
@@ -55,18 +57,46 @@ func init() {
 	}
 }
 
+// ErrSkipEntry can be returned by a TarTransformFunc to omit the entry from
+// the generated layer.
+var ErrSkipEntry = errors.New("skip this entry")
+
+// TarTransformFunc is called with the header (and, for regular files, the
+// contents) of every file added to a generated layer, after all of the other
+// GenerateOptions have been applied to the header and just before it is written.
+// It is called in the order in which entries are written to the layer, which
+// for GenerateLayer is lexicographic order of the paths in the layer. hdr may
+// be modified, and the returned reader is used as the new contents of the
+// entry (hdr.Size must match the length of the new contents) -- content can
+// be returned as-is if the contents are unchanged. If ErrSkipEntry is
+// returned, the entry is omitted from the layer (any other error aborts the
+// generation of the layer).
+//
+// The transform is not called for whiteouts. Note that skipping an entry does
+// not remove it from the image -- if the path existed in a lower layer, the
+// lower layer's version will still be present when the image is extracted,
+// unless the entry was removed from the rootfs (in which case a whiteout is
+// generated as usual). Similarly, renaming an entry doesn't generate a
+// whiteout for its old path.
+type TarTransformFunc func(hdr *tar.Header, content io.Reader) (io.Reader, error)
+
 // tarGenerator is a helper for generating layer diff tars. It should be noted
 // that when using tarGenerator.Add{Path,Whiteout} it is recommended to do it
 // in lexicographic order.
 type tarGenerator struct {
 	tw *tar.Writer
 
-	// mapOptions is the set of mapping options for modifying entries before
-	// they're added to the layer.
-	mapOptions MapOptions
+	// w is the writer underlying tw, used to write sparse entries (which
+	// archive/tar doesn't support).
+	w io.Writer
+
+	// opt is the set of options (including the mapping options) for
+	// modifying entries before they're added to the layer.
+	opt GenerateOptions
 
-	// Hardlink mapping.
-	inodes map[uint64]string
+	// Hardlink mapping. Only inodes with more than one link are tracked, so
+	// that the memory used doesn't grow with the number of files added.
+	inodes map[inodeKey]string
 
 	// fsEval is an fseval.FsEval used for extraction.
 	fsEval fseval.FsEval
@@ -75,19 +105,27 @@ type tarGenerator struct {
 	//      the same path in a tar archive? This is not permitted by the spec.
 }
 
+// inodeKey uniquely identifies an inode on the host, since inode numbers are
+// only unique within a single filesystem (and the root filesystem may contain
+// mountpoints).
+type inodeKey struct {
+	dev, ino uint64
+}
+
 // newTarGenerator creates a new tarGenerator using the provided writer as the
 // output writer.
-func newTarGenerator(w io.Writer, opt MapOptions) *tarGenerator {
+func newTarGenerator(w io.Writer, opt GenerateOptions) *tarGenerator {
 	fsEval := fseval.DefaultFsEval
-	if opt.Rootless {
+	if opt.MapOptions.Rootless {
 		fsEval = fseval.RootlessFsEval
 	}
 
 	return &tarGenerator{
-		tw:         tar.NewWriter(w),
-		mapOptions: opt,
-		inodes:     map[uint64]string{},
-		fsEval:     fsEval,
+		tw:     tar.NewWriter(w),
+		w:      w,
+		opt:    opt,
+		inodes: map[inodeKey]string{},
+		fsEval: fsEval,
 	}
 }
 
@@ -189,13 +227,11 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	for _, name := range names {
 		// Some xattrs need to be skipped for sanity reasons, such as
 		// security.selinux, because they are very much host-specific and
-		// carrying them to other hosts would be a really bad idea.
-		if _, ignore := ignoreXattrs[name]; ignore {
+		// carrying them to other hosts would be a really bad idea. The same
+		// goes for the internal xattrs of overlayfs upper directories.
+		if _, ignore := ignoreXattrs[name]; ignore || strings.HasPrefix(name, overlayXattrPrefix) {
 			continue
 		}
-		// TODO: We should translate all v3 capabilities into root-owned
-		//       capabilities here. But we don't have Go code for that yet
-		//       (we'd need to use libcap to parse it).
 		value, err := tg.fsEval.Lgetxattr(path, name)
 		if err != nil {
 			// XXX: I'm not sure if we're unprivileged whether Lgetxattr can
@@ -203,6 +239,11 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 			//      we try to clear xattrs).
 			return errors.Wrapf(err, "get xattr: %s", name)
 		}
+		// Namespaced capabilities are only valid for a particular user
+		// namespace, so translate them into root-owned capabilities.
+		if name == capabilityXattr {
+			value = capabilityToV2(value)
+		}
 		// https://golang.org/issues/20698 -- We don't just error out here
 		// because it's not _really_ a fatal error. Currently it's unclear
 		// whether the stdlib will correctly handle reading or disable writing
@@ -218,35 +259,84 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 
 	// Not all systems have the concept of an inode, but I'm not in the mood to
 	// handle this in a way that makes anything other than GNU/Linux happy
-	// right now. Handle hardlinks.
-	if oldpath, ok := tg.inodes[statx.Ino]; ok {
+	// right now. Handle hardlinks. Some filesystems (such as some FUSE
+	// filesystems used for rootless containers) don't provide real inode
+	// numbers and report 0, in which case we cannot detect hardlinks and
+	// every path is added as a separate file.
+	inode := inodeKey{dev: uint64(statx.Dev), ino: uint64(statx.Ino)}
+	if oldpath, ok := tg.inodes[inode]; ok {
 		// We just hit a hardlink, so we just have to change the header.
 		hdr.Typeflag = tar.TypeLink
 		hdr.Linkname = oldpath
 		hdr.Size = 0
-	} else {
-		tg.inodes[statx.Ino] = name
+	} else if !fi.IsDir() && statx.Nlink > 1 && statx.Ino != 0 {
+		tg.inodes[inode] = name
 	}
 
 	// Apply any header mappings.
-	if err := mapHeader(hdr, tg.mapOptions); err != nil {
+	if err := mapHeader(hdr, tg.opt.MapOptions); err != nil {
 		return errors.Wrap(err, "map header")
 	}
-	if err := tg.tw.WriteHeader(hdr); err != nil {
-		return errors.Wrap(err, "write header")
+	// Explicit owners override everything else.
+	if tg.opt.ForceUID != nil {
+		hdr.Uid = *tg.opt.ForceUID
+	}
+	if tg.opt.ForceGID != nil {
+		hdr.Gid = *tg.opt.ForceGID
 	}
+	tg.opt.PermPolicy.apply(hdr)
+	clampTimes(hdr, tg.opt.ClampMtime)
 
-	// Write the contents of regular files.
+	var (
+		content io.Reader
+		fh      *os.File
+	)
 	if hdr.Typeflag == tar.TypeReg {
-		fh, err := tg.fsEval.Open(path)
+		fh, err = tg.fsEval.Open(path)
 		if err != nil {
 			return errors.Wrap(err, "open file")
 		}
 		defer fh.Close()
+		content = fh
+	}
 
-		n, err := io.Copy(tg.tw, fh)
+	if tg.opt.Transform != nil {
+		content, err = tg.transform(inode, hdr, content)
+		if err == ErrSkipEntry {
+			return nil
+		}
 		if err != nil {
-			return errors.Wrap(err, "copy to layer")
+			return errors.Wrap(err, "transform entry")
+		}
+	}
+
+	// Files with holes are written as sparse entries, unless the transform
+	// replaced their contents.
+	if tg.opt.Sparse && hdr.Typeflag == tar.TypeReg && content == io.Reader(fh) && hdr.Size == fi.Size() {
+		regions, err := system.DataRegions(fh, hdr.Size)
+		if err != nil {
+			return errors.Wrap(err, "find holes in file")
+		}
+		if hasHoles(regions, hdr.Size) {
+			return errors.Wrap(tg.addSparseFile(hdr, fh, regions), "add sparse file")
+		}
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "rewind file")
+		}
+	}
+
+	if err := tg.tw.WriteHeader(hdr); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+
+	// Write the contents of regular files.
+	if hdr.Typeflag == tar.TypeReg {
+		var n int64
+		if content != nil {
+			n, err = io.Copy(tg.tw, content)
+			if err != nil {
+				return errors.Wrap(err, "copy to layer")
+			}
 		}
 		if n != hdr.Size {
 			return errors.Wrap(io.ErrShortWrite, "copy to layer")
@@ -256,6 +346,59 @@ func (tg *tarGenerator) AddFile(name, path string) error {
 	return nil
 }
 
+// transform applies the TarTransformFunc in tg.opt to the header (and
+// contents) of the entry for the given inode, returning the contents to write
+// to the layer. If the entry is skipped, ErrSkipEntry is returned. The
+// hardlink mapping is kept in sync with the (possibly renamed or skipped)
+// entry, so that later hardlinks to the same inode still refer to an entry in
+// the layer.
+func (tg *tarGenerator) transform(inode inodeKey, hdr *tar.Header, content io.Reader) (io.Reader, error) {
+	oldName := hdr.Name
+	linkTarget := false
+	if name, ok := tg.inodes[inode]; ok && name == oldName {
+		linkTarget = true
+	}
+
+	content, err := tg.opt.Transform(hdr, content)
+	if err == ErrSkipEntry {
+		if linkTarget {
+			delete(tg.inodes, inode)
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The transform must not produce an unsafe path.
+	name, err := normalise(hdr.Name, hdr.Typeflag == tar.TypeDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "normalise path")
+	}
+	if strings.HasPrefix(filepath.Base(name), whPrefix) {
+		return nil, errors.Errorf("invalid path has whiteout prefix %q: %s", whPrefix, name)
+	}
+	hdr.Name = name
+	if linkTarget {
+		tg.inodes[inode] = name
+	}
+	return content, nil
+}
+
+// clampTimes clamps the mtime of hdr to be no later than clamp, and drops the
+// atime and ctime (which are not reproducible). If clamp is nil, hdr is left
+// alone.
+func clampTimes(hdr *tar.Header, clamp *time.Time) {
+	if clamp == nil {
+		return
+	}
+	if hdr.ModTime.After(*clamp) {
+		hdr.ModTime = *clamp
+	}
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+}
+
 // whPrefix is the whiteout prefix, which is used to signify "special" files in
 // an OCI image layer archive. An expanded filesystem image cannot contain
 // files that have a basename starting with this prefix.
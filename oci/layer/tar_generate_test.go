@@ -28,6 +28,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestTarGenerateAddFileNormal(t *testing.T) {
@@ -62,7 +64,7 @@ func TestTarGenerateAddFileNormal(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, GenerateOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -156,7 +158,7 @@ func TestTarGenerateAddFileDirectory(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, GenerateOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -243,7 +245,7 @@ func TestTarGenerateAddFileSymlink(t *testing.T) {
 		t.Fatalf("apply metadata: %s", err)
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, GenerateOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the tar entries in a goroutine so we can parse the tar
@@ -327,7 +329,7 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		"dir/.",
 	}
 
-	tg := newTarGenerator(writer, MapOptions{})
+	tg := newTarGenerator(writer, GenerateOptions{})
 	tr := tar.NewReader(reader)
 
 	// Create all of the whiteout entries in a goroutine so we can parse the
@@ -377,3 +379,191 @@ func TestTarGenerateAddWhiteout(t *testing.T) {
 		t.Errorf("not all paths had a whiteout entry generated (only read %d, expected %d)!", idx, len(paths))
 	}
 }
+
+func TestTarGenerateAddFileClampMtime(t *testing.T) {
+	reader, writer := io.Pipe()
+
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateAddFileClampMtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clamp := time.Unix(1500000000, 0)
+	files := []struct {
+		name     string
+		mtime    time.Time
+		expected time.Time
+	}{
+		{name: "old", mtime: time.Unix(1000000000, 0), expected: time.Unix(1000000000, 0)},
+		{name: "new", mtime: time.Unix(2000000000, 0), expected: clamp},
+		{name: "exact", mtime: clamp, expected: clamp},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := ioutil.WriteFile(path, []byte("file contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, file.mtime, file.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tg := newTarGenerator(writer, GenerateOptions{ClampMtime: &clamp})
+	tr := tar.NewReader(reader)
+
+	// Create all of the tar entries in a goroutine so we can parse the tar
+	// entries as they're generated (io.Pipe pipes are unbuffered).
+	go func() {
+		for _, file := range files {
+			if err := tg.AddFile(file.name, filepath.Join(dir, file.name)); err != nil {
+				t.Errorf("AddFile: %s: unexpected error: %s", file.name, err)
+			}
+		}
+		if err := tg.tw.Close(); err != nil {
+			t.Errorf("tw.Close: unexpected error: %s", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("writer.Close: unexpected error: %s", err)
+		}
+	}()
+
+	for _, file := range files {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if !hdr.ModTime.Equal(file.expected) {
+			t.Errorf("%s: unexpected mtime: expected %s, got %s", file.name, file.expected, hdr.ModTime)
+		}
+		if !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() {
+			t.Errorf("%s: atime and ctime were not dropped: atime=%s ctime=%s", file.name, hdr.AccessTime, hdr.ChangeTime)
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		t.Fatalf("draining tar archive: %s", err)
+	}
+}
+
+func TestTarGenerateCapability(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Log("capability tests only work with root privileges")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateCapability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name  string
+		value []byte
+	}{
+		{"V2", testCapV2},
+		{"V3", testCapV3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "file-"+test.name)
+			if err := ioutil.WriteFile(path, []byte("some binary"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := unix.Lsetxattr(path, capabilityXattr, test.value, 0); err != nil {
+				if err == unix.ENOTSUP {
+					t.Skip("filesystem does not support capabilities")
+				}
+				t.Fatalf("set capability: %s", err)
+			}
+
+			var layer bytes.Buffer
+			tg := newTarGenerator(&layer, GenerateOptions{})
+			if err := tg.AddFile("file", path); err != nil {
+				t.Fatalf("AddFile: unexpected error: %s", err)
+			}
+			if err := tg.tw.Close(); err != nil {
+				t.Fatalf("tw.Close: unexpected error: %s", err)
+			}
+
+			// The capability must be stored as a PAX record, and must not be
+			// namespaced.
+			tr := tar.NewReader(&layer)
+			hdr, err := tr.Next()
+			if err != nil {
+				t.Fatalf("reading tar archive: %s", err)
+			}
+			if got := hdr.PAXRecords["SCHILY.xattr."+capabilityXattr]; got != string(testCapV2) {
+				t.Errorf("unexpected capability in layer: expected %x, got %x", testCapV2, got)
+			}
+
+			// And it must survive extraction.
+			rootfs := filepath.Join(dir, "rootfs-"+test.name)
+			if err := os.Mkdir(rootfs, 0755); err != nil {
+				t.Fatal(err)
+			}
+			te := NewTarExtractor(MapOptions{})
+			if err := te.UnpackEntry(rootfs, hdr, tr); err != nil {
+				t.Fatalf("UnpackEntry: unexpected error: %s", err)
+			}
+			value := make([]byte, 64)
+			n, err := unix.Lgetxattr(filepath.Join(rootfs, "file"), capabilityXattr, value)
+			if err != nil {
+				t.Fatalf("get extracted capability: %s", err)
+			}
+			if !bytes.Equal(value[:n], testCapV2) {
+				t.Errorf("unexpected extracted capability: expected %x, got %x", testCapV2, value[:n])
+			}
+		})
+	}
+}
+
+func TestTarGenerateAddFileHardlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestTarGenerateAddFileHardlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"single", "linked"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(dir, "linked"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tg := newTarGenerator(&buf, GenerateOptions{})
+	for _, name := range []string{"single", "linked", "link"} {
+		if err := tg.AddFile(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("AddFile: %s: unexpected error: %s", name, err)
+		}
+	}
+	if err := tg.tw.Close(); err != nil {
+		t.Fatalf("tw.Close: unexpected error: %s", err)
+	}
+
+	// Only inodes which have other links are tracked.
+	if len(tg.inodes) != 1 {
+		t.Errorf("expected only one inode to be tracked, got %v", tg.inodes)
+	}
+
+	tr := tar.NewReader(&buf)
+	for _, expected := range []struct {
+		name, linkname string
+		typeflag       byte
+	}{
+		{"single", "", tar.TypeReg},
+		{"linked", "", tar.TypeReg},
+		{"link", "linked", tar.TypeLink},
+	} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("reading tar archive: %s", err)
+		}
+		if hdr.Name != expected.name || hdr.Typeflag != expected.typeflag || hdr.Linkname != expected.linkname {
+			t.Errorf("unexpected entry: expected %s (%c -> %q), got %s (%c -> %q)", expected.name, expected.typeflag, expected.linkname, hdr.Name, hdr.Typeflag, hdr.Linkname)
+		}
+	}
+}
@@ -21,21 +21,26 @@ import (
 	"archive/tar"
 	// Import is necessary for go-digest.
 	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
-	gzip "github.com/klauspost/pgzip"
 	"github.com/openSUSE/umoci/oci/cas"
 	"github.com/openSUSE/umoci/oci/casext"
 	iconv "github.com/openSUSE/umoci/oci/config/convert"
+	"github.com/openSUSE/umoci/oci/crypt"
 	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/hardening"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/remote"
 	"github.com/openSUSE/umoci/pkg/system"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -52,13 +57,57 @@ type AfterLayerUnpackCallback func(manifest ispec.Manifest, desc ispec.Descripto
 // state used to create the layer. If an error is returned, the state of root
 // is undefined (unpacking is not guaranteed to be atomic).
 func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
-	var mapOptions MapOptions
-	if opt != nil {
-		mapOptions = *opt
+	return unpackLayer(context.Background(), root, layer, unpackOptions(opt))
+}
+
+// unpackLayer is the same as UnpackLayer, except that it stops extracting
+// entries (returning the error of ctx) if ctx is cancelled.
+func unpackLayer(ctx context.Context, root string, layer io.Reader, opt *UnpackOptions) error {
+	te := NewTarExtractorWithOptions(*opt)
+	tr := tar.NewReader(layer)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+		if err := te.UnpackEntry(root, hdr, tr); err != nil {
+			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
+		}
 	}
-	te := NewTarExtractor(mapOptions)
+	return nil
+}
+
+// UnpackDeltaLayer is the same as UnpackLayer, except that whiteouts are not
+// applied but are instead extracted verbatim in the form given by
+// opt.WhiteoutMode (as empty ".wh." files by default). This is used to extract
+// a delta layer on its own, such that root contains the same changes as the
+// layer (including removals).
+func UnpackDeltaLayer(root string, layer io.Reader, opt *UnpackOptions) error {
+	if opt == nil {
+		opt = &UnpackOptions{}
+	}
+	return unpackDeltaLayer(context.Background(), root, layer, opt)
+}
+
+// unpackDeltaLayer is the same as UnpackDeltaLayer, except that it stops
+// extracting entries (returning the error of ctx) if ctx is cancelled.
+func unpackDeltaLayer(ctx context.Context, root string, layer io.Reader, opt *UnpackOptions) error {
+	te := NewTarExtractorWithOptions(*opt)
 	tr := tar.NewReader(layer)
+	// Opaque whiteouts usually come before the entry for their directory,
+	// which would clear an overlayfs opaque xattr when its metadata is
+	// applied. So they are only applied once every entry has been extracted.
+	var opaqueDirs []string
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
@@ -66,10 +115,33 @@ func UnpackLayer(root string, layer io.Reader, opt *MapOptions) error {
 		if err != nil {
 			return errors.Wrap(err, "read next entry")
 		}
+		if _, file := filepath.Split(CleanPath(hdr.Name)); strings.HasPrefix(file, whPrefix) {
+			switch opt.WhiteoutMode {
+			case WhiteoutModeOverlayfs:
+				dir, err := te.overlayWhiteout(root, hdr)
+				if err != nil {
+					return errors.Wrapf(err, "unpack whiteout: %s", hdr.Name)
+				}
+				if dir != "" {
+					opaqueDirs = append(opaqueDirs, dir)
+				}
+			default:
+				if err := te.keepWhiteout(root, hdr); err != nil {
+					return errors.Wrapf(err, "unpack whiteout: %s", hdr.Name)
+				}
+			}
+			continue
+		}
 		if err := te.UnpackEntry(root, hdr, tr); err != nil {
 			return errors.Wrapf(err, "unpack entry: %s", hdr.Name)
 		}
 	}
+	for _, dir := range opaqueDirs {
+		// Setting an xattr doesn't modify the mtime of the directory.
+		if err := te.fsEval.Lsetxattr(dir, OverlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return errors.Wrapf(err, "set opaque xattr: %s", dir)
+		}
+	}
 	return nil
 }
 
@@ -81,7 +153,14 @@ const RootfsName = "rootfs"
 // layer blob. This includes both distributable and non-distributable images.
 func isLayerType(mediaType string) bool {
 	return mediaType == ispec.MediaTypeImageLayer || mediaType == ispec.MediaTypeImageLayerNonDistributable ||
-		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip
+		mediaType == ispec.MediaTypeImageLayerGzip || mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
+		mediaType == MediaTypeImageLayerZstd || mediaType == MediaTypeImageLayerNonDistributableZstd
+}
+
+// IsSupportedLayerType returns whether the given MediaType is the media type
+// of an image layer blob which umoci is able to unpack.
+func IsSupportedLayerType(mediaType string) bool {
+	return isLayerType(mediaType)
 }
 
 func needsGunzip(mediaType string) bool {
@@ -93,7 +172,21 @@ func needsGunzip(mediaType string) bool {
 // <bundle>/<layer.RootfsName>.
 //
 // FIXME: This interface is ugly.
-func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions, callback AfterLayerUnpackCallback, startFrom ispec.Descriptor) (err error) {
+func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *MapOptions, callback AfterLayerUnpackCallback, startFrom ispec.Descriptor) error {
+	unpackOpt := unpackOptions(opt)
+	unpackOpt.AfterLayerUnpack = callback
+	unpackOpt.StartFrom = startFrom
+	return UnpackManifestWithOptions(ctx, engine, bundle, manifest, unpackOpt)
+}
+
+// UnpackManifestWithOptions is the same as UnpackManifest, except that all of
+// the options (including the callback and the layer to start from) are given
+// by opt (see UnpackOptions).
+func UnpackManifestWithOptions(ctx context.Context, engine cas.Engine, bundle string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
+	if opt == nil {
+		opt = &UnpackOptions{}
+	}
+
 	// Create the bundle directory. We only error out if config.json or rootfs/
 	// already exists, because we cannot be sure that the user intended us to
 	// extract over an existing bundle.
@@ -121,7 +214,7 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	defer func() {
 		if err != nil {
 			fsEval := fseval.DefaultFsEval
-			if opt != nil && opt.Rootless {
+			if opt.MapOptions.Rootless {
 				fsEval = fseval.RootlessFsEval
 			}
 			// It's too late to care about errors.
@@ -130,7 +223,7 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 		}
 	}()
 
-	if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) && startFrom.MediaType == "" {
+	if _, err := os.Lstat(rootfsPath); !os.IsNotExist(err) && opt.StartFrom.MediaType == "" {
 		if err == nil {
 			err = fmt.Errorf("%s already exists", rootfsPath)
 		}
@@ -138,7 +231,7 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	}
 
 	log.Infof("unpack rootfs: %s", rootfsPath)
-	if err := UnpackRootfs(ctx, engine, rootfsPath, manifest, opt, callback, startFrom); err != nil {
+	if err := UnpackRootfsWithOptions(ctx, engine, rootfsPath, manifest, opt); err != nil {
 		return errors.Wrap(err, "unpack rootfs")
 	}
 
@@ -149,7 +242,7 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 	}
 	defer configFile.Close()
 
-	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, opt); err != nil {
+	if err := UnpackRuntimeJSON(ctx, engine, configFile, rootfsPath, manifest, &opt.MapOptions); err != nil {
 		return errors.Wrap(err, "unpack config.json")
 	}
 	return nil
@@ -157,12 +250,21 @@ func UnpackManifest(ctx context.Context, engine cas.Engine, bundle string, manif
 
 // UnpackRootfs extracts all of the layers in the given manifest.
 // Some verification is done during image extraction.
-func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *MapOptions, callback AfterLayerUnpackCallback, startFrom ispec.Descriptor) (err error) {
-	engineExt := casext.NewEngine(engine)
+func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *MapOptions, callback AfterLayerUnpackCallback, startFrom ispec.Descriptor) error {
+	unpackOpt := unpackOptions(opt)
+	unpackOpt.AfterLayerUnpack = callback
+	unpackOpt.StartFrom = startFrom
+	return UnpackRootfsWithOptions(ctx, engine, rootfsPath, manifest, unpackOpt)
+}
 
-	if err := os.Mkdir(rootfsPath, 0755); err != nil && !os.IsExist(err) {
-		return errors.Wrap(err, "mkdir rootfs")
+// UnpackRootfsWithOptions is the same as UnpackRootfs, except that all of the
+// options (including the callback and the layer to start from) are given by
+// opt (see UnpackOptions).
+func UnpackRootfsWithOptions(ctx context.Context, engine cas.Engine, rootfsPath string, manifest ispec.Manifest, opt *UnpackOptions) (err error) {
+	if opt == nil {
+		opt = &UnpackOptions{}
 	}
+	engineExt := casext.NewEngine(engine)
 
 	// In order to avoid having a broken rootfs in the case of an error, we
 	// remove the rootfs. In the case of rootless this is particularly
@@ -170,7 +272,7 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 	defer func() {
 		if err != nil {
 			fsEval := fseval.DefaultFsEval
-			if opt != nil && opt.Rootless {
+			if opt.MapOptions.Rootless {
 				fsEval = fseval.RootlessFsEval
 			}
 			// It's too late to care about errors.
@@ -179,6 +281,48 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 		}
 	}()
 
+	if err := initRootfs(rootfsPath, &opt.MapOptions); err != nil {
+		return err
+	}
+
+	diffIDs, layers, err := manifestLayers(ctx, engineExt, manifest, opt)
+	if err != nil {
+		return err
+	}
+
+	jobs := 1
+	if opt.Jobs > 1 {
+		jobs = opt.Jobs
+	}
+	if jobs > 1 && len(layers) > 1 {
+		return unpackLayersPipelined(ctx, engineExt, rootfsPath, manifest, diffIDs, layers, opt, jobs)
+	}
+
+	// Layer extraction.
+	for _, idx := range layers {
+		layerDescriptor := manifest.Layers[idx]
+		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+
+		if err := unpackLayerBlob(ctx, engineExt, rootfsPath, layerDescriptor, diffIDs[idx], opt, unpackLayer); err != nil {
+			return err
+		}
+		if opt.AfterLayerUnpack != nil {
+			if err := opt.AfterLayerUnpack(manifest, layerDescriptor); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// initRootfs creates the root directory rootfsPath (if it doesn't already
+// exist) for layers to be extracted into, owned by the (mapped) root user.
+func initRootfs(rootfsPath string, opt *MapOptions) error {
+	if err := os.Mkdir(rootfsPath, 0755); err != nil && !os.IsExist(err) {
+		return errors.Wrap(err, "mkdir rootfs")
+	}
+
 	// Make sure that the owner is correct.
 	rootUID, err := idtools.ToHost(0, opt.UIDMappings)
 	if err != nil {
@@ -201,100 +345,465 @@ func UnpackRootfs(ctx context.Context, engine cas.Engine, rootfsPath string, man
 	if err := system.Lutimes(rootfsPath, epoch, epoch); err != nil {
 		return errors.Wrap(err, "set initial root time")
 	}
+	return nil
+}
 
+// manifestLayers returns the DiffIDs of the layers of the given manifest (read
+// from its configuration) and the indices of the layers which need to be
+// extracted -- all of them, unless opt.UpTo or opt.StartFrom is set.
+func manifestLayers(ctx context.Context, engineExt casext.Engine, manifest ispec.Manifest, opt *UnpackOptions) ([]digest.Digest, []int, error) {
 	// In order to verify the DiffIDs as we extract layers, we have to get the
 	// .Config blob first. But we can't extract it (generate the runtime
 	// config) until after we have the full rootfs generated.
 	configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
 	if err != nil {
-		return errors.Wrap(err, "get config blob")
+		return nil, nil, errors.Wrap(err, "get config blob")
 	}
 	defer configBlob.Close()
 	if configBlob.Descriptor.MediaType != ispec.MediaTypeImageConfig {
-		return errors.Errorf("unpack rootfs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
+		return nil, nil, errors.Errorf("unpack rootfs: config blob is not correct mediatype %s: %s", ispec.MediaTypeImageConfig, configBlob.Descriptor.MediaType)
 	}
 	config, ok := configBlob.Data.(ispec.Image)
 	if !ok {
 		// Should _never_ be reached.
-		return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+		return nil, nil, errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
 	}
 
 	// We can't understand non-layer images.
 	if config.RootFS.Type != "layers" {
-		return errors.Errorf("unpack rootfs: config: unsupported rootfs.type: %s", config.RootFS.Type)
+		return nil, nil, errors.Errorf("unpack rootfs: config: unsupported rootfs.type: %s", config.RootFS.Type)
 	}
 
-	// Layer extraction.
+	// Figure out which layers need to be extracted.
+	upTo := len(manifest.Layers)
+	if opt.UpTo != 0 {
+		if opt.UpTo < 0 || opt.UpTo > len(manifest.Layers) {
+			return nil, nil, errors.Errorf("unpack rootfs: cannot unpack up to layer %d: manifest has %d layers", opt.UpTo, len(manifest.Layers))
+		}
+		upTo = opt.UpTo
+	}
+	var layers []int
 	found := false
-	for idx, layerDescriptor := range manifest.Layers {
-		if !found && startFrom.MediaType != "" && layerDescriptor.Digest.String() != startFrom.Digest.String() {
+	for idx, layerDescriptor := range manifest.Layers[:upTo] {
+		if !found && opt.StartFrom.MediaType != "" && layerDescriptor.Digest.String() != opt.StartFrom.Digest.String() {
 			continue
 		}
 		found = true
+		layers = append(layers, idx)
+	}
+	if len(config.RootFS.DiffIDs) < len(manifest.Layers) {
+		return nil, nil, errors.Errorf("unpack rootfs: config has %d diff_ids but manifest has %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	return config.RootFS.DiffIDs, layers, nil
+}
 
-		layerDiffID := config.RootFS.DiffIDs[idx]
-		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+// openLayerBlob returns the layer blob referenced by layerDescriptor, as well
+// as a reader for its uncompressed contents. Both must be closed by the
+// caller. The blob data is verified against the digest and size of
+// layerDescriptor as it is read (see finishLayerBlob). If opt.NoVerify is set,
+// a mismatch is only logged as a warning. Encrypted layers are decrypted using
+// opt.DecryptionKeys, and missing foreign layers are fetched if
+// opt.ForeignLayers is set.
+func openLayerBlob(ctx context.Context, engineExt casext.Engine, layerDescriptor ispec.Descriptor, opt *UnpackOptions) (*casext.Blob, io.ReadCloser, error) {
+	verify := !opt.NoVerify
+	keys := opt.DecryptionKeys
+
+	mediaType := layerDescriptor.MediaType
+	encrypted := crypt.IsEncrypted(mediaType)
+	if encrypted {
+		mediaType = crypt.DecryptedMediaType(mediaType)
+	}
+	if !isLayerType(mediaType) {
+		return nil, nil, errors.Errorf("unpack rootfs: layer %s: blob is not correct mediatype: %s", layerDescriptor.Digest, layerDescriptor.MediaType)
+	}
+	if encrypted && len(keys) == 0 {
+		return nil, nil, errors.Errorf("layer %s is encrypted: a decryption key is required", layerDescriptor.Digest)
+	}
 
-		layerBlob, err := engineExt.FromDescriptor(ctx, layerDescriptor)
+	layerBlob, err := getLayerBlob(ctx, engineExt, layerDescriptor, verify)
+	if err != nil && isMissingBlob(err) && len(layerDescriptor.URLs) > 0 && opt.ForeignLayers != nil {
+		layerBlob, err = fetchLayerBlob(ctx, engineExt, layerDescriptor, *opt.ForeignLayers, verify)
+	}
+	if err != nil {
+		return nil, nil, layerBlobError(layerDescriptor, err)
+	}
+	layerData, ok := layerBlob.Data.(io.ReadCloser)
+	if !ok {
+		layerBlob.Close()
+		// Should _never_ be reached.
+		return nil, nil, errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+	}
+	if encrypted {
+		// The decrypted stream replaces the blob data, so that the rest of
+		// the layer is authenticated by finishLayerBlob.
+		decrypted, err := crypt.DecryptLayer(layerData, layerDescriptor, keys)
 		if err != nil {
-			return errors.Wrap(err, "get layer blob")
+			layerBlob.Close()
+			return nil, nil, errors.Wrap(err, "decrypt layer")
 		}
-		defer layerBlob.Close()
-		if !isLayerType(layerBlob.Descriptor.MediaType) {
-			return errors.Errorf("unpack rootfs: layer %s: blob is not correct mediatype: %s", layerBlob.Descriptor.Digest, layerBlob.Descriptor.MediaType)
+		layerBlob.Data = decrypted
+		layerData = decrypted
+	}
+
+	// We have to extract a decompressed version of the above layer. Also
+	// note that we have to check the DiffID we're extracting (which is the
+	// digest of the *uncompressed* layer).
+	layerRaw, err := decompressLayer(mediaType, layerData)
+	if err != nil {
+		layerBlob.Close()
+		return nil, nil, errors.Wrap(err, "decompress layer")
+	}
+	return layerBlob, layerRaw, nil
+}
+
+// isNonDistributableType returns whether the given MediaType is the media type
+// of a non-distributable layer blob.
+func isNonDistributableType(mediaType string) bool {
+	return mediaType == ispec.MediaTypeImageLayerNonDistributable ||
+		mediaType == ispec.MediaTypeImageLayerNonDistributableGzip ||
+		mediaType == MediaTypeImageLayerNonDistributableZstd
+}
+
+// getLayerBlob returns the blob referenced by layerDescriptor. If verify is
+// false, a mismatch between the blob and layerDescriptor is only logged as a
+// warning.
+func getLayerBlob(ctx context.Context, engineExt casext.Engine, layerDescriptor ispec.Descriptor, verify bool) (*casext.Blob, error) {
+	if verify {
+		return engineExt.FromDescriptor(ctx, layerDescriptor)
+	}
+	// Skip both our verification and any done by the engine itself, so that a
+	// mismatch doesn't cause the read to fail.
+	reader, err := engineExt.GetBlob(ctx, layerDescriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return &casext.Blob{
+		Descriptor: layerDescriptor,
+		Data:       newMismatchWarner(hardening.Unverified(reader), layerDescriptor),
+	}, nil
+}
+
+// fetchLayerBlob fetches the missing blob of the foreign layer referenced by
+// layerDescriptor from its urls and adds it to the image, returning the blob
+// (see getLayerBlob). If the image is read-only, the blob is instead streamed
+// directly from the urls (and is always verified).
+func fetchLayerBlob(ctx context.Context, engineExt casext.Engine, layerDescriptor ispec.Descriptor, remoteOpt remote.Options, verify bool) (*casext.Blob, error) {
+	err := engineExt.FetchForeignLayer(ctx, layerDescriptor, remoteOpt)
+	if errors.Cause(err) == cas.ErrReadOnly {
+		log.Debugf("image is read-only: streaming foreign layer %s", layerDescriptor.Digest)
+		reader, err := casext.OpenForeignLayer(ctx, layerDescriptor, remoteOpt)
+		if err != nil {
+			return nil, err
 		}
-		layerData, ok := layerBlob.Data.(io.ReadCloser)
-		if !ok {
-			// Should _never_ be reached.
-			return errors.Errorf("[internal error] layerBlob was not an io.ReadCloser")
+		return &casext.Blob{
+			Descriptor: layerDescriptor,
+			Data:       reader,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return getLayerBlob(ctx, engineExt, layerDescriptor, verify)
+}
+
+// isMissingBlob returns whether err (as returned when fetching a blob)
+// indicates that the blob is not in the image.
+func isMissingBlob(err error) bool {
+	cause := errors.Cause(err)
+	return cause == cas.ErrNotExist || os.IsNotExist(cause)
+}
+
+// layerBlobError wraps an error from fetching the blob of layerDescriptor. If
+// the blob is missing and the layer is a foreign layer (a non-distributable
+// layer, or one with urls), the error says so -- umoci only fetches foreign
+// layers if UnpackOptions.ForeignLayers is set.
+func layerBlobError(layerDescriptor ispec.Descriptor, err error) error {
+	if !isMissingBlob(err) {
+		return errors.Wrap(err, "get layer blob")
+	}
+	if len(layerDescriptor.URLs) > 0 {
+		return errors.Wrapf(err, "layer %s: foreign layer is not available locally (urls: %s)", layerDescriptor.Digest, strings.Join(layerDescriptor.URLs, ", "))
+	}
+	if isNonDistributableType(layerDescriptor.MediaType) {
+		return errors.Wrapf(err, "layer %s: foreign layer is not available locally", layerDescriptor.Digest)
+	}
+	return errors.Wrap(err, "get layer blob")
+}
+
+// diffIDDigester returns a digester for verifying a layer against the given
+// DiffID, using the same digest algorithm as the DiffID. If verify is false
+// and the DiffID is invalid, nil is returned (since there is nothing to
+// compare the layer against).
+func diffIDDigester(layerDiffID digest.Digest, verify bool) (digest.Digester, error) {
+	if err := layerDiffID.Validate(); err != nil {
+		if !verify {
+			return nil, nil
 		}
+		return nil, errors.Wrapf(err, "unpack manifest: invalid diffid %s", layerDiffID)
+	}
+	return layerDiffID.Algorithm().Digester(), nil
+}
 
-		layerRaw := layerData
-		if needsGunzip(layerBlob.Descriptor.MediaType) {
-			// We have to extract a gzip'd version of the above layer. Also note
-			// that we have to check the DiffID we're extracting (which is the
-			// sha256 sum of the *uncompressed* layer).
-			layerRaw, err = gzip.NewReader(layerData)
-			if err != nil {
-				return errors.Wrap(err, "create gzip reader")
-			}
+// checkDiffID returns an error if the digest of the uncompressed layer
+// computed by layerDigester doesn't match layerDiffID. If verify is false, a
+// mismatch is only logged as a warning.
+func checkDiffID(layerDescriptor ispec.Descriptor, layerDigester digest.Digester, layerDiffID digest.Digest, verify bool) error {
+	if layerDigester == nil {
+		return nil
+	}
+	if layerDigest := layerDigester.Digest(); layerDigest != layerDiffID {
+		if verify {
+			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
 		}
+		log.Warnf("unpack manifest: layer %s: diffid mismatch (ignored since verification is disabled): got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+	}
+	return nil
+}
+
+// mismatchWarner is an io.ReadCloser which digests a layer blob as it is
+// read, and logs a warning on Close if it doesn't match the digest and size
+// of its descriptor. Unlike hardening.VerifiedReadCloser, reads never fail
+// because of a mismatch. It is used when verification is disabled.
+type mismatchWarner struct {
+	io.ReadCloser
+	descriptor ispec.Descriptor
+	digester   digest.Digester
+	size       int64
+	eof        bool
+}
 
-		layerDigester := digest.SHA256.Digester()
-		layer := io.TeeReader(layerRaw, layerDigester.Hash())
+// newMismatchWarner wraps reader in a mismatchWarner for descriptor. If the
+// digest of descriptor is invalid, reader is returned unchanged.
+func newMismatchWarner(reader io.ReadCloser, descriptor ispec.Descriptor) io.ReadCloser {
+	if err := descriptor.Digest.Validate(); err != nil {
+		return reader
+	}
+	return &mismatchWarner{
+		ReadCloser: reader,
+		descriptor: descriptor,
+		digester:   descriptor.Digest.Algorithm().Digester(),
+	}
+}
+
+func (w *mismatchWarner) Read(p []byte) (int, error) {
+	n, err := w.ReadCloser.Read(p)
+	// hash.Hash guarantees Write() never fails and is never short.
+	_, _ = w.digester.Hash().Write(p[:n])
+	w.size += int64(n)
+	if err == io.EOF {
+		w.eof = true
+	}
+	return n, err
+}
 
-		if err := UnpackLayer(rootfsPath, layer, opt); err != nil {
-			return errors.Wrap(err, "unpack layer")
+func (w *mismatchWarner) Close() error {
+	// A partially-read blob can't be checked. The blob may be closed more
+	// than once, but we only want to warn once.
+	if w.eof {
+		w.eof = false
+		if blobDigest := w.digester.Digest(); blobDigest != w.descriptor.Digest {
+			log.Warnf("unpack manifest: layer %s: blob digest mismatch (ignored since verification is disabled): got %s", w.descriptor.Digest, blobDigest)
+		} else if w.size != w.descriptor.Size {
+			log.Warnf("unpack manifest: layer %s: blob size mismatch (ignored since verification is disabled): got %d bytes expected %d", w.descriptor.Digest, w.size, w.descriptor.Size)
 		}
-		// Different tar implementations can have different levels of redundant
-		// padding and other similar weird behaviours. While on paper they are
-		// all entirely valid archives, Go's tar.Reader implementation doesn't
-		// guarantee that the entire stream will be consumed (which can result
-		// in the later diff_id check failing because the digester didn't get
-		// the whole uncompressed stream). Just blindly consume anything left
-		// in the layer.
-		if _, err = io.Copy(ioutil.Discard, layer); err != nil {
-			return errors.Wrap(err, "discard trailing archive bits")
+	}
+	return w.ReadCloser.Close()
+}
+
+// finishLayerBlob consumes the rest of the layer blob (the decompressor need
+// not read the compressed stream to EOF) and closes it. The digest and size
+// of a verified blob are only checked once all of it has been read, so any
+// mismatch with the manifest is returned here.
+func finishLayerBlob(layerBlob *casext.Blob) error {
+	layerData := layerBlob.Data.(io.ReadCloser)
+	if _, err := io.Copy(ioutil.Discard, layerData); err != nil {
+		return errors.Wrapf(err, "unpack manifest: layer %s: verify blob", layerBlob.Descriptor.Digest)
+	}
+	if err := layerData.Close(); err != nil {
+		return errors.Wrapf(err, "unpack manifest: layer %s: verify blob", layerBlob.Descriptor.Digest)
+	}
+	return nil
+}
+
+// layerUnpacker extracts an uncompressed layer to root, such as unpackLayer.
+type layerUnpacker func(ctx context.Context, root string, layer io.Reader, opt *UnpackOptions) error
+
+// unpackLayerBlob extracts the layer blob referenced by layerDescriptor to
+// rootfsPath using unpack, verifying that its DiffID matches layerDiffID (if
+// opt.NoVerify is set, a mismatch is only logged as a warning).
+func unpackLayerBlob(ctx context.Context, engineExt casext.Engine, rootfsPath string, layerDescriptor ispec.Descriptor, layerDiffID digest.Digest, opt *UnpackOptions, unpack layerUnpacker) error {
+	verify := !opt.NoVerify
+	layerBlob, layerRaw, err := openLayerBlob(ctx, engineExt, layerDescriptor, opt)
+	if err != nil {
+		return err
+	}
+	defer layerBlob.Close()
+	defer layerRaw.Close()
+
+	var layer io.Reader = layerRaw
+	layerDigester, err := diffIDDigester(layerDiffID, verify)
+	if err != nil {
+		return err
+	}
+	if layerDigester != nil {
+		layer = io.TeeReader(layerRaw, layerDigester.Hash())
+	}
+
+	if err := unpack(ctx, rootfsPath, layer, opt); err != nil {
+		return errors.Wrap(err, "unpack layer")
+	}
+	// Different tar implementations can have different levels of redundant
+	// padding and other similar weird behaviours. While on paper they are
+	// all entirely valid archives, Go's tar.Reader implementation doesn't
+	// guarantee that the entire stream will be consumed (which can result
+	// in the later diff_id check failing because the digester didn't get
+	// the whole uncompressed stream). Just blindly consume anything left
+	// in the layer.
+	if _, err = io.Copy(ioutil.Discard, layer); err != nil {
+		return errors.Wrap(err, "discard trailing archive bits")
+	}
+	if err := finishLayerBlob(layerBlob); err != nil {
+		return err
+	}
+
+	return checkDiffID(layerDescriptor, layerDigester, layerDiffID, verify)
+}
+
+// spoolLayerBlob decompresses the layer blob referenced by layerDescriptor to
+// a new file inside spoolDir, verifying that its DiffID matches layerDiffID
+// (if opt.NoVerify is set, a mismatch is only logged as a warning). The path of
+// the file is returned.
+func spoolLayerBlob(ctx context.Context, engineExt casext.Engine, spoolDir string, layerDescriptor ispec.Descriptor, layerDiffID digest.Digest, opt *UnpackOptions) (string, error) {
+	verify := !opt.NoVerify
+	layerBlob, layerRaw, err := openLayerBlob(ctx, engineExt, layerDescriptor, opt)
+	if err != nil {
+		return "", err
+	}
+	defer layerBlob.Close()
+	defer layerRaw.Close()
+
+	fh, err := ioutil.TempFile(spoolDir, "layer-")
+	if err != nil {
+		return "", errors.Wrap(err, "create spooled layer")
+	}
+	defer fh.Close()
+
+	var spool io.Writer = fh
+	layerDigester, err := diffIDDigester(layerDiffID, verify)
+	if err != nil {
+		return "", err
+	}
+	if layerDigester != nil {
+		spool = io.MultiWriter(fh, layerDigester.Hash())
+	}
+	if _, err := io.Copy(spool, layerRaw); err != nil {
+		return "", errors.Wrap(err, "spool layer")
+	}
+	if err := fh.Close(); err != nil {
+		return "", errors.Wrap(err, "close spooled layer")
+	}
+	if err := finishLayerBlob(layerBlob); err != nil {
+		return "", err
+	}
+
+	if err := checkDiffID(layerDescriptor, layerDigester, layerDiffID, verify); err != nil {
+		return "", err
+	}
+	return fh.Name(), nil
+}
+
+// spooledLayer is the result of spoolLayerBlob.
+type spooledLayer struct {
+	path string
+	err  error
+}
+
+// unpackLayersPipelined extracts the given layers of the manifest to
+// rootfsPath in order, the same as the serial loop in UnpackRootfs. However,
+// up to jobs layers are decompressed (and verified) concurrently into
+// temporary files next to rootfsPath, so that the decompression of later
+// layers overlaps with the extraction of earlier ones. The entries of each
+// layer are still extracted in order, since the result of extracting an
+// entry (whiteouts, hardlinks and the metadata of parent directories) can
+// depend on every entry before it.
+func unpackLayersPipelined(ctx context.Context, engineExt casext.Engine, rootfsPath string, manifest ispec.Manifest, diffIDs []digest.Digest, layers []int, opt *UnpackOptions, jobs int) error {
+	spoolDir, err := ioutil.TempDir(filepath.Dir(rootfsPath), ".umoci-unpack-")
+	if err != nil {
+		return errors.Wrap(err, "create spool directory")
+	}
+
+	var (
+		wg      sync.WaitGroup
+		done    = make(chan struct{})
+		slots   = make(chan struct{}, jobs)
+		results = make([]chan spooledLayer, len(layers))
+	)
+	for i := range results {
+		results[i] = make(chan spooledLayer, 1)
+	}
+	defer func() {
+		close(done)
+		wg.Wait()
+		// #nosec G104
+		_ = os.RemoveAll(spoolDir)
+	}()
+
+	// Layers are spooled in order, and each one holds a slot until it has
+	// been extracted. This bounds both the number of concurrent
+	// decompressions and the amount of space used by spooled layers.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, idx := range layers {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			wg.Add(1)
+			go func(i, idx int) {
+				defer wg.Done()
+				path, err := spoolLayerBlob(ctx, engineExt, spoolDir, manifest.Layers[idx], diffIDs[idx], opt)
+				results[i] <- spooledLayer{path: path, err: err}
+			}(i, idx)
 		}
-		if err := layerData.Close(); err != nil {
-			return errors.Wrap(err, "close layer data")
+	}()
+
+	for i, idx := range layers {
+		layerDescriptor := manifest.Layers[idx]
+		spooled := <-results[i]
+		if spooled.err != nil {
+			return spooled.err
 		}
 
-		layerDigest := layerDigester.Digest()
-		if layerDigest != layerDiffID {
-			return errors.Errorf("unpack manifest: layer %s: diffid mismatch: got %s expected %s", layerDescriptor.Digest, layerDigest, layerDiffID)
+		log.Infof("unpack layer: %s", layerDescriptor.Digest)
+		if err := unpackSpooledLayer(ctx, rootfsPath, spooled.path, opt); err != nil {
+			return err
 		}
+		// #nosec G104
+		_ = os.Remove(spooled.path)
+		<-slots
 
-		if callback != nil {
-			if err := callback(manifest, layerDescriptor); err != nil {
+		if opt.AfterLayerUnpack != nil {
+			if err := opt.AfterLayerUnpack(manifest, layerDescriptor); err != nil {
 				return err
 			}
 		}
 	}
-
 	return nil
 }
 
+// unpackSpooledLayer extracts the uncompressed layer (as spooled by
+// spoolLayerBlob) at path to rootfsPath.
+func unpackSpooledLayer(ctx context.Context, rootfsPath string, path string, opt *UnpackOptions) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open spooled layer")
+	}
+	defer fh.Close()
+	return errors.Wrap(unpackLayer(ctx, rootfsPath, fh, opt), "unpack layer")
+}
+
 // UnpackRuntimeJSON converts a given manifest's configuration to a runtime
 // configuration and writes it to the given writer. If rootfs is specified, it
 // is sourced during the configuration generation (for conversion of
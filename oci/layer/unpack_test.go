@@ -18,20 +18,33 @@
 package layer
 
 import (
+	"archive/tar"
 	"bytes"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/cas/dir"
 	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/pkg/fseval"
+	"github.com/openSUSE/umoci/pkg/hardening"
+	"github.com/openSUSE/umoci/pkg/remote"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
 	"golang.org/x/net/context"
 )
 
@@ -219,3 +232,484 @@ func TestUnpackStartFromDescriptor(t *testing.T) {
 		t.Errorf("test file present? %+v\n", err)
 	}
 }
+
+func TestUnpackForeignLayer(t *testing.T) {
+	ctx := context.Background()
+
+	root, manifest, engineExt := makeImage(t)
+	defer os.RemoveAll(root)
+
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+				{HostID: uint32(os.Geteuid()), ContainerID: 1000, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+				{HostID: uint32(os.Getegid()), ContainerID: 100, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+
+	// Make the top layer a foreign layer. Since we have a local copy of it,
+	// unpacking must work.
+	foreign := &manifest.Layers[1]
+	foreign.MediaType = ispec.MediaTypeImageLayerNonDistributableGzip
+	foreign.URLs = []string{"https://example.com/layer.tar.gz"}
+	if err := UnpackManifestWithOptions(ctx, engineExt, filepath.Join(root, "bundle-local"), manifest, unpackOptions); err != nil {
+		t.Errorf("unexpected UnpackManifest error: %+v", err)
+	}
+
+	// Without the local copy, the error must make it clear that the layer is
+	// a foreign layer (which we only fetch if asked to).
+	foreignBlob, err := engineExt.GetBlob(ctx, foreign.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreignData, err := ioutil.ReadAll(foreignBlob)
+	foreignBlob.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.DeleteBlob(ctx, foreign.Digest); err != nil {
+		t.Fatal(err)
+	}
+	for _, jobs := range []int{1, 2} {
+		unpackOptions.Jobs = jobs
+		err := UnpackManifestWithOptions(ctx, engineExt, filepath.Join(root, fmt.Sprintf("bundle-missing-%d", jobs)), manifest, unpackOptions)
+		if err == nil {
+			t.Errorf("expected error unpacking missing foreign layer (jobs=%d)", jobs)
+		} else if !strings.Contains(err.Error(), "foreign layer is not available locally") || !strings.Contains(err.Error(), foreign.URLs[0]) {
+			t.Errorf("unexpected error unpacking missing foreign layer (jobs=%d): %v", jobs, err)
+		}
+	}
+
+	// With ForeignLayers, the layer is fetched from its urls and added to the
+	// image.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/layer.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(foreignData)
+	}))
+	defer server.Close()
+	foreign.URLs = []string{server.URL + "/missing.tar.gz", server.URL + "/layer.tar.gz"}
+	unpackOptions.ForeignLayers = &remote.Options{}
+	for _, jobs := range []int{1, 2} {
+		unpackOptions.Jobs = jobs
+		if err := UnpackManifestWithOptions(ctx, engineExt, filepath.Join(root, fmt.Sprintf("bundle-fetched-%d", jobs)), manifest, unpackOptions); err != nil {
+			t.Errorf("unexpected error unpacking fetched foreign layer (jobs=%d): %+v", jobs, err)
+		}
+		blob, err := engineExt.FromDescriptor(ctx, *foreign)
+		if err != nil {
+			t.Errorf("fetched foreign layer was not added to the image (jobs=%d): %+v", jobs, err)
+			continue
+		}
+		blob.Close()
+		if err := engineExt.DeleteBlob(ctx, foreign.Digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A fetched layer which doesn't match the descriptor must be rejected.
+	foreignData = append(foreignData, 0)
+	if err := UnpackManifestWithOptions(ctx, engineExt, filepath.Join(root, "bundle-corrupt"), manifest, unpackOptions); err == nil {
+		t.Errorf("expected error unpacking corrupted foreign layer")
+	}
+}
+
+func TestUnpackRootfsJobs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsJobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifest := makeTarImage(t, root, [][]catEntry{
+		{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "base os-release"},
+			{name: "etc/hostname", typeflag: tar.TypeReg, data: "base hostname"},
+			{name: "etc/link", typeflag: tar.TypeLink, linkname: "etc/hostname"},
+			{name: "opaque/", typeflag: tar.TypeDir},
+			{name: "opaque/file", typeflag: tar.TypeReg, data: "opaque file"},
+			{name: "deleted", typeflag: tar.TypeReg, data: "deleted file"},
+			{name: "symlink", typeflag: tar.TypeSymlink, linkname: "etc/hostname"},
+		},
+		{
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "new os-release"},
+			{name: "opaque/", typeflag: tar.TypeDir},
+			{name: "opaque/" + whOpaque, typeflag: tar.TypeReg},
+			{name: "opaque/new", typeflag: tar.TypeReg, data: "new opaque file"},
+			{name: whPrefix + "deleted", typeflag: tar.TypeReg},
+		},
+		{
+			{name: "etc/other", typeflag: tar.TypeLink, linkname: "etc/os-release"},
+			{name: "deleted", typeflag: tar.TypeReg, data: "recreated file"},
+		},
+		{
+			{name: "etc/" + whPrefix + "hostname", typeflag: tar.TypeReg},
+			{name: "new/", typeflag: tar.TypeDir},
+			{name: "new/file", typeflag: tar.TypeReg, data: "new file"},
+		},
+	})
+	defer engineExt.Close()
+
+	// The layers are uncompressed, so the DiffIDs are the layer digests.
+	var diffIDs []digest.Digest
+	for _, layerDescriptor := range manifest.Layers {
+		diffIDs = append(diffIDs, layerDescriptor.Digest)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS:     "linux",
+		RootFS: ispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	keywords := []mtree.Keyword{"type", "link", "nlink", "uid", "gid", "mode", "size", "time", "sha256digest"}
+	unpack := func(t *testing.T, jobs int) *mtree.DirectoryHierarchy {
+		rootfs := filepath.Join(root, fmt.Sprintf("rootfs-%d", jobs))
+		opt := &UnpackOptions{
+			MapOptions: MapOptions{
+				UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+				GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+				Rootless:    os.Geteuid() != 0,
+			},
+			Jobs: jobs,
+		}
+		var unpacked []digest.Digest
+		opt.AfterLayerUnpack = func(m ispec.Manifest, d ispec.Descriptor) error {
+			unpacked = append(unpacked, d.Digest)
+			return nil
+		}
+		if err := UnpackRootfsWithOptions(ctx, engineExt, rootfs, manifest, opt); err != nil {
+			t.Fatalf("unexpected UnpackRootfs error: %+v", err)
+		}
+		if !reflect.DeepEqual(unpacked, diffIDs) {
+			t.Errorf("layers unpacked out of order: expected %v, got %v", diffIDs, unpacked)
+		}
+
+		fsEval := fseval.DefaultFsEval
+		if opt.MapOptions.Rootless {
+			fsEval = fseval.RootlessFsEval
+		}
+		dh, err := mtree.Walk(rootfs, nil, keywords, fsEval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dh
+	}
+
+	serial := unpack(t, 1)
+	for _, jobs := range []int{2, 4, 16} {
+		t.Run(fmt.Sprintf("Jobs%d", jobs), func(t *testing.T) {
+			parallel := unpack(t, jobs)
+			diffs, err := mtree.Compare(serial, parallel, keywords)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diffs) != 0 {
+				t.Errorf("parallel unpack differs from serial unpack: %v", diffs)
+			}
+		})
+	}
+
+	// No temporary files may be left behind.
+	names, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range names {
+		if strings.HasPrefix(fi.Name(), ".umoci-unpack-") {
+			t.Errorf("spool directory %s was not removed", fi.Name())
+		}
+	}
+
+	// A corrupted layer must still be detected.
+	manifest.Layers[2].Digest = manifest.Layers[1].Digest
+	if err := UnpackRootfsWithOptions(ctx, engineExt, filepath.Join(root, "rootfs-bad"), manifest, &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+			GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+			Rootless:    os.Geteuid() != 0,
+		},
+		Jobs: 4,
+	}); err == nil {
+		t.Errorf("expected diffid mismatch error")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "rootfs-bad")); !os.IsNotExist(err) {
+		t.Errorf("rootfs not removed after failed unpack: %v", err)
+	}
+}
+
+func TestUnpackRootfsVerify(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsVerify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifest := makeTarImage(t, filepath.Join(root, "good"), [][]catEntry{
+		{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/hostname", typeflag: tar.TypeReg, data: "hostname"},
+		},
+		{
+			{name: "etc/file", typeflag: tar.TypeReg, data: "original"},
+		},
+	})
+	defer engineExt.Close()
+	badEngineExt, badManifest := makeTarImage(t, filepath.Join(root, "bad"), [][]catEntry{
+		{
+			{name: "etc/file", typeflag: tar.TypeReg, data: "tampered"},
+		},
+	})
+	defer badEngineExt.Close()
+
+	// The layers are uncompressed, so the DiffIDs are the layer digests.
+	var diffIDs []digest.Digest
+	for _, layerDescriptor := range manifest.Layers {
+		diffIDs = append(diffIDs, layerDescriptor.Digest)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, ispec.Image{
+		OS:     "linux",
+		RootFS: ispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	// Replace the contents of the top layer blob with a different layer of
+	// the same size.
+	expected := manifest.Layers[1].Digest
+	actual := badManifest.Layers[0].Digest
+	if manifest.Layers[1].Size != badManifest.Layers[0].Size {
+		t.Fatalf("tampered layer has a different size: %d != %d", manifest.Layers[1].Size, badManifest.Layers[0].Size)
+	}
+	tampered, err := ioutil.ReadFile(filepath.Join(root, "bad", "image", "blobs", actual.Algorithm().String(), actual.Hex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "good", "image", "blobs", expected.Algorithm().String(), expected.Hex()), tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, jobs := range []int{1, 2} {
+		t.Run(fmt.Sprintf("Jobs%d", jobs), func(t *testing.T) {
+			opt := UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+					GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+					Rootless:    os.Geteuid() != 0,
+				},
+				Jobs: jobs,
+			}
+
+			// The mismatch must be detected by default, and the error must
+			// include both the expected and actual digests.
+			rootfs := filepath.Join(root, fmt.Sprintf("rootfs-verify-%d", jobs))
+			err := UnpackRootfsWithOptions(ctx, engineExt, rootfs, manifest, &opt)
+			if err == nil {
+				t.Fatalf("expected digest mismatch error")
+			}
+			if errors.Cause(err) != hardening.ErrDigestMismatch {
+				t.Errorf("expected digest mismatch error, got %+v", err)
+			}
+			for _, dgst := range []digest.Digest{expected, actual} {
+				if !strings.Contains(err.Error(), dgst.String()) {
+					t.Errorf("digest mismatch error does not include %s: %v", dgst, err)
+				}
+			}
+			if _, err := os.Lstat(rootfs); !os.IsNotExist(err) {
+				t.Errorf("rootfs not removed after failed unpack: %v", err)
+			}
+
+			// With NoVerify, the tampered layer is extracted but both
+			// mismatches are logged as warnings.
+			var (
+				warningsLock sync.Mutex
+				warnings     []string
+			)
+			oldHandler := log.Log.(*log.Logger).Handler
+			log.SetHandler(log.HandlerFunc(func(entry *log.Entry) error {
+				if entry.Level == log.WarnLevel {
+					warningsLock.Lock()
+					warnings = append(warnings, entry.Message)
+					warningsLock.Unlock()
+				}
+				return nil
+			}))
+			defer log.SetHandler(oldHandler)
+
+			opt.NoVerify = true
+			rootfs = filepath.Join(root, fmt.Sprintf("rootfs-noverify-%d", jobs))
+			if err := UnpackRootfsWithOptions(ctx, engineExt, rootfs, manifest, &opt); err != nil {
+				t.Fatalf("unexpected UnpackRootfs error with NoVerify: %+v", err)
+			}
+			for _, mismatch := range []string{"blob digest mismatch", "diffid mismatch"} {
+				found := false
+				for _, warning := range warnings {
+					if strings.Contains(warning, mismatch) && strings.Contains(warning, expected.String()) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("expected %s warning with NoVerify, got %q", mismatch, warnings)
+				}
+			}
+			data, err := ioutil.ReadFile(filepath.Join(rootfs, "etc", "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "tampered" {
+				t.Errorf("unexpected contents of etc/file: %q", data)
+			}
+		})
+	}
+}
+
+func TestUnpackDeltaLayer(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackDeltaLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		{Name: "etc/" + whPrefix + "removed", Typeflag: tar.TypeReg},
+		{Name: whPrefix + "gone", Typeflag: tar.TypeReg},
+		{Name: "missing/parent/" + whPrefix + "file", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	unpackOptions := &UnpackOptions{
+		MapOptions: MapOptions{
+			UIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1},
+			},
+			GIDMappings: []rspec.LinuxIDMapping{
+				{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1},
+			},
+			Rootless: os.Geteuid() != 0,
+		},
+	}
+	if err := UnpackDeltaLayer(root, &buffer, unpackOptions); err != nil {
+		t.Fatalf("unexpected UnpackDeltaLayer error: %+v", err)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(root, "etc/file")); err != nil {
+		t.Errorf("unexpected error reading etc/file: %+v", err)
+	} else if string(data) != "data" {
+		t.Errorf("unexpected etc/file contents: %q", data)
+	}
+
+	// Whiteouts must be extracted verbatim as empty files.
+	for _, path := range []string{
+		"etc/" + whPrefix + "removed",
+		whPrefix + "gone",
+		"missing/parent/" + whPrefix + "file",
+	} {
+		fi, err := os.Lstat(filepath.Join(root, path))
+		if err != nil {
+			t.Errorf("expected whiteout %s to exist: %+v", path, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() || fi.Size() != 0 {
+			t.Errorf("expected whiteout %s to be an empty file: mode=%s size=%d", path, fi.Mode(), fi.Size())
+		}
+	}
+}
+
+func TestUnpackRootfsCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackRootfsCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, manifest := makeTarImage(t, root, [][]catEntry{
+		{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/hostname", typeflag: tar.TypeReg, data: "base hostname"},
+		},
+		{
+			{name: "etc/os-release", typeflag: tar.TypeReg, data: "new os-release"},
+		},
+	})
+	defer engineExt.Close()
+
+	// The layers are uncompressed, so the DiffIDs are the layer digests.
+	var diffIDs []digest.Digest
+	for _, layerDescriptor := range manifest.Layers {
+		diffIDs = append(diffIDs, layerDescriptor.Digest)
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Image{
+		OS:     "linux",
+		RootFS: ispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, jobs := range []int{1, 2} {
+		t.Run(fmt.Sprintf("Jobs%d", jobs), func(t *testing.T) {
+			rootfs := filepath.Join(root, fmt.Sprintf("rootfs-%d", jobs))
+			err := UnpackRootfsWithOptions(ctx, engineExt, rootfs, manifest, &UnpackOptions{
+				MapOptions: MapOptions{
+					UIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}},
+					GIDMappings: []rspec.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}},
+					Rootless:    os.Geteuid() != 0,
+				},
+				Jobs: jobs,
+			})
+			if errors.Cause(err) != context.Canceled {
+				t.Errorf("expected unpack to be cancelled: got %v", err)
+			}
+			if _, err := os.Lstat(rootfs); !os.IsNotExist(err) {
+				t.Errorf("rootfs not removed after cancelled unpack: %v", err)
+			}
+		})
+	}
+}
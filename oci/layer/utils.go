@@ -19,19 +19,27 @@ package layer
 
 import (
 	"archive/tar"
+	"crypto/rsa"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/golang/protobuf/proto"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/openSUSE/umoci/pkg/remote"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	rootlesscontainers "github.com/rootless-containers/proto/go-proto"
 )
 
-// MapOptions specifies the UID and GID mappings used when unpacking and
-// repacking images.
+// MapOptions specifies the UID and GID mappings (and whether rootless mode is
+// used) of a bundle. These are stored in the bundle metadata, and are used both
+// when unpacking and repacking images. The options which only affect how
+// layers are extracted are in UnpackOptions, and the options which only
+// affect how layers are generated are in GenerateOptions.
 type MapOptions struct {
 	// UIDMappings and GIDMappings are the UID and GID mappings to apply when
 	// packing and unpacking image rootfs layers.
@@ -40,15 +48,165 @@ type MapOptions struct {
 
 	// Rootless specifies whether any to error out if chown fails.
 	Rootless bool `json:"rootless"`
+}
+
+// UnpackOptions are the options used when unpacking an image. MapOptions is
+// stored in the bundle metadata (so that the bundle is repacked with the same
+// mappings), but the other options only affect how the image is unpacked and
+// are never stored.
+type UnpackOptions struct {
+	// MapOptions are the UID and GID mappings (and the other options of the
+	// bundle) used to extract the layers.
+	MapOptions MapOptions
 
 	// KeepDirlinks is essentially the same as rsync's optio
 	// --keep-dirlinks: if, on extraction, a directory would be created
 	// where a symlink to a directory previously existed, KeepDirlinks
 	// doesn't create that directory, but instead just uses the existing
 	// symlink.
-	KeepDirlinks bool `json:"-"`
+	KeepDirlinks bool
+
+	// FollowSymlinks allows entries to be extracted through existing symlinks
+	// in the parent components of their paths (scoped to the root filesystem,
+	// so an entry can never be written outside of it). By default such
+	// entries are rejected, unless the symlink is a link to a directory and
+	// KeepDirlinks is set. This should only be used with trusted images.
+	FollowSymlinks bool
+
+	// SymlinkPolicy is applied to every symlink when extracting a layer, in
+	// order to restrict which symlinks are created.
+	SymlinkPolicy SymlinkPolicy
+
+	// Sparse enables support for sparse files when extracting a layer: blocks
+	// of regular files which consist entirely of zeroes are left as holes
+	// rather than being written. The contents of the files are the same
+	// either way.
+	Sparse bool
+
+	// Jobs is the number of layers which may be decompressed concurrently.
+	// Layers are always extracted one at a time (in order), but with more
+	// than one job the following layers are decompressed to temporary files
+	// while the current layer is being extracted. The extracted root
+	// filesystem does not depend on the value of Jobs. Values less than 2
+	// disable this.
+	Jobs int
+
+	// UpTo, if non-zero, is the number of layers (from the bottom-most layer
+	// upwards) to extract. The remaining layers are skipped, so the extracted
+	// root filesystem is the root filesystem as it was at that point in the
+	// image.
+	UpTo int
+
+	// Platform, if non-nil, is the platform whose manifest is unpacked when
+	// the image being unpacked is an index. If nil, the platform of the
+	// running system is used (see casext.DefaultPlatform).
+	Platform *ispec.Platform
+
+	// NoVerify disables the verification of layers. By default every layer
+	// blob is checked against the digest and size of its descriptor in the
+	// manifest (and the uncompressed layer against its DiffID in the
+	// configuration) as it is read, and unpacking fails on any mismatch.
+	// With NoVerify, a mismatch is only logged as a warning. This should only
+	// be used with trusted image stores.
+	NoVerify bool
+
+	// WhiteoutMode controls how whiteouts are represented on the filesystem
+	// by UnpackDeltaLayer (see WhiteoutMode). It has no effect on normal
+	// extraction, where whiteouts are applied.
+	WhiteoutMode WhiteoutMode
+
+	// DecryptionKeys are the private keys used to decrypt encrypted layers
+	// (see the crypt package). Unpacking an image with an encrypted layer
+	// fails if none of the keys are recipients of the layer.
+	DecryptionKeys []*rsa.PrivateKey
+
+	// ForeignLayers, if non-nil, are the options used to fetch the blobs of
+	// foreign layers (layers with urls) which are missing from the image.
+	// The fetched blobs are verified and added to the image, or are streamed
+	// directly if the image is read-only. By default, unpacking an image with
+	// a missing foreign layer fails.
+	ForeignLayers *remote.Options
+
+	// AfterLayerUnpack, if non-nil, is called after each layer is extracted
+	// by UnpackRootfsWithOptions (and UnpackManifestWithOptions).
+	AfterLayerUnpack AfterLayerUnpackCallback
+
+	// StartFrom, if set, is the descriptor of the first layer to extract.
+	// The layers before it are skipped, and are assumed to already have been
+	// extracted to the root filesystem (which may already exist).
+	StartFrom ispec.Descriptor
+}
+
+// unpackOptions returns the UnpackOptions equivalent to the (possibly nil)
+// opt, for the functions which only take MapOptions.
+func unpackOptions(opt *MapOptions) *UnpackOptions {
+	var unpackOpt UnpackOptions
+	if opt != nil {
+		unpackOpt.MapOptions = *opt
+	}
+	return &unpackOpt
 }
 
+// GenerateOptions are the options used when generating a layer from a root
+// filesystem (such as when repacking a bundle). As with UnpackOptions, only
+// MapOptions is stored in the bundle metadata.
+type GenerateOptions struct {
+	// MapOptions are the UID and GID mappings (and the other options of the
+	// bundle) used to map the owners of the entries in the layer.
+	MapOptions MapOptions
+
+	// PermPolicy is applied to every entry when generating a layer, in order
+	// to ensure that certain mode bits are never set in the layer.
+	PermPolicy PermPolicy
+
+	// ClampMtime, if non-nil, is the latest modification time of any entry in
+	// a generated layer. Entries modified after ClampMtime have their mtime
+	// set to ClampMtime, and the atime and ctime of all entries are dropped,
+	// so that generating a layer from the same rootfs is reproducible.
+	ClampMtime *time.Time
+
+	// ForceUID and ForceGID, if non-nil, are the (container) owner and group
+	// of every entry in a generated layer, regardless of the owner of the
+	// files on the host (and of UIDMappings and GIDMappings).
+	ForceUID *int
+	ForceGID *int
+
+	// Progress, if non-nil, is called as each entry is added to a generated
+	// layer (see ProgressFunc).
+	Progress ProgressFunc
+
+	// Transform, if non-nil, is called for each file added to a generated
+	// layer, and may modify or skip the entry (see TarTransformFunc).
+	Transform TarTransformFunc
+
+	// Sparse causes regular files with holes to be written as PAX (GNU 1.0
+	// format) sparse entries which only contain the data regions of the
+	// file.
+	Sparse bool
+
+	// Filters are applied to the deltas given when generating a layer, and
+	// deltas whose path is rejected by any of them are left out of the layer
+	// (see mtreefilter.FilterDeltas). Filtered-out deletions do not get a
+	// whiteout.
+	Filters []mtreefilter.FilterFunc
+}
+
+// generateOptions returns the GenerateOptions equivalent to the (possibly nil)
+// opt, for the functions which only take MapOptions.
+func generateOptions(opt *MapOptions) *GenerateOptions {
+	var generateOpt GenerateOptions
+	if opt != nil {
+		generateOpt.MapOptions = *opt
+	}
+	return &generateOpt
+}
+
+// ProgressFunc is a callback used to report progress while processing the
+// files of a root filesystem. done and total are the number of bytes of
+// regular file contents processed so far and in total, and path is the path
+// (relative to the root filesystem) that was just processed.
+type ProgressFunc func(done, total int64, path string)
+
 // mapHeader maps a tar.Header generated from the filesystem so that it
 // describes the inode as it would be observed by a container process. In
 // particular this involves apply an ID mapping from the host filesystem to the
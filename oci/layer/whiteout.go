@@ -0,0 +1,71 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"github.com/pkg/errors"
+)
+
+// WhiteoutMode controls how whiteouts are represented on the filesystem when
+// they are extracted verbatim (rather than applied) from a layer, such as by
+// UnpackDeltaLayer, and which files on the filesystem are treated as
+// whiteouts when generating a layer from a directory, such as by
+// GenerateInsertLayerWithMode. The zero value is WhiteoutModeOCI.
+type WhiteoutMode int
+
+const (
+	// WhiteoutModeOCI represents whiteouts as they are stored in OCI layers:
+	// empty files with a ".wh." prefix (".wh..wh..opq" inside a directory for
+	// opaque whiteouts). Such files can only be extracted, because they
+	// cannot be included in a generated layer.
+	WhiteoutModeOCI WhiteoutMode = iota
+
+	// WhiteoutModeOverlayfs represents whiteouts the same way as overlayfs:
+	// character devices with device number 0:0, and OverlayOpaqueXattr set on
+	// opaque directories. The resulting directory can be used as a layer of
+	// an overlayfs mount, and the upper directory of an overlayfs mount can be
+	// used to generate a layer. Creating such whiteouts requires root
+	// privileges.
+	WhiteoutModeOverlayfs
+)
+
+// whiteoutModeNames are the names accepted by ParseWhiteoutMode.
+var whiteoutModeNames = map[string]WhiteoutMode{
+	"oci":       WhiteoutModeOCI,
+	"overlayfs": WhiteoutModeOverlayfs,
+}
+
+// ParseWhiteoutMode parses the name of a WhiteoutMode ("oci" or
+// "overlayfs").
+func ParseWhiteoutMode(mode string) (WhiteoutMode, error) {
+	wm, ok := whiteoutModeNames[mode]
+	if !ok {
+		return WhiteoutModeOCI, errors.Errorf("invalid whiteout mode: %q", mode)
+	}
+	return wm, nil
+}
+
+// String returns the name of the mode.
+func (wm WhiteoutMode) String() string {
+	for name, mode := range whiteoutModeNames {
+		if mode == wm {
+			return name
+		}
+	}
+	return "unknown"
+}
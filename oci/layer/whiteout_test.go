@@ -0,0 +1,191 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseWhiteoutMode(t *testing.T) {
+	for _, test := range []struct {
+		mode     string
+		expected WhiteoutMode
+		fail     bool
+	}{
+		{mode: "oci", expected: WhiteoutModeOCI},
+		{mode: "overlayfs", expected: WhiteoutModeOverlayfs},
+		{mode: "", fail: true},
+		{mode: "overlay", fail: true},
+	} {
+		wm, err := ParseWhiteoutMode(test.mode)
+		if test.fail {
+			if err == nil {
+				t.Errorf("ParseWhiteoutMode(%q): expected error, got %s", test.mode, wm)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseWhiteoutMode(%q): unexpected error: %+v", test.mode, err)
+			continue
+		}
+		if wm != test.expected {
+			t.Errorf("ParseWhiteoutMode(%q): expected %s, got %s", test.mode, test.expected, wm)
+		}
+		if wm.String() != test.mode {
+			t.Errorf("ParseWhiteoutMode(%q).String(): got %q", test.mode, wm.String())
+		}
+	}
+}
+
+func TestUnpackDeltaLayerWhiteoutMode(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Log("overlay whiteouts can only be created with root privileges")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestUnpackDeltaLayerWhiteoutMode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "opt/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "etc/.wh.group", Typeflag: tar.TypeReg},
+		{Name: "opt/", Typeflag: tar.TypeDir, Mode: 0755},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := buf.Bytes()
+
+	for _, mode := range []WhiteoutMode{WhiteoutModeOCI, WhiteoutModeOverlayfs} {
+		root := filepath.Join(dir, mode.String())
+		if err := os.Mkdir(root, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := UnpackDeltaLayer(root, bytes.NewReader(layer), &UnpackOptions{WhiteoutMode: mode}); err != nil {
+			t.Fatalf("%s: unexpected error unpacking delta layer: %+v", mode, err)
+		}
+
+		_, ociErr := os.Lstat(filepath.Join(root, "etc", ".wh.group"))
+		fi, overlayErr := os.Lstat(filepath.Join(root, "etc", "group"))
+		_, opaqueErr := unix.Lgetxattr(filepath.Join(root, "opt"), OverlayOpaqueXattr, make([]byte, 16))
+		switch mode {
+		case WhiteoutModeOCI:
+			if ociErr != nil {
+				t.Errorf("%s: whiteout not extracted as a file: %v", mode, ociErr)
+			}
+			if _, err := os.Lstat(filepath.Join(root, "opt", whOpaque)); err != nil {
+				t.Errorf("%s: opaque whiteout not extracted as a file: %v", mode, err)
+			}
+			if overlayErr == nil {
+				t.Errorf("%s: unexpected overlay whiteout", mode)
+			}
+			if opaqueErr == nil {
+				t.Errorf("%s: unexpected opaque xattr", mode)
+			}
+		case WhiteoutModeOverlayfs:
+			if ociErr == nil {
+				t.Errorf("%s: unexpected whiteout file", mode)
+			}
+			if overlayErr != nil || !IsOverlayWhiteout(fi) {
+				t.Errorf("%s: whiteout not extracted as an overlay whiteout: %v", mode, overlayErr)
+			}
+			if opaqueErr != nil {
+				t.Errorf("%s: opaque xattr not set: %v", mode, opaqueErr)
+			}
+		}
+	}
+}
+
+func TestGenerateInsertLayerWhiteoutMode(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Log("overlay whiteouts can only be created with root privileges")
+		t.Skip()
+	}
+
+	dir, err := ioutil.TempDir("", "umoci-TestGenerateInsertLayerWhiteoutMode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upper := filepath.Join(dir, "upper")
+	if err := os.MkdirAll(filepath.Join(upper, "opt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(upper, "old"), unix.S_IFCHR, int(unix.Mkdev(0, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(filepath.Join(upper, "opt"), OverlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upper, "opt", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		mode     WhiteoutMode
+		expected []string
+	}{
+		// The overlay whiteout is inserted as a character device.
+		{WhiteoutModeOCI, []string{"srv/", "srv/old", "srv/opt/", "srv/opt/new"}},
+		{WhiteoutModeOverlayfs, []string{"srv/", "srv/.wh.old", "srv/opt/", "srv/opt/.wh..wh..opq", "srv/opt/new"}},
+	} {
+		reader := GenerateInsertLayerWithMode(upper, "/srv", false, &GenerateOptions{}, test.mode)
+
+		var names []string
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %s", test.mode, err)
+			}
+			for name := range hdr.Xattrs {
+				if name == OverlayOpaqueXattr {
+					t.Errorf("%s: %s: overlay xattr included in layer", test.mode, hdr.Name)
+				}
+			}
+			names = append(names, hdr.Name)
+		}
+		reader.Close()
+
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: unexpected layer entries: expected %v, got %v", test.mode, test.expected, names)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/system"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	// OverlayLayersName is the name of the directory inside an overlay bundle
+	// which contains the extracted layers (the overlayfs lower directories),
+	// numbered from the bottom-most layer up.
+	OverlayLayersName = "layers"
+
+	// OverlayUpperName is the name of the overlayfs upper directory inside an
+	// overlay bundle, which contains the changes made to the rootfs.
+	OverlayUpperName = "upper"
+
+	// OverlayWorkName is the name of the overlayfs work directory inside an
+	// overlay bundle.
+	OverlayWorkName = "work"
+
+	// OverlayMountHelperName is the name of the script inside an overlay
+	// bundle which mounts the rootfs.
+	OverlayMountHelperName = "mount-rootfs"
+)
+
+// UnpackOverlay unpacks an image to the specified bundle path, like Unpack,
+// except that each layer is extracted to its own directory inside
+// <bundle>/layers rather than into the rootfs. The rootfs of the bundle is an
+// (empty) mountpoint for an overlayfs mount of the layers, with
+// <bundle>/upper as the upper directory -- the bundle contains a script
+// (<bundle>/mount-rootfs) which mounts it. Because all changes to the rootfs
+// end up in the upper directory, RepackBundle generates the new layer directly from
+// it rather than from an mtree diff of the rootfs (and so no mtree manifest is
+// saved). Overlay whiteouts can only be created by a privileged user, so
+// rootless unpacking is not supported.
+func UnpackOverlay(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions) (Err error) {
+	var meta Meta
+	meta.Version = MetaVersion
+	meta.MapOptions = unpackOptions.MapOptions
+	meta.Overlay = true
+
+	if meta.MapOptions.Rootless {
+		return errors.Errorf("overlay bundles cannot be unpacked with --rootless")
+	}
+
+	var err error
+	meta.From, err = resolveUnpackFrom(engineExt, fromName, unpackOptions.Platform)
+	if err != nil {
+		return err
+	}
+	platform := casext.DefaultPlatform()
+	if unpackOptions.Platform != nil {
+		platform = *unpackOptions.Platform
+	}
+	if fromPlatform := meta.From.Descriptor().Platform; fromPlatform != nil {
+		meta.Platform = fromPlatform
+	}
+
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	if manifestBlob.Descriptor.MediaType != ispec.MediaTypeImageManifest {
+		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType), "invalid --image tag")
+	}
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	if upTo := unpackOptions.UpTo; upTo != 0 {
+		if upTo < 0 || upTo > len(manifest.Layers) {
+			return errors.Errorf("cannot unpack up to layer %d: image has %d layers", upTo, len(manifest.Layers))
+		}
+		lastLayer := manifest.Layers[upTo-1]
+		meta.UpTo = &lastLayer
+		log.Infof("only unpacking up to layer %d of %d: %s", upTo, len(manifest.Layers), meta.UpTo.Digest)
+	}
+
+	log.WithFields(log.Fields{
+		"bundle": bundlePath,
+		"ref":    fromName,
+		"rootfs": layer.RootfsName,
+	}).Debugf("umoci: unpacking OCI image as overlay")
+
+	if err := os.MkdirAll(bundlePath, 0755); err != nil {
+		return errors.Wrap(err, "create bundle path")
+	}
+	// See layer.UnpackManifest for why we do this.
+	if err := os.Chmod(bundlePath, 0700); err != nil {
+		return errors.Wrap(err, "chmod bundle 0700")
+	}
+
+	configPath := filepath.Join(bundlePath, "config.json")
+	paths := []string{
+		filepath.Join(bundlePath, OverlayLayersName),
+		filepath.Join(bundlePath, OverlayUpperName),
+		filepath.Join(bundlePath, OverlayWorkName),
+		filepath.Join(bundlePath, layer.RootfsName),
+	}
+	for _, path := range append([]string{configPath}, paths...) {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", path)
+			}
+			return errors.Wrap(err, "bundle path empty")
+		}
+	}
+	defer func() {
+		if Err != nil {
+			for _, path := range paths {
+				// It's too late to care about errors.
+				// #nosec G104
+				_ = os.RemoveAll(path)
+			}
+		}
+	}()
+
+	log.Info("unpacking overlay layers ...")
+	if _, err := layer.UnpackOverlayRootfs(context.Background(), engineExt, paths[0], manifest, &unpackOptions); err != nil {
+		return errors.Wrap(err, "unpack overlay layers")
+	}
+	log.Info("... done")
+
+	lowers, err := overlayLowerDirs(bundlePath)
+	if err != nil {
+		return err
+	}
+	if err := initOverlayUpper(bundlePath, lowers[0]); err != nil {
+		return err
+	}
+	if err := os.Mkdir(filepath.Join(bundlePath, layer.RootfsName), 0755); err != nil {
+		return errors.Wrap(err, "mkdir rootfs")
+	}
+	if err := writeOverlayMountHelper(bundlePath, lowers); err != nil {
+		return errors.Wrap(err, "write overlay mount helper")
+	}
+
+	// The runtime configuration needs the /etc/passwd and /etc/group of the
+	// merged rootfs, which isn't mounted yet.
+	etcRoot, err := overlayEtcRootfs(lowers, bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "assemble overlay /etc")
+	}
+	defer os.RemoveAll(filepath.Dir(etcRoot))
+
+	configFile, err := os.Create(configPath)
+	if err != nil {
+		return errors.Wrap(err, "open config.json")
+	}
+	defer configFile.Close()
+	if err := layer.UnpackRuntimeJSON(context.Background(), engineExt, configFile, etcRoot, manifest, &meta.MapOptions); err != nil {
+		// #nosec G104
+		_ = os.Remove(configPath)
+		return errors.Wrap(err, "unpack config.json")
+	}
+
+	meta.DiffIDs, err = imageDiffIDs(context.Background(), engineExt, meta.From, platform)
+	if err != nil {
+		return errors.Wrap(err, "get image diff_ids")
+	}
+	if upTo := unpackOptions.UpTo; upTo != 0 && len(meta.DiffIDs) > upTo {
+		meta.DiffIDs = meta.DiffIDs[:upTo]
+	}
+	meta.Provenance = newProvenance(fromName)
+
+	log.WithFields(log.Fields{
+		"version":     meta.Version,
+		"from":        meta.From,
+		"up_to":       meta.UpTo,
+		"map_options": meta.MapOptions,
+		"provenance":  meta.Provenance,
+	}).Debugf("umoci: saving Meta metadata")
+
+	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+		return errors.Wrap(err, "write umoci.json metadata")
+	}
+
+	log.Infof("unpacked overlay image bundle: %s (mount the rootfs with %s)", bundlePath, filepath.Join(bundlePath, OverlayMountHelperName))
+	return nil
+}
+
+// overlayLowerDirs returns the paths (relative to the bundle) of the layer
+// directories of the overlay bundle at bundlePath, in the order used for the
+// lowerdir option of overlayfs (from the top-most layer down).
+func overlayLowerDirs(bundlePath string) ([]string, error) {
+	names, err := ioutil.ReadDir(filepath.Join(bundlePath, OverlayLayersName))
+	if err != nil {
+		return nil, errors.Wrap(err, "read overlay layers")
+	}
+	var indices []int
+	for _, fi := range names {
+		idx, err := strconv.Atoi(fi.Name())
+		if err != nil || !fi.IsDir() {
+			return nil, errors.Errorf("unexpected entry in overlay layers: %s", fi.Name())
+		}
+		indices = append(indices, idx)
+	}
+	if len(indices) == 0 {
+		return nil, errors.Errorf("overlay bundle has no layers")
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(indices)))
+
+	var lowers []string
+	for _, idx := range indices {
+		lowers = append(lowers, filepath.Join(OverlayLayersName, strconv.Itoa(idx)))
+	}
+	return lowers, nil
+}
+
+// initOverlayUpper creates an empty upper and work directory in the overlay
+// bundle at bundlePath. The root directory of the overlayfs mount takes its
+// metadata from the upper directory, so it is copied from the top-most layer
+// (top, relative to the bundle).
+func initOverlayUpper(bundlePath string, top string) error {
+	upperPath := filepath.Join(bundlePath, OverlayUpperName)
+	workPath := filepath.Join(bundlePath, OverlayWorkName)
+
+	fi, err := os.Lstat(filepath.Join(bundlePath, top))
+	if err != nil {
+		return errors.Wrap(err, "stat top layer")
+	}
+	if err := os.Mkdir(upperPath, 0755); err != nil {
+		return errors.Wrap(err, "mkdir upper")
+	}
+	if err := os.Chmod(upperPath, fi.Mode().Perm()); err != nil {
+		return errors.Wrap(err, "chmod upper")
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(upperPath, int(stat.Uid), int(stat.Gid)); err != nil {
+			return errors.Wrap(err, "chown upper")
+		}
+	}
+	if err := system.Lutimes(upperPath, fi.ModTime(), fi.ModTime()); err != nil {
+		return errors.Wrap(err, "set upper times")
+	}
+
+	if err := os.RemoveAll(workPath); err != nil {
+		return errors.Wrap(err, "remove old work")
+	}
+	return errors.Wrap(os.Mkdir(workPath, 0700), "mkdir work")
+}
+
+// writeOverlayMountHelper writes a script to <bundle>/mount-rootfs which
+// mounts the overlayfs rootfs of the bundle, with the given lower directories
+// (see overlayLowerDirs). Relative paths are used so that the bundle can be
+// moved.
+func writeOverlayMountHelper(bundlePath string, lowers []string) error {
+	script := fmt.Sprintf(`#!/bin/sh
+# Generated by umoci-unpack(1). Mounts the overlayfs rootfs of this bundle. The
+# rootfs must be unmounted before running umoci-repack(1) --refresh-bundle.
+set -e
+cd "$(dirname "$0")"
+exec mount -t overlay overlay -o "lowerdir=%s,upperdir=%s,workdir=%s" %s "$@"
+`, strings.Join(lowers, ":"), OverlayUpperName, OverlayWorkName, layer.RootfsName)
+	// #nosec G306
+	return ioutil.WriteFile(filepath.Join(bundlePath, OverlayMountHelperName), []byte(script), 0755)
+}
+
+// overlayEtcRootfs creates a temporary directory (named after the rootfs, so
+// that it can be passed to layer.UnpackRuntimeJSON) containing the
+// /etc/passwd and /etc/group of the overlayfs rootfs made from the given
+// lower directories (relative to bundlePath, from the top-most layer down).
+// The caller must remove the parent directory of the returned path.
+func overlayEtcRootfs(lowers []string, bundlePath string) (_ string, Err error) {
+	tmpDir, err := ioutil.TempDir("", "umoci-overlay-etc-")
+	if err != nil {
+		return "", errors.Wrap(err, "create temporary directory")
+	}
+	defer func() {
+		if Err != nil {
+			// #nosec G104
+			_ = os.RemoveAll(tmpDir)
+		}
+	}()
+
+	root := filepath.Join(tmpDir, layer.RootfsName)
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		return "", errors.Wrap(err, "mkdir etc")
+	}
+	for _, name := range []string{"etc/passwd", "etc/group"} {
+		path, err := overlayLookup(bundlePath, lowers, name)
+		if err != nil {
+			return "", errors.Wrapf(err, "look up %s", name)
+		}
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "read %s", name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			return "", errors.Wrapf(err, "write %s", name)
+		}
+	}
+	return root, nil
+}
+
+// overlayLookup returns the path of the regular file name as it would appear
+// in the overlayfs rootfs made from the given lower directories (relative to
+// bundlePath, from the top-most layer down), or "" if the file doesn't exist
+// (or isn't a regular file). Symlinks are not followed.
+func overlayLookup(bundlePath string, lowers []string, name string) (string, error) {
+	for _, lower := range lowers {
+		lowerPath := filepath.Join(bundlePath, lower)
+		fi, err := os.Lstat(filepath.Join(lowerPath, name))
+		if err == nil {
+			if !fi.Mode().IsRegular() {
+				return "", nil
+			}
+			return filepath.Join(lowerPath, name), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", errors.Wrap(err, "lstat")
+		}
+		// A whiteout or opaque directory in this layer hides any of the
+		// parent directories of name in the lower layers.
+		for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+			dirPath := filepath.Join(lowerPath, dir)
+			fi, err := os.Lstat(dirPath)
+			if err != nil {
+				continue
+			}
+			if !fi.IsDir() {
+				return "", nil
+			}
+			if opaque, err := system.Lgetxattr(dirPath, layer.OverlayOpaqueXattr); err == nil && string(opaque) == "y" {
+				return "", nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// checkOverlayUnmounted returns an error if the rootfs of the overlay bundle
+// at bundlePath is currently mounted, in which case the upper directory cannot
+// be safely modified.
+func checkOverlayUnmounted(bundlePath string) error {
+	var bundleStat, rootfsStat syscall.Stat_t
+	if err := syscall.Stat(bundlePath, &bundleStat); err != nil {
+		return errors.Wrap(err, "stat bundle")
+	}
+	if err := syscall.Stat(filepath.Join(bundlePath, layer.RootfsName), &rootfsStat); err != nil {
+		return errors.Wrap(err, "stat rootfs")
+	}
+	if bundleStat.Dev != rootfsStat.Dev {
+		return errors.Errorf("overlay rootfs %s is still mounted", filepath.Join(bundlePath, layer.RootfsName))
+	}
+	return nil
+}
+
+// refreshOverlayBundle turns the upper directory of the overlay bundle at
+// bundlePath into a new (top-most) layer directory after it has been
+// repacked, and creates a new empty upper directory (and mount helper) so that
+// later changes are relative to the new image.
+func refreshOverlayBundle(bundlePath string) error {
+	lowers, err := overlayLowerDirs(bundlePath)
+	if err != nil {
+		return err
+	}
+	top, err := strconv.Atoi(filepath.Base(lowers[0]))
+	if err != nil {
+		// Should _never_ be reached.
+		return errors.Wrap(err, "[internal error] parse layer directory")
+	}
+	newLayer := filepath.Join(OverlayLayersName, strconv.Itoa(top+1))
+	if err := os.Rename(filepath.Join(bundlePath, OverlayUpperName), filepath.Join(bundlePath, newLayer)); err != nil {
+		return errors.Wrap(err, "move upper to layers")
+	}
+	lowers = append([]string{newLayer}, lowers...)
+	if err := initOverlayUpper(bundlePath, newLayer); err != nil {
+		return err
+	}
+	return errors.Wrap(writeOverlayMountHelper(bundlePath, lowers), "write overlay mount helper")
+}
@@ -0,0 +1,155 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+func TestUnpackOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Log("overlay bundles can only be unpacked with root privileges")
+		t.Skip()
+	}
+
+	root, err := ioutil.TempDir("", "umoci-TestUnpackOverlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("alice:x:1000:1000::/home/alice:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "old"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{User: "alice"}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackOverlay(engineExt, "latest", bundle, layer.UnpackOptions{}); err != nil {
+		t.Fatalf("unexpected error unpacking overlay: %+v", err)
+	}
+
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Overlay {
+		t.Errorf("bundle metadata does not record that it is an overlay bundle")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(bundle, OverlayLayersName, "0", "etc", "old")); err != nil || string(data) != "old" {
+		t.Errorf("layer not extracted to its own directory: %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(bundle, OverlayMountHelperName)); err != nil {
+		t.Errorf("mount helper missing: %v", err)
+	}
+
+	// The user must be resolved using the /etc/passwd in the layers.
+	configData, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(configData, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Process.User.UID != 1000 {
+		t.Errorf("user not resolved from overlay layers: expected uid 1000, got %d", spec.Process.User.UID)
+	}
+	if spec.Root.Path != layer.RootfsName {
+		t.Errorf("unexpected root path: %s", spec.Root.Path)
+	}
+
+	// Make the changes in the upper directory, as overlayfs would.
+	upper := filepath.Join(bundle, OverlayUpperName)
+	if err := os.Mkdir(filepath.Join(upper, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(filepath.Join(upper, "etc", "old"), unix.S_IFCHR, int(unix.Mkdev(0, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upper, "etc", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "new", bundle, meta, mutator, RepackOptions{RefreshBundle: true}); err != nil {
+		t.Fatalf("unexpected error repacking overlay: %+v", err)
+	}
+
+	expected := []string{"etc/.wh.old", "etc/", "etc/new"}
+	if entries := topLayerEntries(t, engineExt, "new"); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries in new layer: expected %v got %v", expected, entries)
+	}
+
+	// Refreshing the bundle turns the upper directory into a new layer.
+	if _, err := os.Stat(filepath.Join(bundle, OverlayLayersName, "1", "etc", "new")); err != nil {
+		t.Errorf("upper directory not moved to layers: %v", err)
+	}
+	if names, err := ioutil.ReadDir(upper); err != nil || len(names) != 0 {
+		t.Errorf("upper directory not empty after refresh: %v (%v)", names, err)
+	}
+	lowers, err := overlayLowerDirs(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"layers/1", "layers/0"}; !reflect.DeepEqual(lowers, expected) {
+		t.Errorf("unexpected lower directories: expected %v got %v", expected, lowers)
+	}
+
+	// The repacked image must be the same as the overlay.
+	unpacked := filepath.Join(root, "unpacked")
+	if err := Unpack(engineExt, "new", unpacked, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking new image: %+v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(unpacked, layer.RootfsName, "etc", "old")); !os.IsNotExist(err) {
+		t.Errorf("removed file still present in repacked image: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(unpacked, layer.RootfsName, "etc", "new")); err != nil || string(data) != "new" {
+		t.Errorf("new file missing from repacked image: %q (%v)", data, err)
+	}
+}
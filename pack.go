@@ -0,0 +1,115 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// Pack creates a new image (tagged as tagName) with a single layer containing
+// the contents of the directory rootfsPath, and the given configuration. This
+// is equivalent to creating a new image with NewImage, unpacking it, copying
+// the contents of rootfsPath into the bundle and then repacking it. The
+// ownership of the files in rootfsPath is mapped using mapOptions. If history
+// is non-nil, it is used as the history entry for the layer.
+func Pack(engineExt casext.Engine, tagName string, rootfsPath string, config ispec.ImageConfig, meta mutate.Meta, mapOptions layer.MapOptions, history *ispec.History) error {
+	fsEval := mapFsEval(mapOptions)
+
+	if fi, err := os.Stat(rootfsPath); err != nil {
+		return errors.Wrap(err, "stat rootfs")
+	} else if !fi.IsDir() {
+		return errors.Errorf("rootfs is not a directory: %s", rootfsPath)
+	}
+
+	descriptor, err := newManifest(engineExt, meta.Created)
+	if err != nil {
+		return errors.Wrap(err, "create new manifest")
+	}
+
+	mutator, err := mutate.New(engineExt, casext.DescriptorPath{Walk: []ispec.Descriptor{descriptor}})
+	if err != nil {
+		return errors.Wrap(err, "create mutator for new image")
+	}
+	if err := mutator.Set(context.Background(), config, meta, nil, nil); err != nil {
+		return errors.Wrap(err, "set configuration")
+	}
+
+	// Compute the delta against an empty directory, which is what the root
+	// filesystem of a new image looks like.
+	emptyDir, err := ioutil.TempDir("", "umoci-pack-")
+	if err != nil {
+		return errors.Wrap(err, "create empty directory")
+	}
+	defer os.RemoveAll(emptyDir)
+
+	log.Info("computing filesystem diff ...")
+	spec, err := mtree.Walk(emptyDir, nil, MtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "generate mtree spec")
+	}
+	diffs, err := mtree.Check(rootfsPath, spec, MtreeKeywords, fsEval)
+	if err != nil {
+		return errors.Wrap(err, "check mtree")
+	}
+	diffs = mtreefilter.FilterDeltas(diffs, mtreefilter.SimplifyFilter(diffs))
+	log.Info("... done")
+
+	log.WithFields(log.Fields{
+		"ndiff": len(diffs),
+	}).Debugf("umoci: computed rootfs diff")
+
+	reader, err := layer.GenerateLayer(context.Background(), rootfsPath, diffs, &mapOptions)
+	if err != nil {
+		return errors.Wrap(err, "generate layer")
+	}
+	defer reader.Close()
+
+	if err := mutator.Add(context.Background(), reader, history); err != nil {
+		return errors.Wrap(err, "add layer")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit new image")
+	}
+
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
@@ -0,0 +1,239 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gzip "github.com/klauspost/pgzip"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestPack(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "usr", "bin", "hello"), []byte("hello world"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	// A file is not a valid rootfs.
+	if err := Pack(engineExt, "bad", filepath.Join(rootfs, "usr", "bin", "hello"), ispec.ImageConfig{}, mutate.Meta{}, layer.MapOptions{}, nil); err == nil {
+		t.Errorf("expected error packing a non-directory")
+	}
+
+	config := ispec.ImageConfig{
+		Entrypoint: []string{"/usr/bin/hello"},
+	}
+	meta := mutate.Meta{
+		Created:      time.Now(),
+		Author:       "umoci",
+		Architecture: "amd64",
+		OS:           "linux",
+	}
+	history := &ispec.History{CreatedBy: "umoci pack"}
+	if err := Pack(engineExt, "latest", rootfs, config, meta, layer.MapOptions{}, history); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	manifest, err := resolveManifest(engineExt, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected image to have 1 layer, got %d", len(manifest.Layers))
+	}
+
+	var contents bytes.Buffer
+	if err := layer.CatFile(ctx, engineExt, manifest, "/usr/bin/hello", &contents); err != nil {
+		t.Fatalf("unexpected error reading file from image: %+v", err)
+	}
+	if contents.String() != "hello world" {
+		t.Errorf("unexpected file contents: %q", contents.String())
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotConfig, err := mutator.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotConfig.Entrypoint) != 1 || gotConfig.Entrypoint[0] != "/usr/bin/hello" {
+		t.Errorf("unexpected entrypoint: %v", gotConfig.Entrypoint)
+	}
+	gotMeta, err := mutator.Meta(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotMeta.Author != meta.Author {
+		t.Errorf("unexpected author: expected %q, got %q", meta.Author, gotMeta.Author)
+	}
+	gotHistory, err := mutator.History(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotHistory) != 1 || gotHistory[0].CreatedBy != "umoci pack" || gotHistory[0].EmptyLayer {
+		t.Errorf("unexpected history: %+v", gotHistory)
+	}
+}
+
+// TestPackFlatten makes sure that flattening an image (unpacking it and then
+// packing the resulting root filesystem) produces a layer which contains
+// neither whiteouts nor the files which were removed by them.
+func TestPackFlatten(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestPackFlatten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	base := putTestManifest(t, engineExt, []ispec.Descriptor{}, 0)
+	if err := engineExt.UpdateReference(ctx, "layered", base); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lower layer adds two files, and the upper layer removes one of them
+	// (as well as a file which never existed).
+	for _, entries := range [][]tar.Header{
+		{
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "dir/keep", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "dir/remove", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		{
+			{Name: "dir/.wh.remove", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "dir/.wh.neverexisted", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	} {
+		var buffer bytes.Buffer
+		tw := tar.NewWriter(&buffer)
+		for _, hdr := range entries {
+			hdr := hdr
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyDelta(engineExt, "layered", "layered", bytes.NewReader(buffer.Bytes()), nil, ""); err != nil {
+			t.Fatalf("unexpected error adding layer: %+v", err)
+		}
+	}
+
+	manifest, err := resolveManifest(engineExt, "layered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs := filepath.Join(root, "rootfs")
+	if err := layer.UnpackRootfs(ctx, engineExt, rootfs, manifest, &layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+
+	if err := Pack(engineExt, "flat", rootfs, ispec.ImageConfig{}, mutate.Meta{}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	manifest, err = resolveManifest(engineExt, "flat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected flattened image to have 1 layer, got %d", len(manifest.Layers))
+	}
+
+	layerBlob, err := engineExt.GetVerifiedBlob(ctx, manifest.Layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layerBlob.Close()
+	gzr, err := gzip.NewReader(layerBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gzr.Close()
+
+	var names []string
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading flattened layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+		if strings.HasPrefix(filepath.Base(hdr.Name), ".wh.") {
+			t.Errorf("flattened layer contains whiteout: %s", hdr.Name)
+		}
+		if filepath.Clean(hdr.Name) == "dir/remove" {
+			t.Errorf("flattened layer contains removed file: %s", hdr.Name)
+		}
+	}
+
+	foundKeep := false
+	for _, name := range names {
+		if filepath.Clean(name) == "dir/keep" {
+			foundKeep = true
+		}
+	}
+	if !foundKeep {
+		t.Errorf("flattened layer is missing dir/keep: got %v", names)
+	}
+}
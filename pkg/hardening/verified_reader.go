@@ -174,3 +174,16 @@ func (v *VerifiedReadCloser) Close() error {
 	// Verify the state.
 	return v.verify(nil)
 }
+
+// Unverified returns the reader underneath any VerifiedReadClosers wrapping
+// r, so that callers which trust the source of a stream can avoid the cost of
+// hashing it. If r is not a VerifiedReadCloser it is returned unchanged.
+func Unverified(r io.ReadCloser) io.ReadCloser {
+	for {
+		v, ok := r.(*VerifiedReadCloser)
+		if !ok {
+			return r
+		}
+		r = v.Reader
+	}
+}
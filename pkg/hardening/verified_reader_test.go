@@ -282,3 +282,36 @@ func TestNoop(t *testing.T) {
 		t.Errorf("tripleWrappedReader was incorrectly noop'd out")
 	}
 }
+
+func TestUnverified(t *testing.T) {
+	data := []byte("some data that does not match the expected digest")
+	verifiedReader := &VerifiedReadCloser{
+		Reader: &VerifiedReadCloser{
+			Reader:         ioutil.NopCloser(bytes.NewReader(data)),
+			ExpectedDigest: digest.SHA256.FromString("foo"),
+			ExpectedSize:   -1,
+		},
+		ExpectedDigest: digest.SHA256.FromString("bar"),
+		ExpectedSize:   int64(len(data)),
+	}
+
+	reader := Unverified(verifiedReader)
+	if _, ok := reader.(*VerifiedReadCloser); ok {
+		t.Fatalf("Unverified returned a VerifiedReadCloser")
+	}
+	got, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error reading unverified reader: %+v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("unexpected data: expected %q, got %q", data, got)
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("unexpected error closing unverified reader: %+v", err)
+	}
+
+	plainReader := ioutil.NopCloser(bytes.NewReader(data))
+	if Unverified(plainReader) != plainReader {
+		t.Errorf("Unverified modified a plain reader")
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// globPattern is a single pattern given to ExcludeFilter or IncludeFilter.
+type globPattern struct {
+	pattern string
+	// anchored is whether the pattern is matched against the whole path,
+	// rather than against each component of the path.
+	anchored bool
+}
+
+// match returns whether the pattern matches the given cleaned path (relative
+// to '/', without a leading '/') itself.
+func (p globPattern) match(path string) bool {
+	name := path
+	if !p.anchored {
+		name = filepath.Base(path)
+	}
+	// The patterns were already validated, so this cannot fail.
+	matched, _ := filepath.Match(p.pattern, name)
+	return matched
+}
+
+// parsePatterns validates and parses the given glob patterns. kind is only
+// used for error messages.
+func parsePatterns(kind string, patterns []string) ([]globPattern, error) {
+	var globs []globPattern
+	for _, pattern := range patterns {
+		cleaned := filepath.Clean(pattern)
+		anchored := strings.ContainsRune(cleaned, filepath.Separator)
+		cleaned = strings.TrimPrefix(cleaned, string(filepath.Separator))
+		if cleaned == "" || cleaned == "." {
+			return nil, errors.Errorf("invalid %s pattern %q: pattern matches the root", kind, pattern)
+		}
+		if _, err := filepath.Match(cleaned, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s pattern %q", kind, pattern)
+		}
+		globs = append(globs, globPattern{
+			pattern:  cleaned,
+			anchored: anchored,
+		})
+	}
+	return globs, nil
+}
+
+// matchPatterns returns the first of the patterns which matches the path or
+// any of its ancestors (if any).
+func matchPatterns(globs []globPattern, path string) (globPattern, bool) {
+	// Convert the path to be cleaned and relative-to-root, without the
+	// leading '/' (so that it can be matched against the patterns).
+	path = strings.TrimPrefix(makeRoot(path), string(filepath.Separator))
+
+	for parent := path; parent != "" && parent != "."; parent = filepath.Dir(parent) {
+		for _, glob := range globs {
+			if glob.match(parent) {
+				return glob, true
+			}
+		}
+	}
+	return globPattern{}, false
+}
+
+// ExcludeFilter is a factory for FilterFuncs that will exclude all InodeDelta
+// paths which match any of the given glob patterns (using the syntax of
+// filepath.Match), as well as all of the lexical children of such paths.
+// Patterns containing a '/' (other than a trailing '/') are matched against
+// the whole path (relative to '/'), while all other patterns are matched
+// against each component of the path -- so ".git" excludes every .git
+// directory (and its contents) and "*.log" excludes every file with a .log
+// suffix. Deleted paths are excluded in the same way, so no whiteout is
+// generated for them.
+//
+// Note that excluding a path does not exclude its parent directories, so a
+// modified directory is still included (with its own metadata) even if all of
+// the modified paths inside it are excluded.
+func ExcludeFilter(patterns []string) (FilterFunc, error) {
+	excludes, err := parsePatterns("exclude", patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(path string) bool {
+		if exclude, ok := matchPatterns(excludes, path); ok {
+			log.Debugf("excludefilter: ignoring path %q matched by pattern %q", path, exclude.pattern)
+			return false
+		}
+		return true
+	}, nil
+}
+
+// IncludeFilter is the inverse of ExcludeFilter: it is a factory for
+// FilterFuncs that will only include InodeDelta paths which (or one of whose
+// ancestors) match any of the given glob patterns, using the same pattern
+// syntax as ExcludeFilter. If no patterns are given, every path is included.
+//
+// Note that including a path does not include its parent directories, so a
+// modified parent directory is left out (and so keeps its old metadata)
+// unless it also matches one of the patterns. This does not affect the
+// extraction of the included paths, since missing parent directories are
+// created when extracting a layer.
+func IncludeFilter(patterns []string) (FilterFunc, error) {
+	includes, err := parsePatterns("include", patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(path string) bool {
+		if len(includes) == 0 {
+			return true
+		}
+		if _, ok := matchPatterns(includes, path); !ok {
+			log.Debugf("includefilter: ignoring path %q not matched by any pattern", path)
+			return false
+		}
+		return true
+	}, nil
+}
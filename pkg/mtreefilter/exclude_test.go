@@ -0,0 +1,131 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mtreefilter
+
+import (
+	"testing"
+)
+
+func TestExcludeFilter(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		included []string
+		excluded []string
+	}{
+		{
+			patterns: nil,
+			included: []string{".", "etc", "etc/passwd", ".git/HEAD"},
+		},
+		{
+			patterns: []string{".git"},
+			included: []string{".", "etc", "src/git", "src/.gitignore"},
+			excluded: []string{".git", ".git/HEAD", "./src/.git/objects/ab", "/src/.git"},
+		},
+		{
+			patterns: []string{"*.log"},
+			included: []string{"var/log", "var/log/messages", "var/log.d"},
+			excluded: []string{"build.log", "var/log/build.log", "logs.log/file"},
+		},
+		{
+			patterns: []string{"var/cache/"},
+			included: []string{"var", "var/lib", "cache", "usr/var/cache"},
+			excluded: []string{"var/cache", "var/cache/zypp/raw", "/var/cache"},
+		},
+		{
+			patterns: []string{"/build"},
+			included: []string{"src/build", "builder"},
+			excluded: []string{"build", "build/out.o"},
+		},
+		{
+			patterns: []string{"tmp/*", "*.pyc"},
+			included: []string{"tmp", "src/tmp/file"},
+			excluded: []string{"tmp/file", "tmp/dir/file", "src/__pycache__/a.pyc"},
+		},
+	} {
+		filter, err := ExcludeFilter(test.patterns)
+		if err != nil {
+			t.Errorf("unexpected error creating filter for %v: %+v", test.patterns, err)
+			continue
+		}
+		for _, path := range test.included {
+			if !filter(path) {
+				t.Errorf("expected %v to include %q", test.patterns, path)
+			}
+		}
+		for _, path := range test.excluded {
+			if filter(path) {
+				t.Errorf("expected %v to exclude %q", test.patterns, path)
+			}
+		}
+	}
+}
+
+func TestExcludeFilterInvalid(t *testing.T) {
+	for _, pattern := range []string{"[", "a/[b", "/", ".", ""} {
+		if _, err := ExcludeFilter([]string{pattern}); err == nil {
+			t.Errorf("expected error for invalid pattern %q", pattern)
+		}
+	}
+}
+
+func TestIncludeFilter(t *testing.T) {
+	for _, test := range []struct {
+		patterns []string
+		included []string
+		excluded []string
+	}{
+		{
+			patterns: nil,
+			included: []string{".", "etc", "etc/passwd", ".git/HEAD"},
+		},
+		{
+			patterns: []string{"etc/app"},
+			included: []string{"etc/app", "/etc/app/config.yml", "./etc/app/conf.d/a"},
+			excluded: []string{".", "etc", "etc/passwd", "etc/application", "usr/etc/app"},
+		},
+		{
+			patterns: []string{"*.conf", "/opt"},
+			included: []string{"app.conf", "etc/nginx/nginx.conf", "opt", "opt/bin/tool"},
+			excluded: []string{"etc", "etc/nginx", "usr/opt/tool", "nginx.conf.d"},
+		},
+	} {
+		filter, err := IncludeFilter(test.patterns)
+		if err != nil {
+			t.Errorf("unexpected error creating filter for %v: %+v", test.patterns, err)
+			continue
+		}
+		for _, path := range test.included {
+			if !filter(path) {
+				t.Errorf("expected %v to include %q", test.patterns, path)
+			}
+		}
+		for _, path := range test.excluded {
+			if filter(path) {
+				t.Errorf("expected %v to exclude %q", test.patterns, path)
+			}
+		}
+	}
+}
+
+func TestIncludeFilterInvalid(t *testing.T) {
+	for _, pattern := range []string{"[", "a/[b", "/", ".", ""} {
+		if _, err := IncludeFilter([]string{pattern}); err == nil {
+			t.Errorf("expected error for invalid pattern %q", pattern)
+		}
+	}
+}
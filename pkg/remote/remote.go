@@ -0,0 +1,266 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package remote implements fetching of OCI image layouts which have been
+// archived as a tarball (an "oci-archive") and published at an HTTP URL.
+package remote
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	gzip "github.com/klauspost/pgzip"
+	"github.com/pkg/errors"
+)
+
+// IsURL returns whether the given image path is an HTTP(S) URL which should
+// be fetched with FetchLayout rather than opened as a local directory.
+func IsURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// Options are the options used when fetching a layout.
+type Options struct {
+	// Headers are extra headers added to the request (such as
+	// "Authorization").
+	Headers http.Header
+
+	// NetrcPath is the path of a netrc(5) file used to look up credentials
+	// for the request. If empty, no netrc file is used.
+	NetrcPath string
+
+	// Client is the HTTP client used to make the request. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// NewRequest returns a GET request for the given HTTP(S) URL, with the
+// headers and credentials configured by opt.
+func NewRequest(rawurl string, opt Options) (*http.Request, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	for key, values := range opt.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if opt.NetrcPath != "" && req.Header.Get("Authorization") == "" {
+		login, password, err := LookupNetrc(opt.NetrcPath, u.Hostname())
+		if err != nil {
+			return nil, errors.Wrap(err, "lookup netrc credentials")
+		}
+		if login != "" || password != "" {
+			req.SetBasicAuth(login, password)
+		}
+	}
+	return req, nil
+}
+
+// HTTPClient returns the HTTP client configured by opt.
+func (opt Options) HTTPClient() *http.Client {
+	if opt.Client == nil {
+		return http.DefaultClient
+	}
+	return opt.Client
+}
+
+// FetchLayout downloads the oci-archive (an optionally gzip-compressed tar
+// archive of an OCI image layout) at the given URL, and extracts it into dest
+// (which must already exist). The archive is spooled to a temporary file
+// inside dest, which is removed once the layout has been extracted. The
+// downloaded size is verified against the Content-Length of the response.
+func FetchLayout(rawurl string, dest string, opt Options) error {
+	req, err := NewRequest(rawurl, opt)
+	if err != nil {
+		return err
+	}
+	client := opt.HTTPClient()
+	u := req.URL
+
+	// Don't leak any credentials in the URL into the logs.
+	logURL := *u
+	logURL.User = nil
+	log.Infof("fetching oci-archive: %s", logURL.String())
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fetch oci-archive")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("fetch oci-archive: unexpected status: %s", resp.Status)
+	}
+
+	// Spool the archive to disk, so that we don't extract a truncated archive.
+	spool, err := ioutil.TempFile(dest, ".umoci-spool-")
+	if err != nil {
+		return errors.Wrap(err, "create spool file")
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "download oci-archive")
+	}
+	if resp.ContentLength >= 0 && size != resp.ContentLength {
+		return errors.Errorf("download oci-archive: size mismatch: got %d bytes, expected %d", size, resp.ContentLength)
+	}
+	log.Debugf("downloaded oci-archive (%d bytes)", size)
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek spool file")
+	}
+	return errors.Wrap(extractLayout(spool, dest), "extract oci-archive")
+}
+
+// extractLayout extracts the (possibly gzip-compressed) tar archive of an OCI
+// image layout into dest. Only regular files and directories are permitted,
+// since that is all that an OCI image layout can contain.
+func extractLayout(r io.Reader, dest string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Wrap(err, "create gzip reader")
+		}
+		defer gzr.Close()
+		r = gzr
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "read next entry")
+		}
+
+		path, err := securejoin.SecureJoin(dest, hdr.Name)
+		if err != nil {
+			return errors.Wrapf(err, "join path %s", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return errors.Wrap(err, "mkdir")
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return errors.Wrap(err, "mkdir parent")
+			}
+			fh, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return errors.Wrap(err, "create file")
+			}
+			_, err = io.Copy(fh, tr)
+			fh.Close()
+			if err != nil {
+				return errors.Wrapf(err, "write file %s", hdr.Name)
+			}
+		default:
+			return errors.Errorf("unsupported entry type %q in oci-archive: %s", hdr.Typeflag, hdr.Name)
+		}
+	}
+	return nil
+}
+
+// LookupNetrc returns the login and password for the given host from the
+// netrc(5) file at path. If there is no matching "machine" entry, the
+// "default" entry is used (if present). A netrc file which doesn't exist is
+// treated as though it were empty.
+func LookupNetrc(path, host string) (string, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", errors.Wrap(err, "read netrc")
+	}
+
+	type entry struct{ login, password string }
+	var (
+		current  *entry
+		matched  *entry
+		fallback *entry
+	)
+	tokens := strings.Fields(string(data))
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			current = &entry{}
+			if next() == host && matched == nil {
+				matched = current
+			}
+		case "default":
+			current = &entry{}
+			if fallback == nil {
+				fallback = current
+			}
+		case "login":
+			if value := next(); current != nil {
+				current.login = value
+			}
+		case "password":
+			if value := next(); current != nil {
+				current.password = value
+			}
+		case "account", "macdef":
+			// Not supported, skip the value.
+			next()
+		}
+	}
+
+	if matched == nil {
+		matched = fallback
+	}
+	if matched == nil {
+		return "", "", nil
+	}
+	return matched.login, matched.password, nil
+}
@@ -0,0 +1,225 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package remote
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	gzip "github.com/klauspost/pgzip"
+)
+
+// makeArchive creates a tar archive (gzip-compressed if requested) containing
+// the given set of files.
+func makeArchive(t *testing.T, files map[string]string, compress bool) []byte {
+	var buffer bytes.Buffer
+	var gzw *gzip.Writer
+	tw := tar.NewWriter(&buffer)
+	if compress {
+		gzw = gzip.NewWriter(&buffer)
+		tw = tar.NewWriter(gzw)
+	}
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+var testLayout = map[string]string{
+	"oci-layout":                  `{"imageLayoutVersion":"1.0.0"}`,
+	"./index.json":                `{"schemaVersion":2,"manifests":[]}`,
+	"blobs/sha256/deadbeef":       "blob contents",
+	"/blobs/sha256/../../escaped": "not escaped",
+}
+
+func checkLayout(t *testing.T, dest string) {
+	for name, data := range map[string]string{
+		"oci-layout":            testLayout["oci-layout"],
+		"index.json":            testLayout["./index.json"],
+		"blobs/sha256/deadbeef": testLayout["blobs/sha256/deadbeef"],
+		"escaped":               testLayout["/blobs/sha256/../../escaped"],
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Errorf("reading extracted %s: %s", name, err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("extracted %s has wrong contents: expected %q, got %q", name, data, string(got))
+		}
+	}
+
+	// The spool file must have been cleaned up.
+	matches, err := filepath.Glob(filepath.Join(dest, ".umoci-spool-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("spool files were not cleaned up: %v", matches)
+	}
+}
+
+func TestFetchLayout(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run("compress="+strconv.FormatBool(compress), func(t *testing.T) {
+			archive := makeArchive(t, testLayout, compress)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Token") != "secret" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Write(archive)
+			}))
+			defer server.Close()
+
+			dest, err := ioutil.TempDir("", "umoci-TestFetchLayout")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dest)
+
+			// Without the header the request must fail.
+			if err := FetchLayout(server.URL+"/image.tar", dest, Options{}); err == nil {
+				t.Fatalf("expected fetch without credentials to fail")
+			}
+
+			if err := FetchLayout(server.URL+"/image.tar", dest, Options{
+				Headers: http.Header{"X-Token": []string{"secret"}},
+			}); err != nil {
+				t.Fatalf("unexpected error fetching layout: %+v", err)
+			}
+			checkLayout(t, dest)
+		})
+	}
+}
+
+func TestFetchLayoutNetrc(t *testing.T) {
+	archive := makeArchive(t, testLayout, false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "umoci" || pass != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	dest, err := ioutil.TempDir("", "umoci-TestFetchLayoutNetrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	netrc := filepath.Join(dest, "netrc")
+	if err := ioutil.WriteFile(netrc, []byte("machine example.com login other password wrong\nmachine 127.0.0.1\n\tlogin umoci\n\tpassword hunter2\ndefault login anon password anon\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	layout := filepath.Join(dest, "layout")
+	if err := os.Mkdir(layout, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := FetchLayout(server.URL+"/image.tar", layout, Options{NetrcPath: netrc}); err != nil {
+		t.Fatalf("unexpected error fetching layout: %+v", err)
+	}
+	checkLayout(t, layout)
+}
+
+func TestFetchLayoutTruncated(t *testing.T) {
+	archive := makeArchive(t, testLayout, false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Claim to send more data than we actually do.
+		w.Header().Set("Content-Length", strconv.Itoa(len(archive)+512))
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	dest, err := ioutil.TempDir("", "umoci-TestFetchLayoutTruncated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	if err := FetchLayout(server.URL+"/image.tar", dest, Options{}); err == nil {
+		t.Fatalf("expected truncated fetch to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "index.json")); !os.IsNotExist(err) {
+		t.Errorf("truncated archive was extracted")
+	}
+}
+
+func TestLookupNetrc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umoci-TestLookupNetrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	netrc := filepath.Join(dir, "netrc")
+	if err := ioutil.WriteFile(netrc, []byte("machine a.example.com login a password pa\nmachine b.example.com login b password pb\ndefault login d password pd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		host, login, password string
+	}{
+		{"a.example.com", "a", "pa"},
+		{"b.example.com", "b", "pb"},
+		{"c.example.com", "d", "pd"},
+	} {
+		login, password, err := LookupNetrc(netrc, test.host)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", test.host, err)
+			continue
+		}
+		if login != test.login || password != test.password {
+			t.Errorf("%s: expected %s:%s, got %s:%s", test.host, test.login, test.password, login, password)
+		}
+	}
+
+	// Missing netrc files are treated as empty.
+	login, password, err := LookupNetrc(filepath.Join(dir, "missing"), "a.example.com")
+	if err != nil || login != "" || password != "" {
+		t.Errorf("missing netrc: expected no credentials, got %q:%q (err=%v)", login, password, err)
+	}
+}
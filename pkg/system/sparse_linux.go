@@ -0,0 +1,73 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// These are the Linux values of the lseek(2) whence arguments, which are not
+// defined by golang.org/x/sys/unix.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Region is a range of bytes within a file.
+type Region struct {
+	Offset int64
+	Length int64
+}
+
+// DataRegions returns the regions of the first size bytes of the given file
+// which contain data, using lseek(2) with SEEK_DATA and SEEK_HOLE. Any part of
+// the file outside of the returned regions is a hole, which reads as zeroes.
+// If the filesystem does not support SEEK_DATA and SEEK_HOLE, the whole file
+// is returned as a single region. The offset of fh is modified.
+func DataRegions(fh *os.File, size int64) ([]Region, error) {
+	fd := int(fh.Fd())
+
+	var regions []Region
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, seekData)
+		if err == unix.ENXIO {
+			// There is no more data after offset.
+			break
+		} else if err == unix.EINVAL {
+			// SEEK_DATA is not supported.
+			return []Region{{Offset: 0, Length: size}}, nil
+		} else if err != nil {
+			return nil, &os.PathError{Op: "lseek", Path: fh.Name(), Err: err}
+		}
+		if data >= size {
+			break
+		}
+		hole, err := unix.Seek(fd, data, seekHole)
+		if err != nil {
+			return nil, &os.PathError{Op: "lseek", Path: fh.Name(), Err: err}
+		}
+		if hole > size {
+			hole = size
+		}
+		regions = append(regions, Region{Offset: data, Length: hole - data})
+		offset = hole
+	}
+	return regions, nil
+}
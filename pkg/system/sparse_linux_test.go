@@ -0,0 +1,98 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package system
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDataRegions(t *testing.T) {
+	fh, err := ioutil.TempFile("", "umoci-system.TestDataRegions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	// Create a file with a leading hole, a data region, a hole in the middle
+	// and a trailing hole.
+	const blockSize = 1 << 20
+	data := make([]byte, blockSize)
+	for i := range data {
+		data[i] = 'x'
+	}
+	for _, offset := range []int64{1 * blockSize, 3 * blockSize} {
+		if _, err := fh.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := int64(6 * blockSize)
+	if err := fh.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	regions, err := DataRegions(fh, size)
+	if err != nil {
+		t.Fatalf("unexpected error getting data regions: %+v", err)
+	}
+	if len(regions) == 1 && regions[0] == (Region{Offset: 0, Length: size}) {
+		t.Skip("filesystem does not support SEEK_DATA and SEEK_HOLE")
+	}
+
+	// Filesystems may allocate larger blocks than we wrote, so only check
+	// that the data is included and the holes far away from it are not.
+	var total int64
+	for _, region := range regions {
+		total += region.Length
+		if region.Offset+region.Length > size {
+			t.Errorf("region %v extends beyond the end of the file", region)
+		}
+	}
+	for _, offset := range []int64{1 * blockSize, 2*blockSize - 1, 3 * blockSize, 4*blockSize - 1} {
+		found := false
+		for _, region := range regions {
+			if offset >= region.Offset && offset < region.Offset+region.Length {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("offset %d is not inside any of the data regions %v", offset, regions)
+		}
+	}
+	if total >= size {
+		t.Errorf("no holes were found in sparse file: %v", regions)
+	}
+
+	// A file which is entirely a hole has no data regions.
+	if err := fh.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fh.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	regions, err = DataRegions(fh, size)
+	if err != nil {
+		t.Fatalf("unexpected error getting data regions: %+v", err)
+	}
+	if len(regions) != 0 && !reflect.DeepEqual(regions, []Region{{Offset: 0, Length: size}}) {
+		t.Errorf("expected no data regions in empty sparse file, got %v", regions)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// resolveImage resolves name to a single image, using platform to choose
+// between the manifests of an index.
+func resolveImage(ctx context.Context, engineExt casext.Engine, name string, platform ispec.Platform) (casext.DescriptorPath, error) {
+	descriptorPaths, err := engineExt.ResolveReference(ctx, name)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Errorf("tag is not found: %s", name)
+	}
+	descriptorPaths = casext.SelectPlatform(descriptorPaths, platform)
+	if len(descriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Errorf("tag has no manifest for platform %s/%s: %s", platform.OS, platform.Architecture, name)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return casext.DescriptorPath{}, errors.Errorf("tag is ambiguous: %s", name)
+	}
+	return descriptorPaths[0], nil
+}
+
+// Rebase moves the layers which the image referenced by fromName added on top
+// of the image referenced by oldBaseName onto the image referenced by
+// newBaseName (see mutate.Mutator.Rebase), and tags the result as tagName. If
+// history is non-nil, it is appended to the history of the new image as an
+// empty-layer entry.
+func Rebase(ctx context.Context, engineExt casext.Engine, fromName, tagName, oldBaseName, newBaseName string, history *ispec.History) error {
+	fromDescriptorPath, err := resolveImage(ctx, engineExt, fromName, casext.DefaultPlatform())
+	if err != nil {
+		return errors.Wrap(err, "resolve image")
+	}
+
+	mutator, err := mutate.New(engineExt, fromDescriptorPath)
+	if err != nil {
+		return errors.Wrap(err, "create mutator for image")
+	}
+	platform, err := mutator.Platform(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get image platform")
+	}
+
+	oldBase, err := resolveImage(ctx, engineExt, oldBaseName, platform)
+	if err != nil {
+		return errors.Wrap(err, "resolve old base")
+	}
+	newBase, err := resolveImage(ctx, engineExt, newBaseName, platform)
+	if err != nil {
+		return errors.Wrap(err, "resolve new base")
+	}
+
+	log.WithFields(log.Fields{
+		"old": oldBase.Descriptor().Digest,
+		"new": newBase.Descriptor().Digest,
+	}).Info("rebasing image")
+	if err := mutator.Rebase(ctx, oldBase, newBase); err != nil {
+		return errors.Wrap(err, "rebase image")
+	}
+
+	if history != nil {
+		oldHistory, err := mutator.History(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get image history")
+		}
+		entry := *history
+		entry.EmptyLayer = true
+		if err := mutator.SetHistory(ctx, append(oldHistory, entry)); err != nil {
+			return errors.Wrap(err, "add history entry")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(ctx)
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if err := engineExt.UpdateReference(ctx, tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
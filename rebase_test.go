@@ -0,0 +1,114 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestRebase(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestRebase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	base := putTestManifest(t, engineExt, []ispec.Descriptor{}, 0)
+
+	// Create a new version of the base image, and an image built on top of
+	// the old base image, each with one extra layer.
+	for _, name := range []string{"base", "newbase", "app"} {
+		if err := engineExt.UpdateReference(ctx, name, base); err != nil {
+			t.Fatal(err)
+		}
+		if name == "base" {
+			continue
+		}
+		var patch bytes.Buffer
+		tw := tar.NewWriter(&patch)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyDelta(engineExt, name, name, bytes.NewReader(patch.Bytes()), &ispec.History{Comment: name}, ""); err != nil {
+			t.Fatalf("unexpected error applying delta: %+v", err)
+		}
+	}
+
+	// The app wasn't built on top of the new base.
+	if err := Rebase(ctx, engineExt, "app", "bad", "newbase", "base", nil); err == nil {
+		t.Errorf("expected error rebasing onto the wrong old base")
+	}
+
+	if err := Rebase(ctx, engineExt, "app", "rebased", "base", "newbase", &ispec.History{Comment: "rebase"}); err != nil {
+		t.Fatalf("unexpected error rebasing: %+v", err)
+	}
+
+	newBaseManifest, err := resolveManifest(engineExt, "newbase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appManifest, err := resolveManifest(engineExt, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebasedManifest, err := resolveManifest(engineExt, "rebased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(newBaseManifest.Layers, appManifest.Layers[len(appManifest.Layers)-1])
+	if !reflect.DeepEqual(rebasedManifest.Layers, expected) {
+		t.Errorf("unexpected layers after rebase: expected %v, got %v", expected, rebasedManifest.Layers)
+	}
+
+	blob, err := engineExt.FromDescriptor(ctx, rebasedManifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(ispec.Image)
+	if !ok {
+		t.Fatalf("unexpected config type: %T", blob.Data)
+	}
+	var comments []string
+	for _, entry := range config.History {
+		comments = append(comments, entry.Comment)
+	}
+	if !reflect.DeepEqual(comments, []string{"newbase", "app", "rebase"}) {
+		t.Errorf("unexpected history after rebase: %q", comments)
+	}
+}
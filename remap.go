@@ -0,0 +1,101 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"io"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// Remap rewrites the owner of every entry in every layer of the image
+// referenced by fromName according to opt (see layer.RemapLayer), and tags
+// the result as tagName. Since no layers are added, history (if non-nil) is
+// added to the image as an empty layer entry.
+func Remap(engineExt casext.Engine, fromName string, tagName string, opt layer.RemapOptions, history *ispec.History) error {
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return errors.Errorf("tag is not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engineExt, fromDescriptorPaths[0])
+	if err != nil {
+		return errors.Wrap(err, "create mutator for base image")
+	}
+
+	log.Info("remapping layers ...")
+	if err := mutator.MapLayers(context.Background(), func(r io.Reader, w io.Writer) error {
+		return layer.RemapLayer(r, w, opt)
+	}); err != nil {
+		return errors.Wrap(err, "remap layers")
+	}
+	log.Info("... done")
+
+	if history != nil {
+		config, err := mutator.Config(context.Background())
+		if err != nil {
+			return err
+		}
+
+		imageMeta, err := mutator.Meta(context.Background())
+		if err != nil {
+			return err
+		}
+
+		annotations, err := mutator.Annotations(context.Background())
+		if err != nil {
+			return err
+		}
+
+		if err := mutator.Set(context.Background(), config, imageMeta, annotations, history); err != nil {
+			return errors.Wrap(err, "add history")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "commit mutated image")
+	}
+
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+)
+
+func TestRemap(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestRemap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	base := putTestManifest(t, engineExt, []ispec.Descriptor{}, 0)
+	if err := engineExt.UpdateReference(ctx, "base", base); err != nil {
+		t.Fatal(err)
+	}
+
+	var patch bytes.Buffer
+	tw := tar.NewWriter(&patch)
+	for _, hdr := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 0, Gid: 0},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyDelta(engineExt, "base", "base", bytes.NewReader(patch.Bytes()), nil, ""); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	opt := layer.RemapOptions{
+		UIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings: []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}
+	if err := Remap(engineExt, "base", "remapped", opt, &ispec.History{Comment: "remapped"}); err != nil {
+		t.Fatalf("unexpected error remapping image: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "remapped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("expected remapped tag to be created")
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := mutator.History(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) == 0 || history[len(history)-1].Comment != "remapped" || !history[len(history)-1].EmptyLayer {
+		t.Errorf("missing empty history entry for remap: %#v", history)
+	}
+	layers, err := mutator.Layers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 {
+		t.Fatalf("expected 1 layer, got %d", len(layers))
+	}
+
+	rdr, err := layer.OpenLayer(ctx, engineExt, layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	tr := tar.NewReader(rdr)
+	for _, expected := range []int{100000, 101000} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("unexpected error reading remapped layer: %+v", err)
+		}
+		if hdr.Uid != expected || hdr.Gid != expected {
+			t.Errorf("%s: unexpected owner: expected %d:%d, got %d:%d", hdr.Name, expected, expected, hdr.Uid, hdr.Gid)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("unexpected extra entries in remapped layer: %v", err)
+	}
+
+	// The original image must not be modified, and unmapped ids are an error.
+	opt.UIDMappings = []rspec.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 1}}
+	if err := Remap(engineExt, "base", "bad", opt, nil); err == nil {
+		t.Errorf("expected error remapping unmapped uid")
+	}
+	if descriptorPaths, err := engineExt.ResolveReference(ctx, "bad"); err != nil {
+		t.Fatal(err)
+	} else if len(descriptorPaths) != 0 {
+		t.Errorf("tag was created despite remap failing")
+	}
+}
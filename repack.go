@@ -18,28 +18,53 @@
 package umoci
 
 import (
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/mutate"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/openSUSE/umoci/oci/layer"
-	"github.com/openSUSE/umoci/pkg/fseval"
-	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/vbatts/go-mtree"
 	"golang.org/x/net/context"
 )
 
-// Repack repacks a bundle into an image adding a new layer for the changed
-// data in the bundle.
-func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Meta, history *ispec.History, filters []mtreefilter.FilterFunc, refreshBundle bool, mutator *mutate.Mutator) error {
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+// RepackWithMutator repacks a bundle (described by meta) into the image being
+// modified by mutator, adding a new layer for the changed data in the bundle,
+// and tags the result as tagName. The image is modified according to opt (see
+// RepackOptions), other than opt.Base and opt.Rootless which are only used by
+// RepackBundle. Most users should use RepackBundle instead, which creates the
+// mutator from the bundle metadata. If ctx is cancelled, RepackWithMutator
+// stops (returning the error of ctx) without modifying the image or its tags,
+// unless the new image has already been committed.
+//
+// For overlay bundles (see UnpackOverlay), the new layer is generated from the
+// overlayfs upper directory rather than from an mtree diff of the rootfs, and
+// refreshing the bundle turns the upper directory into a new layer directory
+// (which requires the rootfs to not be mounted).
+func RepackWithMutator(ctx context.Context, engineExt casext.Engine, tagName string, bundlePath string, meta Meta, mutator *mutate.Mutator, opt RepackOptions) error {
+	if meta.Base != nil {
+		return errors.Errorf("bundle only contains the delta from %s (it was unpacked with --base) and cannot be repacked", meta.Base.Descriptor().Digest)
+	}
+
+	if opt.NoClobber {
+		if err := checkNoClobber(engineExt, tagName); err != nil {
+			return err
+		}
+	}
+
+	filters, history, err := applyRepackOptions(ctx, mutator, opt)
+	if err != nil {
+		return err
+	}
+
+	logProvenance(meta)
+
+	mtreeName := bundleMtreeName(meta.From.Descriptor().Digest)
 	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
-	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
 	log.WithFields(log.Fields{
 		"bundle": bundlePath,
@@ -47,99 +72,459 @@ func Repack(engineExt casext.Engine, tagName string, bundlePath string, meta Met
 		"mtree":  mtreePath,
 	}).Debugf("umoci: repacking OCI image")
 
-	mfh, err := os.Open(mtreePath)
-	if err != nil {
-		return errors.Wrap(err, "open mtree")
+	if opt.RefreshBundle && meta.Overlay {
+		if err := checkOverlayUnmounted(bundlePath); err != nil {
+			return errors.Wrap(err, "refresh overlay bundle")
+		}
 	}
-	defer mfh.Close()
 
-	spec, err := mtree.ParseSpec(mfh)
+	nchanges, generateLayer, err := bundleChanges(ctx, bundlePath, meta, opt.generateOptions(meta, filters), opt.mtreeJobs(), opt.MtreeCache)
 	if err != nil {
-		return errors.Wrap(err, "parse mtree")
+		return err
 	}
 
-	log.WithFields(log.Fields{
-		"keywords": MtreeKeywords,
-	}).Debugf("umoci: parsed mtree spec")
-
-	fsEval := fseval.DefaultFsEval
-	if meta.MapOptions.Rootless {
-		fsEval = fseval.RootlessFsEval
-	}
-
-	log.Info("computing filesystem diff ...")
-	diffs, err := mtree.Check(fullRootfsPath, spec, MtreeKeywords, fsEval)
-	if err != nil {
-		return errors.Wrap(err, "check mtree")
-	}
-	log.Info("... done")
+	fsEval := mapFsEval(meta.MapOptions)
 
-	log.WithFields(log.Fields{
-		"ndiff": len(diffs),
-	}).Debugf("umoci: checked mtree spec")
+	if opt.Squash {
+		// If there are no changes, only the existing layers are squashed.
+		var reader io.Reader
+		if nchanges > 0 {
+			diffReader, err := generateLayer()
+			if err != nil {
+				return errors.Wrap(err, "generate diff layer")
+			}
+			defer diffReader.Close()
+			reader = diffReader
+		}
 
-	allFilters := append(filters, mtreefilter.SimplifyFilter(diffs))
-	diffs = mtreefilter.FilterDeltas(diffs, allFilters...)
+		if opt.NonDistributable {
+			err = mutator.SquashNonDistributable(ctx, reader, history)
+		} else {
+			err = mutator.Squash(ctx, reader, history)
+		}
+		if err != nil {
+			return errors.Wrap(err, "squash layers")
+		}
+	} else if nchanges == 0 && opt.AllowEmpty {
+		log.Info("no changes to the rootfs, adding an empty layer")
+		reader, err := generateLayer()
+		if err != nil {
+			return errors.Wrap(err, "generate empty layer")
+		}
+		defer reader.Close()
 
-	if len(diffs) == 0 {
-		config, err := mutator.Config(context.Background())
+		if err := addDiffLayer(ctx, mutator, reader, history, opt.NonDistributable); err != nil {
+			return err
+		}
+	} else if nchanges == 0 {
+		config, err := mutator.Config(ctx)
 		if err != nil {
 			return err
 		}
 
-		imageMeta, err := mutator.Meta(context.Background())
+		imageMeta, err := mutator.Meta(ctx)
 		if err != nil {
 			return err
 		}
 
-		annotations, err := mutator.Annotations(context.Background())
+		annotations, err := mutator.Annotations(ctx)
 		if err != nil {
 			return err
 		}
 
-		err = mutator.Set(context.Background(), config, imageMeta, annotations, history)
+		err = mutator.Set(ctx, config, imageMeta, annotations, history)
 		if err != nil {
 			return err
 		}
 	} else {
-		reader, err := layer.GenerateLayer(fullRootfsPath, diffs, &meta.MapOptions)
+		reader, err := generateLayer()
 		if err != nil {
 			return errors.Wrap(err, "generate diff layer")
 		}
 		defer reader.Close()
 
-		// TODO: We should add a flag to allow for a new layer to be made
-		//       non-distributable.
-		if err := mutator.Add(context.Background(), reader, history); err != nil {
-			return errors.Wrap(err, "add diff layer")
+		if opt.MaxLayerSize > 0 {
+			err = layer.SplitLayer(ctx, reader, opt.MaxLayerSize, func(segment io.Reader) error {
+				return addDiffLayer(ctx, mutator, segment, history, opt.NonDistributable)
+			})
+			if err != nil {
+				return errors.Wrap(err, "split diff layer")
+			}
+		} else {
+			if err := addDiffLayer(ctx, mutator, reader, history, opt.NonDistributable); err != nil {
+				return err
+			}
 		}
 	}
 
-	newDescriptorPath, err := mutator.Commit(context.Background())
+	// Don't commit anything if we were cancelled while generating the layer.
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "repack cancelled")
+	}
+
+	newDescriptorPath, err := mutator.Commit(ctx)
 	if err != nil {
 		return errors.Wrap(err, "commit mutated image")
 	}
 
-	log.Infof("new image manifest created: %s->%s", newDescriptorPath.Root().Digest, newDescriptorPath.Descriptor().Digest)
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if opt.NoClobber {
+		// The tag might have been created while we were generating the
+		// layer, so AddReference checks again.
+		if err := engineExt.AddReference(ctx, tagName, newDescriptorPath.Root()); err != nil {
+			if errors.Cause(err) == casext.ErrReferenceExists {
+				// Include the existing digest in the error if possible.
+				if err := checkNoClobber(engineExt, tagName); err != nil {
+					return err
+				}
+			}
+			return errors.Wrap(err, "add new tag")
+		}
+	} else {
+		oldRoots, err := tagRoots(engineExt, tagName)
+		if err != nil {
+			return errors.Wrap(err, "look up existing tag")
+		}
+		for _, oldRoot := range oldRoots {
+			log.WithFields(log.Fields{
+				"tag": tagName,
+				"old": oldRoot.Digest,
+			}).Info("replacing existing tag")
+		}
 
-	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
-		return errors.Wrap(err, "add new tag")
+		if err := engineExt.UpdateReference(ctx, tagName, newDescriptorPath.Root()); err != nil {
+			return errors.Wrap(err, "add new tag")
+		}
 	}
 
-	log.Infof("created new tag for image manifest: %s", tagName)
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+
+	if opt.DockerTag != "" {
+		if err := TagDockerManifest(ctx, engineExt, tagName, opt.DockerTag); err != nil {
+			return errors.Wrap(err, "tag docker manifest")
+		}
+	}
 
-	if refreshBundle {
-		newMtreeName := strings.Replace(newDescriptorPath.Descriptor().Digest.String(), ":", "_", 1)
-		if err := GenerateBundleManifest(newMtreeName, bundlePath, fsEval); err != nil {
+	if opt.RefreshBundle && meta.Overlay {
+		if err := refreshOverlayBundle(bundlePath); err != nil {
+			return errors.Wrap(err, "refresh overlay bundle")
+		}
+	} else if opt.RefreshBundle {
+		// The digests of the files were just computed by Diff, so the cache
+		// (if enabled) avoids computing them again.
+		var cache *MtreeCache
+		cachePath := filepath.Join(bundlePath, MtreeCacheName)
+		if opt.MtreeCache {
+			cache = LoadMtreeCache(cachePath, meta.mtreeKeywords())
+		}
+		newMtreeName := bundleMtreeName(newDescriptorPath.Descriptor().Digest)
+		if err := generateBundleManifest(ctx, newMtreeName, bundlePath, fsEval, opt.mtreeJobs(), cache); err != nil {
 			return errors.Wrap(err, "write mtree metadata")
 		}
+		if cache != nil {
+			if err := cache.Save(cachePath); err != nil {
+				log.Warnf("failed to save mtree cache: %v", err)
+			}
+		}
 		if err := os.Remove(mtreePath); err != nil {
 			return errors.Wrap(err, "remove old mtree metadata")
 		}
+	}
+	if opt.RefreshBundle {
 		meta.From = newDescriptorPath
+		meta.UpTo = nil
+		meta.Provenance = newProvenance(tagName)
+		meta.DiffIDs, err = mutator.DiffIDs(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get new image diff_ids")
+		}
 		if err := WriteBundleMeta(bundlePath, meta); err != nil {
 			return errors.Wrap(err, "write umoci.json metadata")
 		}
 	}
 	return nil
 }
+
+// bundleChanges returns the number of changes made to the rootfs of the
+// bundle at bundlePath (after applying generateOpt.Filters) and a function
+// which generates a layer containing them using generateOpt. For overlay
+// bundles (see UnpackOverlay) the changes are read from the overlayfs upper
+// directory, otherwise they are computed with Diff.
+func bundleChanges(ctx context.Context, bundlePath string, meta Meta, generateOpt layer.GenerateOptions, mtreeJobs int, mtreeCache bool) (int, func() (io.ReadCloser, error), error) {
+	if meta.Overlay {
+		upperPath := filepath.Join(bundlePath, OverlayUpperName)
+
+		changes, err := layer.OverlayChanges(upperPath, &generateOpt)
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "find overlay changes")
+		}
+		return len(changes), func() (io.ReadCloser, error) {
+			return layer.GenerateOverlayLayer(ctx, upperPath, changes, &generateOpt)
+		}, nil
+	}
+
+	diffs, err := Diff(ctx, bundlePath, meta, generateOpt.Filters, mtreeJobs, mtreeCache, generateOpt.Progress)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The deltas have already been filtered by Diff.
+	generateOpt.Filters = nil
+	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+	return len(diffs), func() (io.ReadCloser, error) {
+		return layer.GenerateLayerWithOptions(ctx, fullRootfsPath, diffs, &generateOpt)
+	}, nil
+}
+
+// addDiffLayer adds the layer read from reader to the image, with a copy of
+// the given history entry (if any).
+func addDiffLayer(ctx context.Context, mutator *mutate.Mutator, reader io.Reader, history *ispec.History, nonDistributable bool) error {
+	if history != nil {
+		entry := *history
+		history = &entry
+	}
+	if nonDistributable {
+		if err := mutator.AddNonDistributable(ctx, reader, history); err != nil {
+			return errors.Wrap(err, "add non-distributable diff layer")
+		}
+	} else {
+		if err := mutator.Add(ctx, reader, history); err != nil {
+			return errors.Wrap(err, "add diff layer")
+		}
+	}
+	return nil
+}
+
+// RepackWithMutatorDryRun computes the layer that RepackWithMutator would add
+// to the image for the changed data in the bundle, without modifying the
+// image, its references or the bundle (other than the digest cache, if
+// opt.MtreeCache is set). The descriptor of the new layer is returned, or nil
+// if there are no changes (in which case RepackWithMutator would only add an
+// empty-layer history entry). The options which only affect how the new image
+// is stored (such as opt.RefreshBundle, opt.Squash and opt.DockerTag) are
+// ignored, otherwise the arguments have the same meaning as for
+// RepackWithMutator.
+func RepackWithMutatorDryRun(ctx context.Context, engineExt casext.Engine, tagName string, bundlePath string, meta Meta, mutator *mutate.Mutator, opt RepackOptions) (*ispec.Descriptor, error) {
+	if meta.Base != nil {
+		return nil, errors.Errorf("bundle only contains the delta from %s (it was unpacked with --base) and cannot be repacked", meta.Base.Descriptor().Digest)
+	}
+
+	if opt.NoClobber {
+		if err := checkNoClobber(engineExt, tagName); err != nil {
+			return nil, err
+		}
+	}
+
+	filters, _, err := applyRepackOptions(ctx, mutator, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	logProvenance(meta)
+
+	nchanges, generateLayer, err := bundleChanges(ctx, bundlePath, meta, opt.generateOptions(meta, filters), opt.mtreeJobs(), opt.MtreeCache)
+	if err != nil {
+		return nil, err
+	}
+	if nchanges == 0 {
+		log.Infof("dry run: no changes to the rootfs, would only add an empty-layer history entry")
+		return nil, nil
+	}
+
+	reader, err := generateLayer()
+	if err != nil {
+		return nil, errors.Wrap(err, "generate diff layer")
+	}
+	defer reader.Close()
+
+	descriptor, diffID, err := mutator.DescribeLayer(ctx, reader, opt.NonDistributable)
+	if err != nil {
+		return nil, errors.Wrap(err, "describe diff layer")
+	}
+
+	log.WithFields(log.Fields{
+		"mediatype": descriptor.MediaType,
+		"digest":    descriptor.Digest,
+		"size":      descriptor.Size,
+		"diffid":    diffID,
+		"ndiff":     nchanges,
+	}).Info("dry run: would add a new layer")
+
+	oldRoots, err := tagRoots(engineExt, tagName)
+	if err != nil {
+		return nil, errors.Wrap(err, "look up existing tag")
+	}
+	for _, oldRoot := range oldRoots {
+		log.WithFields(log.Fields{
+			"tag": tagName,
+			"old": oldRoot.Digest,
+		}).Info("dry run: would replace existing tag")
+	}
+	if len(oldRoots) == 0 {
+		log.WithFields(log.Fields{
+			"tag": tagName,
+		}).Info("dry run: would create new tag")
+	}
+	return &descriptor, nil
+}
+
+// logProvenance logs how the bundle described by meta was created, so that the
+// source of a repacked image can be traced from the logs.
+func logProvenance(meta Meta) {
+	if meta.Provenance == nil {
+		log.Debugf("bundle metadata does not record its provenance (it was unpacked by an older umoci)")
+		return
+	}
+	umociVersion := meta.Provenance.UmociVersion
+	if umociVersion == "" {
+		umociVersion = "unknown"
+	}
+	log.WithFields(log.Fields{
+		"reference":     meta.Provenance.Reference,
+		"manifest":      meta.From.Descriptor().Digest,
+		"umoci_version": umociVersion,
+		"keywords":      meta.mtreeKeywords(),
+	}).Infof("repacking bundle unpacked from %s", meta.Provenance.Reference)
+}
+
+// ResolveRepackBase resolves baseName to the image manifest which the bundle
+// described by meta should be repacked onto, in place of the image it was
+// unpacked from (meta.From). This allows a bundle to be repacked after the
+// image has been recreated or its tag has been moved, but it is up to the
+// caller to ensure that the base is actually compatible with the bundle. The
+// only check made is that the layers the bundle was unpacked from are a prefix
+// of the layers of the base (compared by DiffID), because the new layer only
+// contains the changes made to the bundle since it was unpacked. A mutator
+// created from the returned descriptor path can be passed to
+// RepackWithMutator.
+func ResolveRepackBase(ctx context.Context, engineExt casext.Engine, meta Meta, baseName string) (casext.DescriptorPath, error) {
+	if meta.Base != nil {
+		return casext.DescriptorPath{}, errors.Errorf("bundle only contains the delta from %s (it was unpacked with --base) and cannot be repacked", meta.Base.Descriptor().Digest)
+	}
+
+	platform := casext.DefaultPlatform()
+	if meta.Platform != nil {
+		platform = *meta.Platform
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, baseName)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Errorf("tag is not found: %s", baseName)
+	}
+	descriptorPaths = casext.SelectPlatform(descriptorPaths, platform)
+	if len(descriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Errorf("tag has no manifest for platform %s/%s: %s", platform.OS, platform.Architecture, baseName)
+	}
+	if len(descriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return casext.DescriptorPath{}, errors.Errorf("tag is ambiguous: %s", baseName)
+	}
+	base, err := engineExt.ResolvePlatform(ctx, descriptorPaths[0], platform)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "resolve base platform manifest")
+	}
+
+	baseDiffIDs, err := imageDiffIDs(ctx, engineExt, base, platform)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get base diff_ids")
+	}
+
+	// Bundles unpacked by older versions of umoci don't record their layers,
+	// in which case we have to hope the original image is still around.
+	fromDiffIDs := meta.DiffIDs
+	if fromDiffIDs == nil {
+		fromDiffIDs, err = imageDiffIDs(ctx, engineExt, meta.From, platform)
+		if err != nil {
+			return casext.DescriptorPath{}, errors.Wrapf(err, "bundle metadata does not record the layers it was unpacked from, and they could not be read from the original image %s", meta.From.Descriptor().Digest)
+		}
+	}
+
+	if len(fromDiffIDs) > len(baseDiffIDs) {
+		return casext.DescriptorPath{}, errors.Errorf("base %s is not compatible with bundle: bundle was unpacked from %d layers but base only has %d layers", baseName, len(fromDiffIDs), len(baseDiffIDs))
+	}
+	for idx, diffID := range fromDiffIDs {
+		if baseDiffIDs[idx] != diffID {
+			return casext.DescriptorPath{}, errors.Errorf("base %s is not compatible with bundle: layer %d of base has diff_id %s but bundle was unpacked from %s", baseName, idx, baseDiffIDs[idx], diffID)
+		}
+	}
+
+	if base.Descriptor().Digest != meta.From.Descriptor().Digest {
+		log.Warnf("repacking onto base %s (%s) rather than the image the bundle was unpacked from (%s)", baseName, base.Descriptor().Digest, meta.From.Descriptor().Digest)
+	}
+	if extra := len(baseDiffIDs) - len(fromDiffIDs); extra > 0 {
+		log.Warnf("base %s has %d more layers than the bundle was unpacked from: their changes are not in the bundle rootfs, but will be kept beneath the new layer", baseName, extra)
+	}
+	return base, nil
+}
+
+// TruncateToBundle removes the layers of the image being modified by mutator
+// which are above the last layer unpacked to the bundle, if the bundle was
+// only unpacked up to a particular layer (see Meta.UpTo). This must be done
+// before passing a mutator created from meta.From to RepackWithMutator, so
+// that the new layer is added directly on top of the layers in the bundle. It
+// is a no-op for bundles which contain every layer of meta.From.
+func TruncateToBundle(ctx context.Context, mutator *mutate.Mutator, meta Meta) error {
+	if meta.UpTo == nil {
+		return nil
+	}
+	layers, err := mutator.Layers(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get image layers")
+	}
+	for idx, layerDescriptor := range layers {
+		if layerDescriptor.Digest == meta.UpTo.Digest {
+			if dropped := len(layers) - (idx + 1); dropped > 0 {
+				log.Infof("bundle was only unpacked up to layer %d: dropping the %d layers above it", idx+1, dropped)
+			}
+			return errors.Wrap(mutator.TruncateLayers(ctx, idx+1), "truncate image layers")
+		}
+	}
+	return errors.Errorf("bundle was unpacked up to layer %s, which is not in the image", meta.UpTo.Digest)
+}
+
+// imageDiffIDs returns the rootfs.diff_ids of the configuration of the image
+// manifest referenced by descriptorPath (or the manifest for the given
+// platform, if it refers to an index).
+func imageDiffIDs(ctx context.Context, engineExt casext.Engine, descriptorPath casext.DescriptorPath, platform ispec.Platform) ([]digest.Digest, error) {
+	mutator, err := mutate.NewPlatform(engineExt, descriptorPath, platform)
+	if err != nil {
+		return nil, errors.Wrap(err, "create mutator")
+	}
+	return mutator.DiffIDs(ctx)
+}
+
+// tagRoots returns the descriptors in the top-level index of the image which
+// are tagged with tagName.
+func tagRoots(engineExt casext.Engine, tagName string) ([]ispec.Descriptor, error) {
+	index, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "get top-level index")
+	}
+	var roots []ispec.Descriptor
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations[ispec.AnnotationRefName] == tagName {
+			roots = append(roots, descriptor)
+		}
+	}
+	return roots, nil
+}
+
+// checkNoClobber returns an error if tagName already exists in the image.
+func checkNoClobber(engineExt casext.Engine, tagName string) error {
+	roots, err := tagRoots(engineExt, tagName)
+	if err != nil {
+		return errors.Wrap(err, "look up existing tag")
+	}
+	if len(roots) > 0 {
+		return errors.Errorf("refusing to clobber existing tag %s (%s)", tagName, roots[0].Digest)
+	}
+	return nil
+}
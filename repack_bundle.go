@@ -0,0 +1,375 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"time"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// RepackOptions are the options used by RepackBundle and RepackBundleDryRun
+// (and RepackWithMutator and RepackWithMutatorDryRun), which correspond to the flags of
+// umoci-repack(1). The zero value repacks the bundle with the same defaults as
+// umoci-repack(1).
+type RepackOptions struct {
+	// Base is the tag of the image which the new layer is added to, rather
+	// than the image the bundle was unpacked from (see ResolveRepackBase).
+	// It is only used by RepackBundle and RepackBundleDryRun, since
+	// RepackWithMutator and RepackWithMutatorDryRun modify the image of the
+	// mutator they are given.
+	Base string
+
+	// Rootless, if non-nil, overrides the rootless mode recorded in the
+	// bundle metadata (see CheckBundleRootless). Like Base, it is only used
+	// by RepackBundle and RepackBundleDryRun.
+	Rootless *bool
+
+	// History is the history entry for the new layer. If nil, no history
+	// entry is added. If History.Author is empty, the author of the image is
+	// used.
+	History *ispec.History
+
+	// MaskPaths is the set of path prefixes in which changes are ignored.
+	// Unless NoMaskVolumes is set, the Config.Volumes of the image are also
+	// masked.
+	MaskPaths     []string
+	NoMaskVolumes bool
+
+	// Filters are applied to the changes in the bundle in addition to the
+	// mask (such as mtreefilter.ExcludeFilter).
+	Filters []mtreefilter.FilterFunc
+
+	// PermPolicy, ClampMtime and Sparse are used when generating the new
+	// layer (see layer.GenerateOptions). Progress, if non-nil, is called as
+	// the files of the bundle are digested and as they are added to the new
+	// layer.
+	PermPolicy layer.PermPolicy
+	ClampMtime *time.Time
+	Sparse     bool
+	Progress   layer.ProgressFunc
+
+	// Annotations are added to the new manifest, and LayerAnnotations are
+	// added to the descriptor of the new layer.
+	Annotations      map[string]string
+	LayerAnnotations map[string]string
+
+	// ClearAnnotations removes all of the existing annotations of the
+	// manifest (see mutate.Mutator.SetAnnotations) before Annotations are
+	// added.
+	ClearAnnotations bool
+
+	// LayerURLs are set as the urls of the descriptor of the new layer (see
+	// mutate.Mutator.SetLayerURLs).
+	LayerURLs []string
+
+	// Labels are merged into the Config.Labels of the image configuration.
+	Labels map[string]string
+
+	// Created, if non-nil, replaces the creation time of the image
+	// configuration.
+	Created *time.Time
+
+	// Compression is the algorithm used to compress the new layer (if empty,
+	// mutate.GzipCompression). CompressionLevel and CompressionJobs are only
+	// used if they are non-zero (see mutate.Mutator.SetCompressionLevel and
+	// mutate.Mutator.SetCompressionJobs).
+	Compression      mutate.Compression
+	CompressionLevel int
+	CompressionJobs  int
+
+	// OS, Architecture and Variant replace the corresponding fields of the
+	// platform of the image if they are non-nil. Unless AllowUnknownPlatform
+	// is set, the resulting platform must be known to Go (see
+	// mutate.ValidatePlatform).
+	OS                   *string
+	Architecture         *string
+	Variant              *string
+	AllowUnknownPlatform bool
+
+	// MtreeJobs is the number of files which are digested concurrently when
+	// computing the diff (if zero, 1), and MtreeCache is whether file digests
+	// are cached in the bundle between repacks (see Diff).
+	MtreeJobs  int
+	MtreeCache bool
+
+	// RefreshBundle updates the bundle metadata (and mtree manifest) to
+	// reflect the new image, so the bundle can be repacked again.
+	RefreshBundle bool
+
+	// NonDistributable adds the new layer as a non-distributable layer (see
+	// mutate.Mutator.AddNonDistributable).
+	NonDistributable bool
+
+	// Squash squashes all of the existing layers and the new layer into a
+	// single layer (see mutate.Mutator.Squash).
+	Squash bool
+
+	// NoClobber causes an error to be returned (before the image is modified)
+	// if the tag already exists, rather than replacing it.
+	NoClobber bool
+
+	// AllowEmpty adds an empty layer to the image if there are no changes in
+	// the bundle (rather than only an empty-layer history entry).
+	AllowEmpty bool
+
+	// MaxLayerSize, if positive, splits the new layer into as many layers as
+	// necessary for each of them to be at most MaxLayerSize bytes
+	// (uncompressed), each with its own copy of the history entry (see
+	// layer.SplitLayer).
+	MaxLayerSize int64
+
+	// DockerTag, if non-empty, is the tag of a Docker variant of the new
+	// image manifest (see TagDockerManifest).
+	DockerTag string
+}
+
+// mtreeJobs returns the number of files to digest concurrently.
+func (opt RepackOptions) mtreeJobs() int {
+	if opt.MtreeJobs < 1 {
+		return 1
+	}
+	return opt.MtreeJobs
+}
+
+// generateOptions returns the options used to generate the new layer from the
+// bundle described by meta, containing only the changes accepted by filters.
+func (opt RepackOptions) generateOptions(meta Meta, filters []mtreefilter.FilterFunc) layer.GenerateOptions {
+	return layer.GenerateOptions{
+		MapOptions: meta.MapOptions,
+		PermPolicy: opt.PermPolicy,
+		ClampMtime: opt.ClampMtime,
+		Progress:   opt.Progress,
+		Sparse:     opt.Sparse,
+		Filters:    filters,
+	}
+}
+
+// repackMutator creates the mutator for the image that the bundle described
+// by meta is repacked onto (the image it was unpacked from, unless baseName is
+// non-empty). meta.From is resolved to the image manifest if it refers to an
+// index.
+func repackMutator(ctx context.Context, engineExt casext.Engine, meta *Meta, baseName string) (*mutate.Mutator, error) {
+	// The layer is added to the image the bundle was unpacked from, unless
+	// a different base was requested.
+	var base casext.DescriptorPath
+	if baseName != "" {
+		var err error
+		base, err = ResolveRepackBase(ctx, engineExt, *meta, baseName)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve base")
+		}
+	} else {
+		// If the saved descriptor refers to an index, resolve it to the
+		// manifest for the platform that was unpacked. Commit will then
+		// replace that manifest in the index, leaving the other entries
+		// untouched.
+		if meta.From.Descriptor().MediaType == ispec.MediaTypeImageIndex {
+			platform := casext.DefaultPlatform()
+			if meta.Platform != nil {
+				platform = *meta.Platform
+			}
+			from, err := engineExt.ResolvePlatform(ctx, meta.From, platform)
+			if err != nil {
+				return nil, errors.Wrap(err, "resolve saved from descriptor")
+			}
+			meta.From = from
+		}
+		if meta.From.Descriptor().MediaType != ispec.MediaTypeImageManifest {
+			return nil, errors.Wrap(errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", meta.From.Descriptor().MediaType), "invalid saved from descriptor")
+		}
+		base = meta.From
+	}
+
+	mutator, err := mutate.New(engineExt, base)
+	if err != nil {
+		return nil, errors.Wrap(err, "create mutator for base image")
+	}
+	// Drop any layers which weren't unpacked from the original image. With a
+	// different base, the extra layers of the base are kept on purpose.
+	if baseName == "" {
+		if err := TruncateToBundle(ctx, mutator, *meta); err != nil {
+			return nil, errors.Wrap(err, "truncate image to bundle")
+		}
+	}
+	return mutator, nil
+}
+
+// applyRepackOptions applies the options in opt which modify the image
+// (rather than the new layer) to mutator, and returns the filters and history
+// entry for the new layer.
+func applyRepackOptions(ctx context.Context, mutator *mutate.Mutator, opt RepackOptions) ([]mtreefilter.FilterFunc, *ispec.History, error) {
+	if opt.ClearAnnotations {
+		if err := mutator.SetAnnotations(ctx, nil); err != nil {
+			return nil, nil, errors.Wrap(err, "clear annotations")
+		}
+	}
+	mutator.AddAnnotations(opt.Annotations)
+	mutator.SetLayerAnnotations(opt.LayerAnnotations)
+	mutator.SetLayerURLs(opt.LayerURLs)
+	if opt.Compression != "" {
+		mutator.SetCompression(opt.Compression)
+	}
+	if opt.CompressionLevel != 0 {
+		if err := mutator.SetCompressionLevel(opt.CompressionLevel); err != nil {
+			return nil, nil, errors.Wrap(err, "set compression level")
+		}
+	}
+	if opt.CompressionJobs != 0 {
+		if err := mutator.SetCompressionJobs(opt.CompressionJobs); err != nil {
+			return nil, nil, errors.Wrap(err, "set compression jobs")
+		}
+	}
+
+	// We need to mask config.Volumes.
+	config, err := mutator.Config(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get config")
+	}
+	maskedPaths := append([]string{}, opt.MaskPaths...)
+	if !opt.NoMaskVolumes {
+		for v := range config.Volumes {
+			maskedPaths = append(maskedPaths, v)
+		}
+	}
+	filters := append([]mtreefilter.FilterFunc{mtreefilter.MaskFilter(maskedPaths)}, opt.Filters...)
+
+	imageMeta, err := mutator.Meta(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "get image metadata")
+	}
+
+	// Merge the requested labels (and creation time) into the configuration.
+	// Set is used without a history entry, since the new layer gets its own
+	// history entry.
+	if len(opt.Labels) > 0 || opt.Created != nil {
+		annotations, err := mutator.Annotations(ctx)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "get annotations")
+		}
+		labels := map[string]string{}
+		for k, v := range config.Labels {
+			labels[k] = v
+		}
+		for k, v := range opt.Labels {
+			labels[k] = v
+		}
+		config.Labels = labels
+		if opt.Created != nil {
+			imageMeta.Created = *opt.Created
+		}
+		if err := mutator.Set(ctx, config, imageMeta, annotations, nil); err != nil {
+			return nil, nil, errors.Wrap(err, "set config")
+		}
+	}
+
+	// Override the platform of the image, if requested.
+	if opt.OS != nil || opt.Architecture != nil || opt.Variant != nil {
+		platform := ispec.Platform{
+			OS:           imageMeta.OS,
+			Architecture: imageMeta.Architecture,
+			Variant:      imageMeta.Variant,
+		}
+		if opt.OS != nil {
+			platform.OS = *opt.OS
+		}
+		if opt.Architecture != nil {
+			platform.Architecture = *opt.Architecture
+		}
+		if opt.Variant != nil {
+			platform.Variant = *opt.Variant
+		}
+		if !opt.AllowUnknownPlatform {
+			if err := mutate.ValidatePlatform(platform); err != nil {
+				return nil, nil, errors.Wrap(err, "invalid platform")
+			}
+		}
+		if err := mutator.SetPlatform(ctx, platform); err != nil {
+			return nil, nil, errors.Wrap(err, "set platform")
+		}
+	}
+
+	history := opt.History
+	if history != nil && history.Author == "" {
+		entry := *history
+		entry.Author = imageMeta.Author
+		history = &entry
+	}
+	return filters, history, nil
+}
+
+// readRepackMeta reads the metadata of the bundle at bundlePath, applying the
+// rootless mode override in opt.Rootless (if any).
+func readRepackMeta(bundlePath string, opt RepackOptions) (Meta, error) {
+	meta, err := ReadBundleMeta(bundlePath)
+	if err != nil {
+		return Meta{}, errors.Wrap(err, "read umoci.json metadata")
+	}
+
+	log.WithFields(log.Fields{
+		"version":     meta.Version,
+		"from":        meta.From,
+		"up_to":       meta.UpTo,
+		"map_options": meta.MapOptions,
+		"provenance":  meta.Provenance,
+	}).Debugf("umoci: loaded Meta metadata")
+
+	if err := CheckBundleRootless(&meta, opt.Rootless); err != nil {
+		return Meta{}, err
+	}
+	return meta, nil
+}
+
+// RepackBundle repacks the bundle at bundlePath into the image it was unpacked
+// from (or opt.Base), adding a new layer for the changes made to the bundle
+// and tagging the result as tagName. This is the equivalent of
+// umoci-repack(1), with the flags given by opt (see RepackOptions).
+func RepackBundle(ctx context.Context, engineExt casext.Engine, tagName string, bundlePath string, opt RepackOptions) error {
+	meta, err := readRepackMeta(bundlePath, opt)
+	if err != nil {
+		return err
+	}
+	mutator, err := repackMutator(ctx, engineExt, &meta, opt.Base)
+	if err != nil {
+		return err
+	}
+	return RepackWithMutator(ctx, engineExt, tagName, bundlePath, meta, mutator, opt)
+}
+
+// RepackBundleDryRun computes the layer that RepackBundle would add to the
+// image, without modifying the image or its tags (see
+// RepackWithMutatorDryRun). If there are no changes in the bundle, nil is
+// returned.
+func RepackBundleDryRun(ctx context.Context, engineExt casext.Engine, tagName string, bundlePath string, opt RepackOptions) (*ispec.Descriptor, error) {
+	meta, err := readRepackMeta(bundlePath, opt)
+	if err != nil {
+		return nil, err
+	}
+	mutator, err := repackMutator(ctx, engineExt, &meta, opt.Base)
+	if err != nil {
+		return nil, err
+	}
+	return RepackWithMutatorDryRun(ctx, engineExt, tagName, bundlePath, meta, mutator, opt)
+}
@@ -0,0 +1,1384 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/mtreefilter"
+	"github.com/opencontainers/go-digest"
+	imeta "github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// topLayerEntries returns the names of the entries in the top-most
+// layer of the image tagged with name.
+func topLayerEntries(t *testing.T, engineExt casext.Engine, name string) []string {
+	manifest, err := resolveManifest(engineExt, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) == 0 {
+		t.Fatalf("image %s has no layers", name)
+	}
+	blob, err := engineExt.GetBlob(context.Background(), manifest.Layers[len(manifest.Layers)-1].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	gzr, err := gzip.NewReader(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gzr.Close()
+
+	var names []string
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestRepackRefreshBundle(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackRefreshBundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	bundleRootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+
+	// Each repack with refreshBundle should only contain the changes made
+	// since the previous repack.
+	for _, test := range []struct {
+		tag, file string
+	}{
+		{"first", "etc/first"},
+		{"second", "etc/second"},
+	} {
+		meta, err := ReadBundleMeta(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(bundleRootfs, test.file), []byte(test.tag), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		mutator, err := mutate.New(engineExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RepackWithMutator(context.Background(), engineExt, test.tag, bundle, meta, mutator, RepackOptions{RefreshBundle: true}); err != nil {
+			t.Fatalf("%s: unexpected error repacking: %+v", test.tag, err)
+		}
+
+		// The bundle metadata must refer to the new image.
+		newMeta, err := ReadBundleMeta(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), test.tag)
+		if err != nil || len(descriptorPaths) != 1 {
+			t.Fatalf("%s: failed to resolve new tag: %v", test.tag, err)
+		}
+		if newMeta.From.Descriptor().Digest != descriptorPaths[0].Descriptor().Digest {
+			t.Errorf("%s: bundle metadata was not refreshed: expected %s, got %s", test.tag, descriptorPaths[0].Descriptor().Digest, newMeta.From.Descriptor().Digest)
+		}
+		if _, err := os.Stat(filepath.Join(bundle, "sha256_"+newMeta.From.Descriptor().Digest.Encoded()+".mtree")); err != nil {
+			t.Errorf("%s: refreshed mtree manifest missing: %v", test.tag, err)
+		}
+
+		// There should be no remaining changes in the bundle.
+		diffs, err := Diff(context.Background(), bundle, newMeta, nil, 1, false, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error computing diff: %+v", test.tag, err)
+		}
+		if len(diffs) != 0 {
+			t.Errorf("%s: unexpected changes in refreshed bundle: %v", test.tag, diffs)
+		}
+
+		// And the new layer must only contain the latest change (the parent
+		// directory may also be included, depending on its mtime).
+		for _, name := range topLayerEntries(t, engineExt, test.tag) {
+			if name != test.file && name != "etc/" {
+				t.Errorf("%s: unexpected entry %q in new layer", test.tag, name)
+			}
+		}
+	}
+}
+
+func TestRepackNoClobber(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackNoClobber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldDescriptorPaths, err := engineExt.ResolveReference(context.Background(), "latest")
+	if err != nil || len(oldDescriptorPaths) != 1 {
+		t.Fatalf("failed to resolve old tag: %v", err)
+	}
+
+	for _, test := range []struct {
+		tag       string
+		noClobber bool
+		fail      bool
+	}{
+		{"latest", true, true},
+		{"new", true, false},
+		{"latest", false, false},
+	} {
+		meta, err := ReadBundleMeta(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutator, err := mutate.New(engineExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = RepackWithMutator(context.Background(), engineExt, test.tag, bundle, meta, mutator, RepackOptions{NoClobber: test.noClobber})
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected error repacking with noClobber", test.tag)
+			}
+			// The existing tag must not have been modified.
+			descriptorPaths, err := engineExt.ResolveReference(context.Background(), test.tag)
+			if err != nil || len(descriptorPaths) != 1 {
+				t.Fatalf("%s: failed to resolve tag: %v", test.tag, err)
+			}
+			if descriptorPaths[0].Descriptor().Digest != oldDescriptorPaths[0].Descriptor().Digest {
+				t.Errorf("%s: existing tag was clobbered", test.tag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error repacking: %+v", test.tag, err)
+		}
+	}
+}
+
+func TestRepackAllowEmpty(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackAllowEmpty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+
+	oldManifest, err := resolveManifest(engineExt, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any changes, a layer is only added with allowEmpty.
+	for _, test := range []struct {
+		tag        string
+		allowEmpty bool
+		newLayers  int
+	}{
+		{"empty", true, 1},
+		{"history", false, 0},
+	} {
+		meta, err := ReadBundleMeta(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutator, err := mutate.New(engineExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RepackWithMutator(context.Background(), engineExt, test.tag, bundle, meta, mutator, RepackOptions{History: &ispec.History{CreatedBy: test.tag}, AllowEmpty: test.allowEmpty}); err != nil {
+			t.Fatalf("%s: unexpected error repacking: %+v", test.tag, err)
+		}
+
+		manifest, err := resolveManifest(engineExt, test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Layers) != len(oldManifest.Layers)+test.newLayers {
+			t.Errorf("%s: expected %d layers, got %d", test.tag, len(oldManifest.Layers)+test.newLayers, len(manifest.Layers))
+		}
+	}
+}
+
+func TestRepackClearAnnotations(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackClearAnnotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "latest")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected error resolving latest: %+v", err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator.AddAnnotations(map[string]string{"old": "value", "replace": "old"})
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "latest", newDescriptorPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	for _, test := range []struct {
+		tag              string
+		clearAnnotations bool
+		expected         map[string]string
+	}{
+		{"kept", false, map[string]string{"old": "value", "replace": "new"}},
+		{"cleared", true, map[string]string{"replace": "new"}},
+	} {
+		opt := RepackOptions{
+			Annotations:      map[string]string{"replace": "new"},
+			ClearAnnotations: test.clearAnnotations,
+			AllowEmpty:       true,
+		}
+		if err := RepackBundle(context.Background(), engineExt, test.tag, bundle, opt); err != nil {
+			t.Fatalf("%s: unexpected error repacking: %+v", test.tag, err)
+		}
+
+		manifest, err := resolveManifest(engineExt, test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(manifest.Annotations, test.expected) {
+			t.Errorf("%s: unexpected manifest annotations: expected %v, got %v", test.tag, test.expected, manifest.Annotations)
+		}
+	}
+}
+
+func TestRepackExclude(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackExclude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	for _, dir := range []string{"etc", "cache"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"etc/other", "etc/deleted", "old.log", "cache/old"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	bundleRootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+
+	// Make changes which are both included and excluded.
+	if err := os.MkdirAll(filepath.Join(bundleRootfs, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"etc/new", "etc/build.log", ".git/HEAD", "cache/new"} {
+		if err := ioutil.WriteFile(filepath.Join(bundleRootfs, file), []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"etc/deleted", "old.log"} {
+		if err := os.Remove(filepath.Join(bundleRootfs, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	excludeFilter, err := mtreefilter.ExcludeFilter([]string{".git", "*.log", "/cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "new", bundle, meta, mutator, RepackOptions{Filters: []mtreefilter.FilterFunc{excludeFilter}}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	names := map[string]struct{}{}
+	for _, name := range topLayerEntries(t, engineExt, "new") {
+		names[filepath.Clean(name)] = struct{}{}
+	}
+	for _, name := range []string{"etc/new", "etc/.wh.deleted"} {
+		if _, ok := names[name]; !ok {
+			t.Errorf("expected entry %q missing from new layer: %v", name, names)
+		}
+	}
+	for _, name := range []string{".git", ".git/HEAD", "etc/build.log", ".wh.old.log", "cache", "cache/new"} {
+		if _, ok := names[name]; ok {
+			t.Errorf("excluded entry %q included in new layer", name)
+		}
+	}
+}
+
+func TestRepackDryRun(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackDryRun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dryRun := func() *ispec.Descriptor {
+		oldIndex, err := engineExt.GetIndex(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutator, err := mutate.New(engineExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descriptor, err := RepackWithMutatorDryRun(context.Background(), engineExt, "latest", bundle, meta, mutator, RepackOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error in dry run: %+v", err)
+		}
+		newIndex, err := engineExt.GetIndex(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(oldIndex, newIndex) {
+			t.Errorf("dry run modified the image index")
+		}
+		return descriptor
+	}
+
+	// Without any changes, there is no new layer.
+	if descriptor := dryRun(); descriptor != nil {
+		t.Errorf("unexpected new layer without changes: %v", descriptor)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", "file"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	descriptor := dryRun()
+	if descriptor == nil {
+		t.Fatalf("expected a new layer after changing the rootfs")
+	}
+	if _, err := engineExt.GetBlob(context.Background(), descriptor.Digest); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected dry run layer to not be in the CAS: got %v", err)
+	}
+
+	// The real repack must produce the same layer.
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "latest", bundle, meta, mutator, RepackOptions{}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+	manifest, err := resolveManifest(engineExt, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := manifest.Layers[len(manifest.Layers)-1]; !reflect.DeepEqual(got, *descriptor) {
+		t.Errorf("dry run layer does not match repacked layer: expected %v, got %v", got, *descriptor)
+	}
+}
+
+func TestRepackCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackCancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(root, "image")
+	engineExt, err := CreateLayout(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", "file"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldIndex, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldBlobs, err := ioutil.ReadDir(filepath.Join(image, "blobs", "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = RepackWithMutator(ctx, engineExt, "latest", bundle, meta, mutator, RepackOptions{})
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected repack to be cancelled: got %v", err)
+	}
+
+	// Neither the index nor the blobs may have been modified.
+	newIndex, err := engineExt.GetIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(oldIndex, newIndex) {
+		t.Errorf("cancelled repack modified the image index")
+	}
+	newBlobs, err := ioutil.ReadDir(filepath.Join(image, "blobs", "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newBlobs) != len(oldBlobs) {
+		t.Errorf("cancelled repack added blobs: expected %d, got %d", len(oldBlobs), len(newBlobs))
+	}
+}
+
+func TestRepackBase(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackBase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	// "latest" and "other" have different base layers.
+	for _, tag := range []string{"latest", "other"} {
+		rootfs := filepath.Join(root, "rootfs-"+tag)
+		if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "tag"), []byte(tag), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Pack(engineExt, tag, rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+			t.Fatalf("unexpected error packing rootfs: %+v", err)
+		}
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.DiffIDs) != 1 {
+		t.Fatalf("expected bundle metadata to record 1 diff_id: got %v", meta.DiffIDs)
+	}
+
+	// "extended" has an extra layer on top of "latest".
+	extendedBundle := filepath.Join(root, "extended-bundle")
+	if err := Unpack(engineExt, "latest", extendedBundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(extendedBundle, layer.RootfsName, "etc", "extended"), []byte("extended"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "extended", extendedBundle, meta, mutator, RepackOptions{}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+	extendedManifest, err := resolveManifest(engineExt, "extended")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bundles from older versions of umoci don't record their diff_ids.
+	legacyMeta := meta
+	legacyMeta.DiffIDs = nil
+	// The original image is gone and the bundle doesn't record its diff_ids.
+	missingMeta := legacyMeta
+	missingMeta.From = casext.DescriptorPath{Walk: []ispec.Descriptor{{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	}}}
+
+	for _, test := range []struct {
+		name  string
+		meta  Meta
+		base  string
+		valid bool
+	}{
+		{"Same", meta, "latest", true},
+		{"Extended", meta, "extended", true},
+		{"LegacyExtended", legacyMeta, "extended", true},
+		{"Incompatible", meta, "other", false},
+		{"LegacyIncompatible", legacyMeta, "other", false},
+		{"MissingFrom", missingMeta, "extended", false},
+		{"MissingTag", meta, "missing", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			base, err := ResolveRepackBase(context.Background(), engineExt, test.meta, test.base)
+			if test.valid && err != nil {
+				t.Fatalf("unexpected error resolving base: %+v", err)
+			}
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("expected error resolving base, got %v", base.Descriptor())
+				}
+				return
+			}
+			descriptorPaths, err := engineExt.ResolveReference(context.Background(), test.base)
+			if err != nil || len(descriptorPaths) != 1 {
+				t.Fatalf("failed to resolve base tag: %v", err)
+			}
+			if base.Descriptor().Digest != descriptorPaths[0].Descriptor().Digest {
+				t.Errorf("unexpected base: expected %s, got %s", descriptorPaths[0].Descriptor().Digest, base.Descriptor().Digest)
+			}
+		})
+	}
+
+	// Repacking onto "extended" must add the new layer on top of it.
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", "file"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base, err := ResolveRepackBase(context.Background(), engineExt, meta, "extended")
+	if err != nil {
+		t.Fatalf("unexpected error resolving base: %+v", err)
+	}
+	mutator, err = mutate.New(engineExt, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "rebased", bundle, meta, mutator, RepackOptions{}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+	rebasedManifest, err := resolveManifest(engineExt, "rebased")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rebasedManifest.Layers) != len(extendedManifest.Layers)+1 {
+		t.Fatalf("expected %d layers in rebased image, got %d", len(extendedManifest.Layers)+1, len(rebasedManifest.Layers))
+	}
+	if !reflect.DeepEqual(rebasedManifest.Layers[:len(extendedManifest.Layers)], extendedManifest.Layers) {
+		t.Errorf("rebased image does not contain the layers of the base")
+	}
+	found := false
+	for _, name := range topLayerEntries(t, engineExt, "rebased") {
+		if name == "etc/extended" {
+			t.Errorf("new layer contains changes from base: %s", name)
+		}
+		if name == "etc/file" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("new layer does not contain etc/file")
+	}
+}
+
+func TestRepackUpTo(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackUpTo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	// Build an image with three layers, each adding one file.
+	for _, name := range []string{"first", "second"} {
+		bundle := filepath.Join(root, "bundle-"+name)
+		if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+			t.Fatalf("unexpected error unpacking image: %+v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := ReadBundleMeta(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutator, err := mutate.New(engineExt, meta.From)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RepackWithMutator(context.Background(), engineExt, "latest", bundle, meta, mutator, RepackOptions{History: &ispec.History{CreatedBy: name}}); err != nil {
+			t.Fatalf("unexpected error repacking: %+v", err)
+		}
+	}
+	manifest, err := resolveManifest(engineExt, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 3 {
+		t.Fatalf("expected 3 layers, got %d", len(manifest.Layers))
+	}
+
+	for _, test := range []struct {
+		upTo     string
+		expected int
+		valid    bool
+	}{
+		{"1", 1, true},
+		{"2", 2, true},
+		{"3", 3, true},
+		{manifest.Layers[1].Digest.String(), 2, true},
+		{manifest.Layers[0].Digest.Encoded(), 1, true},
+		{"0", 0, false},
+		{"4", 0, false},
+		{"sha256:0000000000000000000000000000000000000000000000000000000000000000", 0, false},
+	} {
+		n, err := ResolveUnpackUpTo(engineExt, "latest", test.upTo, nil)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error resolving layer: %+v", test.upTo, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected error resolving layer, got %d", test.upTo, n)
+		} else if n != test.expected {
+			t.Errorf("%s: expected %d layers, got %d", test.upTo, test.expected, n)
+		}
+	}
+
+	// Unpack up to the second layer.
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackWithOptions(engineExt, "latest", bundle, layer.UnpackOptions{UpTo: 2}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	bundleRootfs := filepath.Join(bundle, layer.RootfsName)
+	if _, err := os.Lstat(filepath.Join(bundleRootfs, "etc", "first")); err != nil {
+		t.Errorf("layer below --upto was not unpacked: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(bundleRootfs, "etc", "second")); !os.IsNotExist(err) {
+		t.Errorf("layer above --upto was unpacked: %v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.UpTo == nil || meta.UpTo.Digest != manifest.Layers[1].Digest {
+		t.Errorf("bundle does not record the last layer unpacked: got %v", meta.UpTo)
+	}
+	if len(meta.DiffIDs) != 2 {
+		t.Errorf("expected bundle to record 2 diff_ids, got %v", meta.DiffIDs)
+	}
+
+	// Repacking drops the third layer.
+	if err := ioutil.WriteFile(filepath.Join(bundleRootfs, "etc", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TruncateToBundle(context.Background(), mutator, meta); err != nil {
+		t.Fatalf("unexpected error truncating image: %+v", err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "fixed", bundle, meta, mutator, RepackOptions{History: &ispec.History{CreatedBy: "new"}, RefreshBundle: true}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+	fixedManifest, err := resolveManifest(engineExt, "fixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixedManifest.Layers) != 3 {
+		t.Fatalf("expected 3 layers in repacked image, got %d", len(fixedManifest.Layers))
+	}
+	if !reflect.DeepEqual(fixedManifest.Layers[:2], manifest.Layers[:2]) {
+		t.Errorf("repacked image does not contain the layers the bundle was unpacked from")
+	}
+	found := false
+	for _, name := range topLayerEntries(t, engineExt, "fixed") {
+		switch name {
+		case "etc/new":
+			found = true
+		case "etc/second", "etc/.wh.second":
+			t.Errorf("new layer contains changes from dropped layer: %s", name)
+		}
+	}
+	if !found {
+		t.Errorf("new layer does not contain etc/new")
+	}
+
+	// The refreshed bundle contains the whole new image.
+	meta, err = ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.UpTo != nil {
+		t.Errorf("refreshed bundle still records --upto layer: %v", meta.UpTo)
+	}
+	if len(meta.DiffIDs) != 3 {
+		t.Errorf("expected refreshed bundle to record 3 diff_ids, got %v", meta.DiffIDs)
+	}
+}
+
+func TestRepackMaxLayerSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackMaxLayerSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc", "old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "old", "file"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	// Replace the old directory with a file, and add several large files so
+	// that the new layer has to be split.
+	bundleRootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := os.RemoveAll(filepath.Join(bundleRootfs, "etc", "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundleRootfs, "etc", "old"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), 8192)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(bundleRootfs, "etc", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "split", bundle, meta, mutator, RepackOptions{History: &ispec.History{CreatedBy: "split"}, MaxLayerSize: 12 * 1024}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	manifest, err := resolveManifest(engineExt, "split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each of the large files needs a layer of its own.
+	if len(manifest.Layers) != 4 {
+		t.Fatalf("expected 4 layers, got %d", len(manifest.Layers))
+	}
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "split")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("resolve split image: %v", err)
+	}
+	splitMutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := splitMutator.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var newEntries int
+	for _, entry := range history {
+		if entry.CreatedBy == "split" && !entry.EmptyLayer {
+			newEntries++
+		}
+	}
+	if newEntries != 3 {
+		t.Errorf("expected 3 history entries for the new layers, got %d", newEntries)
+	}
+
+	// Unpacking the split layers must give the same rootfs.
+	newBundle := filepath.Join(root, "new-bundle")
+	if err := Unpack(engineExt, "split", newBundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking split image: %+v", err)
+	}
+	newRootfs := filepath.Join(newBundle, layer.RootfsName)
+	if content, err := ioutil.ReadFile(filepath.Join(newRootfs, "etc", "old")); err != nil || string(content) != "new" {
+		t.Errorf("etc/old was not replaced: %q (%v)", content, err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if content, err := ioutil.ReadFile(filepath.Join(newRootfs, "etc", name)); err != nil || !bytes.Equal(content, data) {
+			t.Errorf("etc/%s has the wrong contents (%v)", name, err)
+		}
+	}
+}
+
+func TestRepackPlatformIndex(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackPlatformIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	// Create a manifest for each platform, and an index which contains both.
+	var manifests []ispec.Descriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		rootfs := filepath.Join(root, "rootfs-"+arch)
+		if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "arch"), []byte(arch), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Pack(engineExt, arch, rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: arch}, layer.MapOptions{}, nil); err != nil {
+			t.Fatalf("unexpected error packing rootfs: %+v", err)
+		}
+		descriptorPaths, err := engineExt.ResolveReference(context.Background(), arch)
+		if err != nil || len(descriptorPaths) != 1 {
+			t.Fatalf("unexpected error resolving %s: %+v", arch, err)
+		}
+		descriptor := descriptorPaths[0].Descriptor()
+		descriptor.Annotations = nil
+		descriptor.Platform = &ispec.Platform{OS: "linux", Architecture: arch}
+		manifests = append(manifests, descriptor)
+	}
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(context.Background(), ispec.Index{
+		Versioned: imeta.Versioned{
+			SchemaVersion: 2,
+		},
+		Manifests: manifests,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(context.Background(), "latest", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unpacking a platform which isn't in the index must fail.
+	if err := UnpackWithOptions(engineExt, "latest", filepath.Join(root, "bundle-s390x"), layer.UnpackOptions{Platform: &ispec.Platform{OS: "linux", Architecture: "s390x"}}); err == nil {
+		t.Errorf("expected error unpacking missing platform")
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := UnpackWithOptions(engineExt, "latest", bundle, layer.UnpackOptions{Platform: manifests[1].Platform}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(bundle, layer.RootfsName, "etc", "arch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "arm64" {
+		t.Errorf("unpacked the wrong platform: expected arm64, got %s", content)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Platform == nil || !reflect.DeepEqual(*meta.Platform, *manifests[1].Platform) {
+		t.Errorf("unexpected bundle platform: expected %v, got %v", manifests[1].Platform, meta.Platform)
+	}
+
+	// Repacking must only replace the arm64 manifest in the index.
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "latest", bundle, meta, mutator, RepackOptions{History: &ispec.History{CreatedBy: "test"}}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 2 {
+		t.Fatalf("expected 2 manifests in index, got %d", len(descriptorPaths))
+	}
+	if root := descriptorPaths[0].Root(); root.MediaType != ispec.MediaTypeImageIndex || root.Digest == indexDigest {
+		t.Errorf("tag does not refer to a new index: %v", root)
+	}
+	if got := descriptorPaths[0].Descriptor(); !reflect.DeepEqual(got, manifests[0]) {
+		t.Errorf("other platform entry was modified: expected %v, got %v", manifests[0], got)
+	}
+	if got := descriptorPaths[1].Descriptor(); got.Digest == manifests[1].Digest || !reflect.DeepEqual(got.Platform, manifests[1].Platform) {
+		t.Errorf("arm64 entry was not updated correctly: %v", got)
+	}
+}
+
+func TestRepackBundle(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestRepackBundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64", Author: "author"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	bundleRootfs := filepath.Join(bundle, layer.RootfsName)
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(bundleRootfs, "masked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"etc/new", "masked/new"} {
+		if err := ioutil.WriteFile(filepath.Join(bundleRootfs, file), []byte("new"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	arch := "arm64"
+	created := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	opt := RepackOptions{
+		History:          &ispec.History{CreatedBy: "test"},
+		MaskPaths:        []string{"/masked"},
+		Annotations:      map[string]string{"org.opencontainers.image.title": "test"},
+		LayerAnnotations: map[string]string{"layer": "new"},
+		Labels:           map[string]string{"label": "value"},
+		Created:          &created,
+		Architecture:     &arch,
+		DockerTag:        "docker",
+	}
+
+	// Unknown architectures are only accepted with AllowUnknownPlatform.
+	unknown := "x86_64"
+	badOpt := opt
+	badOpt.Architecture = &unknown
+	if err := RepackBundle(context.Background(), engineExt, "bad", bundle, badOpt); err == nil {
+		t.Errorf("expected error repacking with unknown architecture")
+	}
+
+	if descriptor, err := RepackBundleDryRun(context.Background(), engineExt, "new", bundle, opt); err != nil {
+		t.Fatalf("unexpected error in dry-run: %+v", err)
+	} else if descriptor == nil {
+		t.Errorf("dry-run found no changes")
+	}
+	if err := RepackBundle(context.Background(), engineExt, "new", bundle, opt); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	manifest, err := resolveManifest(engineExt, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := manifest.Annotations["org.opencontainers.image.title"]; got != "test" {
+		t.Errorf("manifest annotation not set: got %q", got)
+	}
+	if got := manifest.Layers[len(manifest.Layers)-1].Annotations["layer"]; got != "new" {
+		t.Errorf("layer annotation not set: got %q", got)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(context.Background(), "new")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("unexpected error resolving new: %+v", err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageConfig, err := mutator.Config(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := imageConfig.Labels["label"]; got != "value" {
+		t.Errorf("config label not set: got %q", got)
+	}
+	imageMeta, err := mutator.Meta(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageMeta.Architecture != arch {
+		t.Errorf("architecture not set: expected %s, got %s", arch, imageMeta.Architecture)
+	}
+	if !imageMeta.Created.Equal(created) {
+		t.Errorf("created not set: expected %s, got %s", created, imageMeta.Created)
+	}
+	history, err := mutator.History(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := history[len(history)-1]; last.CreatedBy != "test" || last.Author != "author" {
+		t.Errorf("unexpected history entry: %+v", last)
+	}
+
+	names := map[string]struct{}{}
+	for _, name := range topLayerEntries(t, engineExt, "new") {
+		names[filepath.Clean(name)] = struct{}{}
+	}
+	if _, ok := names["etc/new"]; !ok {
+		t.Errorf("expected entry etc/new missing from new layer: %v", names)
+	}
+	if _, ok := names["masked/new"]; ok {
+		t.Errorf("masked entry included in new layer")
+	}
+
+	if _, err := engineExt.ResolveReference(context.Background(), "docker"); err != nil {
+		t.Errorf("unexpected error resolving docker tag: %+v", err)
+	}
+	if descriptorPaths, err := engineExt.ResolveReference(context.Background(), "bad"); err != nil {
+		t.Fatal(err)
+	} else if len(descriptorPaths) != 0 {
+		t.Errorf("failed repack created a tag: %v", descriptorPaths)
+	}
+}
+
+func TestRepackBundleRootless(t *testing.T) {
+	// The bundle is recorded as rootless, which is only inconsistent with the
+	// current process when running as root.
+	if os.Geteuid() != 0 {
+		t.Skip()
+	}
+
+	root, err := ioutil.TempDir("", "umoci-TestRepackBundleRootless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.MapOptions.Rootless = true
+	if err := WriteBundleMeta(bundle, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RepackBundle(context.Background(), engineExt, "recorded", bundle, RepackOptions{AllowEmpty: true}); err == nil {
+		t.Errorf("expected error repacking with the recorded rootless mode")
+	}
+	rootless := false
+	if err := RepackBundle(context.Background(), engineExt, "override", bundle, RepackOptions{Rootless: &rootless, AllowEmpty: true}); err != nil {
+		t.Errorf("unexpected error repacking with rootless mode override: %+v", err)
+	}
+}
+
+func TestRepackDigestAlgorithm(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestRepackDigestAlgorithm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	imagePath := filepath.Join(root, "image")
+	if err := dir.Create(imagePath); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := dir.OpenWithOptions(imagePath, dir.OpenOptions{BlobAlgorithm: digest.SHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The mtree manifest is named after the full algorithm of the digest.
+	mtreeName := "sha512_" + meta.From.Descriptor().Digest.Encoded() + ".mtree"
+	if _, err := os.Stat(filepath.Join(bundle, mtreeName)); err != nil {
+		t.Errorf("mtree manifest %s missing from bundle: %v", mtreeName, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", "new"), []byte("new file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(ctx, engineExt, "new", bundle, meta, mutator, RepackOptions{}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	// Every blob (and DiffID) uses the configured algorithm.
+	blobs, err := engineExt.ListBlobs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		if blob.Algorithm() != digest.SHA512 {
+			t.Errorf("blob %s does not use sha512", blob)
+		}
+	}
+	manifest, err := resolveManifest(engineExt, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(ispec.Image)
+	if !ok {
+		t.Fatalf("unexpected config type: %T", blob.Data)
+	}
+	if len(config.RootFS.DiffIDs) != 2 {
+		t.Fatalf("expected 2 diff_ids, got %v", config.RootFS.DiffIDs)
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		if diffID.Algorithm() != digest.SHA512 {
+			t.Errorf("diff_id %s does not use sha512", diffID)
+		}
+	}
+
+	newBundle := filepath.Join(root, "new-bundle")
+	if err := Unpack(engineExt, "new", newBundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking repacked image: %+v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(newBundle, layer.RootfsName, "etc", "new")); err != nil || string(data) != "new file" {
+		t.Errorf("unexpected contents of repacked file: %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// DiffIDRepair describes a single rootfs.diff_ids entry which was corrected by
+// RepairDiffIDs.
+type DiffIDRepair struct {
+	// Layer is the digest of the (possibly compressed) layer blob.
+	Layer digest.Digest
+
+	// Old is the incorrect diff_id previously in the configuration. If the
+	// configuration had fewer diff_ids than layers, Old is "". If Layer is
+	// "", then Old was an extra diff_id (without a corresponding layer)
+	// which has been removed.
+	Old digest.Digest
+
+	// New is the correct diff_id, computed from the layer blob (or "" if Old
+	// was removed).
+	New digest.Digest
+}
+
+// RepairDiffIDs recomputes the DiffID of every layer of the image referenced
+// by fromName, and rewrites the rootfs.diff_ids of the image configuration to
+// match them. The repaired image is tagged as tagName. The set of diff_ids
+// which were incorrect is returned, and if there were none then the image is
+// not modified (and tagName is not updated).
+func RepairDiffIDs(engineExt casext.Engine, fromName string, tagName string) ([]DiffIDRepair, error) {
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return nil, errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return nil, errors.Errorf("tag is not found: %s", fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return nil, errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+
+	mutator, err := mutate.New(engineExt, fromDescriptorPaths[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "create mutator for image")
+	}
+
+	layers, err := mutator.Layers(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "get layers")
+	}
+	oldDiffIDs, err := mutator.DiffIDs(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "get diff_ids")
+	}
+
+	var (
+		repairs    []DiffIDRepair
+		newDiffIDs []digest.Digest
+	)
+	for idx, layerDescriptor := range layers {
+		log.Infof("digest layer: %s", layerDescriptor.Digest)
+		diffID, err := layer.DiffID(context.Background(), engineExt, layerDescriptor)
+		if err != nil {
+			return nil, errors.Wrapf(err, "compute diff_id of layer %s", layerDescriptor.Digest)
+		}
+		newDiffIDs = append(newDiffIDs, diffID)
+
+		var oldDiffID digest.Digest
+		if idx < len(oldDiffIDs) {
+			oldDiffID = oldDiffIDs[idx]
+		}
+		if oldDiffID != diffID {
+			log.Warnf("layer %s: incorrect diff_id %q (should be %s)", layerDescriptor.Digest, oldDiffID, diffID)
+			repairs = append(repairs, DiffIDRepair{
+				Layer: layerDescriptor.Digest,
+				Old:   oldDiffID,
+				New:   diffID,
+			})
+		}
+	}
+	// Extra diff_ids (without a corresponding layer) also need to be removed,
+	// though there's no layer to attribute the repair to.
+	for idx := len(layers); idx < len(oldDiffIDs); idx++ {
+		log.Warnf("extra diff_id without a corresponding layer: %s", oldDiffIDs[idx])
+		repairs = append(repairs, DiffIDRepair{Old: oldDiffIDs[idx]})
+	}
+
+	if len(repairs) == 0 {
+		log.Info("all diff_ids are correct, nothing to repair")
+		return nil, nil
+	}
+
+	if err := mutator.SetDiffIDs(context.Background(), newDiffIDs); err != nil {
+		return nil, errors.Wrap(err, "set repaired diff_ids")
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "commit repaired image")
+	}
+
+	log.WithFields(log.Fields{
+		"root":     newDescriptorPath.Root().Digest,
+		"manifest": newDescriptorPath.Descriptor().Digest,
+	}).Info("new image manifest created")
+
+	if err := engineExt.UpdateReference(context.Background(), tagName, newDescriptorPath.Root()); err != nil {
+		return nil, errors.Wrap(err, "add new tag")
+	}
+
+	log.WithFields(log.Fields{
+		"tag": tagName,
+	}).Info("created new tag for image manifest")
+	return repairs, nil
+}
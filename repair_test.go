@@ -0,0 +1,139 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestRepairDiffIDs(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestRepairDiffIDs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	base := putTestManifest(t, engineExt, []ispec.Descriptor{}, 0)
+	if err := engineExt.UpdateReference(ctx, "base", base); err != nil {
+		t.Fatal(err)
+	}
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     "dir/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectedDiffID := digest.FromBytes(layer.Bytes())
+
+	if err := ApplyDelta(engineExt, "base", "good", bytes.NewReader(layer.Bytes()), nil, ""); err != nil {
+		t.Fatalf("unexpected error creating image: %+v", err)
+	}
+
+	// A correct image should not be modified.
+	repairs, err := RepairDiffIDs(engineExt, "good", "good-repaired")
+	if err != nil {
+		t.Fatalf("unexpected error repairing correct image: %+v", err)
+	}
+	if len(repairs) != 0 {
+		t.Errorf("unexpected repairs for correct image: %v", repairs)
+	}
+	if descriptorPaths, err := engineExt.ResolveReference(ctx, "good-repaired"); err != nil {
+		t.Fatal(err)
+	} else if len(descriptorPaths) != 0 {
+		t.Errorf("tag was created despite there being nothing to repair")
+	}
+
+	// Corrupt the diff_ids.
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	badDiffID := digest.FromString("corrupted")
+	if err := mutator.SetDiffIDs(ctx, []digest.Digest{badDiffID}); err != nil {
+		t.Fatalf("unexpected error setting diff_ids: %+v", err)
+	}
+	if err := mutator.SetDiffIDs(ctx, nil); err == nil {
+		t.Errorf("expected error setting the wrong number of diff_ids")
+	}
+	brokenPath, err := mutator.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(ctx, "broken", brokenPath.Root()); err != nil {
+		t.Fatal(err)
+	}
+
+	repairs, err = RepairDiffIDs(engineExt, "broken", "repaired")
+	if err != nil {
+		t.Fatalf("unexpected error repairing image: %+v", err)
+	}
+	if len(repairs) != 1 {
+		t.Fatalf("expected 1 repair, got %d: %v", len(repairs), repairs)
+	}
+	if repairs[0].Old != badDiffID || repairs[0].New != expectedDiffID {
+		t.Errorf("unexpected repair: expected %s->%s, got %s->%s", badDiffID, expectedDiffID, repairs[0].Old, repairs[0].New)
+	}
+
+	descriptorPaths, err = engineExt.ResolveReference(ctx, "repaired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("expected repaired tag to be created, got %d descriptors", len(descriptorPaths))
+	}
+	mutator, err = mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffIDs, err := mutator.DiffIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffIDs) != 1 || diffIDs[0] != expectedDiffID {
+		t.Errorf("diff_ids were not repaired: got %v", diffIDs)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestSquash(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestSquash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	base := putTestManifest(t, engineExt, []ispec.Descriptor{}, 0)
+	if err := engineExt.UpdateReference(ctx, "base", base); err != nil {
+		t.Fatal(err)
+	}
+
+	// Build an image with three layers, the last of which removes a file
+	// added by the first.
+	for _, hdrs := range [][]*tar.Header{
+		{
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "dir/a", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		{
+			{Name: "dir/b", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		{
+			{Name: "dir/.wh.a", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	} {
+		var patch bytes.Buffer
+		tw := tar.NewWriter(&patch)
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyDelta(engineExt, "base", "base", bytes.NewReader(patch.Bytes()), &ispec.History{Comment: "layer"}, ""); err != nil {
+			t.Fatalf("unexpected error creating image: %+v", err)
+		}
+	}
+
+	if err := Squash(engineExt, "base", "squashed", &ispec.History{Comment: "squashed"}); err != nil {
+		t.Fatalf("unexpected error squashing image: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "squashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptorPaths) != 1 {
+		t.Fatalf("expected squashed tag to be created")
+	}
+	mutator, err := mutate.New(engineExt, descriptorPaths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := mutator.History(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Comment != "squashed" || history[0].EmptyLayer {
+		t.Errorf("unexpected history for squashed image: %#v", history)
+	}
+	diffIDs, err := mutator.DiffIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := mutator.Layers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 || len(diffIDs) != 1 {
+		t.Fatalf("expected 1 layer and diff_id, got %d and %d", len(layers), len(diffIDs))
+	}
+
+	rdr, err := layer.OpenLayer(ctx, engineExt, layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	var names []string
+	tr := tar.NewReader(rdr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading squashed layer: %+v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if expected := []string{"dir/", "dir/b"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected squashed layer entries: expected %v, got %v", expected, names)
+	}
+
+	// The original tag must be left untouched.
+	original, err := resolveManifest(engineExt, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(original.Layers) != 3 {
+		t.Errorf("original image was modified: expected 3 layers, got %d", len(original.Layers))
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// UnsupportedError is returned by CheckSupported, and lists every feature
+// used by an image which umoci does not support.
+type UnsupportedError struct {
+	// Problems is the set of human-readable descriptions of each unsupported
+	// feature, in the order they were found.
+	Problems []string
+}
+
+// Error implements the error interface.
+func (e *UnsupportedError) Error() string {
+	return "image uses unsupported features:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// CheckSupported walks the tree of blobs referenced by root, and returns an
+// *UnsupportedError enumerating all of the features used by the image which
+// umoci does not support (such as foreign layers which are not available
+// locally, unsupported layer compression or nested indexes). This allows for
+// users to get an up-front error, rather than an operation failing part-way
+// through. Only the index and manifest blobs are read, layers are never read.
+func CheckSupported(ctx context.Context, engineExt casext.Engine, root ispec.Descriptor) error {
+	var problems []string
+	seen := map[string]struct{}{}
+	addProblem := func(format string, args ...interface{}) {
+		problem := fmt.Sprintf(format, args...)
+		if _, ok := seen[problem]; !ok {
+			seen[problem] = struct{}{}
+			problems = append(problems, problem)
+		}
+	}
+
+	if err := engineExt.Walk(ctx, root, func(descriptorPath casext.DescriptorPath) error {
+		descriptor := descriptorPath.Descriptor()
+		switch descriptor.MediaType {
+		case ispec.MediaTypeImageIndex:
+			for _, parent := range descriptorPath.Walk[:len(descriptorPath.Walk)-1] {
+				if parent.MediaType == ispec.MediaTypeImageIndex {
+					addProblem("index %s: nested indexes are not supported", descriptor.Digest)
+					break
+				}
+			}
+			return nil
+		case ispec.MediaTypeImageManifest:
+			if err := checkManifest(ctx, engineExt, descriptor, addProblem); err != nil {
+				return err
+			}
+		default:
+			addProblem("blob %s: unsupported media type %q", descriptor.Digest, descriptor.MediaType)
+		}
+		return casext.ErrSkipDescriptor
+	}); err != nil {
+		return errors.Wrap(err, "walk image")
+	}
+
+	if len(problems) > 0 {
+		return &UnsupportedError{Problems: problems}
+	}
+	return nil
+}
+
+// checkManifest checks the given manifest for unsupported features, calling
+// addProblem for each one.
+func checkManifest(ctx context.Context, engineExt casext.Engine, descriptor ispec.Descriptor, addProblem func(string, ...interface{})) error {
+	manifestBlob, err := engineExt.FromDescriptor(ctx, descriptor)
+	if err != nil {
+		return errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		// Should _never_ be reached.
+		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		addProblem("manifest %s: unsupported config media type %q", descriptor.Digest, manifest.Config.MediaType)
+	} else {
+		configBlob, err := engineExt.FromDescriptor(ctx, manifest.Config)
+		if err != nil {
+			return errors.Wrap(err, "get config")
+		}
+		defer configBlob.Close()
+		config, ok := configBlob.Data.(ispec.Image)
+		if !ok {
+			// Should _never_ be reached.
+			return errors.Errorf("[internal error] unknown config blob type: %s", configBlob.Descriptor.MediaType)
+		}
+		if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+			addProblem("manifest %s: number of layers (%d) does not match number of diff_ids (%d)", descriptor.Digest, len(manifest.Layers), len(config.RootFS.DiffIDs))
+		}
+	}
+
+	for _, layerDescriptor := range manifest.Layers {
+		if !layer.IsSupportedLayerType(layerDescriptor.MediaType) {
+			addProblem("layer %s: unsupported media type %q", layerDescriptor.Digest, layerDescriptor.MediaType)
+			continue
+		}
+		// Foreign layers are only a problem if we don't have a local copy,
+		// since umoci will never fetch them.
+		if len(layerDescriptor.URLs) > 0 {
+			rdr, err := engineExt.GetBlob(ctx, layerDescriptor.Digest)
+			if os.IsNotExist(errors.Cause(err)) {
+				addProblem("layer %s: foreign layer is not available locally (urls: %s)", layerDescriptor.Digest, strings.Join(layerDescriptor.URLs, ", "))
+				continue
+			}
+			if err != nil {
+				return errors.Wrap(err, "get foreign layer")
+			}
+			rdr.Close()
+		}
+	}
+	return nil
+}
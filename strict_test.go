@@ -0,0 +1,178 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// putTestManifest creates a manifest with the given layers (which are not
+// necessarily stored in the image), and returns its descriptor.
+func putTestManifest(t *testing.T, engineExt casext.Engine, layers []ispec.Descriptor, diffIDs int) ispec.Descriptor {
+	ctx := context.Background()
+
+	config := ispec.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		RootFS:       ispec.RootFS{Type: "layers"},
+	}
+	for i := 0; i < diffIDs; i++ {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromString("diffid"))
+	}
+	configDigest, configSize, err := engineExt.PutBlobJSON(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: layers,
+	}
+	manifestDigest, manifestSize, err := engineExt.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}
+}
+
+func putTestIndex(t *testing.T, engineExt casext.Engine, manifests ...ispec.Descriptor) ispec.Descriptor {
+	index := ispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: manifests,
+	}
+	indexDigest, indexSize, err := engineExt.PutBlobJSON(context.Background(), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      indexSize,
+	}
+}
+
+func TestCheckSupported(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestCheckSupported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewBufferString("layer data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	goodLayer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+	localForeignLayer := goodLayer
+	localForeignLayer.MediaType = ispec.MediaTypeImageLayerNonDistributable
+	localForeignLayer.URLs = []string{"https://example.com/local"}
+	missingForeignLayer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayerNonDistributableGzip,
+		Digest:    digest.FromString("missing foreign layer"),
+		Size:      1234,
+		URLs:      []string{"https://example.com/missing"},
+	}
+	bzip2Layer := ispec.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+bzip2",
+		Digest:    digest.FromString("bzip2 layer"),
+		Size:      1234,
+	}
+
+	goodManifest := putTestManifest(t, engineExt, []ispec.Descriptor{goodLayer, localForeignLayer}, 2)
+	badManifest := putTestManifest(t, engineExt, []ispec.Descriptor{goodLayer, missingForeignLayer, bzip2Layer}, 2)
+	goodIndex := putTestIndex(t, engineExt, goodManifest)
+	nestedIndex := putTestIndex(t, engineExt, goodIndex)
+
+	for _, test := range []struct {
+		name     string
+		root     ispec.Descriptor
+		problems []string
+	}{
+		{name: "Manifest", root: goodManifest},
+		{name: "Index", root: goodIndex},
+		{
+			name: "BadManifest",
+			root: badManifest,
+			problems: []string{
+				"number of layers (3) does not match number of diff_ids (2)",
+				"foreign layer is not available locally (urls: https://example.com/missing)",
+				`unsupported media type "application/vnd.oci.image.layer.v1.tar+bzip2"`,
+			},
+		},
+		{
+			name:     "NestedIndex",
+			root:     nestedIndex,
+			problems: []string{"nested indexes are not supported"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckSupported(ctx, engineExt, test.root)
+			if len(test.problems) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %+v", err)
+				}
+				return
+			}
+
+			unsupported, ok := err.(*UnsupportedError)
+			if !ok {
+				t.Fatalf("expected *UnsupportedError, got %T: %+v", err, err)
+			}
+			if len(unsupported.Problems) != len(test.problems) {
+				t.Errorf("expected %d problems, got %d: %v", len(test.problems), len(unsupported.Problems), unsupported.Problems)
+			}
+			for _, want := range test.problems {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected problem %q in error: %s", want, err)
+				}
+			}
+		})
+	}
+}
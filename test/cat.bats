@@ -0,0 +1,88 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci cat" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Output a file from the original image.
+	umoci cat --image "${IMAGE}:${TAG}" /etc/passwd
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(cat "$ROOTFS/etc/passwd")" ]]
+
+	# Make some changes.
+	echo "umoci cat test" > "$ROOTFS/newfile"
+	echo "modified passwd" > "$ROOTFS/etc/passwd"
+	chmod +w "$ROOTFS/etc/." && rm -f "$ROOTFS/etc/group"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new contents should be output.
+	umoci cat --image "${IMAGE}:${TAG}-new" /newfile
+	[ "$status" -eq 0 ]
+	[[ "$output" == "umoci cat test" ]]
+
+	umoci cat --image "${IMAGE}:${TAG}-new" etc/passwd
+	[ "$status" -eq 0 ]
+	[[ "$output" == "modified passwd" ]]
+
+	# Whited-out files must fail.
+	umoci cat --image "${IMAGE}:${TAG}-new" /etc/group
+	[ "$status" -ne 0 ]
+
+	# But the old image should be unaffected.
+	umoci cat --image "${IMAGE}:${TAG}" /etc/group
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci cat [invalid]" {
+	# Missing path argument.
+	umoci cat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+
+	# Directories cannot be output.
+	umoci cat --image "${IMAGE}:${TAG}" /etc
+	[ "$status" -ne 0 ]
+
+	# Non-existent files.
+	umoci cat --image "${IMAGE}:${TAG}" /does/not/exist
+	[ "$status" -ne 0 ]
+
+	# Non-existent tags.
+	umoci cat --image "${IMAGE}:${TAG}-doesnotexist" /etc/passwd
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
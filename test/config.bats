@@ -400,6 +400,64 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --config.env-file" {
+	# Create some overlapping environment files.
+	cat >"$UMOCI_TMPDIR/base.env" <<EOF
+# Base environment.
+VARIABLE1=base
+VARIABLE2=base
+
+VARIABLE3=base
+EOF
+	cat >"$UMOCI_TMPDIR/override.env" <<EOF
+VARIABLE2=override
+VARIABLE3=override
+VARIABLE4=override
+EOF
+
+	# Apply the files, with an inline --config.env taking precedence.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--config.env-file "$UMOCI_TMPDIR/base.env" \
+		--config.env-file "$UMOCI_TMPDIR/override.env" \
+		--config.env "VARIABLE3=inline"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make sure environment was set.
+	sane_run jq -SMr '.process.env[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+
+	# Make sure that they are all unique.
+	numDefs="${#lines[@]}"
+	numVars="$(echo "$output" | cut -d= -f1 | sort -u | wc -l)"
+	[ "$numDefs" -eq "$numVars" ]
+
+	# Set the variables.
+	export "${lines[@]}"
+	[[ "$VARIABLE1" == "base" ]]
+	[[ "$VARIABLE2" == "override" ]]
+	[[ "$VARIABLE3" == "inline" ]]
+	[[ "$VARIABLE4" == "override" ]]
+
+	# Make sure the ordering of the first definitions was kept.
+	sane_run jq -SMr '.process.env[] | select(startswith("VARIABLE")) | split("=")[0]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "${lines[*]}" == "VARIABLE1 VARIABLE2 VARIABLE3 VARIABLE4" ]]
+
+	# Invalid environment files must be rejected.
+	echo "NOEQUALS" >"$UMOCI_TMPDIR/bad.env"
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-bad" --config.env-file "$UMOCI_TMPDIR/bad.env"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --clear=config.{entrypoint or cmd}" {
 	# Modify the entrypoint+cmd.
 	umoci config --image "${IMAGE}:${TAG}" --config.entrypoint "sh" --config.entrypoint "/here is some values/" --config.cmd "-c" --config.cmd "ls -la" --config.cmd="kek"
@@ -603,6 +661,33 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --[arch+variant]" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-arm" --arch "arm" --variant "v7"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Check that the platform was set in the configuration.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-arm"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	sane_run jq -SMr '.architecture + "/" + .variant' "$IMAGE/blobs/sha256/$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "arm/v7" ]]
+
+	# Unknown architectures are rejected by default.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-unknown" --architecture "x86_64"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-unknown" --architecture "x86_64" --allow-unknown-arch
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# So are variants which don't belong to the architecture.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-badvariant" --os "linux" --arch "amd64" --variant "v7"
+	[ "$status" -ne 0 ]
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-badvariant" --os "linux" --arch "amd64" --variant "v7" --allow-unknown-arch
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
 # XXX: This doesn't do any actual testing of the results of any of these flags.
 # This needs to be fixed after we implement raw-cat or something like that.
 @test "umoci config --[author+created]" {
@@ -697,6 +782,112 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci config --scrub-history" {
+	# Add a history entry containing a "secret".
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-secret" \
+		--history.created_by="curl -H 'Token: hunter2' https://example.com" \
+		--history.comment="token=hunter2"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-secret" --json
+	[ "$status" -eq 0 ]
+	numLinesA="$(echo "$output" | jq -SMr '.history | length')"
+	layersA="$(echo "$output" | jq -SMr '[.history[] | .layer.digest] | @json')"
+
+	# Scrub the secret without adding a new history entry.
+	umoci config --image "${IMAGE}:${TAG}-secret" --tag "${TAG}-new" --no-history \
+		--scrub-history="hunter[0-9]"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	numLinesB="$(echo "$output" | jq -SMr '.history | length')"
+	layersB="$(echo "$output" | jq -SMr '[.history[] | .layer.digest] | @json')"
+
+	# The history structure must be unchanged.
+	[ "$numLinesA" -eq "$numLinesB" ]
+	[[ "$layersA" == "$layersB" ]]
+	# The secret should've been redacted.
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "curl -H 'Token: [REDACTED]' https://example.com" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "token=[REDACTED]" ]]
+	! echo "$output" | grep -q "hunter2"
+
+	# Scrubbing with a new history entry must not leak the secret (or the
+	# pattern) into the new entry.
+	umoci config --image "${IMAGE}:${TAG}-secret" --tag "${TAG}-newhistory" \
+		--scrub-history "hunter2" --history.comment "scrubbed hunter2"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-newhistory" --json
+	[ "$status" -eq 0 ]
+	numLinesC="$(echo "$output" | jq -SMr '.history | length')"
+	[ "$numLinesC" -eq "$((numLinesA + 1))" ]
+	[[ "$(echo "$output" | jq -SMr '.history[-2].created_by')" == "curl -H 'Token: [REDACTED]' https://example.com" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci config --image ${IMAGE}:${TAG}-secret --tag ${TAG}-newhistory --scrub-history [REDACTED] --history.comment 'scrubbed [REDACTED]'" ]]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].comment')" == "scrubbed [REDACTED]" ]]
+	! echo "$output" | grep -q "hunter2"
+
+	# Invalid patterns must be rejected.
+	umoci config --image "${IMAGE}:${TAG}-secret" --tag "${TAG}-bad" --scrub-history="hunter[0-9"
+	[ "$status" -ne 0 ]
+
+	# Patterns are regular expressions, so literal secrets containing
+	# metacharacters have to be escaped to only match themselves.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-meta" \
+		--history.created_by="login p4ss.w0rd+\$ p4ssXw0rd"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci config --image "${IMAGE}:${TAG}-meta" --tag "${TAG}-meta-scrubbed" --no-history \
+		--scrub-history='p4ss\.w0rd\+\$'
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-meta-scrubbed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "login [REDACTED] p4ssXw0rd" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config [default created_by]" {
+	# The default created_by is the command-line.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --author "Jane O'Doe"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci config --image ${IMAGE}:${TAG} --tag ${TAG}-new --author 'Jane O'\"'\"'Doe'" ]]
+
+	# Secrets can be redacted from it.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-redacted" \
+		--config.env "TOKEN=hunter2" --config.env="PASSWORD=hunter2" \
+		--history.redact config.env
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-redacted" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "umoci config --image ${IMAGE}:${TAG} --tag ${TAG}-redacted --config.env [REDACTED] --config.env=[REDACTED] --history.redact config.env" ]]
+	! echo "$output" | grep -q "hunter2"
+
+	# --history.created_by still takes precedence.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-explicit" \
+		--history.created_by "explicit"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-explicit" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history[-1].created_by')" == "explicit" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci config --config.label" {
 	# Modify none of the configuration.
 	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
@@ -765,3 +956,138 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci config --clear=[config.user+config.workingdir+config.stopsignal+author+variant]" {
+	# Set every single-valued field.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-set" \
+		--config.user="1000:1000" --config.workingdir="/srv" \
+		--config.stopsignal="SIGUSR1" --author="Some Author" \
+		--arch "arm" --variant "v7"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Now clear all of them.
+	umoci config --image "${IMAGE}:${TAG}-set" --tag "${TAG}-cleared" \
+		--clear=config.user --clear=config.workingdir \
+		--clear=config.stopsignal --clear=author --clear=variant
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-cleared"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	sane_run jq -SMr '[.config.User, .config.WorkingDir, .config.StopSignal, .author, .variant] | map(. // "") | join(",")' "$IMAGE/blobs/sha256/$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == ",,,," ]]
+
+	# The architecture itself is left alone.
+	sane_run jq -SMr '.architecture' "$IMAGE/blobs/sha256/$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "arm" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config [SOURCE_DATE_EPOCH]" {
+	# The same modification with the same SOURCE_DATE_EPOCH must result in an
+	# identical image.
+	for tag in a b; do
+		SOURCE_DATE_EPOCH="$(date -d "2019-01-01T00:00:00Z" +%s)" umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-$tag" \
+			--config.user="1000:1000" --history.created_by="umoci config"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+
+	manifestA=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-a"'") | .digest' "$IMAGE/index.json")
+	manifestB=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-b"'") | .digest' "$IMAGE/index.json")
+	[[ "$manifestA" == "$manifestB" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.history[-1].created')" == "2019-01-01T00:00:00Z" ]]
+
+	# Invalid values are rejected.
+	SOURCE_DATE_EPOCH="not a number" umoci config --image "${IMAGE}:${TAG}" --config.user="1000:1000"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --manifest.artifacttype" {
+	# Set the artifact type.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--manifest.artifacttype="application/vnd.example.thing"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.artifact_type')" == "application/vnd.example.thing" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	[[ "${lines[0]}" == "ARTIFACT TYPE: application/vnd.example.thing" ]]
+
+	# The artifact type must be kept by later modifications.
+	umoci config --image "${IMAGE}:${TAG}-new" --config.user="1000:1000"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.artifact_type')" == "application/vnd.example.thing" ]]
+
+	# And it can be cleared.
+	umoci config --image "${IMAGE}:${TAG}-new" --clear=manifest.artifacttype
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.artifact_type')" == "null" ]]
+
+	# Invalid media types must be rejected.
+	for bad in "invalid" "type/" "type/sub/type" "type/subtype; charset=utf-8"; do
+		umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-bad" --manifest.artifacttype="$bad"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci config --manifest.annotation [merge]" {
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" \
+		--manifest.annotation="keep=value" --manifest.annotation="replace=old"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --manifest.annotation is merged into the existing annotations.
+	umoci config --image "${IMAGE}:${TAG}-new" \
+		--manifest.annotation="replace=new" --manifest.annotation="org.opencontainers.image.revision=abc123"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -SMr '.annotations["keep"]' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "value" ]]
+	sane_run jq -SMr '.annotations["replace"]' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "new" ]]
+	sane_run jq -SMr '.annotations["org.opencontainers.image.revision"]' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "abc123" ]]
+
+	# --manifest.annotation is applied after --clear.
+	umoci config --image "${IMAGE}:${TAG}-new" --clear=manifest.annotations --manifest.annotation="only=this"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -SMc '.annotations' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == '{"only":"this"}' ]]
+
+	# Invalid annotations must be rejected.
+	for bad in "noequals" "=value"; do
+		umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-bad" --manifest.annotation="$bad"
+		[ "$status" -ne 0 ]
+	done
+
+	image-verify "${IMAGE}"
+}
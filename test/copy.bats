@@ -0,0 +1,110 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci copy" {
+	DEST="$(setup_tmpdir)/dest"
+
+	# Copy the tag into a new image.
+	umoci copy --src "${IMAGE}:${TAG}" --dest "$DEST"
+	[ "$status" -eq 0 ]
+	image-verify "$DEST"
+
+	# The tag name defaults to the source tag.
+	umoci ls --layout "$DEST"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "${lines[0]}" == "$TAG" ]]
+
+	# The tags must refer to the same manifest.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.Manifest.Digest}}'
+	[ "$status" -eq 0 ]
+	srcStat="$output"
+	umoci stat --image "${DEST}:${TAG}" --format '{{.Manifest.Digest}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$srcStat" ]]
+
+	# Modify the image, and copy it to a different tag.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "umoci copy test" > "$ROOTFS/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	nblobs="$(find "$DEST/blobs" -type f | wc -l)"
+	umoci copy --src "${IMAGE}:${TAG}-new" --dest "${DEST}:new"
+	[ "$status" -eq 0 ]
+	image-verify "$DEST"
+
+	# Only the new manifest, config and layer are copied.
+	[ "$(find "$DEST/blobs" -type f | wc -l)" -eq "$((nblobs + 3))" ]
+
+	umoci cat --image "${DEST}:new" /newfile
+	[ "$status" -eq 0 ]
+	[[ "$output" == "umoci copy test" ]]
+
+	# --no-clobber refuses to replace existing tags.
+	umoci copy --no-clobber --src "${IMAGE}:${TAG}-new" --dest "${DEST}:${TAG}"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "refusing to clobber existing tag"
+	umoci stat --image "${DEST}:${TAG}" --format '{{.Manifest.Digest}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$srcStat" ]]
+
+	# Copying within the same image works like umoci tag.
+	umoci copy --src "${IMAGE}:${TAG}" --dest "${IMAGE}:${TAG}-copy"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-copy" --format '{{.Manifest.Digest}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$srcStat" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci copy [invalid]" {
+	DEST="$(setup_tmpdir)/dest"
+
+	# Missing arguments.
+	umoci copy --src "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci copy --dest "$DEST"
+	[ "$status" -ne 0 ]
+	umoci copy --src "${IMAGE}:${TAG}" --dest "$DEST" extra
+	[ "$status" -ne 0 ]
+
+	# Non-existent tags.
+	umoci copy --src "${IMAGE}:${TAG}-doesnotexist" --dest "$DEST"
+	[ "$status" -ne 0 ]
+
+	# Invalid tags.
+	umoci copy --src "${IMAGE}:${TAG}" --dest "${DEST}:-invalid-"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
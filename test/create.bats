@@ -126,6 +126,71 @@ function teardown() {
 	#image-verify "$IMAGE"
 }
 
+@test "umoci new --no-clobber" {
+	# We are making a new image.
+	IMAGE="$(setup_tmpdir)/image" TAG="latest"
+
+	# The layout must already exist.
+	umoci new --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	[ ! -e "$IMAGE" ]
+
+	umoci init --layout "$IMAGE"
+	[ "$status" -eq 0 ]
+
+	umoci new --no-clobber --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci ls --layout "$IMAGE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+	[[ "$output" == "$TAG" ]]
+
+	# --no-clobber must refuse to replace the existing tag.
+	DIGEST="$(jq -SMr '.manifests[0].digest' "$IMAGE/index.json")"
+	umoci new --no-clobber --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	[[ "$(jq -SMr '.manifests[0].digest' "$IMAGE/index.json")" == "$DIGEST" ]]
+
+	# But without --no-clobber it is replaced.
+	umoci new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci ls --layout "$IMAGE"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 1 ]
+
+	# XXX: oci-image-tool validate doesn't like empty images (without layers)
+	#image-verify "$IMAGE"
+}
+
+@test "umoci new [SOURCE_DATE_EPOCH]" {
+	# We are making a new image.
+	IMAGE="$(setup_tmpdir)/image" TAG="latest"
+
+	umoci init --layout "$IMAGE"
+	[ "$status" -eq 0 ]
+
+	# The same SOURCE_DATE_EPOCH must result in an identical image.
+	for tag in a b; do
+		SOURCE_DATE_EPOCH="$(date -d "2019-01-01T00:00:00Z" +%s)" umoci new --image "${IMAGE}:${TAG}-$tag"
+		[ "$status" -eq 0 ]
+	done
+
+	manifestA=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-a"'") | .digest' "$IMAGE/index.json")
+	manifestB=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-b"'") | .digest' "$IMAGE/index.json")
+	[[ "$manifestA" == "$manifestB" ]]
+
+	manifestHash="${manifestA#*:}"
+	configHash="$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifestHash")"
+	[[ "$(jq -r '.created' "$IMAGE/blobs/sha256/${configHash#*:}")" == "2019-01-01T00:00:00Z" ]]
+
+	# Invalid values are rejected.
+	SOURCE_DATE_EPOCH="not a number" umoci new --image "${IMAGE}:${TAG}-c"
+	[ "$status" -ne 0 ]
+
+	# XXX: oci-image-tool validate doesn't like empty images (without layers)
+	#image-verify "$IMAGE"
+}
+
 # Given the bad experiences we've had with Go compiler changes resulting in
 # inconsistent archive output, this is a simple test to check whether a Go
 # compiler update will change our expected hashes seriously. We want to be as
@@ -136,6 +201,49 @@ function teardown() {
 # behaviour and thus non-deterministic archives. Do you ever get the feeling
 # that sometimes you have to cut your losses and actually do something better
 # than to sit and suffer? Well, this is how it feels.
+@test "umoci --digest-algorithm" {
+	# We are making a new image.
+	IMAGE="$(setup_tmpdir)/image" TAG="latest"
+
+	# Unsupported algorithms must be rejected.
+	umoci --digest-algorithm=md5 init --layout "$IMAGE"
+	[ "$status" -ne 0 ]
+	[ ! -e "$IMAGE" ]
+
+	umoci --digest-algorithm=sha512 init --layout "$IMAGE"
+	[ "$status" -eq 0 ]
+	umoci --digest-algorithm=sha512 new --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	new_bundle_rootfs
+	umoci --digest-algorithm=sha512 unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "new file" > "$ROOTFS/newfile"
+	umoci --digest-algorithm=sha512 repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# Every blob uses sha512.
+	sane_run find "$IMAGE/blobs/sha256" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 0 ]
+	sane_run find "$IMAGE/blobs/sha512" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -gt 0 ]
+	sane_run jq -SMr '.manifests[0].digest' "$IMAGE/index.json"
+	[[ "$output" == "sha512:"* ]]
+
+	# The image can be read without --digest-algorithm, and the mtree manifest
+	# is named after the digest algorithm.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/newfile" ]
+	sane_run find "$BUNDLE" -maxdepth 1 -name 'sha512_*.mtree'
+	[ "${#lines[@]}" -eq 1 ]
+}
+
 @test "umoci [archive/tar regressions]" {
 	# Setup up $IMAGE.
 	IMAGE="$(setup_tmpdir)/image"
@@ -207,3 +315,61 @@ function teardown() {
 
 	image-verify "$IMAGE"
 }
+
+@test "umoci pack [missing args]" {
+	umoci pack
+	[ "$status" -ne 0 ]
+
+	umoci pack --image "${IMAGE}:${TAG}-packed"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci pack --rootfs" {
+	# Create a root filesystem.
+	NEWROOTFS="$(setup_tmpdir)"
+	mkdir -p "$NEWROOTFS/bin" "$NEWROOTFS/etc"
+	echo "#!/bin/sh" > "$NEWROOTFS/bin/hello"
+	chmod +x "$NEWROOTFS/bin/hello"
+	echo "umoci pack test" > "$NEWROOTFS/etc/motd"
+	ln -s ../etc/motd "$NEWROOTFS/bin/motd"
+
+	umoci pack --image "${IMAGE}:${TAG}-packed" --rootfs "$NEWROOTFS" \
+		--config.entrypoint="/bin/hello" --config.env="HELLO=world" \
+		--author="Aleksa Sarai <asarai@suse.de>"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The image must have exactly one layer.
+	umoci stat --image "${IMAGE}:${TAG}-packed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '.history | length')" == 1 ]]
+	[[ "$(echo "$output" | jq -SMr '.history[0].created_by')" == "umoci pack "* ]]
+	[[ "$(echo "$output" | jq -SMr '.history[0].empty_layer')" == "null" ]]
+
+	# Unpack the image and make sure it matches.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-packed" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run diff -r "$NEWROOTFS" "$ROOTFS"
+	[ "$status" -eq 0 ]
+	[[ "$(readlink "$ROOTFS/bin/motd")" == "../etc/motd" ]]
+
+	# Check the configuration.
+	sane_run jq -SMr '.process.args[0]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "/bin/hello" ]]
+	sane_run jq -SMr '.process.env[]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep "^HELLO=world$"
+	sane_run jq -SMr '.annotations["org.opencontainers.image.author"]' "$BUNDLE/config.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "Aleksa Sarai <asarai@suse.de>" ]]
+
+	# A non-existent rootfs must be rejected.
+	umoci pack --image "${IMAGE}:${TAG}-bad" --rootfs "$NEWROOTFS/nonexistent"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,118 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+function genkey() {
+	local key="$(setup_tmpdir)/key"
+	sane_run openssl genrsa -out "$key.pem" 2048
+	[ "$status" -eq 0 ]
+	sane_run openssl rsa -in "$key.pem" -pubout -out "$key.pub.pem"
+	[ "$status" -eq 0 ]
+	echo "$key"
+}
+
+@test "umoci encrypt" {
+	KEY_A="$(genkey)"
+	KEY_B="$(genkey)"
+	KEY_C="$(genkey)"
+
+	umoci encrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-enc" --recipient "$KEY_A.pub.pem" --recipient "jwe:$KEY_B.pub.pem"
+	[ "$status" -eq 0 ]
+
+	# Every layer must be encrypted, and the history must contain an
+	# empty_layer entry.
+	umoci stat --image "${IMAGE}:${TAG}-enc" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '[.layers[].layer.mediaType | endswith("+encrypted")] | all')" == "true" ]]
+	[[ "$(echo "$output" | jq -SM '[.layers[].layer.annotations | has("org.opencontainers.image.enc.keys.jwe")] | all')" == "true" ]]
+	[[ "$(echo "$output" | jq -SM '.history[-1].empty_layer')" == "true" ]]
+
+	# Unpacking requires a matching key.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-enc" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-enc" --decryption-key "$KEY_C.pem" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Either recipient can unpack the image, and the root filesystem is the
+	# same as the original image.
+	new_bundle_rootfs
+	BUNDLE_A="$BUNDLE"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	for key in "$KEY_A" "$KEY_B"; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}-enc" --decryption-key "$KEY_C.pem" --decryption-key "$key.pem" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		sane_run diff -r "$BUNDLE_A/rootfs" "$BUNDLE/rootfs"
+		[ "$status" -eq 0 ]
+	done
+
+	# Recipients must be valid public keys.
+	umoci encrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-bad"
+	[ "$status" -ne 0 ]
+	umoci encrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-bad" --recipient "pkcs7:$KEY_A.pub.pem"
+	[ "$status" -ne 0 ]
+	umoci encrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-bad" --recipient "$(setup_tmpdir)/missing.pem"
+	[ "$status" -ne 0 ]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-bad"* ]]
+}
+
+@test "umoci decrypt" {
+	KEY_A="$(genkey)"
+	KEY_B="$(genkey)"
+
+	umoci encrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-enc" --recipient "$KEY_A.pub.pem" --no-history
+	[ "$status" -eq 0 ]
+
+	# Decrypting with the wrong key fails.
+	umoci decrypt --image "${IMAGE}:${TAG}-enc" --tag "${TAG}-dec" --key "$KEY_B.pem"
+	[ "$status" -ne 0 ]
+
+	# Decrypting results in the original image.
+	umoci decrypt --image "${IMAGE}:${TAG}-enc" --tag "${TAG}-dec" --key "$KEY_B.pem" --key "$KEY_A.pem" --no-history
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.Manifest.Digest}}'
+	[ "$status" -eq 0 ]
+	origDigest="$output"
+	umoci stat --image "${IMAGE}:${TAG}-dec" --format '{{.Manifest.Digest}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$origDigest" ]]
+
+	# Decrypting an unencrypted image is a no-op.
+	umoci decrypt --image "${IMAGE}:${TAG}" --tag "${TAG}-dec2" --key "$KEY_A.pem" --no-history
+	[ "$status" -eq 0 ]
+	umoci stat --image "${IMAGE}:${TAG}-dec2" --format '{{.Manifest.Digest}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$origDigest" ]]
+}
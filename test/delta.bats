@@ -0,0 +1,147 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci delta" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	echo "umoci delta test" > "$ROOTFS/newfile"
+	mkdir -p "$ROOTFS/newdir/subdir"
+	echo "nested" > "$ROOTFS/newdir/subdir/file"
+	chmod +w "$ROOTFS/etc/." && echo "modified passwd" > "$ROOTFS/etc/passwd"
+	rm -f "$ROOTFS/etc/group"
+	ln -s /newfile "$ROOTFS/etc/newlink"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Compute the delta.
+	umoci delta --from "${IMAGE}:${TAG}" --to "${IMAGE}:${TAG}-new" --output "$UMOCI_TMPDIR/patch.tar"
+	[ "$status" -eq 0 ]
+	[ -f "$UMOCI_TMPDIR/patch.tar" ]
+
+	# The delta must contain the changes (and whiteouts).
+	sane_run tar tf "$UMOCI_TMPDIR/patch.tar"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"newfile"* ]]
+	[[ "$output" == *"newdir/subdir/file"* ]]
+	[[ "$output" == *"etc/passwd"* ]]
+	[[ "$output" == *"etc/.wh.group"* ]]
+	[[ "$output" == *"etc/newlink"* ]]
+
+	# Apply the delta on top of the original image.
+	umoci apply-delta --image "${IMAGE}:${TAG}" --output "${TAG}-patched" "$UMOCI_TMPDIR/patch.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Make sure the history entry was added.
+	umoci stat --image "${IMAGE}:${TAG}-patched" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -r '.history[-1].created_by' <<<"$output")" == "umoci apply-delta "* ]]
+
+	# Unpack both the new and patched images.
+	new_bundle_rootfs
+	NEW_BUNDLE="$BUNDLE"
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$NEW_BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$NEW_BUNDLE"
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-patched" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The patched rootfs must be identical to the new rootfs.
+	gomtree -p "$ROOTFS" -f "$NEW_BUNDLE"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+}
+
+@test "umoci delta [missing arguments]" {
+	umoci delta --to "${IMAGE}:${TAG}" --output "$UMOCI_TMPDIR/patch.tar"
+	[ "$status" -ne 0 ]
+	umoci delta --from "${IMAGE}:${TAG}" --output "$UMOCI_TMPDIR/patch.tar"
+	[ "$status" -ne 0 ]
+	umoci delta --from "${IMAGE}:${TAG}" --to "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	! [ -e "$UMOCI_TMPDIR/patch.tar" ]
+
+	# Non-existent tags must fail without leaving an output behind.
+	umoci delta --from "${IMAGE}:${TAG}" --to "${IMAGE}:does-not-exist" --output "$UMOCI_TMPDIR/patch.tar"
+	[ "$status" -ne 0 ]
+	! [ -e "$UMOCI_TMPDIR/patch.tar" ]
+}
+
+@test "umoci apply-delta --expect" {
+	# Create a new image to compute a delta to.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "umoci apply-delta test" > "$ROOTFS/newfile"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Compressed deltas are also accepted.
+	umoci delta --from "${IMAGE}:${TAG}" --to "${IMAGE}:${TAG}-new" --output "$UMOCI_TMPDIR/patch.tar"
+	[ "$status" -eq 0 ]
+	gzip "$UMOCI_TMPDIR/patch.tar"
+
+	umoci apply-delta --image "${IMAGE}:${TAG}" --output "${TAG}-patched" "$UMOCI_TMPDIR/patch.tar.gz"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-patched" --json
+	[ "$status" -eq 0 ]
+	chainid="$(jq -r '.history | map(select(.chain_id != "")) | .[-1].chain_id' <<<"$output")"
+
+	# Applying the same delta must result in the same chain id.
+	umoci apply-delta --image "${IMAGE}:${TAG}" --output "${TAG}-verified" --expect "$chainid" "$UMOCI_TMPDIR/patch.tar.gz"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# ... and a mismatch must not create the tag.
+	umoci apply-delta --image "${IMAGE}:${TAG}" --output "${TAG}-bad" --expect "sha256:0000000000000000000000000000000000000000000000000000000000000000" "$UMOCI_TMPDIR/patch.tar.gz"
+	[ "$status" -ne 0 ]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-bad"* ]]
+
+	# Invalid deltas must be rejected.
+	echo "not a tar archive" > "$UMOCI_TMPDIR/bad.tar"
+	umoci apply-delta --image "${IMAGE}:${TAG}" --output "${TAG}-bad" "$UMOCI_TMPDIR/bad.tar"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+}
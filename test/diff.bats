@@ -0,0 +1,89 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci repair-diffids" {
+@test "umoci diff" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Nothing has changed yet.
+	umoci diff "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+	umoci diff --json "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "[]" ]]
+
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	tags="$output"
+
+	# Make some changes.
+	echo "new file" > "$ROOTFS/newfile"
+	chmod +w "$ROOTFS/etc/passwd" && echo "modified" > "$ROOTFS/etc/passwd"
+	chmod +w "$ROOTFS/usr/bin/." && rm -f "$ROOTFS/usr/bin/env"
+	mkdir -p "$ROOTFS/masked"
+	echo "masked" > "$ROOTFS/masked/file"
+
+	umoci diff --mask-path /masked "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep -P '^A\tnewfile$'
+	echo "$output" | grep -P '^M\tetc/passwd$'
+	echo "$output" | grep -P '^D\tusr/bin/env$'
+	! echo "$output" | grep "masked"
+
+	umoci diff --json --mask-path /masked "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -r '.[] | select(.path == "newfile") | .type' <<<"$output")" == "extra" ]]
+	[[ "$(jq -r '.[] | select(.path == "etc/passwd") | .type' <<<"$output")" == "modified" ]]
+	[[ "$(jq -r '.[] | select(.path == "usr/bin/env") | .type' <<<"$output")" == "missing" ]]
+
+	# The image must not have been touched.
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$tags" ]]
+
+	# A repacked bundle (with --refresh-bundle) has no changes.
+	umoci repack --refresh-bundle --mask-path /masked --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci diff --mask-path /masked "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Invalid arguments.
+	umoci diff
+	[ "$status" -ne 0 ]
+	umoci diff "$BUNDLE" too many
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,99 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+@test "umoci export docker-archive" {
+	archive="$(setup_tmpdir)/docker.tar"
+
+	umoci export --image "${IMAGE}:${TAG}" "docker-archive:$archive:example/image:exported"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The archive must list the image under the given name.
+	manifest="$(tar -xOf "$archive" manifest.json)"
+	[[ "$(echo "$manifest" | jq -r '.[0].RepoTags[0]')" == "example/image:exported" ]]
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$manifest" | jq -r '.[0].Layers | length')" == "$(echo "$output" | jq -r '[.history[] | select(.layer != null)] | length')" ]]
+
+	# Exporting the same image again gives an identical archive.
+	umoci export --image "${IMAGE}:${TAG}" "docker-archive:$archive.2:example/image:exported"
+	[ "$status" -eq 0 ]
+	cmp "$archive" "$archive.2"
+
+	# Only docker-archive: is supported.
+	umoci export --image "${IMAGE}:${TAG}" "oci-archive:$archive"
+	[ "$status" -ne 0 ]
+	umoci export --image "${IMAGE}:${TAG}-nonexistent" "docker-archive:$archive.3"
+	[ "$status" -ne 0 ]
+	! [ -e "$archive.3" ]
+}
+
+@test "umoci import docker-archive" {
+	archive="$(setup_tmpdir)/docker.tar"
+
+	umoci export --image "${IMAGE}:${TAG}" "docker-archive:$archive:example/image:imported"
+	[ "$status" -eq 0 ]
+
+	# Import the archive into a new image.
+	NEW_IMAGE="$(setup_tmpdir)/image"
+	umoci import --image "$NEW_IMAGE" "docker-archive:$archive:example/image:imported"
+	[ "$status" -eq 0 ]
+	image-verify "$NEW_IMAGE"
+
+	# The tag defaults to the tag of the name.
+	umoci ls --layout "$NEW_IMAGE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "imported" ]]
+
+	# The imported image must be identical to the original.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	original="$output"
+	umoci stat --image "${NEW_IMAGE}:imported" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history')" == "$(echo "$original" | jq -SM '.history')" ]]
+
+	# Importing a missing name must fail.
+	umoci import --image "$NEW_IMAGE:other" "docker-archive:$archive:example/image:other"
+	[ "$status" -ne 0 ]
+
+	# Both images must unpack to the same rootfs.
+	new_bundle_rootfs
+	BUNDLE_A="$BUNDLE"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	new_bundle_rootfs
+	BUNDLE_B="$BUNDLE"
+	umoci unpack --image "${NEW_IMAGE}:imported" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,97 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci edit-layers" {
+	# Add a few layers to the image.
+	for name in first second third; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+
+		echo "$name" > "$ROOTFS/$name"
+
+		umoci repack --image "${IMAGE}:${TAG}" --history.comment "$name" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	nlayers="$(jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest")"
+
+	# Create a replacement for the last layer.
+	LAYER_DIR="$(setup_tmpdir)"
+	echo "replaced" > "$LAYER_DIR/replaced"
+	tar -C "$LAYER_DIR" -cf "$LAYER_DIR.tar" replaced
+
+	# Invalid arguments must be rejected.
+	umoci edit-layers --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci edit-layers --image "${IMAGE}:${TAG}" --replace "last=$LAYER_DIR.tar"
+	[ "$status" -ne 0 ]
+	umoci edit-layers --image "${IMAGE}:${TAG}" --remove 1 --replace "1=$LAYER_DIR.tar"
+	[ "$status" -ne 0 ]
+	umoci edit-layers --image "${IMAGE}:${TAG}" --remove "$nlayers"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Remove the second-last layer and replace the last layer.
+	umoci edit-layers --image "${IMAGE}:${TAG}" --tag "${TAG}-edited" \
+		--remove "$((nlayers - 2))" --replace "$((nlayers - 1))=$LAYER_DIR.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-edited"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	[[ "$(jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest")" == "$((nlayers - 1))" ]]
+	[[ "$(jq -r '.rootfs.diff_ids | length' "$IMAGE/blobs/sha256/$config")" == "$((nlayers - 1))" ]]
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-edited" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/first")" == "first" ]]
+	! [ -e "$ROOTFS/second" ]
+	! [ -e "$ROOTFS/third" ]
+	[[ "$(cat "$ROOTFS/replaced")" == "replaced" ]]
+
+	# Truncate the image to drop the last two layers.
+	umoci edit-layers --image "${IMAGE}:${TAG}" --tag "${TAG}-truncated" --truncate "$((nlayers - 2))"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-truncated" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/first")" == "first" ]]
+	! [ -e "$ROOTFS/second" ]
+	! [ -e "$ROOTFS/third" ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,96 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci extract" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Extract a file from the original image.
+	DEST="$(setup_tmpdir)"
+	umoci extract --image "${IMAGE}:${TAG}" /etc/passwd "$DEST/passwd"
+	[ "$status" -eq 0 ]
+	cmp "$DEST/passwd" "$ROOTFS/etc/passwd"
+
+	# Make some changes.
+	echo "umoci extract test" > "$ROOTFS/etc/newfile"
+	echo "modified passwd" > "$ROOTFS/etc/passwd"
+	chmod +w "$ROOTFS/etc/." && rm -f "$ROOTFS/etc/group"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Extracting the directory should give the merged contents.
+	umoci extract --image "${IMAGE}:${TAG}-new" /etc "$DEST/etc"
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$DEST/etc/newfile")" == "umoci extract test" ]]
+	[[ "$(cat "$DEST/etc/passwd")" == "modified passwd" ]]
+	[[ "$(ls -A "$DEST/etc" | sort)" == "$(ls -A "$ROOTFS/etc" | sort)" ]]
+	! [ -e "$DEST/etc/group" ]
+	! [ -e "$DEST/etc/.wh.group" ]
+
+	# Whited-out files must fail.
+	umoci extract --image "${IMAGE}:${TAG}-new" /etc/group "$DEST/group"
+	[ "$status" -ne 0 ]
+	! [ -e "$DEST/group" ]
+
+	# But the old image should be unaffected.
+	umoci extract --image "${IMAGE}:${TAG}" /etc/group "$DEST/group"
+	[ "$status" -eq 0 ]
+	[ -f "$DEST/group" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci extract [invalid]" {
+	DEST="$(setup_tmpdir)"
+
+	# Missing arguments.
+	umoci extract --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	umoci extract --image "${IMAGE}:${TAG}" /etc/passwd
+	[ "$status" -ne 0 ]
+
+	# Existing destinations.
+	umoci extract --image "${IMAGE}:${TAG}" /etc/passwd "$DEST"
+	[ "$status" -ne 0 ]
+
+	# Non-existent files.
+	umoci extract --image "${IMAGE}:${TAG}" /does/not/exist "$DEST/file"
+	[ "$status" -ne 0 ]
+	! [ -e "$DEST/file" ]
+
+	# Non-existent tags.
+	umoci extract --image "${IMAGE}:${TAG}-doesnotexist" /etc/passwd "$DEST/file"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -115,6 +115,142 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci gc [missing non-distributable layer]" {
+	# Add a non-distributable layer.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "proprietary" > "$ROOTFS/proprietary"
+	umoci repack --non-distributable --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	# Remove the non-distributable layer blob, as though the image had been
+	# fetched without it.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	rm "$IMAGE/blobs/sha256/$layer"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# GC must still work, and must not remove any of the other blobs.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# Unpacking must fail with a clear error.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"foreign layer is not available locally"* ]]
+}
+
+@test "umoci gc --dry-run" {
+	# Initial gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Nothing should be listed.
+	umoci gc --layout "${IMAGE}" --dry-run
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Create some garbage by removing a tag.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user "1234:1234"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci rm --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# The unreferenced manifest and config must be listed, with their sizes.
+	umoci gc --layout "${IMAGE}" --dry-run
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 2 ]
+	for line in "${lines[@]}"; do
+		digest="$(cut -f1 <<<"$line")"
+		size="$(cut -f2 <<<"$line")"
+		[ -f "$IMAGE/blobs/sha256/${digest#sha256:}" ]
+		[[ "$(stat -c %s "$IMAGE/blobs/sha256/${digest#sha256:}")" == "$size" ]]
+	done
+
+	# Nothing must have been removed.
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# A real gc removes them.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$((nblobs - 2))" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci gc --format json" {
+	# Initial gc.
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci gc --layout "${IMAGE}" --format yaml
+	[ "$status" -ne 0 ]
+
+	# Create some garbage by removing a tag.
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --config.user "1234:1234"
+	[ "$status" -eq 0 ]
+	umoci rm --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	nblobs="${#lines[@]}"
+
+	# The report must list the unreferenced manifest and config.
+	umoci gc --layout "${IMAGE}" --dry-run --format json
+	[ "$status" -eq 0 ]
+	report="$output"
+	[[ "$(jq -r '.unreachable | length' <<<"$report")" == 2 ]]
+	[[ "$(jq -r '.total_blobs' <<<"$report")" == "$nblobs" ]]
+	[[ "$(jq -r '[.unreachable[].size] | add' <<<"$report")" == "$(jq -r '.reclaimed_bytes' <<<"$report")" ]]
+	for digest in $(jq -r '.unreachable[].digest' <<<"$report"); do
+		[ -f "$IMAGE/blobs/sha256/${digest#sha256:}" ]
+	done
+	[[ "$(jq -r '.roots[] | select(.name == "'"${TAG}"'") | .reachable_blobs' <<<"$report")" -gt 0 ]]
+
+	# Nothing must have been removed.
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nblobs" ]
+
+	# A real gc outputs the same report.
+	umoci gc --layout "${IMAGE}" --format json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -cS '.' <<<"$output")" == "$(jq -cS '.' <<<"$report")" ]]
+
+	sane_run find "$IMAGE/blobs" -type f
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$((nblobs - 2))" ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci gc [empty]" {
 	# Initial gc.
 	umoci gc --layout "${IMAGE}"
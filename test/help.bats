@@ -81,6 +81,14 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci new"+ ]]
 
+	umoci pack --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci pack"+ ]]
+
+	umoci pack -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci pack"+ ]]
+
 	umoci tag --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci tag"+ ]]
@@ -137,6 +145,46 @@ load helpers
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci stat"+ ]]
 
+	umoci cat --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci cat"+ ]]
+
+	umoci cat -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci cat"+ ]]
+
+	umoci delta --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci delta"+ ]]
+
+	umoci delta -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci delta"+ ]]
+
+	umoci apply-delta --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci apply-delta"+ ]]
+
+	umoci apply-delta -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci apply-delta"+ ]]
+
+	umoci repair-diffids --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci repair-diffids"+ ]]
+
+	umoci repair-diffids -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci repair-diffids"+ ]]
+
+	umoci diff --help
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci diff"+ ]]
+
+	umoci diff -h
+	[ "$status" -eq 0 ]
+	[[ "${lines[1]}" =~ "umoci diff"+ ]]
+
 	umoci gc --help
 	[ "$status" -eq 0 ]
 	[[ "${lines[1]}" =~ "umoci gc"+ ]]
@@ -268,3 +268,71 @@ function teardown() {
 
 	image-verify "${IMAGE}"
 }
+
+@test "umoci insert --uid --gid" {
+	INSERTDIR="$(setup_tmpdir)"
+	mkdir -p "${INSERTDIR}/certs/sub"
+	echo "ca" > "${INSERTDIR}/certs/ca.pem"
+	echo "other" > "${INSERTDIR}/certs/sub/other.pem"
+
+	# Invalid owners are rejected, as is combining them with --whiteout.
+	umoci insert --image "${IMAGE}:${TAG}" --uid -1 "${INSERTDIR}/certs" /etc/certs
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --whiteout --gid 0 /etc/certs
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --uid 1234 --gid 5678 "${INSERTDIR}/certs" /etc/certs
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Every inserted entry has the given owner.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	sane_run tar --numeric-owner -tvzf "$IMAGE/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq 4 ]
+	for line in "${lines[@]}"; do
+		[[ "$line" == *" 1234/5678 "* ]]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci insert --whiteout-mode=overlayfs" {
+	# Overlay whiteouts can only be created by root.
+	requires root
+
+	# Create something that looks like an overlayfs upper directory.
+	INSERTDIR="$(setup_tmpdir)"
+	mkdir -p "${INSERTDIR}/upper/etc"
+	mknod "${INSERTDIR}/upper/etc/group" c 0 0
+	echo "overlay" > "${INSERTDIR}/upper/etc/overlay-file"
+
+	# Invalid modes are rejected, as is combining it with --whiteout.
+	umoci insert --image "${IMAGE}:${TAG}" --whiteout-mode=bogus "${INSERTDIR}/upper" /
+	[ "$status" -ne 0 ]
+	umoci insert --image "${IMAGE}:${TAG}" --whiteout --whiteout-mode=overlayfs /etc
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci insert --image "${IMAGE}:${TAG}" --tag "${TAG}-new" --whiteout-mode=overlayfs "${INSERTDIR}/upper" /
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The overlay whiteout was converted to a whiteout.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	sane_run tar -tzf "$IMAGE/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"etc/.wh.group"* ]]
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	! [ -e "$ROOTFS/etc/group" ]
+	[[ "$(cat "$ROOTFS/etc/overlay-file")" == "overlay" ]]
+
+	image-verify "${IMAGE}"
+}
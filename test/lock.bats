@@ -0,0 +1,93 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+# hold_lock takes a flock(2) on the image directory (with the given flock(1)
+# mode) in the background, until release_lock is called.
+function hold_lock() {
+	flock -o "$1" "$IMAGE" sleep 60 3>&- &
+	LOCK_PID="$!"
+	# Wait for the lock to be taken.
+	sleep 0.5
+}
+
+function release_lock() {
+	kill "$LOCK_PID"
+	wait "$LOCK_PID" || true
+}
+
+@test "umoci --lock-timeout [exclusive]" {
+	hold_lock -x
+
+	# Neither readers nor writers can use the image while it is being modified.
+	umoci --lock-timeout 200ms stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "in use by another process"
+	umoci --lock-timeout 200ms tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "in use by another process"
+
+	# Unless locking is disabled.
+	umoci --no-lock stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	release_lock
+
+	umoci --lock-timeout 200ms stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci --lock-timeout 200ms tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --lock-timeout [shared]" {
+	hold_lock -s
+
+	# Readers can use the image at the same time, but writers cannot.
+	umoci --lock-timeout 200ms stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci --lock-timeout 200ms tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "in use by another process"
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "in use by another process"
+
+	# Unless locking is disabled.
+	umoci --no-lock tag --image "${IMAGE}:${TAG}" "${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	release_lock
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci --no-lock [--lock-timeout]" {
+	umoci --no-lock --lock-timeout 1s stat --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+}
@@ -0,0 +1,90 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci rebase" {
+	# Create a new version of the base image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "new base" > "$ROOTFS/newbase"
+	umoci repack --image "${IMAGE}:${TAG}-newbase" --history.comment "new base" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Build an application on top of the old base image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "app" > "$ROOTFS/app"
+	umoci repack --image "${IMAGE}:${TAG}-app" --history.comment "app" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Both bases are required.
+	umoci rebase --image "${IMAGE}:${TAG}-app" --old-base "${TAG}"
+	[ "$status" -ne 0 ]
+	umoci rebase --image "${IMAGE}:${TAG}-app" --onto "${TAG}-newbase"
+	[ "$status" -ne 0 ]
+
+	# The application wasn't built on top of the new base.
+	umoci rebase --image "${IMAGE}:${TAG}-app" --old-base "${TAG}-newbase" --onto "${TAG}"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	umoci rebase --image "${IMAGE}:${TAG}-app" --old-base "${TAG}" --onto "${TAG}-newbase" --tag "${TAG}-rebased"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The layers of the new base are followed by the application layer.
+	newbase_manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-newbase"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	app_manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-app"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-rebased"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -r '[.layers[].digest] | join(" ")' "$IMAGE/blobs/sha256/$newbase_manifest"
+	newbase_layers="$output"
+	sane_run jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$app_manifest"
+	app_layer="$output"
+	sane_run jq -r '[.layers[].digest] | join(" ")' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "$newbase_layers $app_layer" ]]
+
+	# The history of the new base is followed by the application history.
+	umoci stat --image "${IMAGE}:${TAG}-rebased" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '[.history[] | select(.empty_layer | not) | .comment] | .[-2:] | join(",")')" == "new base,app" ]]
+
+	# The rebased image contains both files.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-rebased" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/newbase")" == "new base" ]]
+	[[ "$(cat "$ROOTFS/app")" == "app" ]]
+
+	image-verify "${IMAGE}"
+}
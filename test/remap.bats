@@ -0,0 +1,125 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci remap --uid-map --gid-map" {
+	# We need to be able to unpack files with arbitrary owners.
+	requires root
+
+	umoci remap --image "${IMAGE}:${TAG}" --tag "${TAG}-remapped" --uid-map "0:1337:65536" --gid-map "0:8888:65536"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The history must contain an empty_layer entry.
+	umoci stat --image "${IMAGE}:${TAG}-remapped" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history[-1].empty_layer')" == "true" ]]
+
+	# Unpack the image without a mapping.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-remapped" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Check that all of the files have a UID owner >=1337 and a GID owner >=8888.
+	find "$ROOTFS" -mindepth 1 | xargs stat -c '%u:%g' | awk -F: '{
+		uid = $1;
+		if (uid < 1337 || uid >= 1337 + 65536)
+			exit 1;
+		gid = $2;
+		if (gid < 8888 || gid >= 8888 + 65536)
+			exit 1;
+	}'
+
+	# Unpacking the original image with the same mapping gives the same owners.
+	BUNDLE_A="$BUNDLE"
+	new_bundle_rootfs
+	BUNDLE_B="$BUNDLE"
+	umoci unpack --image "${IMAGE}:${TAG}" --uid-map "0:1337:65536" --gid-map "0:8888:65536" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	(cd "$BUNDLE_A/rootfs" && find . | sort | xargs stat -c '%n %u:%g') >"$UMOCI_TMPDIR/a"
+	(cd "$BUNDLE_B/rootfs" && find . | sort | xargs stat -c '%n %u:%g') >"$UMOCI_TMPDIR/b"
+	sane_run diff -u "$UMOCI_TMPDIR/a" "$UMOCI_TMPDIR/b"
+	[ "$status" -eq 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci remap --keep-unmapped" {
+	# We need to be able to create files with arbitrary owners.
+	requires root
+
+	# Add a file owned by an unusual user.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "unmapped" >"$ROOTFS/unmapped"
+	chown "123456:123456" "$ROOTFS/unmapped"
+	umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Files outside of the mapping are an error by default.
+	umoci remap --image "${IMAGE}:${TAG}" --tag "${TAG}-remapped" --uid-map "0:1000:65536"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "cannot be mapped"
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	! echo "$output" | grep -q "${TAG}-remapped"
+
+	# But can be left alone with --keep-unmapped.
+	umoci remap --image "${IMAGE}:${TAG}" --tag "${TAG}-remapped" --uid-map "0:1000:65536" --keep-unmapped
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-remapped" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	sane_run stat -c '%u:%g' "$ROOTFS/unmapped"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "123456:123456" ]]
+	sane_run stat -c '%u:%g' "$ROOTFS/etc"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1000:0" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci remap [invalid arguments]" {
+	umoci remap --image "${IMAGE}:${TAG}" --uid-map "invalid"
+	[ "$status" -ne 0 ]
+	umoci remap --image "${IMAGE}:${TAG}" --gid-map "0:a:1"
+	[ "$status" -ne 0 ]
+	umoci remap --image "${IMAGE}:${TAG}" extra
+	[ "$status" -ne 0 ]
+	umoci remap --image "${IMAGE}:${TAG}" --tag "invalid tag!"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
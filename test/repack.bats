@@ -544,6 +544,66 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci {un,re}pack [capabilities]" {
+	# Setting security.capability requires CAP_SETFCAP.
+	requires root
+
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Set cap_net_bind_service=ep, both as a normal capability and as a
+	# namespaced capability (scoped to uid 1000).
+	echo "some binary" > "$ROOTFS/cap_v2"
+	echo "some binary" > "$ROOTFS/cap_v3"
+	setfattr -n "security.capability" -v "0x0100000200040000000000000000000000000000" "$ROOTFS/cap_v2"
+	setfattr -n "security.capability" -v "0x0100000300040000000000000000000000000000e8030000" "$ROOTFS/cap_v3"
+
+	# Repack the image.
+	umoci repack --image "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Both capabilities must have survived, and the namespaced one must no
+	# longer be scoped to a user namespace.
+	sane_run _getfattr security.capability "$ROOTFS/cap_v2"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0x0100000200040000000000000000000000000000" ]]
+	sane_run _getfattr security.capability "$ROOTFS/cap_v3"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0x0100000200040000000000000000000000000000" ]]
+
+	# Dropping the capability must be included in the next layer.
+	setfattr -x "security.capability" "$ROOTFS/cap_v2"
+
+	# Repack the image.
+	umoci repack --image "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack the image again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	sane_run _getfattr security.capability "$ROOTFS/cap_v2"
+	[ "$status" -ne 0 ]
+	sane_run _getfattr security.capability "$ROOTFS/cap_v3"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "0x0100000200040000000000000000000000000000" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci {un,re}pack [unicode]" {
 	# Unpack the image.
 	new_bundle_rootfs
@@ -811,3 +871,1101 @@ function teardown() {
 	layers1=$(cat "${IMAGE}/oci/blobs/sha256/$manifest1" | jq -r .layers)
 	[ "$layers0" == "$layers1" ]
 }
+
+@test "umoci repack --allow-empty" {
+	# Unpack the original image
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# --allow-empty cannot be used with --squash.
+	umoci repack --allow-empty --squash --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Repack the unmodified bundle with an empty layer.
+	umoci repack --allow-empty --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# There must be one more layer, which is empty and has a history entry.
+	manifest0=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	manifest1=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	layers0="$(jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest0")"
+	layers1="$(jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest1")"
+	[ "$layers1" -eq "$((layers0 + 1))" ]
+
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest1" | cut -d: -f2)
+	sane_run sh -c "zcat '$IMAGE/blobs/sha256/$layer' | tar -t"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	umoci stat --image "${IMAGE}:${TAG}-new" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -r '.history[-1].empty_layer')" == "null" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --mtree-jobs" {
+	# Unpack the original image
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes.
+	for i in $(seq 32); do
+		head -c 4096 /dev/urandom >"$ROOTFS/umoci-file-$i"
+	done
+	rm -rf "$ROOTFS/etc"
+
+	# An invalid number of jobs must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --mtree-jobs 0 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Repack the image serially and in parallel.
+	umoci repack --image "${IMAGE}:${TAG}-serial" --mtree-jobs 1 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci repack --image "${IMAGE}:${TAG}-parallel" --mtree-jobs 8 "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The generated layers must be identical.
+	umoci stat --image "${IMAGE}:${TAG}-serial" --json
+	[ "$status" -eq 0 ]
+	layerSerial="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+
+	umoci stat --image "${IMAGE}:${TAG}-parallel" --json
+	[ "$status" -eq 0 ]
+	layerParallel="$(echo "$output" | jq -SMr '.history[-1].layer.digest')"
+
+	[[ "$layerSerial" != "null" ]]
+	[[ "$layerSerial" == "$layerParallel" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --mtree-cache" {
+	# Unpack the original image
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Repack with the cache, which should create it.
+	echo "first" >"$ROOTFS/umoci-cache-file"
+	umoci repack --image "${IMAGE}:${TAG}-first" --refresh-bundle --mtree-cache "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ -f "$BUNDLE/umoci-mtree-cache.json" ]
+	sane_run jq -SMr '.version' "$BUNDLE/umoci-mtree-cache.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "1" ]]
+
+	# Changes must still be picked up when the cache is used.
+	echo "second" >"$ROOTFS/umoci-cache-file"
+	umoci diff --mtree-cache "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep -P '^M\tumoci-cache-file$'
+
+	# A corrupt cache is ignored.
+	echo "garbage" >"$BUNDLE/umoci-mtree-cache.json"
+	umoci repack --image "${IMAGE}:${TAG}-second" --mtree-cache "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must contain the change.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-second" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/umoci-cache-file")" == "second" ]]
+	[ ! -e "$BUNDLE/umoci-mtree-cache.json" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --perm-policy" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some files with offending permissions.
+	mkdir "$ROOTFS/policy"
+	echo "world writeable" > "$ROOTFS/policy/file"
+	echo "group writeable" > "$ROOTFS/policy/exec"
+	chmod 0777 "$ROOTFS/policy"
+	chmod 0666 "$ROOTFS/policy/file"
+	chmod 0775 "$ROOTFS/policy/exec"
+
+	# Invalid policies must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --perm-policy "no-such-rule" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Repack with the policy, and make sure the adjustments are reported.
+	umoci --log=info repack --image "${IMAGE}:${TAG}-new" --perm-policy "no-group-write,no-other-write" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	echo "$output" | grep "perm-policy: adjusted mode of policy/file"
+	echo "$output" | grep "perm-policy: adjusted mode of policy/exec"
+
+	# The bundle itself must be unmodified.
+	[[ "$(stat -c '%a' "$ROOTFS/policy/file")" == "666" ]]
+
+	# Unpack the new image and check the permissions.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	[[ "$(stat -c '%a' "$ROOTFS/policy")" == "755" ]]
+	[[ "$(stat -c '%a' "$ROOTFS/policy/file")" == "644" ]]
+	[[ "$(stat -c '%a' "$ROOTFS/policy/exec")" == "755" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [index]" {
+	# Replace the tag with an index containing the manifest twice, once for
+	# any platform and once for a platform we will never run on.
+	manifest=$(jq -c '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | del(.annotations)' "$IMAGE/index.json")
+	jq -n --argjson m "$manifest" '{"schemaVersion": 2, "manifests": [$m, ($m + {"platform": {"os": "plan9", "architecture": "386"}})]}' >"$UMOCI_TMPDIR/index-blob.json"
+	index=$(sha256sum "$UMOCI_TMPDIR/index-blob.json" | cut -d' ' -f1)
+	indexSize=$(stat -c '%s' "$UMOCI_TMPDIR/index-blob.json")
+	mv "$UMOCI_TMPDIR/index-blob.json" "$IMAGE/blobs/sha256/$index"
+	jq '(.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'")) |= (.mediaType = "application/vnd.oci.image.index.v1+json" | .digest = "sha256:'"$index"'" | .size = '"$indexSize"')' "$IMAGE/index.json" >"$UMOCI_TMPDIR/index.json"
+	mv "$UMOCI_TMPDIR/index.json" "$IMAGE/index.json"
+	image-verify "${IMAGE}"
+
+	# Unpack and modify the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "new file" > "$ROOTFS/newfile"
+
+	# Repack the image under a new tag.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new tag must be an index, with only the first entry modified.
+	newIndex=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	[[ "$(jq -r '.manifests | length' "$IMAGE/blobs/sha256/$newIndex")" == "2" ]]
+	[[ "$(jq -r '.manifests[0].digest' "$IMAGE/blobs/sha256/$newIndex")" != "$(jq -r '.digest' <<<"$manifest")" ]]
+	[[ "$(jq -c '.manifests[1]' "$IMAGE/blobs/sha256/$newIndex")" == "$(jq -c '.manifests[1]' "$IMAGE/blobs/sha256/$index")" ]]
+
+	# Unpack it again.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/newfile" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --mtime" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some files.
+	mkdir "$ROOTFS/reproducible"
+	echo "some contents" > "$ROOTFS/reproducible/file"
+
+	# Invalid times must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --mtime "not a time" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Repack twice, changing the mtimes in between. The default created_by
+	# includes the tag name, so it is set explicitly.
+	touch -d "2020-01-01T00:00:00Z" "$ROOTFS/reproducible/file"
+	umoci repack --image "${IMAGE}:${TAG}-a" --mtime "2019-01-01T00:00:00Z" --history.created_by "repack" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	touch -d "2021-01-01T00:00:00Z" "$ROOTFS/reproducible/file"
+	umoci repack --image "${IMAGE}:${TAG}-b" --mtime "2019-01-01T00:00:00Z" --history.created_by "repack" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The layers and history must be identical.
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	statA="$output"
+	umoci stat --image "${IMAGE}:${TAG}-b" --json
+	[ "$status" -eq 0 ]
+	statB="$output"
+	[[ "$statA" == "$statB" ]]
+	[[ "$(jq -r '.history[-1].created' <<<"$statA")" == "2019-01-01T00:00:00Z" ]]
+
+	manifestA=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-a"'") | .digest' "$IMAGE/index.json")
+	manifestB=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-b"'") | .digest' "$IMAGE/index.json")
+	[[ "$manifestA" == "$manifestB" ]]
+
+	# SOURCE_DATE_EPOCH is used if --mtime is not given.
+	touch -d "2022-01-01T00:00:00Z" "$ROOTFS/reproducible/file"
+	SOURCE_DATE_EPOCH="$(date -d "2019-01-01T00:00:00Z" +%s)" umoci repack --image "${IMAGE}:${TAG}-c" --history.created_by "repack" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifestC=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-c"'") | .digest' "$IMAGE/index.json")
+	[[ "$manifestA" == "$manifestC" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --created" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	mkdir "$ROOTFS/reproducible"
+	echo "some contents" > "$ROOTFS/reproducible/file"
+
+	# Invalid times must be rejected.
+	umoci repack --image "${IMAGE}:${TAG}-bad" --created "not a time" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# Repack twice, changing the mtimes in between. --created must also be
+	# used for clamping the mtimes and for the history entry. The default
+	# created_by includes the tag name, so it is set explicitly.
+	touch -d "2020-01-01T00:00:00Z" "$ROOTFS/reproducible/file"
+	umoci repack --image "${IMAGE}:${TAG}-a" --created "2019-01-01T00:00:00Z" --history.created_by "repack" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	touch -d "2021-01-01T00:00:00Z" "$ROOTFS/reproducible/file"
+	umoci repack --image "${IMAGE}:${TAG}-b" --created "2019-01-01T00:00:00Z" --history.created_by "repack" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifestA=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-a"'") | .digest' "$IMAGE/index.json")
+	manifestB=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-b"'") | .digest' "$IMAGE/index.json")
+	[[ "$manifestA" == "$manifestB" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}-a" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -r '.history[-1].created' <<<"$output")" == "2019-01-01T00:00:00Z" ]]
+
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/${manifestA#sha256:}" | cut -d: -f2)
+	sane_run jq -SMr '.created' "$IMAGE/blobs/sha256/$config"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "2019-01-01T00:00:00Z" ]]
+
+	# The gzip header of the new layer must not contain a timestamp.
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/${manifestA#sha256:}" | cut -d: -f2)
+	[[ "$(od -An -tx1 -j4 -N4 "$IMAGE/blobs/sha256/$layer" | tr -d ' ')" == "00000000" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --non-distributable" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create some proprietary content.
+	echo "proprietary" > "$ROOTFS/proprietary"
+
+	umoci repack --non-distributable --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Only the new layer must be non-distributable.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	[[ "$(jq -r '.layers[-1].mediaType' "$IMAGE/blobs/sha256/$manifest")" == "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip" ]]
+	[[ "$(jq -r '.layers[:-1][] | .mediaType' "$IMAGE/blobs/sha256/$manifest" | grep -c nondistributable)" -eq 0 ]]
+
+	# The rootfs.diff_ids must still match the layers.
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	[[ "$(jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest")" == "$(jq -r '.rootfs.diff_ids | length' "$IMAGE/blobs/sha256/$config")" ]]
+
+	# Unpack the new image and make sure the content is there.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/proprietary")" == "proprietary" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --compress" {
+	# Invalid algorithms must be rejected.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	umoci repack --compress "lzma" --image "${IMAGE}:${TAG}-bad" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	for compress in gzip zstd none; do
+		case "$compress" in
+		gzip) mediaType="application/vnd.oci.image.layer.v1.tar+gzip" ;;
+		zstd) mediaType="application/vnd.oci.image.layer.v1.tar+zstd" ;;
+		none) mediaType="application/vnd.oci.image.layer.v1.tar" ;;
+		esac
+
+		# Unpack the image and create a file.
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		echo "compressed with $compress" > "$ROOTFS/compressed"
+
+		umoci repack --compress "$compress" --image "${IMAGE}:${TAG}-$compress" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+
+		manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-$compress"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+		[[ "$(jq -r '.layers[-1].mediaType' "$IMAGE/blobs/sha256/$manifest")" == "$mediaType" ]]
+
+		# Make sure the layer round-trips.
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}-$compress" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		[[ "$(cat "$ROOTFS/compressed")" == "compressed with $compress" ]]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --compress-level" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Out-of-range and invalid levels must be rejected.
+	for level in 0 10 -1 fast; do
+		umoci repack --compress-level "$level" --image "${IMAGE}:${TAG}-bad" "$BUNDLE"
+		[ "$status" -ne 0 ]
+	done
+	# Levels only make sense for gzip.
+	umoci repack --compress zstd --compress-level 1 --image "${IMAGE}:${TAG}-bad" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	for level in 1 9 default; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		echo "compressed with level $level" > "$ROOTFS/compressed"
+
+		umoci repack --compress-level "$level" --image "${IMAGE}:${TAG}-$level" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+
+		# Make sure the layer round-trips.
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}-$level" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		[[ "$(cat "$ROOTFS/compressed")" == "compressed with level $level" ]]
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --compress-jobs" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Invalid numbers of jobs must be rejected.
+	for jobs in 0 -1; do
+		umoci repack --compress-jobs "$jobs" --image "${IMAGE}:${TAG}-bad" "$BUNDLE"
+		[ "$status" -ne 0 ]
+	done
+	umoci repack --compress none --compress-jobs 2 --image "${IMAGE}:${TAG}-bad" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	image-verify "${IMAGE}"
+
+	# The layer must not depend on the number of jobs.
+	dd if=/dev/urandom of="$ROOTFS/random" bs=1M count=2
+	for jobs in 1 8; do
+		umoci repack --compress-jobs "$jobs" --image "${IMAGE}:${TAG}-$jobs" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+	umoci stat --image "${IMAGE}:${TAG}-1" --json
+	[ "$status" -eq 0 ]
+	layer1="$(echo "$output" | jq -r '.history[-1].layer.digest')"
+	umoci stat --image "${IMAGE}:${TAG}-8" --json
+	[ "$status" -eq 0 ]
+	layer8="$(echo "$output" | jq -r '.history[-1].layer.digest')"
+	[[ "$layer1" == "$layer8" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --no-clobber" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	echo "new file" > "$ROOTFS/new-file"
+
+	oldManifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json")
+
+	# Repacking onto an existing tag must fail and leave the tag untouched.
+	umoci repack --no-clobber --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"refusing to clobber existing tag"* ]]
+	image-verify "${IMAGE}"
+	[[ "$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json")" == "$oldManifest" ]]
+
+	# A new tag is fine.
+	umoci repack --no-clobber --image "${IMAGE}:${TAG}-noclobber" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Without --no-clobber the tag is replaced, and the old digest is logged.
+	umoci repack --image "${IMAGE}:${TAG}-noclobber" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"replacing existing tag"*"tag=${TAG}-noclobber"* ]]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --squash" {
+	# Unpack the image.
+	new_bundle_rootfs && BUNDLE_A="$BUNDLE" ROOTFS_A="$ROOTFS"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes, including removing files from the lower layers.
+	echo "squashed" > "$ROOTFS/squashed"
+	rm -rf "$ROOTFS/etc"
+
+	umoci repack --squash --image "${IMAGE}:${TAG}-squashed" --history.comment "squashed image" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# There must be a single layer and history entry.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-squashed"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	[[ "$(jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest")" == 1 ]]
+	[[ "$(jq -r '.rootfs.diff_ids | length' "$IMAGE/blobs/sha256/$config")" == 1 ]]
+	[[ "$(jq -r '.history | length' "$IMAGE/blobs/sha256/$config")" == 1 ]]
+	[[ "$(jq -r '.history[0].comment' "$IMAGE/blobs/sha256/$config")" == "squashed image" ]]
+
+	# Unpack the squashed image, and make sure it has the same rootfs.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-squashed" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/squashed")" == "squashed" ]]
+	! [ -e "$ROOTFS/etc" ]
+
+	gomtree -p "$ROOTFS_A" -f "$BUNDLE"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [opaque whiteout]" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Replace all of the contents of a directory.
+	rm -rf "$ROOTFS/etc"
+	mkdir "$ROOTFS/etc"
+	echo "new contents" > "$ROOTFS/etc/new"
+
+	umoci repack --image "${IMAGE}:${TAG}-opaque" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new layer must use an opaque whiteout rather than a whiteout for
+	# each of the old entries.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-opaque"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	sane_run tar -tzf "$IMAGE/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"etc/.wh..wh..opq"* ]]
+	! [[ "$output" == *"etc/.wh.group"* ]]
+
+	# Make sure the old contents are gone after unpacking.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-opaque" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(ls "$ROOTFS/etc")" == "new" ]]
+	[[ "$(cat "$ROOTFS/etc/new")" == "new contents" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --exclude" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes, including some transient build artifacts.
+	echo "new file" > "$ROOTFS/etc/new-file"
+	mkdir -p "$ROOTFS/.git" "$ROOTFS/src/.git" "$ROOTFS/var/cache/build"
+	echo "ref: refs/heads/master" > "$ROOTFS/.git/HEAD"
+	echo "ref: refs/heads/master" > "$ROOTFS/src/.git/HEAD"
+	echo "some output" > "$ROOTFS/etc/build.log"
+	echo "cached" > "$ROOTFS/var/cache/build/object"
+	rm "$ROOTFS/etc/group" "$ROOTFS/etc/passwd"
+
+	# Invalid patterns are rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --exclude '[' "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --exclude .git --exclude '*.log' --exclude var/cache/build --exclude /etc/passwd "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Check the contents of the new layer.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	sane_run tar -tzf "$IMAGE/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"etc/new-file"* ]]
+	[[ "$output" == *"etc/.wh.group"* ]]
+	! [[ "$output" == *".git"* ]]
+	! [[ "$output" == *"build.log"* ]]
+	! [[ "$output" == *"var/cache/build"* ]]
+	! [[ "$output" == *"etc/.wh.passwd"* ]]
+
+	# Excluded deletions are not applied to the new image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/etc/new-file" ]
+	[ -f "$ROOTFS/etc/passwd" ]
+	! [ -e "$ROOTFS/etc/group" ]
+	! [ -e "$ROOTFS/.git" ]
+	! [ -e "$ROOTFS/src/.git" ]
+	! [ -e "$ROOTFS/etc/build.log" ]
+	! [ -e "$ROOTFS/var/cache/build" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --include" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Make some changes, only some of which should end up in the image.
+	mkdir -p "$ROOTFS/opt/app/lib" "$ROOTFS/var/cache/build"
+	echo "binary" > "$ROOTFS/opt/app/app"
+	echo "library" > "$ROOTFS/opt/app/lib/lib.so"
+	echo "debug" > "$ROOTFS/opt/app/lib/lib.so.log"
+	echo "config" > "$ROOTFS/etc/app.conf"
+	echo "cached" > "$ROOTFS/var/cache/build/object"
+	rm "$ROOTFS/etc/group"
+
+	# Invalid patterns are rejected.
+	umoci repack --image "${IMAGE}:${TAG}-new" --include '[' "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --include /opt/app --include '*.conf' --exclude '*.log' "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Check the contents of the new layer.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	sane_run tar -tzf "$IMAGE/blobs/sha256/$layer"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"opt/app/app"* ]]
+	[[ "$output" == *"opt/app/lib/lib.so"* ]]
+	[[ "$output" == *"etc/app.conf"* ]]
+	! [[ "$output" == *"lib.so.log"* ]]
+	! [[ "$output" == *"var/cache"* ]]
+	! [[ "$output" == *"etc/.wh.group"* ]]
+
+	# Changes which were not included are not applied to the new image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/opt/app/app" ]
+	[ -f "$ROOTFS/opt/app/lib/lib.so" ]
+	[ -f "$ROOTFS/etc/app.conf" ]
+	[ -f "$ROOTFS/etc/group" ]
+	! [ -e "$ROOTFS/opt/app/lib/lib.so.log" ]
+	! [ -e "$ROOTFS/var/cache/build" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --sparse" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create a large sparse file.
+	truncate -s 256M "$ROOTFS/disk.img"
+	echo "some data" | dd of="$ROOTFS/disk.img" bs=1M seek=128 conv=notrunc
+	sha256sum "$ROOTFS/disk.img" | awk '{ print $1 }' > "$UMOCI_TMPDIR/disk.sha256"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" --sparse "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The layer only contains the data regions of the file.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	size="$(jq -r '.layers[-1].size' "$IMAGE/blobs/sha256/$manifest")"
+	[ "$size" -lt $((1024 * 1024)) ]
+
+	# The file is extracted with the same contents, and with --sparse it is
+	# still sparse.
+	for flags in "" "--sparse"; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}-new" $flags "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		[[ "$(sha256sum "$ROOTFS/disk.img" | awk '{ print $1 }')" == "$(cat "$UMOCI_TMPDIR/disk.sha256")" ]]
+	done
+	[ "$(du -k "$ROOTFS/disk.img" | cut -f1)" -lt 1024 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --dry-run" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	cp "$IMAGE/index.json" "$UMOCI_TMPDIR/index.json"
+	nblobs="$(ls "$IMAGE/blobs/sha256" | wc -l)"
+
+	# Without any changes, --dry-run exits with a distinct status.
+	umoci repack --dry-run --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 2 ]
+
+	# --dry-run cannot be combined with options that modify the image.
+	umoci repack --dry-run --squash --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --dry-run --refresh-bundle --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Make some changes.
+	echo "new file" > "$ROOTFS/etc/new-file"
+	rm "$ROOTFS/etc/group"
+
+	umoci --log=info repack --dry-run --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"would create new tag"*"tag=${TAG}-new"* ]]
+	digest="$(echo "$output" | grep -o 'digest=sha256:[0-9a-f]*' | cut -d= -f2)"
+	[ -n "$digest" ]
+
+	# Neither the index nor the blobs were modified.
+	sane_run diff -u "$UMOCI_TMPDIR/index.json" "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[ "$(ls "$IMAGE/blobs/sha256" | wc -l)" -eq "$nblobs" ]
+	! [ -e "$IMAGE/blobs/sha256/${digest#sha256:}" ]
+
+	# The real repack must produce the same layer.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest")
+	[[ "$layer" == "$digest" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --timeout" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "new file" > "$ROOTFS/etc/new-file"
+	cp "$IMAGE/index.json" "$UMOCI_TMPDIR/index.json"
+	nblobs="$(ls "$IMAGE/blobs/sha256" | wc -l)"
+
+	# Invalid timeouts are rejected.
+	umoci repack --timeout -1s --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --timeout invalid --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# A repack which times out must not modify the image.
+	umoci repack --timeout 1ns --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"deadline exceeded"* ]]
+	sane_run diff -u "$UMOCI_TMPDIR/index.json" "$IMAGE/index.json"
+	[ "$status" -eq 0 ]
+	[ "$(ls "$IMAGE/blobs/sha256" | wc -l)" -eq "$nblobs" ]
+	image-verify "${IMAGE}"
+
+	# With a reasonable timeout the repack succeeds.
+	umoci repack --timeout 10m --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --base" {
+	BUNDLE_A="$(setup_tmpdir)"
+	BUNDLE_B="$(setup_tmpdir)"
+
+	# Create an image with an extra layer on top of the original image.
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+	echo "extended" > "$BUNDLE_A/rootfs/etc/extended"
+	umoci repack --image "${IMAGE}:${TAG}-extended" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Create an image which doesn't contain the original layers.
+	umoci new --image "${IMAGE}:${TAG}-empty"
+	[ "$status" -eq 0 ]
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+	echo "new file" > "$BUNDLE_B/rootfs/etc/new-file"
+
+	# Invalid or incompatible bases are rejected.
+	umoci repack --base "" --image "${IMAGE}:${TAG}-rebased" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+	umoci repack --base "${TAG}-nonexistent" --image "${IMAGE}:${TAG}-rebased" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+	umoci repack --base "${TAG}-empty" --image "${IMAGE}:${TAG}-rebased" "$BUNDLE_B"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"not compatible with bundle"* ]]
+	image-verify "${IMAGE}"
+
+	# Repack onto the extended image.
+	umoci repack --base "${TAG}-extended" --image "${IMAGE}:${TAG}-rebased" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The new image has the layers of the base, followed by the new layer.
+	extended=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-extended"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	rebased=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-rebased"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -r '.layers | length' "$IMAGE/blobs/sha256/$extended"
+	nlayers="$output"
+	sane_run jq -r '.layers | length' "$IMAGE/blobs/sha256/$rebased"
+	[ "$output" -eq "$((nlayers + 1))" ]
+	sane_run diff -u <(jq '.layers' "$IMAGE/blobs/sha256/$extended") <(jq ".layers[:$nlayers]" "$IMAGE/blobs/sha256/$rebased")
+	[ "$status" -eq 0 ]
+
+	# Both the changes from the base and the bundle are in the new image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-rebased" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -f "$ROOTFS/etc/extended" ]
+	[ -f "$ROOTFS/etc/new-file" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --manifest.annotation" {
+	umoci config --image "${IMAGE}:${TAG}" --manifest.annotation="keep=value" --manifest.annotation="replace=old"
+	[ "$status" -eq 0 ]
+
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Invalid annotations must be rejected.
+	umoci repack --manifest.annotation "noequals" --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --layer-annotation "=value" --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --config.label "noequals" --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	echo "new file" > "$ROOTFS/etc/new-file"
+	umoci repack --image "${IMAGE}:${TAG}-new" \
+		--manifest.annotation "replace=new" \
+		--manifest.annotation "org.opencontainers.image.created=2019-01-01T00:00:00Z" \
+		--manifest.annotation "org.opencontainers.image.revision=abc123" \
+		--layer-annotation "com.example.layer=value" \
+		--config.label "com.example.label=value" \
+		"$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+
+	# The existing annotations are kept unless the same key is given.
+	sane_run jq -SMr '.annotations["keep"]' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "value" ]]
+	sane_run jq -SMr '.annotations["replace"]' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "new" ]]
+	sane_run jq -SMr '.annotations["org.opencontainers.image.created"]' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "2019-01-01T00:00:00Z" ]]
+	sane_run jq -SMr '.annotations["org.opencontainers.image.revision"]' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "abc123" ]]
+
+	# Only the new layer has the layer annotation.
+	sane_run jq -SMr '.layers[-1].annotations["com.example.layer"]' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "value" ]]
+	sane_run jq -SMr '[.layers[:-1][] | select(.annotations["com.example.layer"] != null)] | length' "$IMAGE/blobs/sha256/$manifest"
+	[ "$output" -eq 0 ]
+
+	# The label was added to the configuration.
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	sane_run jq -SMr '.config.Labels["com.example.label"]' "$IMAGE/blobs/sha256/$config"
+	[[ "$output" == "value" ]]
+
+	# With --clear-annotations only the new annotations are kept.
+	umoci repack --image "${IMAGE}:${TAG}-cleared" --clear-annotations \
+		--manifest.annotation "replace=cleared" \
+		"$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-cleared"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -SMc '.annotations' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == '{"replace":"cleared"}' ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [provenance]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The bundle records where it came from.
+	sane_run jq -SMr '.umoci_version' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "3" ]]
+	sane_run jq -SMr '.provenance.reference' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$TAG" ]]
+	sane_run jq -SMr '.provenance.mtree_keywords | length' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[ "$output" -gt 0 ]
+
+	# And repack tells us about it.
+	echo "new file" > "$BUNDLE/rootfs/etc/new-file"
+	umoci --log=info repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"repacking bundle unpacked from $TAG"* ]]
+	image-verify "${IMAGE}"
+
+	# Bundles without any provenance (from older versions) can be repacked.
+	jq -SMc '.umoci_version = "2" | del(.provenance)' "$BUNDLE/umoci.json" > "$BUNDLE/umoci.json.new"
+	mv "$BUNDLE/umoci.json.new" "$BUNDLE/umoci.json"
+	echo "another file" > "$BUNDLE/rootfs/etc/another-file"
+	umoci repack --image "${IMAGE}:${TAG}-new2" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack [mismatched mtree keywords]" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Pretend the bundle was unpacked by an older umoci which didn't record
+	# its keywords and used a different set of keywords.
+	jq -SMc '.umoci_version = "2" | del(.provenance)' "$BUNDLE/umoci.json" > "$BUNDLE/umoci.json.new"
+	mv "$BUNDLE/umoci.json.new" "$BUNDLE/umoci.json"
+	sed -i 's/^\(#[[:space:]]*keywords: .*\),xattr$/\1/' "$BUNDLE"/*.mtree
+
+	echo "new file" > "$BUNDLE/rootfs/etc/new-file"
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"bundle was created with different mtree keywords"* ]]
+	image-verify "${IMAGE}"
+
+	# The tag must not have been created.
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack [rootless mismatch]" {
+	requires root
+
+	BUNDLE="$(setup_tmpdir)"
+
+	# Unpack in rootless mode, even though we're root.
+	umoci unpack --rootless --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '.map_options.rootless' "$BUNDLE/umoci.json")" == "true" ]]
+
+	echo "new file" > "$BUNDLE/rootfs/etc/new-file"
+
+	# Repacking as root must fail without an override.
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"rootless mode is enabled but umoci is running as root"* ]]
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -ne 0 ]
+
+	# The same goes for diff.
+	umoci diff "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# --rootless and --no-rootless cannot be combined.
+	umoci repack --rootless --no-rootless --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Explicitly using the recorded mode works (with a warning).
+	umoci repack --rootless --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"rootless mode is enabled but umoci is running as root"* ]]
+	image-verify "${IMAGE}"
+}
+
+@test "umoci repack --docker-tag" {
+	BUNDLE="$(setup_tmpdir)"
+
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "new file" > "$BUNDLE/rootfs/etc/new-file"
+	umoci repack --image "${IMAGE}:${TAG}-new" --docker-tag "${TAG}-docker" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The OCI manifest is untouched.
+	umoci stat --image "${IMAGE}:${TAG}-new"
+	[ "$status" -eq 0 ]
+
+	# The docker manifest references the same config and layers.
+	ociDigest="$(jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-new"'") | .digest' "${IMAGE}/index.json")"
+	dockerDescriptor="$(jq -SMc '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-docker"'")' "${IMAGE}/index.json")"
+	[[ "$(jq -SMr '.mediaType' <<<"$dockerDescriptor")" == "application/vnd.docker.distribution.manifest.v2+json" ]]
+
+	ociManifest="${IMAGE}/blobs/${ociDigest/://}"
+	dockerManifest="${IMAGE}/blobs/$(jq -SMr '.digest | sub(":"; "/")' <<<"$dockerDescriptor")"
+	[[ "$(jq -SMr '.config.mediaType' "$dockerManifest")" == "application/vnd.docker.container.image.v1+json" ]]
+	[[ "$(jq -SMr '.config.digest' "$dockerManifest")" == "$(jq -SMr '.config.digest' "$ociManifest")" ]]
+	[[ "$(jq -SMr '[.layers[].digest]' "$dockerManifest")" == "$(jq -SMr '[.layers[].digest]' "$ociManifest")" ]]
+	[[ "$(jq -SMr '.layers[].mediaType' "$dockerManifest" | sort -u)" == "application/vnd.docker.image.rootfs.diff.tar.gzip" ]]
+
+	# Only gzip layers can be represented.
+	umoci repack --image "${IMAGE}:${TAG}-zstd" --compress zstd --docker-tag "${TAG}-docker" "$BUNDLE"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci repack --max-layer-size" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Remove an existing file and add several large ones.
+	rm -rf "$ROOTFS/etc"
+	for name in a b c; do
+		head -c 1048576 /dev/urandom > "$ROOTFS/big-$name"
+	done
+
+	# The size must be valid.
+	umoci repack --max-layer-size=bad --image "${IMAGE}:${TAG}-split" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --max-layer-size=1k --image "${IMAGE}:${TAG}-split" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci repack --max-layer-size=2MiB --squash --image "${IMAGE}:${TAG}-split" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	numLayersA="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer | not)] | length')"
+
+	# Each of the large files ends up in its own layer.
+	umoci repack --max-layer-size=1536KiB --image "${IMAGE}:${TAG}-split" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-split" --json
+	[ "$status" -eq 0 ]
+	numLayersB="$(echo "$output" | jq -SM '[.history[] | select(.empty_layer | not)] | length')"
+	[ "$numLayersB" -eq "$(($numLayersA + 3))" ]
+
+	# Unpacking the split image gives the same rootfs.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-split" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ ! -e "$ROOTFS/etc" ]
+	for name in a b c; do
+		[ -f "$ROOTFS/big-$name" ]
+	done
+}
+
+@test "umoci repack --layer-url" {
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Only http:// and https:// urls are allowed.
+	umoci repack --layer-url "ftp://example.com/layer.tar.gz" --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	echo "new file" > "$ROOTFS/etc/new-file"
+	umoci repack --image "${IMAGE}:${TAG}-new" \
+		--layer-url "https://example.com/layer.tar.gz" \
+		--layer-url "https://mirror.example.com/layer.tar.gz" \
+		"$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Only the new layer has the urls, and its blob is still in the image.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-new"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -SMr '.layers[-1].urls | join(" ")' "$IMAGE/blobs/sha256/$manifest"
+	[[ "$output" == "https://example.com/layer.tar.gz https://mirror.example.com/layer.tar.gz" ]]
+	sane_run jq -SMr '[.layers[:-1][] | select(.urls != null)] | length' "$IMAGE/blobs/sha256/$manifest"
+	[ "$output" -eq 0 ]
+	layer=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	[ -f "$IMAGE/blobs/sha256/$layer" ]
+
+	# Without the blob, unpacking fails unless the layer is fetched.
+	rm "$IMAGE/blobs/sha256/$layer"
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	[[ "$output" == *"foreign layer is not available locally"* ]]
+	[[ "$output" == *"https://example.com/layer.tar.gz"* ]]
+}
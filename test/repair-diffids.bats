@@ -0,0 +1,78 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci repair-diffids" {
+	# A correct image must not be modified.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	expectedDiffIDs="$(echo "$output" | jq -SMr '[.history[] | select(.diff_id != "") | .diff_id] | @json')"
+
+	umoci repair-diffids --image "${IMAGE}:${TAG}" --tag "${TAG}-unmodified"
+	[ "$status" -eq 0 ]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	! echo "$output" | grep -q "${TAG}-unmodified"
+
+	# Corrupt the first diff_id in the image configuration.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	jq '.rootfs.diff_ids[0] = "sha256:0000000000000000000000000000000000000000000000000000000000000000"' "$IMAGE/blobs/sha256/$config" >"$UMOCI_TMPDIR/config.json"
+	newConfig=$(sha256sum "$UMOCI_TMPDIR/config.json" | cut -d' ' -f1)
+	newConfigSize=$(stat -c '%s' "$UMOCI_TMPDIR/config.json")
+	mv "$UMOCI_TMPDIR/config.json" "$IMAGE/blobs/sha256/$newConfig"
+	jq '.config.digest = "sha256:'"$newConfig"'" | .config.size = '"$newConfigSize" "$IMAGE/blobs/sha256/$manifest" >"$UMOCI_TMPDIR/manifest.json"
+	newManifest=$(sha256sum "$UMOCI_TMPDIR/manifest.json" | cut -d' ' -f1)
+	newManifestSize=$(stat -c '%s' "$UMOCI_TMPDIR/manifest.json")
+	mv "$UMOCI_TMPDIR/manifest.json" "$IMAGE/blobs/sha256/$newManifest"
+	jq '(.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'")) |= (.digest = "sha256:'"$newManifest"'" | .size = '"$newManifestSize"')' "$IMAGE/index.json" >"$UMOCI_TMPDIR/index.json"
+	mv "$UMOCI_TMPDIR/index.json" "$IMAGE/index.json"
+
+	# The image can no longer be unpacked.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "diffid mismatch"
+
+	# Repair the image.
+	umoci repair-diffids --image "${IMAGE}:${TAG}" --tag "${TAG}-repaired"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep "replaced diff_id sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}-repaired" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SMr '[.history[] | select(.diff_id != "") | .diff_id] | @json')" == "$expectedDiffIDs" ]]
+
+	# And the repaired image can be unpacked.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-repaired" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,83 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+@test "umoci squash" {
+	# Add a few layers to the image.
+	for name in first second; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+
+		echo "$name" > "$ROOTFS/$name"
+		rm -rf "$ROOTFS/etc"
+
+		umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+	ROOTFS_A="$ROOTFS"
+
+	umoci squash --image "${IMAGE}:${TAG}" --tag "${TAG}-squashed" --history.comment "squashed image"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# There must be a single layer and history entry.
+	umoci stat --image "${IMAGE}:${TAG}-squashed" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == 1 ]]
+	[[ "$(echo "$output" | jq -r '.history[0].comment')" == "squashed image" ]]
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-squashed"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	[[ "$(jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest")" == 1 ]]
+	[[ "$(jq -r '.rootfs.diff_ids | length' "$IMAGE/blobs/sha256/$config")" == 1 ]]
+
+	# The squashed image must have the same rootfs.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-squashed" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/first")" == "first" ]]
+	[[ "$(cat "$ROOTFS/second")" == "second" ]]
+	! [ -e "$ROOTFS/etc" ]
+
+	gomtree -p "$ROOTFS_A" -f "$BUNDLE"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci squash --no-history" {
+	umoci squash --image "${IMAGE}:${TAG}" --no-history
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | jq -SM '.history | length')" == 0 ]]
+}
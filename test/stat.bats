@@ -63,6 +63,171 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci stat --chain-ids" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	# The first chain_id must be the first diff_id.
+	sane_run jq -SMr '[.history[] | select(.diff_id != "")][0] | .chain_id == .diff_id' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# Recompute the chain_ids with sha256sum and compare them.
+	sane_run jq -SMr '.history[] | select(.diff_id != "") | .diff_id' "$statFile"
+	[ "$status" -eq 0 ]
+	chainid=""
+	expected=()
+	for diffid in "${lines[@]}"; do
+		if [ -z "$chainid" ]; then
+			chainid="$diffid"
+		else
+			chainid="sha256:$(echo -n "$chainid $diffid" | sha256sum | cut -d' ' -f1)"
+		fi
+		expected+=("$chainid")
+	done
+
+	sane_run jq -SMr '.history[] | select(.diff_id != "") | .chain_id' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "${lines[*]}" == "${expected[*]}" ]]
+
+	# The plain output should include the same chain_ids.
+	umoci stat --image "${IMAGE}:${TAG}" --chain-ids
+	[ "$status" -eq 0 ]
+	echo "$output" | grep 'CHAIN ID'
+	for chainid in "${expected[@]}"; do
+		echo "$output" | grep "$chainid"
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci stat [layers]" {
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+
+	statFile="$(setup_tmpdir)/stat"
+	echo "$output" > "$statFile"
+
+	# .layers must match the layers in the manifest.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -SMr '[.layers[] | .layer.digest]' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$(jq -SMr '[.layers[] | .digest]' "$IMAGE/blobs/sha256/$manifest")" == "$output" ]]
+
+	# Each layer with a history entry must refer to the same layer.
+	sane_run jq -SMr '. as $s | [.layers[] | select(.history >= 0) | $s.history[.history].layer.digest == .layer.digest] | all' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# The totals must add up.
+	sane_run jq -SMr '([.layers[] | .layer.size] | add) == .layers_size' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+	sane_run jq -SMr '.size > .layers_size' "$statFile"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# The plain output should include the layer breakdown.
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep 'MEDIA TYPE'
+	echo "$output" | grep 'TOTAL:'
+	for digest in $(jq -r '.layers[].digest' "$IMAGE/blobs/sha256/$manifest"); do
+		echo "$output" | grep "$digest"
+	done
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci stat [index]" {
+	# Replace the tag with an index containing the manifest for two platforms.
+	manifest=$(jq -c '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | del(.annotations)' "$IMAGE/index.json")
+	jq -n --argjson m "$manifest" '{"schemaVersion": 2, "manifests": [($m + {"platform": {"os": "linux", "architecture": "amd64"}}), ($m + {"platform": {"os": "plan9", "architecture": "386"}})]}' >"$UMOCI_TMPDIR/index-blob.json"
+	index=$(sha256sum "$UMOCI_TMPDIR/index-blob.json" | cut -d' ' -f1)
+	indexSize=$(stat -c '%s' "$UMOCI_TMPDIR/index-blob.json")
+	mv "$UMOCI_TMPDIR/index-blob.json" "$IMAGE/blobs/sha256/$index"
+	jq '(.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'")) |= (.mediaType = "application/vnd.oci.image.index.v1+json" | .digest = "sha256:'"$index"'" | .size = '"$indexSize"')' "$IMAGE/index.json" >"$UMOCI_TMPDIR/index.json"
+	mv "$UMOCI_TMPDIR/index.json" "$IMAGE/index.json"
+	image-verify "${IMAGE}"
+
+	# Without --platform, every manifest is shown.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -r 'length' <<<"$output")" == "2" ]]
+	[[ "$(jq -r '[.[] | .platform.os] | sort | join(",")' <<<"$output")" == "linux,plan9" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	[[ "$(echo "$output" | grep -c '^MANIFEST:')" == "2" ]]
+	echo "$output" | grep 'PLATFORM: linux/amd64'
+	echo "$output" | grep 'PLATFORM: plan9/386'
+
+	# With --platform, only the matching manifest is shown.
+	umoci stat --image "${IMAGE}:${TAG}" --platform plan9/386 --json
+	[ "$status" -eq 0 ]
+	[[ "$(jq -r '.platform.os' <<<"$output")" == "plan9" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --platform windows/amd64
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}" --platform invalid
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci stat --format" {
+	# Set up some configuration to inspect.
+	umoci config --image "${IMAGE}:${TAG}" --config.env "UMOCI_STAT=yes" --config.label "org.opensuse.umoci=stat" --config.entrypoint "/bin/umoci-stat"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --format json is the same as --json.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	jsonOutput="$output"
+	umoci stat --image "${IMAGE}:${TAG}" --format json
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$jsonOutput" ]]
+
+	# The configuration is included in the JSON output.
+	[[ "$(jq -r '.config.Env | index("UMOCI_STAT=yes") != null' <<<"$jsonOutput")" == "true" ]]
+	[[ "$(jq -r '.config.Labels["org.opensuse.umoci"]' <<<"$jsonOutput")" == "stat" ]]
+	[[ "$(jq -r '.config.Entrypoint[0]' <<<"$jsonOutput")" == "/bin/umoci-stat" ]]
+	[[ "$(jq -r '.manifest.mediaType' <<<"$jsonOutput")" == "application/vnd.oci.image.manifest.v1+json" ]]
+
+	# Templates are executed with the stat information.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{index .Config.Labels "org.opensuse.umoci"}} {{json .Config.Entrypoint}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == 'stat ["/bin/umoci-stat"]' ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{range .Layers}}{{.Layer.Digest}}{{"\n"}}{{end}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(jq -r '.layers[] | .layer.digest' <<<"$jsonOutput")" ]]
+
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.Size}}'
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$(jq -r '.size' <<<"$jsonOutput")" ]]
+
+	# The default output includes the configuration.
+	umoci stat --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep 'ENTRYPOINT: *\["/bin/umoci-stat"\]'
+	echo "$output" | grep 'LABEL: *org.opensuse.umoci=stat'
+
+	# Invalid templates and combinations must fail.
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.Config'
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}" --format '{{.DoesNotExist}}'
+	[ "$status" -ne 0 ]
+	umoci stat --image "${IMAGE}:${TAG}" --format json --json
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci stat [missing args]" {
 	umoci stat
 	[ "$status" -ne 0 ]
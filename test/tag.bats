@@ -50,6 +50,29 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci list --long" {
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	nrefs="${#lines[@]}"
+
+	umoci ls --long --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ "${#lines[@]}" -eq "$nrefs" ]
+
+	# Each line must match the descriptor in index.json.
+	umoci ls -l --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	for line in "${lines[@]}"; do
+		read -r name digest size platforms <<<"$line"
+		sane_run jq -SMr '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$name"'") | "\(.digest) \(.size)"' "$IMAGE/index.json"
+		[ "$status" -eq 0 ]
+		[[ "$output" == "$digest $size" ]]
+		[[ "$platforms" == */* ]]
+	done
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci list [missing args]" {
 	umoci ls
 	[ "$status" -ne 0 ]
@@ -129,6 +152,34 @@ function teardown() {
 	image-verify "${IMAGE}"
 }
 
+@test "umoci tag --no-clobber" {
+	# Make a copy of the tag.
+	umoci tag --no-clobber --image "${IMAGE}:${TAG}" "${TAG}-newtag"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Modify the configuration.
+	umoci config --author="Someone" --image "${IMAGE}:${TAG}-newtag"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	umoci stat --image "${IMAGE}:${TAG}-newtag" --json
+	[ "$status" -eq 0 ]
+	oldOutput="$output"
+
+	# Clobbering the tag must fail.
+	umoci tag --no-clobber --image "${IMAGE}:${TAG}" "${TAG}-newtag"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "refusing to clobber existing tag"
+	image-verify "${IMAGE}"
+
+	# And the tag must be unchanged.
+	umoci stat --image "${IMAGE}:${TAG}-newtag" --json
+	[ "$status" -eq 0 ]
+	[[ "$oldOutput" == "$output" ]]
+
+	image-verify "${IMAGE}"
+}
+
 @test "umoci remove" {
 	# How many tags?
 	umoci list --layout "${IMAGE}"
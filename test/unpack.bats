@@ -71,6 +71,19 @@ function teardown() {
 	[ "$status" -ne 0 ]
 }
 
+@test "umoci unpack [invalid url]" {
+	# Nothing is listening on this port, so the fetch must fail.
+	new_bundle_rootfs
+	umoci unpack --image="http://127.0.0.1:1/image.tar:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -e "$BUNDLE/rootfs" ]
+
+	# Invalid headers are rejected.
+	umoci unpack --image="http://127.0.0.1:1/image.tar:${TAG}" --http-header "not a header" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -e "$BUNDLE/rootfs" ]
+}
+
 @test "umoci unpack [config.json contains mount namespace]" {
 	# Unpack the image.
 	new_bundle_rootfs
@@ -313,3 +326,469 @@ function teardown() {
 	[ "$(readlink "$ROOTFS/loop3")" = "link2/loop4" ]
 	[ "$(readlink "$ROOTFS/dir/loop4")" = "../loop1" ]
 }
+
+@test "umoci unpack --follow-symlinks" {
+	# Unpack the image.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Create a symlink for the next layer to write through.
+	mkdir "$ROOTFS/target"
+	echo "original" >"$ROOTFS/target/file"
+	ln -s target "$ROOTFS/link"
+
+	# Repack the image.
+	umoci repack --refresh-bundle --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "$IMAGE"
+
+	# Create a layer which contains an entry inside the symlink.
+	ROOTFS="$(setup_tmpdir)"
+	mkdir "$ROOTFS/link"
+	echo "overwritten" >"$ROOTFS/link/file"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer1.tar" "$ROOTFS" ./link/file
+	[ "$status" -eq 0 ]
+
+	umoci raw add-layer --image "${IMAGE}:${TAG}" "$UMOCI_TMPDIR/layer1.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# By default, unpacking refuses to follow the symlink.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "refusing to follow symlink"
+
+	# ... but it can be explicitly allowed.
+	new_bundle_rootfs
+	umoci unpack --follow-symlinks --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[ -L "$ROOTFS/link" ]
+	[[ "$(cat "$ROOTFS/target/file")" == "overwritten" ]]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --jobs" {
+	# Unpack the image serially.
+	new_bundle_rootfs
+	BUNDLE_A="$BUNDLE"
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE_A"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_A"
+
+	# Unpack the image with several jobs.
+	new_bundle_rootfs
+	BUNDLE_B="$BUNDLE"
+	umoci unpack --jobs 4 --image "${IMAGE}:${TAG}" "$BUNDLE_B"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_B"
+
+	# The root filesystems must be identical.
+	gomtree -p "$BUNDLE_B/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# No temporary files are left in the bundle.
+	! ls -A "$BUNDLE_B" | grep -q "^\.umoci-unpack-"
+
+	# --parallel is an alias for --jobs.
+	new_bundle_rootfs
+	BUNDLE_C="$BUNDLE"
+	umoci unpack --parallel 4 --image "${IMAGE}:${TAG}" "$BUNDLE_C"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE_C"
+	gomtree -p "$BUNDLE_C/rootfs" -f "$BUNDLE_A"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# --jobs must be positive.
+	new_bundle_rootfs
+	umoci unpack --jobs 0 --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --parallel 0 --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --strict-spec" {
+	# A normal image is fully supported.
+	new_bundle_rootfs
+	umoci unpack --strict-spec --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# Add a foreign layer (which we don't have a copy of) to the manifest.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	jq '.layers += [{"mediaType": "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip", "digest": "sha256:0000000000000000000000000000000000000000000000000000000000000000", "size": 1234, "urls": ["https://example.com/layer.tar.gz"]}]' "$IMAGE/blobs/sha256/$manifest" >"$UMOCI_TMPDIR/manifest.json"
+	newManifest=$(sha256sum "$UMOCI_TMPDIR/manifest.json" | cut -d' ' -f1)
+	newSize=$(stat -c '%s' "$UMOCI_TMPDIR/manifest.json")
+	mv "$UMOCI_TMPDIR/manifest.json" "$IMAGE/blobs/sha256/$newManifest"
+	jq '(.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'")) |= (.digest = "sha256:'"$newManifest"'" | .size = '"$newSize"')' "$IMAGE/index.json" >"$UMOCI_TMPDIR/index.json"
+	mv "$UMOCI_TMPDIR/index.json" "$IMAGE/index.json"
+
+	# --strict-spec must refuse the image up-front, listing the problems.
+	new_bundle_rootfs
+	umoci unpack --strict-spec --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "foreign layer is not available locally"
+	echo "$output" | grep "number of layers"
+	! [ -d "$ROOTFS" ]
+
+	# Other image commands also support --strict-spec.
+	umoci stat --strict-spec --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "foreign layer is not available locally"
+}
+
+@test "umoci unpack --base" {
+	# Create a new image with some changes.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "umoci unpack --base test" > "$ROOTFS/newfile"
+	chmod +w "$ROOTFS/etc/." && echo "modified passwd" > "$ROOTFS/etc/passwd"
+	rm -f "$ROOTFS/etc/group"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# Unpack only the changes.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" --base "${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[ -f "$BUNDLE/config.json" ]
+
+	# Only the changed files (and whiteouts) must be present.
+	[[ "$(cat "$ROOTFS/newfile")" == "umoci unpack --base test" ]]
+	[[ "$(cat "$ROOTFS/etc/passwd")" == "modified passwd" ]]
+	[ -f "$ROOTFS/etc/.wh.group" ]
+	! [ -s "$ROOTFS/etc/.wh.group" ]
+	! [ -e "$ROOTFS/etc/group" ]
+	! [ -e "$ROOTFS/bin/sh" ]
+
+	# The bundle must be marked as a delta extraction.
+	sane_run jq -r '.base_descriptor_path.descriptor_walk[0].digest' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "sha256:"* ]]
+
+	# ... and thus cannot be repacked.
+	umoci repack --image "${IMAGE}:${TAG}-bad" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci ls --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[[ "$output" != *"${TAG}-bad"* ]]
+
+	# Unknown base tags must fail.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" --base "does-not-exist" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -d "$ROOTFS" ]
+}
+
+@test "umoci unpack --base --whiteout-mode=overlayfs" {
+	# Overlay whiteouts can only be created by root.
+	requires root
+
+	# Create a new image with some changes.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	echo "umoci unpack --whiteout-mode test" > "$ROOTFS/newfile"
+	rm -f "$ROOTFS/etc/group"
+
+	umoci repack --image "${IMAGE}:${TAG}-new" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# --whiteout-mode is only valid with --base.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-new" --whiteout-mode=overlayfs "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}-new" --base "${TAG}" --whiteout-mode=bogus "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	# Removed files are represented as overlayfs whiteouts.
+	umoci unpack --image "${IMAGE}:${TAG}-new" --base "${TAG}" --whiteout-mode=overlayfs "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(cat "$ROOTFS/newfile")" == "umoci unpack --whiteout-mode test" ]]
+	[ -c "$ROOTFS/etc/group" ]
+	[[ "$(stat -c '%t:%T' "$ROOTFS/etc/group")" == "0:0" ]]
+	! [ -e "$ROOTFS/etc/.wh.group" ]
+}
+
+@test "umoci unpack --symlink-policy" {
+	# Create a layer with a variety of symlinks.
+	LAYER="$(setup_tmpdir)"
+	mkdir -p "$LAYER/etc" "$LAYER/usr/lib"
+	echo "os-release" > "$LAYER/usr/lib/os-release"
+	ln -s ../usr/lib/os-release "$LAYER/etc/relative"
+	ln -s /usr/lib/os-release "$LAYER/etc/absolute"
+	ln -s ../../../../etc/shadow "$LAYER/etc/escape"
+	sane_run tar cvfC "$UMOCI_TMPDIR/layer.tar" "$LAYER" .
+	[ "$status" -eq 0 ]
+
+	umoci new --image "${IMAGE}:${TAG}-symlinks"
+	[ "$status" -eq 0 ]
+	umoci raw add-layer --image "${IMAGE}:${TAG}-symlinks" "$UMOCI_TMPDIR/layer.tar"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	# The default policy creates all symlinks as-is.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-symlinks" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(readlink "$ROOTFS/etc/relative")" == "../usr/lib/os-release" ]]
+	[[ "$(readlink "$ROOTFS/etc/absolute")" == "/usr/lib/os-release" ]]
+	[[ "$(readlink "$ROOTFS/etc/escape")" == "../../../../etc/shadow" ]]
+
+	# no-absolute rewrites absolute symlinks.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-symlinks" --symlink-policy=no-absolute "$BUNDLE"
+	[ "$status" -eq 0 ]
+	[[ "$(readlink "$ROOTFS/etc/relative")" == "../usr/lib/os-release" ]]
+	[[ "$(readlink "$ROOTFS/etc/absolute")" == "../usr/lib/os-release" ]]
+	[[ "$(readlink "$ROOTFS/etc/escape")" == "../../../../etc/shadow" ]]
+
+	# relative-only blocks absolute and escaping symlinks, reporting them.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-symlinks" --symlink-policy=relative-only "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep "blocked absolute symlink"
+	echo "$output" | grep "blocked symlink escaping the root"
+	[[ "$(readlink "$ROOTFS/etc/relative")" == "../usr/lib/os-release" ]]
+	! [ -L "$ROOTFS/etc/absolute" ]
+	! [ -L "$ROOTFS/etc/escape" ]
+
+	# Invalid policies are rejected.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-symlinks" --symlink-policy=some-links "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -d "$ROOTFS" ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack [oci archive]" {
+	# Create an (uncompressed) archive of the image.
+	ARCHIVE="$(setup_tmpdir)/image.tar"
+	sane_run tar -C "$IMAGE" -cf "$ARCHIVE" .
+	[ "$status" -eq 0 ]
+
+	# Read-only commands must work with the archive.
+	umoci stat --image "${ARCHIVE}:${TAG}"
+	[ "$status" -eq 0 ]
+	umoci ls --layout "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	[[ "$output" == *"$TAG"* ]]
+
+	new_bundle_rootfs && BUNDLE_A="$BUNDLE" ROOTFS_A="$ROOTFS"
+	umoci unpack --image "${ARCHIVE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+
+	# The rootfs must be the same as unpacking the image directory.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	gomtree -p "$ROOTFS_A" -f "$BUNDLE"/sha256_*.mtree
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Modifying an archive must fail, and leave it untouched.
+	oldSum="$(sha256sum "$ARCHIVE")"
+	umoci tag --image "${ARCHIVE}:${TAG}" "${TAG}-new"
+	[ "$status" -ne 0 ]
+	[[ "$(sha256sum "$ARCHIVE")" == "$oldSum" ]]
+
+	# Compressed archives are not supported.
+	sane_run gzip -k "$ARCHIVE"
+	[ "$status" -eq 0 ]
+	umoci stat --image "${ARCHIVE}.gz:${TAG}"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
+
+@test "umoci unpack --no-verify" {
+	# Create two images which each add a different file.
+	for name in good bad; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		echo "$name" >"$ROOTFS/verify-$name"
+		umoci repack --image "${IMAGE}:${TAG}-$name" "$BUNDLE"
+		[ "$status" -eq 0 ]
+	done
+	image-verify "${IMAGE}"
+
+	# Replace the top layer of one image with the top layer of the other.
+	for name in good bad; do
+		manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"${TAG}-$name"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+		declare "layer_$name=$(jq -r '.layers[-1].digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)"
+	done
+	[[ "$layer_good" != "$layer_bad" ]]
+	chmod +w "$IMAGE/blobs/sha256/$layer_good"
+	cp "$IMAGE/blobs/sha256/$layer_bad" "$IMAGE/blobs/sha256/$layer_good"
+
+	# The layer no longer matches the manifest, so unpacking must fail and
+	# include both digests.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-good" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "digest mismatch"
+	echo "$output" | grep "sha256:$layer_good"
+	echo "$output" | grep "sha256:$layer_bad"
+	! [ -e "$ROOTFS" ]
+
+	# With --no-verify the (tampered) layer is extracted, but the mismatches
+	# are still reported.
+	new_bundle_rootfs
+	umoci unpack --no-verify --image "${IMAGE}:${TAG}-good" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	echo "$output" | grep "blob digest mismatch"
+	echo "$output" | grep "diffid mismatch"
+	[ -f "$ROOTFS/verify-bad" ]
+	! [ -e "$ROOTFS/verify-good" ]
+
+	# The image is deliberately corrupted, so image-verify would fail.
+}
+
+@test "umoci unpack --upto" {
+	# Add two layers to the image.
+	for layer in first second; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+		echo "$layer" > "$ROOTFS/upto-$layer"
+		umoci repack --image "${IMAGE}:${TAG}" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		image-verify "${IMAGE}"
+	done
+
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest"
+	[ "$status" -eq 0 ]
+	nlayers="$output"
+	sane_run jq -r '.layers[-2].digest' "$IMAGE/blobs/sha256/$manifest"
+	[ "$status" -eq 0 ]
+	layer="$output"
+
+	# Invalid layers are rejected.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --upto "" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --upto 0 "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --upto "$((nlayers + 1))" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --upto "sha256:0000000000000000000000000000000000000000000000000000000000000000" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	umoci unpack --image "${IMAGE}:${TAG}" --upto 1 --base "${TAG}" "$BUNDLE"
+	[ "$status" -ne 0 ]
+	! [ -d "$ROOTFS" ]
+
+	# Unpacking up to the second-last layer (by index and by digest) doesn't
+	# include the last layer.
+	for upto in "$((nlayers - 1))" "$layer"; do
+		new_bundle_rootfs
+		umoci unpack --image "${IMAGE}:${TAG}" --upto "$upto" "$BUNDLE"
+		[ "$status" -eq 0 ]
+		bundle-verify "$BUNDLE"
+
+		[[ "$(cat "$ROOTFS/upto-first")" == "first" ]]
+		! [ -e "$ROOTFS/upto-second" ]
+
+		sane_run jq -r '.up_to_layer.digest' "$BUNDLE/umoci.json"
+		[ "$status" -eq 0 ]
+		[[ "$output" == "$layer" ]]
+	done
+
+	# Repacking drops the last layer.
+	echo "replaced" > "$ROOTFS/upto-replaced"
+	umoci repack --image "${IMAGE}:${TAG}-upto" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+
+	new_manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-upto"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	sane_run jq -r '.layers | length' "$IMAGE/blobs/sha256/$new_manifest"
+	[ "$status" -eq 0 ]
+	[ "$output" -eq "$nlayers" ]
+	sane_run jq -r '.layers[-2].digest' "$IMAGE/blobs/sha256/$new_manifest"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "$layer" ]]
+
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-upto" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/upto-first")" == "first" ]]
+	[[ "$(cat "$ROOTFS/upto-replaced")" == "replaced" ]]
+	! [ -e "$ROOTFS/upto-second" ]
+}
+
+@test "umoci unpack --mode=overlay" {
+	# Overlay whiteouts and mounting the overlayfs both require root.
+	requires root
+
+	image-verify "${IMAGE}"
+
+	# Unpack the image as an overlay.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --mode=overlay "$BUNDLE"
+	[ "$status" -eq 0 ]
+
+	# Each layer has its own directory, and the rootfs is only a mountpoint.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	nlayers="$(jq -r '.layers | length' "$IMAGE/blobs/sha256/$manifest")"
+	[ "$(ls "$BUNDLE/layers" | wc -l)" -eq "$nlayers" ]
+	[ -z "$(ls -A "$ROOTFS")" ]
+	[ -x "$BUNDLE/mount-rootfs" ]
+	sane_run jq -r '.overlay' "$BUNDLE/umoci.json"
+	[ "$status" -eq 0 ]
+	[[ "$output" == "true" ]]
+
+	# Modify the mounted rootfs.
+	"$BUNDLE/mount-rootfs"
+	[ -d "$ROOTFS/etc" ]
+	echo "overlay" > "$ROOTFS/overlay-file"
+	rm -rf "$ROOTFS/etc"
+	umount "$ROOTFS"
+
+	# The changes are in the upper directory, and repacking doesn't need a
+	# diff of the rootfs.
+	[ -f "$BUNDLE/upper/overlay-file" ]
+	umoci repack --image "${IMAGE}:${TAG}-overlay" --refresh-bundle "$BUNDLE"
+	[ "$status" -eq 0 ]
+	image-verify "${IMAGE}"
+	[ "$(ls "$BUNDLE/layers" | wc -l)" -eq "$((nlayers + 1))" ]
+	[ -z "$(ls -A "$BUNDLE/upper")" ]
+
+	# The new image contains the changes.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}-overlay" "$BUNDLE"
+	[ "$status" -eq 0 ]
+	bundle-verify "$BUNDLE"
+	[[ "$(cat "$ROOTFS/overlay-file")" == "overlay" ]]
+	! [ -e "$ROOTFS/etc" ]
+
+	# Overlay bundles can't be unpacked rootless.
+	new_bundle_rootfs
+	umoci unpack --image "${IMAGE}:${TAG}" --mode=overlay --rootless "$BUNDLE"
+	[ "$status" -ne 0 ]
+
+	image-verify "${IMAGE}"
+}
@@ -0,0 +1,99 @@
+#!/usr/bin/env bats -t
+# umoci: Umoci Modifies Open Containers' Images
+# Copyright (C) 2016-2019 SUSE LLC.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#   http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load helpers
+
+function setup() {
+	setup_tmpdirs
+	setup_image
+}
+
+function teardown() {
+	teardown_tmpdirs
+	teardown_image
+}
+
+@test "umoci verify" {
+	# A valid image has no problems.
+	umoci verify --image "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	umoci verify --image "${IMAGE}:${TAG}"
+	[ "$status" -eq 0 ]
+
+	# Truncate the largest layer of the image, and remove its config.
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	layer=$(jq -r '.layers | max_by(.size) | .digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	truncate -s 0 "$IMAGE/blobs/sha256/$layer"
+	rm -f "$IMAGE/blobs/sha256/$config"
+
+	# Both problems must be reported.
+	umoci verify --image "${IMAGE}"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "sha256:$config ($TAG): blob is missing"
+	echo "$output" | grep "sha256:$layer ($TAG): digest mismatch"
+
+	umoci verify --image "${IMAGE}:${TAG}"
+	[ "$status" -ne 0 ]
+}
+
+@test "umoci verify --diff-ids --orphans" {
+	umoci gc --layout "${IMAGE}"
+	[ "$status" -eq 0 ]
+	umoci verify --diff-ids --orphans --image "${IMAGE}"
+	[ "$status" -eq 0 ]
+	[ -z "$output" ]
+
+	# Corrupt the diff_ids of the image.
+	umoci stat --image "${IMAGE}:${TAG}" --json
+	[ "$status" -eq 0 ]
+	layer="$(echo "$output" | jq -r '.history | map(select(.layer != null)) | .[-1].layer.digest')"
+	umoci config --image "${IMAGE}:${TAG}" --tag "${TAG}-bad"
+	[ "$status" -eq 0 ]
+	manifest=$(jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-bad"'") | .digest' "$IMAGE/index.json" | cut -d: -f2)
+	config=$(jq -r '.config.digest' "$IMAGE/blobs/sha256/$manifest" | cut -d: -f2)
+	newconfig="$(setup_tmpdir)/config.json"
+	jq -cM '.rootfs.diff_ids[-1] = "sha256:'"$(printf 'bad' | sha256sum | cut -d' ' -f1)"'"' "$IMAGE/blobs/sha256/$config" > "$newconfig"
+	newdigest="$(sha256sum "$newconfig" | cut -d' ' -f1)"
+	cp "$newconfig" "$IMAGE/blobs/sha256/$newdigest"
+	jq -cM '.config.digest = "sha256:'"$newdigest"'" | .config.size = '"$(stat -c %s "$newconfig")" "$IMAGE/blobs/sha256/$manifest" > "$newconfig"
+	newmanifest="$(sha256sum "$newconfig" | cut -d' ' -f1)"
+	cp "$newconfig" "$IMAGE/blobs/sha256/$newmanifest"
+	jq -cM '(.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "'"$TAG-bad"'")) |= (.digest = "sha256:'"$newmanifest"'" | .size = '"$(stat -c %s "$newconfig")"')' "$IMAGE/index.json" > "$newconfig"
+	mv "$newconfig" "$IMAGE/index.json"
+
+	# Add an orphaned blob.
+	echo "orphan" > "$IMAGE/blobs/sha256/$(echo "orphan" | sha256sum | cut -d' ' -f1)"
+
+	# Neither problem is reported by default.
+	umoci verify --image "${IMAGE}"
+	[ "$status" -eq 0 ]
+
+	umoci verify --diff-ids --image "${IMAGE}:${TAG}-bad"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "$layer ($TAG-bad): diff_id mismatch"
+
+	umoci verify --orphans --image "${IMAGE}"
+	[ "$status" -ne 0 ]
+	echo "$output" | grep "orphaned blob is not referenced by any image"
+}
+
+@test "umoci verify [missing tag]" {
+	umoci verify --image "${IMAGE}:${TAG}-nonexistent"
+	[ "$status" -ne 0 ]
+}
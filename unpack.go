@@ -19,36 +19,115 @@ package umoci
 
 import (
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"path/filepath"
+	"strconv"
 
 	"github.com/apex/log"
 	"github.com/openSUSE/umoci/oci/casext"
 	"github.com/openSUSE/umoci/oci/layer"
-	"github.com/openSUSE/umoci/pkg/fseval"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
+// resolveUnpackFrom resolves fromName to the descriptor path of the image
+// manifest which is unpacked by Unpack. If fromName refers to an index, the
+// manifest for the given platform is used (or casext.DefaultPlatform, if
+// platform is nil).
+func resolveUnpackFrom(engineExt casext.Engine, fromName string, platform *ispec.Platform) (casext.DescriptorPath, error) {
+	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	if err != nil {
+		return casext.DescriptorPath{}, errors.Wrap(err, "get descriptor")
+	}
+	if len(fromDescriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Errorf("tag is not found: %s", fromName)
+	}
+	// If the tag refers to an index, pick the manifest for the platform.
+	selected := casext.DefaultPlatform()
+	if platform != nil {
+		selected = *platform
+	}
+	fromDescriptorPaths = casext.SelectPlatform(fromDescriptorPaths, selected)
+	if len(fromDescriptorPaths) == 0 {
+		return casext.DescriptorPath{}, errors.Errorf("tag has no manifest for platform %s/%s: %s", selected.OS, selected.Architecture, fromName)
+	}
+	if len(fromDescriptorPaths) != 1 {
+		// TODO: Handle this more nicely.
+		return casext.DescriptorPath{}, errors.Errorf("tag is ambiguous: %s", fromName)
+	}
+	return fromDescriptorPaths[0], nil
+}
+
+// ResolveUnpackUpTo returns the number of layers of the image referenced by
+// fromName which must be unpacked (see layer.UnpackOptions.UpTo) in order
+// to unpack the image up to the layer given by upTo -- which is either the
+// (1-based) index of the layer, or the digest of the layer. If fromName refers
+// to an index, the manifest for the given platform is used (see
+// layer.UnpackOptions.Platform).
+func ResolveUnpackUpTo(engineExt casext.Engine, fromName string, upTo string, platform *ispec.Platform) (int, error) {
+	from, err := resolveUnpackFrom(engineExt, fromName, platform)
+	if err != nil {
+		return 0, err
+	}
+	manifestBlob, err := engineExt.FromDescriptor(context.Background(), from.Descriptor())
+	if err != nil {
+		return 0, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return 0, errors.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType)
+	}
+
+	if n, err := strconv.Atoi(upTo); err == nil {
+		if n < 1 || n > len(manifest.Layers) {
+			return 0, errors.Errorf("layer %d is out of range: image has %d layers", n, len(manifest.Layers))
+		}
+		return n, nil
+	}
+	for idx, layerDescriptor := range manifest.Layers {
+		if layerDescriptor.Digest.String() == upTo || layerDescriptor.Digest.Encoded() == upTo {
+			return idx + 1, nil
+		}
+	}
+	return 0, errors.Errorf("layer %s is not in the image", upTo)
+}
+
 // Unpack unpacks an image to the specified bundle path.
 func Unpack(engineExt casext.Engine, fromName string, bundlePath string, mapOptions layer.MapOptions, callback layer.AfterLayerUnpackCallback, startFrom ispec.Descriptor) error {
+	return UnpackWithOptions(engineExt, fromName, bundlePath, layer.UnpackOptions{
+		MapOptions:       mapOptions,
+		AfterLayerUnpack: callback,
+		StartFrom:        startFrom,
+	})
+}
+
+// UnpackWithOptions is the same as Unpack, except that all of the options
+// are given by unpackOptions (see layer.UnpackOptions). This is the
+// equivalent of umoci-unpack(1). Only unpackOptions.MapOptions is saved in
+// the bundle metadata. If
+// unpackOptions.UpTo is set, only that many layers of the image are unpacked
+// and the bundle records the last layer that was unpacked (so that
+// umoci-repack(1) adds the new layer directly on top of it).
+func UnpackWithOptions(engineExt casext.Engine, fromName string, bundlePath string, unpackOptions layer.UnpackOptions) error {
 	var meta Meta
 	meta.Version = MetaVersion
-	meta.MapOptions = mapOptions
+	meta.MapOptions = unpackOptions.MapOptions
 
-	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
+	var err error
+	meta.From, err = resolveUnpackFrom(engineExt, fromName, unpackOptions.Platform)
 	if err != nil {
-		return errors.Wrap(err, "get descriptor")
+		return err
 	}
-	if len(fromDescriptorPaths) == 0 {
-		return errors.Errorf("tag is not found: %s", fromName)
+	platform := casext.DefaultPlatform()
+	if unpackOptions.Platform != nil {
+		platform = *unpackOptions.Platform
 	}
-	if len(fromDescriptorPaths) != 1 {
-		// TODO: Handle this more nicely.
-		return errors.Errorf("tag is ambiguous: %s", fromName)
+	if fromPlatform := meta.From.Descriptor().Platform; fromPlatform != nil {
+		meta.Platform = fromPlatform
 	}
-	meta.From = fromDescriptorPaths[0]
 
 	manifestBlob, err := engineExt.FromDescriptor(context.Background(), meta.From.Descriptor())
 	if err != nil {
@@ -60,7 +139,7 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, mapOpti
 		return errors.Wrap(fmt.Errorf("descriptor does not point to ispec.MediaTypeImageManifest: not implemented: %s", manifestBlob.Descriptor.MediaType), "invalid --image tag")
 	}
 
-	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mtreeName := bundleMtreeName(meta.From.Descriptor().Digest)
 	log.WithFields(log.Fields{
 		"bundle": bundlePath,
 		"ref":    fromName,
@@ -74,6 +153,15 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, mapOpti
 		return errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
 	}
 
+	if upTo := unpackOptions.UpTo; upTo != 0 {
+		if upTo < 0 || upTo > len(manifest.Layers) {
+			return errors.Errorf("cannot unpack up to layer %d: image has %d layers", upTo, len(manifest.Layers))
+		}
+		lastLayer := manifest.Layers[upTo-1]
+		meta.UpTo = &lastLayer
+		log.Infof("only unpacking up to layer %d of %d: %s", upTo, len(manifest.Layers), meta.UpTo.Digest)
+	}
+
 	// Unpack the runtime bundle.
 	if err := os.MkdirAll(bundlePath, 0755); err != nil {
 		return errors.Wrap(err, "create bundle path")
@@ -81,24 +169,32 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, mapOpti
 	// XXX: We should probably defer os.RemoveAll(bundlePath).
 
 	log.Info("unpacking bundle ...")
-	if err := layer.UnpackManifest(context.Background(), engineExt, bundlePath, manifest, &meta.MapOptions, callback, startFrom); err != nil {
+	if err := layer.UnpackManifestWithOptions(context.Background(), engineExt, bundlePath, manifest, &unpackOptions); err != nil {
 		return errors.Wrap(err, "create runtime bundle")
 	}
 	log.Info("... done")
 
-	fsEval := fseval.DefaultFsEval
-	if meta.MapOptions.Rootless {
-		fsEval = fseval.RootlessFsEval
-	}
+	fsEval := mapFsEval(meta.MapOptions)
 
 	if err := GenerateBundleManifest(mtreeName, bundlePath, fsEval); err != nil {
 		return errors.Wrap(err, "write mtree")
 	}
 
+	meta.DiffIDs, err = imageDiffIDs(context.Background(), engineExt, meta.From, platform)
+	if err != nil {
+		return errors.Wrap(err, "get image diff_ids")
+	}
+	if upTo := unpackOptions.UpTo; upTo != 0 && len(meta.DiffIDs) > upTo {
+		meta.DiffIDs = meta.DiffIDs[:upTo]
+	}
+	meta.Provenance = newProvenance(fromName)
+
 	log.WithFields(log.Fields{
 		"version":     meta.Version,
 		"from":        meta.From,
+		"up_to":       meta.UpTo,
 		"map_options": meta.MapOptions,
+		"provenance":  meta.Provenance,
 	}).Debugf("umoci: saving Meta metadata")
 
 	if err := WriteBundleMeta(bundlePath, meta); err != nil {
@@ -108,3 +204,117 @@ func Unpack(engineExt casext.Engine, fromName string, bundlePath string, mapOpti
 	log.Infof("unpacked image bundle: %s", bundlePath)
 	return nil
 }
+
+// UnpackDelta unpacks only the changes in the image referenced by fromName
+// relative to the image referenced by baseName to the specified bundle path.
+// The root filesystem of the bundle contains every file which was added or
+// modified, as well as whiteouts (empty files with a ".wh." prefix, as in a
+// layer) for every file which was removed. The runtime configuration is
+// generated from fromName as usual, but since the bundle doesn't contain a
+// complete root filesystem it cannot be repacked. If either image is a
+// multi-platform index, the manifest for unpackOptions.Platform (or the
+// default platform) is used.
+func UnpackDelta(engineExt casext.Engine, fromName string, baseName string, bundlePath string, unpackOptions layer.UnpackOptions) error {
+	var meta Meta
+	meta.Version = MetaVersion
+	meta.MapOptions = unpackOptions.MapOptions
+
+	// Both images are resolved using the same platform, so that the delta is
+	// between the matching manifests of multi-platform images.
+	var err error
+	meta.From, err = resolveUnpackFrom(engineExt, fromName, unpackOptions.Platform)
+	if err != nil {
+		return err
+	}
+	if fromPlatform := meta.From.Descriptor().Platform; fromPlatform != nil {
+		meta.Platform = fromPlatform
+	}
+	base, err := resolveUnpackFrom(engineExt, baseName, unpackOptions.Platform)
+	if err != nil {
+		return errors.Wrap(err, "resolve base image")
+	}
+	meta.Base = &base
+
+	fromManifest, err := descriptorManifest(engineExt, meta.From.Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "resolve image")
+	}
+	baseManifest, err := descriptorManifest(engineExt, meta.Base.Descriptor())
+	if err != nil {
+		return errors.Wrap(err, "resolve base image")
+	}
+
+	log.WithFields(log.Fields{
+		"bundle": bundlePath,
+		"ref":    fromName,
+		"base":   baseName,
+		"rootfs": layer.RootfsName,
+	}).Debugf("umoci: unpacking OCI image delta")
+
+	// Unpack the runtime bundle.
+	if err := os.MkdirAll(bundlePath, 0755); err != nil {
+		return errors.Wrap(err, "create bundle path")
+	}
+	// See layer.UnpackManifest for why we do this.
+	if err := os.Chmod(bundlePath, 0700); err != nil {
+		return errors.Wrap(err, "chmod bundle 0700")
+	}
+
+	configPath := filepath.Join(bundlePath, "config.json")
+	rootfsPath := filepath.Join(bundlePath, layer.RootfsName)
+	for _, path := range []string{configPath, rootfsPath} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", path)
+			}
+			return errors.Wrap(err, "bundle path empty")
+		}
+	}
+
+	log.Info("unpacking bundle delta ...")
+	if err := computeDelta(engineExt, baseManifest, engineExt, fromManifest, meta.MapOptions, func(delta io.Reader, fullRootfs string) error {
+		if err := os.Mkdir(rootfsPath, 0755); err != nil {
+			return errors.Wrap(err, "mkdir rootfs")
+		}
+		if err := layer.UnpackDeltaLayer(rootfsPath, delta, &unpackOptions); err != nil {
+			return errors.Wrap(err, "unpack delta layer")
+		}
+
+		// The runtime configuration has to be generated using the complete
+		// root filesystem (to resolve users and groups).
+		configFile, err := os.Create(configPath)
+		if err != nil {
+			return errors.Wrap(err, "open config.json")
+		}
+		defer configFile.Close()
+		return errors.Wrap(layer.UnpackRuntimeJSON(context.Background(), engineExt, configFile, fullRootfs, fromManifest, &meta.MapOptions), "unpack config.json")
+	}); err != nil {
+		// Don't leave a broken rootfs behind.
+		fsEval := mapFsEval(meta.MapOptions)
+		// #nosec G104
+		_ = fsEval.RemoveAll(rootfsPath)
+		return errors.Wrap(err, "create runtime bundle")
+	}
+	log.Info("... done")
+
+	// There is no mtree manifest for delta bundles.
+	meta.Provenance = &Provenance{
+		UmociVersion: UmociVersion,
+		Reference:    fromName,
+	}
+
+	log.WithFields(log.Fields{
+		"version":     meta.Version,
+		"from":        meta.From,
+		"base":        meta.Base,
+		"map_options": meta.MapOptions,
+		"provenance":  meta.Provenance,
+	}).Debugf("umoci: saving Meta metadata")
+
+	if err := WriteBundleMeta(bundlePath, meta); err != nil {
+		return errors.Wrap(err, "write umoci.json metadata")
+	}
+
+	log.Infof("unpacked image bundle delta: %s", bundlePath)
+	return nil
+}
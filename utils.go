@@ -24,15 +24,20 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/tabwriter"
+	"text/template"
 
 	"github.com/apex/log"
 	"github.com/docker/go-units"
+	"github.com/openSUSE/umoci/mutate"
 	"github.com/openSUSE/umoci/oci/casext"
 	igen "github.com/openSUSE/umoci/oci/config/generate"
 	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
 	"github.com/openSUSE/umoci/pkg/idtools"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -66,16 +71,68 @@ var MtreeKeywords = []mtree.Keyword{
 // bundles extracted by umoci.
 const MetaName = "umoci.json"
 
-// MetaVersion is the version of Meta supported by this code. The
-// value is only bumped for updates which are not backwards compatible.
-const MetaVersion = "2"
+// MetaVersion is the version of Meta written by this code. The value is
+// bumped whenever the format changes, so that older versions of umoci refuse to
+// use bundles with metadata they don't understand (rather than silently
+// ignoring it).
+const MetaVersion = "3"
+
+// compatibleMetaVersions are the older versions of Meta which can still be
+// read by ReadBundleMeta. Any fields added since those versions are left
+// unset.
+var compatibleMetaVersions = map[string]struct{}{
+	"2": {},
+}
+
+// UmociVersion is the version of umoci recorded in the metadata of bundles
+// created by Unpack (see Provenance). It is set by the umoci command-line tool,
+// and is empty otherwise.
+var UmociVersion = ""
+
+// Provenance records how a bundle was created, so that images created from it
+// with umoci-repack(1) can be traced back to their source.
+type Provenance struct {
+	// UmociVersion is the version of umoci which created the bundle, if known.
+	UmociVersion string `json:"umoci_version,omitempty"`
+
+	// Reference is the name of the reference the bundle was created from,
+	// such as the tag given as the --image argument to umoci-unpack(1).
+	Reference string `json:"reference"`
+
+	// MtreeKeywords is the set of keywords used to generate the mtree
+	// manifest of the bundle, which must also be used to compute the diff of
+	// the bundle. It is empty if the bundle has no mtree manifest.
+	MtreeKeywords []mtree.Keyword `json:"mtree_keywords,omitempty"`
+}
+
+// newProvenance returns the Provenance of a bundle created by this version of
+// umoci from the given reference.
+func newProvenance(reference string) *Provenance {
+	keywords := make([]mtree.Keyword, len(MtreeKeywords))
+	copy(keywords, MtreeKeywords)
+	return &Provenance{
+		UmociVersion:  UmociVersion,
+		Reference:     reference,
+		MtreeKeywords: keywords,
+	}
+}
+
+// mtreeKeywords returns the keywords used to generate the mtree manifest of
+// the bundle. Bundles which don't record them were created with MtreeKeywords.
+func (m Meta) mtreeKeywords() []mtree.Keyword {
+	if m.Provenance != nil && len(m.Provenance.MtreeKeywords) > 0 {
+		return m.Provenance.MtreeKeywords
+	}
+	return MtreeKeywords
+}
 
 // Meta represents metadata about how umoci unpacked an image to a bundle
 // and other similar information. It is used to keep track of information that
 // is required when repacking an image and other similar bundle information.
 type Meta struct {
-	// Version is the version of umoci used to unpack the bundle. This is used
-	// to future-proof the umoci.json information.
+	// Version is the version of the umoci.json format (see MetaVersion). This
+	// is used to future-proof the umoci.json information. Note that despite
+	// the name, this is not the version of umoci (see Provenance).
 	Version string `json:"umoci_version"`
 
 	// From is a copy of the descriptor pointing to the image manifest that was
@@ -89,6 +146,41 @@ type Meta struct {
 	// umoci-repack(1) calls, changing them is not recommended and so the
 	// default should be that they are the same.
 	MapOptions layer.MapOptions `json:"map_options"`
+
+	// Base is a copy of the descriptor pointing to the image manifest given as
+	// the --base argument to umoci-unpack(1). If set, the bundle only
+	// contains the delta from Base to From and so cannot be repacked.
+	Base *casext.DescriptorPath `json:"base_descriptor_path,omitempty"`
+
+	// Platform is the platform of the manifest that was unpacked, if it was
+	// selected from an index. It is used to find the same manifest when From
+	// refers to an index.
+	Platform *ispec.Platform `json:"platform,omitempty"`
+
+	// DiffIDs is a copy of the rootfs.diff_ids of the image configuration of
+	// From (only up to UpTo, if set). It is used to check that a different
+	// base image given to umoci-repack(1) with --base still contains the
+	// layers the bundle was unpacked from (even if From is no longer present
+	// in the image).
+	DiffIDs []digest.Digest `json:"diff_ids,omitempty"`
+
+	// UpTo is the descriptor of the last layer of From that was extracted, if
+	// the bundle was unpacked with --upto. The layers of From above it are not
+	// part of the bundle, and are removed by umoci-repack(1) before adding the
+	// new layer (see TruncateToBundle).
+	UpTo *ispec.Descriptor `json:"up_to_layer,omitempty"`
+
+	// Provenance records which version of umoci created the bundle and from
+	// which reference. It is not set for bundles created by umoci-unpack(1)
+	// before version 3 of the umoci.json format.
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// Overlay is set if the bundle was unpacked with --mode=overlay. The
+	// layers of such bundles are extracted to separate directories and the
+	// rootfs is an overlayfs mount of them (see UnpackOverlay), so the new
+	// layer is generated from the overlayfs upper directory rather than from
+	// an mtree diff of the rootfs.
+	Overlay bool `json:"overlay,omitempty"`
 }
 
 // WriteTo writes a JSON-serialised version of Meta to the given io.Writer.
@@ -121,6 +213,10 @@ func ReadBundleMeta(bundle string) (Meta, error) {
 	defer fh.Close()
 
 	err = json.NewDecoder(fh).Decode(&meta)
+	if _, compatible := compatibleMetaVersions[meta.Version]; compatible && err == nil {
+		log.Debugf("upgrading umoci.json from version %s to %s", meta.Version, MetaVersion)
+		meta.Version = MetaVersion
+	}
 	if meta.Version != MetaVersion {
 		if err == nil {
 			err = fmt.Errorf("unsupported umoci.json version: %s", meta.Version)
@@ -137,8 +233,39 @@ type ManifestStat struct {
 	//       equivalent of docker-history(1). We really need to add more
 	//       information about it.
 
+	// Manifest is the descriptor of the manifest.
+	Manifest ispec.Descriptor `json:"manifest"`
+
+	// Platform is the platform of the manifest. If the manifest was selected
+	// from an index which specified a platform that platform is used,
+	// otherwise it is taken from the image configuration (if the
+	// configuration specifies one).
+	Platform *ispec.Platform `json:"platform,omitempty"`
+
+	// ArtifactType is the "artifactType" of the manifest, or "" if the
+	// manifest doesn't have one.
+	ArtifactType string `json:"artifact_type,omitempty"`
+
+	// Annotations are the annotations of the manifest.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Config is the runtime configuration (such as the environment,
+	// entrypoint and labels) from the image configuration.
+	Config ispec.ImageConfig `json:"config"`
+
 	// History stores the history information for the manifest.
 	History []historyStat `json:"history"`
+
+	// Layers stores information about each of the layers in the manifest
+	// (from the bottom-most layer upwards).
+	Layers []layerStat `json:"layers"`
+
+	// LayersSize is the total (compressed) size of the layer blobs.
+	LayersSize int64 `json:"layers_size"`
+
+	// Size is the total size of the image, including the manifest and config
+	// blobs as well as the layer blobs.
+	Size int64 `json:"size"`
 }
 
 // Format formats a ManifestStat using the default formatting, and writes the
@@ -147,19 +274,35 @@ type ManifestStat struct {
 //       define their own custom templates for different blocks (meaning that
 //       this should use text/template rather than using tabwriters manually.
 func (ms ManifestStat) Format(w io.Writer) error {
+	// Output platform and artifact type (if any).
+	if ms.Platform != nil {
+		fmt.Fprintf(w, "PLATFORM: %s\n\n", casext.FormatPlatform(*ms.Platform))
+	}
+	if ms.ArtifactType != "" {
+		fmt.Fprintf(w, "ARTIFACT TYPE: %s\n\n", ms.ArtifactType)
+	}
+
+	// Output the runtime configuration and annotations (if any).
+	if err := ms.formatConfig(w); err != nil {
+		return err
+	}
+
 	// Output history information.
 	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
 	fmt.Fprintf(tw, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
 	for _, histEntry := range ms.History {
 		var (
-			created   = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
+			created   = "<none>"
 			createdBy = strings.Replace(histEntry.CreatedBy, "\t", " ", -1)
 			comment   = strings.Replace(histEntry.Comment, "\t", " ", -1)
 			layerID   = "<none>"
 			size      = "<none>"
 		)
 
-		if !histEntry.EmptyLayer {
+		if histEntry.Created != nil {
+			created = strings.Replace(histEntry.Created.Format(igen.ISO8601), "\t", " ", -1)
+		}
+		if histEntry.Layer != nil {
 			layerID = histEntry.Layer.Digest.String()
 			size = units.HumanSize(float64(histEntry.Layer.Size))
 		}
@@ -167,6 +310,131 @@ func (ms ManifestStat) Format(w io.Writer) error {
 		// TODO: We need to truncate some of the fields.
 		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", layerID, created, createdBy, size, comment)
 	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// Output the layer breakdown, with the history entry which created each
+	// layer (counting from 0, as in the image configuration).
+	fmt.Fprintf(w, "\n")
+	tw = tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "LAYER\tMEDIA TYPE\tSIZE\tHISTORY\n")
+	for _, layerEntry := range ms.Layers {
+		history := "<none>"
+		if layerEntry.History >= 0 {
+			history = fmt.Sprintf("%d", layerEntry.History)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", layerEntry.Layer.Digest, layerEntry.Layer.MediaType, units.HumanSize(float64(layerEntry.Layer.Size)), history)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nTOTAL: %d layers, %s (%s including manifest and config)\n", len(ms.Layers), units.HumanSize(float64(ms.LayersSize)), units.HumanSize(float64(ms.Size)))
+	return nil
+}
+
+// formatConfig writes a human-readable summary of the runtime configuration
+// and annotations of the ManifestStat, followed by an empty line. Nothing is
+// written if none of the summarised fields are set.
+func (ms ManifestStat) formatConfig(w io.Writer) error {
+	var lines [][2]string
+	if len(ms.Config.Entrypoint) > 0 {
+		entrypoint, _ := json.Marshal(ms.Config.Entrypoint)
+		lines = append(lines, [2]string{"ENTRYPOINT", string(entrypoint)})
+	}
+	if len(ms.Config.Cmd) > 0 {
+		cmd, _ := json.Marshal(ms.Config.Cmd)
+		lines = append(lines, [2]string{"CMD", string(cmd)})
+	}
+	if ms.Config.User != "" {
+		lines = append(lines, [2]string{"USER", ms.Config.User})
+	}
+	if ms.Config.WorkingDir != "" {
+		lines = append(lines, [2]string{"WORKDIR", ms.Config.WorkingDir})
+	}
+	for _, env := range ms.Config.Env {
+		lines = append(lines, [2]string{"ENV", env})
+	}
+	for _, key := range sortedKeys(ms.Config.Labels) {
+		lines = append(lines, [2]string{"LABEL", key + "=" + ms.Config.Labels[key]})
+	}
+	for _, key := range sortedKeys(ms.Annotations) {
+		lines = append(lines, [2]string{"ANNOTATION", key + "=" + ms.Annotations[key]})
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	for _, line := range lines {
+		fmt.Fprintf(tw, "%s:\t%s\n", line[0], strings.Replace(line[1], "\t", " ", -1))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n")
+	return nil
+}
+
+// sortedKeys returns the keys of the given map in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statTemplateFuncs are the functions (in addition to the text/template
+// builtins) available to templates parsed with ParseStatTemplate.
+var statTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":      strings.Join,
+	"humanSize": func(size int64) string { return units.HumanSize(float64(size)) },
+}
+
+// ParseStatTemplate parses a text/template for formatting a ManifestStat with
+// FormatTemplate. In addition to the builtin functions, templates can use
+// "json" (to encode a value as JSON), "join" (strings.Join) and "humanSize"
+// (to format a size in bytes).
+func ParseStatTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("stat").Funcs(statTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse stat template")
+	}
+	return tmpl, nil
+}
+
+// FormatTemplate executes the given template (see ParseStatTemplate) with the
+// ManifestStat, and writes the result (followed by a newline) to the given
+// writer. The fields available to the template are the same as those in the
+// JSON encoding of the ManifestStat, using the Go field names.
+func (ms ManifestStat) FormatTemplate(w io.Writer, tmpl *template.Template) error {
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, ms); err != nil {
+		return errors.Wrap(err, "execute stat template")
+	}
+	buffer.WriteString("\n")
+	_, err := buffer.WriteTo(w)
+	return err
+}
+
+// FormatChainIDs writes a human-readable table of the layers in the
+// ManifestStat (from the bottom-most layer upwards) together with their
+// DiffIDs and ChainIDs.
+func (ms ManifestStat) FormatChainIDs(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 4, 2, 1, ' ', 0)
+	fmt.Fprintf(tw, "LAYER\tDIFF ID\tCHAIN ID\n")
+	for _, histEntry := range ms.History {
+		if histEntry.EmptyLayer {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", histEntry.Layer.Digest, histEntry.DiffID, histEntry.ChainID)
+	}
 	return tw.Flush()
 }
 
@@ -184,10 +452,30 @@ type historyStat struct {
 	// is "", then this entry is an empty_layer.
 	DiffID string `json:"diff_id"`
 
+	// ChainID is the ChainID of the layer corresponding to the history entry
+	// (see mutate.ChainIDs). If ChainID is "", then this entry is an
+	// empty_layer.
+	ChainID string `json:"chain_id"`
+
 	// History is embedded in the stat information.
 	ispec.History
 }
 
+// layerStat contains information about a single layer of a manifest.
+type layerStat struct {
+	// Layer is the descriptor referencing where the layer is stored.
+	Layer ispec.Descriptor `json:"layer"`
+
+	// DiffID is the DiffID of the layer, or "" if the configuration has no
+	// DiffID for the layer.
+	DiffID string `json:"diff_id"`
+
+	// History is the index of the (non-empty_layer) entry in the history of
+	// the image that corresponds to the layer, or -1 if there is no such
+	// entry (such as for layers added with --no-history).
+	History int `json:"history"`
+}
+
 // Stat computes the ManifestStat for a given manifest blob. The provided
 // descriptor must refer to an OCI Manifest.
 func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.Descriptor) (ManifestStat, error) {
@@ -208,6 +496,13 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 		return stat, errors.Errorf("[internal error] unknown manifest blob type: %s", manifestBlob.Descriptor.MediaType)
 	}
 
+	// ispec.Manifest doesn't have an "artifactType" field, so we need to get
+	// it separately.
+	stat.ArtifactType, err = mutate.ManifestArtifactType(ctx, engine, manifestDescriptor)
+	if err != nil {
+		return stat, errors.Wrap(err, "stat")
+	}
+
 	// Now get the config.
 	configBlob, err := engine.FromDescriptor(ctx, manifest.Config)
 	if err != nil {
@@ -225,8 +520,10 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 	// are in the same order as the manifest.Layer entries this is fairly
 	// simple. However, we only increment the layer index if a layer was
 	// actually generated by a history entry.
+	chainIDs := mutate.ChainIDs(config)
+	layerHistory := map[int]int{}
 	layerIdx := 0
-	for _, histEntry := range config.History {
+	for histIdx, histEntry := range config.History {
 		info := historyStat{
 			History: histEntry,
 			DiffID:  "",
@@ -235,21 +532,67 @@ func Stat(ctx context.Context, engine casext.Engine, manifestDescriptor ispec.De
 
 		// Only fill the other information and increment layerIdx if it's a
 		// non-empty layer.
-		if !histEntry.EmptyLayer {
+		if !histEntry.EmptyLayer && layerIdx < len(manifest.Layers) && layerIdx < len(config.RootFS.DiffIDs) {
 			info.DiffID = config.RootFS.DiffIDs[layerIdx].String()
+			info.ChainID = chainIDs[layerIdx].String()
 			info.Layer = &manifest.Layers[layerIdx]
+			layerHistory[layerIdx] = histIdx
 			layerIdx++
 		}
 
 		stat.History = append(stat.History, info)
 	}
 
+	stat.Manifest = manifestDescriptor
+	stat.Annotations = manifest.Annotations
+	stat.Config = config.Config
+
+	// Generate the layer breakdown of the image.
+	stat.Platform = manifestDescriptor.Platform
+	if stat.Platform == nil && config.OS != "" && config.Architecture != "" {
+		stat.Platform = &ispec.Platform{
+			OS:           config.OS,
+			Architecture: config.Architecture,
+		}
+	}
+	stat.Size = manifestDescriptor.Size + manifest.Config.Size
+	for idx, layerDescriptor := range manifest.Layers {
+		info := layerStat{
+			Layer:   layerDescriptor,
+			History: -1,
+		}
+		if idx < len(config.RootFS.DiffIDs) {
+			info.DiffID = config.RootFS.DiffIDs[idx].String()
+		}
+		if histIdx, ok := layerHistory[idx]; ok {
+			info.History = histIdx
+		}
+		stat.Layers = append(stat.Layers, info)
+		stat.LayersSize += layerDescriptor.Size
+	}
+	stat.Size += stat.LayersSize
+
 	return stat, nil
 }
 
+// bundleMtreeName returns the name (without the ".mtree" suffix) of the mtree
+// manifest stored in a bundle for the given manifest digest. The name is of
+// the form <algorithm>_<encoded>, so that it is a valid filename regardless of
+// the digest algorithm used.
+func bundleMtreeName(manifestDigest digest.Digest) string {
+	return manifestDigest.Algorithm().String() + "_" + manifestDigest.Encoded()
+}
+
 // GenerateBundleManifest creates and writes an mtree of the rootfs in the given
 // bundle path, using the supplied fsEval method
 func GenerateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.FsEval) error {
+	return generateBundleManifest(context.Background(), mtreeName, bundlePath, fsEval, 1, nil)
+}
+
+// generateBundleManifest is GenerateBundleManifest, except that the file
+// digests are computed by up to jobs concurrent workers and are looked up in
+// (and added to) cache, if it is non-nil (see WalkMtree).
+func generateBundleManifest(ctx context.Context, mtreeName string, bundlePath string, fsEval mtree.FsEval, jobs int, cache *MtreeCache) error {
 	mtreePath := filepath.Join(bundlePath, mtreeName+".mtree")
 	fullRootfsPath := filepath.Join(bundlePath, layer.RootfsName)
 
@@ -259,7 +602,7 @@ func GenerateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.Fs
 	}).Debugf("umoci: generating mtree manifest")
 
 	log.Info("computing filesystem manifest ...")
-	dh, err := mtree.Walk(fullRootfsPath, nil, MtreeKeywords, fsEval)
+	dh, err := WalkMtree(ctx, fullRootfsPath, MtreeKeywords, fsEval, jobs, cache, nil)
 	if err != nil {
 		return errors.Wrap(err, "generate mtree spec")
 	}
@@ -281,11 +624,102 @@ func GenerateBundleManifest(mtreeName string, bundlePath string, fsEval mtree.Fs
 	return nil
 }
 
+// CheckRootless returns an error if the given rootless mode is inconsistent
+// with the effective uid of the current process. Using rootless mode as root,
+// or not using rootless mode as an unprivileged user, results in the
+// ownership of files being misinterpreted when unpacking or generating
+// layers.
+func CheckRootless(rootless bool) error {
+	euid := os.Geteuid()
+	if rootless && euid == 0 {
+		return errors.Errorf("rootless mode is enabled but umoci is running as root")
+	}
+	if !rootless && euid != 0 {
+		return errors.Errorf("rootless mode is disabled but umoci is running as an unprivileged user (euid %d)", euid)
+	}
+	return nil
+}
+
+// mapFsEval returns the FsEval to use for accessing files with the given
+// mapping options.
+func mapFsEval(mapOptions layer.MapOptions) fseval.FsEval {
+	if mapOptions.Rootless {
+		return fseval.RootlessFsEval
+	}
+	return fseval.DefaultFsEval
+}
+
+// parseRootlessFlags returns the rootless mode requested with --rootless or
+// --no-rootless, and whether either flag was specified.
+func parseRootlessFlags(ctx *cli.Context) (rootless bool, isSet bool, _ error) {
+	if ctx.Bool("rootless") && ctx.Bool("no-rootless") {
+		return false, false, errors.Errorf("--rootless and --no-rootless are mutually exclusive")
+	}
+	return ctx.Bool("rootless"), ctx.Bool("rootless") || ctx.Bool("no-rootless"), nil
+}
+
+// ParseRootlessOverride returns the rootless mode requested with --rootless
+// or --no-rootless, or nil if neither flag was specified (see
+// CheckBundleRootless).
+func ParseRootlessOverride(ctx *cli.Context) (*bool, error) {
+	rootless, isSet, err := parseRootlessFlags(ctx)
+	if err != nil || !isSet {
+		return nil, err
+	}
+	return &rootless, nil
+}
+
+// CheckBundleRootless checks that the rootless mode recorded in the metadata
+// of a bundle is consistent with the effective uid of the current process
+// (see CheckRootless). If rootless is non-nil, it overrides the recorded mode
+// and an inconsistency only results in a warning.
+func CheckBundleRootless(meta *Meta, rootless *bool) error {
+	if rootless == nil {
+		if err := CheckRootless(meta.MapOptions.Rootless); err != nil {
+			return errors.Wrap(err, "bundle was unpacked with a different rootless mode (use --rootless or --no-rootless to override)")
+		}
+		return nil
+	}
+
+	if *rootless != meta.MapOptions.Rootless {
+		log.Warnf("overriding rootless mode recorded in bundle (rootless=%v) with rootless=%v", meta.MapOptions.Rootless, *rootless)
+	}
+	meta.MapOptions.Rootless = *rootless
+	if err := CheckRootless(*rootless); err != nil {
+		log.Warnf("%v", err)
+	}
+	return nil
+}
+
+// ParseBundleRootless is the same as CheckBundleRootless, except that the
+// override is given with --rootless or --no-rootless.
+func ParseBundleRootless(meta *Meta, ctx *cli.Context) error {
+	rootless, err := ParseRootlessOverride(ctx)
+	if err != nil {
+		return err
+	}
+	return CheckBundleRootless(meta, rootless)
+}
+
 // ParseIdmapOptions sets up the mapping options for Meta, using
-// the arguments specified on the command line
+// the arguments specified on the command line. If neither --rootless nor
+// --no-rootless is specified, rootless mode is enabled if the current process
+// is not running as root.
 func ParseIdmapOptions(meta *Meta, ctx *cli.Context) error {
+	rootless, isSet, err := parseRootlessFlags(ctx)
+	if err != nil {
+		return err
+	}
+	if isSet {
+		if err := CheckRootless(rootless); err != nil {
+			log.Warnf("%v", err)
+		}
+	} else if rootless = os.Geteuid() != 0; rootless {
+		log.Info("not running as root: enabling rootless mode")
+	}
+
 	// We need to set mappings if we're in rootless mode.
-	meta.MapOptions.Rootless = ctx.Bool("rootless")
+	meta.MapOptions.Rootless = rootless
 	if meta.MapOptions.Rootless {
 		if !ctx.IsSet("uid-map") {
 			if err := ctx.Set("uid-map", fmt.Sprintf("0:%d:1", os.Geteuid())); err != nil {
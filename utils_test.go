@@ -0,0 +1,371 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestStatLayers(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestStatLayers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("hostname"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, &ispec.History{CreatedBy: "pack"}); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	// Add a second layer without a history entry.
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(ctx, engineExt, "latest", bundle, meta, mutator, RepackOptions{}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("failed to resolve tag: %v", err)
+	}
+	manifestDescriptor := descriptorPaths[0].Descriptor()
+	manifest, err := resolveManifest(engineExt, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms, err := Stat(ctx, engineExt, manifestDescriptor)
+	if err != nil {
+		t.Fatalf("unexpected error computing stat: %+v", err)
+	}
+	if len(ms.Layers) != len(manifest.Layers) || len(ms.Layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(ms.Layers))
+	}
+
+	layersSize := int64(0)
+	for idx, layerStat := range ms.Layers {
+		if layerStat.Layer.Digest != manifest.Layers[idx].Digest {
+			t.Errorf("layer %d: expected digest %s, got %s", idx, manifest.Layers[idx].Digest, layerStat.Layer.Digest)
+		}
+		if layerStat.DiffID == "" {
+			t.Errorf("layer %d: missing diff_id", idx)
+		}
+		layersSize += manifest.Layers[idx].Size
+	}
+	if ms.Layers[0].History < 0 || ms.History[ms.Layers[0].History].CreatedBy != "pack" {
+		t.Errorf("first layer has incorrect history correlation: %d", ms.Layers[0].History)
+	}
+	if ms.Layers[1].History != -1 {
+		t.Errorf("layer without history entry has history correlation: %d", ms.Layers[1].History)
+	}
+	if ms.LayersSize != layersSize {
+		t.Errorf("expected layers size %d, got %d", layersSize, ms.LayersSize)
+	}
+	if expected := layersSize + manifestDescriptor.Size + manifest.Config.Size; ms.Size != expected {
+		t.Errorf("expected total size %d, got %d", expected, ms.Size)
+	}
+
+	var output bytes.Buffer
+	if err := ms.Format(&output); err != nil {
+		t.Fatalf("unexpected error formatting stat: %+v", err)
+	}
+	for _, layerDescriptor := range manifest.Layers {
+		if !strings.Contains(output.String(), layerDescriptor.Digest.String()+" "+layerDescriptor.MediaType) {
+			t.Errorf("formatted stat missing layer %s:\n%s", layerDescriptor.Digest, output.String())
+		}
+	}
+	if !strings.Contains(output.String(), "TOTAL: 2 layers") {
+		t.Errorf("formatted stat missing totals:\n%s", output.String())
+	}
+}
+
+func TestStatConfig(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestStatConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	config := ispec.ImageConfig{
+		Env:        []string{"PATH=/bin", "FOO=bar"},
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Labels:     map[string]string{"b": "2", "a": "1"},
+	}
+	if err := Pack(engineExt, "latest", rootfs, config, mutate.Meta{OS: "linux", Architecture: "arm64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	descriptorPaths, err := engineExt.ResolveReference(ctx, "latest")
+	if err != nil || len(descriptorPaths) != 1 {
+		t.Fatalf("failed to resolve tag: %v", err)
+	}
+	manifestDescriptor := descriptorPaths[0].Descriptor()
+
+	ms, err := Stat(ctx, engineExt, manifestDescriptor)
+	if err != nil {
+		t.Fatalf("unexpected error computing stat: %+v", err)
+	}
+	if ms.Manifest.Digest != manifestDescriptor.Digest {
+		t.Errorf("expected manifest %s, got %s", manifestDescriptor.Digest, ms.Manifest.Digest)
+	}
+	if ms.Platform == nil || ms.Platform.OS != "linux" || ms.Platform.Architecture != "arm64" {
+		t.Errorf("expected platform from config, got %v", ms.Platform)
+	}
+	if !reflect.DeepEqual(ms.Config.Env, config.Env) || !reflect.DeepEqual(ms.Config.Entrypoint, config.Entrypoint) || !reflect.DeepEqual(ms.Config.Labels, config.Labels) {
+		t.Errorf("expected config %#v, got %#v", config, ms.Config)
+	}
+
+	var output bytes.Buffer
+	if err := ms.Format(&output); err != nil {
+		t.Fatalf("unexpected error formatting stat: %+v", err)
+	}
+	for _, expected := range []string{
+		"PLATFORM: linux/arm64",
+		`ENTRYPOINT: ["/bin/sh","-c"]`,
+		"ENV:        PATH=/bin",
+		"LABEL:      a=1\nLABEL:      b=2",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("formatted stat missing %q:\n%s", expected, output.String())
+		}
+	}
+
+	for _, test := range []struct {
+		template string
+		expected string
+	}{
+		{`{{.Platform.OS}}/{{.Platform.Architecture}}`, "linux/arm64\n"},
+		{`{{json .Config.Entrypoint}}`, `["/bin/sh","-c"]` + "\n"},
+		{`{{join .Config.Env ","}}`, "PATH=/bin,FOO=bar\n"},
+		{`{{index .Config.Labels "b"}} {{len .Layers}}`, "2 1\n"},
+		{`{{humanSize 2048}}`, "2.048kB\n"},
+	} {
+		tmpl, err := ParseStatTemplate(test.template)
+		if err != nil {
+			t.Errorf("unexpected error parsing template %q: %+v", test.template, err)
+			continue
+		}
+		output.Reset()
+		if err := ms.FormatTemplate(&output, tmpl); err != nil {
+			t.Errorf("unexpected error executing template %q: %+v", test.template, err)
+			continue
+		}
+		if output.String() != test.expected {
+			t.Errorf("template %q: expected %q, got %q", test.template, test.expected, output.String())
+		}
+	}
+
+	if _, err := ParseStatTemplate("{{.Config"); err == nil {
+		t.Errorf("expected error parsing invalid template")
+	}
+	tmpl, err := ParseStatTemplate("{{.DoesNotExist}}")
+	if err != nil {
+		t.Fatalf("unexpected error parsing template: %+v", err)
+	}
+	if err := ms.FormatTemplate(&output, tmpl); err == nil {
+		t.Errorf("expected error executing template with unknown field")
+	}
+}
+
+func TestReadBundleMetaVersions(t *testing.T) {
+	bundle, err := ioutil.TempDir("", "umoci-TestReadBundleMetaVersions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bundle)
+
+	for _, test := range []struct {
+		name    string
+		version string
+		valid   bool
+	}{
+		{"Current", MetaVersion, true},
+		{"Compatible", "2", true},
+		{"Old", "1", false},
+		{"Future", "999", false},
+		{"Missing", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			data := `{"umoci_version": "` + test.version + `", "from_descriptor_path": {"descriptor_walk": []}, "map_options": {}}`
+			if err := ioutil.WriteFile(filepath.Join(bundle, MetaName), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := ReadBundleMeta(bundle)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("expected error reading umoci.json version %q", test.version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error reading umoci.json version %q: %+v", test.version, err)
+			}
+			if meta.Version != MetaVersion {
+				t.Errorf("metadata was not upgraded: expected version %s, got %s", MetaVersion, meta.Version)
+			}
+			if meta.Provenance != nil {
+				t.Errorf("unexpected provenance: %#v", meta.Provenance)
+			}
+			if got := meta.mtreeKeywords(); !reflect.DeepEqual(got, MtreeKeywords) {
+				t.Errorf("unexpected mtree keywords: expected %v, got %v", MtreeKeywords, got)
+			}
+		})
+	}
+}
+
+func TestUnpackProvenance(t *testing.T) {
+	root, err := ioutil.TempDir("", "umoci-TestUnpackProvenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "latest", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+
+	oldUmociVersion := UmociVersion
+	UmociVersion = "1.2.3~test"
+	defer func() { UmociVersion = oldUmociVersion }()
+
+	bundle := filepath.Join(root, "bundle")
+	if err := Unpack(engineExt, "latest", bundle, layer.MapOptions{}, nil, ispec.Descriptor{}); err != nil {
+		t.Fatalf("unexpected error unpacking image: %+v", err)
+	}
+	meta, err := ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Provenance{
+		UmociVersion:  "1.2.3~test",
+		Reference:     "latest",
+		MtreeKeywords: MtreeKeywords,
+	}
+	if !reflect.DeepEqual(meta.Provenance, expected) {
+		t.Errorf("unexpected provenance: expected %#v, got %#v", expected, meta.Provenance)
+	}
+
+	// Refreshing the bundle records the new reference.
+	if err := ioutil.WriteFile(filepath.Join(bundle, layer.RootfsName, "etc", "new"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mutator, err := mutate.New(engineExt, meta.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RepackWithMutator(context.Background(), engineExt, "new", bundle, meta, mutator, RepackOptions{RefreshBundle: true}); err != nil {
+		t.Fatalf("unexpected error repacking: %+v", err)
+	}
+	meta, err = ReadBundleMeta(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Provenance == nil || meta.Provenance.Reference != "new" {
+		t.Errorf("provenance was not refreshed: %#v", meta.Provenance)
+	}
+}
+
+func TestBundleMtreeName(t *testing.T) {
+	for _, test := range []struct {
+		digest   digest.Digest
+		expected string
+	}{
+		{digest.SHA256.FromString("foo"), "sha256_" + digest.SHA256.FromString("foo").Encoded()},
+		{digest.SHA512.FromString("foo"), "sha512_" + digest.SHA512.FromString("foo").Encoded()},
+	} {
+		if got := bundleMtreeName(test.digest); got != test.expected {
+			t.Errorf("bundleMtreeName(%s): expected %s, got %s", test.digest, test.expected, got)
+		}
+	}
+}
+
+func TestCheckRootless(t *testing.T) {
+	isRoot := os.Geteuid() == 0
+
+	if err := CheckRootless(!isRoot); err != nil {
+		t.Errorf("CheckRootless(%v) as euid %d: unexpected error: %+v", !isRoot, os.Geteuid(), err)
+	}
+	if err := CheckRootless(isRoot); err == nil {
+		t.Errorf("CheckRootless(%v) as euid %d: expected an error", isRoot, os.Geteuid())
+	}
+}
@@ -0,0 +1,401 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/openSUSE/umoci/oci/cas"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/casext/mediatype"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/hardening"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// VerifyProblem describes a single inconsistency in an image found by Verify.
+type VerifyProblem struct {
+	// Reference is the reference name of the index.json entry through which
+	// the problematic descriptor was reached ("" if the entry has no
+	// reference name, or if the problem is with index.json itself).
+	Reference string
+
+	// Descriptor is the descriptor with the problem. If the problem is with
+	// index.json itself, Descriptor is empty.
+	Descriptor ispec.Descriptor
+
+	// Problem is a description of the problem.
+	Problem string
+}
+
+// String formats the problem in a human-readable way.
+func (p VerifyProblem) String() string {
+	location := "index.json"
+	if p.Descriptor.Digest != "" {
+		location = p.Descriptor.Digest.String()
+	}
+	if p.Reference != "" {
+		location = fmt.Sprintf("%s (%s)", location, p.Reference)
+	}
+	return location + ": " + p.Problem
+}
+
+// VerifyOptions are optional (and more expensive) checks done by
+// VerifyWithOptions.
+type VerifyOptions struct {
+	// DiffIDs causes every layer to be decompressed, to check that its DiffID
+	// matches the corresponding rootfs.diff_ids entry of the configuration.
+	// Layers which umoci cannot decompress (such as encrypted layers) are
+	// skipped.
+	DiffIDs bool
+
+	// Orphans causes every blob in the image which is not reachable from
+	// index.json to be reported as a problem (along with whether it matches
+	// its digest). It is ignored if only a single reference is verified.
+	Orphans bool
+}
+
+// verifyState stores the state of a Verify call.
+type verifyState struct {
+	engine   casext.Engine
+	opt      VerifyOptions
+	problems []VerifyProblem
+
+	// verified is the set of descriptors which have already been verified
+	// (see verifyKey), to avoid re-reading blobs shared between images.
+	verified map[string]struct{}
+
+	// broken is the set of descriptors (see verifyKey) with problems, whose
+	// contents are not checked any further.
+	broken map[string]struct{}
+
+	// reachable is the set of digests referenced from index.json.
+	reachable map[digest.Digest]struct{}
+}
+
+// problem records a new problem.
+func (vs *verifyState) problem(reference string, descriptor ispec.Descriptor, format string, args ...interface{}) {
+	problem := VerifyProblem{
+		Reference:  reference,
+		Descriptor: descriptor,
+		Problem:    fmt.Sprintf(format, args...),
+	}
+	log.Debugf("verify: %s", problem)
+	vs.problems = append(vs.problems, problem)
+	vs.broken[verifyKey(descriptor)] = struct{}{}
+}
+
+// readBlob reads the blob referenced by descriptor, checking that it exists
+// and matches the descriptor's digest and size. If the blob has a parseable
+// media type, the parsed blob is returned (and nil otherwise). If the blob is
+// inconsistent, the problem is recorded and nil is returned.
+func (vs *verifyState) readBlob(ctx context.Context, reference string, descriptor ispec.Descriptor) (interface{}, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		vs.problem(reference, descriptor, "invalid digest: %v", err)
+		return nil, nil
+	}
+	if descriptor.Size < 0 {
+		vs.problem(reference, descriptor, "invalid size %d", descriptor.Size)
+		return nil, nil
+	}
+
+	reader, err := vs.engine.GetBlob(ctx, descriptor.Digest)
+	if err != nil {
+		if isNotExist(err) {
+			vs.problem(reference, descriptor, "blob is missing")
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "get blob %s", descriptor.Digest)
+	}
+	defer reader.Close()
+
+	// Only blobs which we can parse are kept in memory.
+	parser := mediatype.GetParser(descriptor.MediaType)
+	var buffer bytes.Buffer
+	var output io.Writer = ioutil.Discard
+	if parser != nil {
+		output = &buffer
+	}
+
+	digester := descriptor.Digest.Algorithm().Digester()
+	size, err := io.Copy(io.MultiWriter(output, digester.Hash()), reader)
+	if err != nil && errors.Cause(err) != hardening.ErrDigestMismatch {
+		return nil, errors.Wrapf(err, "read blob %s", descriptor.Digest)
+	}
+	if actual := digester.Digest(); actual != descriptor.Digest {
+		vs.problem(reference, descriptor, "digest mismatch: blob has digest %s", actual)
+		return nil, nil
+	}
+	if size != descriptor.Size {
+		vs.problem(reference, descriptor, "size mismatch: blob has size %d (descriptor has size %d)", size, descriptor.Size)
+		return nil, nil
+	}
+
+	if parser == nil {
+		return nil, nil
+	}
+	data, err := parser(&buffer)
+	if err != nil {
+		vs.problem(reference, descriptor, "cannot parse %s blob: %v", descriptor.MediaType, err)
+		return nil, nil
+	}
+	return data, nil
+}
+
+// verifyManifest checks that the layers of a manifest are consistent with the
+// configuration it references, which is returned (or nil, if the configuration
+// has a problem).
+func (vs *verifyState) verifyManifest(ctx context.Context, reference string, descriptor ispec.Descriptor, manifest ispec.Manifest) (*ispec.Image, error) {
+	if manifest.SchemaVersion != 2 {
+		vs.problem(reference, descriptor, "manifest has unsupported schemaVersion %d", manifest.SchemaVersion)
+	}
+	if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		vs.problem(reference, descriptor, "manifest config has unexpected media type %s", manifest.Config.MediaType)
+		return nil, nil
+	}
+
+	configData, err := vs.readBlob(ctx, reference, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	config, ok := configData.(ispec.Image)
+	if !ok {
+		// The problem with the config has already been recorded.
+		return nil, nil
+	}
+
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		vs.problem(reference, descriptor, "manifest has %d layers but config has %d diff_ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	if len(config.History) > 0 {
+		if nonEmpty := countNonEmptyHistory(config.History); nonEmpty != len(manifest.Layers) {
+			vs.problem(reference, descriptor, "manifest has %d layers but config has %d non-empty history entries", len(manifest.Layers), nonEmpty)
+		}
+	}
+
+	return &config, nil
+}
+
+// verifyDiffID checks that the DiffID of the layer referenced by
+// layerDescriptor is diffID. The layer blob itself must already have been
+// verified, and is skipped if it had any problems.
+func (vs *verifyState) verifyDiffID(ctx context.Context, reference string, layerDescriptor ispec.Descriptor, diffID digest.Digest) error {
+	if !layer.IsSupportedLayerType(layerDescriptor.MediaType) {
+		log.Debugf("verify: skipping diff_id of %s layer %s", layerDescriptor.MediaType, layerDescriptor.Digest)
+		return nil
+	}
+	if _, ok := vs.broken[verifyKey(layerDescriptor)]; ok {
+		return nil
+	}
+	key := verifyKey(layerDescriptor) + "=" + diffID.String()
+	if _, ok := vs.verified[key]; ok {
+		return nil
+	}
+	vs.verified[key] = struct{}{}
+
+	if err := diffID.Validate(); err != nil {
+		vs.problem(reference, layerDescriptor, "config has invalid diff_id %q: %v", diffID, err)
+		return nil
+	}
+	actual, err := layer.DiffIDWithAlgorithm(ctx, vs.engine, layerDescriptor, diffID.Algorithm())
+	if err != nil {
+		vs.problem(reference, layerDescriptor, "cannot compute diff_id: %v", err)
+		return nil
+	}
+	if actual != diffID {
+		vs.problem(reference, layerDescriptor, "diff_id mismatch: layer has diff_id %s (config has %s)", actual, diffID)
+	}
+	return nil
+}
+
+// verifyOrphans reports every blob in the image which is not reachable from
+// index.json, checking whether each one matches its digest.
+func (vs *verifyState) verifyOrphans(ctx context.Context) error {
+	blobs, err := vs.engine.ListBlobs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list blobs")
+	}
+	for _, blob := range blobs {
+		if _, ok := vs.reachable[blob]; ok {
+			continue
+		}
+		reader, err := vs.engine.GetBlob(ctx, blob)
+		if err != nil {
+			return errors.Wrapf(err, "get blob %s", blob)
+		}
+		digester := blob.Algorithm().Digester()
+		size, err := io.Copy(digester.Hash(), reader)
+		// #nosec G104
+		_ = reader.Close()
+		if err != nil && errors.Cause(err) != hardening.ErrDigestMismatch {
+			return errors.Wrapf(err, "read blob %s", blob)
+		}
+		descriptor := ispec.Descriptor{Digest: blob, Size: size}
+		if actual := digester.Digest(); actual != blob {
+			vs.problem("", descriptor, "orphaned blob is not referenced by any image, and has digest %s", actual)
+		} else {
+			vs.problem("", descriptor, "orphaned blob is not referenced by any image")
+		}
+	}
+	return nil
+}
+
+// verifyKey returns the key used to check whether a descriptor has already
+// been verified. Two descriptors referencing the same blob may still differ in
+// media type or size, and so need to be verified separately.
+func verifyKey(descriptor ispec.Descriptor) string {
+	return fmt.Sprintf("%s@%s:%d", descriptor.MediaType, descriptor.Digest, descriptor.Size)
+}
+
+// verify recursively verifies the blob referenced by descriptor, and all of
+// the blobs it references.
+func (vs *verifyState) verify(ctx context.Context, reference string, descriptor ispec.Descriptor) error {
+	key := verifyKey(descriptor)
+	if _, ok := vs.verified[key]; ok {
+		return nil
+	}
+	vs.verified[key] = struct{}{}
+	vs.reachable[descriptor.Digest] = struct{}{}
+
+	data, err := vs.readBlob(ctx, reference, descriptor)
+	if err != nil || data == nil {
+		return err
+	}
+
+	var config *ispec.Image
+	manifest, isManifest := data.(ispec.Manifest)
+	if isManifest {
+		config, err = vs.verifyManifest(ctx, reference, descriptor, manifest)
+		if err != nil {
+			return err
+		}
+		// The config has been verified by verifyManifest.
+		vs.verified[verifyKey(manifest.Config)] = struct{}{}
+		vs.reachable[manifest.Config.Digest] = struct{}{}
+	}
+
+	var children []ispec.Descriptor
+	if err := casext.MapDescriptors(data, func(child ispec.Descriptor) ispec.Descriptor {
+		children = append(children, child)
+		return child
+	}); err != nil {
+		return errors.Wrapf(err, "find children of %s", descriptor.Digest)
+	}
+	for _, child := range children {
+		if err := vs.verify(ctx, reference, child); err != nil {
+			return err
+		}
+	}
+
+	// The DiffIDs are only checked once the layers themselves have been
+	// verified, so that broken layers are skipped.
+	if config != nil && vs.opt.DiffIDs {
+		for idx, layerDescriptor := range manifest.Layers {
+			if idx >= len(config.RootFS.DiffIDs) {
+				break
+			}
+			if err := vs.verifyDiffID(ctx, reference, layerDescriptor, config.RootFS.DiffIDs[idx]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Verify checks that the image is internally consistent: that index.json is
+// well-formed, that every blob referenced (recursively) from index.json
+// exists and matches the digest and size of its descriptor, and that the
+// number of layers of every manifest matches the number of diff_ids and
+// non-empty history entries of its configuration. Every problem found is
+// returned (rather than stopping at the first one). If refname is non-empty,
+// only the index.json entries with that reference name are verified. An error
+// is only returned if the image could not be read. See VerifyWithOptions for
+// more thorough checks.
+func Verify(ctx context.Context, engineExt casext.Engine, refname string) ([]VerifyProblem, error) {
+	return VerifyWithOptions(ctx, engineExt, refname, VerifyOptions{})
+}
+
+// VerifyWithOptions is the same as Verify, but also does the extra checks
+// enabled in opt.
+func VerifyWithOptions(ctx context.Context, engineExt casext.Engine, refname string, opt VerifyOptions) ([]VerifyProblem, error) {
+	vs := &verifyState{
+		engine:    engineExt,
+		opt:       opt,
+		verified:  map[string]struct{}{},
+		broken:    map[string]struct{}{},
+		reachable: map[digest.Digest]struct{}{},
+	}
+
+	index, err := engineExt.GetIndex(ctx)
+	if err != nil {
+		vs.problem("", ispec.Descriptor{}, "cannot read index: %v", err)
+		return vs.problems, nil
+	}
+	if index.SchemaVersion != 2 {
+		vs.problem("", ispec.Descriptor{}, "index has unsupported schemaVersion %d", index.SchemaVersion)
+	}
+
+	found := false
+	for _, descriptor := range index.Manifests {
+		reference := descriptor.Annotations[ispec.AnnotationRefName]
+		if refname != "" && reference != refname {
+			continue
+		}
+		found = true
+		if reference != "" && !casext.IsValidReferenceName(reference) {
+			vs.problem(reference, descriptor, "invalid reference name")
+		}
+		if err := vs.verify(ctx, reference, descriptor); err != nil {
+			return nil, err
+		}
+	}
+	if refname != "" && !found {
+		return nil, errors.Wrapf(cas.ErrNotExist, "verify reference %s", refname)
+	}
+	if opt.Orphans && refname == "" {
+		if err := vs.verifyOrphans(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return vs.problems, nil
+}
+
+// isNotExist returns whether the error indicates that a blob doesn't exist.
+func isNotExist(err error) bool {
+	return errors.Cause(err) == cas.ErrNotExist || os.IsNotExist(errors.Cause(err))
+}
+
+// countNonEmptyHistory returns the number of entries in the given history
+// which correspond to a layer.
+func countNonEmptyHistory(history []ispec.History) int {
+	n := 0
+	for _, entry := range history {
+		if !entry.EmptyLayer {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,233 @@
+/*
+ * umoci: Umoci Modifies Open Containers' Images
+ * Copyright (C) 2016-2019 SUSE LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package umoci
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestVerify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	engineExt, err := CreateLayout(filepath.Join(root, "image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	layerData := []byte("not really a layer")
+	layerDigest, layerSize, err := engineExt.PutBlob(ctx, bytes.NewReader(layerData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	}
+
+	good := putTestManifest(t, engineExt, []ispec.Descriptor{layer}, 1)
+	if err := engineExt.UpdateReference(ctx, "good", good); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Verify(ctx, engineExt, "")
+	if err != nil {
+		t.Fatalf("unexpected error verifying image: %+v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems with valid image: %v", problems)
+	}
+
+	missingLayer := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageLayer,
+		Digest:    digest.FromString("missing layer"),
+		Size:      13,
+	}
+	wrongSizeLayer := layer
+	wrongSizeLayer.Size++
+
+	// A manifest with every layer broken, and which doesn't match its config.
+	bad := putTestManifest(t, engineExt, []ispec.Descriptor{missingLayer, wrongSizeLayer}, 1)
+	if err := engineExt.UpdateReference(ctx, "bad", bad); err != nil {
+		t.Fatal(err)
+	}
+	// A manifest whose blob doesn't match its digest.
+	corrupt := putTestManifest(t, engineExt, []ispec.Descriptor{layer}, 1)
+	corrupt.Digest = digest.FromString("corrupt manifest")
+	if err := ioutil.WriteFile(filepath.Join(root, "image", "blobs", corrupt.Digest.Algorithm().String(), corrupt.Digest.Encoded()), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := engineExt.UpdateReference(ctx, "corrupt", corrupt); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err = Verify(ctx, engineExt, "")
+	if err != nil {
+		t.Fatalf("unexpected error verifying image: %+v", err)
+	}
+	expected := []struct {
+		reference string
+		digest    digest.Digest
+		problem   string
+	}{
+		{"bad", bad.Digest, "manifest has 2 layers but config has 1 diff_ids"},
+		{"bad", missingLayer.Digest, "blob is missing"},
+		{"bad", wrongSizeLayer.Digest, "size mismatch"},
+		{"corrupt", corrupt.Digest, "digest mismatch"},
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for idx, want := range expected {
+		got := problems[idx]
+		if got.Reference != want.reference || got.Descriptor.Digest != want.digest || !strings.HasPrefix(got.Problem, want.problem) {
+			t.Errorf("problem %d: expected %s (%s): %q, got %v", idx, want.digest, want.reference, want.problem, got)
+		}
+	}
+
+	// Only the requested reference is verified.
+	problems, err = Verify(ctx, engineExt, "good")
+	if err != nil {
+		t.Fatalf("unexpected error verifying image: %+v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems with valid reference: %v", problems)
+	}
+	if _, err := Verify(ctx, engineExt, "nonexistent"); err == nil {
+		t.Errorf("expected an error verifying a nonexistent reference")
+	}
+}
+
+func TestVerifyOptions(t *testing.T) {
+	ctx := context.Background()
+
+	root, err := ioutil.TempDir("", "umoci-TestVerifyOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	rootfs := filepath.Join(root, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "file"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	imagePath := filepath.Join(root, "image")
+	engineExt, err := CreateLayout(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engineExt.Close()
+
+	if err := Pack(engineExt, "good", rootfs, ispec.ImageConfig{}, mutate.Meta{OS: "linux", Architecture: "amd64"}, layer.MapOptions{}, nil); err != nil {
+		t.Fatalf("unexpected error packing rootfs: %+v", err)
+	}
+	if err := engineExt.GC(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := VerifyOptions{DiffIDs: true, Orphans: true}
+	problems, err := VerifyWithOptions(ctx, engineExt, "", opt)
+	if err != nil {
+		t.Fatalf("unexpected error verifying image: %+v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems with valid image: %v", problems)
+	}
+
+	// A manifest whose config has the wrong diff_id for an intact layer.
+	manifest, err := resolveManifest(engineExt, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerDescriptor := manifest.Layers[0]
+	bad := putTestManifest(t, engineExt, []ispec.Descriptor{layerDescriptor}, 1)
+	if err := engineExt.UpdateReference(ctx, "bad", bad); err != nil {
+		t.Fatal(err)
+	}
+
+	// An orphaned blob, and an orphaned blob which doesn't match its digest.
+	orphan, _, err := engineExt.PutBlob(ctx, bytes.NewReader([]byte("orphaned blob")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := digest.FromString("corrupt orphaned blob")
+	if err := ioutil.WriteFile(filepath.Join(imagePath, "blobs", corrupt.Algorithm().String(), corrupt.Encoded()), []byte("something else"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the options, none of these are problems.
+	problems, err = Verify(ctx, engineExt, "")
+	if err != nil {
+		t.Fatalf("unexpected error verifying image: %+v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems without options: %v", problems)
+	}
+
+	problems, err = VerifyWithOptions(ctx, engineExt, "", opt)
+	if err != nil {
+		t.Fatalf("unexpected error verifying image: %+v", err)
+	}
+	found := map[digest.Digest]string{}
+	for _, problem := range problems {
+		found[problem.Descriptor.Digest] = problem.Problem
+	}
+	if len(problems) != 3 {
+		t.Errorf("expected 3 problems, got %d: %v", len(problems), problems)
+	}
+	if got := found[layerDescriptor.Digest]; !strings.HasPrefix(got, "diff_id mismatch") {
+		t.Errorf("expected diff_id mismatch for %s, got %q", layerDescriptor.Digest, got)
+	}
+	if got := found[orphan]; got != "orphaned blob is not referenced by any image" {
+		t.Errorf("expected orphaned blob %s to be reported, got %q", orphan, got)
+	}
+	if got := found[corrupt]; !strings.HasPrefix(got, "orphaned blob is not referenced by any image, and has digest") {
+		t.Errorf("expected corrupt orphaned blob %s to be reported, got %q", corrupt, got)
+	}
+
+	// Orphans are only reported when verifying the whole image.
+	problems, err = VerifyWithOptions(ctx, engineExt, "good", opt)
+	if err != nil {
+		t.Fatalf("unexpected error verifying image: %+v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems with valid reference: %v", problems)
+	}
+}